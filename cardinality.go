@@ -0,0 +1,141 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// The values of cardinality_limit_overflow, which decides what happens to
+// metrics in new contexts once the cardinality limit is reached.
+const (
+	// cardinalityOverflowAggregate aggregates them into one context for
+	// each metric name, tagged with cardinalityOverflowTag.
+	cardinalityOverflowAggregate = "aggregate"
+	// cardinalityOverflowDrop drops them.
+	cardinalityOverflowDrop = "drop"
+)
+
+const cardinalityOverflowTag = "cardinality_overflow:true"
+
+// cardinalityLimiter limits the number of unique metric contexts (metric
+// names with their tags) that a worker aggregates in each interval. A
+// worker's limiter is only used with the worker's mutex held.
+type cardinalityLimiter struct {
+	// budgets are the limits for the prefixes, longest prefix first;
+	// the last one is for the metrics that don't match any of them
+	budgets []cardinalityBudget
+	// headroom is the smallest limit: while there are fewer contexts
+	// than that in total, none of the limits can have been reached
+	headroom  int
+	aggregate bool
+
+	total    int
+	overflow int
+}
+
+type cardinalityBudget struct {
+	prefix   string
+	limit    int
+	contexts int
+}
+
+// newCardinalityLimiter makes the limiter for one of workers workers. The
+// limits are for all of them, so each worker gets its share. It returns
+// nil if there's no limit.
+func newCardinalityLimiter(limit int, prefixLimits map[string]int, overflow string, workers int) (*cardinalityLimiter, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	cl := &cardinalityLimiter{}
+	switch overflow {
+	case "", cardinalityOverflowAggregate:
+		cl.aggregate = true
+	case cardinalityOverflowDrop:
+	default:
+		return nil, fmt.Errorf("unknown cardinality_limit_overflow %q", overflow)
+	}
+
+	share := func(limit int) int {
+		if limit = limit / workers; limit < 1 {
+			return 1
+		}
+		return limit
+	}
+	for prefix, limit := range prefixLimits {
+		cl.budgets = append(cl.budgets, cardinalityBudget{prefix: prefix, limit: share(limit)})
+	}
+	sort.Slice(cl.budgets, func(i, j int) bool {
+		if len(cl.budgets[i].prefix) != len(cl.budgets[j].prefix) {
+			return len(cl.budgets[i].prefix) > len(cl.budgets[j].prefix)
+		}
+		return cl.budgets[i].prefix < cl.budgets[j].prefix
+	})
+	cl.budgets = append(cl.budgets, cardinalityBudget{limit: share(limit)})
+
+	cl.headroom = cl.budgets[0].limit
+	for _, b := range cl.budgets {
+		if b.limit < cl.headroom {
+			cl.headroom = b.limit
+		}
+	}
+	return cl, nil
+}
+
+// budget returns the budget that the metric name counts against.
+func (cl *cardinalityLimiter) budget(name string) *cardinalityBudget {
+	for i := range cl.budgets[:len(cl.budgets)-1] {
+		if strings.HasPrefix(name, cl.budgets[i].prefix) {
+			return &cl.budgets[i]
+		}
+	}
+	return &cl.budgets[len(cl.budgets)-1]
+}
+
+// created counts a new context for the metric name.
+func (cl *cardinalityLimiter) created(name string) {
+	cl.total++
+	cl.budget(name).contexts++
+}
+
+// reset forgets the contexts, when a new interval starts.
+func (cl *cardinalityLimiter) reset() {
+	cl.total = 0
+	cl.overflow = 0
+	for i := range cl.budgets {
+		cl.budgets[i].contexts = 0
+	}
+}
+
+// admitMetric checks a metric against the worker's cardinality limit. If
+// it's in a new context and its budget is used up, it's either rewritten
+// into its name's overflow context, or dropped, in which case
+// admitMetric returns false. The caller must hold the worker's mutex.
+func (w *Worker) admitMetric(m *samplers.UDPMetric) bool {
+	cl := w.cardinality
+	if cl.total < cl.headroom || w.wm.contains(m.MetricKey, m.Scope) {
+		return true
+	}
+	b := cl.budget(m.Name)
+	if b.contexts < b.limit {
+		return true
+	}
+
+	w.overflowed++
+	if !cl.aggregate {
+		return false
+	}
+	m.MetricKey.JoinedTags = cardinalityOverflowTag
+	m.Tags = []string{cardinalityOverflowTag}
+	if !w.wm.contains(m.MetricKey, m.Scope) {
+		// the overflow contexts are bounded too, in case the
+		// metric names themselves are what's unbounded
+		if cl.overflow >= b.limit {
+			return false
+		}
+		cl.overflow++
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package veneur
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func processPackets(t testing.TB, w *Worker, packets ...string) {
+	for _, packet := range packets {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		w.ProcessMetric(m)
+	}
+}
+
+func TestCardinalityLimitAggregate(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	var err error
+	w.cardinality, err = newCardinalityLimiter(2, nil, "", 1)
+	require.NoError(t, err)
+
+	processPackets(t, w,
+		"a:1|c|#id:1",
+		"a:1|c|#id:2",
+		"a:1|c|#id:3",
+		"a:1|c|#id:4",
+		"a:1|c|#id:1",
+	)
+	assert.Equal(t, int64(2), w.overflowed)
+	wm := w.Flush()
+	assert.Len(t, wm.counters, 3)
+	overflow := wm.counters[samplers.MetricKey{Name: "a", Type: "counter", JoinedTags: cardinalityOverflowTag}]
+	require.NotNil(t, overflow, "the new contexts should be aggregated into the overflow context")
+	assert.Equal(t, []string{cardinalityOverflowTag}, overflow.Tags)
+	metrics := overflow.Flush(0)
+	assert.Equal(t, 2.0, metrics[0].Value)
+
+	// the next interval starts afresh:
+	assert.Zero(t, w.overflowed)
+	processPackets(t, w, "a:1|c|#id:3", "a:1|c|#id:4")
+	assert.Zero(t, w.overflowed)
+}
+
+func TestCardinalityLimitDropAndPrefixes(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	var err error
+	w.cardinality, err = newCardinalityLimiter(2, map[string]int{"good.": 10, "good.but.small.": 1}, "drop", 1)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		processPackets(t, w,
+			fmt.Sprintf("bad:1|c|#id:%d", i),
+			fmt.Sprintf("good.metric:1|c|#id:%d", i),
+			fmt.Sprintf("good.but.small.metric:1|c|#id:%d", i))
+	}
+	assert.Equal(t, int64(3+4), w.overflowed)
+	wm := w.Flush()
+	assert.Len(t, wm.counters, 2+5+1)
+
+	_, err = newCardinalityLimiter(2, nil, "explode", 1)
+	assert.Error(t, err)
+	cl, err := newCardinalityLimiter(0, nil, "", 1)
+	assert.NoError(t, err)
+	assert.Nil(t, cl)
+}
+
+func BenchmarkCardinalityLimit(b *testing.B) {
+	for _, limit := range []int{0, 1000000} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			w := NewWorker(1, nil, logrus.New(), nil)
+			w.cardinality, _ = newCardinalityLimiter(limit, map[string]int{"x.": 10}, "", 1)
+			metrics := make([]*samplers.UDPMetric, 1000)
+			for i := range metrics {
+				var err error
+				metrics[i], err = samplers.ParseMetric([]byte(fmt.Sprintf("a.b.c:1|c|#id:%d", i)))
+				require.NoError(b, err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.ProcessMetric(metrics[i%len(metrics)])
+			}
+		})
+	}
+}
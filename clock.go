@@ -0,0 +1,29 @@
+package veneur
+
+import "time"
+
+// clock is where the server's flush loop gets the time, and its ticks,
+// from. Tests replace it to flush without waiting for the interval.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a channel that ticks every d, like a
+	// time.Ticker's, and the function that stops it.
+	NewTicker(d time.Duration) (ticks <-chan time.Time, stop func())
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
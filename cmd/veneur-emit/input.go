@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// DefaultMTU is the size that statsd lines read with -input are batched
+// up to in each datagram, by default: what fits in an Ethernet frame.
+const DefaultMTU = 1432
+
+// maxInputLine bounds how long lines read with -input can be.
+const maxInputLine = 1 << 20
+
+// InputConfig configures reading metrics and spans with -input.
+type InputConfig struct {
+	// SSF reads JSON-encoded SSF spans, rather than statsd lines.
+	SSF bool
+	// MTU is the size that statsd lines are batched up to in each
+	// datagram.
+	MTU int
+}
+
+// InputResult is how reading with -input went: how many lines were
+// read, how many metrics or spans were sent, and how many lines couldn't
+// be parsed.
+type InputResult struct {
+	Lines  int
+	Sent   int
+	Errors int
+}
+
+// LineError is a line that couldn't be parsed.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// parseStatsdLine checks that a line is a metric, event or service check
+// that veneur can parse.
+func parseStatsdLine(line []byte) error {
+	var err error
+	switch {
+	case bytes.HasPrefix(line, []byte("_e{")):
+		_, err = samplers.ParseEvent(line)
+	case bytes.HasPrefix(line, []byte("_sc|")):
+		_, err = samplers.ParseServiceCheck(line)
+	default:
+		_, err = samplers.ParseMetric(line)
+	}
+	return err
+}
+
+// inputSender sends what's read with -input over a single connection.
+// Statsd lines sent in datagrams are batched up to the MTU.
+type inputSender struct {
+	*loadSender
+	mtu   int
+	batch []byte
+}
+
+func (s *inputSender) sendLine(line []byte) error {
+	if s.stream != nil {
+		return s.loadSender.send(string(line), nil)
+	}
+	if len(s.batch) > 0 && len(s.batch)+1+len(line) > s.mtu {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	if len(s.batch) > 0 {
+		s.batch = append(s.batch, '\n')
+	}
+	s.batch = append(s.batch, line...)
+	return nil
+}
+
+func (s *inputSender) flush() error {
+	if len(s.batch) > 0 {
+		_, err := s.conn.Write(s.batch)
+		s.batch = s.batch[:0]
+		if err != nil {
+			return err
+		}
+	}
+	return s.loadSender.flush()
+}
+
+// runInput reads newline-delimited statsd lines, or JSON-encoded SSF
+// spans, from r, and sends them all to netAddr over a single connection.
+// Blank lines and lines starting with "#" are skipped. Lines that can't
+// be parsed aren't sent, but passed to lineErr; an error is only
+// returned if reading or sending fails.
+func runInput(r io.Reader, netAddr net.Addr, cfg InputConfig, lineErr func(*LineError)) (InputResult, error) {
+	var result InputResult
+	ls, err := newLoadSender(netAddr, cfg.SSF)
+	if err != nil {
+		return result, err
+	}
+	defer ls.conn.Close()
+	mtu := cfg.MTU
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	s := &inputSender{loadSender: ls, mtu: mtu}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxInputLine)
+	for scanner.Scan() {
+		result.Lines++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		if cfg.SSF {
+			span := &ssf.SSFSpan{}
+			if err := json.Unmarshal(line, span); err != nil {
+				result.Errors++
+				lineErr(&LineError{Line: result.Lines, Err: err})
+				continue
+			}
+			if err := s.send("", span); err != nil {
+				return result, err
+			}
+		} else {
+			if err := parseStatsdLine(line); err != nil {
+				result.Errors++
+				lineErr(&LineError{Line: result.Lines, Err: err})
+				continue
+			}
+			if err := s.sendLine(line); err != nil {
+				return result, err
+			}
+		}
+		result.Sent++
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	return result, s.flush()
+}
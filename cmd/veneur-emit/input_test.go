@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol"
+)
+
+func TestRunInputStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var input strings.Builder
+	input.WriteString("# a summary of the job\n\n")
+	for i := 0; i < 100; i++ {
+		input.WriteString("job.rows:10|c|#table:widgets\n")
+	}
+	input.WriteString("job.rows:ten|c\n")
+	input.WriteString("_sc|job.ok|0\n")
+
+	var lineErrs []*LineError
+	result, err := runInput(strings.NewReader(input.String()), conn.LocalAddr(), InputConfig{MTU: 200}, func(err *LineError) {
+		lineErrs = append(lineErrs, err)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, InputResult{Lines: 104, Sent: 101, Errors: 1}, result)
+	require.Len(t, lineErrs, 1)
+	assert.Equal(t, 103, lineErrs[0].Line)
+	assert.Contains(t, lineErrs[0].Error(), "line 103: ")
+
+	// Lines are batched into datagrams no bigger than the MTU:
+	var lines []string
+	buf := make([]byte, 2048)
+	for len(lines) < 101 {
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.True(t, n <= 200, "%d bytes", n)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	assert.Len(t, lines, 101)
+	assert.Equal(t, "job.rows:10|c|#table:widgets", lines[0])
+	assert.Equal(t, "_sc|job.ok|0", lines[100])
+}
+
+func TestRunInputSSF(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	names := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var received []string
+		for {
+			span, err := protocol.ReadSSF(conn)
+			if err != nil {
+				names <- received
+				return
+			}
+			received = append(received, span.Name)
+		}
+	}()
+
+	input := `{"id": 2, "trace_id": 1, "name": "load", "service": "batch", "start_timestamp": 1000, "end_timestamp": 2000}
+not json
+{"id": 3, "trace_id": 1, "parent_id": 2, "name": "transform", "service": "batch", "metrics": [{"metric": 1, "name": "job.rows", "value": 10}]}
+`
+	errs := 0
+	result, err := runInput(strings.NewReader(input), ln.Addr(), InputConfig{SSF: true}, func(*LineError) { errs++ })
+	require.NoError(t, err)
+	assert.Equal(t, InputResult{Lines: 3, Sent: 2, Errors: 1}, result)
+	assert.Equal(t, 1, errs)
+	assert.Equal(t, []string{"load", "transform"}, <-names)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+)
+
+// The kinds of things that load mode sends.
+const (
+	loadCounter = "counter"
+	loadGauge   = "gauge"
+	loadTimer   = "timer"
+	loadSet     = "set"
+	loadSpan    = "span"
+)
+
+// loadTick is how often each load mode worker catches up with its rate.
+const loadTick = 10 * time.Millisecond
+
+// LoadConfig describes the load that load mode generates.
+type LoadConfig struct {
+	// Rate is how many metrics and spans are sent per second, in all.
+	Rate int
+	// Duration is how long to send for, including the ramp-up.
+	Duration time.Duration
+	// RampUp is how long the rate takes to rise from 0 to Rate.
+	RampUp time.Duration
+	// Mix is the kinds of metrics and spans to send: each is sent in
+	// proportion to its weight.
+	Mix map[string]int
+	// Cardinality is how many distinct values the "series" tag takes.
+	Cardinality int
+	// Workers is how many connections the load is sent over.
+	Workers int
+
+	Name string
+	Tags map[string]string
+	SSF  bool
+}
+
+// LoadResult is what load mode managed to send.
+type LoadResult struct {
+	// Target is how many metrics and spans should have been sent.
+	Target  uint64
+	Sent    uint64
+	Errors  uint64
+	Elapsed time.Duration
+}
+
+// Achieved returns the rate that was sent at, per second.
+func (r LoadResult) Achieved() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+// parseMix parses a mix of kinds like "counter:4,timer:2,span:1". A kind
+// without a weight has a weight of 1.
+func parseMix(mix string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, elem := range strings.Split(mix, ",") {
+		if elem == "" {
+			continue
+		}
+		parts := strings.SplitN(elem, ":", 2)
+		kind, weight := parts[0], 1
+		switch kind {
+		case loadCounter, loadGauge, loadTimer, loadSet, loadSpan:
+		default:
+			return nil, fmt.Errorf("unknown kind %q in the load mix", kind)
+		}
+		if len(parts) == 2 {
+			var err error
+			weight, err = strconv.Atoi(parts[1])
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight %q for %s in the load mix", parts[1], kind)
+			}
+		}
+		weights[kind] += weight
+	}
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("the load mix %q has nothing in it", mix)
+	}
+	return weights, nil
+}
+
+// mixCycle spreads the kinds of a mix over a cycle, in proportion to
+// their weights, so that a mix of counter:2,span:1 sends a counter, then a
+// span, then a counter. Sending in a cycle keeps runs reproducible.
+func mixCycle(mix map[string]int) []string {
+	total := 0
+	for _, weight := range mix {
+		total += weight
+	}
+	cycle := make([]string, 0, total)
+	sent := map[string]int{}
+	for len(cycle) < total {
+		// Send whichever kind is furthest behind its share, in a fixed
+		// order of kinds to break ties:
+		next, behind := "", -1.0
+		for _, kind := range []string{loadCounter, loadGauge, loadTimer, loadSet, loadSpan} {
+			if sent[kind] == mix[kind] {
+				continue
+			}
+			share := float64(mix[kind]) * float64(len(cycle)+1) / float64(total)
+			if b := share - float64(sent[kind]); b > behind {
+				next, behind = kind, b
+			}
+		}
+		cycle = append(cycle, next)
+		sent[next]++
+	}
+	return cycle
+}
+
+// loadTarget returns how many things should have been sent after
+// elapsed at rate, with the rate rising linearly over rampUp.
+func loadTarget(rate float64, rampUp, elapsed time.Duration) uint64 {
+	t := elapsed.Seconds()
+	if r := rampUp.Seconds(); t < r {
+		return uint64(rate * t * t / (2 * r))
+	} else if r > 0 {
+		return uint64(rate * (t - r/2))
+	}
+	return uint64(rate * t)
+}
+
+// loadSender writes what load mode sends to a connection.
+type loadSender struct {
+	conn   net.Conn
+	stream *bufio.Writer
+	ssf    bool
+}
+
+func newLoadSender(netAddr net.Addr, useSSF bool) (*loadSender, error) {
+	conn, err := net.Dial(netAddr.Network(), netAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	s := &loadSender{conn: conn, ssf: useSSF}
+	switch netAddr.Network() {
+	case "udp", "unixgram":
+	case "tcp", "unix":
+		s.stream = bufio.NewWriter(conn)
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("can't send load over %s", netAddr.Network())
+	}
+	return s, nil
+}
+
+// send writes a statsd line, or an SSF span if the sender speaks SSF.
+func (s *loadSender) send(line string, span *ssf.SSFSpan) error {
+	if s.ssf {
+		if s.stream != nil {
+			_, err := protocol.WriteSSF(s.stream, span)
+			return err
+		}
+		packet, err := proto.Marshal(span)
+		if err != nil {
+			return err
+		}
+		_, err = s.conn.Write(packet)
+		return err
+	}
+	if s.stream != nil {
+		_, err := io.WriteString(s.stream, line+"\n")
+		return err
+	}
+	_, err := io.WriteString(s.conn, line)
+	return err
+}
+
+// flush writes what's buffered for a stream.
+func (s *loadSender) flush() error {
+	if s.stream == nil {
+		return nil
+	}
+	return s.stream.Flush()
+}
+
+// loadItem builds the i-th thing that load mode sends: as a statsd line,
+// or as an SSF span.
+func loadItem(cfg *LoadConfig, kind string, i uint64, now time.Time) (string, *ssf.SSFSpan) {
+	series := strconv.FormatUint(i%uint64(cfg.Cardinality), 10)
+	name := cfg.Name + "." + kind
+	tags := map[string]string{"series": series}
+	for k, v := range cfg.Tags {
+		tags[k] = v
+	}
+
+	if cfg.SSF {
+		span := &ssf.SSFSpan{}
+		switch kind {
+		case loadCounter:
+			span.Metrics = []*ssf.SSFSample{ssf.Count(name, 1, tags)}
+		case loadGauge:
+			span.Metrics = []*ssf.SSFSample{ssf.Gauge(name, float32(i%100), tags)}
+		case loadTimer:
+			span.Metrics = []*ssf.SSFSample{ssf.Timing(name, time.Duration(i%1000)*time.Millisecond, time.Millisecond, tags)}
+		case loadSet:
+			span.Metrics = []*ssf.SSFSample{ssf.Set(name, strconv.FormatUint(i, 10), tags)}
+		case loadSpan:
+			span.TraceId = int64(i + 1)
+			span.Id = int64(i + 1)
+			span.Name = name
+			span.Service = "veneur-emit"
+			span.StartTimestamp = now.Add(-time.Duration(i%1000) * time.Millisecond).UnixNano()
+			span.EndTimestamp = now.UnixNano()
+			span.Tags = tags
+		}
+		return "", span
+	}
+
+	var line string
+	switch kind {
+	case loadCounter:
+		line = fmt.Sprintf("%s:1|c", name)
+	case loadGauge:
+		line = fmt.Sprintf("%s:%d|g", name, i%100)
+	case loadTimer:
+		line = fmt.Sprintf("%s:%d|ms", name, i%1000)
+	case loadSet:
+		line = fmt.Sprintf("%s:%d|s", name, i)
+	}
+	tagStrs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		tagStrs = append(tagStrs, k+":"+v)
+	}
+	return line + "|#" + strings.Join(tagStrs, ","), nil
+}
+
+// runLoad sends load to an address until cfg.Duration is up, logging
+// its progress every second.
+func runLoad(netAddr net.Addr, cfg *LoadConfig) (LoadResult, error) {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.Cardinality < 1 {
+		cfg.Cardinality = 1
+	}
+	if cfg.Name == "" {
+		cfg.Name = "veneur_emit.load"
+	}
+	if cfg.Mix[loadSpan] > 0 && !cfg.SSF {
+		return LoadResult{}, fmt.Errorf("spans can only be sent with -ssf")
+	}
+	cycle := mixCycle(cfg.Mix)
+
+	senders := make([]*loadSender, cfg.Workers)
+	for i := range senders {
+		var err error
+		senders[i], err = newLoadSender(netAddr, cfg.SSF)
+		if err != nil {
+			return LoadResult{}, err
+		}
+		defer senders[i].conn.Close()
+	}
+
+	var sent, errs uint64
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w, sender := range senders {
+		wg.Add(1)
+		go func(w int, sender *loadSender) {
+			defer wg.Done()
+			rate := float64(cfg.Rate) / float64(cfg.Workers)
+			ticker := time.NewTicker(loadTick)
+			defer ticker.Stop()
+			var n uint64
+			for {
+				now := time.Now()
+				elapsed := now.Sub(start)
+				if elapsed > cfg.Duration {
+					elapsed = cfg.Duration
+				}
+				for target := loadTarget(rate, cfg.RampUp, elapsed); n < target; n++ {
+					// Each worker sends the whole mix, and
+					// every cfg.Workers-th value:
+					i := n*uint64(cfg.Workers) + uint64(w)
+					line, span := loadItem(cfg, cycle[n%uint64(len(cycle))], i, now)
+					if err := sender.send(line, span); err != nil {
+						atomic.AddUint64(&errs, 1)
+						continue
+					}
+					atomic.AddUint64(&sent, 1)
+				}
+				if err := sender.flush(); err != nil {
+					atomic.AddUint64(&errs, 1)
+				}
+				if elapsed == cfg.Duration {
+					return
+				}
+				<-ticker.C
+			}
+		}(w, sender)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+	var lastSent uint64
+	for running := true; running; {
+		select {
+		case <-progress.C:
+			s := atomic.LoadUint64(&sent)
+			logrus.WithFields(logrus.Fields{
+				"sent":   s,
+				"rate":   s - lastSent,
+				"errors": atomic.LoadUint64(&errs),
+			}).Info("Sending load")
+			lastSent = s
+		case <-finished:
+			running = false
+		}
+	}
+
+	return LoadResult{
+		Target:  loadTarget(float64(cfg.Rate), cfg.RampUp, cfg.Duration),
+		Sent:    atomic.LoadUint64(&sent),
+		Errors:  atomic.LoadUint64(&errs),
+		Elapsed: time.Since(start),
+	}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := parseMix("counter:4,timer:2,set,span:0")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{loadCounter: 4, loadTimer: 2, loadSet: 1, loadSpan: 0}, mix)
+
+	for _, bad := range []string{"", "span:0", "histogram:1", "counter:x", "counter:-1"} {
+		_, err := parseMix(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestMixCycle(t *testing.T) {
+	assert.Equal(t, []string{loadCounter, loadSpan, loadCounter}, mixCycle(map[string]int{loadCounter: 2, loadSpan: 1}))
+	cycle := mixCycle(map[string]int{loadCounter: 4, loadTimer: 2, loadSet: 1})
+	assert.Len(t, cycle, 7)
+	counts := map[string]int{}
+	for _, kind := range cycle {
+		counts[kind]++
+	}
+	assert.Equal(t, map[string]int{loadCounter: 4, loadTimer: 2, loadSet: 1}, counts)
+}
+
+func TestLoadTarget(t *testing.T) {
+	assert.Equal(t, uint64(500), loadTarget(100, 0, 5*time.Second))
+	// Halfway through a 10s ramp-up, the rate has reached 50/s, and
+	// 125 were sent:
+	assert.Equal(t, uint64(125), loadTarget(100, 10*time.Second, 5*time.Second))
+	assert.Equal(t, uint64(1500), loadTarget(100, 10*time.Second, 20*time.Second))
+}
+
+func TestRunLoadStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	received := make(chan string, 1000)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+
+	result, err := runLoad(conn.LocalAddr(), &LoadConfig{
+		Rate:        2000,
+		Duration:    100 * time.Millisecond,
+		Mix:         map[string]int{loadCounter: 1, loadTimer: 1},
+		Cardinality: 2,
+		Workers:     2,
+		Name:        "test",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), result.Target)
+	assert.Equal(t, uint64(200), result.Sent)
+	assert.Zero(t, result.Errors)
+
+	var lines []string
+	timeout := time.After(time.Second)
+	for len(lines) < 200 {
+		select {
+		case line := <-received:
+			lines = append(lines, line)
+		case <-timeout:
+			t.Fatalf("received %d lines", len(lines))
+		}
+	}
+	all := strings.Join(lines, "\n")
+	assert.Equal(t, 100, strings.Count(all, "test.counter:1|c|"))
+	assert.Equal(t, 100, strings.Count(all, "|ms|"))
+	assert.Contains(t, all, "test.timer:3|ms|#series:1")
+}
+
+func TestRunLoadSSF(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	spans := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := 0
+		for {
+			span, err := protocol.ReadSSF(conn)
+			if err != nil {
+				spans <- n
+				return
+			}
+			if span.Id != 0 {
+				n++
+			}
+		}
+	}()
+
+	result, err := runLoad(ln.Addr(), &LoadConfig{
+		Rate:     1000,
+		Duration: 100 * time.Millisecond,
+		Mix:      map[string]int{loadGauge: 1, loadSpan: 1},
+		SSF:      true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), result.Sent)
+	assert.Zero(t, result.Errors)
+	assert.Equal(t, 50, <-spans)
+
+	_, err = runLoad(ln.Addr(), &LoadConfig{Rate: 1, Duration: time.Millisecond, Mix: map[string]int{loadSpan: 1}})
+	assert.Error(t, err)
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
-	"math"
-	"math/big"
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -16,9 +17,6 @@ import (
 	"fmt"
 	"strconv"
 
-	"crypto/rand"
-
-	"github.com/DataDog/datadog-go/statsd"
 	"github.com/araddon/dateparse"
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/veneur/protocol"
@@ -35,13 +33,24 @@ type Flags struct {
 	Command   bool
 	ExtraArgs []string
 
+	FailureCount string
+	Rusage       bool
+
 	Name   string
 	Gauge  float64
 	Timing time.Duration
 	Count  int64
 	Set    string
+	Metric metricFlags
 	Tag    string
 	ToSSF  bool
+	GRPC   bool
+
+	Timeout time.Duration
+
+	Input  string
+	MTU    int
+	Strict bool
 
 	Event struct {
 		Title      string
@@ -72,6 +81,17 @@ type Flags struct {
 		Service   string
 		Indicator bool
 		Tags      string
+
+		PrintContext bool
+	}
+
+	Load struct {
+		Rate        int
+		Duration    time.Duration
+		RampUp      time.Duration
+		Mix         string
+		Cardinality int
+		Workers     int
 	}
 }
 
@@ -79,7 +99,8 @@ const (
 	MetricMode EmitMode = 1 << iota
 	EventMode
 	ServiceCheckMode
-	AllModes = MetricMode | EventMode | ServiceCheckMode
+	LoadMode
+	AllModes = MetricMode | EventMode | ServiceCheckMode | LoadMode
 )
 
 func (m EmitMode) String() string {
@@ -90,11 +111,19 @@ func (m EmitMode) String() string {
 		return "event"
 	case ServiceCheckMode:
 		return "sc"
+	case LoadMode:
+		return "load"
 	case AllModes:
 		return "any"
 	}
 
-	return ""
+	var modes []string
+	for _, mode := range []EmitMode{MetricMode, EventMode, ServiceCheckMode, LoadMode} {
+		if m&mode != 0 {
+			modes = append(modes, mode.String())
+		}
+	}
+	return strings.Join(modes, "|")
 }
 
 var flagModeMappings = map[string]EmitMode{}
@@ -105,16 +134,30 @@ func init() {
 			"hostport",
 			"debug",
 			"command",
+			"tag",
 		},
 		MetricMode: []string{
-			"name",
 			"gauge",
 			"timing",
 			"count",
 			"set",
-			"tag",
+			"metric",
+			"input",
+			"mtu",
+			"strict",
+			"failure_count",
+			"rusage",
+		},
+		MetricMode | LoadMode: []string{
+			"name",
+		},
+		MetricMode | ServiceCheckMode | LoadMode: []string{
 			"ssf",
 		},
+		MetricMode | ServiceCheckMode: []string{
+			"grpc",
+			"timeout",
+		},
 		EventMode: []string{
 			"e_title",
 			"e_text",
@@ -134,6 +177,14 @@ func init() {
 			"sc_tags",
 			"sc_msg",
 		},
+		LoadMode: []string{
+			"load_rate",
+			"load_duration",
+			"load_ramp_up",
+			"load_mix",
+			"load_cardinality",
+			"load_workers",
+		},
 	} {
 		for _, flag := range flags {
 			flagModeMappings[flag] = mode
@@ -167,7 +218,15 @@ func main() {
 
 	validateFlagCombinations(passedFlags, flagStruct.ExtraArgs)
 
-	addr, netAddr, err := destination(&flagStruct.HostPort, flagStruct.ToSSF)
+	if flagStruct.GRPC && !flagStruct.ToSSF {
+		logrus.Fatal("-grpc requires -ssf.")
+	}
+	hostport := flagStruct.HostPort
+	if flagStruct.GRPC && hostport != "" && !strings.Contains(hostport, "://") {
+		// gRPC is always over TCP:
+		hostport = "tcp://" + hostport
+	}
+	addr, netAddr, err := destination(&hostport, flagStruct.ToSSF)
 	if err != nil {
 		logrus.WithError(err).Fatal("Error getting destination address.")
 	}
@@ -178,36 +237,106 @@ func main() {
 
 	if flagStruct.Mode == "event" {
 		if flagStruct.ToSSF {
+			// Veneur only takes DogStatsD events, as SSF has no
+			// samples for them:
 			logrus.WithField("mode", flagStruct.Mode).
 				Fatal("Unsupported mode with SSF")
 		}
 		logrus.Debug("Sending event")
-		nconn, _ := net.Dial(netAddr.Network(), netAddr.String())
 		pkt, err := buildEventPacket(passedFlags)
 		if err != nil {
 			logrus.WithError(err).Fatal("build event")
 		}
-		nconn.Write(pkt.Bytes())
+		nconn, err := net.Dial(netAddr.Network(), netAddr.String())
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not connect")
+		}
+		if _, err := nconn.Write(pkt.Bytes()); err != nil {
+			logrus.WithError(err).Fatal("Could not send event")
+		}
 		logrus.Debugf("Buffer string: %s", pkt.String())
 		return
 	}
 
 	if flagStruct.Mode == "sc" {
 		if flagStruct.ToSSF {
-			logrus.WithField("mode", flagStruct.Mode).
-				Fatal("Unsupported mode with SSF")
+			logrus.Debug("Sending service check over SSF")
+			sample, err := buildSCSample(passedFlags)
+			if err != nil {
+				logrus.WithError(err).Fatal("build service check")
+			}
+			if err := deliverSSF(addr, netAddr, &ssf.SSFSpan{Metrics: []*ssf.SSFSample{sample}}, flagStruct.GRPC, flagStruct.Timeout); err != nil {
+				logrus.WithError(err).
+					WithField("address", addr).
+					Fatal("Could not send SSF span")
+			}
+			return
 		}
 		logrus.Debug("Sending service check")
-		nconn, _ := net.Dial(netAddr.Network(), netAddr.String())
 		pkt, err := buildSCPacket(passedFlags)
 		if err != nil {
-			logrus.WithError(err).Fatal("build event")
+			logrus.WithError(err).Fatal("build service check")
+		}
+		nconn, err := net.Dial(netAddr.Network(), netAddr.String())
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not connect")
+		}
+		if _, err := nconn.Write(pkt.Bytes()); err != nil {
+			logrus.WithError(err).Fatal("Could not send service check")
 		}
-		nconn.Write(pkt.Bytes())
 		logrus.Debugf("Buffer string: %s", pkt.String())
 		return
 	}
 
+	if flagStruct.Mode == "load" {
+		mix, err := parseMix(flagStruct.Load.Mix)
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid -load_mix")
+		}
+		result, err := runLoad(netAddr, &LoadConfig{
+			Rate:        flagStruct.Load.Rate,
+			Duration:    flagStruct.Load.Duration,
+			RampUp:      flagStruct.Load.RampUp,
+			Mix:         mix,
+			Cardinality: flagStruct.Load.Cardinality,
+			Workers:     flagStruct.Load.Workers,
+			Name:        flagStruct.Name,
+			Tags:        tagsFromString(flagStruct.Tag),
+			SSF:         flagStruct.ToSSF,
+		})
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not send load")
+		}
+		fmt.Printf("target=%d sent=%d errors=%d elapsed=%s achieved_rate=%.1f/s\n",
+			result.Target, result.Sent, result.Errors, result.Elapsed.Round(time.Millisecond), result.Achieved())
+		if result.Errors > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flagStruct.Input != "" {
+		in := os.Stdin
+		if flagStruct.Input != "-" {
+			in, err = os.Open(flagStruct.Input)
+			if err != nil {
+				logrus.WithError(err).Fatal("Could not open -input")
+			}
+			defer in.Close()
+		}
+		result, err := runInput(in, netAddr, InputConfig{SSF: flagStruct.ToSSF, MTU: flagStruct.MTU}, func(err *LineError) {
+			logrus.WithError(err.Err).WithField("line", err.Line).Warn("Could not parse line")
+		})
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not send input")
+		}
+		fmt.Printf("lines=%d sent=%d errors=%d\n", result.Lines, result.Sent, result.Errors)
+		if flagStruct.Strict && result.Errors > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if flagStruct.Span.TraceID, err = inferTraceIDInt(flagStruct.Span.TraceID, envTraceID); err != nil {
 		logrus.WithError(err).
 			WithField("env_var", envTraceID).
@@ -220,11 +349,38 @@ func main() {
 			WithField("ID", "parent_span_id").
 			Warn("Could not infer ID from environment")
 	}
+	var traceIDHigh int64
+	if flagStruct.ToSSF {
+		// Spans of SSF mode are also children of the trace context
+		// that's propagated through the environment:
+		tc, err := inferTraceContext(traceContext{TraceID: flagStruct.Span.TraceID, ParentID: flagStruct.Span.ParentID}, os.LookupEnv)
+		if err != nil {
+			logrus.WithError(err).Warn("Could not infer the trace context from environment")
+		}
+		traceIDHigh, flagStruct.Span.TraceID, flagStruct.Span.ParentID = tc.TraceIDHigh, tc.TraceID, tc.ParentID
+	} else if flagStruct.Span.PrintContext {
+		logrus.Fatal("-print_span_context requires -ssf.")
+	}
+	newTrace := false
+	if flagStruct.Span.PrintContext && flagStruct.Span.TraceID == 0 {
+		// Start a new trace, for the later steps to be part of:
+		if flagStruct.Span.TraceID, err = newSpanID(); err != nil {
+			logrus.WithError(err).Fatal("Couldn't start a trace")
+		}
+		newTrace = true
+	}
 	span, err := setupSpan(flagStruct.Span.TraceID, flagStruct.Span.ParentID, flagStruct.Name, flagStruct.Tag, flagStruct.Span.Service, flagStruct.Span.Tags, flagStruct.Span.Indicator)
 	if err != nil {
 		logrus.WithError(err).
 			Fatal("Couldn't set up the main span")
 	}
+	if newTrace {
+		// The root span of a trace has the trace's ID:
+		span.Id = span.TraceId
+	}
+	if span.TraceId != 0 {
+		span.TraceIdHigh = traceIDHigh
+	}
 	if span.TraceId != 0 {
 		if !flagStruct.ToSSF {
 			logrus.WithField("ssf", flagStruct.ToSSF).
@@ -243,16 +399,17 @@ func main() {
 		logrus.WithError(err).Fatal("Error creating metrics.")
 	}
 	if flagStruct.ToSSF {
-		client, err := trace.NewClient(addr)
-		if err != nil {
+		if err := deliverSSF(addr, netAddr, span, flagStruct.GRPC, flagStruct.Timeout); err != nil {
 			logrus.WithError(err).
 				WithField("address", addr).
-				Fatal("Could not construct client")
+				Fatal("Could not send SSF span")
 		}
-		defer client.Close()
-		err = sendSSF(client, span)
-		if err != nil {
-			logrus.WithError(err).Fatal("Could not send SSF span")
+		if flagStruct.Span.PrintContext {
+			exports, err := spanContextExports(span)
+			if err != nil {
+				logrus.WithError(err).Fatal("Could not print the span context")
+			}
+			fmt.Print(exports)
 		}
 	} else {
 		if netAddr.Network() != "udp" {
@@ -261,9 +418,11 @@ func main() {
 				Fatal("hostport must be a UDP address for statsd metrics")
 		}
 		if len(span.Metrics) == 0 {
-			logrus.Fatal("No metrics to send. Must pass metric data via at least one of -count, -gauge, -timing, or -set.")
+			logrus.Fatal("No metrics to send. Must pass metric data via at least one of -count, -gauge, -timing, -set, or -metric.")
+		}
+		if err := sendStatsd(netAddr, span); err != nil {
+			logrus.WithError(err).Fatal("Could not send metrics")
 		}
-		sendStatsd(netAddr.String(), span)
 	}
 	os.Exit(status)
 }
@@ -274,9 +433,11 @@ func flags(args []string) (Flags, map[string]flag.Value) {
 
 	// Generic flags
 	flagset.StringVar(&flagStruct.HostPort, "hostport", "", "Address of destination (hostport or listening address URL).")
-	flagset.StringVar(&flagStruct.Mode, "mode", "metric", "Mode for veneur-emit. Must be one of: 'metric', 'event', 'sc'.")
+	flagset.StringVar(&flagStruct.Mode, "mode", "metric", "Mode for veneur-emit. Must be one of: 'metric', 'event', 'sc', 'load'.")
 	flagset.BoolVar(&flagStruct.Debug, "debug", false, "Turns on debug messages.")
-	flagset.BoolVar(&flagStruct.Command, "command", false, "Turns on command-timing mode. veneur-emit will grab everything after the first non-known-flag argument, time its execution, and report it as a timing metric.")
+	flagset.BoolVar(&flagStruct.Command, "command", false, "Turns on command-timing mode. veneur-emit will grab everything after the first non-known-flag argument, time its execution, and report it as a timing metric, tagged with exit_status and success. veneur-emit exits with the command's exit status.")
+	flagset.StringVar(&flagStruct.FailureCount, "failure_count", "", "With -command, name of a counter to increment if the command exits with a non-zero status or is terminated by a signal.")
+	flagset.BoolVar(&flagStruct.Rusage, "rusage", false, "With -command, also report the command's maximum resident set size and its user and system CPU time, as the gauges <name>.max_rss_bytes, <name>.user_cpu_seconds and <name>.system_cpu_seconds.")
 
 	// Metric flags
 	flagset.StringVar(&flagStruct.Name, "name", "", "Name of metric to report. Ex: 'daemontools.service.starts'")
@@ -284,8 +445,14 @@ func flags(args []string) (Flags, map[string]flag.Value) {
 	flagset.DurationVar(&flagStruct.Timing, "timing", 0*time.Millisecond, "Report a 'timing' metric. Value must be parseable by time.ParseDuration (https://golang.org/pkg/time/#ParseDuration).")
 	flagset.Int64Var(&flagStruct.Count, "count", 0, "Report a 'count' metric. Value must be an integer.")
 	flagset.StringVar(&flagStruct.Set, "set", "", "Report a 'set' metric with an arbitrary string value.")
+	flagset.Var(&flagStruct.Metric, "metric", "Report a metric, as name:value:type[:tags], where type is one of 'count', 'gauge', 'timing', 'histogram' or 'set', and tags are comma separated and added to -tag. Can be repeated, and combined with -name and the other metric flags; all the metrics are sent together. Ex: -metric 'job.rows:1200:count:table:widgets' -metric 'job.duration:2.5s:timing'")
 	flagset.StringVar(&flagStruct.Tag, "tag", "", "Tag(s) for metric, comma separated. Ex: 'service:airflow'. Note: Any tags here are applied to all emitted data. See also mode-specific tag options (e.g. span_tags)")
 	flagset.BoolVar(&flagStruct.ToSSF, "ssf", false, "Sends packets via SSF instead of StatsD. (https://github.com/stripe/veneur/blob/master/ssf/)")
+	flagset.BoolVar(&flagStruct.GRPC, "grpc", false, "With -ssf, sends the span to veneur's gRPC import service at -hostport (host:port or tcp://host:port), rather than to an SSF listener. Errors are reported, with a nonzero exit status.")
+	flagset.DurationVar(&flagStruct.Timeout, "timeout", DefaultTimeout, "With -ssf, how long connecting to -hostport and sending the span may take in all, before giving up with a nonzero exit status. 0 never gives up.")
+	flagset.StringVar(&flagStruct.Input, "input", "", "Read newline-delimited statsd lines (or, with -ssf, JSON-encoded SSF spans) from a file, or from stdin if it's '-', and send them all over a single connection.")
+	flagset.IntVar(&flagStruct.MTU, "mtu", DefaultMTU, "Maximum size of the datagrams that statsd lines read with -input are batched into.")
+	flagset.BoolVar(&flagStruct.Strict, "strict", false, "Exit with a nonzero status if any line read with -input couldn't be parsed.")
 
 	// Event flags
 	// TODO: what should flags be called?
@@ -314,8 +481,17 @@ func flags(args []string) (Flags, map[string]flag.Value) {
 	flagset.StringVar(&flagStruct.Span.EndTime, "span_endtime", "", "Date/time to set for the end of the span. Format is same as -span_starttime.")
 	flagset.StringVar(&flagStruct.Span.Service, "span_service", "veneur-emit", "Service name to associate with the span.")
 	flagset.BoolVar(&flagStruct.Span.Indicator, "indicator", false, "Mark the reported span as an indicator span")
+	flagset.BoolVar(&flagStruct.Span.PrintContext, "print_span_context", false, "After sending the span, print shell export lines of its trace context (VENEUR_TRACE_ID, VENEUR_PARENT_SPAN_ID and TRACEPARENT), so that the veneur-emits of later steps report their spans as its children. Ex: eval \"$(veneur-emit -ssf -print_span_context ...)\". Without a trace context, a new trace is started. Requires -ssf.")
 	flagset.StringVar(&flagStruct.Span.Tags, "span_tags", "", "Tag(s) for span, comma separated. Useful for avoiding high cardinality tags. Ex 'user_id:ac0b23,widget_id:284802'")
 
+	// Load flags
+	flagset.IntVar(&flagStruct.Load.Rate, "load_rate", 1000, "Metrics and spans to send per second, in all.")
+	flagset.DurationVar(&flagStruct.Load.Duration, "load_duration", time.Minute, "How long to send load for, including the ramp-up.")
+	flagset.DurationVar(&flagStruct.Load.RampUp, "load_ramp_up", 0, "How long the rate takes to rise linearly from 0 to -load_rate.")
+	flagset.StringVar(&flagStruct.Load.Mix, "load_mix", "counter:1", "Kinds of metrics and spans to send, with their weights, comma separated. Kinds are 'counter', 'gauge', 'timer', 'set' and 'span' (which needs -ssf). Ex: 'counter:4,timer:2,set:1'")
+	flagset.IntVar(&flagStruct.Load.Cardinality, "load_cardinality", 100, "Number of distinct values of the 'series' tag that load is spread over.")
+	flagset.IntVar(&flagStruct.Load.Workers, "load_workers", 1, "Number of connections to send load over.")
+
 	flagset.Parse(args[1:])
 
 	flagStruct.ExtraArgs = make([]string, len(flagset.Args()))
@@ -394,11 +570,11 @@ func setupSpan(traceID, parentID int64, name, tags, service, spanTags string, in
 	if traceID != 0 {
 		span.TraceId = traceID
 		span.ParentId = parentID
-		bigid, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+		id, err := newSpanID()
 		if err != nil {
 			return nil, err
 		}
-		span.Id = bigid.Int64()
+		span.Id = id
 		span.Name = name
 		span.Tags = tagsFromString(tags)
 		for k, v := range tagsFromString(spanTags) {
@@ -410,7 +586,52 @@ func setupSpan(traceID, parentID int64, name, tags, service, spanTags string, in
 	return span, nil
 }
 
-func timeCommand(span *ssf.SSFSpan, command []string) (exitStatus int, start time.Time, ended time.Time, err error) {
+// commandResult is how a timed command ran.
+type commandResult struct {
+	start, ended time.Time
+	// exitStatus is the command's exit status or, if a signal terminated
+	// it, 128 and the signal, like shells report.
+	exitStatus int
+	// signal is the signal that terminated the command, if one did.
+	signal syscall.Signal
+	state  *os.ProcessState
+}
+
+// statusTag is the value of the exit_status tag of the command's
+// metrics: its exit status, or the signal that terminated it.
+func (r commandResult) statusTag() string {
+	if r.signal != 0 {
+		return fmt.Sprintf("signal_%d", int(r.signal))
+	}
+	return strconv.Itoa(r.exitStatus)
+}
+
+// rusage returns the gauges of the resources that the command used: its
+// maximum resident set size, and its user and system CPU time.
+func (r commandResult) rusage(name string, tags map[string]string) []*ssf.SSFSample {
+	if r.state == nil {
+		return nil
+	}
+	usage, ok := r.state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	maxRSS := float32(usage.Maxrss)
+	if runtime.GOOS != "darwin" {
+		// Linux and the BSDs report it in kilobytes; macOS, in bytes:
+		maxRSS *= 1024
+	}
+	return []*ssf.SSFSample{
+		ssf.Gauge(name+".max_rss_bytes", maxRSS, tags),
+		ssf.Gauge(name+".user_cpu_seconds", float32(r.state.UserTime().Seconds()), tags),
+		ssf.Gauge(name+".system_cpu_seconds", float32(r.state.SystemTime().Seconds()), tags),
+	}
+}
+
+// timeCommand runs a command and times it. If the command exits with a
+// non-zero status, or is terminated by a signal, the *exec.ExitError is
+// returned along with the result.
+func timeCommand(span *ssf.SSFSpan, command []string) (result commandResult, err error) {
 	logrus.Debugf("Timing %q...", command)
 	cmd := exec.Command(command[0], command[1:]...)
 
@@ -426,26 +647,32 @@ func timeCommand(span *ssf.SSFSpan, command []string) (exitStatus int, start tim
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 
-	start = time.Now()
+	result.start = time.Now()
 	err = cmd.Start()
 	if err != nil {
 		logrus.WithError(err).WithField("command", command).Error("Could not start command")
-		exitStatus = 1
+		result.exitStatus = 1
 		return
 	}
 
 	err = cmd.Wait()
-	ended = time.Now()
+	result.ended = time.Now()
+	result.state = cmd.ProcessState
 	if err != nil {
 		exitError, ok := err.(*exec.ExitError)
 		if !ok {
-			exitStatus = 1
+			result.exitStatus = 1
 			return
 		}
 		status := exitError.ProcessState.Sys().(syscall.WaitStatus)
-		exitStatus = status.ExitStatus()
+		if status.Signaled() {
+			result.signal = status.Signal()
+			result.exitStatus = 128 + int(result.signal)
+		} else {
+			result.exitStatus = status.ExitStatus()
+		}
 	}
-	logrus.Debugf("%q took %s", command, ended.Sub(start))
+	logrus.Debugf("%q took %s", command, result.ended.Sub(result.start))
 	return
 }
 
@@ -455,15 +682,29 @@ func createMetric(span *ssf.SSFSpan, passedFlags map[string]flag.Value, name str
 	tags := tagsFromString(tagStr)
 
 	if command {
-		var start, ended time.Time
-
-		status, start, ended, err = timeCommand(span, extraArgs)
-		if err != nil {
-			return status, err
+		result, err := timeCommand(span, extraArgs)
+		if _, exited := err.(*exec.ExitError); err != nil && !exited {
+			return result.exitStatus, err
+		}
+		status = result.exitStatus
+		span.StartTimestamp = result.start.UnixNano()
+		span.EndTimestamp = result.ended.UnixNano()
+
+		// The command's metrics are tagged with how it exited:
+		commandTags := map[string]string{
+			"exit_status": result.statusTag(),
+			"success":     strconv.FormatBool(status == 0),
+		}
+		for k, v := range tags {
+			commandTags[k] = v
+		}
+		span.Metrics = append(span.Metrics, ssf.Timing(name, result.ended.Sub(result.start), time.Millisecond, commandTags))
+		if passedFlags["failure_count"] != nil && status != 0 {
+			span.Metrics = append(span.Metrics, ssf.Count(passedFlags["failure_count"].String(), 1, commandTags))
+		}
+		if passedFlags["rusage"] != nil && passedFlags["rusage"].String() == "true" {
+			span.Metrics = append(span.Metrics, result.rusage(name, commandTags)...)
 		}
-		span.StartTimestamp = start.UnixNano()
-		span.EndTimestamp = ended.UnixNano()
-		span.Metrics = append(span.Metrics, ssf.Timing(name, ended.Sub(start), time.Millisecond, tags))
 	}
 
 	sf, shas := passedFlags["span_starttime"]
@@ -522,54 +763,77 @@ func createMetric(span *ssf.SSFSpan, passedFlags map[string]flag.Value, name str
 		logrus.Debugf("Sending set '%s' -> %s", name, passedFlags["set"].String())
 		span.Metrics = append(span.Metrics, ssf.Set(name, passedFlags["set"].String(), tags))
 	}
+
+	if metrics, ok := passedFlags["metric"].(flag.Getter); ok {
+		for _, spec := range metrics.Get().([]string) {
+			logrus.Debugf("Sending metric %s", spec)
+			sample, err := parseMetricSpec(spec, tags)
+			if err != nil {
+				return status, err
+			}
+			span.Metrics = append(span.Metrics, sample)
+		}
+	}
 	return status, err
 }
 
-// sendSSF sends a whole span to an SSF receiver.
-func sendSSF(client *trace.Client, span *ssf.SSFSpan) error {
-	done := make(chan error)
+// sendSSF sends a whole span to an SSF receiver, giving up when ctx is
+// done.
+func sendSSF(ctx context.Context, client *trace.Client, span *ssf.SSFSpan) error {
+	done := make(chan error, 1)
 	err := trace.Record(client, span, done)
 	if err != nil {
 		return err
 	}
-	return <-done
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // sendStatsd sends the metrics gathered in a span to a dogstatsd
-// endpoint.
-func sendStatsd(addr string, span *ssf.SSFSpan) error {
-	client, err := statsd.New(addr)
+// endpoint, batched into as few datagrams as they fit in.
+func sendStatsd(netAddr net.Addr, span *ssf.SSFSpan) error {
+	ls, err := newLoadSender(netAddr, false)
 	if err != nil {
 		return err
 	}
-	// Report all the metrics in the span:
+	defer ls.conn.Close()
+	s := &inputSender{loadSender: ls, mtu: DefaultMTU}
 	for _, metric := range span.Metrics {
-		tags := make([]string, 0, len(metric.Tags))
-		for name, val := range metric.Tags {
-			tags = append(tags, fmt.Sprintf("%s:%s", name, val))
-		}
-		switch metric.Metric {
-		case ssf.SSFSample_COUNTER:
-			err = client.Count(metric.Name, int64(metric.Value), tags, 1.0)
-		case ssf.SSFSample_GAUGE:
-			err = client.Gauge(metric.Name, float64(metric.Value), tags, 1.0)
-		case ssf.SSFSample_HISTOGRAM:
-			if metric.Unit == "ms" {
-				// Treating the "ms" unit special is a
-				// bit wonky, but it seems like the
-				// right tool for the job here:
-				err = client.TimeInMilliseconds(metric.Name, float64(metric.Value), tags, 1.0)
-			} else {
-				err = client.Histogram(metric.Name, float64(metric.Value), tags, 1.0)
-			}
-		case ssf.SSFSample_SET:
-			err = client.Set(metric.Name, metric.Message, tags, 1.0)
-		}
-		if err != nil {
+		if err := s.sendLine(statsdLine(metric)); err != nil {
 			return err
 		}
 	}
-	return nil
+	return s.flush()
+}
+
+// statsdLine formats a metric as a DogStatsD line.
+func statsdLine(metric *ssf.SSFSample) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(metric.Name + ":")
+	switch metric.Metric {
+	case ssf.SSFSample_COUNTER:
+		buffer.WriteString(strconv.FormatInt(int64(metric.Value), 10) + "|c")
+	case ssf.SSFSample_GAUGE:
+		buffer.WriteString(strconv.FormatFloat(float64(metric.Value), 'f', 6, 64) + "|g")
+	case ssf.SSFSample_HISTOGRAM:
+		buffer.WriteString(strconv.FormatFloat(float64(metric.Value), 'f', 6, 64))
+		if metric.Unit == "ms" {
+			// Treating the "ms" unit special is a
+			// bit wonky, but it seems like the
+			// right tool for the job here:
+			buffer.WriteString("|ms")
+		} else {
+			buffer.WriteString("|h")
+		}
+	case ssf.SSFSample_SET:
+		buffer.WriteString(metric.Message + "|s")
+	}
+	writeDogstatsdTags(&buffer, metric.Tags)
+	return buffer.Bytes()
 }
 
 func validateFlagCombinations(passedFlags map[string]flag.Value, extraArgs []string) {
@@ -587,6 +851,8 @@ func validateFlagCombinations(passedFlags map[string]flag.Value, extraArgs []str
 			mode = EventMode
 		case "sc":
 			mode = ServiceCheckMode
+		case "load":
+			mode = LoadMode
 		}
 	}
 
@@ -607,6 +873,54 @@ func validateFlagCombinations(passedFlags map[string]flag.Value, extraArgs []str
 
 }
 
+// escapeDogstatsd escapes the newlines of a field of a DogStatsD packet
+// as "\\n", which veneur and the Datadog agent unescape. Pipes separate
+// the sections of packets, and DogStatsD has no escape for them.
+func escapeDogstatsd(field, value string) (string, error) {
+	if strings.ContainsRune(value, '|') {
+		return "", fmt.Errorf("%s can't contain '|', which separates the sections of DogStatsD packets", field)
+	}
+	value = strings.Replace(value, "\r\n", "\n", -1)
+	return strings.Replace(value, "\n", "\\n", -1), nil
+}
+
+// writeDogstatsdTags writes a tag section, in order of the tags' names.
+func writeDogstatsdTags(buffer *bytes.Buffer, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer.WriteString("|#") // Write the tag prefix bytes
+	for i, name := range names {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(name)
+		if tags[name] != "" {
+			buffer.WriteString(":" + tags[name])
+		}
+	}
+}
+
+// mergedTags returns the tags of a mode's tag flag, and of -tag, which
+// applies to everything.
+func mergedTags(passedFlags map[string]flag.Value, modeFlag string) map[string]string {
+	finalTags := map[string]string{}
+	if passedFlags[modeFlag] != nil {
+		finalTags = tagsFromString(passedFlags[modeFlag].String())
+	}
+	if passedFlags["tag"] != nil {
+		for k, v := range tagsFromString(passedFlags["tag"].String()) {
+			finalTags[k] = v
+		}
+	}
+	return finalTags
+}
+
 func buildEventPacket(passedFlags map[string]flag.Value) (bytes.Buffer, error) {
 	var buffer bytes.Buffer
 	buffer.WriteString("_e")
@@ -619,57 +933,58 @@ func buildEventPacket(passedFlags map[string]flag.Value) (bytes.Buffer, error) {
 		return bytes.Buffer{}, errors.New("missing event text")
 	}
 
-	buffer.WriteString(fmt.Sprintf("{%d,%d}", len(passedFlags["e_title"].String()), len(passedFlags["e_text"].String())))
+	title, err := escapeDogstatsd("event title", passedFlags["e_title"].String())
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+	text, err := escapeDogstatsd("event text", passedFlags["e_text"].String())
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+
+	// The lengths are those of the escaped title and text, as they're
+	// sent:
+	buffer.WriteString(fmt.Sprintf("{%d,%d}", len(title), len(text)))
 	buffer.WriteString(":")
 
-	buffer.WriteString(passedFlags["e_title"].String())
+	buffer.WriteString(title)
 	buffer.WriteString("|")
-
-	text := strings.Replace(passedFlags["e_text"].String(), "\n", "\\n", -1)
 	buffer.WriteString(text)
 
-	if passedFlags["e_time"] != nil {
-		buffer.WriteString(fmt.Sprintf("|d:%s", passedFlags["e_time"].String()))
-	}
-
-	if passedFlags["e_hostname"] != nil {
-		buffer.WriteString(fmt.Sprintf("|h:%s", passedFlags["e_hostname"].String()))
-	}
-
-	if passedFlags["e_aggr_key"] != nil {
-		buffer.WriteString(fmt.Sprintf("|k:%s", passedFlags["e_aggr_key"].String()))
+	for _, section := range []struct{ flag, prefix string }{
+		{"e_time", "d"},
+		{"e_hostname", "h"},
+		{"e_aggr_key", "k"},
+		{"e_priority", "p"},
+		{"e_source_type", "s"},
+		{"e_alert_type", "t"},
+	} {
+		if passedFlags[section.flag] == nil {
+			continue
+		}
+		value, err := escapeDogstatsd("-"+section.flag, passedFlags[section.flag].String())
+		if err != nil {
+			return bytes.Buffer{}, err
+		}
+		buffer.WriteString(fmt.Sprintf("|%s:%s", section.prefix, value))
 	}
 
-	if passedFlags["e_priority"] != nil {
-		buffer.WriteString(fmt.Sprintf("|p:%s", passedFlags["e_priority"].String()))
-	}
+	writeDogstatsdTags(&buffer, mergedTags(passedFlags, "e_event_tags"))
 
-	if passedFlags["e_source_type"] != nil {
-		buffer.WriteString(fmt.Sprintf("|s:%s", passedFlags["e_source_type"].String()))
-	}
-
-	if passedFlags["e_alert_type"] != nil {
-		buffer.WriteString(fmt.Sprintf("|t:%s", passedFlags["e_alert_type"].String()))
-	}
+	return buffer, nil
+}
 
-	finalTags := map[string]string{}
-	if passedFlags["e_event_tags"] != nil {
-		finalTags = tagsFromString(passedFlags["e_event_tags"].String())
-	}
-	if passedFlags["tag"] != nil {
-		for k, v := range tagsFromString(passedFlags["tag"].String()) {
-			finalTags[k] = v
-		}
-	}
-	if len(finalTags) > 0 {
-		buffer.WriteString("|#") // Write the tag prefix bytes
-		for k, v := range finalTags {
-			buffer.WriteString(fmt.Sprintf("%s:%s,", k, v))
+// parseSCStatus parses the status of a service check: a number from 0
+// to 3, or the name of one of those.
+func parseSCStatus(status string) (ssf.SSFSample_Status, error) {
+	if n, err := strconv.Atoi(status); err == nil {
+		if _, ok := ssf.SSFSample_Status_name[int32(n)]; ok {
+			return ssf.SSFSample_Status(n), nil
 		}
-		buffer.Truncate(buffer.Len() - 1) // Drop the last comma for cleanliness
+	} else if n, ok := ssf.SSFSample_Status_value[strings.ToUpper(status)]; ok {
+		return ssf.SSFSample_Status(n), nil
 	}
-
-	return buffer, nil
+	return 0, fmt.Errorf("invalid service check status %q: must be one of 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN)", status)
 }
 
 func buildSCPacket(passedFlags map[string]flag.Value) (bytes.Buffer, error) {
@@ -684,11 +999,20 @@ func buildSCPacket(passedFlags map[string]flag.Value) (bytes.Buffer, error) {
 		return bytes.Buffer{}, errors.New("missing service check status")
 	}
 
+	name, err := escapeDogstatsd("service check name", passedFlags["sc_name"].String())
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+	status, err := parseSCStatus(passedFlags["sc_status"].String())
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+
 	buffer.WriteString("|")
-	buffer.WriteString(passedFlags["sc_name"].String())
+	buffer.WriteString(name)
 
 	buffer.WriteString("|")
-	buffer.WriteString(passedFlags["sc_status"].String())
+	buffer.WriteString(strconv.Itoa(int(status)))
 
 	if passedFlags["sc_time"] != nil {
 		buffer.WriteString(fmt.Sprintf("|d:%s", passedFlags["sc_time"].String()))
@@ -698,26 +1022,46 @@ func buildSCPacket(passedFlags map[string]flag.Value) (bytes.Buffer, error) {
 		buffer.WriteString(fmt.Sprintf("|h:%s", passedFlags["sc_hostname"].String()))
 	}
 
-	finalTags := map[string]string{}
-	if passedFlags["sc_tags"] != nil {
-		finalTags = tagsFromString(passedFlags["sc_tags"].String())
-	}
-	if passedFlags["tag"] != nil {
-		for k, v := range tagsFromString(passedFlags["tag"].String()) {
-			finalTags[k] = v
+	writeDogstatsdTags(&buffer, mergedTags(passedFlags, "sc_tags"))
+
+	// The message must be the last section:
+	if passedFlags["sc_msg"] != nil {
+		msg, err := escapeDogstatsd("service check message", passedFlags["sc_msg"].String())
+		if err != nil {
+			return bytes.Buffer{}, err
 		}
+		buffer.WriteString(fmt.Sprintf("|m:%s", msg))
 	}
-	if len(finalTags) > 0 {
-		buffer.WriteString("|#") // Write the tag prefix bytes
-		for k, v := range finalTags {
-			buffer.WriteString(fmt.Sprintf("%s:%s,", k, v))
+
+	return buffer, nil
+}
+
+// buildSCSample builds a service check as an SSF status sample, which
+// veneur treats like a DogStatsD service check.
+func buildSCSample(passedFlags map[string]flag.Value) (*ssf.SSFSample, error) {
+	if passedFlags["sc_name"] == nil {
+		return nil, errors.New("missing service check name")
+	}
+	if passedFlags["sc_status"] == nil {
+		return nil, errors.New("missing service check status")
+	}
+	if passedFlags["sc_hostname"] != nil {
+		return nil, errors.New("SSF service checks have no hostname: -sc_hostname can't be used with -ssf")
+	}
+	status, err := parseSCStatus(passedFlags["sc_status"].String())
+	if err != nil {
+		return nil, err
+	}
+	sample := ssf.Status(passedFlags["sc_name"].String(), status, mergedTags(passedFlags, "sc_tags"))
+	if passedFlags["sc_time"] != nil {
+		timestamp, err := strconv.ParseInt(passedFlags["sc_time"].String(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service check time: %v", err)
 		}
-		buffer.Truncate(buffer.Len() - 1) // Drop the last comma for cleanliness
+		sample.Timestamp = time.Unix(timestamp, 0).UnixNano()
 	}
-
 	if passedFlags["sc_msg"] != nil {
-		buffer.WriteString(fmt.Sprintf("|m:%s", passedFlags["sc_msg"].String()))
+		sample.Message = passedFlags["sc_msg"].String()
 	}
-
-	return buffer, nil
+	return sample, nil
 }
@@ -11,6 +11,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol/dogstatsd"
+	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
 )
@@ -56,20 +58,70 @@ func TestMain(m *testing.M) {
 func TestTimeCommand(t *testing.T) {
 	t.Run("basic", func(t *testing.T) {
 		command := []string{"true"}
-		st, start, ended, err := timeCommand(&ssf.SSFSpan{}, command)
+		result, err := timeCommand(&ssf.SSFSpan{}, command)
 
 		assert.NoError(t, err, "timeCommand had an error")
-		assert.NotZero(t, start)
-		assert.NotZero(t, ended)
-		assert.Zero(t, st)
+		assert.NotZero(t, result.start)
+		assert.NotZero(t, result.ended)
+		assert.Zero(t, result.exitStatus)
+		assert.Equal(t, "0", result.statusTag())
 	})
 
 	t.Run("badCall", func(t *testing.T) {
 		command := []string{"false"}
-		st, _, _, err := timeCommand(&ssf.SSFSpan{}, command)
+		result, err := timeCommand(&ssf.SSFSpan{}, command)
 		assert.Error(t, err, "timeCommand did not throw error.")
-		assert.NotZero(t, st)
+		assert.NotZero(t, result.exitStatus)
 	})
+
+	t.Run("signal", func(t *testing.T) {
+		command := []string{"sh", "-c", "kill -9 $$"}
+		result, err := timeCommand(&ssf.SSFSpan{}, command)
+		assert.Error(t, err)
+		assert.Equal(t, 128+9, result.exitStatus)
+		assert.Equal(t, "signal_9", result.statusTag())
+	})
+}
+
+func TestCreateMetricsCommand(t *testing.T) {
+	testFlag := make(map[string]flag.Value)
+	testFlag["failure_count"] = newValue("cron.failures")
+	testFlag["rusage"] = newValue("true")
+
+	span := &ssf.SSFSpan{}
+	status, err := createMetric(span, testFlag, "cron.duration", "job:backup", true, []string{"sh", "-c", "exit 3"})
+	require.NoError(t, err)
+	// veneur-emit exits with the command's status:
+	assert.Equal(t, 3, status)
+	require.Len(t, span.Metrics, 5)
+	tags := map[string]string{"job": "backup", "exit_status": "3", "success": "false"}
+
+	timer := span.Metrics[0]
+	assert.Equal(t, "cron.duration", timer.Name)
+	assert.Equal(t, ssf.SSFSample_HISTOGRAM, timer.Metric)
+	assert.Equal(t, tags, timer.Tags)
+
+	failures := span.Metrics[1]
+	assert.Equal(t, "cron.failures", failures.Name)
+	assert.Equal(t, ssf.SSFSample_COUNTER, failures.Metric)
+	assert.Equal(t, float32(1), failures.Value)
+	assert.Equal(t, tags, failures.Tags)
+
+	var names []string
+	for _, gauge := range span.Metrics[2:] {
+		assert.Equal(t, ssf.SSFSample_GAUGE, gauge.Metric)
+		names = append(names, gauge.Name)
+	}
+	assert.Equal(t, []string{"cron.duration.max_rss_bytes", "cron.duration.user_cpu_seconds", "cron.duration.system_cpu_seconds"}, names)
+	assert.True(t, span.Metrics[2].Value > 0, "max RSS should be positive")
+
+	// Successful commands increment no failure counter:
+	span = &ssf.SSFSpan{}
+	status, err = createMetric(span, map[string]flag.Value{"failure_count": newValue("cron.failures")}, "cron.duration", "", true, []string{"true"})
+	require.NoError(t, err)
+	assert.Zero(t, status)
+	require.Len(t, span.Metrics, 1)
+	assert.Equal(t, map[string]string{"exit_status": "0", "success": "true"}, span.Metrics[0].Tags)
 }
 
 func TestGauge(t *testing.T) {
@@ -312,7 +364,7 @@ func TestSendSpan(t *testing.T) {
 	require.NoError(t, err)
 
 	be.errors <- nil
-	err = sendSSF(cl, span)
+	err = sendSSF(context.Background(), cl, span)
 	assert.NoError(t, err)
 
 	spanOut := <-ch
@@ -334,7 +386,7 @@ func TestBadSendSpan(t *testing.T) {
 	require.NoError(t, err)
 
 	errors <- fmt.Errorf("a potential error in sending")
-	err = sendSSF(cl, span)
+	err = sendSSF(context.Background(), cl, span)
 	assert.Error(t, err)
 }
 
@@ -504,6 +556,101 @@ func TestBuilldSCPacket(t *testing.T) {
 	})
 }
 
+func TestBuildEventPacketMultiline(t *testing.T) {
+	text := "Deployed abc123 to production:\n* fix the widget\r\n* break the gadget"
+	testFlag := make(map[string]flag.Value)
+	testFlag["e_title"] = newValue("Deploy")
+	testFlag["e_text"] = newValue(text)
+	testFlag["e_aggr_key"] = newValue("deploys")
+	testFlag["e_alert_type"] = newValue("success")
+	testFlag["e_event_tags"] = newValue("service:api,canary")
+
+	pkt, err := buildEventPacket(testFlag)
+	require.NoError(t, err)
+	assert.Equal(t, "_e{6,68}:Deploy|Deployed abc123 to production:\\n* fix the widget\\n* break the gadget|k:deploys|t:success|#canary,service:api", pkt.String())
+	assert.NotContains(t, pkt.String(), "\n", "a packet must be a single line")
+
+	// Veneur parses the packet back into the event:
+	event, err := samplers.ParseEvent(pkt.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, "Deploy", event.Name)
+	assert.Equal(t, "Deployed abc123 to production:\n* fix the widget\n* break the gadget", event.Message)
+	assert.Equal(t, "deploys", event.Tags[dogstatsd.EventAggregationKeyTagKey])
+	assert.Equal(t, "api", event.Tags["service"])
+
+	// Pipes can't be escaped:
+	testFlag["e_text"] = newValue("grep foo | wc -l")
+	_, err = buildEventPacket(testFlag)
+	assert.Error(t, err)
+}
+
+func TestBuildSCPacketMultiline(t *testing.T) {
+	testFlag := make(map[string]flag.Value)
+	testFlag["sc_name"] = newValue("deploy.health")
+	testFlag["sc_status"] = newValue("critical")
+	testFlag["sc_msg"] = newValue("2 hosts failed:\nweb-1\nweb-2")
+
+	pkt, err := buildSCPacket(testFlag)
+	require.NoError(t, err)
+	assert.Equal(t, "_sc|deploy.health|2|m:2 hosts failed:\\nweb-1\\nweb-2", pkt.String())
+
+	check, err := samplers.ParseServiceCheck(pkt.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, "deploy.health", check.Name)
+	assert.Equal(t, "2 hosts failed:\nweb-1\nweb-2", check.Message)
+
+	testFlag["sc_msg"] = newValue("a | b")
+	_, err = buildSCPacket(testFlag)
+	assert.Error(t, err)
+}
+
+func TestParseSCStatus(t *testing.T) {
+	for status, expected := range map[string]ssf.SSFSample_Status{
+		"0":        ssf.SSFSample_OK,
+		"1":        ssf.SSFSample_WARNING,
+		"critical": ssf.SSFSample_CRITICAL,
+		"UNKNOWN":  ssf.SSFSample_UNKNOWN,
+	} {
+		parsed, err := parseSCStatus(status)
+		assert.NoError(t, err, status)
+		assert.Equal(t, expected, parsed, status)
+	}
+	for _, status := range []string{"4", "-1", "bad"} {
+		_, err := parseSCStatus(status)
+		assert.Error(t, err, status)
+	}
+}
+
+func TestBuildSCSample(t *testing.T) {
+	testFlag := make(map[string]flag.Value)
+	testFlag["sc_name"] = newValue("deploy.health")
+	testFlag["sc_status"] = newValue("1")
+	testFlag["sc_time"] = newValue("1501002564")
+	testFlag["sc_tags"] = newValue("service:api")
+	testFlag["tag"] = newValue("env:prod")
+	testFlag["sc_msg"] = newValue("slow\nhosts")
+
+	sample, err := buildSCSample(testFlag)
+	require.NoError(t, err)
+	assert.Equal(t, ssf.SSFSample_STATUS, sample.Metric)
+	assert.Equal(t, "deploy.health", sample.Name)
+	assert.Equal(t, ssf.SSFSample_WARNING, sample.Status)
+	assert.Equal(t, int64(1501002564000000000), sample.Timestamp)
+	assert.Equal(t, map[string]string{"service": "api", "env": "prod"}, sample.Tags)
+	// SSF carries the message as it is:
+	assert.Equal(t, "slow\nhosts", sample.Message)
+
+	testFlag["sc_hostname"] = newValue("web-1")
+	_, err = buildSCSample(testFlag)
+	assert.Error(t, err)
+}
+
+func TestEmitModeString(t *testing.T) {
+	assert.Equal(t, "sc", ServiceCheckMode.String())
+	assert.Equal(t, "metric|sc|load", (MetricMode | ServiceCheckMode | LoadMode).String())
+	assert.Equal(t, "any", AllModes.String())
+}
+
 func resetMap(m map[string]bool) {
 	for key := range m {
 		m[key] = false
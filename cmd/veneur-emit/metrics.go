@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// metricFlags are the metrics passed with -metric, which can be
+// repeated. Each is checked as it's passed, and parsed with the tags of
+// -tag later.
+type metricFlags []string
+
+func (m *metricFlags) String() string {
+	return strings.Join(*m, " ")
+}
+
+func (m *metricFlags) Set(spec string) error {
+	if _, err := parseMetricSpec(spec, nil); err != nil {
+		return err
+	}
+	*m = append(*m, spec)
+	return nil
+}
+
+// Get returns the metrics passed, so that they can be told from other
+// flags' values.
+func (m *metricFlags) Get() interface{} {
+	return []string(*m)
+}
+
+// parseMetricSpec parses a metric passed with -metric, as
+// name:value:type[:tags]. Its tags, which are comma separated, are
+// added to (and override) baseTags. The types are count (or c), gauge
+// (g), timing (ms), histogram (h) and set (s); timings' values are Go
+// durations, or numbers of milliseconds.
+func parseMetricSpec(spec string, baseTags map[string]string) (*ssf.SSFSample, error) {
+	parts := strings.SplitN(spec, ":", 4)
+	if len(parts) < 3 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid metric %q: must be name:value:type[:tags]", spec)
+	}
+	name, value, typ := parts[0], parts[1], parts[2]
+	tags := make(map[string]string, len(baseTags))
+	for k, v := range baseTags {
+		tags[k] = v
+	}
+	if len(parts) == 4 {
+		for k, v := range tagsFromString(parts[3]) {
+			tags[k] = v
+		}
+	}
+
+	switch typ {
+	case "c", "count":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count in metric %q: %v", spec, err)
+		}
+		return ssf.Count(name, float32(n), tags), nil
+	case "g", "gauge":
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gauge in metric %q: %v", spec, err)
+		}
+		return ssf.Gauge(name, float32(f), tags), nil
+	case "ms", "timing":
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			ms, ferr := strconv.ParseFloat(value, 64)
+			if ferr != nil {
+				return nil, fmt.Errorf("invalid timing in metric %q: %v", spec, err)
+			}
+			duration = time.Duration(ms * float64(time.Millisecond))
+		}
+		return ssf.Timing(name, duration, time.Millisecond, tags), nil
+	case "h", "histogram":
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram value in metric %q: %v", spec, err)
+		}
+		return ssf.Histogram(name, float32(f), tags), nil
+	case "s", "set":
+		return ssf.Set(name, value, tags), nil
+	}
+	return nil, fmt.Errorf("invalid type %q in metric %q: must be one of count, gauge, timing, histogram or set", typ, spec)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestParseMetricSpec(t *testing.T) {
+	base := map[string]string{"team": "data", "env": "qa"}
+	tests := []struct {
+		spec     string
+		expected *ssf.SSFSample
+	}{
+		{"job.rows:1200:count", ssf.Count("job.rows", 1200, base)},
+		{"job.rows:1200:c:table:widgets,env:prod", ssf.Count("job.rows", 1200, map[string]string{"team": "data", "env": "prod", "table": "widgets"})},
+		{"job.ratio:0.5:gauge", ssf.Gauge("job.ratio", 0.5, base)},
+		{"job.duration:2.5s:timing", ssf.Timing("job.duration", 2500*time.Millisecond, time.Millisecond, base)},
+		{"job.duration:250:ms", ssf.Timing("job.duration", 250*time.Millisecond, time.Millisecond, base)},
+		{"job.size:42:h", ssf.Histogram("job.size", 42, base)},
+		{"job.users:alice:set:first", ssf.Set("job.users", "alice", map[string]string{"team": "data", "env": "qa", "first": ""})},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			sample, err := parseMetricSpec(test.spec, base)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, sample)
+		})
+	}
+
+	for _, spec := range []string{"job.rows", "job.rows:1200", ":1200:count", "job.rows:many:count", "job.duration:forever:timing", "job.rows:1200:counter"} {
+		_, err := parseMetricSpec(spec, nil)
+		assert.Error(t, err, spec)
+	}
+	// The base tags aren't changed by the metric's:
+	assert.Equal(t, map[string]string{"team": "data", "env": "qa"}, base)
+}
+
+func TestMetricFlagsRepeated(t *testing.T) {
+	_, passed := flags([]string{"veneur-emit",
+		"-metric", "job.rows:1200:count:table:widgets",
+		"-metric", "job.rows:300:count:table:gadgets",
+		"-metric", "job.duration:2.5s:timing",
+	})
+	require.NotNil(t, passed["metric"])
+
+	span := &ssf.SSFSpan{}
+	_, err := createMetric(span, passed, "", "env:prod", false, nil)
+	require.NoError(t, err)
+	require.Len(t, span.Metrics, 3)
+	// Each metric keeps its own tags:
+	assert.Equal(t, map[string]string{"env": "prod", "table": "widgets"}, span.Metrics[0].Tags)
+	assert.Equal(t, map[string]string{"env": "prod", "table": "gadgets"}, span.Metrics[1].Tags)
+	assert.Equal(t, map[string]string{"env": "prod"}, span.Metrics[2].Tags)
+	assert.Equal(t, float32(2500), span.Metrics[2].Value)
+}
+
+func TestMetricFlagsCombined(t *testing.T) {
+	metrics := &metricFlags{}
+	require.NoError(t, metrics.Set("job.ratio:0.5:g"))
+	assert.Error(t, metrics.Set("job.ratio"))
+
+	passed := map[string]flag.Value{
+		"count":  newValue("2"),
+		"metric": metrics,
+	}
+	span := &ssf.SSFSpan{}
+	_, err := createMetric(span, passed, "job.runs", "", false, nil)
+	require.NoError(t, err)
+	require.Len(t, span.Metrics, 2)
+	assert.Equal(t, "job.runs", span.Metrics[0].Name)
+	assert.Equal(t, "job.ratio", span.Metrics[1].Name)
+}
+
+func TestSendStatsdBatched(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	span := &ssf.SSFSpan{Metrics: []*ssf.SSFSample{
+		ssf.Count("job.rows", 1200, map[string]string{"table": "widgets"}),
+		ssf.Gauge("job.ratio", 0.5, nil),
+		ssf.Timing("job.duration", 2500*time.Millisecond, time.Millisecond, nil),
+		ssf.Set("job.users", "alice", nil),
+	}}
+	require.NoError(t, sendStatsd(conn.LocalAddr(), span))
+
+	// All the metrics arrive in a single datagram:
+	buf := make([]byte, 2048)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	lines := strings.Split(string(buf[:n]), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{
+		"job.duration:2500.000000|ms",
+		"job.ratio:0.500000|g",
+		"job.rows:1200|c|#table:widgets",
+		"job.users:alice|s",
+	}, lines)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// The environment variables that SSF spans pick up their trace context
+// from, when -trace_id isn't passed and VENEUR_EMIT_TRACE_ID isn't set.
+const (
+	envVeneurTraceID  = "VENEUR_TRACE_ID"
+	envVeneurParentID = "VENEUR_PARENT_SPAN_ID"
+	// envTraceparent is the W3C Trace Context header, as CI systems and
+	// OpenTelemetry instrumented tools propagate it.
+	envTraceparent = "TRACEPARENT"
+)
+
+// newSpanID returns a random, positive span ID.
+func newSpanID() (int64, error) {
+	bigid, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return 0, err
+	}
+	return bigid.Int64() + 1, nil
+}
+
+// traceContext is the trace that an SSF span is part of, and its
+// parent.
+type traceContext struct {
+	TraceIDHigh int64
+	TraceID     int64
+	ParentID    int64
+}
+
+// inferTraceContext returns the trace context that an SSF span should
+// have, if it wasn't passed: from VENEUR_TRACE_ID and
+// VENEUR_PARENT_SPAN_ID, or else from TRACEPARENT. Without any of those,
+// the context is returned as it is. As VENEUR_TRACE_ID only has the low
+// 64 bits of trace IDs, the high ones are taken from TRACEPARENT if it's
+// of the same trace.
+func inferTraceContext(tc traceContext, lookupEnv func(string) (string, bool)) (traceContext, error) {
+	if tc.TraceID != 0 {
+		return tc, nil
+	}
+	var fromTraceparent traceContext
+	var traceparentErr error
+	if traceparent, ok := lookupEnv(envTraceparent); ok && traceparent != "" {
+		var tp trace.Traceparent
+		tp, traceparentErr = trace.ParseTraceparent(traceparent)
+		fromTraceparent = traceContext{TraceIDHigh: tp.TraceIDHigh, TraceID: tp.TraceID, ParentID: tp.ParentID}
+	}
+
+	if strID, ok := lookupEnv(envVeneurTraceID); ok && strID != "" {
+		id, err := strconv.ParseInt(strID, 10, 64)
+		if err != nil {
+			return tc, fmt.Errorf("%s: %v", envVeneurTraceID, err)
+		}
+		inferred := traceContext{TraceID: id, ParentID: tc.ParentID}
+		if traceparentErr == nil && fromTraceparent.TraceID == id {
+			inferred.TraceIDHigh = fromTraceparent.TraceIDHigh
+		}
+		if inferred.ParentID == 0 {
+			if strID, ok := lookupEnv(envVeneurParentID); ok && strID != "" {
+				if inferred.ParentID, err = strconv.ParseInt(strID, 10, 64); err != nil {
+					return traceContext{TraceID: id}, fmt.Errorf("%s: %v", envVeneurParentID, err)
+				}
+			}
+		}
+		return inferred, nil
+	}
+	if traceparentErr != nil {
+		return tc, traceparentErr
+	}
+	if fromTraceparent.TraceID != 0 || fromTraceparent.TraceIDHigh != 0 {
+		if tc.ParentID != 0 {
+			fromTraceparent.ParentID = tc.ParentID
+		}
+		return fromTraceparent, nil
+	}
+	return tc, nil
+}
+
+// spanContextExports returns the shell export lines that make the
+// veneur-emits of later steps report their spans as children of span.
+func spanContextExports(span *ssf.SSFSpan) (string, error) {
+	if (span.TraceId == 0 && span.TraceIdHigh == 0) || span.Id == 0 {
+		return "", errors.New("the span has no trace context")
+	}
+	traceparent := trace.Traceparent{TraceIDHigh: span.TraceIdHigh, TraceID: span.TraceId, ParentID: span.Id, Sampled: true}
+	return fmt.Sprintf("export %s=%d\nexport %s=%d\nexport %s=%s\n",
+		envVeneurTraceID, span.TraceId,
+		envVeneurParentID, span.Id,
+		envTraceparent, traceparent), nil
+}
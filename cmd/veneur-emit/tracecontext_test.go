@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestInferTraceContext(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-00000000000000ff-01"
+	const traceparentOf255 = "0af7651916cd43dd00000000000000ff-00000000000000fe-01"
+	tests := []struct {
+		name     string
+		passed   traceContext
+		env      map[string]string
+		expected traceContext
+		error    bool
+	}{
+		{"no context", traceContext{}, nil, traceContext{}, false},
+		{"passed", traceContext{TraceID: 11, ParentID: 12}, map[string]string{envVeneurTraceID: "99", envTraceparent: traceparent}, traceContext{TraceID: 11, ParentID: 12}, false},
+		{"veneur env", traceContext{}, map[string]string{envVeneurTraceID: "99", envVeneurParentID: "98"}, traceContext{TraceID: 99, ParentID: 98}, false},
+		{"veneur env without parent", traceContext{}, map[string]string{envVeneurTraceID: "99"}, traceContext{TraceID: 99}, false},
+		{"veneur env over traceparent", traceContext{}, map[string]string{envVeneurTraceID: "99", envVeneurParentID: "98", envTraceparent: traceparent}, traceContext{TraceID: 99, ParentID: 98}, false},
+		{"veneur env of traceparent's trace", traceContext{}, map[string]string{envVeneurTraceID: "255", envVeneurParentID: "98", envTraceparent: "00-" + traceparentOf255}, traceContext{TraceIDHigh: 0x0af7651916cd43dd, TraceID: 255, ParentID: 98}, false},
+		{"traceparent", traceContext{}, map[string]string{envTraceparent: traceparent}, traceContext{TraceIDHigh: 0x0af7651916cd43dd, TraceID: -0x7bb714dee37fce64, ParentID: 255}, false},
+		{"traceparent with passed parent", traceContext{ParentID: 12}, map[string]string{envTraceparent: traceparent}, traceContext{TraceIDHigh: 0x0af7651916cd43dd, TraceID: -0x7bb714dee37fce64, ParentID: 12}, false},
+		{"bad veneur env", traceContext{}, map[string]string{envVeneurTraceID: "farts"}, traceContext{}, true},
+		{"bad traceparent", traceContext{}, map[string]string{envTraceparent: "farts"}, traceContext{}, true},
+	}
+	for _, elt := range tests {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			lookupEnv := func(key string) (string, bool) {
+				v, ok := test.env[key]
+				return v, ok
+			}
+			tc, err := inferTraceContext(test.passed, lookupEnv)
+			if test.error {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expected, tc)
+		})
+	}
+}
+
+func TestSpanContextExports(t *testing.T) {
+	exports, err := spanContextExports(&ssf.SSFSpan{TraceIdHigh: 0x0af7651916cd43dd, TraceId: 255, Id: 42, ParentId: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "export VENEUR_TRACE_ID=255\n"+
+		"export VENEUR_PARENT_SPAN_ID=42\n"+
+		"export TRACEPARENT=00-0af7651916cd43dd00000000000000ff-000000000000002a-01\n", exports)
+
+	// What's printed is picked up by the next step, in all its
+	// bits:
+	env := map[string]string{
+		"VENEUR_TRACE_ID":       "255",
+		"VENEUR_PARENT_SPAN_ID": "42",
+		"TRACEPARENT":           "00-0af7651916cd43dd00000000000000ff-000000000000002a-01",
+	}
+	tc, err := inferTraceContext(traceContext{}, func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	})
+	require.NoError(t, err)
+	assert.Equal(t, traceContext{TraceIDHigh: 0x0af7651916cd43dd, TraceID: 255, ParentID: 42}, tc)
+
+	_, err = spanContextExports(&ssf.SSFSpan{})
+	assert.Error(t, err)
+}
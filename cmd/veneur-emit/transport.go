@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"google.golang.org/grpc"
+)
+
+// DefaultTimeout bounds how long sending an SSF span takes, by default.
+const DefaultTimeout = 10 * time.Second
+
+// deliverSSF sends a span to an SSF receiver: to veneur's gRPC Forward
+// service if useGRPC is set, framed over a connection to a tcp://
+// address, and otherwise with a trace client, over UDP or a unix
+// socket. Connecting and sending are bounded by timeout, if it's
+// positive.
+func deliverSSF(addr string, netAddr net.Addr, span *ssf.SSFSpan, useGRPC bool, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if useGRPC {
+		return sendGRPC(ctx, netAddr, span)
+	}
+	if _, ok := netAddr.(*net.TCPAddr); ok {
+		return sendTCP(ctx, netAddr, span)
+	}
+
+	client, err := trace.NewClient(addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return sendSSF(ctx, client, span)
+}
+
+// sendGRPC sends a span with the SendSpans RPC of veneur's Forward
+// service. The connection isn't waited for before the RPC, so that
+// connecting and sending take as few round trips as they can.
+func sendGRPC(ctx context.Context, netAddr net.Addr, span *ssf.SSFSpan) error {
+	if _, ok := netAddr.(*net.TCPAddr); !ok {
+		return fmt.Errorf("gRPC needs a TCP address, not a %s one", netAddr.Network())
+	}
+	conn, err := grpc.DialContext(ctx, netAddr.String(), grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = forwardrpc.NewForwardClient(conn).SendSpans(ctx, &forwardrpc.SpanList{Spans: []*ssf.SSFSpan{span}})
+	return err
+}
+
+// sendTCP writes a span as a frame to veneur's SSF listener on a TCP
+// connection. Veneur closes connections once it's read everything that
+// was sent on them, so the span was delivered once the connection, half
+// closed after the frame, is closed by veneur.
+func sendTCP(ctx context.Context, netAddr net.Addr, span *ssf.SSFSpan) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, netAddr.Network(), netAddr.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	if _, err := protocol.WriteSSF(conn, span); err != nil {
+		return err
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		return fmt.Errorf("waiting for veneur to read the span: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testSSFSpan() *ssf.SSFSpan {
+	return &ssf.SSFSpan{
+		Id:             2,
+		TraceId:        1,
+		Name:           "ci.step",
+		StartTimestamp: 1,
+		EndTimestamp:   2,
+		Metrics:        []*ssf.SSFSample{ssf.Count("ci.steps", 1, map[string]string{"step": "build"})},
+	}
+}
+
+func TestDeliverSSFTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	received := make(chan *ssf.SSFSpan, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// Like veneur, read until the client hangs up, then
+		// close:
+		defer conn.Close()
+		for {
+			span, err := protocol.ReadSSF(conn)
+			if err != nil {
+				return
+			}
+			received <- span
+		}
+	}()
+
+	span := testSSFSpan()
+	require.NoError(t, deliverSSF("tcp://"+ln.Addr().String(), ln.Addr(), span, false, time.Second))
+	select {
+	case got := <-received:
+		assert.Equal(t, span.Name, got.Name)
+		assert.Equal(t, span.Metrics[0].Name, got.Metrics[0].Name)
+	default:
+		t.Fatal("the span wasn't read before delivery returned")
+	}
+}
+
+func TestDeliverSSFTCPTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// A listener that never reads the span, nor closes:
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(2 * time.Second)
+	}()
+
+	start := time.Now()
+	err = deliverSSF("tcp://"+ln.Addr().String(), ln.Addr(), testSSFSpan(), false, 100*time.Millisecond)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+}
+
+type fakeForwardServer struct {
+	spans chan []*ssf.SSFSpan
+	err   error
+}
+
+func (f *fakeForwardServer) SendMetrics(context.Context, *forwardrpc.MetricList) (*empty.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "no metrics")
+}
+
+func (f *fakeForwardServer) SendMetricsStream(forwardrpc.Forward_SendMetricsStreamServer) error {
+	return status.Error(codes.Unimplemented, "no metrics")
+}
+
+func (f *fakeForwardServer) SendSpans(ctx context.Context, slist *forwardrpc.SpanList) (*empty.Empty, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.spans <- slist.Spans
+	return &empty.Empty{}, nil
+}
+
+func serveFakeForward(t *testing.T, fake *fakeForwardServer) (net.Addr, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	forwardrpc.RegisterForwardServer(srv, fake)
+	go srv.Serve(ln)
+	return ln.Addr(), srv.Stop
+}
+
+func TestDeliverSSFGRPC(t *testing.T) {
+	fake := &fakeForwardServer{spans: make(chan []*ssf.SSFSpan, 1)}
+	addr, stop := serveFakeForward(t, fake)
+	defer stop()
+
+	span := testSSFSpan()
+	require.NoError(t, deliverSSF("tcp://"+addr.String(), addr, span, true, time.Second))
+	spans := <-fake.spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, span.Name, spans[0].Name)
+	assert.Equal(t, span.Metrics[0].Name, spans[0].Metrics[0].Name)
+}
+
+func TestDeliverSSFGRPCErrors(t *testing.T) {
+	fake := &fakeForwardServer{err: status.Error(codes.PermissionDenied, "no token")}
+	addr, stop := serveFakeForward(t, fake)
+	defer stop()
+	err := deliverSSF("tcp://"+addr.String(), addr, testSSFSpan(), true, time.Second)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Nothing listens on a closed port:
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := ln.Addr()
+	ln.Close()
+	start := time.Now()
+	err = deliverSSF("tcp://"+closed.String(), closed, testSSFSpan(), true, 5*time.Second)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "took %v", time.Since(start))
+
+	unix := &net.UnixAddr{Name: "/tmp/veneur.sock", Net: "unix"}
+	assert.Error(t, deliverSSF("unix:///tmp/veneur.sock", unix, testSSFSpan(), true, time.Second))
+}
+
+func TestDeliverSSFUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	span := testSSFSpan()
+	require.NoError(t, deliverSSF("udp://"+conn.LocalAddr().String(), conn.LocalAddr(), span, false, time.Second))
+	buf := make([]byte, 2048)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	got, err := protocol.ParseSSF(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, span.Name, got.Name)
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"flag"
+	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/veneur"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
+	"gopkg.in/yaml.v2"
 )
 
 var (
-	configFile = flag.String("f", "", "The config file to read for settings.")
+	configFile           = flag.String("f", "", "The config file to read for settings.")
+	validateConfig       = flag.Bool("validate-config", false, "Validate the config file, print the settings it results in (with credentials redacted), then exit: nonzero if it has unknown keys or invalid settings.")
+	validateConfigStrict = flag.Bool("validate-config-strict", false, "Refuse to start if the config file has unknown keys or invalid settings, instead of warning about them.")
 )
 
 func init() {
@@ -26,12 +30,22 @@ func main() {
 
 	conf, err := veneur.ReadProxyConfig(*configFile)
 	if err != nil {
-		if _, ok := err.(*veneur.UnknownConfigKeys); ok {
-			logrus.WithError(err).Warn("Config contains invalid or deprecated keys")
-		} else {
+		if _, ok := err.(*veneur.UnknownConfigKeys); !ok {
 			logrus.WithError(err).Fatal("Error reading config file")
 		}
 	}
+	valid := checkConfig(err, conf.Validate(), *validateConfig || *validateConfigStrict)
+
+	if *validateConfig {
+		printConfig(conf.Redacted())
+		if !valid {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if !valid {
+		logrus.Fatal("Refusing to start with an invalid config")
+	}
 
 	logger := logrus.StandardLogger()
 	proxy, err := veneur.NewProxyFromConfig(logger, conf)
@@ -56,3 +70,31 @@ func main() {
 
 	proxy.Serve()
 }
+
+// checkConfig logs the unknown keys and the problems found with the
+// config. They are errors if strict is set, and warnings otherwise; it
+// returns false only for errors.
+func checkConfig(unknownKeys, invalid error, strict bool) bool {
+	logProblem := logrus.Warn
+	if strict {
+		logProblem = logrus.Error
+	}
+	if unknownKeys != nil {
+		logProblem("Config contains invalid or deprecated keys: ", unknownKeys)
+	}
+	if invalid, ok := invalid.(*veneur.InvalidConfig); ok {
+		for _, problem := range invalid.Problems {
+			logProblem("Invalid config: ", problem)
+		}
+	}
+	return !strict || (unknownKeys == nil && invalid == nil)
+}
+
+// printConfig prints the config's settings, as YAML.
+func printConfig(conf interface{}) {
+	out, err := yaml.Marshal(conf)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not print the config")
+	}
+	os.Stdout.Write(out)
+}
@@ -10,12 +10,13 @@ import (
 	"github.com/stripe/veneur"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
+	"gopkg.in/yaml.v2"
 )
 
 var (
 	configFile           = flag.String("f", "", "The config file to read for settings.")
-	validateConfig       = flag.Bool("validate-config", false, "Validate the config file is valid YAML with correct value types, then immediately exit.")
-	validateConfigStrict = flag.Bool("validate-config-strict", false, "Validate as with -validate-config, but also fail if there are any unknown fields.")
+	validateConfig       = flag.Bool("validate-config", false, "Validate the config file, print the settings it results in (with credentials redacted), then exit: nonzero if it has unknown keys or invalid settings.")
+	validateConfigStrict = flag.Bool("validate-config-strict", false, "Refuse to start if the config file has unknown keys or invalid settings, instead of warning about them.")
 )
 
 func init() {
@@ -31,20 +32,22 @@ func main() {
 
 	conf, err := veneur.ReadConfig(*configFile)
 	if err != nil {
-		if _, ok := err.(*veneur.UnknownConfigKeys); ok {
-			if *validateConfigStrict {
-				logrus.WithError(err).Fatal("Config contains invalid or deprecated keys")
-			} else {
-				logrus.WithError(err).Warn("Config contains invalid or deprecated keys")
-			}
-		} else {
+		if _, ok := err.(*veneur.UnknownConfigKeys); !ok {
 			logrus.WithError(err).Fatal("Error reading config file")
 		}
 	}
+	valid := checkConfig(err, conf.Validate(), *validateConfig || *validateConfigStrict)
 
 	if *validateConfig {
+		printConfig(conf.Redacted())
+		if !valid {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
+	if !valid {
+		logrus.Fatal("Refusing to start with an invalid config")
+	}
 
 	logger := logrus.StandardLogger()
 	server, err := veneur.NewFromConfig(logger, conf)
@@ -89,10 +92,42 @@ func main() {
 		trace.DefaultClient = server.TraceClient
 	}
 	server.Start()
+	server.EnableConfigReload(*configFile)
 
+	stopped := make(chan struct{})
 	if conf.HTTPAddress != "" || conf.GrpcAddress != "" {
-		server.Serve()
-	} else {
-		select {}
+		go func() {
+			server.Serve()
+			close(stopped)
+		}()
+	}
+	server.ShutdownOnSignal(stopped)
+}
+
+// checkConfig logs the unknown keys and the problems found with the
+// config. They are errors if strict is set, and warnings otherwise; it
+// returns false only for errors.
+func checkConfig(unknownKeys, invalid error, strict bool) bool {
+	logProblem := logrus.Warn
+	if strict {
+		logProblem = logrus.Error
+	}
+	if unknownKeys != nil {
+		logProblem("Config contains invalid or deprecated keys: ", unknownKeys)
+	}
+	if invalid, ok := invalid.(*veneur.InvalidConfig); ok {
+		for _, problem := range invalid.Problems {
+			logProblem("Invalid config: ", problem)
+		}
+	}
+	return !strict || (unknownKeys == nil && invalid == nil)
+}
+
+// printConfig prints the config's settings, as YAML.
+func printConfig(conf interface{}) {
+	out, err := yaml.Marshal(conf)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not print the config")
 	}
+	os.Stdout.Write(out)
 }
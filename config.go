@@ -1,94 +1,322 @@
 package veneur
 
 type Config struct {
-	Aggregates                   []string  `yaml:"aggregates"`
-	AwsAccessKeyID               string    `yaml:"aws_access_key_id"`
-	AwsRegion                    string    `yaml:"aws_region"`
-	AwsS3Bucket                  string    `yaml:"aws_s3_bucket"`
-	AwsSecretAccessKey           string    `yaml:"aws_secret_access_key"`
-	BlockProfileRate             int       `yaml:"block_profile_rate"`
-	DatadogAPIHostname           string    `yaml:"datadog_api_hostname"`
-	DatadogAPIKey                string    `yaml:"datadog_api_key"`
-	DatadogFlushMaxPerBody       int       `yaml:"datadog_flush_max_per_body"`
-	DatadogSpanBufferSize        int       `yaml:"datadog_span_buffer_size"`
-	DatadogTraceAPIAddress       string    `yaml:"datadog_trace_api_address"`
-	Debug                        bool      `yaml:"debug"`
-	DebugFlushedMetrics          bool      `yaml:"debug_flushed_metrics"`
-	DebugIngestedSpans           bool      `yaml:"debug_ingested_spans"`
-	EnableProfiling              bool      `yaml:"enable_profiling"`
-	FalconerAddress              string    `yaml:"falconer_address"`
-	FlushFile                    string    `yaml:"flush_file"`
-	FlushMaxPerBody              int       `yaml:"flush_max_per_body"`
-	ForwardAddress               string    `yaml:"forward_address"`
-	ForwardUseGrpc               bool      `yaml:"forward_use_grpc"`
-	GrpcAddress                  string    `yaml:"grpc_address"`
-	Hostname                     string    `yaml:"hostname"`
-	HTTPAddress                  string    `yaml:"http_address"`
-	IndicatorSpanTimerName       string    `yaml:"indicator_span_timer_name"`
-	Interval                     string    `yaml:"interval"`
-	KafkaBroker                  string    `yaml:"kafka_broker"`
-	KafkaCheckTopic              string    `yaml:"kafka_check_topic"`
-	KafkaEventTopic              string    `yaml:"kafka_event_topic"`
-	KafkaMetricBufferBytes       int       `yaml:"kafka_metric_buffer_bytes"`
-	KafkaMetricBufferFrequency   string    `yaml:"kafka_metric_buffer_frequency"`
-	KafkaMetricBufferMessages    int       `yaml:"kafka_metric_buffer_messages"`
-	KafkaMetricRequireAcks       string    `yaml:"kafka_metric_require_acks"`
-	KafkaMetricTopic             string    `yaml:"kafka_metric_topic"`
-	KafkaPartitioner             string    `yaml:"kafka_partitioner"`
-	KafkaRetryMax                int       `yaml:"kafka_retry_max"`
-	KafkaSpanBufferBytes         int       `yaml:"kafka_span_buffer_bytes"`
-	KafkaSpanBufferFrequency     string    `yaml:"kafka_span_buffer_frequency"`
-	KafkaSpanBufferMesages       int       `yaml:"kafka_span_buffer_mesages"`
-	KafkaSpanRequireAcks         string    `yaml:"kafka_span_require_acks"`
-	KafkaSpanSampleRatePercent   int       `yaml:"kafka_span_sample_rate_percent"`
-	KafkaSpanSampleTag           string    `yaml:"kafka_span_sample_tag"`
-	KafkaSpanSerializationFormat string    `yaml:"kafka_span_serialization_format"`
-	KafkaSpanTopic               string    `yaml:"kafka_span_topic"`
-	LightstepAccessToken         string    `yaml:"lightstep_access_token"`
-	LightstepCollectorHost       string    `yaml:"lightstep_collector_host"`
-	LightstepMaximumSpans        int       `yaml:"lightstep_maximum_spans"`
-	LightstepNumClients          int       `yaml:"lightstep_num_clients"`
-	LightstepReconnectPeriod     string    `yaml:"lightstep_reconnect_period"`
-	MetricMaxLength              int       `yaml:"metric_max_length"`
-	MutexProfileFraction         int       `yaml:"mutex_profile_fraction"`
-	NumReaders                   int       `yaml:"num_readers"`
-	NumSpanWorkers               int       `yaml:"num_span_workers"`
-	NumWorkers                   int       `yaml:"num_workers"`
-	OmitEmptyHostname            bool      `yaml:"omit_empty_hostname"`
-	Percentiles                  []float64 `yaml:"percentiles"`
-	ReadBufferSizeBytes          int       `yaml:"read_buffer_size_bytes"`
-	SentryDsn                    string    `yaml:"sentry_dsn"`
-	SignalfxAPIKey               string    `yaml:"signalfx_api_key"`
-	SignalfxEndpointBase         string    `yaml:"signalfx_endpoint_base"`
-	SignalfxHostnameTag          string    `yaml:"signalfx_hostname_tag"`
-	SignalfxPerTagAPIKeys        []struct {
+	AggregateOverrides                           map[string][]string  `yaml:"aggregate_overrides"`
+	Aggregates                                   []string             `yaml:"aggregates"`
+	AwsAccessKeyID                               string               `yaml:"aws_access_key_id"`
+	AwsRegion                                    string               `yaml:"aws_region"`
+	AwsS3Bucket                                  string               `yaml:"aws_s3_bucket"`
+	AwsS3BucketOwnerFullControl                  bool                 `yaml:"aws_s3_bucket_owner_full_control"`
+	AwsS3Format                                  string               `yaml:"aws_s3_format"`
+	AwsS3KeyTemplate                             string               `yaml:"aws_s3_key_template"`
+	AwsS3MultipartThresholdBytes                 int                  `yaml:"aws_s3_multipart_threshold_bytes"`
+	AwsS3ParquetRowGroupSize                     int                  `yaml:"aws_s3_parquet_row_group_size"`
+	AwsS3ParquetTagColumns                       []string             `yaml:"aws_s3_parquet_tag_columns"`
+	AwsS3SSEKMS                                  bool                 `yaml:"aws_s3_sse_kms"`
+	AwsS3SSEKMSKeyID                             string               `yaml:"aws_s3_sse_kms_key_id"`
+	AwsSecretAccessKey                           string               `yaml:"aws_secret_access_key"`
+	BlackholeSink                                bool                 `yaml:"blackhole_sink"`
+	BlockProfileRate                             int                  `yaml:"block_profile_rate"`
+	CardinalityLimit                             int                  `yaml:"cardinality_limit"`
+	CardinalityLimitOverflow                     string               `yaml:"cardinality_limit_overflow"`
+	CardinalityLimitPrefixes                     map[string]int       `yaml:"cardinality_limit_prefixes"`
+	CloudWatchDimensionPriority                  []string             `yaml:"cloudwatch_dimension_priority"`
+	CloudWatchEndpoint                           string               `yaml:"cloudwatch_endpoint"`
+	CloudWatchNamespace                          string               `yaml:"cloudwatch_namespace"`
+	CloudWatchRegion                             string               `yaml:"cloudwatch_region"`
+	CloudWatchStatisticSets                      bool                 `yaml:"cloudwatch_statistic_sets"`
+	CumulativeCounterExpiryIntervals             int                  `yaml:"cumulative_counter_expiry_intervals"`
+	CumulativeCounters                           []string             `yaml:"cumulative_counters"`
+	DatadogAPIHostname                           string               `yaml:"datadog_api_hostname"`
+	DatadogAPIKey                                string               `yaml:"datadog_api_key"`
+	DatadogFlushMaxPerBody                       int                  `yaml:"datadog_flush_max_per_body"`
+	DatadogSpanBufferSize                        int                  `yaml:"datadog_span_buffer_size"`
+	DatadogTraceAPIAddress                       string               `yaml:"datadog_trace_api_address"`
+	Debug                                        bool                 `yaml:"debug"`
+	DebugFlushedMetrics                          bool                 `yaml:"debug_flushed_metrics"`
+	DebugIngestedSpans                           bool                 `yaml:"debug_ingested_spans"`
+	DebugSinkColor                               bool                 `yaml:"debug_sink_color"`
+	DebugSinkFilter                              string               `yaml:"debug_sink_filter"`
+	DebugSinkFormat                              string               `yaml:"debug_sink_format"`
+	DebugSinkOutput                              string               `yaml:"debug_sink_output"`
+	DebugSinkSampleRate                          int                  `yaml:"debug_sink_sample_rate"`
+	ElasticsearchAddress                         string               `yaml:"elasticsearch_address"`
+	ElasticsearchAPIKey                          string               `yaml:"elasticsearch_api_key"`
+	ElasticsearchBatchBytes                      int                  `yaml:"elasticsearch_batch_bytes"`
+	ElasticsearchBatchSize                       int                  `yaml:"elasticsearch_batch_size"`
+	ElasticsearchIndex                           string               `yaml:"elasticsearch_index"`
+	ElasticsearchPassword                        string               `yaml:"elasticsearch_password"`
+	ElasticsearchSpanBufferSize                  int                  `yaml:"elasticsearch_span_buffer_size"`
+	ElasticsearchSpanSampleRate                  int                  `yaml:"elasticsearch_span_sample_rate"`
+	ElasticsearchTLSAuthorityCertificate         string               `yaml:"elasticsearch_tls_authority_certificate"`
+	ElasticsearchTLSCertificate                  string               `yaml:"elasticsearch_tls_certificate"`
+	ElasticsearchTLSKey                          string               `yaml:"elasticsearch_tls_key"`
+	ElasticsearchUsername                        string               `yaml:"elasticsearch_username"`
+	EnableProfiling                              bool                 `yaml:"enable_profiling"`
+	FalconerAddress                              string               `yaml:"falconer_address"`
+	FlushFile                                    string               `yaml:"flush_file"`
+	FlushFileCompress                            bool                 `yaml:"flush_file_compress"`
+	FlushFileFormat                              string               `yaml:"flush_file_format"`
+	FlushFileMaxAge                              string               `yaml:"flush_file_max_age"`
+	FlushFileMaxFiles                            int                  `yaml:"flush_file_max_files"`
+	FlushFileMaxSizeBytes                        int64                `yaml:"flush_file_max_size_bytes"`
+	FlushMaxPerBody                              int                  `yaml:"flush_max_per_body"`
+	FlushTraceEnabled                            bool                 `yaml:"flush_trace_enabled"`
+	FlushTraceSampleRate                         float64              `yaml:"flush_trace_sample_rate"`
+	FlushWatchdogAction                          string               `yaml:"flush_watchdog_action"`
+	FlushWatchdogMissedFlushes                   int                  `yaml:"flush_watchdog_missed_flushes"`
+	ForwardAddress                               string               `yaml:"forward_address"`
+	ForwardAddressRefreshInterval                string               `yaml:"forward_address_refresh_interval"`
+	ForwardGrpcAuthToken                         string               `yaml:"forward_grpc_auth_token"`
+	ForwardGrpcCompression                       string               `yaml:"forward_grpc_compression"`
+	ForwardGrpcStream                            bool                 `yaml:"forward_grpc_stream"`
+	ForwardGrpcStreamBatchSize                   int                  `yaml:"forward_grpc_stream_batch_size"`
+	ForwardGrpcTLSAuthorityCertificate           string               `yaml:"forward_grpc_tls_authority_certificate"`
+	ForwardGrpcTLSCertificate                    string               `yaml:"forward_grpc_tls_certificate"`
+	ForwardGrpcTLSKey                            string               `yaml:"forward_grpc_tls_key"`
+	ForwardTLSAuthorityCertificateFile           string               `yaml:"forward_tls_authority_certificate_file"`
+	ForwardTLSCertificateFile                    string               `yaml:"forward_tls_certificate_file"`
+	ForwardTLSKeyFile                            string               `yaml:"forward_tls_key_file"`
+	ForwardTLSServerName                         string               `yaml:"forward_tls_server_name"`
+	ForwardUseGrpc                               bool                 `yaml:"forward_use_grpc"`
+	GaugeAggregations                            map[string]string    `yaml:"gauge_aggregations"`
+	GaugeRateExpiryIntervals                     int                  `yaml:"gauge_rate_expiry_intervals"`
+	GaugeRateMaxContexts                         int                  `yaml:"gauge_rate_max_contexts"`
+	GaugeRateNames                               []string             `yaml:"gauge_rate_names"`
+	GaugeRatePrefixes                            []string             `yaml:"gauge_rate_prefixes"`
+	GcsBucket                                    string               `yaml:"gcs_bucket"`
+	GcsCredentialsFile                           string               `yaml:"gcs_credentials_file"`
+	GcsFormat                                    string               `yaml:"gcs_format"`
+	GcsKeyTemplate                               string               `yaml:"gcs_key_template"`
+	GcsParquetRowGroupSize                       int                  `yaml:"gcs_parquet_row_group_size"`
+	GcsParquetTagColumns                         []string             `yaml:"gcs_parquet_tag_columns"`
+	GcsUncompressed                              bool                 `yaml:"gcs_uncompressed"`
+	GraphiteAddress                              string               `yaml:"graphite_address"`
+	GraphiteBufferSize                           int                  `yaml:"graphite_buffer_size"`
+	GraphiteTemplate                             string               `yaml:"graphite_template"`
+	GraphiteWriteTimeout                         string               `yaml:"graphite_write_timeout"`
+	GrpcAddress                                  string               `yaml:"grpc_address"`
+	GrpcAuthPermissive                           bool                 `yaml:"grpc_auth_permissive"`
+	GrpcAuthToken                                string               `yaml:"grpc_auth_token"`
+	GrpcMaxRecvMsgSize                           int                  `yaml:"grpc_max_recv_msg_size"`
+	GrpcMaxSendMsgSize                           int                  `yaml:"grpc_max_send_msg_size"`
+	GrpcMaxSpanBatchSize                         int                  `yaml:"grpc_max_span_batch_size"`
+	GrpcTLSAuthorityCertificate                  string               `yaml:"grpc_tls_authority_certificate"`
+	GrpcTLSCertificate                           string               `yaml:"grpc_tls_certificate"`
+	GrpcTLSKey                                   string               `yaml:"grpc_tls_key"`
+	HistogramExemplars                           int                  `yaml:"histogram_exemplars"`
+	HistogramWindowIntervals                     int                  `yaml:"histogram_window_intervals"`
+	HistogramWindowIntervalsPrefixes             map[string]int       `yaml:"histogram_window_intervals_prefixes"`
+	HoneycombAPIHost                             string               `yaml:"honeycomb_api_host"`
+	HoneycombAPIKey                              string               `yaml:"honeycomb_api_key"`
+	HoneycombBatchSize                           int                  `yaml:"honeycomb_batch_size"`
+	HoneycombDataset                             string               `yaml:"honeycomb_dataset"`
+	HoneycombSpanBufferSize                      int                  `yaml:"honeycomb_span_buffer_size"`
+	HoneycombSpanSampleRate                      int                  `yaml:"honeycomb_span_sample_rate"`
+	Hostname                                     string               `yaml:"hostname"`
+	HTTPAddress                                  string               `yaml:"http_address"`
+	HTTPTLSCertificateFile                       string               `yaml:"http_tls_certificate_file"`
+	HTTPTLSClientAuthorityCertificateFile        string               `yaml:"http_tls_client_authority_certificate_file"`
+	HTTPTLSKeyFile                               string               `yaml:"http_tls_key_file"`
+	IndicatorSpanTimerName                       string               `yaml:"indicator_span_timer_name"`
+	InfluxDBAddress                              string               `yaml:"influxdb_address"`
+	InfluxDBBatchSize                            int                  `yaml:"influxdb_batch_size"`
+	InfluxDBBucket                               string               `yaml:"influxdb_bucket"`
+	InfluxDBDatabase                             string               `yaml:"influxdb_database"`
+	InfluxDBMaxPayloadBytes                      int                  `yaml:"influxdb_max_payload_bytes"`
+	InfluxDBOrg                                  string               `yaml:"influxdb_org"`
+	InfluxDBPassword                             string               `yaml:"influxdb_password"`
+	InfluxDBRetentionPolicy                      string               `yaml:"influxdb_retention_policy"`
+	InfluxDBToken                                string               `yaml:"influxdb_token"`
+	InfluxDBUsername                             string               `yaml:"influxdb_username"`
+	InternalMetricsSink                          string               `yaml:"internal_metrics_sink"`
+	Interval                                     string               `yaml:"interval"`
+	KafkaBroker                                  string               `yaml:"kafka_broker"`
+	KafkaCheckTopic                              string               `yaml:"kafka_check_topic"`
+	KafkaEventTopic                              string               `yaml:"kafka_event_topic"`
+	KafkaHeaders                                 map[string]string    `yaml:"kafka_headers"`
+	KafkaHeadersEnabled                          bool                 `yaml:"kafka_headers_enabled"`
+	KafkaMetricBufferBytes                       int                  `yaml:"kafka_metric_buffer_bytes"`
+	KafkaMetricBufferFrequency                   string               `yaml:"kafka_metric_buffer_frequency"`
+	KafkaMetricBufferMessages                    int                  `yaml:"kafka_metric_buffer_messages"`
+	KafkaMetricPartitionKey                      string               `yaml:"kafka_metric_partition_key"`
+	KafkaMetricSerializationFormat               string               `yaml:"kafka_metric_serialization_format"`
+	KafkaMetricRequireAcks                       string               `yaml:"kafka_metric_require_acks"`
+	KafkaMetricTopic                             string               `yaml:"kafka_metric_topic"`
+	KafkaPartitioner                             string               `yaml:"kafka_partitioner"`
+	KafkaRetryQueueMaxAttempts                   int                  `yaml:"kafka_retry_queue_max_attempts"`
+	KafkaRetryQueueSize                          int                  `yaml:"kafka_retry_queue_size"`
+	KafkaRetryMax                                int                  `yaml:"kafka_retry_max"`
+	KafkaSaslMechanism                           string               `yaml:"kafka_sasl_mechanism"`
+	KafkaSaslPassword                            string               `yaml:"kafka_sasl_password"`
+	KafkaSaslPasswordFile                        string               `yaml:"kafka_sasl_password_file"`
+	KafkaSaslUsername                            string               `yaml:"kafka_sasl_username"`
+	KafkaSchemaRegistryPassword                  string               `yaml:"kafka_schema_registry_password"`
+	KafkaSchemaRegistryURL                       string               `yaml:"kafka_schema_registry_url"`
+	KafkaSchemaRegistryUsername                  string               `yaml:"kafka_schema_registry_username"`
+	KafkaSpanBufferBytes                         int                  `yaml:"kafka_span_buffer_bytes"`
+	KafkaSpanBufferFrequency                     string               `yaml:"kafka_span_buffer_frequency"`
+	KafkaSpanBufferMesages                       int                  `yaml:"kafka_span_buffer_mesages"`
+	KafkaSpanPartitionKey                        string               `yaml:"kafka_span_partition_key"`
+	KafkaSpanRequireAcks                         string               `yaml:"kafka_span_require_acks"`
+	KafkaSpanSampleKeepTag                       string               `yaml:"kafka_span_sample_keep_tag"`
+	KafkaSpanSampleRate                          int                  `yaml:"kafka_span_sample_rate"`
+	KafkaSpanSampleRatePercent                   int                  `yaml:"kafka_span_sample_rate_percent"`
+	KafkaSpanSampleTag                           string               `yaml:"kafka_span_sample_tag"`
+	KafkaSpanSerializationFormat                 string               `yaml:"kafka_span_serialization_format"`
+	KafkaSpanTopic                               string               `yaml:"kafka_span_topic"`
+	KafkaSpanTopicTemplate                       string               `yaml:"kafka_span_topic_template"`
+	KafkaTLSAuthorityCertificate                 string               `yaml:"kafka_tls_authority_certificate"`
+	KafkaTLSCertificate                          string               `yaml:"kafka_tls_certificate"`
+	KafkaTLSEnabled                              bool                 `yaml:"kafka_tls_enabled"`
+	KafkaTLSInsecureSkipVerify                   bool                 `yaml:"kafka_tls_insecure_skip_verify"`
+	KafkaTLSKey                                  string               `yaml:"kafka_tls_key"`
+	LightstepAccessToken                         string               `yaml:"lightstep_access_token"`
+	LightstepAccessTokenFile                     string               `yaml:"lightstep_access_token_file"`
+	LightstepCollectorHost                       string               `yaml:"lightstep_collector_host"`
+	LightstepCollectorHosts                      []string             `yaml:"lightstep_collector_hosts"`
+	LightstepMaximumSpans                        int                  `yaml:"lightstep_maximum_spans"`
+	LightstepNumClients                          int                  `yaml:"lightstep_num_clients"`
+	LightstepReconnectPeriod                     string               `yaml:"lightstep_reconnect_period"`
+	LightstepRefreshPeriod                       string               `yaml:"lightstep_refresh_period"`
+	MetricMaxLength                              int                  `yaml:"metric_max_length"`
+	MetricNameAllowPatterns                      []string             `yaml:"metric_name_allow_patterns"`
+	MetricNameDenyPatterns                       []string             `yaml:"metric_name_deny_patterns"`
+	MetricRewriteRules                           []MetricRewriteRule  `yaml:"metric_rewrite_rules"`
+	MetricSinkFlushTimeout                       string               `yaml:"metric_sink_flush_timeout"`
+	MetricSinkFlushTimeouts                      map[string]string    `yaml:"metric_sink_flush_timeouts"`
+	MetricSinkMaxStragglers                      int                  `yaml:"metric_sink_max_stragglers"`
+	MutexProfileFraction                         int                  `yaml:"mutex_profile_fraction"`
+	NewRelicInsertKey                            string               `yaml:"newrelic_insert_key"`
+	NewRelicRegion                               string               `yaml:"newrelic_region"`
+	NumReaders                                   int                  `yaml:"num_readers"`
+	NumSpanWorkers                               int                  `yaml:"num_span_workers"`
+	NumUDPSockets                                int                  `yaml:"num_udp_sockets"`
+	NumWorkers                                   int                  `yaml:"num_workers"`
+	OmitEmptyHostname                            bool                 `yaml:"omit_empty_hostname"`
+	OTLPMetricEndpoint                           string               `yaml:"otlp_metric_endpoint"`
+	OTLPMetricHeaders                            map[string]string    `yaml:"otlp_metric_headers"`
+	OTLPMetricInsecure                           bool                 `yaml:"otlp_metric_insecure"`
+	OTLPMetricProtocol                           string               `yaml:"otlp_metric_protocol"`
+	OTLPMetricTimeout                            string               `yaml:"otlp_metric_timeout"`
+	OTLPMetricTLSAuthorityCertificate            string               `yaml:"otlp_metric_tls_authority_certificate"`
+	OTLPMetricTLSCertificate                     string               `yaml:"otlp_metric_tls_certificate"`
+	OTLPMetricTLSKey                             string               `yaml:"otlp_metric_tls_key"`
+	OTLPTraceEndpoint                            string               `yaml:"otlp_trace_endpoint"`
+	OTLPTraceExportTimeout                       string               `yaml:"otlp_trace_export_timeout"`
+	OTLPTraceHeaders                             map[string]string    `yaml:"otlp_trace_headers"`
+	OTLPTraceInsecure                            bool                 `yaml:"otlp_trace_insecure"`
+	OTLPTraceSpanBufferSize                      int                  `yaml:"otlp_trace_span_buffer_size"`
+	OTLPTraceTLSAuthorityCertificate             string               `yaml:"otlp_trace_tls_authority_certificate"`
+	OTLPTraceTLSCertificate                      string               `yaml:"otlp_trace_tls_certificate"`
+	OTLPTraceTLSKey                              string               `yaml:"otlp_trace_tls_key"`
+	Percentiles                                  []float64            `yaml:"percentiles"`
+	PercentilesOverrides                         map[string][]float64 `yaml:"percentiles_overrides"`
+	PrometheusExpositionCounterExpiryIntervals   int                  `yaml:"prometheus_exposition_counter_expiry_intervals"`
+	PrometheusExpositionEnabled                  bool                 `yaml:"prometheus_exposition_enabled"`
+	PrometheusExpositionSummaries                bool                 `yaml:"prometheus_exposition_summaries"`
+	PrometheusRemoteWriteAddress                 string               `yaml:"prometheus_remote_write_address"`
+	PrometheusRemoteWriteBasicAuthPassword       string               `yaml:"prometheus_remote_write_basic_auth_password"`
+	PrometheusRemoteWriteBasicAuthUsername       string               `yaml:"prometheus_remote_write_basic_auth_username"`
+	PrometheusRemoteWriteBatchSize               int                  `yaml:"prometheus_remote_write_batch_size"`
+	PrometheusRemoteWriteBearerToken             string               `yaml:"prometheus_remote_write_bearer_token"`
+	PrometheusRemoteWriteCounterExpiryIntervals  int                  `yaml:"prometheus_remote_write_counter_expiry_intervals"`
+	PrometheusRemoteWriteCounterMode             string               `yaml:"prometheus_remote_write_counter_mode"`
+	PrometheusRemoteWriteMaxRetries              int                  `yaml:"prometheus_remote_write_max_retries"`
+	PrometheusRemoteWriteTLSAuthorityCertificate string               `yaml:"prometheus_remote_write_tls_authority_certificate"`
+	PrometheusRemoteWriteTLSCertificate          string               `yaml:"prometheus_remote_write_tls_certificate"`
+	PrometheusRemoteWriteTLSKey                  string               `yaml:"prometheus_remote_write_tls_key"`
+	ReadBatchSize                                int                  `yaml:"read_batch_size"`
+	ReadBufferSizeBytes                          int                  `yaml:"read_buffer_size_bytes"`
+	SentryDsn                                    string               `yaml:"sentry_dsn"`
+	SetPrecision                                 int                  `yaml:"set_precision"`
+	SetPrecisionPrefixes                         map[string]int       `yaml:"set_precision_prefixes"`
+	ShutdownTimeout                              string               `yaml:"shutdown_timeout"`
+	SignalfxAPIKey                               string               `yaml:"signalfx_api_key"`
+	SignalfxEndpointBase                         string               `yaml:"signalfx_endpoint_base"`
+	SignalfxFlushTimeout                         string               `yaml:"signalfx_flush_timeout"`
+	SignalfxHostnameTag                          string               `yaml:"signalfx_hostname_tag"`
+	SignalfxPerTagAPIKeys                        []struct {
 		APIKey string `yaml:"api_key"`
 		Name   string `yaml:"name"`
 	} `yaml:"signalfx_per_tag_api_keys"`
-	SignalfxVaryKeyBy             string   `yaml:"signalfx_vary_key_by"`
-	SpanChannelCapacity           int      `yaml:"span_channel_capacity"`
-	SplunkHecAddress              string   `yaml:"splunk_hec_address"`
-	SplunkHecBatchSize            int      `yaml:"splunk_hec_batch_size"`
-	SplunkHecIngestTimeout        string   `yaml:"splunk_hec_ingest_timeout"`
-	SplunkHecSendTimeout          string   `yaml:"splunk_hec_send_timeout"`
-	SplunkHecSubmissionWorkers    int      `yaml:"splunk_hec_submission_workers"`
-	SplunkHecTLSValidateHostname  string   `yaml:"splunk_hec_tls_validate_hostname"`
-	SplunkHecToken                string   `yaml:"splunk_hec_token"`
-	SplunkSpanSampleRate          int      `yaml:"splunk_span_sample_rate"`
-	SsfBufferSize                 int      `yaml:"ssf_buffer_size"`
-	SsfListenAddresses            []string `yaml:"ssf_listen_addresses"`
-	StatsAddress                  string   `yaml:"stats_address"`
-	StatsdListenAddresses         []string `yaml:"statsd_listen_addresses"`
-	SynchronizeWithInterval       bool     `yaml:"synchronize_with_interval"`
-	Tags                          []string `yaml:"tags"`
-	TagsExclude                   []string `yaml:"tags_exclude"`
-	TLSAuthorityCertificate       string   `yaml:"tls_authority_certificate"`
-	TLSCertificate                string   `yaml:"tls_certificate"`
-	TLSKey                        string   `yaml:"tls_key"`
-	TraceLightstepAccessToken     string   `yaml:"trace_lightstep_access_token"`
-	TraceLightstepCollectorHost   string   `yaml:"trace_lightstep_collector_host"`
-	TraceLightstepMaximumSpans    int      `yaml:"trace_lightstep_maximum_spans"`
-	TraceLightstepNumClients      int      `yaml:"trace_lightstep_num_clients"`
-	TraceLightstepReconnectPeriod string   `yaml:"trace_lightstep_reconnect_period"`
-	TraceMaxLengthBytes           int      `yaml:"trace_max_length_bytes"`
+	SignalfxVaryKeyBy                string            `yaml:"signalfx_vary_key_by"`
+	SpanChannelCapacity              int               `yaml:"span_channel_capacity"`
+	SpanFileCompress                 bool              `yaml:"span_file_compress"`
+	SpanFileMaxAge                   string            `yaml:"span_file_max_age"`
+	SpanFileMaxFiles                 int               `yaml:"span_file_max_files"`
+	SpanFileMaxSizeBytes             int               `yaml:"span_file_max_size_bytes"`
+	SpanFileMaxTotalBytes            int               `yaml:"span_file_max_total_bytes"`
+	SpanFilePath                     string            `yaml:"span_file_path"`
+	SpanFileQueueSize                int               `yaml:"span_file_queue_size"`
+	SpanNameAllowPatterns            []string          `yaml:"span_name_allow_patterns"`
+	SpanNameDenyPatterns             []string          `yaml:"span_name_deny_patterns"`
+	SpanRedMetricsDurationName       string            `yaml:"span_red_metrics_duration_name"`
+	SpanRedMetricsErrorsName         string            `yaml:"span_red_metrics_errors_name"`
+	SpanRedMetricsIndicatorOnly      bool              `yaml:"span_red_metrics_indicator_only"`
+	SpanRedMetricsRequestsName       string            `yaml:"span_red_metrics_requests_name"`
+	SpanRedMetricsTagKeys            []string          `yaml:"span_red_metrics_tag_keys"`
+	SpanScrubRules                   []SpanScrubRule   `yaml:"span_scrub_rules"`
+	SpanSinkDispatchers              map[string]int    `yaml:"span_sink_dispatchers"`
+	SpanSinkQueueSizes               map[string]int    `yaml:"span_sink_queue_sizes"`
+	SplunkHecAddress                 string            `yaml:"splunk_hec_address"`
+	SplunkHecBatchSize               int               `yaml:"splunk_hec_batch_size"`
+	SplunkHecIngestTimeout           string            `yaml:"splunk_hec_ingest_timeout"`
+	SplunkHecSendTimeout             string            `yaml:"splunk_hec_send_timeout"`
+	SplunkHecSubmissionWorkers       int               `yaml:"splunk_hec_submission_workers"`
+	SplunkHecTLSValidateHostname     string            `yaml:"splunk_hec_tls_validate_hostname"`
+	SplunkHecToken                   string            `yaml:"splunk_hec_token"`
+	SplunkSpanSampleRate             int               `yaml:"splunk_span_sample_rate"`
+	SsfBufferSize                    int               `yaml:"ssf_buffer_size"`
+	SsfDebugParseFailures            bool              `yaml:"ssf_debug_parse_failures"`
+	SsfListenAddresses               []string          `yaml:"ssf_listen_addresses"`
+	SsfListenerMaxLengthBytes        map[string]int    `yaml:"ssf_listener_max_length_bytes"`
+	SsfMaxBatchSpans                 int               `yaml:"ssf_max_batch_spans"`
+	SsfMaxFrameLengthBytes           int               `yaml:"ssf_max_frame_length_bytes"`
+	SsfMaxSpanEvents                 int               `yaml:"ssf_max_span_events"`
+	SsfMaxSpanLinks                  int               `yaml:"ssf_max_span_links"`
+	SsfRateLimitBytesPerSecond       float64           `yaml:"ssf_rate_limit_bytes_per_second"`
+	SsfRateLimitPacketsPerSecond     float64           `yaml:"ssf_rate_limit_packets_per_second"`
+	SsfTCPReadTimeout                string            `yaml:"ssf_tcp_read_timeout"`
+	SsfTLSAuthorityCertificate       string            `yaml:"ssf_tls_authority_certificate"`
+	SsfTLSCertificate                string            `yaml:"ssf_tls_certificate"`
+	SsfTLSKey                        string            `yaml:"ssf_tls_key"`
+	SsfTruncateOversizedSpans        bool              `yaml:"ssf_truncate_oversized_spans"`
+	SsfUnixPeerCredentials           bool              `yaml:"ssf_unix_peer_credentials"`
+	SsfUnixPeerServices              map[uint32]string `yaml:"ssf_unix_peer_services"`
+	StatsAddress                     string            `yaml:"stats_address"`
+	StatsdContainerIDTag             string            `yaml:"statsd_container_id_tag"`
+	StatsdListenAddresses            []string          `yaml:"statsd_listen_addresses"`
+	StatsdRateLimitBytesPerSecond    float64           `yaml:"statsd_rate_limit_bytes_per_second"`
+	StatsdRateLimitPacketsPerSecond  float64           `yaml:"statsd_rate_limit_packets_per_second"`
+	StatsdSourceAccounting           bool              `yaml:"statsd_source_accounting"`
+	StatsdSourceAccountingMaxNames   int               `yaml:"statsd_source_accounting_max_names"`
+	StatsdSourceAccountingMaxSources int               `yaml:"statsd_source_accounting_max_sources"`
+	StatsdTCPMaxConnections          int               `yaml:"statsd_tcp_max_connections"`
+	StatsdTCPMaxLineLength           int               `yaml:"statsd_tcp_max_line_length"`
+	StatsdTCPReadTimeout             string            `yaml:"statsd_tcp_read_timeout"`
+	SynchronizeWithInterval          bool              `yaml:"synchronize_with_interval"`
+	TagNormalizationDedupeKeys       bool              `yaml:"tag_normalization_dedupe_keys"`
+	TagNormalizationLowercaseKeys    bool              `yaml:"tag_normalization_lowercase_keys"`
+	TagNormalizationRenames          map[string]string `yaml:"tag_normalization_renames"`
+	TagNormalizationSanitize         bool              `yaml:"tag_normalization_sanitize"`
+	Tags                             []string          `yaml:"tags"`
+	TagsExclude                      []string          `yaml:"tags_exclude"`
+	TLSAuthorityCertificate          string            `yaml:"tls_authority_certificate"`
+	TLSCertificate                   string            `yaml:"tls_certificate"`
+	TLSKey                           string            `yaml:"tls_key"`
+	TopMetricsCount                  int               `yaml:"top_metrics_count"`
+	TraceLightstepAccessToken        string            `yaml:"trace_lightstep_access_token"`
+	TraceLightstepCollectorHost      string            `yaml:"trace_lightstep_collector_host"`
+	TraceLightstepMaximumSpans       int               `yaml:"trace_lightstep_maximum_spans"`
+	TraceLightstepNumClients         int               `yaml:"trace_lightstep_num_clients"`
+	TraceLightstepReconnectPeriod    string            `yaml:"trace_lightstep_reconnect_period"`
+	TraceMaxLengthBytes              int               `yaml:"trace_max_length_bytes"`
+	WorkerScalingIdleIntervals       int               `yaml:"worker_scaling_idle_intervals"`
+	WorkerScalingMaxWorkers          int               `yaml:"worker_scaling_max_workers"`
+	WorkerScalingQueueDepth          float64           `yaml:"worker_scaling_queue_depth"`
+
+	// references are the env:// and file:// references that were
+	// resolved in reading the config, by their keys.
+	references map[string]string
 }
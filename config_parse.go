@@ -15,6 +15,7 @@ var defaultConfig = Config{
 	Aggregates:             []string{"min", "max", "count"},
 	DatadogFlushMaxPerBody: 25000,
 	Interval:               "10s",
+	KafkaRetryQueueSize:    1000,
 	MetricMaxLength:        4096,
 	ReadBufferSizeBytes:    1048576 * 2, // 2 MiB
 	SpanChannelCapacity:    100,
@@ -22,6 +23,9 @@ var defaultConfig = Config{
 }
 
 var defaultProxyConfig = ProxyConfig{
+	ForwardEvictionThreshold:     5,
+	ForwardQueueSize:             100,
+	ForwardQueueWorkers:          1,
 	MaxIdleConnsPerHost:          100,
 	TracingClientCapacity:        1024,
 	TracingClientFlushInterval:   "500ms",
@@ -51,6 +55,15 @@ func (c *ProxyConfig) applyDefaults() {
 		).Warn("max_idle_conns_per_host being unset may lead to unsafe operations, defaulting!")
 		c.MaxIdleConnsPerHost = defaultProxyConfig.MaxIdleConnsPerHost
 	}
+	if c.ForwardEvictionThreshold == 0 {
+		c.ForwardEvictionThreshold = defaultProxyConfig.ForwardEvictionThreshold
+	}
+	if c.ForwardQueueSize == 0 {
+		c.ForwardQueueSize = defaultProxyConfig.ForwardQueueSize
+	}
+	if c.ForwardQueueWorkers == 0 {
+		c.ForwardQueueWorkers = defaultProxyConfig.ForwardQueueWorkers
+	}
 	if c.TracingClientCapacity == 0 {
 		c.TracingClientCapacity = defaultProxyConfig.TracingClientCapacity
 	}
@@ -70,7 +83,7 @@ func readProxyConfig(r io.Reader) (ProxyConfig, error) {
 	}
 	unmarshalErr := unmarshalSemiStrictly(bts, &c)
 	if unmarshalErr != nil {
-		if _, ok := err.(*UnknownConfigKeys); !ok {
+		if _, ok := unmarshalErr.(*UnknownConfigKeys); !ok {
 			return c, unmarshalErr
 		}
 	}
@@ -79,6 +92,10 @@ func readProxyConfig(r io.Reader) (ProxyConfig, error) {
 	if err != nil {
 		return c, err
 	}
+	c.references, err = resolveReferences(&c)
+	if err != nil {
+		return c, err
+	}
 
 	return c, unmarshalErr
 }
@@ -134,7 +151,7 @@ func readConfig(r io.Reader) (Config, error) {
 	}
 	unmarshalErr := unmarshalSemiStrictly(bts, &c)
 	if unmarshalErr != nil {
-		if _, ok := err.(*UnknownConfigKeys); !ok {
+		if _, ok := unmarshalErr.(*UnknownConfigKeys); !ok {
 			return c, unmarshalErr
 		}
 	}
@@ -143,6 +160,10 @@ func readConfig(r io.Reader) (Config, error) {
 	if err != nil {
 		return c, err
 	}
+	c.references, err = resolveReferences(&c)
+	if err != nil {
+		return c, err
+	}
 
 	// pass back an error about any unknown fields:
 	return c, unmarshalErr
@@ -218,6 +239,10 @@ func (c *Config) applyDefaults() {
 	if c.SplunkHecBatchSize == 0 {
 		c.SplunkHecBatchSize = defaultConfig.SplunkHecBatchSize
 	}
+
+	if c.KafkaRetryQueueSize == 0 {
+		c.KafkaRetryQueueSize = defaultConfig.KafkaRetryQueueSize
+	}
 }
 
 // ParseInterval handles parsing the flush interval as a time.Duration
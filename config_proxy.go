@@ -1,27 +1,46 @@
 package veneur
 
 type ProxyConfig struct {
-	ConsulForwardGrpcServiceName string `yaml:"consul_forward_grpc_service_name"`
-	ConsulForwardServiceName     string `yaml:"consul_forward_service_name"`
-	ConsulRefreshInterval        string `yaml:"consul_refresh_interval"`
-	ConsulTraceServiceName       string `yaml:"consul_trace_service_name"`
-	Debug                        bool   `yaml:"debug"`
-	EnableProfiling              bool   `yaml:"enable_profiling"`
-	ForwardAddress               string `yaml:"forward_address"`
-	ForwardTimeout               string `yaml:"forward_timeout"`
-	GrpcAddress                  string `yaml:"grpc_address"`
-	GrpcForwardAddress           string `yaml:"grpc_forward_address"`
-	HTTPAddress                  string `yaml:"http_address"`
-	IdleConnectionTimeout        string `yaml:"idle_connection_timeout"`
-	MaxIdleConns                 int    `yaml:"max_idle_conns"`
-	MaxIdleConnsPerHost          int    `yaml:"max_idle_conns_per_host"`
-	RuntimeMetricsInterval       string `yaml:"runtime_metrics_interval"`
-	SentryDsn                    string `yaml:"sentry_dsn"`
-	SsfDestinationAddress        string `yaml:"ssf_destination_address"`
-	StatsAddress                 string `yaml:"stats_address"`
-	TraceAddress                 string `yaml:"trace_address"`
-	TraceAPIAddress              string `yaml:"trace_api_address"`
-	TracingClientCapacity        int    `yaml:"tracing_client_capacity"`
-	TracingClientFlushInterval   string `yaml:"tracing_client_flush_interval"`
-	TracingClientMetricsInterval string `yaml:"tracing_client_metrics_interval"`
+	ConsulForwardGrpcServiceName       string `yaml:"consul_forward_grpc_service_name"`
+	ConsulForwardServiceName           string `yaml:"consul_forward_service_name"`
+	ConsulRefreshInterval              string `yaml:"consul_refresh_interval"`
+	ConsulTraceServiceName             string `yaml:"consul_trace_service_name"`
+	Debug                              bool   `yaml:"debug"`
+	EnableProfiling                    bool   `yaml:"enable_profiling"`
+	ForwardAddress                     string `yaml:"forward_address"`
+	ForwardEvictionProbeInterval       string `yaml:"forward_eviction_probe_interval"`
+	ForwardEvictionThreshold           int    `yaml:"forward_eviction_threshold"`
+	ForwardGrpcAuthToken               string `yaml:"forward_grpc_auth_token"`
+	ForwardGrpcPort                    int    `yaml:"forward_grpc_port"`
+	ForwardGrpcTLSAuthorityCertificate string `yaml:"forward_grpc_tls_authority_certificate"`
+	ForwardGrpcTLSCertificate          string `yaml:"forward_grpc_tls_certificate"`
+	ForwardGrpcTLSKey                  string `yaml:"forward_grpc_tls_key"`
+	ForwardQueueSize                   int    `yaml:"forward_queue_size"`
+	ForwardQueueWorkers                int    `yaml:"forward_queue_workers"`
+	ForwardTLSAuthorityCertificateFile string `yaml:"forward_tls_authority_certificate_file"`
+	ForwardTLSCertificateFile          string `yaml:"forward_tls_certificate_file"`
+	ForwardTLSKeyFile                  string `yaml:"forward_tls_key_file"`
+	ForwardTLSServerName               string `yaml:"forward_tls_server_name"`
+	ForwardTimeout                     string `yaml:"forward_timeout"`
+	ForwardUseGrpc                     bool   `yaml:"forward_use_grpc"`
+	GrpcAddress                        string `yaml:"grpc_address"`
+	GrpcForwardAddress                 string `yaml:"grpc_forward_address"`
+	HTTPAddress                        string `yaml:"http_address"`
+	IdleConnectionTimeout              string `yaml:"idle_connection_timeout"`
+	MaxIdleConns                       int    `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost                int    `yaml:"max_idle_conns_per_host"`
+	ProxyForwardRetryMode              string `yaml:"proxy_forward_retry_mode"`
+	RuntimeMetricsInterval             string `yaml:"runtime_metrics_interval"`
+	SentryDsn                          string `yaml:"sentry_dsn"`
+	SsfDestinationAddress              string `yaml:"ssf_destination_address"`
+	StatsAddress                       string `yaml:"stats_address"`
+	TraceAddress                       string `yaml:"trace_address"`
+	TraceAPIAddress                    string `yaml:"trace_api_address"`
+	TracingClientCapacity              int    `yaml:"tracing_client_capacity"`
+	TracingClientFlushInterval         string `yaml:"tracing_client_flush_interval"`
+	TracingClientMetricsInterval       string `yaml:"tracing_client_metrics_interval"`
+
+	// references are the env:// and file:// references that were
+	// resolved in reading the config, by their keys.
+	references map[string]string
 }
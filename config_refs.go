@@ -0,0 +1,202 @@
+package veneur
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Config values can refer to an environment variable or a file,
+// instead of holding the setting itself, like secrets that are
+// injected into the environment or mounted as files:
+//
+//	datadog_api_key: env://DD_API_KEY
+//	splunk_hec_token: file:///var/run/secrets/hec_token
+const (
+	envReference  = "env://"
+	fileReference = "file://"
+)
+
+// resolveReference returns the value that a config value refers to,
+// or the value itself if it isn't a reference. The trailing newlines
+// of files are trimmed.
+func resolveReference(value string) (resolved string, isReference bool, err error) {
+	switch {
+	case strings.HasPrefix(value, envReference):
+		name := strings.TrimPrefix(value, envReference)
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", true, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return resolved, true, nil
+	case strings.HasPrefix(value, fileReference):
+		contents, err := ioutil.ReadFile(strings.TrimPrefix(value, fileReference))
+		if err != nil {
+			return "", true, err
+		}
+		return strings.TrimRight(string(contents), "\r\n"), true, nil
+	}
+	return value, false, nil
+}
+
+// configKey returns the key of a config struct's field, or "" for the
+// fields that aren't settings.
+func configKey(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	return key
+}
+
+// resolveReferences replaces the references in the string settings
+// of the config struct that conf points to with the values they refer
+// to, including the strings in its maps, slices and nested structs. It
+// returns the references it resolved, by their keys (like
+// "otlp_trace_headers.x" for map values, and
+// "signalfx_per_tag_api_keys[0].api_key" for the fields of a slice's
+// structs), and an error naming the key of the first one it couldn't
+// resolve.
+func resolveReferences(conf interface{}) (map[string]string, error) {
+	var refs map[string]string
+	resolve := func(key, value string) (string, error) {
+		resolved, isReference, err := resolveReference(value)
+		if err != nil {
+			return "", fmt.Errorf("%s: resolving %q: %v", key, value, err)
+		}
+		if isReference {
+			if refs == nil {
+				refs = map[string]string{}
+			}
+			refs[key] = value
+		}
+		return resolved, nil
+	}
+
+	var resolveValue func(key string, v reflect.Value) error
+	resolveValue = func(key string, v reflect.Value) error {
+		switch {
+		case v.Kind() == reflect.String:
+			resolved, err := resolve(key, v.String())
+			if err != nil {
+				return err
+			}
+			v.SetString(resolved)
+		case isStringMap(v.Type()):
+			for _, k := range sortedMapKeys(v) {
+				resolved, err := resolve(key+"."+k.String(), v.MapIndex(k).String())
+				if err != nil {
+					return err
+				}
+				v.SetMapIndex(k, reflect.ValueOf(resolved).Convert(v.Type().Elem()))
+			}
+		case v.Kind() == reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				if err := resolveValue(fmt.Sprintf("%s[%d]", key, i), v.Index(i)); err != nil {
+					return err
+				}
+			}
+		case v.Kind() == reflect.Ptr && !v.IsNil():
+			return resolveValue(key, v.Elem())
+		case v.Kind() == reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				field := configKey(v.Type().Field(i))
+				if field == "" {
+					continue
+				}
+				if key != "" {
+					field = key + "." + field
+				}
+				if err := resolveValue(field, v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := resolveValue("", reflect.ValueOf(conf).Elem()); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// restoreReferences puts the references that resolveReferences
+// resolved back into the config struct that conf points to, so that
+// printing it doesn't print what they refer to. The maps, slices and
+// pointed-to structs that hold references are copied, rather than
+// changed.
+func restoreReferences(conf interface{}, refs map[string]string) {
+	if len(refs) == 0 {
+		return
+	}
+	// holdsReferences reports whether the value with the key holds
+	// any of the references.
+	holdsReferences := func(key string) bool {
+		for ref := range refs {
+			if strings.HasPrefix(ref, key+".") || strings.HasPrefix(ref, key+"[") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var restoreValue func(key string, v reflect.Value)
+	restoreValue = func(key string, v reflect.Value) {
+		switch {
+		case v.Kind() == reflect.String:
+			if ref, ok := refs[key]; ok {
+				v.SetString(ref)
+			}
+		case isStringMap(v.Type()) && !v.IsNil() && holdsReferences(key):
+			restored := reflect.MakeMapWithSize(v.Type(), v.Len())
+			for _, k := range v.MapKeys() {
+				value := v.MapIndex(k)
+				if ref, ok := refs[key+"."+k.String()]; ok {
+					value = reflect.ValueOf(ref).Convert(v.Type().Elem())
+				}
+				restored.SetMapIndex(k, value)
+			}
+			v.Set(restored)
+		case v.Kind() == reflect.Slice && holdsReferences(key):
+			restored := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			reflect.Copy(restored, v)
+			for i := 0; i < restored.Len(); i++ {
+				restoreValue(fmt.Sprintf("%s[%d]", key, i), restored.Index(i))
+			}
+			v.Set(restored)
+		case v.Kind() == reflect.Ptr && !v.IsNil() && holdsReferences(key):
+			restored := reflect.New(v.Type().Elem())
+			restored.Elem().Set(v.Elem())
+			restoreValue(key, restored.Elem())
+			v.Set(restored)
+		case v.Kind() == reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				field := configKey(v.Type().Field(i))
+				if field == "" {
+					continue
+				}
+				if key != "" {
+					field = key + "." + field
+				}
+				restoreValue(field, v.Field(i))
+			}
+		}
+	}
+	restoreValue("", reflect.ValueOf(conf).Elem())
+}
+
+func isStringMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.String
+}
+
+func sortedMapKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
@@ -1,12 +1,15 @@
 package veneur
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestReadConfig(t *testing.T) {
@@ -65,6 +68,143 @@ debug: true
 	assert.Equal(t, true, c.Debug)
 }
 
+func TestReadUnknownKeysConfigFromEnv(t *testing.T) {
+	const config = `---
+no_such_key: 1
+`
+	os.Setenv("VENEUR_HOSTNAME", "fromenv")
+	defer os.Unsetenv("VENEUR_HOSTNAME")
+	c, err := readConfig(strings.NewReader(config))
+	_, ok := err.(*UnknownConfigKeys)
+	assert.True(t, ok, "Returned error should indicate a strictness error")
+	assert.Equal(t, "fromenv", c.Hostname, "Environment variables apply despite unknown keys")
+}
+
+func TestConfigValidate(t *testing.T) {
+	const config = `---
+interval: 10 seconds
+percentiles: [0.5, 99]
+percentiles_overrides:
+  api.: [1.5]
+splunk_hec_token: "abc"
+splunk_hec_batch_size: -1
+honeycomb_batch_size: 0
+kafka_span_sample_rate: 10
+kafka_span_sample_rate_percent: 50
+ssf_listen_addresses: ["udp://127.0.0.1:8128"]
+ssf_listener_max_length_bytes:
+  "udp://127.0.0.1:8128": 0
+  "unix:///tmp/other.sock": 1024
+prometheus_exposition_enabled: true
+prometheus_exposition_summaries: true
+`
+	c, err := readConfig(strings.NewReader(config))
+	require.NoError(t, err)
+	c.applyDefaults()
+	err = c.Validate()
+	require.IsType(t, &InvalidConfig{}, err)
+	problems := err.(*InvalidConfig).Problems
+	require.NotEmpty(t, problems)
+	assert.Contains(t, problems[0], "interval: time: unknown unit")
+	assert.Equal(t, []string{
+		"percentiles: percentile 99 is not between 0 and 1",
+		"percentiles_overrides api.: percentile 1.5 is not between 0 and 1",
+		"splunk_hec_batch_size is -1, but must be at least 1",
+		"ssf_listener_max_length_bytes udp://127.0.0.1:8128 is 0, but must be at least 1",
+		"ssf_listener_max_length_bytes has unix:///tmp/other.sock, which isn't in ssf_listen_addresses",
+		"splunk_hec_token is set, but splunk_hec_address isn't",
+		"kafka_span_sample_rate and kafka_span_sample_rate_percent are both set, but only one of them may be",
+		"prometheus_exposition_summaries is set, but aggregates doesn't include both sum and count",
+	}, problems[1:])
+}
+
+func TestProxyConfigValidate(t *testing.T) {
+	c, err := readProxyConfig(strings.NewReader("forward_queue_workers: -1\nforward_timeout: 1\n"))
+	require.NoError(t, err)
+	c.applyDefaults()
+	err = c.Validate()
+	require.IsType(t, &InvalidConfig{}, err)
+	problems := err.(*InvalidConfig).Problems
+	require.NotEmpty(t, problems)
+	assert.Contains(t, problems[0], "forward_timeout: time: missing unit")
+	assert.Equal(t, []string{
+		"forward_queue_workers is -1, but must be at least 1",
+		"the proxy has nowhere to forward to: none of forward_address, grpc_forward_address, trace_address or their consul_*_service_name are set",
+	}, problems[1:])
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c, err := ReadConfig("example.yaml")
+	require.NoError(t, err)
+	c.SignalfxPerTagAPIKeys = append(c.SignalfxPerTagAPIKeys, c.SignalfxPerTagAPIKeys...)
+	c.SignalfxPerTagAPIKeys[0].APIKey = "secret"
+	redacted := c.Redacted()
+
+	assert.Equal(t, REDACTED, redacted.DatadogAPIKey)
+	assert.Equal(t, REDACTED, redacted.SplunkHecToken)
+	assert.Equal(t, REDACTED, redacted.SignalfxPerTagAPIKeys[0].APIKey)
+	assert.Equal(t, "", redacted.GrpcAuthToken, "Unset secrets stay empty")
+	assert.Equal(t, c.SplunkHecAddress, redacted.SplunkHecAddress)
+	assert.Equal(t, "secret", c.SignalfxPerTagAPIKeys[0].APIKey, "The original config keeps its secrets")
+}
+
+func TestConfigReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "hec_token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("hec-secret\n"), 0600))
+	os.Setenv("TEST_DD_API_KEY", "dd-secret")
+	defer os.Unsetenv("TEST_DD_API_KEY")
+
+	config := `---
+datadog_api_key: env://TEST_DD_API_KEY
+splunk_hec_token: file://` + tokenFile + `
+otlp_trace_headers:
+  authorization: env://TEST_DD_API_KEY
+  x-team: observability
+signalfx_per_tag_api_keys:
+  - name: team-a
+    api_key: env://TEST_DD_API_KEY
+  - name: team-b
+    api_key: literal-key
+`
+	c, err := readConfig(strings.NewReader(config))
+	require.NoError(t, err)
+	assert.Equal(t, "dd-secret", c.DatadogAPIKey)
+	assert.Equal(t, "hec-secret", c.SplunkHecToken, "Trailing newlines are trimmed")
+	assert.Equal(t, map[string]string{"authorization": "dd-secret", "x-team": "observability"}, c.OTLPTraceHeaders)
+	require.Len(t, c.SignalfxPerTagAPIKeys, 2)
+	assert.Equal(t, "dd-secret", c.SignalfxPerTagAPIKeys[0].APIKey, "References in slices of structs are resolved")
+	assert.Equal(t, "team-a", c.SignalfxPerTagAPIKeys[0].Name)
+
+	// The redacted config shows the references, never what they
+	// refer to:
+	redacted := c.Redacted()
+	assert.Equal(t, "env://TEST_DD_API_KEY", redacted.DatadogAPIKey)
+	assert.Equal(t, "file://"+tokenFile, redacted.SplunkHecToken)
+	assert.Equal(t, map[string]string{"authorization": "env://TEST_DD_API_KEY", "x-team": REDACTED}, redacted.OTLPTraceHeaders)
+	assert.Equal(t, "env://TEST_DD_API_KEY", redacted.SignalfxPerTagAPIKeys[0].APIKey)
+	assert.Equal(t, REDACTED, redacted.SignalfxPerTagAPIKeys[1].APIKey)
+	assert.Equal(t, "dd-secret", c.OTLPTraceHeaders["authorization"], "The original config keeps its values")
+	assert.Equal(t, "dd-secret", c.SignalfxPerTagAPIKeys[0].APIKey)
+}
+
+func TestConfigReferenceErrors(t *testing.T) {
+	_, err := readConfig(strings.NewReader("splunk_hec_token: file:///no/such/file\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "splunk_hec_token")
+
+	_, err = readConfig(strings.NewReader("signalfx_per_tag_api_keys:\n  - name: a\n    api_key: env://TEST_NO_SUCH_VARIABLE\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "signalfx_per_tag_api_keys[0].api_key")
+
+	_, err = readProxyConfig(strings.NewReader("forward_grpc_auth_token: env://TEST_NO_SUCH_VARIABLE\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "forward_grpc_auth_token")
+	assert.Contains(t, err.Error(), "TEST_NO_SUCH_VARIABLE is not set")
+}
+
 func TestHostname(t *testing.T) {
 	const hostnameConfig = "hostname: foo"
 	r := strings.NewReader(hostnameConfig)
@@ -124,8 +264,9 @@ func TestVeneurExamples(t *testing.T) {
 		test := elt
 		t.Run(test, func(t *testing.T) {
 			t.Parallel()
-			_, err := ReadConfig(test)
+			c, err := ReadConfig(test)
 			assert.NoError(t, err)
+			assert.NoError(t, c.Validate())
 		})
 	}
 }
@@ -136,8 +277,9 @@ func TestProxyExamples(t *testing.T) {
 		test := elt
 		t.Run(test, func(t *testing.T) {
 			t.Parallel()
-			_, err := ReadProxyConfig(test)
+			c, err := ReadProxyConfig(test)
 			assert.NoError(t, err)
+			assert.NoError(t, c.Validate())
 		})
 	}
 }
@@ -0,0 +1,289 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InvalidConfig is returned by Validate for a config that parses,
+// but can't work as it is. Problems lists all that is wrong with it.
+type InvalidConfig struct {
+	Problems []string
+}
+
+func (e *InvalidConfig) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// configChecker collects the problems found with a config.
+type configChecker struct {
+	problems []string
+}
+
+func (cc *configChecker) problem(format string, args ...interface{}) {
+	cc.problems = append(cc.problems, fmt.Sprintf(format, args...))
+}
+
+// requires checks that the setting b is set if a is, as a does
+// nothing without it.
+func (cc *configChecker) requires(a, aValue, b, bValue string) {
+	if aValue != "" && bValue == "" {
+		cc.problem("%s is set, but %s isn't", a, b)
+	}
+}
+
+// durations checks that the settings that are set parse as durations.
+func (cc *configChecker) durations(settings map[string]string) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if settings[name] == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(settings[name]); err != nil {
+			cc.problem("%s: %v", name, err)
+		}
+	}
+}
+
+// atLeast checks that the settings are at least min.
+func (cc *configChecker) atLeast(min int, settings map[string]int) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if settings[name] < min {
+			cc.problem("%s is %d, but must be at least %d", name, settings[name], min)
+		}
+	}
+}
+
+func (cc *configChecker) percentiles(name string, percentiles []float64) {
+	for _, p := range percentiles {
+		if p < 0 || p > 1 {
+			cc.problem("%s: percentile %v is not between 0 and 1", name, p)
+		}
+	}
+}
+
+func (cc *configChecker) err() error {
+	if len(cc.problems) == 0 {
+		return nil
+	}
+	return &InvalidConfig{Problems: cc.problems}
+}
+
+// Validate checks the settings that the YAML decoder can't, like
+// durations, ranges and settings that only work together. It expects
+// a config read with ReadConfig, with its defaults applied, and
+// returns an *InvalidConfig if anything is wrong with it.
+func (c Config) Validate() error {
+	var cc configChecker
+	if c.Interval == "" {
+		cc.problem("interval is not set")
+	}
+	cc.durations(map[string]string{
+		"flush_file_max_age":               c.FlushFileMaxAge,
+		"forward_address_refresh_interval": c.ForwardAddressRefreshInterval,
+		"graphite_write_timeout":           c.GraphiteWriteTimeout,
+		"interval":                         c.Interval,
+		"lightstep_reconnect_period":       c.LightstepReconnectPeriod,
+		"lightstep_refresh_period":         c.LightstepRefreshPeriod,
+		"metric_sink_flush_timeout":        c.MetricSinkFlushTimeout,
+		"otlp_metric_timeout":              c.OTLPMetricTimeout,
+		"otlp_trace_export_timeout":        c.OTLPTraceExportTimeout,
+		"shutdown_timeout":                 c.ShutdownTimeout,
+		"signalfx_flush_timeout":           c.SignalfxFlushTimeout,
+		"span_file_max_age":                c.SpanFileMaxAge,
+		"splunk_hec_ingest_timeout":        c.SplunkHecIngestTimeout,
+		"splunk_hec_send_timeout":          c.SplunkHecSendTimeout,
+		"ssf_tcp_read_timeout":             c.SsfTCPReadTimeout,
+		"statsd_tcp_read_timeout":          c.StatsdTCPReadTimeout,
+	})
+
+	if c.FlushTraceSampleRate < 0 || c.FlushTraceSampleRate > 1 {
+		cc.problem("flush_trace_sample_rate %v is not between 0 and 1", c.FlushTraceSampleRate)
+	}
+
+	cc.percentiles("percentiles", c.Percentiles)
+	prefixes := make([]string, 0, len(c.PercentilesOverrides))
+	for prefix := range c.PercentilesOverrides {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		cc.percentiles("percentiles_overrides "+prefix, c.PercentilesOverrides[prefix])
+	}
+
+	// These have defaults, so they are only ever below 1 if they
+	// were set that way:
+	cc.atLeast(1, map[string]int{
+		"datadog_flush_max_per_body": c.DatadogFlushMaxPerBody,
+		"kafka_retry_queue_size":     c.KafkaRetryQueueSize,
+		"metric_max_length":          c.MetricMaxLength,
+		"read_buffer_size_bytes":     c.ReadBufferSizeBytes,
+		"span_channel_capacity":      c.SpanChannelCapacity,
+		"splunk_hec_batch_size":      c.SplunkHecBatchSize,
+	})
+	// ...and for these, 0 means the default:
+	cc.atLeast(0, map[string]int{
+		"elasticsearch_batch_size":                         c.ElasticsearchBatchSize,
+		"forward_grpc_stream_batch_size":                   c.ForwardGrpcStreamBatchSize,
+		"gauge_rate_expiry_intervals":                      c.GaugeRateExpiryIntervals,
+		"gauge_rate_max_contexts":                          c.GaugeRateMaxContexts,
+		"grpc_max_span_batch_size":                         c.GrpcMaxSpanBatchSize,
+		"honeycomb_batch_size":                             c.HoneycombBatchSize,
+		"influxdb_batch_size":                              c.InfluxDBBatchSize,
+		"kafka_span_sample_rate":                           c.KafkaSpanSampleRate,
+		"prometheus_exposition_counter_expiry_intervals":   c.PrometheusExpositionCounterExpiryIntervals,
+		"prometheus_remote_write_batch_size":               c.PrometheusRemoteWriteBatchSize,
+		"prometheus_remote_write_counter_expiry_intervals": c.PrometheusRemoteWriteCounterExpiryIntervals,
+		"read_batch_size":                                  c.ReadBatchSize,
+	})
+
+	listeners := make(map[string]bool, len(c.SsfListenAddresses))
+	for _, addr := range c.SsfListenAddresses {
+		listeners[addr] = true
+	}
+	addrs := make([]string, 0, len(c.SsfListenerMaxLengthBytes))
+	for addr := range c.SsfListenerMaxLengthBytes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		if !listeners[addr] {
+			cc.problem("ssf_listener_max_length_bytes has %s, which isn't in ssf_listen_addresses", addr)
+		}
+		if max := c.SsfListenerMaxLengthBytes[addr]; max < 1 {
+			cc.problem("ssf_listener_max_length_bytes %s is %d, but must be at least 1", addr, max)
+		}
+	}
+
+	cc.requires("splunk_hec_address", c.SplunkHecAddress, "splunk_hec_token", c.SplunkHecToken)
+	cc.requires("splunk_hec_token", c.SplunkHecToken, "splunk_hec_address", c.SplunkHecAddress)
+	cc.requires("datadog_api_key", c.DatadogAPIKey, "datadog_api_hostname", c.DatadogAPIHostname)
+	// Both sample the Kafka sink's spans, and only one may, so that it's
+	// clear which rate applies. 100 is the percentage that keeps
+	// everything, which example.yaml sets.
+	if c.KafkaSpanSampleRate > 1 && c.KafkaSpanSampleRatePercent != 0 && c.KafkaSpanSampleRatePercent != 100 {
+		cc.problem("kafka_span_sample_rate and kafka_span_sample_rate_percent are both set, but only one of them may be")
+	}
+	if c.ForwardGrpcStream && !c.ForwardUseGrpc {
+		cc.problem("forward_grpc_stream is set, but forward_use_grpc isn't")
+	}
+	// A summary without its _sum and _count series isn't valid
+	// exposition, and they come from those aggregates.
+	if c.PrometheusExpositionEnabled && c.PrometheusExpositionSummaries {
+		aggregates := map[string]bool{}
+		for _, name := range c.Aggregates {
+			aggregates[name] = true
+		}
+		if !aggregates["sum"] || !aggregates["count"] {
+			cc.problem("prometheus_exposition_summaries is set, but aggregates doesn't include both sum and count")
+		}
+	}
+	return cc.err()
+}
+
+// Validate checks the settings of a proxy config that the YAML
+// decoder can't, like durations and ranges. It expects a config read
+// with ReadProxyConfig, and returns an *InvalidConfig if anything is
+// wrong with it.
+func (c ProxyConfig) Validate() error {
+	var cc configChecker
+	cc.durations(map[string]string{
+		"consul_refresh_interval":         c.ConsulRefreshInterval,
+		"forward_eviction_probe_interval": c.ForwardEvictionProbeInterval,
+		"forward_timeout":                 c.ForwardTimeout,
+		"idle_connection_timeout":         c.IdleConnectionTimeout,
+		"runtime_metrics_interval":        c.RuntimeMetricsInterval,
+		"tracing_client_flush_interval":   c.TracingClientFlushInterval,
+		"tracing_client_metrics_interval": c.TracingClientMetricsInterval,
+	})
+	cc.atLeast(1, map[string]int{
+		"forward_eviction_threshold": c.ForwardEvictionThreshold,
+		"forward_queue_size":         c.ForwardQueueSize,
+		"forward_queue_workers":      c.ForwardQueueWorkers,
+		"max_idle_conns_per_host":    c.MaxIdleConnsPerHost,
+		"tracing_client_capacity":    c.TracingClientCapacity,
+	})
+	if c.ForwardAddress == "" && c.ConsulForwardServiceName == "" &&
+		c.GrpcForwardAddress == "" && c.ConsulForwardGrpcServiceName == "" &&
+		c.TraceAddress == "" && c.ConsulTraceServiceName == "" {
+		cc.problem("the proxy has nowhere to forward to: none of forward_address, grpc_forward_address, trace_address or their consul_*_service_name are set")
+	}
+	return cc.err()
+}
+
+// redact returns REDACTED for a secret that is set, so that the
+// secrets that are left empty still show as such.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return REDACTED
+}
+
+// Redacted returns a copy of the config with its credentials replaced
+// by REDACTED, that is safe to log or print.
+func (c Config) Redacted() Config {
+	c.AwsAccessKeyID = redact(c.AwsAccessKeyID)
+	c.AwsSecretAccessKey = redact(c.AwsSecretAccessKey)
+	c.DatadogAPIKey = redact(c.DatadogAPIKey)
+	c.ElasticsearchAPIKey = redact(c.ElasticsearchAPIKey)
+	c.ElasticsearchPassword = redact(c.ElasticsearchPassword)
+	c.ElasticsearchTLSKey = redact(c.ElasticsearchTLSKey)
+	c.ForwardGrpcAuthToken = redact(c.ForwardGrpcAuthToken)
+	c.ForwardGrpcTLSKey = redact(c.ForwardGrpcTLSKey)
+	c.GrpcAuthToken = redact(c.GrpcAuthToken)
+	c.GrpcTLSKey = redact(c.GrpcTLSKey)
+	c.HoneycombAPIKey = redact(c.HoneycombAPIKey)
+	c.InfluxDBPassword = redact(c.InfluxDBPassword)
+	c.InfluxDBToken = redact(c.InfluxDBToken)
+	c.KafkaHeaders = redactValues(c.KafkaHeaders)
+	c.KafkaSaslPassword = redact(c.KafkaSaslPassword)
+	c.KafkaSchemaRegistryPassword = redact(c.KafkaSchemaRegistryPassword)
+	c.KafkaTLSKey = redact(c.KafkaTLSKey)
+	c.LightstepAccessToken = redact(c.LightstepAccessToken)
+	c.NewRelicInsertKey = redact(c.NewRelicInsertKey)
+	c.OTLPMetricHeaders = redactValues(c.OTLPMetricHeaders)
+	c.OTLPMetricTLSKey = redact(c.OTLPMetricTLSKey)
+	c.OTLPTraceHeaders = redactValues(c.OTLPTraceHeaders)
+	c.OTLPTraceTLSKey = redact(c.OTLPTraceTLSKey)
+	c.PrometheusRemoteWriteBasicAuthPassword = redact(c.PrometheusRemoteWriteBasicAuthPassword)
+	c.PrometheusRemoteWriteBearerToken = redact(c.PrometheusRemoteWriteBearerToken)
+	c.PrometheusRemoteWriteTLSKey = redact(c.PrometheusRemoteWriteTLSKey)
+	c.SentryDsn = redact(c.SentryDsn)
+	c.SignalfxAPIKey = redact(c.SignalfxAPIKey)
+	// The per-tag keys are copied, as they share their array with
+	// the original config:
+	c.SignalfxPerTagAPIKeys = append(c.SignalfxPerTagAPIKeys[:0:0], c.SignalfxPerTagAPIKeys...)
+	for i := range c.SignalfxPerTagAPIKeys {
+		c.SignalfxPerTagAPIKeys[i].APIKey = redact(c.SignalfxPerTagAPIKeys[i].APIKey)
+	}
+	c.SplunkHecToken = redact(c.SplunkHecToken)
+	c.SsfTLSKey = redact(c.SsfTLSKey)
+	c.TLSKey = redact(c.TLSKey)
+	c.TraceLightstepAccessToken = redact(c.TraceLightstepAccessToken)
+	// Settings that refer to the environment or a file show the
+	// reference, whether or not they're secret:
+	restoreReferences(&c, c.references)
+	return c
+}
+
+// Redacted returns a copy of the proxy config with its credentials
+// replaced by REDACTED, that is safe to log or print.
+func (c ProxyConfig) Redacted() ProxyConfig {
+	c.ForwardGrpcAuthToken = redact(c.ForwardGrpcAuthToken)
+	c.ForwardGrpcTLSKey = redact(c.ForwardGrpcTLSKey)
+	c.SentryDsn = redact(c.SentryDsn)
+	restoreReferences(&c, c.references)
+	return c
+}
@@ -0,0 +1,135 @@
+package veneur
+
+import (
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// cumulativeTag marks a counter whose values are cumulative totals,
+// rather than increments.
+const cumulativeTag = "veneur_metric_kind:cumulative"
+
+// defaultCumulativeExpiryIntervals is how many intervals the last value
+// of a cumulative counter is kept for without being updated.
+const defaultCumulativeExpiryIntervals = 10
+
+// cumulativeCounters turns the cumulative totals that some clients send
+// for counters into the increments between them. Every metric context is
+// always sent to the same worker (by its digest), so each worker keeps
+// the last values of the contexts it's sent. A worker's
+// cumulativeCounters are only used with the worker's mutex held.
+type cumulativeCounters struct {
+	// names are the counters that are cumulative without the tag
+	names map[string]struct{}
+	// expiry is how many intervals a context is kept for after it was
+	// last seen
+	expiry int64
+
+	interval int64
+	contexts map[samplers.MetricKey]*cumulativeContext
+
+	resets  int64
+	evicted int64
+}
+
+type cumulativeContext struct {
+	// counterKey and tags are those of the counter that the
+	// increments are added to, without the cumulativeTag
+	counterKey samplers.MetricKey
+	tags       []string
+	last       float64
+	lastSeen   int64
+}
+
+func newCumulativeCounters(names []string, expiryIntervals int) *cumulativeCounters {
+	if expiryIntervals <= 0 {
+		expiryIntervals = defaultCumulativeExpiryIntervals
+	}
+	cc := &cumulativeCounters{
+		names:    make(map[string]struct{}, len(names)),
+		expiry:   int64(expiryIntervals),
+		contexts: map[samplers.MetricKey]*cumulativeContext{},
+	}
+	for _, name := range names {
+		cc.names[name] = struct{}{}
+	}
+	return cc
+}
+
+// cumulative reports whether the metric is a cumulative counter.
+func (cc *cumulativeCounters) cumulative(m *samplers.UDPMetric) bool {
+	if m.Type != counterTypeName {
+		return false
+	}
+	if _, ok := cc.names[m.Name]; ok {
+		return true
+	}
+	for _, tag := range m.Tags {
+		if tag == cumulativeTag {
+			return true
+		}
+	}
+	return false
+}
+
+// increment rewrites a cumulative counter into the increment since the
+// last value of its context, which is added to the counter without the
+// cumulativeTag. A value lower than the last one means that the counter
+// was reset, so the whole value is the increment. The first value of a
+// context only establishes where it starts, so increment returns false
+// for it, and it isn't counted.
+func (cc *cumulativeCounters) increment(m *samplers.UDPMetric) bool {
+	value := m.Value.(float64)
+	ctx, ok := cc.contexts[m.MetricKey]
+	if !ok {
+		tags := make([]string, 0, len(m.Tags))
+		for _, tag := range m.Tags {
+			if tag != cumulativeTag {
+				tags = append(tags, tag)
+			}
+		}
+		cc.contexts[m.MetricKey] = &cumulativeContext{
+			counterKey: samplers.MetricKey{
+				Name:       m.Name,
+				Type:       m.Type,
+				JoinedTags: strings.Join(tags, ","),
+			},
+			tags:     tags,
+			last:     value,
+			lastSeen: cc.interval,
+		}
+		return false
+	}
+
+	increment := value - ctx.last
+	if value < ctx.last {
+		increment = value
+		cc.resets++
+	}
+	ctx.last = value
+	ctx.lastSeen = cc.interval
+
+	m.MetricKey = ctx.counterKey
+	m.Tags = ctx.tags
+	m.Value = increment
+	// totals aren't sampled
+	m.SampleRate = 1
+	return true
+}
+
+// rotate starts a new interval, forgetting the contexts that weren't
+// seen in the last expiry intervals. It returns the resets and evictions
+// since the last call.
+func (cc *cumulativeCounters) rotate() (resets, evicted int64) {
+	cc.interval++
+	for key, ctx := range cc.contexts {
+		if cc.interval-ctx.lastSeen > cc.expiry {
+			delete(cc.contexts, key)
+			cc.evicted++
+		}
+	}
+	resets, evicted = cc.resets, cc.evicted
+	cc.resets, cc.evicted = 0, 0
+	return resets, evicted
+}
@@ -0,0 +1,72 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+// flushCounters flushes the worker, and returns the values of its
+// counters by their names and joined tags.
+func flushCounters(w *Worker) map[string]float64 {
+	values := map[string]float64{}
+	for key, c := range w.Flush().counters {
+		values[key.Name+"|"+key.JoinedTags] = c.Flush(0)[0].Value
+	}
+	return values
+}
+
+func TestCumulativeCounters(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	w.cumulative = newCumulativeCounters([]string{"configured"}, 2)
+
+	processPackets(t, w,
+		"bytes_sent:100|c|#host:a,veneur_metric_kind:cumulative",
+		"bytes_sent:150|c|#host:a,veneur_metric_kind:cumulative",
+		"configured:10|c",
+		"plain:10|c",
+	)
+	assert.Equal(t, map[string]float64{
+		"bytes_sent|host:a": 50,
+		"plain|":            10,
+	}, flushCounters(w), "the first totals should only be remembered")
+
+	processPackets(t, w,
+		"bytes_sent:170|c|#host:a,veneur_metric_kind:cumulative",
+		// a reset:
+		"bytes_sent:5|c|#host:a,veneur_metric_kind:cumulative",
+		"bytes_sent:8|c|#host:a,veneur_metric_kind:cumulative",
+		"configured:25|c|@0.5",
+	)
+	assert.Equal(t, map[string]float64{
+		"bytes_sent|host:a": 20 + 5 + 3,
+		"configured|":       15,
+	}, flushCounters(w))
+	assert.Len(t, w.cumulative.contexts, 2)
+
+	// "configured" isn't sent for long enough to be forgotten, so its
+	// next total starts it over:
+	processPackets(t, w, "bytes_sent:10|c|#host:a,veneur_metric_kind:cumulative")
+	assert.Equal(t, map[string]float64{"bytes_sent|host:a": 2}, flushCounters(w))
+	processPackets(t, w, "bytes_sent:12|c|#host:a,veneur_metric_kind:cumulative")
+	assert.Equal(t, map[string]float64{"bytes_sent|host:a": 2}, flushCounters(w))
+	assert.Len(t, w.cumulative.contexts, 1)
+	processPackets(t, w, "configured:100|c")
+	assert.Empty(t, flushCounters(w))
+}
+
+func TestCumulativeCountersGlobal(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	processPackets(t, w,
+		"total:1|c|#veneurglobalonly,veneur_metric_kind:cumulative",
+		"total:4|c|#veneurglobalonly,veneur_metric_kind:cumulative",
+	)
+	wm := w.Flush()
+	assert.Empty(t, wm.counters)
+	c := wm.globalCounters[samplers.MetricKey{Name: "total", Type: "counter"}]
+	if assert.NotNil(t, c) {
+		assert.Equal(t, float64(3), c.Flush(0)[0].Value)
+	}
+}
@@ -0,0 +1,235 @@
+package veneur
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+)
+
+// The bounds of the captures at /debug/capture: how long they last by
+// default and at most, and how many datagrams and bytes of them they
+// keep at most. Once they're reached, the oldest datagrams make room
+// for new ones.
+const (
+	defaultCaptureDuration = 10 * time.Second
+	maxCaptureDuration     = time.Minute
+	maxCapturePackets      = 10000
+	maxCaptureBytes        = 16 * 1024 * 1024
+)
+
+// packetCapture records the raw datagrams that the statsd and SSF UDP
+// listeners read, while a capture that /debug/capture started runs.
+// While none does, the listeners only check active, so that capturing
+// costs nothing otherwise.
+type packetCapture struct {
+	active int32 // atomic; 1 while a capture runs
+
+	mtx     sync.Mutex
+	session *captureSession
+}
+
+// captureSession is a capture of the datagrams of one protocol, or of
+// both if it's empty, and with a metric or span name that starts with
+// prefix, if it's set. It keeps the last of them in a ring.
+type captureSession struct {
+	protocol string
+	prefix   string
+	clock    clock
+
+	mtx     sync.Mutex
+	packets []capturedPacket
+	head    int
+	count   int
+	bytes   int
+	evicted int
+}
+
+// capturedPacket is a datagram as /debug/capture returns it, in a JSON
+// line. statsd datagrams are in Text, and SSF ones in Data, which is
+// encoded in base64.
+type capturedPacket struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	Source   string    `json:"source,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+}
+
+func (p *capturedPacket) size() int {
+	return len(p.Text) + len(p.Data)
+}
+
+// isActive reports whether a capture is running, and the listeners
+// should record their datagrams.
+func (c *packetCapture) isActive() bool {
+	return atomic.LoadInt32(&c.active) == 1
+}
+
+// start starts a capture, unless one is running already.
+func (c *packetCapture) start(proto, prefix string, cl clock) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.session != nil {
+		return false
+	}
+	c.session = &captureSession{
+		protocol: proto,
+		prefix:   prefix,
+		clock:    cl,
+		packets:  make([]capturedPacket, maxCapturePackets),
+	}
+	atomic.StoreInt32(&c.active, 1)
+	return true
+}
+
+// stop stops the running capture, and returns the datagrams it kept,
+// oldest first, and how many it evicted to make room for them.
+func (c *packetCapture) stop() ([]capturedPacket, int) {
+	c.mtx.Lock()
+	s := c.session
+	c.session = nil
+	atomic.StoreInt32(&c.active, 0)
+	c.mtx.Unlock()
+	if s == nil {
+		return nil, 0
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	packets := make([]capturedPacket, 0, s.count)
+	for i := 0; i < s.count; i++ {
+		packets = append(packets, s.packets[(s.head+i)%len(s.packets)])
+	}
+	return packets, s.evicted
+}
+
+// record records a datagram of the protocol proto from addr, if the
+// running capture, if any, matches it. The datagram is copied, so that
+// its buffer can be reused.
+func (c *packetCapture) record(proto string, packet []byte, addr net.Addr) {
+	c.mtx.Lock()
+	s := c.session
+	c.mtx.Unlock()
+	if s == nil || (s.protocol != "" && s.protocol != proto) || !s.matches(proto, packet) {
+		return
+	}
+
+	p := capturedPacket{Time: s.clock.Now(), Protocol: proto}
+	if addr != nil {
+		p.Source = addr.String()
+	}
+	if proto == "ssf" {
+		p.Data = append([]byte(nil), packet...)
+	} else {
+		p.Text = string(packet)
+	}
+	s.add(p)
+}
+
+// matches reports whether a datagram has a metric, or for SSF a span,
+// whose name starts with the session's prefix.
+func (s *captureSession) matches(proto string, packet []byte) bool {
+	if s.prefix == "" {
+		return true
+	}
+	if proto != "ssf" {
+		prefix := []byte(s.prefix)
+		for _, line := range bytes.Split(packet, []byte{'\n'}) {
+			if bytes.HasPrefix(line, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var spans []*ssf.SSFSpan
+	if protocol.IsBatchDatagram(packet) {
+		spans, _ = protocol.ParseSSFBatchDatagram(packet, 0)
+	} else if span, err := protocol.ParseSSF(packet); err == nil {
+		spans = []*ssf.SSFSpan{span}
+	}
+	for _, span := range spans {
+		if strings.HasPrefix(span.Name, s.prefix) {
+			return true
+		}
+		for _, sample := range span.Metrics {
+			if strings.HasPrefix(sample.Name, s.prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// add adds a datagram to the ring, evicting the oldest ones until it
+// fits in maxCapturePackets and maxCaptureBytes.
+func (s *captureSession) add(p capturedPacket) {
+	if p.size() > maxCaptureBytes {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for s.count > 0 && (s.count == len(s.packets) || s.bytes+p.size() > maxCaptureBytes) {
+		s.bytes -= s.packets[s.head].size()
+		s.packets[s.head] = capturedPacket{}
+		s.head = (s.head + 1) % len(s.packets)
+		s.count--
+		s.evicted++
+	}
+	s.packets[(s.head+s.count)%len(s.packets)] = p
+	s.count++
+	s.bytes += p.size()
+}
+
+// handleDebugCapture captures the datagrams that the statsd and SSF UDP
+// listeners read for the number of seconds in its parameter, 10 by
+// default and 60 at most, and returns them as JSON lines. The protocol
+// parameter only captures statsd or ssf, and filter only the datagrams
+// with metrics (or spans) whose names start with it. Only one capture
+// runs at a time.
+func (s *Server) handleDebugCapture(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	d := defaultCaptureDuration
+	if v := q.Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > int(maxCaptureDuration/time.Second) {
+			http.Error(w, "seconds must be an integer from 1 to 60", http.StatusBadRequest)
+			return
+		}
+		d = time.Duration(n) * time.Second
+	}
+	proto := q.Get("protocol")
+	if proto != "" && proto != "statsd" && proto != "ssf" {
+		http.Error(w, "protocol must be statsd or ssf", http.StatusBadRequest)
+		return
+	}
+
+	timeout := s.clock.After(d)
+	if !s.capture.start(proto, q.Get("filter"), s.clock) {
+		http.Error(w, "a capture is already running", http.StatusConflict)
+		return
+	}
+	select {
+	case <-timeout:
+	case <-r.Context().Done():
+	case <-s.shutdown:
+	}
+	packets, evicted := s.capture.stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="veneur-capture.jsonl"`)
+	w.Header().Set("X-Capture-Evicted", strconv.Itoa(evicted))
+	enc := json.NewEncoder(w)
+	for i := range packets {
+		enc.Encode(&packets[i])
+	}
+}
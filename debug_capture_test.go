@@ -0,0 +1,92 @@
+package veneur
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/internal/veneurtest"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestPacketCaptureRing(t *testing.T) {
+	var c packetCapture
+	c.record("statsd", []byte("a.b.c:1|c"), nil)
+	assert.False(t, c.isActive())
+
+	require.True(t, c.start("statsd", "", veneurtest.NewClock(time.Unix(1500000000, 0))))
+	assert.True(t, c.isActive())
+	assert.False(t, c.start("", "", nil), "only one capture runs at a time")
+	for i := 0; i < maxCapturePackets+2; i++ {
+		c.record("statsd", []byte("a.b.c:"+strconv.Itoa(i)+"|c"), nil)
+	}
+	c.record("ssf", []byte{0}, nil)
+
+	packets, evicted := c.stop()
+	assert.False(t, c.isActive())
+	assert.Equal(t, 2, evicted)
+	require.Len(t, packets, maxCapturePackets)
+	assert.Equal(t, "a.b.c:2|c", packets[0].Text, "the oldest datagrams are evicted")
+	assert.Equal(t, "a.b.c:"+strconv.Itoa(maxCapturePackets+1)+"|c", packets[len(packets)-1].Text)
+}
+
+func TestHandleDebugCapture(t *testing.T) {
+	h := newHarness(t, globalConfig())
+	defer h.Close()
+	s := h.server
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.handleDebugCapture(rec, httptest.NewRequest(http.MethodGet, "/debug/capture?seconds=1&filter=api.", nil))
+		close(done)
+	}()
+	for start := time.Now(); !s.capture.isActive(); time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < harnessTimeout, "timed out waiting for the capture")
+	}
+
+	busy := httptest.NewRecorder()
+	s.handleDebugCapture(busy, httptest.NewRequest(http.MethodGet, "/debug/capture", nil))
+	assert.Equal(t, http.StatusConflict, busy.Code)
+
+	source := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	s.handleMetricDatagram([]byte("db.queries:1|c\napi.requests:1|c"), source, nil)
+	s.handleMetricDatagram([]byte("db.queries:1|c"), source, nil)
+	batch := &protocol.Batch{}
+	require.NoError(t, batch.Add(&ssf.SSFSpan{Id: 1, TraceId: 1, Name: "api.handle"}))
+	s.capture.record("ssf", batch.Datagram(), nil)
+	other, err := (&ssf.SSFSpan{Id: 2, TraceId: 1, Name: "db.query"}).Marshal()
+	require.NoError(t, err)
+	s.capture.record("ssf", other, nil)
+
+	h.clock.Advance(time.Second)
+	<-done
+	assert.False(t, s.capture.isActive())
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	var packets []capturedPacket
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var p capturedPacket
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &p))
+		packets = append(packets, p)
+	}
+	require.Len(t, packets, 2)
+	assert.Equal(t, "statsd", packets[0].Protocol)
+	assert.Equal(t, "db.queries:1|c\napi.requests:1|c", packets[0].Text)
+	assert.Equal(t, "10.0.0.1:5000", packets[0].Source)
+	assert.Equal(t, "ssf", packets[1].Protocol)
+	assert.Equal(t, batch.Datagram(), packets[1].Data)
+
+	bad := httptest.NewRecorder()
+	s.handleDebugCapture(bad, httptest.NewRequest(http.MethodGet, "/debug/capture?seconds=600", nil))
+	assert.Equal(t, http.StatusBadRequest, bad.Code)
+}
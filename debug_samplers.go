@@ -0,0 +1,150 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// maxDebugSamplers caps how many samplers /debug/samplers describes,
+// however many match, so that the response stays small enough to
+// build without holding up the workers for long.
+const maxDebugSamplers = 10000
+
+// debugSampler is a sampler's state, with its type and scope.
+type debugSampler struct {
+	Type  string `json:"type"`
+	Scope string `json:"scope"`
+	samplers.SamplerState
+}
+
+type debugWorker struct {
+	ID       int            `json:"id"`
+	Samplers []debugSampler `json:"samplers"`
+}
+
+// samplerSnapshot describes up to limit of the worker's samplers whose
+// names start with prefix. It holds the worker's mutex for one map of
+// samplers at a time, so that it only holds up ingestion briefly; so
+// the maps it reads may straddle a flush.
+func (w *Worker) samplerSnapshot(prefix string, limit int, percentiles []float64) []debugSampler {
+	snapshot := []debugSampler{}
+	// add adds the sampler if its name matches, and returns false once
+	// the snapshot is full
+	add := func(typ, scope, name string, state func() samplers.SamplerState) bool {
+		if len(snapshot) >= limit {
+			return false
+		}
+		if strings.HasPrefix(name, prefix) {
+			snapshot = append(snapshot, debugSampler{Type: typ, Scope: scope, SamplerState: state()})
+		}
+		return true
+	}
+	locked := func(read func(wm WorkerMetrics)) {
+		if len(snapshot) >= limit {
+			return
+		}
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		read(w.wm)
+	}
+	histos := func(typ, scope string, histos map[samplers.MetricKey]*samplers.Histo) {
+		for _, h := range histos {
+			state := func() samplers.SamplerState { return h.State(percentiles) }
+			if !add(typ, scope, h.Name, state) {
+				return
+			}
+		}
+	}
+
+	locked(func(wm WorkerMetrics) {
+		for _, c := range wm.counters {
+			if !add("counter", "mixed", c.Name, c.State) {
+				return
+			}
+		}
+	})
+	locked(func(wm WorkerMetrics) {
+		for _, c := range wm.globalCounters {
+			if !add("counter", "global", c.Name, c.State) {
+				return
+			}
+		}
+	})
+	locked(func(wm WorkerMetrics) {
+		for _, g := range wm.gauges {
+			if !add("gauge", "mixed", g.Name, g.State) {
+				return
+			}
+		}
+	})
+	locked(func(wm WorkerMetrics) {
+		for _, g := range wm.globalGauges {
+			if !add("gauge", "global", g.Name, g.State) {
+				return
+			}
+		}
+	})
+	locked(func(wm WorkerMetrics) {
+		for _, s := range wm.sets {
+			if !add("set", "mixed", s.Name, s.State) {
+				return
+			}
+		}
+	})
+	locked(func(wm WorkerMetrics) {
+		for _, s := range wm.localSets {
+			if !add("set", "local", s.Name, s.State) {
+				return
+			}
+		}
+	})
+	locked(func(wm WorkerMetrics) { histos("histogram", "mixed", wm.histograms) })
+	locked(func(wm WorkerMetrics) { histos("histogram", "local", wm.localHistograms) })
+	locked(func(wm WorkerMetrics) { histos("timer", "mixed", wm.timers) })
+	locked(func(wm WorkerMetrics) { histos("timer", "local", wm.localTimers) })
+	return snapshot
+}
+
+// handleDebugSamplers describes the samplers that each worker holds in
+// the current interval, as JSON. The prefix parameter only describes
+// the samplers whose names start with it, and limit caps how many are
+// described, up to maxDebugSamplers.
+func (s *Server) handleDebugSamplers(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	limit := maxDebugSamplers
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	workers := s.currentWorkers()
+	body := struct {
+		Workers []debugWorker `json:"workers"`
+		// Truncated is set if the limit was reached, so that there
+		// may be more samplers
+		Truncated bool `json:"truncated"`
+	}{Workers: make([]debugWorker, 0, len(workers))}
+	remaining := limit
+	for _, wk := range workers {
+		if remaining == 0 {
+			break
+		}
+		snapshot := wk.samplerSnapshot(prefix, remaining, s.HistogramPercentiles)
+		remaining -= len(snapshot)
+		body.Workers = append(body.Workers, debugWorker{ID: wk.id, Samplers: snapshot})
+	}
+	body.Truncated = remaining == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
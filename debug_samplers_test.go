@@ -0,0 +1,77 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestHandleDebugSamplers(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	for _, packet := range []string{
+		"api.requests:1|c|#method:get", "api.requests:2|c|#method:get",
+		"api.latency:10|h", "api.latency:20|h", "api.latency:30|h",
+		"db.connections:4|g",
+	} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		w.ProcessMetric(m)
+	}
+	s := &Server{Workers: []*Worker{w}, HistogramPercentiles: []float64{0.5}}
+
+	get := func(query string) (body struct {
+		Workers []struct {
+			ID       int `json:"id"`
+			Samplers []struct {
+				Type        string             `json:"type"`
+				Name        string             `json:"name"`
+				Tags        []string           `json:"tags"`
+				Samples     int64              `json:"samples"`
+				Value       float64            `json:"value"`
+				Percentiles map[string]float64 `json:"percentiles"`
+			} `json:"samplers"`
+		} `json:"workers"`
+		Truncated bool `json:"truncated"`
+	}) {
+		rec := httptest.NewRecorder()
+		s.handleDebugSamplers(rec, httptest.NewRequest(http.MethodGet, "/debug/samplers"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		return body
+	}
+
+	body := get("?prefix=api.")
+	require.Len(t, body.Workers, 1)
+	assert.False(t, body.Truncated)
+	samplers := body.Workers[0].Samplers
+	require.Len(t, samplers, 2)
+	for _, sampler := range samplers {
+		switch sampler.Type {
+		case "counter":
+			assert.Equal(t, "api.requests", sampler.Name)
+			assert.Equal(t, []string{"method:get"}, sampler.Tags)
+			assert.Equal(t, int64(2), sampler.Samples)
+			assert.Equal(t, float64(3), sampler.Value)
+		case "histogram":
+			assert.Equal(t, "api.latency", sampler.Name)
+			assert.Equal(t, int64(3), sampler.Samples)
+			assert.InDelta(t, 20, sampler.Percentiles["50percentile"], 5)
+		default:
+			t.Errorf("unexpected %s %s", sampler.Type, sampler.Name)
+		}
+	}
+
+	body = get("?limit=1")
+	assert.True(t, body.Truncated)
+	assert.Len(t, body.Workers[0].Samplers, 1)
+
+	rec := httptest.NewRecorder()
+	s.handleDebugSamplers(rec, httptest.NewRequest(http.MethodGet, "/debug/samplers?limit=none", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,64 @@
+package veneur
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/stripe/veneur/trace"
+)
+
+// flushTraceTag marks the spans of the stages of a flush.
+const flushTraceTag = "veneur_flush_stage"
+
+type flushStagesKey struct{}
+
+// flushStages records the stages of a traced flush as child spans of
+// its root span: draining the workers, merging their metrics, and
+// flushing each sink, forwarding and each plugin. They go through the
+// internal trace client, like veneur's other spans, to the span sinks.
+//
+// The spans of a flush carry no metrics and aren't indicators, so that
+// ingesting them doesn't add metrics to later flushes, and there are a
+// fixed number of them for each flush: the span sinks' own flushes,
+// which ingest them, aren't traced span by span.
+type flushStages struct {
+	cl   *trace.Client
+	root *trace.Trace
+}
+
+// traceFlushStages returns the flush stages of a flush with the root
+// span, or nil if flush tracing is off or this flush isn't sampled. The
+// stages can be started on the context that it returns.
+func (s *Server) traceFlushStages(ctx context.Context, root *trace.Span) context.Context {
+	if !s.flushTraceEnabled || rand.Float64() >= s.flushTraceSampleRate {
+		return ctx
+	}
+	return context.WithValue(ctx, flushStagesKey{}, &flushStages{cl: s.TraceClient, root: root.Trace})
+}
+
+// startFlushStage starts the span of a stage of the flush traced by
+// ctx, if it is traced. service names the span's service, if it isn't
+// veneur itself, like the sink that a stage flushes. It returns a
+// function that finishes the span and records it, as failed if err is
+// not nil.
+func startFlushStage(ctx context.Context, name, service string) func(err error) {
+	fs, ok := ctx.Value(flushStagesKey{}).(*flushStages)
+	if !ok {
+		return func(error) {}
+	}
+	stage := trace.StartChildSpan(fs.root)
+	stage.Tags = map[string]string{flushTraceTag: name}
+	return func(err error) {
+		if err != nil {
+			stage.Error(err)
+		}
+		stage.End = time.Now()
+		span := stage.SSFSpan()
+		span.Name = "flush." + name
+		if service != "" {
+			span.Service = service
+		}
+		trace.Record(fs.cl, span, nil)
+	}
+}
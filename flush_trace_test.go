@@ -0,0 +1,70 @@
+package veneur
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+func TestFlushStages(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 10)
+	cl, err := trace.NewChannelClient(spans)
+	require.NoError(t, err)
+	defer cl.Close()
+	cms, _ := NewChannelMetricSink(make(chan []samplers.InterMetric, 1))
+	sf, err := newSinkFlushes(time.Hour, "", nil, 1)
+	require.NoError(t, err)
+	s := &Server{
+		metricSinks:          []sinks.MetricSink{cms},
+		sinkFlushes:          sf,
+		TraceClient:          cl,
+		flushTraceEnabled:    true,
+		flushTraceSampleRate: 1,
+	}
+
+	root := tracer.StartSpan("flush").(*trace.Span)
+	ctx := s.traceFlushStages(context.Background(), root)
+	merged := startFlushStage(ctx, "merge", "")
+	merged(nil)
+	startFlushStage(ctx, "forward", "")(errors.New("no destinations"))
+	s.flushMetricSinks(ctx, []samplers.InterMetric{{Name: "a.b.c", Value: 1}})
+
+	// The spans of the stages come along with those that carry the
+	// sink's metrics:
+	byName := map[string]*ssf.SSFSpan{}
+	for len(byName) < 3 {
+		span := <-spans
+		if len(span.Metrics) > 0 {
+			continue
+		}
+		byName[span.Name] = span
+		assert.Equal(t, root.TraceID, span.TraceId)
+		assert.Equal(t, root.SpanID, span.ParentId)
+		assert.False(t, span.Indicator)
+	}
+	require.Contains(t, byName, "flush.merge")
+	assert.Equal(t, "merge", byName["flush.merge"].Tags[flushTraceTag])
+	assert.False(t, byName["flush.merge"].Error)
+	require.Contains(t, byName, "flush.forward")
+	assert.True(t, byName["flush.forward"].Error)
+	require.Contains(t, byName, "flush.sink")
+	assert.Equal(t, "channel", byName["flush.sink"].Service)
+
+	// Flushes that aren't traced have no stages:
+	for len(spans) > 0 {
+		<-spans
+	}
+	s.flushTraceEnabled = false
+	startFlushStage(s.traceFlushStages(context.Background(), root), "merge", "")(nil)
+	s.flushTraceEnabled, s.flushTraceSampleRate = true, 0
+	startFlushStage(s.traceFlushStages(context.Background(), root), "merge", "")(nil)
+	assert.Len(t, spans, 0)
+}
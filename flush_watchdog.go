@@ -0,0 +1,228 @@
+package veneur
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+const (
+	// flushWatchdogExit exits the process when flushes are stuck, so
+	// that its supervisor restarts it.
+	flushWatchdogExit = "exit"
+	// flushWatchdogAbandon cancels the stuck flush's context and
+	// carries on flushing in a new loop. The new loop's flushes wait
+	// for the stuck one to be done with the workers, so that only
+	// their sinks' flushes can overlap.
+	flushWatchdogAbandon = "abandon"
+)
+
+// flushWatchdog notices when a flush hasn't finished within missed
+// intervals. It's safe for use by concurrent goroutines.
+type flushWatchdog struct {
+	missed  int
+	abandon bool
+
+	// lastFlush is when the last flush finished, in unix nanoseconds
+	lastFlush int64
+
+	// generation is bumped each time a flush loop is abandoned, so that
+	// the abandoned loop stops once its flush returns
+	mtx        sync.Mutex
+	generation int
+	cancel     context.CancelFunc
+}
+
+// newFlushWatchdog returns nil if missed is 0, for a server without a
+// watchdog.
+func newFlushWatchdog(missed int, action string) (*flushWatchdog, error) {
+	if missed == 0 {
+		return nil, nil
+	}
+	// the first flush can take up to two intervals when they're
+	// synchronized, so anything less would trip on startup
+	if missed < 2 {
+		return nil, fmt.Errorf("flush_watchdog_missed_flushes must be at least 2, not %d", missed)
+	}
+	w := &flushWatchdog{missed: missed}
+	switch action {
+	case "", flushWatchdogExit:
+	case flushWatchdogAbandon:
+		w.abandon = true
+	default:
+		return nil, fmt.Errorf("flush_watchdog_action must be %q or %q, not %q",
+			flushWatchdogExit, flushWatchdogAbandon, action)
+	}
+	w.flushed()
+	return w, nil
+}
+
+func (w *flushWatchdog) flushed() {
+	atomic.StoreInt64(&w.lastFlush, time.Now().UnixNano())
+}
+
+func (w *flushWatchdog) sinceFlush() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&w.lastFlush)))
+}
+
+// start returns the context for a flush by the loop of the generation,
+// or false if the loop has been abandoned.
+func (w *flushWatchdog) start(generation int) (context.Context, bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if generation != w.generation {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	return ctx, true
+}
+
+// finish records that the loop's flush has returned, and returns false
+// if the loop has been abandoned in the meantime.
+func (w *flushWatchdog) finish(generation int) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if generation != w.generation {
+		return false
+	}
+	w.cancel()
+	w.cancel = nil
+	w.flushed()
+	return true
+}
+
+// abandonFlush cancels the running flush, if there is one, and returns
+// the generation of the loop that takes over.
+func (w *flushWatchdog) abandonFlush() int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+	w.generation++
+	w.flushed()
+	return w.generation
+}
+
+// startFlushLoop starts a flush loop of the generation, which takes
+// over from the running one, if any: the final flush on shutdown only
+// waits for the last loop that started to exit.
+func (s *Server) startFlushLoop(generation int) {
+	done := make(chan struct{})
+	s.flushLoopMtx.Lock()
+	s.flushLoopDone = done
+	s.flushLoopMtx.Unlock()
+	go func() {
+		defer close(done)
+		s.flushLoop(generation)
+	}()
+}
+
+// flushLoop flushes every interval until the server shuts down, or
+// until the watchdog abandons the loop's generation.
+func (s *Server) flushLoop(generation int) {
+	defer func() {
+		ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
+	}()
+
+	if s.synchronizeInterval {
+		// We want to align our ticker to a multiple of its duration for
+		// convenience of bucketing.
+		select {
+		case <-s.clock.After(CalculateTickDelay(s.interval, s.clock.Now())):
+		case <-s.shutdown:
+			return
+		}
+	}
+
+	// We aligned the ticker to our interval above. It's worth noting that just
+	// because we aligned once we're not guaranteed to be perfect on each
+	// subsequent tick. This code is small, however, and should service the
+	// incoming tick signal fast enough that the amount we are "off" is
+	// negligible.
+	ticks, stop := s.clock.NewTicker(s.interval)
+	defer stop()
+	for {
+		select {
+		case <-s.shutdown:
+			// stop flushing on graceful shutdown
+			return
+		case <-ticks:
+			if s.flushWatchdog == nil {
+				s.flushed(s.flush(context.TODO()))
+				continue
+			}
+			ctx, ok := s.flushWatchdog.start(generation)
+			if !ok {
+				return
+			}
+			s.flushed(s.flush(ctx))
+			if !s.flushWatchdog.finish(generation) {
+				return
+			}
+		}
+	}
+}
+
+// flushed hands the background parts of a flush loop's flush to
+// afterFlush, if it's set.
+func (s *Server) flushed(wg *sync.WaitGroup) {
+	if s.afterFlush != nil {
+		s.afterFlush(wg)
+	}
+}
+
+// watchFlushes checks every interval that a flush has finished within
+// the watchdog's missed intervals, until the server shuts down.
+func (s *Server) watchFlushes() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			if s.flushWatchdog.sinceFlush() > time.Duration(s.flushWatchdog.missed)*s.interval {
+				s.flushesStuck()
+			}
+		}
+	}
+}
+
+// flushesStuck logs every goroutine's stack, to show where the flush is
+// stuck, and then exits or abandons the flush.
+func (s *Server) flushesStuck() {
+	action := flushWatchdogExit
+	if s.flushWatchdog.abandon {
+		action = flushWatchdogAbandon
+	}
+	var dump bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&dump, 2)
+	fields := logrus.Fields{
+		"missed_flushes": s.flushWatchdog.missed,
+		"since_flush":    s.flushWatchdog.sinceFlush(),
+		"action":         action,
+		"goroutines":     dump.String(),
+	}
+	metrics.ReportOne(s.TraceClient, ssf.Count("flush.watchdog_triggered", 1,
+		map[string]string{"action": action}))
+
+	if !s.flushWatchdog.abandon {
+		// give the counter a chance to make it out before exiting
+		trace.Flush(s.TraceClient)
+		log.WithFields(fields).Fatal("Flushes are stuck, exiting")
+	}
+	log.WithFields(fields).Error("Flushes are stuck, abandoning the stuck flush")
+	s.startFlushLoop(s.flushWatchdog.abandonFlush())
+}
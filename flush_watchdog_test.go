@@ -0,0 +1,163 @@
+package veneur
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// wedgedMetricSink's first flush doesn't return until its context is
+// cancelled. Later flushes send their metrics down flushed.
+type wedgedMetricSink struct {
+	flushes   int32
+	wedged    chan struct{}
+	abandoned chan struct{}
+	flushed   chan []samplers.InterMetric
+}
+
+func (s *wedgedMetricSink) Name() string { return "wedged" }
+
+func (s *wedgedMetricSink) Start(*trace.Client) error { return nil }
+
+func (s *wedgedMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	if atomic.AddInt32(&s.flushes, 1) == 1 {
+		close(s.wedged)
+		<-ctx.Done()
+		close(s.abandoned)
+		return ctx.Err()
+	}
+	s.flushed <- metrics
+	return nil
+}
+
+func (s *wedgedMetricSink) FlushOtherSamples(ctx context.Context, events []ssf.SSFSample) {}
+
+func TestFlushWatchdogAbandon(t *testing.T) {
+	config := globalConfig()
+	config.FlushWatchdogMissedFlushes = 2
+	config.FlushWatchdogAction = flushWatchdogAbandon
+	// so that only the watchdog can unwedge the sink
+	config.MetricSinkFlushTimeout = "1h"
+
+	sink := &wedgedMetricSink{
+		wedged:    make(chan struct{}),
+		abandoned: make(chan struct{}),
+		flushed:   make(chan []samplers.InterMetric, 10),
+	}
+	s := setupVeneurServer(t, config, nil, sink, nil)
+	defer s.Shutdown()
+	require.NotNil(t, s.flushWatchdog)
+
+	require.NoError(t, s.HandleMetricPacket([]byte("a.b.c:1|c")))
+	wait := func(ch <-chan struct{}, what string) {
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for the %s", what)
+		}
+	}
+	wait(sink.wedged, "sink to wedge")
+	wait(sink.abandoned, "watchdog to abandon the flush")
+
+	// a new flush loop should have taken over:
+	require.NoError(t, s.HandleMetricPacket([]byte("d.e.f:1|c")))
+	for {
+		select {
+		case metrics := <-sink.flushed:
+			for _, m := range metrics {
+				if m.Name == "d.e.f" {
+					return
+				}
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for a flush after the watchdog triggered")
+		}
+	}
+}
+
+// countingMetricSink counts the flushes of other samples, and sends its
+// flushes' metrics down flushed.
+type countingMetricSink struct {
+	otherFlushes int32
+	flushed      chan []samplers.InterMetric
+}
+
+func (s *countingMetricSink) Name() string { return "counting" }
+
+func (s *countingMetricSink) Start(*trace.Client) error { return nil }
+
+func (s *countingMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	s.flushed <- metrics
+	return nil
+}
+
+func (s *countingMetricSink) FlushOtherSamples(ctx context.Context, events []ssf.SSFSample) {
+	atomic.AddInt32(&s.otherFlushes, 1)
+}
+
+func TestFlushWatchdogAbandonWaitsForWorkers(t *testing.T) {
+	config := globalConfig()
+	config.FlushWatchdogMissedFlushes = 2
+	config.FlushWatchdogAction = flushWatchdogAbandon
+	config.NumWorkers = 1
+	sink := &countingMetricSink{flushed: make(chan []samplers.InterMetric, 100)}
+	s := setupVeneurServer(t, config, nil, sink, nil)
+	defer s.Shutdown()
+
+	// wedge the flushes while they take the worker's metrics:
+	s.Workers[0].mutex.Lock()
+	require.NoError(t, s.HandleMetricPacket([]byte("a.b.c:1|c")))
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.flushWatchdog.mtx.Lock()
+		abandoned := s.flushWatchdog.generation > 0
+		s.flushWatchdog.mtx.Unlock()
+		if abandoned {
+			break
+		}
+		require.True(t, time.Since(start) < 10*time.Second, "timed out waiting for the watchdog to abandon the flush")
+	}
+	time.Sleep(3 * s.interval)
+	assert.Zero(t, atomic.LoadInt32(&sink.otherFlushes),
+		"the new flush loop shouldn't flush while the abandoned flush is stuck on the worker")
+	s.Workers[0].mutex.Unlock()
+
+	// the counter is flushed once, by one of the flushes:
+	var total float64
+	timeout := time.After(20 * s.interval)
+	for {
+		select {
+		case metrics := <-sink.flushed:
+			for _, m := range metrics {
+				if m.Name == "a.b.c" {
+					total += m.Value
+				}
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	assert.Equal(t, float64(1), total)
+}
+
+func TestNewFlushWatchdog(t *testing.T) {
+	w, err := newFlushWatchdog(0, flushWatchdogAbandon)
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+
+	w, err = newFlushWatchdog(3, "")
+	require.NoError(t, err)
+	assert.False(t, w.abandon)
+
+	_, err = newFlushWatchdog(1, flushWatchdogExit)
+	assert.Error(t, err)
+	_, err = newFlushWatchdog(3, "restart")
+	assert.Error(t, err)
+}
@@ -14,9 +14,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/veneur/forwardrpc"
 	vhttp "github.com/stripe/veneur/http"
+	"github.com/stripe/veneur/internal/build"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/samplers/metricpb"
-	"github.com/stripe/veneur/sinks"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
 	"github.com/stripe/veneur/trace/metrics"
@@ -25,8 +25,17 @@ import (
 
 // Flush collects sampler's metrics and passes them to sinks.
 func (s *Server) Flush(ctx context.Context) {
+	s.flush(ctx)
+}
+
+// flush is Flush, returning a WaitGroup for the parts of the flush it
+// leaves running in the background: flushing the traces, forwarding and
+// the plugins. The final flush on shutdown waits for them.
+func (s *Server) flush(ctx context.Context) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
 	span := tracer.StartSpan("flush").(*trace.Span)
 	defer span.ClientFinish(s.TraceClient)
+	ctx = s.traceFlushStages(ctx, span)
 
 	mem := &runtime.MemStats{}
 	runtime.ReadMemStats(mem)
@@ -39,15 +48,31 @@ func (s *Server) Flush(ctx context.Context) {
 	s.Statsd.Gauge("gc.alloc_heap_bytes_total", float64(mem.TotalAlloc), nil, 1.0)
 	s.Statsd.Gauge("gc.mallocs_objects_total", float64(mem.Mallocs), nil, 1.0)
 	s.Statsd.Gauge("mem.heap_alloc_bytes", float64(mem.HeapAlloc), nil, 1.0)
+	s.Statsd.Gauge("build_info", 1, []string{"version:" + build.Version, "commit:" + build.Commit}, 1.0)
+
+	// Everything up to handing the metrics to the sinks is single
+	// flight: only the sinks' flushes of an abandoned flush may still
+	// be running.
+	s.aggregating.Lock()
+	if s.sourceAccounting != nil {
+		s.sourceAccounting.rotate(s.TraceClient)
+	}
+	s.reportRateLimited()
+	s.reportSocketStats()
+	if s.ssfTLSConfig != nil {
+		s.Statsd.Gauge("ssf.tls.open_connections", float64(atomic.LoadInt64(&s.ssfTLSConns)), nil, 1.0)
+	}
+	s.applyPendingExcludedTags()
 
 	samples := s.EventWorker.Flush()
 
-	// TODO Concurrency
-	for _, sink := range s.metricSinks {
-		sink.FlushOtherSamples(span.Attach(ctx), samples)
-	}
-
-	go s.flushTraces(span.Attach(ctx))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		done := startFlushStage(ctx, "span_sinks", "")
+		s.flushTraces(span.Attach(ctx))
+		done(nil)
+	}()
 
 	// don't publish percentiles if we're a local veneur; that's the global
 	// veneur's job
@@ -58,49 +83,83 @@ func (s *Server) Flush(ctx context.Context) {
 		percentiles = s.HistogramPercentiles
 	}
 
+	drained := startFlushStage(ctx, "worker_drain", "")
+	if s.workerScaler != nil {
+		s.Workers = s.workerScaler.scale(ctx, s.TraceClient)
+	}
 	tempMetrics, ms := s.tallyMetrics(percentiles)
+	if s.workerScaler != nil {
+		s.workerScaler.flushed()
+	}
+	drained(nil)
+	if s.topMetrics != nil {
+		s.topMetrics.update(tempMetrics, s.TraceClient)
+	}
 
+	merged := startFlushStage(ctx, "merge", "")
 	finalMetrics = s.generateInterMetrics(span.Attach(ctx), percentiles, tempMetrics, ms)
+	if s.gaugeRates != nil {
+		rates, samples := s.gaugeRates.rates(finalMetrics)
+		finalMetrics = append(finalMetrics, rates...)
+		metrics.ReportBatch(s.TraceClient, samples)
+	}
+	// The rewrite rules only apply to the metrics that are flushed to
+	// sinks here: forwarded metrics keep their names, so that the
+	// global veneur aggregates them under the names they were sent
+	// with, and rewrites them in its own flush.
+	if mr := s.metricRewriter.load(); mr != nil {
+		metrics.ReportBatch(s.TraceClient, mr.rewrite(finalMetrics))
+	}
+	merged(nil)
 
 	s.reportMetricsFlushCounts(ms)
+	s.aggregating.Unlock()
+
+	// TODO Concurrency
+	for _, sink := range s.metricSinks {
+		sink.FlushOtherSamples(span.Attach(ctx), samples)
+	}
+
+	compressionSamples := &ssf.Samples{}
+	forwardrpc.ReportCompression(compressionSamples)
+	metrics.Report(s.TraceClient, compressionSamples)
 
 	if s.IsLocal() {
 		// Forward over gRPC or HTTP depending on the configuration
-		if s.forwardUseGRPC {
-			go s.forwardGRPC(span.Attach(ctx), tempMetrics)
-		} else {
-			go s.flushForward(span.Attach(ctx), tempMetrics)
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := startFlushStage(ctx, "forward", "")
+			defer done(nil)
+			if s.forwardUseGRPC {
+				s.forwardGRPC(span.Attach(ctx), tempMetrics)
+			} else {
+				s.flushForward(span.Attach(ctx), tempMetrics)
+			}
+		}()
 	} else {
 		s.reportGlobalMetricsFlushCounts(ms)
 	}
 
 	// If there's nothing to flush, don't bother calling the plugins and stuff.
 	if len(finalMetrics) == 0 {
-		return
+		return wg
 	}
 
-	wg := sync.WaitGroup{}
-	for _, sink := range s.metricSinks {
-		wg.Add(1)
-		go func(ms sinks.MetricSink) {
-			err := ms.Flush(span.Attach(ctx), finalMetrics)
-			if err != nil {
-				log.WithError(err).WithField("sink", ms.Name()).Warn("Error flushing sink")
-			}
-			wg.Done()
-		}(sink)
-	}
-	wg.Wait()
+	s.flushMetricSinks(span.Attach(ctx), finalMetrics)
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		samples := &ssf.Samples{}
 		defer metrics.Report(s.TraceClient, samples)
 
 		tags := map[string]string{"part": "post"}
 		for _, p := range s.getPlugins() {
 			start := time.Now()
+			done := startFlushStage(ctx, "plugin", p.Name())
 			err := p.Flush(span.Attach(ctx), finalMetrics)
+			done(err)
 			samples.Add(ssf.Timing(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), time.Since(start), time.Nanosecond, tags))
 			if err != nil {
 				samples.Add(ssf.Count(fmt.Sprintf("flush.plugins.%s.error_total", p.Name()), 1, nil))
@@ -108,6 +167,7 @@ func (s *Server) Flush(ctx context.Context) {
 			samples.Add(ssf.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float32(len(finalMetrics)), nil))
 		}
 	}()
+	return wg
 }
 
 type metricsSummary struct {
@@ -125,6 +185,8 @@ type metricsSummary struct {
 	totalLocalTimers       int
 	totalLocalStatusChecks int
 
+	totalTimestamped int
+
 	totalLength int
 }
 
@@ -159,11 +221,13 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 		ms.totalLocalTimers += len(wm.localTimers)
 
 		ms.totalLocalStatusChecks += len(wm.localStatusChecks)
+
+		ms.totalTimestamped += len(wm.timestamped)
 	}
 
 	metrics.ReportOne(s.TraceClient, ssf.Timing("flush.total_duration_ns", time.Since(gatherStart), time.Nanosecond, map[string]string{"part": "gather"}))
 
-	ms.totalLength = ms.totalCounters + ms.totalGauges +
+	ms.totalLength = ms.totalCounters + ms.totalGauges + ms.totalTimestamped +
 		// histograms and timers each report a metric point for each percentile
 		// plus a point for each of their aggregates
 		(ms.totalTimers+ms.totalHistograms)*(s.HistogramAggregates.Count+len(percentiles)) +
@@ -184,6 +248,28 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 	return tempMetrics, ms
 }
 
+// flushHisto flushes a histogram or timer with the configured aggregates
+// and percentiles, or those configured for its name in
+// aggregate_overrides or its prefix in percentiles_overrides, unless it
+// sets its own with tags. If it's flushed with percentiles and has a
+// rolling window, they're computed over the whole window; histograms
+// flushed without them are forwarded, and stay single-interval.
+func (s *Server) flushHisto(key samplers.MetricKey, local bool, h *samplers.Histo, percentiles []float64) []samplers.InterMetric {
+	if h.Override == nil {
+		h.Override = s.aggregateOverrides[h.Name]
+	}
+	if percentiles == nil {
+		return h.Flush(s.interval, percentiles, s.HistogramAggregates)
+	}
+	percentiles = percentilesFor(s.percentilesOverrides, h.Name, percentiles)
+	if s.histogramWindows != nil {
+		windowed := *h
+		windowed.Value = s.histogramWindows.add(histogramWindowKey{key, local}, h)
+		h = &windowed
+	}
+	return h.Flush(s.interval, percentiles, s.HistogramAggregates)
+}
+
 // generateInterMetrics calls the Flush method on each
 // counter/gauge/histogram/timer/set in order to
 // generate an InterMetric corresponding to that value
@@ -202,31 +288,35 @@ func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64
 		}
 		// if we're a local veneur, then percentiles=nil, and only the local
 		// parts (count, min, max) will be flushed
-		for _, h := range wm.histograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, percentiles, s.HistogramAggregates)...)
+		for k, h := range wm.histograms {
+			finalMetrics = append(finalMetrics, s.flushHisto(k, false, h, percentiles)...)
 		}
-		for _, t := range wm.timers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, percentiles, s.HistogramAggregates)...)
+		for k, t := range wm.timers {
+			finalMetrics = append(finalMetrics, s.flushHisto(k, false, t, percentiles)...)
 		}
 
 		// local-only samplers should be flushed in their entirety, since they
 		// will not be forwarded
 		// we still want percentiles for these, even if we're a local veneur, so
 		// we use the original percentile list when flushing them
-		for _, h := range wm.localHistograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates)...)
+		for k, h := range wm.localHistograms {
+			finalMetrics = append(finalMetrics, s.flushHisto(k, true, h, s.HistogramPercentiles)...)
 		}
 		for _, s := range wm.localSets {
 			finalMetrics = append(finalMetrics, s.Flush()...)
 		}
-		for _, t := range wm.localTimers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates)...)
+		for k, t := range wm.localTimers {
+			finalMetrics = append(finalMetrics, s.flushHisto(k, true, t, s.HistogramPercentiles)...)
 		}
 
 		for _, status := range wm.localStatusChecks {
 			finalMetrics = append(finalMetrics, status.Flush()...)
 		}
 
+		// timestamped metrics aren't aggregated, so they're flushed
+		// wherever they were received
+		finalMetrics = append(finalMetrics, wm.timestamped...)
+
 		// TODO (aditya) refactor this out so we don't
 		// have to call IsLocal again
 		if !s.IsLocal() {
@@ -250,6 +340,10 @@ func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64
 		}
 	}
 
+	if s.histogramWindows != nil {
+		s.histogramWindows.rotate(s.TraceClient)
+	}
+
 	metrics.ReportOne(s.TraceClient, ssf.Timing("flush.total_duration_ns", time.Since(span.Start), time.Nanosecond, map[string]string{"part": "combine"}))
 	return finalMetrics
 }
@@ -375,15 +469,73 @@ func (s *Server) flushForward(ctx context.Context, wms []WorkerMetrics) {
 		return
 	}
 
+	parts, err := s.forwardDestinations.partition(len(jsonMetrics), func(i int) string {
+		return jsonMetrics[i].MetricKey.String()
+	}, nil)
+	if err != nil {
+		s.Statsd.Count("forward.error_total", 1, []string{"cause:no_destination"}, 1.0)
+		log.WithError(err).WithField("metrics", len(jsonMetrics)).Error("Failed to forward to an upstream Veneur")
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	for dest, idx := range parts {
+		batch := make([]samplers.JSONMetric, len(idx))
+		for i, j := range idx {
+			batch[i] = jsonMetrics[j]
+		}
+		wg.Add(1)
+		go func(dest string, batch []samplers.JSONMetric) {
+			defer wg.Done()
+			s.flushForwardBatch(span.Attach(ctx), dest, batch, map[string]bool{})
+		}(dest, batch)
+	}
+	wg.Wait()
+}
+
+// flushForwardBatch posts metrics to a destination, retrying them
+// against the remaining destinations if that fails, in the same way as
+// forwardGRPCBatch.
+func (s *Server) flushForwardBatch(ctx context.Context, dest string, jsonMetrics []samplers.JSONMetric, tried map[string]bool) {
+	destTags := []string{"destination:" + dest, "protocol:http"}
+	start := time.Now()
 	// the error has already been logged (if there was one), so we only care
 	// about the success case
-	endpoint := fmt.Sprintf("%s/import", s.ForwardAddr)
-	if vhttp.PostHelper(span.Attach(ctx), s.HTTPClient, s.TraceClient, http.MethodPost, endpoint, jsonMetrics, "forward", true, nil, log) == nil {
+	endpoint := fmt.Sprintf("%s/import", dest)
+	err := vhttp.PostHelper(ctx, s.forwardHTTPClient, s.TraceClient, http.MethodPost, endpoint, jsonMetrics, "forward", true, nil, log)
+	s.Statsd.TimeInMilliseconds("forward.destination.duration_ns", float64(time.Since(start).Nanoseconds()), destTags, 1.0)
+	s.Statsd.Count("forward.destination.metrics_total", int64(len(jsonMetrics)), destTags, 1.0)
+	if err == nil {
+		s.Statsd.Count("forward.destination.error_total", 0, destTags, 1.0)
 		log.WithFields(logrus.Fields{
 			"metrics":     len(jsonMetrics),
 			"endpoint":    endpoint,
-			"forwardAddr": s.ForwardAddr,
+			"forwardAddr": dest,
 		}).Info("Completed forward to upstream Veneur")
+		return
+	}
+	s.Statsd.Count("forward.destination.error_total", 1, destTags, 1.0)
+
+	if len(s.forwardDestinations.Members()) < 2 {
+		return
+	}
+	s.forwardDestinations.markUnhealthy(dest)
+	tried[dest] = true
+	parts, err := s.forwardDestinations.partition(len(jsonMetrics), func(i int) string {
+		return jsonMetrics[i].MetricKey.String()
+	}, tried)
+	if err != nil {
+		s.Statsd.Count("forward.error_total", 1, []string{"cause:no_destination"}, 1.0)
+		log.WithError(err).WithField("metrics", len(jsonMetrics)).Error("Failed to forward to any upstream Veneur")
+		return
+	}
+	s.Statsd.Count("forward.destination.retried_metrics_total", int64(len(jsonMetrics)), destTags, 1.0)
+	for next, idx := range parts {
+		batch := make([]samplers.JSONMetric, len(idx))
+		for i, j := range idx {
+			batch[i] = jsonMetrics[j]
+		}
+		s.flushForwardBatch(ctx, next, batch, tried)
 	}
 }
 
@@ -450,17 +602,119 @@ func (s *Server) forwardGRPC(ctx context.Context, wms []WorkerMetrics) {
 		return
 	}
 
+	parts, err := s.forwardDestinations.partition(len(metrics), func(i int) string {
+		return samplers.NewMetricKeyFromMetric(metrics[i]).String()
+	}, nil)
+	if err != nil {
+		span.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": "no_destination"}))
+		log.WithError(err).WithField("metrics", len(metrics)).Error("Failed to forward to an upstream Veneur")
+		return
+	}
+
+	// Send to each destination concurrently, so that one that's down
+	// doesn't hold up the others:
+	wg := sync.WaitGroup{}
+	for dest, idx := range parts {
+		batch := make([]*metricpb.Metric, len(idx))
+		for i, j := range idx {
+			batch[i] = metrics[j]
+		}
+		wg.Add(1)
+		go func(dest string, batch []*metricpb.Metric) {
+			defer wg.Done()
+			s.forwardGRPCBatch(span.Attach(ctx), dest, batch, map[string]bool{})
+		}(dest, batch)
+	}
+	wg.Wait()
+}
+
+// forwardGRPCBatch forwards metrics to a destination. If that fails,
+// the destination is marked unhealthy, and the metrics are hashed to the
+// remaining destinations and sent to them instead, until every
+// destination has been tried.
+func (s *Server) forwardGRPCBatch(ctx context.Context, dest string, metrics []*metricpb.Metric, tried map[string]bool) {
+	span, _ := trace.StartSpanFromContext(ctx, "")
+	span.SetTag("protocol", "grpc")
+	span.SetTag("destination", dest)
+	defer span.ClientFinish(s.TraceClient)
+
+	destTags := map[string]string{"destination": dest, "protocol": "grpc"}
+	start := time.Now()
+	err := s.sendGRPC(ctx, span, dest, metrics)
+	span.Add(
+		ssf.Timing("forward.destination.duration_ns", time.Since(start), time.Nanosecond, destTags),
+		ssf.Count("forward.destination.metrics_total", float32(len(metrics)), destTags),
+	)
+	if err == nil {
+		span.Add(ssf.Count("forward.destination.error_total", 0, destTags))
+		return
+	}
+	span.Add(ssf.Count("forward.destination.error_total", 1, destTags))
+
+	if len(s.forwardDestinations.Members()) < 2 {
+		return
+	}
+	s.forwardDestinations.markUnhealthy(dest)
+	tried[dest] = true
+	parts, err := s.forwardDestinations.partition(len(metrics), func(i int) string {
+		return samplers.NewMetricKeyFromMetric(metrics[i]).String()
+	}, tried)
+	if err != nil {
+		span.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": "no_destination"}))
+		log.WithError(err).WithField("metrics", len(metrics)).Error("Failed to forward to any upstream Veneur")
+		return
+	}
+	span.Add(ssf.Count("forward.destination.retried_metrics_total", float32(len(metrics)), destTags))
+	for next, idx := range parts {
+		batch := make([]*metricpb.Metric, len(idx))
+		for i, j := range idx {
+			batch[i] = metrics[j]
+		}
+		s.forwardGRPCBatch(ctx, next, batch, tried)
+	}
+}
+
+// sendGRPC sends metrics to a single destination, over its stream if
+// that's enabled, or with a regular call otherwise.
+func (s *Server) sendGRPC(ctx context.Context, span *trace.Span, dest string, metrics []*metricpb.Metric) error {
+	fc, ok := s.grpcForwardConnFor(dest)
+	if !ok {
+		span.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": "no_connection"}))
+		return fmt.Errorf("no gRPC connection to %s", dest)
+	}
+
 	entry := log.WithFields(logrus.Fields{
 		"metrics":     len(metrics),
-		"destination": s.ForwardAddr,
+		"destination": dest,
 		"protocol":    "grpc",
-		"grpcstate":   s.grpcForwardConn.GetState().String(),
+		"grpcstate":   fc.conn.GetState().String(),
 	})
 
-	c := forwardrpc.NewForwardClient(s.grpcForwardConn)
-
 	grpcStart := time.Now()
-	_, err := c.SendMetrics(ctx, &forwardrpc.MetricList{Metrics: metrics})
+	if fc.streamer != nil {
+		sent, err := fc.streamer.send(ctx, metrics)
+		span.Add(ssf.Timing("forward.duration_ns", time.Since(grpcStart), time.Nanosecond,
+			map[string]string{"part": "grpc-stream"}))
+		if err == nil {
+			entry.WithField("protocol", "grpc-stream").Info("Completed forward to an upstream Veneur")
+			span.Add(ssf.Count("forward.error_total", 0, nil))
+			return nil
+		}
+		if err != errStreamUnavailable {
+			span.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": "stream"}))
+		}
+		// Send whatever didn't make it over the stream with a
+		// regular call:
+		metrics = metrics[sent:]
+		grpcStart = time.Now()
+	}
+
+	c := forwardrpc.NewForwardClient(fc.conn)
+	mlist := &forwardrpc.MetricList{Metrics: metrics}
+	_, err := c.SendMetrics(ctx, mlist, s.grpcForwardCompression.callOptions()...)
+	if err != nil && s.grpcForwardCompression.unsupported(err) {
+		_, err = c.SendMetrics(ctx, mlist, s.grpcForwardCompression.callOptions()...)
+	}
 	if err != nil {
 		if statErr, ok := status.FromError(err); ok && (statErr.Message() == "all SubConns are in TransientFailure" || statErr.Message() == "transport is closing") {
 			// We could check statErr.Code() == codes.Unavailable, but we don't know all of the cases that
@@ -480,4 +734,5 @@ func (s *Server) forwardGRPC(ctx context.Context, wms []WorkerMetrics) {
 			map[string]string{"part": "grpc"}),
 		ssf.Count("forward.error_total", 0, nil),
 	)
+	return err
 }
@@ -1,54 +1,73 @@
 package veneur
 
 import (
-	"context"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/forwardrpc"
 	"github.com/stripe/veneur/internal/forwardtest"
 	"github.com/stripe/veneur/samplers/metricpb"
 )
 
-func TestServerFlushGRPC(t *testing.T) {
-	done := make(chan []string)
+// newGRPCForwardServer starts a forwarding gRPC server that collects
+// the names of the metrics in each batch that it receives.
+func newGRPCForwardServer(t *testing.T) (*forwardtest.Server, chan []string) {
+	received := make(chan []string, 10)
 	testServer := forwardtest.NewServer(func(ms []*metricpb.Metric) {
 		var names []string
 		for _, m := range ms {
 			names = append(names, m.Name)
 		}
-		done <- names
+		received <- names
 	})
 	testServer.Start(t)
+	return testServer, received
+}
+
+func TestServerFlushGRPC(t *testing.T) {
+	testServer, received := newGRPCForwardServer(t)
 	defer testServer.Stop()
 
 	localCfg := localConfig()
 	localCfg.ForwardAddress = testServer.Addr().String()
 	localCfg.ForwardUseGrpc = true
-	local := setupVeneurServer(t, localCfg, nil, nil, nil)
-	defer local.Shutdown()
+	local := newHarness(t, localCfg)
+	defer local.Close()
 
-	inputs := forwardGRPCTestMetrics()
-	for _, input := range inputs {
-		local.Workers[0].ProcessMetric(input)
-	}
-
-	local.Flush(context.Background())
+	local.IngestMetrics(forwardGRPCTestMetrics()...)
+	local.Flush()
 
-	expected := []string{
+	require.Len(t, received, 1)
+	assert.ElementsMatch(t, []string{
 		testGRPCMetric("histogram"),
 		testGRPCMetric("timer"),
 		testGRPCMetric("counter"),
 		testGRPCMetric("gauge"),
 		testGRPCMetric("set"),
-	}
+	}, <-received, "Flush didn't output the right metrics")
+}
+
+func TestServerFlushGRPCCompressed(t *testing.T) {
+	for _, compression := range []string{forwardrpc.CompressionGzip, forwardrpc.CompressionSnappy} {
+		t.Run(compression, func(t *testing.T) {
+			testServer, received := newGRPCForwardServer(t)
+			defer testServer.Stop()
+
+			localCfg := localConfig()
+			localCfg.ForwardAddress = testServer.Addr().String()
+			localCfg.ForwardUseGrpc = true
+			localCfg.ForwardGrpcCompression = compression
+			local := newHarness(t, localCfg)
+			defer local.Close()
+
+			local.IngestMetrics(forwardGRPCTestMetrics()...)
+			local.Flush()
 
-	select {
-	case v := <-done:
-		assert.ElementsMatch(t, expected, v,
-			"Flush didn't output the right metrics")
-	case <-time.After(time.Second):
-		t.Fatal("Timed out waiting for the gRPC server to receive the flush")
+			require.Len(t, received, 1)
+			assert.Len(t, <-received, 5, "Flush didn't output the right metrics")
+		})
 	}
 }
 
@@ -57,9 +76,45 @@ func TestServerFlushGRPCBadAddress(t *testing.T) {
 	localCfg := localConfig()
 	localCfg.ForwardAddress = "bad-address:123"
 	localCfg.ForwardUseGrpc = true
-	local := setupVeneurServer(t, localCfg, nil, nil, nil)
-	defer local.Shutdown()
+	local := newHarness(t, localCfg)
+	defer local.Close()
 
-	local.Workers[0].ProcessMetric(forwardGRPCTestMetrics()[0])
-	local.Flush(context.Background())
+	local.IngestMetrics(forwardGRPCTestMetrics()[0])
+	local.Flush()
+}
+
+func TestServerFlushGRPCStream(t *testing.T) {
+	testServer, received := newGRPCForwardServer(t)
+	defer testServer.Stop()
+
+	localCfg := localConfig()
+	localCfg.ForwardAddress = testServer.Addr().String()
+	localCfg.ForwardUseGrpc = true
+	localCfg.ForwardGrpcStream = true
+	localCfg.ForwardGrpcStreamBatchSize = 2
+	local := newHarness(t, localCfg)
+	defer local.Close()
+
+	local.IngestMetrics(forwardGRPCTestMetrics()...)
+	local.Flush()
+
+	// Five metrics arrive in batches of two. The flush doesn't wait
+	// for the stream's server to receive them:
+	var names []string
+	for i := 0; i < 3; i++ {
+		select {
+		case batch := <-received:
+			assert.True(t, len(batch) <= 2, "batch is too large: %v", batch)
+			names = append(names, batch...)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the gRPC server to receive the flush")
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		testGRPCMetric("histogram"),
+		testGRPCMetric("timer"),
+		testGRPCMetric("counter"),
+		testGRPCMetric("gauge"),
+		testGRPCMetric("set"),
+	}, names)
 }
@@ -0,0 +1,71 @@
+package veneur
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/forwardrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// forwardCompressionRetryInterval is how long forwarding goes without
+// compression after the upstream rejected it, before trying it again.
+// This lets compression come back on its own once the upstream is
+// upgraded.
+const forwardCompressionRetryInterval = 10 * time.Minute
+
+// forwardCompression selects the compressor for forwarding RPCs. If the
+// upstream Veneur doesn't have the compressor, it falls back to sending
+// uncompressed messages for a while.
+type forwardCompression struct {
+	name string
+
+	mtx           sync.Mutex
+	disabledUntil time.Time
+}
+
+func newForwardCompression(name string) *forwardCompression {
+	return &forwardCompression{name: name}
+}
+
+// callOptions returns the options that set the compressor of an RPC.
+func (fc *forwardCompression) callOptions() []grpc.CallOption {
+	if fc == nil || fc.name == "" {
+		return nil
+	}
+	if fc.disabled() {
+		return []grpc.CallOption{grpc.UseCompressor(encoding.Identity)}
+	}
+	return []grpc.CallOption{grpc.UseCompressor(fc.name)}
+}
+
+// disabled reports whether compression is turned off because the
+// upstream rejected it recently.
+func (fc *forwardCompression) disabled() bool {
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	return time.Now().Before(fc.disabledUntil)
+}
+
+// unsupported reports whether an RPC failed because the upstream
+// doesn't support the compressor, in which case compression is turned
+// off and the RPC should be made again.
+func (fc *forwardCompression) unsupported(err error) bool {
+	if fc == nil || fc.name == "" || !forwardrpc.IsCompressorUnsupported(err) {
+		return false
+	}
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	if time.Now().Before(fc.disabledUntil) {
+		// The failed call was already uncompressed
+		return false
+	}
+	fc.disabledUntil = time.Now().Add(forwardCompressionRetryInterval)
+	log.WithError(err).WithFields(logrus.Fields{
+		"compression": fc.name,
+		"retry_after": forwardCompressionRetryInterval,
+	}).Warn("Upstream Veneur doesn't support the forwarding compression, sending uncompressed")
+	return true
+}
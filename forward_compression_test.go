@@ -0,0 +1,30 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/forwardrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestForwardCompressionFallback(t *testing.T) {
+	fc := newForwardCompression(forwardrpc.CompressionSnappy)
+	assert.Len(t, fc.callOptions(), 1)
+
+	assert.False(t, fc.unsupported(status.Error(codes.Unavailable, "transport is closing")),
+		"Other errors shouldn't turn compression off")
+	assert.False(t, fc.disabled())
+
+	err := status.Error(codes.Unimplemented, `grpc: Decompressor is not installed for grpc-encoding "snappy"`)
+	assert.True(t, fc.unsupported(err), "The call should be retried without compression")
+	assert.True(t, fc.disabled())
+	assert.False(t, fc.unsupported(err), "An uncompressed call shouldn't be retried")
+}
+
+func TestForwardCompressionNone(t *testing.T) {
+	fc := newForwardCompression("")
+	assert.Empty(t, fc.callOptions())
+	assert.False(t, fc.unsupported(status.Error(codes.Unimplemented, "grpc: Decompressor is not installed")))
+}
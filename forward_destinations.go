@@ -0,0 +1,346 @@
+package veneur
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/forwardrpc"
+	"google.golang.org/grpc"
+	"stathat.com/c/consistent"
+)
+
+// forwardSRVPrefix marks a forward_address that is the name of an SRV
+// record, rather than a list of addresses.
+const forwardSRVPrefix = "srv:"
+
+const defaultForwardRefreshInterval = 30 * time.Second
+
+// forwardUnhealthyDuration is how long a destination that failed to
+// receive a batch is skipped for, before metrics are hashed to it
+// again.
+const forwardUnhealthyDuration = 30 * time.Second
+
+var errNoForwardDestination = errors.New("no healthy destination to forward to")
+
+// lookupSRV is net.LookupSRV, swapped out in tests.
+var lookupSRV = net.LookupSRV
+
+// forwardDestinations is the set of upstream Veneurs that metrics are
+// forwarded to. Each metric is consistently hashed to one of them by its
+// key, in the same way veneur-proxy does, so that every local Veneur
+// sends a given metric to the same global Veneur.
+//
+// forward_address is either a comma-separated list of addresses, or
+// "srv:" followed by the name of an SRV record, which is resolved again
+// periodically.
+type forwardDestinations struct {
+	static  []string
+	srvName string
+	// scheme is prepended to the addresses resolved from an SRV
+	// record, since they're only a host and port.
+	scheme string
+
+	mtx       sync.RWMutex
+	ring      *consistent.Consistent
+	members   []string
+	unhealthy map[string]time.Time
+}
+
+// newForwardDestinations parses forward_address. For HTTP forwarding,
+// the destinations resolved from an SRV record are given an http://
+// scheme. The static destinations are usable right away; an SRV record
+// must be resolved first.
+func newForwardDestinations(addr string, useHTTP bool) *forwardDestinations {
+	fd := &forwardDestinations{
+		ring:      consistent.New(),
+		unhealthy: map[string]time.Time{},
+	}
+	if useHTTP {
+		fd.scheme = "http://"
+	}
+	if strings.HasPrefix(addr, forwardSRVPrefix) {
+		fd.srvName = strings.TrimPrefix(addr, forwardSRVPrefix)
+		return fd
+	}
+	for _, dest := range strings.Split(addr, ",") {
+		if dest = strings.TrimSpace(dest); dest != "" {
+			fd.static = append(fd.static, dest)
+		}
+	}
+	fd.set(fd.static)
+	return fd
+}
+
+// dynamic reports whether the destinations need to be resolved again
+// periodically.
+func (fd *forwardDestinations) dynamic() bool {
+	return fd.srvName != ""
+}
+
+// resolve looks up the SRV record, and replaces the destinations with
+// its targets. It returns the destinations that were added and removed.
+// If the lookup fails, or finds no targets, the current destinations are
+// kept.
+func (fd *forwardDestinations) resolve() (added, removed []string, err error) {
+	if !fd.dynamic() {
+		return nil, nil, nil
+	}
+	_, records, err := lookupSRV("", "", fd.srvName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("SRV record %q has no targets", fd.srvName)
+	}
+	dests := make([]string, 0, len(records))
+	for _, rec := range records {
+		host := strings.TrimSuffix(rec.Target, ".")
+		dests = append(dests, fd.scheme+net.JoinHostPort(host, fmt.Sprint(rec.Port)))
+	}
+	added, removed = fd.set(dests)
+	return added, removed, nil
+}
+
+func (fd *forwardDestinations) set(dests []string) (added, removed []string) {
+	sort.Strings(dests)
+
+	fd.mtx.Lock()
+	defer fd.mtx.Unlock()
+	for _, dest := range dests {
+		if !strInSlice(dest, fd.members) {
+			added = append(added, dest)
+		}
+	}
+	for _, dest := range fd.members {
+		if !strInSlice(dest, dests) {
+			removed = append(removed, dest)
+			delete(fd.unhealthy, dest)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		fd.ring.Set(dests)
+		fd.members = dests
+	}
+	return added, removed
+}
+
+// Members returns the current destinations.
+func (fd *forwardDestinations) Members() []string {
+	fd.mtx.RLock()
+	defer fd.mtx.RUnlock()
+	return fd.members
+}
+
+// markUnhealthy skips the destination for a while.
+func (fd *forwardDestinations) markUnhealthy(dest string) {
+	fd.mtx.Lock()
+	defer fd.mtx.Unlock()
+	if strInSlice(dest, fd.members) {
+		fd.unhealthy[dest] = time.Now().Add(forwardUnhealthyDuration)
+	}
+}
+
+// partition hashes n items, whose keys are returned by key, to the
+// destinations, returning the indexes of the items for each one.
+// Destinations in avoid, and ones that are unhealthy, are skipped in
+// favor of the next destination on the ring. If every destination is
+// unhealthy, they're used anyway; if every one is to be avoided, an
+// error is returned.
+func (fd *forwardDestinations) partition(n int, key func(int) string, avoid map[string]bool) (map[string][]int, error) {
+	fd.mtx.Lock()
+	defer fd.mtx.Unlock()
+
+	now := time.Now()
+	skip := map[string]bool{}
+	for dest, until := range fd.unhealthy {
+		if now.After(until) {
+			delete(fd.unhealthy, dest)
+			continue
+		}
+		skip[dest] = true
+	}
+	var available []string
+	for _, dest := range fd.members {
+		if !avoid[dest] {
+			available = append(available, dest)
+		}
+	}
+	if len(available) == 0 {
+		return nil, errNoForwardDestination
+	}
+	healthy := 0
+	for _, dest := range available {
+		if !skip[dest] {
+			healthy++
+		}
+	}
+	if healthy == 0 {
+		skip = map[string]bool{}
+	}
+	for dest := range avoid {
+		skip[dest] = true
+	}
+
+	parts := map[string][]int{}
+	if len(fd.members) == 1 {
+		idx := make([]int, n)
+		for i := range idx {
+			idx[i] = i
+		}
+		parts[fd.members[0]] = idx
+		return parts, nil
+	}
+	for i := 0; i < n; i++ {
+		dest, err := fd.pick(key(i), skip)
+		if err != nil {
+			return nil, err
+		}
+		parts[dest] = append(parts[dest], i)
+	}
+	return parts, nil
+}
+
+// pick returns the first destination on the ring for the key that
+// isn't skipped. The caller must hold the lock.
+func (fd *forwardDestinations) pick(key string, skip map[string]bool) (string, error) {
+	dest, err := fd.ring.Get(key)
+	if err != nil || !skip[dest] {
+		return dest, err
+	}
+	dests, err := fd.ring.GetN(key, len(fd.members))
+	if err != nil {
+		return "", err
+	}
+	for _, dest := range dests {
+		if !skip[dest] {
+			return dest, nil
+		}
+	}
+	return "", errNoForwardDestination
+}
+
+// refreshForwardDestinations re-resolves the forwarding destinations
+// every interval until the server shuts down, setting up and tearing
+// down the gRPC connections to them.
+func (s *Server) refreshForwardDestinations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.resolveForwardDestinations()
+		}
+	}
+}
+
+func (s *Server) resolveForwardDestinations() {
+	added, removed, err := s.forwardDestinations.resolve()
+	if err != nil {
+		log.WithError(err).WithField("forwardAddr", s.ForwardAddr).Warn("Failed to resolve the forwarding destinations")
+		return
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		log.WithFields(logrus.Fields{
+			"added":   added,
+			"removed": removed,
+		}).Info("Updated the forwarding destinations")
+	}
+	if s.forwardUseGRPC {
+		s.updateGRPCForwardConns(added, removed)
+	}
+}
+
+// grpcForwardConn is the connection to one gRPC forwarding destination.
+type grpcForwardConn struct {
+	addr     string
+	conn     *grpc.ClientConn
+	streamer *metricStreamer
+}
+
+func (c *grpcForwardConn) close() {
+	if c.streamer != nil {
+		c.streamer.close()
+	}
+	c.conn.Close()
+}
+
+// dialGRPCForward opens a connection to a gRPC forwarding destination.
+func (s *Server) dialGRPCForward(addr string) (*grpcForwardConn, error) {
+	dialOpts := forwardrpc.ClientDialOptions(s.grpcForwardTLS, s.grpcForwardAuthToken)
+	var callOpts []grpc.CallOption
+	if s.grpcMaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(s.grpcMaxRecvMsgSize))
+	}
+	if s.grpcMaxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(s.grpcMaxSendMsgSize))
+	}
+	if len(callOpts) > 0 {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	conn, err := grpc.Dial(addr, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c := &grpcForwardConn{addr: addr, conn: conn}
+	if s.forwardGRPCStream {
+		c.streamer = newMetricStreamer(conn, s.forwardGRPCStreamBatchSize, s.grpcForwardCompression)
+	}
+	return c, nil
+}
+
+// updateGRPCForwardConns opens connections to the added destinations,
+// and closes the ones to the removed destinations.
+func (s *Server) updateGRPCForwardConns(added, removed []string) {
+	s.grpcForwardMtx.Lock()
+	defer s.grpcForwardMtx.Unlock()
+	for _, addr := range removed {
+		if c, ok := s.grpcForwardConns[addr]; ok {
+			c.close()
+			delete(s.grpcForwardConns, addr)
+		}
+	}
+	for _, addr := range added {
+		c, err := s.dialGRPCForward(addr)
+		if err != nil {
+			log.WithError(err).WithField("forwardAddr", addr).Error("Failed to initialize a gRPC connection for forwarding")
+			continue
+		}
+		s.grpcForwardConns[addr] = c
+	}
+}
+
+// grpcForwardConnFor returns the connection to the destination.
+func (s *Server) grpcForwardConnFor(addr string) (*grpcForwardConn, bool) {
+	s.grpcForwardMtx.Lock()
+	defer s.grpcForwardMtx.Unlock()
+	c, ok := s.grpcForwardConns[addr]
+	return c, ok
+}
+
+// closeGRPCForwardConns closes every gRPC forwarding connection.
+func (s *Server) closeGRPCForwardConns() {
+	s.grpcForwardMtx.Lock()
+	defer s.grpcForwardMtx.Unlock()
+	for addr, c := range s.grpcForwardConns {
+		c.close()
+		delete(s.grpcForwardConns, addr)
+	}
+}
+
+// strInSlice reports whether the slice contains the string.
+func strInSlice(s string, slice []string) bool {
+	for _, e := range slice {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/internal/forwardtest"
+	"github.com/stripe/veneur/samplers/metricpb"
+)
+
+func testKey(i int) string {
+	return fmt.Sprintf("metric.%d", i)
+}
+
+func TestForwardDestinationsList(t *testing.T) {
+	fd := newForwardDestinations("b:8128, a:8128,,c:8128", false)
+	assert.False(t, fd.dynamic())
+	assert.Equal(t, []string{"a:8128", "b:8128", "c:8128"}, fd.Members())
+
+	parts, err := fd.partition(1000, testKey, nil)
+	require.NoError(t, err)
+	assert.Len(t, parts, 3, "Metrics should be spread over every destination")
+
+	again, err := fd.partition(1000, testKey, nil)
+	require.NoError(t, err)
+	assert.Equal(t, parts, again, "Metrics should hash to the same destinations every time")
+}
+
+func TestForwardDestinationsAvoid(t *testing.T) {
+	fd := newForwardDestinations("a:8128,b:8128,c:8128", false)
+	parts, err := fd.partition(1000, testKey, nil)
+	require.NoError(t, err)
+
+	retried, err := fd.partition(1000, testKey, map[string]bool{"a:8128": true})
+	require.NoError(t, err)
+	assert.NotContains(t, retried, "a:8128")
+	for _, dest := range []string{"b:8128", "c:8128"} {
+		assert.Subset(t, retried[dest], parts[dest],
+			"Metrics that didn't hash to the avoided destination shouldn't move")
+	}
+
+	_, err = fd.partition(10, testKey, map[string]bool{"a:8128": true, "b:8128": true, "c:8128": true})
+	assert.Equal(t, errNoForwardDestination, err)
+}
+
+func TestForwardDestinationsUnhealthy(t *testing.T) {
+	fd := newForwardDestinations("a:8128,b:8128", false)
+	fd.markUnhealthy("a:8128")
+	parts, err := fd.partition(100, testKey, nil)
+	require.NoError(t, err)
+	assert.Len(t, parts["b:8128"], 100, "Unhealthy destinations should be skipped")
+
+	fd.markUnhealthy("b:8128")
+	parts, err = fd.partition(100, testKey, nil)
+	require.NoError(t, err)
+	assert.Len(t, parts, 2, "If every destination is unhealthy, they should all be used")
+}
+
+func TestForwardDestinationsSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "veneur-1.example.com.", Port: 8128},
+		{Target: "veneur-2.example.com.", Port: 8128},
+	}
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		assert.Equal(t, "_veneur._tcp.example.com", name)
+		return name, records, nil
+	}
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	fd := newForwardDestinations("srv:_veneur._tcp.example.com", true)
+	assert.True(t, fd.dynamic())
+	assert.Empty(t, fd.Members())
+
+	added, removed, err := fd.resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://veneur-1.example.com:8128", "http://veneur-2.example.com:8128"}, added)
+	assert.Empty(t, removed)
+
+	records = records[1:]
+	added, removed, err = fd.resolve()
+	require.NoError(t, err)
+	assert.Empty(t, added)
+	assert.Equal(t, []string{"http://veneur-1.example.com:8128"}, removed)
+	assert.Equal(t, []string{"http://veneur-2.example.com:8128"}, fd.Members())
+}
+
+func TestServerFlushGRPCFailover(t *testing.T) {
+	received := make(chan []*metricpb.Metric, 10)
+	testServer := forwardtest.NewServer(func(ms []*metricpb.Metric) {
+		received <- ms
+	})
+	testServer.Start(t)
+	defer testServer.Stop()
+
+	// An address that nothing listens on:
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	localCfg := localConfig()
+	localCfg.ForwardAddress = deadAddr + "," + testServer.Addr().String()
+	localCfg.ForwardUseGrpc = true
+	local := setupVeneurServer(t, localCfg, nil, nil, nil)
+	defer local.Shutdown()
+
+	for _, input := range forwardGRPCTestMetrics() {
+		local.Workers[0].ProcessMetric(input)
+	}
+	local.Flush(context.Background())
+
+	// Every metric should end up at the destination that's up,
+	// including the ones that hashed to the one that's down:
+	count := 0
+	for count < 5 {
+		select {
+		case ms := <-received:
+			count += len(ms)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the metrics; received %d", count)
+		}
+	}
+	assert.Equal(t, 5, count)
+
+	local.forwardDestinations.mtx.RLock()
+	defer local.forwardDestinations.mtx.RUnlock()
+	assert.Contains(t, local.forwardDestinations.unhealthy, deadAddr,
+		"The destination that's down should be marked unhealthy")
+}
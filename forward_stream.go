@@ -0,0 +1,200 @@
+package veneur
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/samplers/metricpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultForwardStreamBatchSize = 1000
+	forwardStreamHandshakeTimeout = 5 * time.Second
+	forwardStreamMinBackoff       = time.Second
+	forwardStreamMaxBackoff       = 30 * time.Second
+)
+
+// errStreamUnavailable is returned by metricStreamer.send when metrics
+// should be sent with the unary RPC instead.
+var errStreamUnavailable = errors.New("metric stream is unavailable")
+
+// metricStreamer forwards metrics over a long-lived SendMetricsStream
+// stream, which is opened on first use and reopened (with a backoff)
+// whenever it fails. If the server doesn't implement the stream, the
+// streamer gives up on it for good, and callers should use SendMetrics.
+type metricStreamer struct {
+	conn        *grpc.ClientConn
+	batchSize   int
+	compression *forwardCompression
+
+	mtx         sync.Mutex
+	stream      forwardrpc.Forward_SendMetricsStreamClient
+	cancel      context.CancelFunc
+	unsupported bool
+	backoff     time.Duration
+	retryAt     time.Time
+}
+
+func newMetricStreamer(conn *grpc.ClientConn, batchSize int, compression *forwardCompression) *metricStreamer {
+	if batchSize <= 0 {
+		batchSize = defaultForwardStreamBatchSize
+	}
+	return &metricStreamer{conn: conn, batchSize: batchSize, compression: compression}
+}
+
+// send sends the metrics over the stream in batches. Each Send blocks
+// while the server's flow control window is full, so a slow server
+// applies backpressure instead of the client buffering without bound.
+// It returns the number of metrics sent; if that's less than all of
+// them, the rest were not sent and the error says why.
+//
+// Once ctx is done, the stream is cancelled, so that a Send that a
+// stalled server blocks doesn't hold up later forwards.
+func (ms *metricStreamer) send(ctx context.Context, metrics []*metricpb.Metric) (int, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if ms.unsupported || time.Now().Before(ms.retryAt) {
+		return 0, errStreamUnavailable
+	}
+	if ms.stream == nil {
+		if err := ms.open(); err != nil {
+			return 0, ms.failed(err)
+		}
+	}
+
+	cancel := ms.cancel
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks Send and CloseAndRecv, which only
+			// give up when the stream's own context does
+			cancel()
+		case <-done:
+		}
+	}()
+
+	sent := 0
+	for sent < len(metrics) {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		end := sent + ms.batchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		if err := ms.stream.Send(&forwardrpc.MetricList{Metrics: metrics[sent:end]}); err != nil {
+			// Send only reports io.EOF when the server ended the
+			// stream; the actual status comes from receiving:
+			_, err = ms.stream.CloseAndRecv()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			} else if err == nil {
+				err = errors.New("metric stream was closed by the server")
+			}
+			return sent, ms.failed(err)
+		}
+		sent = end
+	}
+	ms.backoff = 0
+	return sent, nil
+}
+
+// open opens a new stream, and waits for the server to accept it.
+func (ms *metricStreamer) open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := forwardrpc.NewForwardClient(ms.conn).SendMetricsStream(ctx, ms.compression.callOptions()...)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	type header struct {
+		accepted bool
+		err      error
+	}
+	headerCh := make(chan header, 1)
+	go func() {
+		md, err := stream.Header()
+		headerCh <- header{accepted: len(md[forwardrpc.StreamAcceptedHeader]) > 0, err: err}
+	}()
+	select {
+	case h := <-headerCh:
+		if h.err != nil {
+			cancel()
+			return h.err
+		}
+		if !h.accepted {
+			// The stream ended without being accepted, most
+			// likely as unimplemented:
+			_, err := stream.CloseAndRecv()
+			cancel()
+			if err == nil {
+				err = errors.New("server did not accept the metric stream")
+			}
+			return err
+		}
+	case <-time.After(forwardStreamHandshakeTimeout):
+		cancel()
+		return errors.New("timed out waiting for the server to accept the metric stream")
+	}
+
+	ms.stream = stream
+	ms.cancel = cancel
+	return nil
+}
+
+// failed tears down the current stream after an error, and decides
+// when to try again.
+func (ms *metricStreamer) failed(err error) error {
+	if ms.cancel != nil {
+		ms.cancel()
+	}
+	ms.stream = nil
+	ms.cancel = nil
+
+	if ms.compression.unsupported(err) {
+		// The next stream will be opened without compression, so
+		// don't wait to open it:
+		return err
+	}
+	if status.Code(err) == codes.Unimplemented {
+		log.WithError(err).Warn("Forwarding server doesn't implement metric streams, falling back to unary RPCs")
+		ms.unsupported = true
+		return err
+	}
+
+	if ms.backoff == 0 {
+		ms.backoff = forwardStreamMinBackoff
+	} else if ms.backoff < forwardStreamMaxBackoff {
+		ms.backoff *= 2
+		if ms.backoff > forwardStreamMaxBackoff {
+			ms.backoff = forwardStreamMaxBackoff
+		}
+	}
+	ms.retryAt = time.Now().Add(ms.backoff)
+	log.WithError(err).WithFields(logrus.Fields{
+		"backoff": ms.backoff,
+	}).Warn("Metric stream failed, reconnecting after a backoff")
+	return err
+}
+
+// close closes the stream, if one is open.
+func (ms *metricStreamer) close() {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if ms.stream != nil {
+		ms.stream.CloseAndRecv()
+		ms.cancel()
+		ms.stream = nil
+	}
+}
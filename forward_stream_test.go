@@ -0,0 +1,141 @@
+package veneur
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/samplers/metricpb"
+	"google.golang.org/grpc"
+)
+
+// unaryOnlyForwardServer implements only the unary SendMetrics RPC, like
+// Veneurs that predate SendMetricsStream.
+type unaryOnlyForwardServer struct {
+	received chan []*metricpb.Metric
+}
+
+func (s *unaryOnlyForwardServer) SendMetrics(ctx context.Context, mlist *forwardrpc.MetricList) (*empty.Empty, error) {
+	s.received <- mlist.Metrics
+	return &empty.Empty{}, nil
+}
+
+func startUnaryOnlyForwardServer(t *testing.T) (*unaryOnlyForwardServer, string, func()) {
+	impl := &unaryOnlyForwardServer{received: make(chan []*metricpb.Metric, 10)}
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "forwardrpc.Forward",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "SendMetrics",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &forwardrpc.MetricList{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(*unaryOnlyForwardServer).SendMetrics(ctx, in)
+			},
+		}},
+	}, impl)
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	return impl, ln.Addr().String(), srv.Stop
+}
+
+func TestMetricStreamerUnimplemented(t *testing.T) {
+	_, addr, stop := startUnaryOnlyForwardServer(t)
+	defer stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ms := newMetricStreamer(conn, 10, nil)
+	sent, err := ms.send(context.Background(), []*metricpb.Metric{{Name: "a"}})
+	assert.Error(t, err)
+	assert.Equal(t, 0, sent)
+	assert.True(t, ms.unsupported)
+
+	// Once the stream is known to be unsupported, it isn't tried again:
+	_, err = ms.send(context.Background(), []*metricpb.Metric{{Name: "a"}})
+	assert.Equal(t, errStreamUnavailable, err)
+}
+
+// TestMetricStreamerStalledServer checks that a server that accepts the
+// stream but never reads from it doesn't block sends past their
+// context, nor the sends after them.
+func TestMetricStreamerStalledServer(t *testing.T) {
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "forwardrpc.Forward",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "SendMetricsStream",
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				if err := forwardrpc.AcceptStream(stream); err != nil {
+					return err
+				}
+				<-stream.Context().Done()
+				return stream.Context().Err()
+			},
+		}},
+	}, struct{}{})
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Far more than fits in the flow control windows:
+	metrics := make([]*metricpb.Metric, 20000)
+	for i := range metrics {
+		metrics[i] = &metricpb.Metric{Name: strings.Repeat("x", 200)}
+	}
+	ms := newMetricStreamer(conn, 100, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	sent, err := ms.send(ctx, metrics)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, sent < len(metrics))
+	assert.True(t, time.Since(start) < 5*time.Second, "the send took %v", time.Since(start))
+
+	// The stream is torn down, so the next send doesn't wait for it:
+	start = time.Now()
+	_, err = ms.send(context.Background(), metrics[:1])
+	assert.Equal(t, errStreamUnavailable, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestServerFlushGRPCStreamFallback(t *testing.T) {
+	impl, addr, stop := startUnaryOnlyForwardServer(t)
+	defer stop()
+
+	localCfg := localConfig()
+	localCfg.ForwardAddress = addr
+	localCfg.ForwardUseGrpc = true
+	localCfg.ForwardGrpcStream = true
+	local := setupVeneurServer(t, localCfg, nil, nil, nil)
+	defer local.Shutdown()
+
+	for _, input := range forwardGRPCTestMetrics() {
+		local.Workers[0].ProcessMetric(input)
+	}
+	local.Flush(context.Background())
+
+	select {
+	case ms := <-impl.received:
+		assert.Len(t, ms, 5)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the metrics to be sent with SendMetrics")
+	}
+}
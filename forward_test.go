@@ -1,43 +1,42 @@
 package veneur
 
 import (
-	"context"
-	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/internal/veneurtest"
 	"github.com/stripe/veneur/samplers"
-	"github.com/stripe/veneur/sinks"
 	"github.com/stripe/veneur/ssf"
 )
 
 type forwardFixture struct {
-	t      testing.TB
-	proxy  *Proxy
-	global *Server
+	t     testing.TB
+	proxy *Proxy
 
+	global   *testHarness
 	globalTS *httptest.Server
 	proxyTS  *httptest.Server
-	server   *Server
+	local    *testHarness
 }
 
 // newForwardingFixture constructs and returns a chain of veneur
 // servers that represent a fairly typical metrics pipeline:
 //     [local veneur] -> [veneur proxy] -> [global veneur]
 //
-// The globalSink argument is the global veneur's metric sink, and the
+// The local and global veneurs are test harnesses, and the
 // localConfig argument is the local veneur agent's config, which will
 // be amended to include the forwarder and proxy addresses.
-func newForwardingFixture(t testing.TB, localConfig Config, transport http.RoundTripper, globalSink sinks.MetricSink) *forwardFixture {
+func newForwardingFixture(t testing.TB, localConfig Config) *forwardFixture {
 	ff := &forwardFixture{t: t}
 
 	// Make the global veneur:
-	ff.global = setupVeneurServer(t, globalConfig(), transport, globalSink, nil)
-	ff.globalTS = httptest.NewServer(handleImport(ff.global))
+	ff.global = newHarness(t, globalConfig())
+	ff.globalTS = httptest.NewServer(handleImport(ff.global.server))
 
 	// Make the proxy that sends to the global veneur:
 	proxyCfg := generateProxyConfig()
@@ -53,7 +52,7 @@ func newForwardingFixture(t testing.TB, localConfig Config, transport http.Round
 
 	// Now make the local server, have it forward to the proxy:
 	localConfig.ForwardAddress = ff.proxyTS.URL
-	ff.server = setupVeneurServer(t, localConfig, transport, nil, nil)
+	ff.local = newHarness(t, localConfig)
 
 	return ff
 }
@@ -62,35 +61,29 @@ func newForwardingFixture(t testing.TB, localConfig Config, transport http.Round
 func (ff *forwardFixture) Close() {
 	ff.proxy.Shutdown()
 	ff.proxyTS.Close()
-	ff.global.Shutdown()
+	ff.global.Close()
 	ff.globalTS.Close()
-	ff.server.Shutdown()
+	ff.local.Close()
 }
 
-// Flush synchronously waits until all metrics have been flushed along
-// the chain of veneur servers.
-func (ff *forwardFixture) Flush(ctx context.Context) {
-	ff.server.Flush(ctx)
-	// The proxy proxies synchronously, so when the local server
-	// returns, we assume it has proxied everything to the global
-	// veneur.
-	ff.global.Flush(ctx)
+// Flush flushes the chain of veneur servers, so that what the local
+// veneur was sent ends up in the global veneur's sink.
+func (ff *forwardFixture) Flush() {
+	// The local veneur's flush waits for its forwarding, so once it
+	// returns, and the proxy is done proxying, the global veneur has
+	// been sent everything.
+	ff.local.Flush()
+	ff.proxy.proxying.Wait()
+	ff.global.Flush()
 }
 
-// IngestSpan synchronously writes a span to the forwarding fixture's
-// local veneur's span worker. The fixture must be flushed via the
-// (*forwardFixture).Flush method so the ingestion effects can be
-// observed.
-func (ff *forwardFixture) IngestSpan(span *ssf.SSFSpan) {
-	ff.server.SpanChan <- span
-}
-
-// IngestMetric synchronously writes a metric to the forwarding
-// fixture's local veneur span worker. The fixture must be flushed via
-// the (*forwardFixture).Flush method so the ingestion effects can be
-// observed.
-func (ff *forwardFixture) IngestMetric(m *samplers.UDPMetric) {
-	ff.server.Workers[0].ProcessMetric(m)
+// hasMetrics checks that the sink was flushed metrics with each of the
+// names.
+func hasMetrics(t *testing.T, sink *veneurtest.MetricSink, names ...string) {
+	for _, name := range names {
+		_, ok := sink.Metric(name)
+		assert.True(t, ok, "Metric named %s missing", name)
+	}
 }
 
 // TestForwardingIndicatorMetrics ensures that the metrics extracted
@@ -99,57 +92,58 @@ func (ff *forwardFixture) IngestMetric(m *samplers.UDPMetric) {
 // on the global veneur.
 func TestE2EForwardingIndicatorMetrics(t *testing.T) {
 	t.Parallel()
-	ch := make(chan []samplers.InterMetric)
-	sink, _ := NewChannelMetricSink(ch)
 	cfg := localConfig()
 	cfg.IndicatorSpanTimerName = "indicator.span.timer"
-	ffx := newForwardingFixture(t, cfg, nil, sink)
+	ffx := newForwardingFixture(t, cfg)
 	defer ffx.Close()
 
 	start := time.Now()
 	end := start.Add(5 * time.Second)
-	span := &ssf.SSFSpan{
+	ffx.local.SendSSF(&ssf.SSFSpan{
 		Id:             5,
 		TraceId:        5,
 		Service:        "indicator_testing",
 		StartTimestamp: start.UnixNano(),
 		EndTimestamp:   end.UnixNano(),
 		Indicator:      true,
-	}
-	ffx.IngestSpan(span)
-	done := make(chan struct{})
-	go func() {
-		metrics := <-ch
-		for _, suffix := range []string{".50percentile", ".75percentile", ".99percentile"} {
-			mName := "indicator.span.timer" + suffix
-			found := false
-			for _, m := range metrics {
-				if m.Name == mName {
-					found = true
-				}
-			}
-			assert.True(t, found, "Metric named %s missing", mName)
-		}
-		close(done)
-	}()
-	ffx.Flush(context.TODO())
-	select {
-	case <-done:
-	case <-time.After(3 * time.Second):
-		t.Fatal("Timed out waiting for a metric after 5 seconds")
+	})
+	ffx.Flush()
+
+	hasMetrics(t, ffx.global.Metrics,
+		"indicator.span.timer.50percentile",
+		"indicator.span.timer.75percentile",
+		"indicator.span.timer.99percentile")
+}
+
+// TestE2EForwardRoutedMetric ensures that a metric's veneursinkonly
+// tags survive forwarding, and route it on the global veneur.
+func TestE2EForwardRoutedMetric(t *testing.T) {
+	t.Parallel()
+	ffx := newForwardingFixture(t, localConfig())
+	defer ffx.Close()
+
+	ffx.local.SendStatsd(
+		"routed:20|h|#foo:bar,veneursinkonly:fake",
+		"elsewhere:20|h|#veneursinkonly:datadog",
+	)
+	ffx.Flush()
+
+	metrics := ffx.global.Metrics.Metrics()
+	require.NotEmpty(t, metrics)
+	for _, m := range metrics {
+		assert.True(t, strings.HasPrefix(m.Name, "routed."), "unexpected metric %s", m.Name)
+		assert.Equal(t, []string{"foo:bar"}, m.Tags)
 	}
 }
 
 func TestE2EForwardMetric(t *testing.T) {
 	t.Parallel()
-	ch := make(chan []samplers.InterMetric)
-	sink, _ := NewChannelMetricSink(ch)
 	cfg := localConfig()
 	cfg.IndicatorSpanTimerName = "indicator.span.timer"
-	ffx := newForwardingFixture(t, cfg, nil, sink)
+	ffx := newForwardingFixture(t, cfg)
 	defer ffx.Close()
 
-	ffx.IngestMetric(&samplers.UDPMetric{
+	ffx.local.IngestMetrics(&samplers.UDPMetric{
 		MetricKey: samplers.MetricKey{
 			Name: "a.b.c",
 			Type: "histogram",
@@ -159,26 +153,9 @@ func TestE2EForwardMetric(t *testing.T) {
 		SampleRate: 1.0,
 		Scope:      samplers.MixedScope,
 	})
-	done := make(chan struct{})
-	go func() {
-		metrics := <-ch
-		require.Equal(t, 3, len(metrics), "metrics:\n%#v", metrics)
-		for _, suffix := range []string{".50percentile", ".75percentile", ".99percentile"} {
-			mName := "a.b.c" + suffix
-			found := false
-			for _, m := range metrics {
-				if m.Name == mName {
-					found = true
-				}
-			}
-			assert.True(t, found, "Metric named %s missing", mName)
-		}
-		close(done)
-	}()
-	ffx.Flush(context.TODO())
-	select {
-	case <-done:
-	case <-time.After(3 * time.Second):
-		t.Fatal("Timed out waiting for a metric after 5 seconds")
-	}
+	ffx.Flush()
+
+	metrics := ffx.global.Metrics.Metrics()
+	require.Equal(t, 3, len(metrics), "metrics:\n%#v", metrics)
+	hasMetrics(t, ffx.global.Metrics, "a.b.c.50percentile", "a.b.c.75percentile", "a.b.c.99percentile")
 }
@@ -0,0 +1,195 @@
+package forwardrpc
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The reasons that an RPC can fail authentication for, as passed to
+// Authenticator.Report.
+const (
+	AuthReasonMissingClientCert = "missing_client_cert"
+	AuthReasonMissingToken      = "missing_token"
+	AuthReasonInvalidToken      = "invalid_token"
+)
+
+const authorizationHeader = "authorization"
+const bearerPrefix = "Bearer "
+
+// NewServerTLSConfig builds the TLS configuration of a Forward server
+// from PEM-encoded certificates. If clientAuthority is set, clients may
+// present certificates signed by it; Authenticator.RequireClientCert
+// decides whether they must. Verifying certificates during the
+// handshake, but requiring them per RPC, lets unauthenticated clients
+// be rejected with PermissionDenied (or let through while migrating)
+// rather than failing to connect.
+func NewServerTLSConfig(cert, key, clientAuthority string) (*tls.Config, error) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{pair}}
+	if clientAuthority != "" {
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM([]byte(clientAuthority)) {
+			return nil, errors.New("could not load any client authority certificates")
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// NewClientTLSConfig builds the TLS configuration of a Forward client
+// from PEM-encoded certificates. Any of the arguments may be empty. If
+// all are empty, nil is returned, meaning the connection isn't
+// encrypted.
+func NewClientTLSConfig(authorityCert, cert, key string) (*tls.Config, error) {
+	if authorityCert == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+	conf := &tls.Config{}
+	if authorityCert != "" {
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM([]byte(authorityCert)) {
+			return nil, errors.New("could not load any authority certificates")
+		}
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
+
+// ClientDialOptions returns the options that dial a Forward server with
+// the credentials it expects. If tlsConf is nil, the connection isn't
+// encrypted; if token is empty, no bearer token is sent.
+func ClientDialOptions(tlsConf *tls.Config, token string) []grpc.DialOption {
+	var opts []grpc.DialOption
+	if tlsConf != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken{
+			token:  token,
+			secure: tlsConf != nil,
+		}))
+	}
+	return opts
+}
+
+// bearerToken sends a shared token with every RPC.
+type bearerToken struct {
+	token  string
+	secure bool
+}
+
+func (b bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorizationHeader: bearerPrefix + b.token}, nil
+}
+
+func (b bearerToken) RequireTransportSecurity() bool {
+	return b.secure
+}
+
+// Authenticator checks the credentials of every RPC to a Forward
+// server, with interceptors.
+type Authenticator struct {
+	// RequireClientCert requires a client certificate that was
+	// verified by the server's TLS configuration.
+	RequireClientCert bool
+	// Token is the bearer token that clients must send, if set.
+	Token string
+	// Permissive lets RPCs without valid credentials through, after
+	// reporting them, so that clients can be migrated gradually.
+	Permissive bool
+	// Report, if set, is called for every RPC without valid
+	// credentials, with the reason it failed and whether it was
+	// allowed anyway.
+	Report func(reason string, allowed bool)
+}
+
+// Enabled reports whether the Authenticator checks anything.
+func (a *Authenticator) Enabled() bool {
+	return a != nil && (a.RequireClientCert || a.Token != "")
+}
+
+// ServerOptions returns the options that install the Authenticator's
+// interceptors on a server.
+func (a *Authenticator) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := a.authenticate(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := a.authenticate(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// authenticate returns a PermissionDenied error if the RPC should be
+// rejected.
+func (a *Authenticator) authenticate(ctx context.Context) error {
+	reason := a.check(ctx)
+	if reason == "" {
+		return nil
+	}
+	if a.Report != nil {
+		a.Report(reason, a.Permissive)
+	}
+	if a.Permissive {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "unauthenticated: %s", reason)
+}
+
+// check returns the reason the RPC's credentials aren't valid, or ""
+// if they are.
+func (a *Authenticator) check(ctx context.Context) string {
+	if a.RequireClientCert && !hasVerifiedClientCert(ctx) {
+		return AuthReasonMissingClientCert
+	}
+	if a.Token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md[authorizationHeader]
+		if len(values) == 0 || !strings.HasPrefix(values[0], bearerPrefix) {
+			return AuthReasonMissingToken
+		}
+		token := strings.TrimPrefix(values[0], bearerPrefix)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			return AuthReasonInvalidToken
+		}
+	}
+	return ""
+}
+
+func hasVerifiedClientCert(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	return ok && len(info.State.VerifiedChains) > 0
+}
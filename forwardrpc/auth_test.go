@@ -0,0 +1,80 @@
+package forwardrpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func withToken(ctx context.Context, header string) context.Context {
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(authorizationHeader, header))
+}
+
+func withClientCert(ctx context.Context, verified bool) context.Context {
+	state := tls.ConnectionState{}
+	if verified {
+		state.VerifiedChains = [][]*x509.Certificate{{&x509.Certificate{}}}
+	}
+	return peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+func TestAuthenticatorToken(t *testing.T) {
+	a := &Authenticator{Token: "secret"}
+	ctx := context.Background()
+
+	assert.Equal(t, AuthReasonMissingToken, a.check(ctx))
+	assert.Equal(t, AuthReasonMissingToken, a.check(withToken(ctx, "secret")))
+	assert.Equal(t, AuthReasonInvalidToken, a.check(withToken(ctx, "Bearer wrong")))
+	assert.Equal(t, "", a.check(withToken(ctx, "Bearer secret")))
+}
+
+func TestAuthenticatorClientCert(t *testing.T) {
+	a := &Authenticator{RequireClientCert: true}
+	ctx := context.Background()
+
+	assert.Equal(t, AuthReasonMissingClientCert, a.check(ctx))
+	assert.Equal(t, AuthReasonMissingClientCert, a.check(withClientCert(ctx, false)))
+	assert.Equal(t, "", a.check(withClientCert(ctx, true)))
+}
+
+func TestAuthenticatorPermissive(t *testing.T) {
+	type report struct {
+		reason  string
+		allowed bool
+	}
+	var reports []report
+	a := &Authenticator{
+		Token: "secret",
+		Report: func(reason string, allowed bool) {
+			reports = append(reports, report{reason, allowed})
+		},
+	}
+
+	err := a.authenticate(context.Background())
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	a.Permissive = true
+	assert.NoError(t, a.authenticate(context.Background()))
+	assert.NoError(t, a.authenticate(withToken(context.Background(), "Bearer secret")))
+
+	assert.Equal(t, []report{
+		{AuthReasonMissingToken, false},
+		{AuthReasonMissingToken, true},
+	}, reports)
+}
+
+func TestClientBearerToken(t *testing.T) {
+	md, err := bearerToken{token: "secret"}.GetRequestMetadata(context.Background())
+	assert.NoError(t, err)
+
+	a := &Authenticator{Token: "secret"}
+	assert.Equal(t, "", a.check(withToken(context.Background(), md[authorizationHeader])))
+}
@@ -0,0 +1,170 @@
+package forwardrpc
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/stripe/veneur/ssf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// The names of the compressors that are registered with gRPC when this
+// package is imported. Clients select one with grpc.UseCompressor.
+const (
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+)
+
+const (
+	// MetricKeyUncompressedBytes counts the bytes of messages before
+	// compression (or after decompression), tagged with the
+	// compressor and direction.
+	MetricKeyUncompressedBytes = "forward.compression.uncompressed_bytes_total"
+	// MetricKeyCompressedBytes counts the bytes of messages on the
+	// wire, tagged with the compressor and direction.
+	MetricKeyCompressedBytes = "forward.compression.compressed_bytes_total"
+)
+
+var compressors = []*countingCompressor{
+	{name: CompressionGzip,
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		decompress: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}},
+	{name: CompressionSnappy,
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		decompress: func(r io.Reader) (io.Reader, error) {
+			return snappy.NewReader(r), nil
+		}},
+}
+
+func init() {
+	for _, c := range compressors {
+		encoding.RegisterCompressor(c)
+	}
+}
+
+// ValidCompression reports whether name is a compressor registered by
+// this package, or empty (meaning no compression).
+func ValidCompression(name string) bool {
+	if name == "" {
+		return true
+	}
+	for _, c := range compressors {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCompressorUnsupported reports whether an RPC failed because the
+// server doesn't have the decompressor for the request's encoding. The
+// call can be made again without compression.
+func IsCompressorUnsupported(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.Unimplemented &&
+		strings.Contains(st.Message(), "Decompressor is not installed")
+}
+
+// ReportCompression adds the byte counts of every compressor that was
+// used since the last report to samples, and resets them.
+func ReportCompression(samples *ssf.Samples) {
+	for _, c := range compressors {
+		c.report(samples, "send", &c.sent)
+		c.report(samples, "receive", &c.received)
+	}
+}
+
+type byteCounts struct {
+	uncompressed int64
+	compressed   int64
+}
+
+// countingCompressor is an encoding.Compressor that counts the bytes
+// going through it in each direction.
+type countingCompressor struct {
+	name       string
+	compress   func(io.Writer) (io.WriteCloser, error)
+	decompress func(io.Reader) (io.Reader, error)
+
+	sent     byteCounts
+	received byteCounts
+}
+
+func (c *countingCompressor) Name() string {
+	return c.name
+}
+
+func (c *countingCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	cw := &countingWriter{w: w, n: &c.sent.compressed}
+	wc, err := c.compress(cw)
+	if err != nil {
+		return nil, err
+	}
+	return &countingWriteCloser{WriteCloser: wc, n: &c.sent.uncompressed}, nil
+}
+
+func (c *countingCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	cr := &countingReader{r: r, n: &c.received.compressed}
+	dr, err := c.decompress(cr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{r: dr, n: &c.received.uncompressed}, nil
+}
+
+func (c *countingCompressor) report(samples *ssf.Samples, direction string, counts *byteCounts) {
+	uncompressed := atomic.SwapInt64(&counts.uncompressed, 0)
+	compressed := atomic.SwapInt64(&counts.compressed, 0)
+	if uncompressed == 0 && compressed == 0 {
+		return
+	}
+	tags := map[string]string{"compressor": c.name, "direction": direction}
+	samples.Add(
+		ssf.Count(MetricKeyUncompressedBytes, float32(uncompressed), tags),
+		ssf.Count(MetricKeyCompressedBytes, float32(compressed), tags),
+	)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+type countingWriteCloser struct {
+	io.WriteCloser
+	n *int64
+}
+
+func (cw *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := cw.WriteCloser.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
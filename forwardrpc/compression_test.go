@@ -0,0 +1,59 @@
+package forwardrpc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+	"google.golang.org/grpc/encoding"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	input := bytes.Repeat([]byte("a.very.repetitive.metric.name"), 1000)
+	for _, name := range []string{CompressionGzip, CompressionSnappy} {
+		t.Run(name, func(t *testing.T) {
+			c := encoding.GetCompressor(name)
+			require.NotNil(t, c, "The compressor should be registered")
+
+			buf := &bytes.Buffer{}
+			wc, err := c.Compress(buf)
+			require.NoError(t, err)
+			_, err = wc.Write(input)
+			require.NoError(t, err)
+			require.NoError(t, wc.Close())
+			compressedLen := buf.Len()
+			assert.True(t, compressedLen < len(input), "The input should compress")
+
+			r, err := c.Decompress(buf)
+			require.NoError(t, err)
+			output, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, input, output)
+
+			samples := &ssf.Samples{}
+			ReportCompression(samples)
+			counts := map[string]float32{}
+			for _, s := range samples.Batch {
+				if s.Tags["compressor"] == name {
+					counts[s.Tags["direction"]+" "+s.Name] = s.Value
+				}
+			}
+			assert.Equal(t, map[string]float32{
+				"send " + MetricKeyUncompressedBytes:    float32(len(input)),
+				"send " + MetricKeyCompressedBytes:      float32(compressedLen),
+				"receive " + MetricKeyUncompressedBytes: float32(len(input)),
+				"receive " + MetricKeyCompressedBytes:   float32(compressedLen),
+			}, counts)
+		})
+	}
+}
+
+func TestValidCompression(t *testing.T) {
+	assert.True(t, ValidCompression(""))
+	assert.True(t, ValidCompression(CompressionGzip))
+	assert.True(t, ValidCompression(CompressionSnappy))
+	assert.False(t, ValidCompression("zstd"))
+}
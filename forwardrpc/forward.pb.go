@@ -9,6 +9,7 @@
 
 	It has these top-level messages:
 		MetricList
+		SpanList
 */
 package forwardrpc
 
@@ -17,6 +18,7 @@ import fmt "fmt"
 import math "math"
 import metricpb "github.com/stripe/veneur/samplers/metricpb"
 import google_protobuf1 "github.com/golang/protobuf/ptypes/empty"
+import ssf "github.com/stripe/veneur/ssf"
 
 import (
 	context "golang.org/x/net/context"
@@ -53,8 +55,26 @@ func (m *MetricList) GetMetrics() []*metricpb.Metric {
 	return nil
 }
 
+// SpanList wraps a list of ssf.SSFSpan's.
+type SpanList struct {
+	Spans []*ssf.SSFSpan `protobuf:"bytes,1,rep,name=spans" json:"spans,omitempty"`
+}
+
+func (m *SpanList) Reset()                    { *m = SpanList{} }
+func (m *SpanList) String() string            { return proto.CompactTextString(m) }
+func (*SpanList) ProtoMessage()               {}
+func (*SpanList) Descriptor() ([]byte, []int) { return fileDescriptorForward, []int{1} }
+
+func (m *SpanList) GetSpans() []*ssf.SSFSpan {
+	if m != nil {
+		return m.Spans
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*MetricList)(nil), "forwardrpc.MetricList")
+	proto.RegisterType((*SpanList)(nil), "forwardrpc.SpanList")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -70,6 +90,12 @@ const _ = grpc.SupportPackageIsVersion4
 type ForwardClient interface {
 	// SendMetrics sends a batch of metrics at once, and returns no response.
 	SendMetrics(ctx context.Context, in *MetricList, opts ...grpc.CallOption) (*google_protobuf1.Empty, error)
+	// SendMetricsStream sends batches of metrics over a long-lived stream.
+	// Each MetricList is ingested as soon as it is received.
+	SendMetricsStream(ctx context.Context, opts ...grpc.CallOption) (Forward_SendMetricsStreamClient, error)
+	// SendSpans sends a batch of SSF spans at once, to be ingested like
+	// spans received on an SSF listener, and returns no response.
+	SendSpans(ctx context.Context, in *SpanList, opts ...grpc.CallOption) (*google_protobuf1.Empty, error)
 }
 
 type forwardClient struct {
@@ -89,11 +115,60 @@ func (c *forwardClient) SendMetrics(ctx context.Context, in *MetricList, opts ..
 	return out, nil
 }
 
+func (c *forwardClient) SendMetricsStream(ctx context.Context, opts ...grpc.CallOption) (Forward_SendMetricsStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Forward_serviceDesc.Streams[0], c.cc, "/forwardrpc.Forward/SendMetricsStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &forwardSendMetricsStreamClient{stream}
+	return x, nil
+}
+
+type Forward_SendMetricsStreamClient interface {
+	Send(*MetricList) error
+	CloseAndRecv() (*google_protobuf1.Empty, error)
+	grpc.ClientStream
+}
+
+type forwardSendMetricsStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *forwardSendMetricsStreamClient) Send(m *MetricList) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *forwardSendMetricsStreamClient) CloseAndRecv() (*google_protobuf1.Empty, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(google_protobuf1.Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *forwardClient) SendSpans(ctx context.Context, in *SpanList, opts ...grpc.CallOption) (*google_protobuf1.Empty, error) {
+	out := new(google_protobuf1.Empty)
+	err := grpc.Invoke(ctx, "/forwardrpc.Forward/SendSpans", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Forward service
 
 type ForwardServer interface {
 	// SendMetrics sends a batch of metrics at once, and returns no response.
 	SendMetrics(context.Context, *MetricList) (*google_protobuf1.Empty, error)
+	// SendMetricsStream sends batches of metrics over a long-lived stream.
+	// Each MetricList is ingested as soon as it is received.
+	SendMetricsStream(Forward_SendMetricsStreamServer) error
+	// SendSpans sends a batch of SSF spans at once, to be ingested like
+	// spans received on an SSF listener, and returns no response.
+	SendSpans(context.Context, *SpanList) (*google_protobuf1.Empty, error)
 }
 
 func RegisterForwardServer(s *grpc.Server, srv ForwardServer) {
@@ -118,6 +193,50 @@ func _Forward_SendMetrics_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Forward_SendMetricsStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ForwardServer).SendMetricsStream(&forwardSendMetricsStreamServer{stream})
+}
+
+type Forward_SendMetricsStreamServer interface {
+	SendAndClose(*google_protobuf1.Empty) error
+	Recv() (*MetricList, error)
+	grpc.ServerStream
+}
+
+type forwardSendMetricsStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *forwardSendMetricsStreamServer) SendAndClose(m *google_protobuf1.Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *forwardSendMetricsStreamServer) Recv() (*MetricList, error) {
+	m := new(MetricList)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Forward_SendSpans_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SpanList)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ForwardServer).SendSpans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/forwardrpc.Forward/SendSpans",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ForwardServer).SendSpans(ctx, req.(*SpanList))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Forward_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "forwardrpc.Forward",
 	HandlerType: (*ForwardServer)(nil),
@@ -126,8 +245,18 @@ var _Forward_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SendMetrics",
 			Handler:    _Forward_SendMetrics_Handler,
 		},
+		{
+			MethodName: "SendSpans",
+			Handler:    _Forward_SendSpans_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendMetricsStream",
+			Handler:       _Forward_SendMetricsStream_Handler,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "forwardrpc/forward.proto",
 }
 
@@ -161,6 +290,36 @@ func (m *MetricList) MarshalTo(dAtA []byte) (int, error) {
 	return i, nil
 }
 
+func (m *SpanList) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *SpanList) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Spans) > 0 {
+		for _, msg := range m.Spans {
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintForward(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	return i, nil
+}
+
 func encodeVarintForward(dAtA []byte, offset int, v uint64) int {
 	for v >= 1<<7 {
 		dAtA[offset] = uint8(v&0x7f | 0x80)
@@ -182,6 +341,18 @@ func (m *MetricList) Size() (n int) {
 	return n
 }
 
+func (m *SpanList) Size() (n int) {
+	var l int
+	_ = l
+	if len(m.Spans) > 0 {
+		for _, e := range m.Spans {
+			l = e.Size()
+			n += 1 + l + sovForward(uint64(l))
+		}
+	}
+	return n
+}
+
 func sovForward(x uint64) (n int) {
 	for {
 		n++
@@ -276,6 +447,87 @@ func (m *MetricList) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *SpanList) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowForward
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SpanList: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SpanList: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Spans", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowForward
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthForward
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Spans = append(m.Spans, &ssf.SSFSpan{})
+			if err := m.Spans[len(m.Spans)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipForward(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthForward
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipForward(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -384,18 +636,22 @@ var (
 func init() { proto.RegisterFile("forwardrpc/forward.proto", fileDescriptorForward) }
 
 var fileDescriptorForward = []byte{
-	// 194 bytes of a gzipped FileDescriptorProto
+	// 269 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x92, 0x48, 0xcb, 0x2f, 0x2a,
 	0x4f, 0x2c, 0x4a, 0x29, 0x2a, 0x48, 0xd6, 0x87, 0x32, 0xf5, 0x0a, 0x8a, 0xf2, 0x4b, 0xf2, 0x85,
 	0xb8, 0x10, 0x32, 0x52, 0x72, 0xc5, 0x89, 0xb9, 0x05, 0x39, 0xa9, 0x45, 0xc5, 0xfa, 0xb9, 0xa9,
 	0x25, 0x45, 0x99, 0xc9, 0x05, 0x49, 0x50, 0x06, 0x44, 0xad, 0x94, 0x74, 0x7a, 0x7e, 0x7e, 0x7a,
-	0x4e, 0xaa, 0x3e, 0x98, 0x97, 0x54, 0x9a, 0xa6, 0x9f, 0x9a, 0x5b, 0x50, 0x52, 0x09, 0x91, 0x54,
-	0xb2, 0xe0, 0xe2, 0xf2, 0x05, 0x2b, 0xf6, 0xc9, 0x2c, 0x2e, 0x11, 0xd2, 0xe2, 0x62, 0x87, 0x68,
-	0x2d, 0x96, 0x60, 0x54, 0x60, 0xd6, 0xe0, 0x36, 0x12, 0xd0, 0x83, 0x99, 0xa9, 0x07, 0x51, 0x16,
-	0x04, 0x53, 0x60, 0xe4, 0xc5, 0xc5, 0xee, 0x06, 0x71, 0x84, 0x90, 0x3d, 0x17, 0x77, 0x70, 0x6a,
-	0x5e, 0x0a, 0x44, 0x45, 0xb1, 0x90, 0x98, 0x1e, 0xc2, 0x75, 0x7a, 0x08, 0xd3, 0xa5, 0xc4, 0xf4,
-	0x20, 0x2e, 0xd1, 0x83, 0xb9, 0x44, 0xcf, 0x15, 0xe4, 0x12, 0x25, 0x06, 0x27, 0x81, 0x13, 0x8f,
-	0xe4, 0x18, 0x2f, 0x3c, 0x92, 0x63, 0x7c, 0xf0, 0x48, 0x8e, 0x71, 0xc2, 0x63, 0x39, 0x86, 0x24,
-	0x36, 0xb0, 0x1a, 0x63, 0x40, 0x00, 0x00, 0x00, 0xff, 0xff, 0x19, 0x1f, 0x49, 0x76, 0x03, 0x01,
-	0x00, 0x00,
+	0x4e, 0xaa, 0x3e, 0x98, 0x97, 0x54, 0x9a, 0xa6, 0x9f, 0x9a, 0x5b, 0x50, 0x52, 0x09, 0x95, 0x14,
+	0x28, 0x2e, 0x4e, 0xd3, 0x87, 0x18, 0x00, 0x11, 0x51, 0xb2, 0xe0, 0xe2, 0xf2, 0x05, 0x6b, 0xf7,
+	0xc9, 0x2c, 0x2e, 0x11, 0xd2, 0xe2, 0x62, 0x87, 0x18, 0x56, 0x2c, 0xc1, 0xa8, 0xc0, 0xac, 0xc1,
+	0x6d, 0x24, 0xa0, 0x07, 0xb3, 0x45, 0x0f, 0xa2, 0x2c, 0x08, 0xa6, 0x40, 0x49, 0x8f, 0x8b, 0x23,
+	0xb8, 0x20, 0x31, 0x0f, 0xac, 0x4f, 0x89, 0x8b, 0xb5, 0xb8, 0x20, 0x31, 0x0f, 0xa6, 0x8b, 0x47,
+	0xaf, 0xb8, 0x38, 0x4d, 0x2f, 0x38, 0xd8, 0x0d, 0xa4, 0x20, 0x08, 0x22, 0x65, 0x74, 0x81, 0x91,
+	0x8b, 0xdd, 0x0d, 0xe2, 0x0f, 0x21, 0x7b, 0x2e, 0xee, 0xe0, 0xd4, 0xbc, 0x14, 0x88, 0x91, 0xc5,
+	0x42, 0x62, 0x7a, 0x08, 0x0f, 0xea, 0x21, 0x9c, 0x23, 0x25, 0xa6, 0x07, 0xf1, 0x8c, 0x1e, 0xcc,
+	0x33, 0x7a, 0xae, 0x20, 0xcf, 0x28, 0x31, 0x08, 0xb9, 0x73, 0x09, 0x22, 0x19, 0x10, 0x5c, 0x52,
+	0x94, 0x9a, 0x98, 0x4b, 0xba, 0x31, 0x1a, 0x8c, 0x42, 0xd6, 0x5c, 0x9c, 0x20, 0x83, 0x40, 0x0e,
+	0x2d, 0x16, 0x12, 0x41, 0x36, 0x00, 0xe6, 0x39, 0xdc, 0xda, 0x9d, 0x04, 0x4e, 0x3c, 0x92, 0x63,
+	0xbc, 0xf0, 0x48, 0x8e, 0xf1, 0xc1, 0x23, 0x39, 0xc6, 0x09, 0x8f, 0xe5, 0x18, 0x92, 0xd8, 0xc0,
+	0x6a, 0x8c, 0x01, 0x03, 0x00, 0x41, 0x78, 0x9d, 0xd3, 0xcc, 0x01, 0x00, 0x00,
 }
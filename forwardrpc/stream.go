@@ -0,0 +1,18 @@
+package forwardrpc
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// StreamAcceptedHeader is the header that servers implementing
+// SendMetricsStream send as soon as they accept a stream. Clients wait for
+// it to tell servers that accept streams apart from ones that don't
+// implement them.
+const StreamAcceptedHeader = "veneur-stream-accepted"
+
+// AcceptStream sends the StreamAcceptedHeader on a server stream. It should
+// be called at the start of a SendMetricsStream handler.
+func AcceptStream(stream grpc.ServerStream) error {
+	return stream.SendHeader(metadata.Pairs(StreamAcceptedHeader, "true"))
+}
@@ -0,0 +1,168 @@
+package veneur
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// gaugeRateSuffix is added to the name of a gauge for the counter of
+// its rate.
+const gaugeRateSuffix = ".rate"
+
+// defaultGaugeRateExpiryIntervals is how many intervals the last value
+// of a gauge is kept for without being updated, and
+// defaultGaugeRateMaxContexts is how many gauges' last values are kept
+// at most.
+const (
+	defaultGaugeRateExpiryIntervals = 10
+	defaultGaugeRateMaxContexts     = 100000
+)
+
+// gaugeRates turns gauges whose values only grow, like the byte counts
+// that some systems report as gauges, into counters of how much they
+// grew in each interval, named like the gauge with gaugeRateSuffix.
+// The counters are flushed along with the gauges, which are flushed as
+// they were.
+type gaugeRates struct {
+	names       map[string]struct{}
+	prefixes    []string
+	expiry      int64
+	maxContexts int
+
+	// mtx guards the contexts, by gaugeRateKey, and the counts of
+	// what happened to them since the last flush.
+	mtx      sync.Mutex
+	interval int64
+	contexts map[string]*gaugeRateContext
+	resets   int64
+	evicted  int64
+	dropped  int64
+}
+
+type gaugeRateContext struct {
+	last     float64
+	lastSeen int64
+}
+
+// newGaugeRates returns the gauge rates for the gauges with the names,
+// or with names starting with the prefixes, or nil if there are
+// neither.
+func newGaugeRates(names, prefixes []string, expiryIntervals, maxContexts int) *gaugeRates {
+	if len(names) == 0 && len(prefixes) == 0 {
+		return nil
+	}
+	if expiryIntervals <= 0 {
+		expiryIntervals = defaultGaugeRateExpiryIntervals
+	}
+	if maxContexts <= 0 {
+		maxContexts = defaultGaugeRateMaxContexts
+	}
+	gr := &gaugeRates{
+		names:       make(map[string]struct{}, len(names)),
+		prefixes:    prefixes,
+		expiry:      int64(expiryIntervals),
+		maxContexts: maxContexts,
+		contexts:    map[string]*gaugeRateContext{},
+	}
+	for _, name := range names {
+		gr.names[name] = struct{}{}
+	}
+	return gr
+}
+
+func (gr *gaugeRates) matches(name string) bool {
+	if _, ok := gr.names[name]; ok {
+		return true
+	}
+	for _, prefix := range gr.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gaugeRateKey identifies a gauge by its name, host and tags, in any
+// order.
+func gaugeRateKey(m *samplers.InterMetric) string {
+	tags := append([]string(nil), m.Tags...)
+	sort.Strings(tags)
+	return m.Name + "\x00" + m.HostName + "\x00" + strings.Join(tags, "\x00")
+}
+
+// rates returns the rate counters of the gauges among the metrics of a
+// flush, and samples that count what happened to the gauges' contexts.
+//
+// A rate is how much a gauge grew since its last value, spread evenly
+// over the intervals since then, if it was missing from some. A gauge
+// that shrank was reset, so its rate is 0. The first value of a gauge
+// only establishes where it starts. The contexts that weren't seen for
+// expiry intervals are evicted, and new ones are dropped while there
+// are maxContexts of them.
+func (gr *gaugeRates) rates(metrics []samplers.InterMetric) ([]samplers.InterMetric, []*ssf.SSFSample) {
+	gr.mtx.Lock()
+	defer gr.mtx.Unlock()
+
+	var rates []samplers.InterMetric
+	for i := range metrics {
+		m := &metrics[i]
+		if m.Type != samplers.GaugeMetric || !gr.matches(m.Name) {
+			continue
+		}
+		key := gaugeRateKey(m)
+		ctx, ok := gr.contexts[key]
+		if !ok {
+			if len(gr.contexts) >= gr.maxContexts {
+				gr.dropped++
+				continue
+			}
+			gr.contexts[key] = &gaugeRateContext{last: m.Value, lastSeen: gr.interval}
+			continue
+		}
+		if ctx.lastSeen == gr.interval {
+			// the same gauge twice in one flush only counts
+			// once
+			continue
+		}
+
+		rate := 0.0
+		if m.Value < ctx.last {
+			gr.resets++
+		} else {
+			rate = (m.Value - ctx.last) / float64(gr.interval-ctx.lastSeen)
+		}
+		ctx.last = m.Value
+		ctx.lastSeen = gr.interval
+
+		rates = append(rates, samplers.InterMetric{
+			Name:      m.Name + gaugeRateSuffix,
+			Timestamp: m.Timestamp,
+			Value:     rate,
+			Tags:      m.Tags,
+			Type:      samplers.CounterMetric,
+			HostName:  m.HostName,
+			Sinks:     m.Sinks,
+		})
+	}
+
+	gr.interval++
+	for key, ctx := range gr.contexts {
+		if gr.interval-ctx.lastSeen > gr.expiry {
+			delete(gr.contexts, key)
+			gr.evicted++
+		}
+	}
+
+	samples := []*ssf.SSFSample{
+		ssf.Count("flush.gauge_rates.resets_total", float32(gr.resets), nil),
+		ssf.Count("flush.gauge_rates.evicted_total", float32(gr.evicted), nil),
+		ssf.Count("flush.gauge_rates.dropped_total", float32(gr.dropped), nil),
+		ssf.Gauge("flush.gauge_rates.contexts", float32(len(gr.contexts)), nil),
+	}
+	gr.resets, gr.evicted, gr.dropped = 0, 0, 0
+	return rates, samples
+}
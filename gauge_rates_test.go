@@ -0,0 +1,96 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func gauge(name string, value float64, tags ...string) samplers.InterMetric {
+	return samplers.InterMetric{Name: name, Value: value, Tags: tags, Type: samplers.GaugeMetric}
+}
+
+// flushRates returns the values of the rates of the gauges, by their
+// names and first tags, and the values of the samples by their names.
+func flushRates(gr *gaugeRates, gauges ...samplers.InterMetric) (map[string]float64, map[string]float32) {
+	rates, samples := gr.rates(gauges)
+	values := map[string]float64{}
+	for _, rate := range rates {
+		values[rate.Name+"|"+rate.Tags[0]] = rate.Value
+	}
+	counts := map[string]float32{}
+	for _, sample := range samples {
+		counts[sample.Name] = sample.Value
+	}
+	return values, counts
+}
+
+func TestGaugeRates(t *testing.T) {
+	gr := newGaugeRates([]string{"bytes"}, []string{"net."}, 2, 0)
+
+	rates, _ := flushRates(gr,
+		gauge("bytes", 100, "host:a", "disk:1"),
+		gauge("net.rx", 1000, "host:a"),
+		gauge("other", 5, "host:a"),
+	)
+	assert.Empty(t, rates, "the first values should only be remembered")
+
+	rates, counts := flushRates(gr,
+		// the same tags in another order are the same gauge:
+		gauge("bytes", 150, "disk:1", "host:a"),
+		gauge("net.rx", 400, "host:a"),
+		gauge("other", 10, "host:a"),
+	)
+	assert.Equal(t, map[string]float64{
+		"bytes.rate|disk:1":  50,
+		"net.rx.rate|host:a": 0,
+	}, rates)
+	assert.Equal(t, float32(1), counts["flush.gauge_rates.resets_total"])
+	assert.Equal(t, float32(2), counts["flush.gauge_rates.contexts"])
+
+	// net.rx goes missing for an interval, which its growth is spread
+	// over:
+	flushRates(gr, gauge("bytes", 150, "host:a", "disk:1"))
+	rates, _ = flushRates(gr, gauge("net.rx", 500, "host:a"))
+	assert.Equal(t, map[string]float64{"net.rx.rate|host:a": 50}, rates)
+
+	// ...and bytes expires after 2 more intervals:
+	rates, counts = flushRates(gr)
+	assert.Empty(t, rates)
+	assert.Equal(t, float32(1), counts["flush.gauge_rates.evicted_total"])
+	rates, _ = flushRates(gr, gauge("bytes", 200, "host:a", "disk:1"))
+	assert.Empty(t, rates)
+
+	assert.Nil(t, newGaugeRates(nil, nil, 0, 0))
+}
+
+func TestGaugeRatesMaxContexts(t *testing.T) {
+	gr := newGaugeRates(nil, []string{""}, 0, 1)
+	_, counts := flushRates(gr, gauge("a", 1, "x:1"), gauge("b", 1, "x:1"))
+	assert.Equal(t, float32(1), counts["flush.gauge_rates.dropped_total"])
+	rates, _ := flushRates(gr, gauge("a", 2, "x:1"), gauge("b", 2, "x:1"))
+	assert.Equal(t, map[string]float64{"a.rate|x:1": 1}, rates)
+}
+
+func TestFlushGaugeRates(t *testing.T) {
+	config := globalConfig()
+	config.GaugeRateNames = []string{"bytes_sent"}
+	h := newHarness(t, config)
+	defer h.Close()
+
+	h.SendStatsd("bytes_sent:100|g|#host:a")
+	h.Flush()
+	h.SendStatsd("bytes_sent:160|g|#host:a")
+	h.Flush()
+
+	m, ok := h.Metrics.Metric("bytes_sent.rate")
+	require.True(t, ok)
+	assert.Equal(t, float64(60), m.Value)
+	assert.Equal(t, samplers.CounterMetric, m.Type)
+	assert.Equal(t, []string{"host:a"}, m.Tags)
+	m, ok = h.Metrics.Metric("bytes_sent")
+	require.True(t, ok, "the gauge is flushed, too")
+	assert.Equal(t, float64(160), m.Value)
+}
@@ -38,7 +38,11 @@ func handleProxy(p *Proxy) http.Handler {
 		}
 		// the server usually waits for this to return before finalizing the
 		// response, so this part must be done asynchronously
-		go p.ProxyMetrics(span.Attach(ctx), jsonMetrics, strings.SplitN(r.RemoteAddr, ":", 2)[0])
+		p.proxying.Add(1)
+		go func() {
+			defer p.proxying.Done()
+			p.ProxyMetrics(span.Attach(ctx), jsonMetrics, strings.SplitN(r.RemoteAddr, ":", 2)[0])
+		}()
 	})
 }
 
@@ -67,7 +71,11 @@ func handleImport(s *Server) http.Handler {
 		}
 		// the server usually waits for this to return before finalizing the
 		// response, so this part must be done asynchronously
-		go s.ImportMetrics(span.Attach(ctx), jsonMetrics)
+		s.imports.Add(1)
+		go func() {
+			defer s.imports.Done()
+			s.ImportMetrics(span.Attach(ctx), jsonMetrics)
+		}()
 	})
 }
 
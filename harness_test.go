@@ -0,0 +1,164 @@
+package veneur
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/internal/veneurtest"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// testHarness runs a veneur server in memory, that flushes to fake
+// sinks when the test advances its fake clock. Tests send it statsd
+// and SSF packets directly, flush it with Flush, and then look at
+// what its sinks got:
+//
+//	h := newHarness(t, globalConfig())
+//	defer h.Close()
+//	h.SendStatsd("a.b.c:1|c")
+//	h.Flush()
+//	m, ok := h.Metrics.Metric("a.b.c")
+type testHarness struct {
+	t        testing.TB
+	server   *Server
+	clock    *veneurtest.Clock
+	interval time.Duration
+	flushes  chan *sync.WaitGroup
+	// sentSpans is how many spans the test sent.
+	sentSpans int
+
+	// Metrics and Spans are the server's fake sinks, named "fake".
+	Metrics *veneurtest.MetricSink
+	Spans   *veneurtest.SpanSink
+}
+
+// harnessTimeout bounds how long a harness waits for the server, in
+// real time, before it fails the test.
+const harnessTimeout = 10 * time.Second
+
+// newHarness starts a server from the config, without any statsd or
+// SSF listeners, and with the fake sinks added to the ones the config
+// sets up.
+func newHarness(t testing.TB, config Config) *testHarness {
+	config.SynchronizeWithInterval = false
+	server, err := NewFromConfig(logrus.New(), config)
+	require.NoError(t, err)
+	server.StatsdListenAddrs = nil
+	server.SSFListenAddrs = nil
+	// Make sure we don't send internal metrics when testing:
+	trace.NeutralizeClient(server.TraceClient)
+	server.TraceClient = nil
+
+	clock := veneurtest.NewClock(time.Unix(1500000000, 0))
+	h := &testHarness{
+		t:        t,
+		server:   server,
+		clock:    clock,
+		interval: server.interval,
+		flushes:  make(chan *sync.WaitGroup, 1),
+		Metrics:  veneurtest.NewMetricSink("fake", clock),
+		Spans:    veneurtest.NewSpanSink("fake", clock),
+	}
+	server.clock = clock
+	server.afterFlush = func(wg *sync.WaitGroup) { h.flushes <- wg }
+	server.metricSinks = append(server.metricSinks, h.Metrics)
+	server.spanSinks = append(server.spanSinks, h.Spans)
+	server.Start()
+	// Wait for the flush loop, so that the first Flush isn't missed:
+	clock.WaitForTickers(1)
+	return h
+}
+
+// SendStatsd handles statsd packets, like the server's statsd
+// listeners do.
+func (h *testHarness) SendStatsd(packets ...string) {
+	for _, packet := range packets {
+		require.NoError(h.t, h.server.HandleMetricPacket([]byte(packet)))
+	}
+}
+
+// SendSSF handles the spans, each in an SSF packet, like the server's
+// SSF listeners do.
+func (h *testHarness) SendSSF(spans ...*ssf.SSFSpan) {
+	for _, span := range spans {
+		packet, err := proto.Marshal(span)
+		require.NoError(h.t, err)
+		h.server.HandleTracePacket(packet)
+		h.sentSpans++
+	}
+}
+
+// IngestMetrics hands parsed metrics to the server's workers.
+func (h *testHarness) IngestMetrics(metrics ...*samplers.UDPMetric) {
+	for _, m := range metrics {
+		h.server.ingestUDP(*m)
+	}
+}
+
+// Flush waits for the server to process everything it was sent, then
+// advances the clock by an interval, and waits for the flush that that
+// triggers to finish, including its forwarding and span sink flushes.
+func (h *testHarness) Flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), harnessTimeout)
+	defer cancel()
+	// The spans and imports go first, as they end up with the
+	// workers. Once the fake sink got the spans that were sent, the
+	// span workers took them all, and the other sinks are drained
+	// after them:
+	require.True(h.t, h.Spans.WaitForSpans(ctx, h.sentSpans), "timed out waiting for the spans")
+	require.True(h.t, h.server.drainSpans(ctx), "timed out waiting for the span sinks")
+	require.True(h.t, h.server.drainImports(ctx), "timed out waiting for imports")
+	for _, w := range h.server.Workers {
+		require.NoError(h.t, w.drain(ctx), "timed out waiting for the workers")
+	}
+
+	h.clock.Advance(h.interval)
+	select {
+	case wg := <-h.flushes:
+		wg.Wait()
+	case <-ctx.Done():
+		h.t.Fatal("timed out waiting for the flush")
+	}
+}
+
+// Close shuts the server down.
+func (h *testHarness) Close() {
+	h.server.Shutdown()
+}
+
+func TestHarnessFlushes(t *testing.T) {
+	h := newHarness(t, globalConfig())
+	defer h.Close()
+
+	h.SendStatsd("a.b.c:1|c", "a.b.c:2|c", "x.y.z:5|g")
+	h.SendSSF(&ssf.SSFSpan{Id: 1, TraceId: 1, Name: "checkout", Service: "shop",
+		StartTimestamp: 1, EndTimestamp: 2})
+	h.Flush()
+
+	flushes := h.Metrics.Flushes()
+	require.Len(t, flushes, 1)
+	require.Equal(t, time.Unix(1500000000, 0).Add(h.interval), flushes[0].Time)
+	m, ok := h.Metrics.Metric("x.y.z")
+	require.True(t, ok)
+	require.Equal(t, float64(5), m.Value)
+	_, ok = h.Metrics.Metric("a.b.c")
+	require.True(t, ok)
+
+	spans := h.Spans.Spans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "checkout", spans[0].Span.Name)
+	require.Len(t, h.Spans.Flushes(), 1)
+
+	// Nothing new, so no metrics to flush, but the span sinks are
+	// flushed every interval:
+	h.Flush()
+	require.Len(t, h.Metrics.Flushes(), 1)
+	require.Len(t, h.Spans.Flushes(), 2)
+}
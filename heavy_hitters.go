@@ -0,0 +1,260 @@
+package veneur
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// heavyHittersCapacityFactor is how many more names each worker keeps
+// than it reports, which makes the counts of the reported ones more
+// accurate.
+const heavyHittersCapacityFactor = 10
+
+// defaultHeavyHittersSampling is how many samples a worker sees for each
+// one it adds to its heavy hitters, scaled up to stand for the others.
+// Names with many samples are still found, at a fraction of the cost,
+// and those are the ones that matter.
+const defaultHeavyHittersSampling = 8
+
+// heavyHitters finds the metric names with the most weight (samples, or
+// bytes) with the Space-Saving algorithm: it only keeps capacity names,
+// and a new name replaces the one with the least weight, starting out
+// with its weight as an overcount. So a name's weight may be
+// overestimated, by at most its overcount, but any name with more than
+// 1/capacity of the total weight is never missed.
+type heavyHitters struct {
+	capacity int
+	entries  map[string]*heavyHitter
+	byWeight heavyHitterHeap
+}
+
+// heavyHitter is a metric name and its weight, in /debug/top.
+type heavyHitter struct {
+	Name      string `json:"name"`
+	Weight    int64  `json:"value"`
+	Overcount int64  `json:"overcount"`
+	index     int
+}
+
+func newHeavyHitters(capacity int) *heavyHitters {
+	return &heavyHitters{
+		capacity: capacity,
+		entries:  make(map[string]*heavyHitter, capacity),
+		byWeight: make(heavyHitterHeap, 0, capacity),
+	}
+}
+
+// add adds weight to the name.
+func (hh *heavyHitters) add(name string, weight int64) {
+	entry, ok := hh.entries[name]
+	if !ok {
+		if len(hh.byWeight) < hh.capacity {
+			entry = &heavyHitter{Name: name}
+			hh.entries[name] = entry
+			heap.Push(&hh.byWeight, entry)
+		} else {
+			// reuse the evicted entry, to avoid allocating
+			entry = hh.byWeight[0]
+			delete(hh.entries, entry.Name)
+			entry.Name = name
+			entry.Overcount = entry.Weight
+			hh.entries[name] = entry
+		}
+	}
+	entry.Weight += weight
+	hh.byWeight.down(entry.index)
+}
+
+// topHeavyHitters merges the names tracked by each worker (since
+// workers are sent metrics by their names and tags, a name can be
+// tracked by several of them), and returns the n with the most weight,
+// the most first.
+func topHeavyHitters(n int, trackers []*heavyHitters) []heavyHitter {
+	merged := map[string]*heavyHitter{}
+	for _, hh := range trackers {
+		if hh == nil {
+			continue
+		}
+		for name, entry := range hh.entries {
+			m, ok := merged[name]
+			if !ok {
+				m = &heavyHitter{Name: name}
+				merged[name] = m
+			}
+			m.Weight += entry.Weight
+			m.Overcount += entry.Overcount
+		}
+	}
+	top := make([]heavyHitter, 0, len(merged))
+	for _, m := range merged {
+		top = append(top, *m)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Weight != top[j].Weight {
+			return top[i].Weight > top[j].Weight
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// metricHeavyHitters tracks the metric names that a worker is sent the
+// most samples, and the most bytes, of in an interval. Only one in
+// sampling samples, chosen at random, is tracked. It's only used with
+// the worker's mutex held.
+type metricHeavyHitters struct {
+	samples  *heavyHitters
+	bytes    *heavyHitters
+	sampling uint64
+	rand     uint64
+}
+
+func newMetricHeavyHitters(capacity, sampling int) *metricHeavyHitters {
+	if sampling < 1 {
+		sampling = 1
+	}
+	return &metricHeavyHitters{
+		samples:  newHeavyHitters(capacity),
+		bytes:    newHeavyHitters(capacity),
+		sampling: uint64(sampling),
+		// xorshift's state must not be zero
+		rand: uint64(time.Now().UnixNano()) | 1,
+	}
+}
+
+func (mhh *metricHeavyHitters) add(name string, size int) {
+	if mhh.sampling > 1 {
+		// xorshift64, which is much cheaper than math/rand, and
+		// random enough to not be fooled by clients that send
+		// metrics in a repeating order
+		mhh.rand ^= mhh.rand << 13
+		mhh.rand ^= mhh.rand >> 7
+		mhh.rand ^= mhh.rand << 17
+		if mhh.rand%mhh.sampling != 0 {
+			return
+		}
+	}
+	weight := int64(mhh.sampling)
+	mhh.samples.add(name, weight)
+	// metrics that weren't sent over DogStatsD don't have a size
+	if size > 0 {
+		mhh.bytes.add(name, int64(size)*weight)
+	}
+}
+
+// topMetrics keeps the top metric names of the last interval, for
+// /debug/top.
+type topMetrics struct {
+	n int
+
+	mtx       sync.Mutex
+	bySamples []heavyHitter
+	byBytes   []heavyHitter
+}
+
+func newTopMetrics(n int) *topMetrics {
+	return &topMetrics{n: n}
+}
+
+// update merges the workers' heavy hitters at the end of an interval,
+// and reports the top names as internal metrics.
+func (tm *topMetrics) update(wms []WorkerMetrics, cl *trace.Client) {
+	samplesTrackers := make([]*heavyHitters, 0, len(wms))
+	bytesTrackers := make([]*heavyHitters, 0, len(wms))
+	for _, wm := range wms {
+		if wm.heavyHitters != nil {
+			samplesTrackers = append(samplesTrackers, wm.heavyHitters.samples)
+			bytesTrackers = append(bytesTrackers, wm.heavyHitters.bytes)
+		}
+	}
+	bySamples := topHeavyHitters(tm.n, samplesTrackers)
+	byBytes := topHeavyHitters(tm.n, bytesTrackers)
+
+	tm.mtx.Lock()
+	tm.bySamples = bySamples
+	tm.byBytes = byBytes
+	tm.mtx.Unlock()
+
+	reports := make([]*ssf.SSFSample, 0, len(bySamples)+len(byBytes))
+	for i, hh := range bySamples {
+		reports = append(reports, ssf.Gauge("top_metrics.samples", float32(hh.Weight),
+			map[string]string{"metric_name": hh.Name, "rank": strconv.Itoa(i + 1)}))
+	}
+	for i, hh := range byBytes {
+		reports = append(reports, ssf.Gauge("top_metrics.bytes", float32(hh.Weight),
+			map[string]string{"metric_name": hh.Name, "rank": strconv.Itoa(i + 1)}))
+	}
+	if len(reports) > 0 {
+		metrics.ReportBatch(cl, reports)
+	}
+}
+
+// ServeHTTP shows the top metric names of the last interval as JSON.
+func (tm *topMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tm.mtx.Lock()
+	body := struct {
+		BySamples []heavyHitter `json:"by_samples"`
+		ByBytes   []heavyHitter `json:"by_bytes"`
+	}{tm.bySamples, tm.byBytes}
+	tm.mtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// heavyHitterHeap is a min-heap of heavy hitters by weight.
+type heavyHitterHeap []*heavyHitter
+
+func (h heavyHitterHeap) Len() int           { return len(h) }
+func (h heavyHitterHeap) Less(i, j int) bool { return h[i].Weight < h[j].Weight }
+func (h heavyHitterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *heavyHitterHeap) Push(x interface{}) {
+	entry := x.(*heavyHitter)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+// down moves the entry at i down the heap, after its weight increased.
+// It's heap.Fix, without the overhead of calling the heap's methods
+// through an interface, which matters since it's done for every sample.
+func (h heavyHitterHeap) down(i int) {
+	n := len(h)
+	for {
+		least := 2*i + 1
+		if least >= n {
+			break
+		}
+		if right := least + 1; right < n && h[right].Weight < h[least].Weight {
+			least = right
+		}
+		if h[i].Weight <= h[least].Weight {
+			break
+		}
+		h.Swap(i, least)
+		i = least
+	}
+}
+
+func (h *heavyHitterHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,157 @@
+package veneur
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestHeavyHitters(t *testing.T) {
+	hh := newHeavyHitters(3)
+	for name, weight := range map[string]int64{"a": 10, "b": 5, "c": 2} {
+		hh.add(name, weight)
+	}
+	// a new name replaces the one with the least weight, and starts out
+	// with its weight:
+	hh.add("d", 1)
+	assert.Len(t, hh.entries, 3)
+	assert.NotContains(t, hh.entries, "c")
+	assert.Equal(t, int64(3), hh.entries["d"].Weight)
+	assert.Equal(t, int64(2), hh.entries["d"].Overcount)
+
+	other := newHeavyHitters(3)
+	other.add("b", 7)
+	other.add("e", 1)
+	top := topHeavyHitters(2, []*heavyHitters{hh, nil, other})
+	require.Len(t, top, 2)
+	assert.Equal(t, "b", top[0].Name, "the trackers' weights should be added up")
+	assert.Equal(t, int64(12), top[0].Weight)
+	assert.Equal(t, "a", top[1].Name)
+	assert.Equal(t, int64(10), top[1].Weight)
+}
+
+// TestHeavyHittersSkewed checks that the heaviest names are found, with
+// their weights within their overcounts, among many more names than
+// are tracked.
+func TestHeavyHittersSkewed(t *testing.T) {
+	hh := newHeavyHitters(100)
+	sampled := newMetricHeavyHitters(100, defaultHeavyHittersSampling)
+	exact := map[string]int64{}
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, 10000)
+	for i := 0; i < 100000; i++ {
+		name := fmt.Sprintf("metric.%d", zipf.Uint64())
+		exact[name]++
+		hh.add(name, 1)
+		sampled.add(name, 10)
+	}
+	for i, top := range topHeavyHitters(10, []*heavyHitters{hh}) {
+		assert.Equal(t, fmt.Sprintf("metric.%d", i), top.Name)
+		assert.True(t, top.Weight >= exact[top.Name] && top.Weight-top.Overcount <= exact[top.Name],
+			"%s: %d (overcount %d) should bound %d", top.Name, top.Weight, top.Overcount, exact[top.Name])
+	}
+	// sampling still finds the heaviest names, with about their counts:
+	for i, top := range topHeavyHitters(3, []*heavyHitters{sampled.samples}) {
+		assert.Equal(t, fmt.Sprintf("metric.%d", i), top.Name)
+		assert.InEpsilon(t, exact[top.Name], top.Weight, 0.1)
+	}
+}
+
+func TestTopMetrics(t *testing.T) {
+	workers := []*Worker{
+		NewWorker(1, nil, logrus.New(), nil),
+		NewWorker(2, nil, logrus.New(), nil),
+	}
+	for _, w := range workers {
+		w.heavyHittersCapacity = 10
+	}
+	packets := []string{
+		"a:1|c", "a:1|c|#tag:1", "a:1|c|#tag:2",
+		"b.with.a.much.longer.name:1|c|#and:some,more:tags",
+		"c:1:2:3|h",
+	}
+	for i, packet := range packets {
+		parsed, err := samplers.ParseMetrics([]byte(packet), "")
+		require.NoError(t, err)
+		for j := range parsed {
+			workers[i%len(workers)].ProcessMetric(&parsed[j])
+		}
+	}
+
+	tm := newTopMetrics(2)
+	wms := make([]WorkerMetrics, 0, len(workers))
+	for _, w := range workers {
+		wms = append(wms, w.Flush())
+	}
+	tm.update(wms, nil)
+
+	w := httptest.NewRecorder()
+	tm.ServeHTTP(w, httptest.NewRequest("GET", "/debug/top", nil))
+	var body struct {
+		BySamples []heavyHitter `json:"by_samples"`
+		ByBytes   []heavyHitter `json:"by_bytes"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	names := func(hhs []heavyHitter) (names []string, weights []int64) {
+		for _, hh := range hhs {
+			names = append(names, hh.Name)
+			weights = append(weights, hh.Weight)
+		}
+		return
+	}
+	bySamples, samples := names(body.BySamples)
+	assert.Equal(t, []string{"a", "c"}, bySamples)
+	assert.Equal(t, []int64{3, 3}, samples)
+	byBytes, bytes := names(body.ByBytes)
+	assert.Equal(t, []string{"b.with.a.much.longer.name", "a"}, byBytes)
+	assert.Equal(t, []int64{int64(len(packets[3])), int64(len(packets[0]) + len(packets[1]) + len(packets[2]))}, bytes)
+}
+
+// BenchmarkHeavyHittersOverhead measures Worker.ProcessMetric with
+// heavy hitters tracked and without, over names with a long tail, and
+// reports each tracked run's time per sample as a ratio of the
+// untracked one's.
+func BenchmarkHeavyHittersOverhead(b *testing.B) {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 100000)
+	metrics := make([]*samplers.UDPMetric, 10000)
+	for i := range metrics {
+		var err error
+		metrics[i], err = samplers.ParseMetric([]byte(fmt.Sprintf("metric.%d:1|c|#env:prod", zipf.Uint64())))
+		require.NoError(b, err)
+	}
+
+	var untracked float64
+	run := func(b *testing.B, capacity, sampling int) float64 {
+		w := NewWorker(1, nil, logrus.New(), nil)
+		w.heavyHittersCapacity = capacity
+		w.heavyHittersSampling = sampling
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := time.Now()
+		for i := 0; i < b.N; i++ {
+			w.ProcessMetric(metrics[i%len(metrics)])
+		}
+		b.StopTimer()
+		return float64(time.Since(start).Nanoseconds()) / float64(b.N)
+	}
+	b.Run("untracked", func(b *testing.B) {
+		untracked = run(b, 0, 0)
+	})
+	for _, sampling := range []int{1, defaultHeavyHittersSampling} {
+		for _, capacity := range []int{100, 1000} {
+			b.Run(fmt.Sprintf("sampling=%d/capacity=%d", sampling, capacity), func(b *testing.B) {
+				perSample := run(b, capacity, sampling)
+				if untracked > 0 {
+					b.ReportMetric(perSample/untracked, "x-untracked")
+				}
+			})
+		}
+	}
+}
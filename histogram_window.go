@@ -0,0 +1,150 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/tdigest"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// histogramWindows keeps the digests of the last few intervals of each
+// histogram and timer, so that their percentiles are computed over a
+// rolling window instead of a single interval. Their other aggregates,
+// like the count, stay per interval. It's only used by the flush
+// goroutine, so it isn't safe for concurrent use.
+type histogramWindows struct {
+	// intervals is the length of the windows of the histograms that
+	// don't match any of the prefixes
+	intervals int
+	// prefixes are the prefixes with their own window lengths, longest
+	// first
+	prefixes  []string
+	prefixLen map[string]int
+
+	// generation counts the flushes
+	generation int
+	windows    map[histogramWindowKey]*histogramWindow
+}
+
+// histogramWindowKey identifies a histogram or timer context. Local-only
+// histograms are flushed apart from mixed ones, so they get their own
+// windows.
+type histogramWindowKey struct {
+	samplers.MetricKey
+	local bool
+}
+
+type histogramWindow struct {
+	intervals int
+	// digests are the digests of the intervals the histogram was flushed
+	// in, oldest first, and generations are those intervals
+	digests     []*tdigest.MergingDigest
+	generations []int
+}
+
+// newHistogramWindows validates the window lengths. It returns nil if no
+// histograms have a window longer than one interval.
+func newHistogramWindows(intervals int, prefixIntervals map[string]int) (*histogramWindows, error) {
+	if intervals < 0 {
+		return nil, fmt.Errorf("histogram_window_intervals: %d is negative", intervals)
+	}
+	if intervals <= 1 && len(prefixIntervals) == 0 {
+		return nil, nil
+	}
+	hw := &histogramWindows{
+		intervals: intervals,
+		prefixLen: make(map[string]int, len(prefixIntervals)),
+		windows:   map[histogramWindowKey]*histogramWindow{},
+	}
+	for prefix, n := range prefixIntervals {
+		if n < 0 {
+			return nil, fmt.Errorf("histogram_window_intervals_prefixes: %s: %d is negative", prefix, n)
+		}
+		hw.prefixes = append(hw.prefixes, prefix)
+		hw.prefixLen[prefix] = n
+	}
+	sort.Slice(hw.prefixes, func(i, j int) bool {
+		if len(hw.prefixes[i]) != len(hw.prefixes[j]) {
+			return len(hw.prefixes[i]) > len(hw.prefixes[j])
+		}
+		return hw.prefixes[i] < hw.prefixes[j]
+	})
+	return hw, nil
+}
+
+// windowIntervals returns the window length for histograms with the
+// name: that of the longest matching prefix, if any.
+func (hw *histogramWindows) windowIntervals(name string) int {
+	for _, prefix := range hw.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return hw.prefixLen[prefix]
+		}
+	}
+	return hw.intervals
+}
+
+// add records the digest of this interval's histogram with the key, and
+// returns the digest to compute its percentiles from: h.Value merged with
+// the digests of the rest of its window. h isn't modified.
+func (hw *histogramWindows) add(key histogramWindowKey, h *samplers.Histo) *tdigest.MergingDigest {
+	win, ok := hw.windows[key]
+	if !ok {
+		n := hw.windowIntervals(h.Name)
+		if n <= 1 {
+			return h.Value
+		}
+		win = &histogramWindow{intervals: n}
+		hw.windows[key] = win
+	}
+
+	win.expire(hw.generation)
+	win.digests = append(win.digests, h.Value)
+	win.generations = append(win.generations, hw.generation)
+	if len(win.digests) == 1 {
+		return h.Value
+	}
+
+	merged := tdigest.NewMerging(100, false)
+	for _, d := range win.digests {
+		merged.Merge(d)
+	}
+	return merged
+}
+
+// expire drops the digests that are out of the window as of the
+// generation, keeping at most intervals-1 of them, so that there's room
+// for the generation's own.
+func (win *histogramWindow) expire(generation int) {
+	oldest := 0
+	for oldest < len(win.generations) && win.generations[oldest] <= generation-win.intervals {
+		oldest++
+	}
+	if oldest == 0 {
+		return
+	}
+	n := copy(win.digests, win.digests[oldest:])
+	copy(win.generations, win.generations[oldest:])
+	for i := n; i < len(win.digests); i++ {
+		// let the expired digests be collected
+		win.digests[i] = nil
+	}
+	win.digests = win.digests[:n]
+	win.generations = win.generations[:n]
+}
+
+// rotate starts the next interval, and forgets the windows of the
+// histograms that haven't been flushed within them.
+func (hw *histogramWindows) rotate(cl *trace.Client) {
+	hw.generation++
+	for key, win := range hw.windows {
+		if win.generations[len(win.generations)-1] <= hw.generation-win.intervals {
+			delete(hw.windows, key)
+		}
+	}
+	metrics.ReportOne(cl, ssf.Gauge("flush.histogram_windows_total", float32(len(hw.windows)), nil))
+}
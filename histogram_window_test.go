@@ -0,0 +1,68 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestHistogramWindowsConfig(t *testing.T) {
+	hw, err := newHistogramWindows(1, nil)
+	require.NoError(t, err)
+	assert.Nil(t, hw, "one interval windows don't need keeping")
+
+	hw, err = newHistogramWindows(3, map[string]int{"api.": 6, "api.health.": 1})
+	require.NoError(t, err)
+	assert.Equal(t, 3, hw.windowIntervals("storage.read"))
+	assert.Equal(t, 6, hw.windowIntervals("api.request"))
+	assert.Equal(t, 1, hw.windowIntervals("api.health.check"))
+
+	_, err = newHistogramWindows(-1, nil)
+	assert.Error(t, err)
+	_, err = newHistogramWindows(0, map[string]int{"api.": -2})
+	assert.Error(t, err)
+}
+
+func TestHistogramWindows(t *testing.T) {
+	hw, err := newHistogramWindows(2, map[string]int{"single.": 1})
+	require.NoError(t, err)
+	key := histogramWindowKey{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "histogram"}}
+
+	histo := func(name string, values ...float64) *samplers.Histo {
+		h := samplers.NewHist(name, nil)
+		for _, v := range values {
+			h.Sample(v, 1)
+		}
+		return h
+	}
+
+	first := histo("a.b.c", 1, 2, 3)
+	d := hw.add(key, first)
+	assert.Equal(t, first.Value, d, "a window with one interval is that interval")
+	hw.rotate(nil)
+
+	second := histo("a.b.c", 100, 200, 300)
+	d = hw.add(key, second)
+	assert.Equal(t, float64(6), d.Count())
+	assert.Equal(t, float64(1), d.Min())
+	assert.Equal(t, float64(3), second.Value.Count(), "the histogram itself shouldn't change")
+	hw.rotate(nil)
+
+	third := histo("a.b.c", 1000)
+	d = hw.add(key, third)
+	assert.Equal(t, float64(4), d.Count(), "the first interval should have left the window")
+	assert.Equal(t, float64(100), d.Min())
+	assert.Len(t, hw.windows[key].digests, 2)
+	hw.rotate(nil)
+
+	// a skipped interval still counts towards the window:
+	hw.rotate(nil)
+	assert.Empty(t, hw.windows, "the window should expire once it's empty")
+
+	single := histogramWindowKey{MetricKey: samplers.MetricKey{Name: "single.x", Type: "timer"}}
+	h := histo("single.x", 5)
+	assert.Equal(t, h.Value, hw.add(single, h))
+	assert.Empty(t, hw.windows, "single interval histograms shouldn't be kept")
+}
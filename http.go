@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stripe/veneur/samplers"
+	promsink "github.com/stripe/veneur/sinks/prometheus"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
 	"github.com/stripe/veneur/trace/metrics"
@@ -29,9 +30,7 @@ func (s *Server) Handler() http.Handler {
 		w.Write([]byte(BUILD_DATE))
 	})
 
-	mux.HandleFuncC(pat.Get("/version"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(VERSION))
-	})
+	mux.Handle(pat.Get("/version"), http.HandlerFunc(s.handleVersion))
 
 	// TODO3.0: Maybe remove this endpoint as it is kinda useless now that tracing is always on.
 	mux.HandleFuncC(pat.Get("/healthcheck/tracing"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
@@ -39,6 +38,20 @@ func (s *Server) Handler() http.Handler {
 	})
 
 	mux.Handle(pat.Post("/import"), handleImport(s))
+	mux.Handle(pat.Post("/config/reload"), http.HandlerFunc(s.handleConfigReload))
+
+	if s.promExposition != nil {
+		mux.Handle(pat.Get(promsink.ExpositionPath), s.promExposition)
+	}
+
+	if s.sourceAccounting != nil {
+		mux.Handle(pat.Get("/debug/sources"), s.sourceAccounting)
+	}
+	if s.topMetrics != nil {
+		mux.Handle(pat.Get("/debug/top"), s.topMetrics)
+	}
+	mux.Handle(pat.Get("/debug/samplers"), http.HandlerFunc(s.handleDebugSamplers))
+	mux.Handle(pat.Get("/debug/capture"), http.HandlerFunc(s.handleDebugCapture))
 
 	mux.Handle(pat.Get("/debug/pprof/cmdline"), http.HandlerFunc(pprof.Cmdline))
 	mux.Handle(pat.Get("/debug/pprof/profile"), http.HandlerFunc(pprof.Profile))
@@ -62,10 +75,14 @@ func (s *Server) ImportMetrics(ctx context.Context, jsonMetrics []samplers.JSONM
 	// of allocations)
 	// instead, we'll compute the fnv hash of every metric in the array,
 	// and sort the array by the hashes
-	sortedIter := newJSONMetricsByWorker(jsonMetrics, len(s.Workers))
-	for sortedIter.Next() {
-		nextChunk, workerIndex := sortedIter.Chunk()
-		s.Workers[workerIndex].ImportChan <- nextChunk
+	if s.workerScaler != nil {
+		s.workerScaler.importJSON(jsonMetrics)
+	} else {
+		sortedIter := newJSONMetricsByWorker(jsonMetrics, len(s.Workers))
+		for sortedIter.Next() {
+			nextChunk, workerIndex := sortedIter.Chunk()
+			s.Workers[workerIndex].ImportChan <- nextChunk
+		}
 	}
 	metrics.ReportOne(s.TraceClient, ssf.Timing("import.response_duration_ns", time.Since(span.Start), time.Nanosecond, map[string]string{"part": "merge"}))
 }
@@ -231,7 +231,11 @@ func PostHelper(ctx context.Context, httpClient *http.Client, tc *trace.Client,
 			err = urlErr.Err
 		}
 		span.Error(err)
-		span.Add(ssf.Count(action+".error_total", 1, mergeTags(extraTags, "cause", "io")))
+		cause := "io"
+		if IsTLSHandshakeError(err) {
+			cause = "tls_handshake"
+		}
+		span.Add(ssf.Count(action+".error_total", 1, mergeTags(extraTags, "cause", cause)))
 		// Log at Warn level instead of Error, because we don't want to create
 		// Sentry events for these (they're only important in large numbers, and
 		// we already have Datadog metrics for them)
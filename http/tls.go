@@ -0,0 +1,204 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTLSReloadInterval is how often TLSFiles checks whether its
+// files changed.
+const DefaultTLSReloadInterval = time.Minute
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSFiles holds a TLS certificate and key, and a bundle of authority
+// certificates, loaded from PEM files. Since certificates are rotated
+// often, the files are loaded again whenever they change, and the
+// configurations returned by TLSFiles always use the latest ones.
+type TLSFiles struct {
+	certFile      string
+	keyFile       string
+	authorityFile string
+
+	mtx         sync.RWMutex
+	cert        *tls.Certificate
+	authorities *x509.CertPool
+	modTimes    [3]time.Time
+}
+
+// LoadTLSFiles loads the certificate and key, and the authority
+// certificates. Any of the files may be empty, but the certificate and
+// key must be given together. If they're all empty, it returns nil.
+func LoadTLSFiles(certFile, keyFile, authorityFile string) (*TLSFiles, error) {
+	if certFile == "" && keyFile == "" && authorityFile == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a TLS certificate and key must be given together")
+	}
+	f := &TLSFiles{certFile: certFile, keyFile: keyFile, authorityFile: authorityFile}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload loads the files again if any of them changed since they were
+// last loaded, and reports whether they did. If loading them fails, the
+// previous certificates are kept.
+func (f *TLSFiles) Reload() (bool, error) {
+	var modTimes [3]time.Time
+	for i, name := range []string{f.certFile, f.keyFile, f.authorityFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	f.mtx.RLock()
+	unchanged := modTimes == f.modTimes
+	f.mtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if f.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &pair
+	}
+	var authorities *x509.CertPool
+	if f.authorityFile != "" {
+		pem, err := ioutil.ReadFile(f.authorityFile)
+		if err != nil {
+			return false, err
+		}
+		authorities = x509.NewCertPool()
+		if !authorities.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("could not load any authority certificates from %s", f.authorityFile)
+		}
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.cert = cert
+	f.authorities = authorities
+	f.modTimes = modTimes
+	return true, nil
+}
+
+// Watch reloads the files every interval, until stop is closed.
+func (f *TLSFiles) Watch(interval time.Duration, stop <-chan struct{}, log *logrus.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := f.Reload()
+			if err != nil {
+				log.WithError(err).WithField("certificate", f.certFile).Error("Could not reload TLS certificates, keeping the old ones")
+			} else if reloaded {
+				log.WithField("certificate", f.certFile).Info("Reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+// ServerConfig returns the configuration of a TLS listener that presents
+// the certificate. If authority certificates were given, clients must
+// present a certificate signed by one of them.
+func (f *TLSFiles) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.mtx.RLock()
+			defer f.mtx.RUnlock()
+			conf := &tls.Config{}
+			if f.cert != nil {
+				conf.Certificates = []tls.Certificate{*f.cert}
+			}
+			if f.authorities != nil {
+				conf.ClientCAs = f.authorities
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return conf, nil
+		},
+	}
+}
+
+// ClientConfig returns the configuration of a TLS connection to
+// serverName that presents the certificate (if there is one), and
+// verifies the server with the authority certificates (or the system's,
+// if none were given).
+func (f *TLSFiles) ClientConfig(serverName string) *tls.Config {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	conf := &tls.Config{ServerName: serverName, RootCAs: f.authorities}
+	if f.cert != nil {
+		conf.Certificates = []tls.Certificate{*f.cert}
+	}
+	return conf
+}
+
+// ConfigureTransport makes the transport's HTTPS connections use the
+// latest certificates. If serverName is set, it's used to verify every
+// server instead of the host being connected to.
+func (f *TLSFiles) ConfigureTransport(t *http.Transport, serverName string) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialTLS = func(network, addr string) (net.Conn, error) {
+		name := serverName
+		if name == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			name = host
+		}
+		conn, err := dialer.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, f.ClientConfig(name))
+		conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, &TLSHandshakeError{Err: err}
+		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
+
+// TLSHandshakeError is returned by connections made with a transport
+// configured by TLSFiles, when the TLS handshake fails.
+type TLSHandshakeError struct {
+	Err error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return "TLS handshake failed: " + e.Err.Error()
+}
+
+// IsTLSHandshakeError reports whether err was caused by a failed TLS
+// handshake, as opposed to e.g. failing to connect.
+func IsTLSHandshakeError(err error) bool {
+	var handshakeErr *TLSHandshakeError
+	return errors.As(err, &handshakeErr)
+}
@@ -0,0 +1,169 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert makes a certificate for 127.0.0.1, signed by parent, or
+// a self-signed authority if parent is nil.
+func newTestCert(t *testing.T, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "veneur-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, dir, name string, contents []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, contents, 0600))
+	return path
+}
+
+func TestTLSFilesMutualAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, nil)
+	server := newTestCert(t, ca)
+	client := newTestCert(t, ca)
+
+	serverFiles, err := LoadTLSFiles(
+		writeFile(t, dir, "server.pem", server.certPEM),
+		writeFile(t, dir, "server.key", server.keyPEM),
+		writeFile(t, dir, "ca.pem", ca.certPEM),
+	)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = serverFiles.ServerConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientFiles, err := LoadTLSFiles(
+		writeFile(t, dir, "client.pem", client.certPEM),
+		writeFile(t, dir, "client.key", client.keyPEM),
+		filepath.Join(dir, "ca.pem"),
+	)
+	require.NoError(t, err)
+	transport := &http.Transport{}
+	clientFiles.ConfigureTransport(transport, "")
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	require.NoError(t, err, "a client with a certificate from the authority should be accepted")
+	resp.Body.Close()
+
+	// A client that doesn't trust the server's authority fails the
+	// handshake:
+	other := newTestCert(t, nil)
+	untrusting, err := LoadTLSFiles(
+		filepath.Join(dir, "client.pem"),
+		filepath.Join(dir, "client.key"),
+		writeFile(t, dir, "other-ca.pem", other.certPEM),
+	)
+	require.NoError(t, err)
+	transport = &http.Transport{}
+	untrusting.ConfigureTransport(transport, "")
+	_, err = (&http.Client{Transport: transport}).Get(ts.URL)
+	require.Error(t, err)
+	assert.True(t, IsTLSHandshakeError(err), "%v should be a handshake error", err)
+
+	// A client without a certificate is rejected:
+	anonymous, err := LoadTLSFiles("", "", filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	transport = &http.Transport{}
+	anonymous.ConfigureTransport(transport, "")
+	_, err = (&http.Client{Transport: transport}).Get(ts.URL)
+	assert.Error(t, err, "a client without a certificate should be rejected")
+}
+
+func TestTLSFilesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, nil)
+	first := newTestCert(t, ca)
+	certFile := writeFile(t, dir, "cert.pem", first.certPEM)
+	keyFile := writeFile(t, dir, "cert.key", first.keyPEM)
+	files, err := LoadTLSFiles(certFile, keyFile, "")
+	require.NoError(t, err)
+
+	reloaded, err := files.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "unchanged files shouldn't be loaded again")
+
+	second := newTestCert(t, ca)
+	writeFile(t, dir, "cert.pem", second.certPEM)
+	writeFile(t, dir, "cert.key", second.keyPEM)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+
+	reloaded, err = files.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	conf := files.ClientConfig("127.0.0.1")
+	require.Len(t, conf.Certificates, 1)
+	assert.Equal(t, second.cert.Raw, conf.Certificates[0].Certificate[0], "the new certificate should be used")
+
+	// A broken rotation keeps the old certificate:
+	writeFile(t, dir, "cert.key", []byte("garbage"))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	_, err = files.Reload()
+	assert.Error(t, err)
+	conf = files.ClientConfig("127.0.0.1")
+	assert.Equal(t, second.cert.Raw, conf.Certificates[0].Certificate[0])
+
+	_, err = LoadTLSFiles(certFile, "", "")
+	assert.Error(t, err, "a certificate needs a key")
+}
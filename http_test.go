@@ -12,6 +12,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"testing"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/samplers"
 )
 
@@ -352,10 +354,13 @@ func TestVersion(t *testing.T) {
 	handler := s.Handler()
 	handler.ServeHTTP(w, r)
 
-	bts, err := ioutil.ReadAll(w.Body)
-	assert.NoError(t, err, "error reading /version")
-
-	assert.Equal(t, string(bts), VERSION, "received invalid version")
+	var info versionInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info), "error decoding /version")
+	assert.Equal(t, VERSION, info.Commit, "received invalid version")
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Equal(t, s.interval.String(), info.Interval)
+	assert.Len(t, info.SpanSinks, len(s.spanSinks))
+	assert.False(t, info.StartTime.IsZero())
 }
 
 func testServerImportHelper(t *testing.T, data interface{}) {
@@ -400,3 +405,23 @@ func BenchmarkNewSortableJSONMetrics(b *testing.B) {
 		newSortableJSONMetrics(jsonMetrics, numWorkers)
 	}
 }
+
+func TestPrometheusExpositionEndpoint(t *testing.T) {
+	config := globalConfig()
+	config.PrometheusExpositionEnabled = true
+	s := setupVeneurServer(t, config, nil, nil, nil)
+	defer s.Shutdown()
+
+	err := s.promExposition.Flush(context.Background(), []samplers.InterMetric{{
+		Name:  "a.b.c",
+		Value: 1,
+		Tags:  []string{"foo:bar"},
+		Type:  samplers.GaugeMetric,
+	}})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics-prom", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `a_b_c{foo="bar"} 1`)
+}
@@ -1,6 +1,11 @@
 package importsrv
 
-import "github.com/stripe/veneur/trace"
+import (
+	"crypto/tls"
+
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/trace"
+)
 
 // WithTraceClient sets the trace client for the server.  Otherwise it uses
 // trace.DefaultClient.
@@ -9,3 +14,57 @@ func WithTraceClient(c *trace.Client) Option {
 		opts.traceClient = c
 	}
 }
+
+// WithMaxRecvMsgSize sets the largest message, in bytes, that the server
+// accepts. If it's 0, gRPC's default of 4MB is used.
+func WithMaxRecvMsgSize(size int) Option {
+	return func(opts *options) {
+		opts.maxRecvMsgSize = size
+	}
+}
+
+// WithMaxSendMsgSize sets the largest message, in bytes, that the server
+// sends. If it's 0, gRPC's default is used.
+func WithMaxSendMsgSize(size int) Option {
+	return func(opts *options) {
+		opts.maxSendMsgSize = size
+	}
+}
+
+// WithTLS serves gRPC over TLS with the given configuration. To
+// authenticate clients by their certificates, the configuration must
+// verify them (see forwardrpc.NewServerTLSConfig), and WithAuthenticator
+// must require them.
+func WithTLS(conf *tls.Config) Option {
+	return func(opts *options) {
+		opts.tlsConfig = conf
+	}
+}
+
+// WithAuthenticator checks the credentials of every RPC, rejecting
+// (or, in permissive mode, only counting) the ones without valid
+// credentials.
+func WithAuthenticator(a *forwardrpc.Authenticator) Option {
+	return func(opts *options) {
+		opts.auth = a
+	}
+}
+
+// WithSpanIngester accepts SSF spans with SendSpans, and hands them to
+// the ingester. Otherwise, SendSpans returns Unimplemented.
+func WithSpanIngester(si SpanIngester) Option {
+	return func(opts *options) {
+		opts.spanIngester = si
+	}
+}
+
+// WithMaxSpanBatchSize sets the largest batch of spans that SendSpans
+// accepts; larger ones are rejected with InvalidArgument. If it's 0,
+// the default of 10000 is used.
+func WithMaxSpanBatchSize(size int) Option {
+	return func(opts *options) {
+		if size > 0 {
+			opts.maxSpanBatchSize = size
+		}
+	}
+}
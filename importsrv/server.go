@@ -6,23 +6,39 @@
 package importsrv
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/segmentio/fasthash/fnv1a"
 	"golang.org/x/net/context" // This can be replace with "context" after Go 1.8 support is dropped
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/protocol"
 	"github.com/stripe/veneur/samplers/metricpb"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
 )
 
 const (
 	responseDurationMetric = "import.response_duration_ns"
+	authFailuresMetric     = "import.auth_failures_total"
+
+	spansReceivedMetric = "import.spans_received_total"
+	spansIngestedMetric = "import.spans_ingested_total"
+	spansInvalidMetric  = "import.spans_invalid_total"
+	spansDroppedMetric  = "import.spans_dropped_total"
+
+	defaultMaxSpanBatchSize = 10000
 )
 
 // MetricIngester reads metrics from protobufs
@@ -30,6 +46,13 @@ type MetricIngester interface {
 	IngestMetrics([]*metricpb.Metric)
 }
 
+// SpanIngester receives SSF spans, in the same way as spans read from an
+// SSF listener. IngestSpan may block while the ingester is busy, but must
+// give up and return the context's error once it's done.
+type SpanIngester interface {
+	IngestSpan(context.Context, *ssf.SSFSpan) error
+}
+
 // Server wraps a gRPC server and implements the forwardrpc.Forward service.
 // It reads a list of metrics, and based on the provided key chooses a
 // MetricIngester to send it to.  A unique metric (name, tags, and type)
@@ -41,7 +64,14 @@ type Server struct {
 }
 
 type options struct {
-	traceClient *trace.Client
+	traceClient    *trace.Client
+	maxRecvMsgSize int
+	maxSendMsgSize int
+	tlsConfig      *tls.Config
+	auth           *forwardrpc.Authenticator
+
+	spanIngester     SpanIngester
+	maxSpanBatchSize int
 }
 
 // Option is returned by functions that serve as options to New, like
@@ -52,15 +82,31 @@ type Option func(*options)
 // output to.
 func New(metricOuts []MetricIngester, opts ...Option) *Server {
 	res := &Server{
-		Server:     grpc.NewServer(),
 		metricOuts: metricOuts,
-		opts:       &options{},
+		opts:       &options{maxSpanBatchSize: defaultMaxSpanBatchSize},
 	}
 
 	for _, opt := range opts {
 		opt(res.opts)
 	}
 
+	var serverOpts []grpc.ServerOption
+	if res.opts.maxRecvMsgSize > 0 {
+		serverOpts = append(serverOpts, grpc.MaxRecvMsgSize(res.opts.maxRecvMsgSize))
+	}
+	if res.opts.maxSendMsgSize > 0 {
+		serverOpts = append(serverOpts, grpc.MaxSendMsgSize(res.opts.maxSendMsgSize))
+	}
+	if res.opts.tlsConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(res.opts.tlsConfig)))
+	}
+	if res.opts.auth.Enabled() {
+		auth := *res.opts.auth
+		auth.Report = res.reportAuthFailure
+		serverOpts = append(serverOpts, auth.ServerOptions()...)
+	}
+	res.Server = grpc.NewServer(serverOpts...)
+
 	if res.opts.traceClient == nil {
 		res.opts.traceClient = trace.DefaultClient
 	}
@@ -83,9 +129,18 @@ func (s *Server) Serve(addr string) error {
 	return s.Server.Serve(ln)
 }
 
+// reportAuthFailure counts an RPC that didn't have valid credentials.
+func (s *Server) reportAuthFailure(reason string, allowed bool) {
+	metrics.ReportOne(s.opts.traceClient, ssf.Count(authFailuresMetric, 1, map[string]string{
+		"reason":  reason,
+		"allowed": strconv.FormatBool(allowed),
+	}))
+}
+
 // Static maps of tags used in the SendMetrics handler
 var (
 	grpcTags          = map[string]string{"protocol": "grpc"}
+	grpcStreamTags    = map[string]string{"protocol": "grpc-stream"}
 	responseGroupTags = map[string]string{
 		"protocol": "grpc",
 		"part":     "group",
@@ -103,11 +158,95 @@ func (s *Server) SendMetrics(ctx context.Context, mlist *forwardrpc.MetricList)
 	span.SetTag("protocol", "grpc")
 	defer span.ClientFinish(s.opts.traceClient)
 
+	s.ingest(span, mlist.Metrics, grpcTags)
+	return &empty.Empty{}, nil
+}
+
+// SendMetricsStream receives batches of metrics over a stream, and hands
+// each one to the metric ingesters as soon as it arrives, in the same way
+// as SendMetrics. It returns when the client closes the stream.
+func (s *Server) SendMetricsStream(stream forwardrpc.Forward_SendMetricsStreamServer) error {
+	if err := forwardrpc.AcceptStream(stream); err != nil {
+		return err
+	}
+	for {
+		mlist, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&empty.Empty{})
+		}
+		if err != nil {
+			return err
+		}
+
+		span, _ := trace.StartSpanFromContext(stream.Context(), "veneur.opentracing.importsrv.handle_send_metrics_stream")
+		span.SetTag("protocol", "grpc-stream")
+		s.ingest(span, mlist.Metrics, grpcStreamTags)
+		span.ClientFinish(s.opts.traceClient)
+	}
+}
+
+// SendSpans validates each span in the batch, and hands the valid ones
+// to the SpanIngester. If the RPC's deadline passes while the ingester is
+// busy, the rest of the batch is dropped, and DeadlineExceeded is
+// returned.
+func (s *Server) SendSpans(ctx context.Context, slist *forwardrpc.SpanList) (*empty.Empty, error) {
+	span, _ := trace.StartSpanFromContext(ctx, "veneur.opentracing.importsrv.handle_send_spans")
+	span.SetTag("protocol", "grpc")
+	defer span.ClientFinish(s.opts.traceClient)
+
+	if s.opts.spanIngester == nil {
+		return nil, status.Error(codes.Unimplemented, "this server doesn't ingest spans")
+	}
+	spans := slist.Spans
+	span.Add(ssf.Count(spansReceivedMetric, float32(len(spans)), grpcTags))
+	if s.opts.maxSpanBatchSize > 0 && len(spans) > s.opts.maxSpanBatchSize {
+		span.Add(ssf.Count(spansDroppedMetric, float32(len(spans)), map[string]string{
+			"protocol": "grpc",
+			"reason":   "batch_too_large",
+		}))
+		return nil, status.Errorf(codes.InvalidArgument,
+			"batch of %d spans is larger than the maximum of %d", len(spans), s.opts.maxSpanBatchSize)
+	}
+
+	var ingested, invalid int
+	var err error
+	for _, ssfSpan := range spans {
+		if protocol.ValidateTrace(ssfSpan) != nil {
+			invalid++
+			continue
+		}
+		if err = s.opts.spanIngester.IngestSpan(ctx, ssfSpan); err != nil {
+			break
+		}
+		ingested++
+	}
+	span.Add(
+		ssf.Count(spansIngestedMetric, float32(ingested), grpcTags),
+		ssf.Count(spansInvalidMetric, float32(invalid), grpcTags),
+	)
+	if err != nil {
+		dropped := len(spans) - ingested - invalid
+		span.Add(ssf.Count(spansDroppedMetric, float32(dropped), map[string]string{
+			"protocol": "grpc",
+			"reason":   "deadline",
+		}))
+		code := codes.Canceled
+		if err == context.DeadlineExceeded {
+			code = codes.DeadlineExceeded
+		}
+		return nil, status.Errorf(code, "ingested %d of %d spans before giving up: %v",
+			ingested, len(spans), err)
+	}
+	return &empty.Empty{}, nil
+}
+
+// ingest hashes each metric to a MetricIngester, and sends it there.
+func (s *Server) ingest(span *trace.Span, metrics []*metricpb.Metric, tags map[string]string) {
 	dests := make([][]*metricpb.Metric, len(s.metricOuts))
 
 	// group metrics by their destination
 	groupStart := time.Now()
-	for _, m := range mlist.Metrics {
+	for _, m := range metrics {
 		workerIdx := s.hashMetric(m) % uint32(len(dests))
 		dests[workerIdx] = append(dests[workerIdx], m)
 	}
@@ -125,10 +264,8 @@ func (s *Server) SendMetrics(ctx context.Context, mlist *forwardrpc.MetricList)
 
 	span.Add(
 		ssf.Timing(responseDurationMetric, time.Since(sendStart), time.Nanosecond, responseSendTags),
-		ssf.Count("import.metrics_total", float32(len(mlist.Metrics)), grpcTags),
+		ssf.Count("import.metrics_total", float32(len(metrics)), tags),
 	)
-
-	return &empty.Empty{}, nil
 }
 
 // hashMetric returns a 32-bit hash from the input metric based on its name,
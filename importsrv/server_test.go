@@ -4,14 +4,20 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/forwardrpc"
 	"github.com/stripe/veneur/samplers/metricpb"
 	metrictest "github.com/stripe/veneur/samplers/metricpb/testutils"
+	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type testMetricIngester struct {
@@ -135,3 +141,147 @@ func BenchmarkImportServerSendMetrics(b *testing.B) {
 		})
 	}
 }
+
+func TestSendMetricsStream(t *testing.T) {
+	ingester := &testMetricIngester{}
+	s := New([]MetricIngester{ingester})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Server.Serve(ln)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := forwardrpc.NewForwardClient(conn).SendMetricsStream(context.Background())
+	require.NoError(t, err)
+	md, err := stream.Header()
+	require.NoError(t, err)
+	assert.NotEmpty(t, md[forwardrpc.StreamAcceptedHeader], "The server should accept the stream")
+
+	batches := [][]*metricpb.Metric{
+		{{Name: "test.counter", Type: metricpb.Type_Counter}},
+		{{Name: "test.gauge", Type: metricpb.Type_Gauge}, {Name: "test.set", Type: metricpb.Type_Set}},
+	}
+	for _, batch := range batches {
+		require.NoError(t, stream.Send(&forwardrpc.MetricList{Metrics: batch}))
+	}
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	assert.Len(t, ingester.metrics, 3, "Every batch on the stream should be ingested")
+}
+
+func TestSendMetrics_Auth(t *testing.T) {
+	ingester := &testMetricIngester{}
+	s := New([]MetricIngester{ingester},
+		WithAuthenticator(&forwardrpc.Authenticator{Token: "secret"}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Server.Serve(ln)
+	defer s.Stop()
+
+	send := func(token string) error {
+		conn, err := grpc.Dial(ln.Addr().String(), forwardrpc.ClientDialOptions(nil, token)...)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = forwardrpc.NewForwardClient(conn).SendMetrics(context.Background(),
+			&forwardrpc.MetricList{Metrics: []*metricpb.Metric{{Name: "test.counter", Type: metricpb.Type_Counter}}})
+		return err
+	}
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(send("")), "Metrics without a token should be rejected")
+	assert.Equal(t, codes.PermissionDenied, status.Code(send("wrong")), "Metrics with the wrong token should be rejected")
+	assert.Empty(t, ingester.metrics)
+
+	assert.NoError(t, send("secret"))
+	assert.Len(t, ingester.metrics, 1)
+}
+
+type testSpanIngester struct {
+	spans   []*ssf.SSFSpan
+	blocked bool
+}
+
+func (si *testSpanIngester) IngestSpan(ctx context.Context, span *ssf.SSFSpan) error {
+	if si.blocked {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	si.spans = append(si.spans, span)
+	return nil
+}
+
+func testSpan(id int64) *ssf.SSFSpan {
+	now := time.Now()
+	return &ssf.SSFSpan{
+		Id:             id,
+		TraceId:        id,
+		StartTimestamp: now.Add(-time.Second).UnixNano(),
+		EndTimestamp:   now.UnixNano(),
+		Service:        "test-service",
+		Name:           "test-span",
+	}
+}
+
+func TestSendSpans(t *testing.T) {
+	ingester := &testSpanIngester{}
+	s := New(nil, WithSpanIngester(ingester))
+
+	_, err := s.SendSpans(context.Background(), &forwardrpc.SpanList{Spans: []*ssf.SSFSpan{
+		testSpan(1),
+		{Name: "invalid"},
+		testSpan(2),
+	}})
+	require.NoError(t, err)
+	if assert.Len(t, ingester.spans, 2, "Only the valid spans should be ingested") {
+		assert.Equal(t, int64(1), ingester.spans[0].Id)
+		assert.Equal(t, int64(2), ingester.spans[1].Id)
+	}
+}
+
+func TestSendSpans_Unimplemented(t *testing.T) {
+	s := New(nil)
+	_, err := s.SendSpans(context.Background(), &forwardrpc.SpanList{Spans: []*ssf.SSFSpan{testSpan(1)}})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestSendSpans_MaxBatchSize(t *testing.T) {
+	ingester := &testSpanIngester{}
+	s := New(nil, WithSpanIngester(ingester), WithMaxSpanBatchSize(2))
+
+	_, err := s.SendSpans(context.Background(), &forwardrpc.SpanList{Spans: []*ssf.SSFSpan{
+		testSpan(1), testSpan(2), testSpan(3),
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, ingester.spans, "No spans from a batch that's too large should be ingested")
+
+	_, err = s.SendSpans(context.Background(), &forwardrpc.SpanList{Spans: []*ssf.SSFSpan{
+		testSpan(1), testSpan(2),
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, ingester.spans, 2)
+}
+
+func TestSendSpans_Deadline(t *testing.T) {
+	ingester := &testSpanIngester{blocked: true}
+	s := New(nil, WithSpanIngester(ingester))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := s.SendSpans(ctx, &forwardrpc.SpanList{Spans: []*ssf.SSFSpan{testSpan(1), testSpan(2)}})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	case <-time.After(time.Second):
+		t.Fatal("SendSpans should give up once the deadline passes")
+	}
+}
@@ -0,0 +1,31 @@
+// Package build describes the veneur binary that's running. Its
+// variables are set at link time, e.g.:
+//
+//	go build -ldflags "-X github.com/stripe/veneur/internal/build.Commit=$(git rev-parse HEAD)"
+package build
+
+import (
+	"runtime"
+	"time"
+)
+
+const unknown = "dirty"
+
+var (
+	// Version is the release veneur was built from, e.g. the output of
+	// git describe.
+	Version = unknown
+	// Commit is the git commit veneur was built from.
+	Commit = unknown
+	// Date is when veneur was built, in seconds since the Unix epoch.
+	Date = unknown
+)
+
+// Started is when the process started, or near enough: when this
+// package was initialized.
+var Started = time.Now()
+
+// GoVersion is the version of Go that veneur was built with.
+func GoVersion() string {
+	return runtime.Version()
+}
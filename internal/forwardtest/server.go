@@ -1,6 +1,7 @@
 package forwardtest
 
 import (
+	"io"
 	"net"
 	"sync"
 	"testing"
@@ -8,6 +9,8 @@ import (
 	"github.com/golang/protobuf/ptypes/empty"
 	"golang.org/x/net/context" // This can be replace with "context" after Go 1.8 support is dropped
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/stripe/veneur/forwardrpc"
 	"github.com/stripe/veneur/samplers/metricpb"
@@ -71,3 +74,26 @@ func (s *Server) SendMetrics(ctx context.Context, mlist *forwardrpc.MetricList)
 	s.handler(mlist.Metrics)
 	return &empty.Empty{}, nil
 }
+
+// SendSpans isn't supported by the test server.
+func (s *Server) SendSpans(ctx context.Context, slist *forwardrpc.SpanList) (*empty.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "the test server doesn't accept spans")
+}
+
+// SendMetricsStream calls the input SendMetricsHandler for each batch of
+// metrics received on the stream.
+func (s *Server) SendMetricsStream(stream forwardrpc.Forward_SendMetricsStreamServer) error {
+	if err := forwardrpc.AcceptStream(stream); err != nil {
+		return err
+	}
+	for {
+		mlist, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&empty.Empty{})
+		}
+		if err != nil {
+			return err
+		}
+		s.handler(mlist.Metrics)
+	}
+}
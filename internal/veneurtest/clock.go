@@ -0,0 +1,125 @@
+// Package veneurtest has the fakes that veneur's end-to-end tests run a
+// server with: a clock that only moves when the test advances it, and
+// metric and span sinks that record everything they receive.
+//
+// The helpers that make a server out of them live in the veneur
+// package's own tests (see harness_test.go there), as they need to
+// reach into the server.
+package veneurtest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock. Its time only moves when Advance is called,
+// which fires the timers and tickers that are due.
+type Clock struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	timers  []*timer
+	tickers int
+}
+
+type timer struct {
+	at     time.Time
+	period time.Duration // 0 for timers that fire once
+	ch     chan time.Time
+}
+
+// NewClock returns a Clock set to now.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.mtx)
+	return c
+}
+
+// Now returns the clock's time.
+func (c *Clock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the clock's time once it's
+// been advanced by d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &timer{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t.ch
+	}
+	c.timers = append(c.timers, t)
+	return t.ch
+}
+
+// NewTicker returns a channel that ticks each time the clock went
+// through another d, and the function that stops it. Like with a
+// time.Ticker, ticks are dropped if the last one wasn't received.
+func (c *Clock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &timer{at: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.tickers++
+	c.cond.Broadcast()
+	return t.ch, func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		for i, other := range c.timers {
+			if other == t {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				c.tickers--
+				return
+			}
+		}
+	}
+}
+
+// WaitForTickers waits until n tickers are running, so that a test
+// can advance the clock once the code it tests is ready for it.
+func (c *Clock) WaitForTickers(n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for c.tickers < n {
+		c.cond.Wait()
+	}
+}
+
+// Advance moves the clock forward by d, and fires the timers and
+// tickers that are due, in order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	end := c.now.Add(d)
+	for {
+		var next *timer
+		for _, t := range c.timers {
+			if !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.at
+		select {
+		case next.ch <- c.now:
+		default:
+		}
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+			continue
+		}
+		for i, t := range c.timers {
+			if t == next {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				break
+			}
+		}
+	}
+	c.now = end
+}
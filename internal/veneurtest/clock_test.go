@@ -0,0 +1,35 @@
+package veneurtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	c := NewClock(start)
+	ticks, stop := c.NewTicker(10 * time.Second)
+	after := c.After(15 * time.Second)
+	c.WaitForTickers(1)
+
+	c.Advance(9 * time.Second)
+	assert.Len(t, ticks, 0)
+	c.Advance(time.Second)
+	require.Len(t, ticks, 1)
+	assert.Equal(t, start.Add(10*time.Second), <-ticks)
+	assert.Len(t, after, 0)
+
+	// Ticks that aren't received are dropped, like a time.Ticker's:
+	c.Advance(20 * time.Second)
+	assert.Equal(t, start.Add(15*time.Second), <-after)
+	require.Len(t, ticks, 1)
+	assert.Equal(t, start.Add(20*time.Second), <-ticks)
+	assert.Equal(t, start.Add(30*time.Second), c.Now())
+
+	stop()
+	c.Advance(time.Minute)
+	assert.Len(t, ticks, 0)
+}
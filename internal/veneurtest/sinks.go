@@ -0,0 +1,186 @@
+package veneurtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// Now is where the fake sinks get the time they record from, like a
+// Clock.
+type Now interface {
+	Now() time.Time
+}
+
+// MetricFlush is one flush of a MetricSink.
+type MetricFlush struct {
+	Time    time.Time
+	Metrics []samplers.InterMetric
+}
+
+// MetricSink is a metric sink that records the metrics and other
+// samples that it's flushed. It's safe for use by concurrent
+// goroutines.
+type MetricSink struct {
+	name  string
+	clock Now
+
+	mtx          sync.Mutex
+	flushes      []MetricFlush
+	otherSamples []ssf.SSFSample
+}
+
+// NewMetricSink returns a MetricSink with the name, which records the
+// time of its flushes from clock.
+func NewMetricSink(name string, clock Now) *MetricSink {
+	return &MetricSink{name: name, clock: clock}
+}
+
+// Name returns the sink's name.
+func (s *MetricSink) Name() string {
+	return s.name
+}
+
+// Start does nothing.
+func (s *MetricSink) Start(*trace.Client) error {
+	return nil
+}
+
+// Flush records the metrics.
+func (s *MetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.flushes = append(s.flushes, MetricFlush{Time: s.clock.Now(), Metrics: metrics})
+	return nil
+}
+
+// FlushOtherSamples records the samples.
+func (s *MetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.otherSamples = append(s.otherSamples, samples...)
+}
+
+// Flushes returns the sink's flushes so far, oldest first.
+func (s *MetricSink) Flushes() []MetricFlush {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]MetricFlush(nil), s.flushes...)
+}
+
+// Metrics returns all the metrics that the sink was flushed.
+func (s *MetricSink) Metrics() []samplers.InterMetric {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var metrics []samplers.InterMetric
+	for _, flush := range s.flushes {
+		metrics = append(metrics, flush.Metrics...)
+	}
+	return metrics
+}
+
+// Metric returns the last metric with the name that the sink was
+// flushed, and whether there was one.
+func (s *MetricSink) Metric(name string) (samplers.InterMetric, bool) {
+	metrics := s.Metrics()
+	for i := len(metrics) - 1; i >= 0; i-- {
+		if metrics[i].Name == name {
+			return metrics[i], true
+		}
+	}
+	return samplers.InterMetric{}, false
+}
+
+// OtherSamples returns the events and service checks that the sink
+// was flushed.
+func (s *MetricSink) OtherSamples() []ssf.SSFSample {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]ssf.SSFSample(nil), s.otherSamples...)
+}
+
+// IngestedSpan is a span that a SpanSink ingested, and when.
+type IngestedSpan struct {
+	Time time.Time
+	Span *ssf.SSFSpan
+}
+
+// SpanSink is a span sink that records the spans it ingests, and when
+// it's flushed. It's safe for use by concurrent goroutines.
+type SpanSink struct {
+	name  string
+	clock Now
+
+	mtx     sync.Mutex
+	spans   []IngestedSpan
+	flushes []time.Time
+}
+
+// NewSpanSink returns a SpanSink with the name, which records the time
+// that it ingests spans and is flushed from clock.
+func NewSpanSink(name string, clock Now) *SpanSink {
+	return &SpanSink{name: name, clock: clock}
+}
+
+// Name returns the sink's name.
+func (s *SpanSink) Name() string {
+	return s.name
+}
+
+// Start does nothing.
+func (s *SpanSink) Start(*trace.Client) error {
+	return nil
+}
+
+// Ingest records the span.
+func (s *SpanSink) Ingest(span *ssf.SSFSpan) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.spans = append(s.spans, IngestedSpan{Time: s.clock.Now(), Span: span})
+	return nil
+}
+
+// Flush records the time of the flush.
+func (s *SpanSink) Flush() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.flushes = append(s.flushes, s.clock.Now())
+}
+
+// Spans returns the spans that the sink ingested, in order.
+func (s *SpanSink) Spans() []IngestedSpan {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]IngestedSpan(nil), s.spans...)
+}
+
+// WaitForSpans waits until the sink ingested at least n spans, and
+// returns false if ctx is done first.
+func (s *SpanSink) WaitForSpans(ctx context.Context, n int) bool {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mtx.Lock()
+		ingested := len(s.spans)
+		s.mtx.Unlock()
+		if ingested >= n {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Flushes returns the times that the sink was flushed.
+func (s *SpanSink) Flushes() []time.Time {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]time.Time(nil), s.flushes...)
+}
@@ -0,0 +1,79 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// internalMetricsBoth is the internal_metrics_sink that sends veneur's
+// own metrics to every metric sink, like the metrics it ingests.
+const internalMetricsBoth = "both"
+
+// internalMetricsRouteTag is the tag that routes a metric to one sink
+// only; see samplers.RouteInformation.
+const internalMetricsRouteTag = "veneursinkonly"
+
+// internalSpanBackend sends the spans of veneur's internal trace client
+// to the server's span channel, and marks the metrics on them so that
+// only one metric sink receives them.
+type internalSpanBackend struct {
+	spans chan<- *ssf.SSFSpan
+	sink  string
+}
+
+var _ trace.ClientBackend = &internalSpanBackend{}
+
+// newInternalTraceClient returns the client that veneur reports its
+// own spans and metrics to, sending them into spans. Unless sink is
+// empty or "both", the metrics reported to it only go to the metric
+// sink with that name.
+func newInternalTraceClient(spans chan<- *ssf.SSFSpan, sink string, capacity int, opts ...trace.ClientParam) (*trace.Client, error) {
+	if sink == "" || sink == internalMetricsBoth {
+		return trace.NewChannelClient(spans, opts...)
+	}
+	opts = append(opts, trace.Capacity(uint(capacity)))
+	return trace.NewBackendClient(&internalSpanBackend{spans: spans, sink: sink}, opts...)
+}
+
+// Close is a no-op.
+func (b *internalSpanBackend) Close() error {
+	return nil
+}
+
+// SendSync marks the metrics on the span with the routing tag, and
+// sends it to the span channel. The metrics' tags are copied first, as
+// their maps are often shared between samples.
+func (b *internalSpanBackend) SendSync(ctx context.Context, span *ssf.SSFSpan) error {
+	for _, sample := range span.Metrics {
+		tags := make(map[string]string, len(sample.Tags)+1)
+		for k, v := range sample.Tags {
+			tags[k] = v
+		}
+		tags[internalMetricsRouteTag] = b.sink
+		sample.Tags = tags
+	}
+	select {
+	case b.spans <- span:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkInternalMetricsSink returns an error if the internal_metrics_sink
+// doesn't name one of the metric sinks.
+func checkInternalMetricsSink(name string, metricSinks []sinks.MetricSink) error {
+	if name == "" || name == internalMetricsBoth {
+		return nil
+	}
+	for _, sink := range metricSinks {
+		if sink.Name() == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("internal_metrics_sink %q isn't a configured metric sink", name)
+}
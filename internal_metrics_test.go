@@ -0,0 +1,60 @@
+package veneur
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+func TestInternalTraceClientRoutesMetrics(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 10)
+	cl, err := newInternalTraceClient(spans, "datadog", 10)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	tags := map[string]string{"sink": "kafka"}
+	require.NoError(t, metrics.ReportBatch(cl, []*ssf.SSFSample{
+		ssf.Count("flushes", 1, tags),
+		ssf.Gauge("queued", 2, tags),
+	}))
+	var span *ssf.SSFSpan
+	select {
+	case span = <-spans:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the span")
+	}
+	assert.Equal(t, map[string]string{"sink": "kafka"}, tags, "shared tags shouldn't change")
+
+	udpMetrics, err := samplers.ConvertMetrics(span)
+	require.NoError(t, err)
+	require.Len(t, udpMetrics, 2)
+	for _, m := range udpMetrics {
+		assert.ElementsMatch(t, []string{"sink:kafka", "veneursinkonly:datadog"}, m.Tags)
+	}
+}
+
+func TestInternalTraceClientBoth(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 10)
+	cl, err := newInternalTraceClient(spans, internalMetricsBoth, 10)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	require.NoError(t, metrics.ReportOne(cl, ssf.Count("flushes", 1, nil)))
+	span := <-spans
+	assert.Empty(t, span.Metrics[0].Tags)
+}
+
+func TestCheckInternalMetricsSink(t *testing.T) {
+	cms, _ := NewChannelMetricSink(make(chan []samplers.InterMetric))
+	metricSinks := []sinks.MetricSink{cms}
+	assert.NoError(t, checkInternalMetricsSink("", metricSinks))
+	assert.NoError(t, checkInternalMetricsSink(internalMetricsBoth, metricSinks))
+	assert.NoError(t, checkInternalMetricsSink(cms.Name(), metricSinks))
+	assert.Error(t, checkInternalMetricsSink("datadog", metricSinks))
+}
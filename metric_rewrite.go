@@ -0,0 +1,147 @@
+package veneur
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// MetricRewriteRule is one of the metric_rewrite_rules, which rename
+// the metrics that a flush sends to the metric sinks. A rule matches
+// metric names either by Prefix, which Replacement replaces, or by
+// Pattern, a regular expression that Replacement is a template for
+// (with $1 or ${name} for its submatches). AddTags are added to the
+// metrics that the rule renames.
+//
+// A DryRun rule only counts the metrics that it matches. Rules are
+// counted by Name, or their index if it's empty.
+type MetricRewriteRule struct {
+	AddTags     []string `yaml:"add_tags"`
+	DryRun      bool     `yaml:"dry_run"`
+	Name        string   `yaml:"name"`
+	Pattern     string   `yaml:"pattern"`
+	Prefix      string   `yaml:"prefix"`
+	Replacement string   `yaml:"replacement"`
+}
+
+// rewriteRule is a compiled MetricRewriteRule.
+type rewriteRule struct {
+	MetricRewriteRule
+	name    string
+	pattern *regexp.Regexp
+}
+
+// rewrite returns the name that the rule renames name to, and whether
+// it matches name at all.
+func (r *rewriteRule) rewrite(name string) (string, bool) {
+	if r.pattern == nil {
+		if !strings.HasPrefix(name, r.Prefix) {
+			return name, false
+		}
+		return r.Replacement + strings.TrimPrefix(name, r.Prefix), true
+	}
+	if !r.pattern.MatchString(name) {
+		return name, false
+	}
+	return r.pattern.ReplaceAllString(name, r.Replacement), true
+}
+
+// metricRewriter applies rewrite rules to the metrics of a flush.
+type metricRewriter struct {
+	rules []*rewriteRule
+}
+
+// newMetricRewriter compiles the rules. It returns nil if there
+// aren't any.
+func newMetricRewriter(rules []MetricRewriteRule) (*metricRewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	mr := &metricRewriter{}
+	for i, rule := range rules {
+		r := &rewriteRule{MetricRewriteRule: rule, name: rule.Name}
+		if r.name == "" {
+			r.name = strconv.Itoa(i)
+		}
+		switch {
+		case rule.Prefix == "" && rule.Pattern == "":
+			return nil, fmt.Errorf("metric rewrite rule %s has neither a prefix nor a pattern", r.name)
+		case rule.Prefix != "" && rule.Pattern != "":
+			return nil, fmt.Errorf("metric rewrite rule %s has both a prefix and a pattern", r.name)
+		case rule.Pattern != "":
+			var err error
+			if r.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return nil, fmt.Errorf("metric rewrite rule %s pattern: %v", r.name, err)
+			}
+		}
+		for _, tag := range rule.AddTags {
+			if tag == "" {
+				return nil, fmt.Errorf("metric rewrite rule %s adds an empty tag", r.name)
+			}
+		}
+		mr.rules = append(mr.rules, r)
+	}
+	return mr, nil
+}
+
+// rewrite renames the metrics in place, with the first rule (that
+// isn't a dry run) that matches each of them. Dry run rules count the
+// metrics that they match, whether or not another rule renames them.
+// It returns the number of metrics that each rule matched, as
+// samples.
+func (mr *metricRewriter) rewrite(metrics []samplers.InterMetric) []*ssf.SSFSample {
+	counts := make([]int, len(mr.rules))
+	for i := range metrics {
+		m := &metrics[i]
+		for j, r := range mr.rules {
+			name, ok := r.rewrite(m.Name)
+			if !ok {
+				continue
+			}
+			counts[j]++
+			if r.DryRun {
+				continue
+			}
+			m.Name = name
+			if len(r.AddTags) > 0 {
+				// The tags may be shared with the metric's
+				// sampler, so they are copied:
+				tags := make([]string, 0, len(m.Tags)+len(r.AddTags))
+				m.Tags = append(append(tags, m.Tags...), r.AddTags...)
+			}
+			break
+		}
+	}
+
+	var samples []*ssf.SSFSample
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+		samples = append(samples, ssf.Count("flush.metric_rewrites_total", float32(n), map[string]string{
+			"rule":    mr.rules[i].name,
+			"dry_run": strconv.FormatBool(mr.rules[i].DryRun),
+		}))
+	}
+	return samples
+}
+
+// metricRewriterValue holds a metric rewriter that's replaced, while
+// it's in use, when the config is reloaded.
+type metricRewriterValue struct {
+	v atomic.Value // *metricRewriter
+}
+
+func (mv *metricRewriterValue) load() *metricRewriter {
+	mr, _ := mv.v.Load().(*metricRewriter)
+	return mr
+}
+
+func (mv *metricRewriterValue) store(mr *metricRewriter) {
+	mv.v.Store(mr)
+}
@@ -0,0 +1,74 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestMetricRewriter(t *testing.T) {
+	mr, err := newMetricRewriter([]MetricRewriteRule{
+		{Name: "legacy", Prefix: "legacyapp.", Replacement: "app.", AddTags: []string{"legacy:true"}},
+		{Name: "latency", Pattern: `^(.*)\.latency_ms$`, Replacement: "${1}.duration_ms", DryRun: true},
+		{Pattern: `^db\.(\w+)\.latency_ms$`, Replacement: "db.duration_ms"},
+	})
+	require.NoError(t, err)
+
+	tags := []string{"a:b", "c:d"}
+	metrics := []samplers.InterMetric{
+		{Name: "legacyapp.requests", Tags: tags[:1]},
+		{Name: "api.latency_ms"},
+		{Name: "db.users.latency_ms"},
+		{Name: "app.requests"},
+	}
+	samples := mr.rewrite(metrics)
+
+	assert.Equal(t, "app.requests", metrics[0].Name)
+	assert.Equal(t, []string{"a:b", "legacy:true"}, metrics[0].Tags)
+	assert.Equal(t, "c:d", tags[1], "the metric's tags are copied")
+	assert.Equal(t, "api.latency_ms", metrics[1].Name, "dry run rules don't rename")
+	assert.Equal(t, "db.duration_ms", metrics[2].Name)
+	assert.Equal(t, "app.requests", metrics[3].Name)
+
+	counts := map[string]float32{}
+	for _, sample := range samples {
+		assert.Equal(t, "flush.metric_rewrites_total", sample.Name)
+		counts[sample.Tags["rule"]+"/"+sample.Tags["dry_run"]] = sample.Value
+	}
+	assert.Equal(t, map[string]float32{"legacy/false": 1, "latency/true": 2, "2/false": 1}, counts)
+
+	for _, rules := range [][]MetricRewriteRule{
+		{{Replacement: "app."}},
+		{{Prefix: "a.", Pattern: "^a", Replacement: "b"}},
+		{{Pattern: "(", Replacement: "b"}},
+		{{Prefix: "a.", AddTags: []string{""}}},
+	} {
+		_, err := newMetricRewriter(rules)
+		assert.Error(t, err, "rules %v", rules)
+	}
+	mr, err = newMetricRewriter(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, mr)
+}
+
+func TestFlushRewritesMetrics(t *testing.T) {
+	config := globalConfig()
+	config.MetricRewriteRules = []MetricRewriteRule{
+		{Prefix: "legacyapp.", Replacement: "app.", AddTags: []string{"legacy:true"}},
+	}
+	h := newHarness(t, config)
+	defer h.Close()
+
+	h.SendStatsd("legacyapp.requests:1|c|#veneursinkonly:fake", "other.requests:1|c")
+	h.Flush()
+
+	m, ok := h.Metrics.Metric("app.requests")
+	require.True(t, ok, "the metric is renamed")
+	assert.Equal(t, []string{"legacy:true"}, m.Tags)
+	_, ok = h.Metrics.Metric("other.requests")
+	assert.True(t, ok)
+	_, ok = h.Metrics.Metric("legacyapp.requests")
+	assert.False(t, ok)
+}
@@ -0,0 +1,91 @@
+package veneur
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+)
+
+// notAllowed is the pattern index of names that are filtered for not
+// matching any of the allow patterns.
+const notAllowed = -1
+
+// nameFilter drops metrics or spans by name: those that match any of
+// its deny patterns, or, if it has allow patterns, that don't match any
+// of those.
+type nameFilter struct {
+	deny  []*regexp.Regexp
+	allow []*regexp.Regexp
+}
+
+// newNameFilter compiles the patterns, which are described by kind in
+// errors. It returns nil if there aren't any.
+func newNameFilter(kind string, deny, allow []string) (*nameFilter, error) {
+	if len(deny) == 0 && len(allow) == 0 {
+		return nil, nil
+	}
+	f := &nameFilter{}
+	for i, pattern := range deny {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s deny pattern %d: %v", kind, i, err)
+		}
+		f.deny = append(f.deny, re)
+	}
+	for i, pattern := range allow {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s allow pattern %d: %v", kind, i, err)
+		}
+		f.allow = append(f.allow, re)
+	}
+	return f, nil
+}
+
+// filtered reports whether the name should be dropped, and if so, the
+// index of the deny pattern it matched, or notAllowed.
+func (f *nameFilter) filtered(name string) (int, bool) {
+	for i, re := range f.deny {
+		if re.MatchString(name) {
+			return i, true
+		}
+	}
+	if len(f.allow) == 0 {
+		return 0, false
+	}
+	for _, re := range f.allow {
+		if re.MatchString(name) {
+			return 0, false
+		}
+	}
+	return notAllowed, true
+}
+
+// patternTag is the tag that names filtered by the pattern at index are
+// counted with.
+func patternTag(index int) string {
+	if index == notAllowed {
+		return "pattern_index:not_allowed"
+	}
+	return "pattern_index:" + strconv.Itoa(index)
+}
+
+// nameFilterValue holds a name filter that's replaced, while it's in
+// use, when the config is reloaded. A nil *nameFilterValue holds no
+// filter.
+type nameFilterValue struct {
+	v atomic.Value // *nameFilter
+}
+
+func (fv *nameFilterValue) load() *nameFilter {
+	if fv == nil {
+		return nil
+	}
+	f, _ := fv.v.Load().(*nameFilter)
+	return f
+}
+
+func (fv *nameFilterValue) store(f *nameFilter) {
+	fv.v.Store(f)
+}
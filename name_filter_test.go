@@ -0,0 +1,76 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestNameFilter(t *testing.T) {
+	f, err := newNameFilter("metric name", []string{`^requests\.[0-9a-f]{8}`, `\.debug$`}, nil)
+	require.NoError(t, err)
+	pattern, ok := f.filtered("requests.deadbeef.count")
+	assert.True(t, ok)
+	assert.Equal(t, 0, pattern)
+	pattern, ok = f.filtered("app.debug")
+	assert.True(t, ok)
+	assert.Equal(t, 1, pattern)
+	_, ok = f.filtered("requests.count")
+	assert.False(t, ok)
+
+	f, err = newNameFilter("metric name", []string{`\.debug$`}, []string{`^app\.`})
+	require.NoError(t, err)
+	_, ok = f.filtered("app.requests")
+	assert.False(t, ok)
+	pattern, ok = f.filtered("other.requests")
+	assert.True(t, ok)
+	assert.Equal(t, notAllowed, pattern)
+	pattern, ok = f.filtered("app.debug")
+	assert.True(t, ok, "deny patterns should win over allow patterns")
+	assert.Equal(t, 0, pattern)
+
+	f, err = newNameFilter("metric name", nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	_, err = newNameFilter("metric name", []string{"("}, nil)
+	assert.Error(t, err)
+}
+
+func TestWorkerNameFilter(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	f, err := newNameFilter("metric name", []string{`^requests\.[0-9a-f]{8}`}, nil)
+	require.NoError(t, err)
+	w.nameFilter = &nameFilterValue{}
+	w.nameFilter.store(f)
+
+	for _, packet := range []string{"requests.deadbeef:1|c", "requests.cafebabe:1|c", "requests:1|c"} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		w.ProcessMetric(m)
+	}
+	assert.Equal(t, map[int]int64{0: 2}, w.filtered)
+	wm := w.Flush()
+	require.Len(t, wm.counters, 1)
+	for key := range wm.counters {
+		assert.Equal(t, "requests", key.Name)
+	}
+	assert.Empty(t, w.filtered)
+}
+
+func TestServerSpanNameFilter(t *testing.T) {
+	config := localConfig()
+	config.SpanNameDenyPatterns = []string{`^debug\.`}
+	f := newFixture(t, config, nil, nil)
+	defer f.Close()
+
+	f.server.SpanChan = make(chan *ssf.SSFSpan, 2)
+	f.server.handleSSF(&ssf.SSFSpan{Id: 1, TraceId: 1, Name: "debug.span", Service: "foo"}, "packet")
+	f.server.handleSSF(&ssf.SSFSpan{Id: 2, TraceId: 2, Name: "request", Service: "foo"}, "packet")
+	require.Len(t, f.server.SpanChan, 1)
+	assert.Equal(t, "request", (<-f.server.SpanChan).Name)
+}
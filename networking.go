@@ -2,12 +2,20 @@ package veneur
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
 	flock "github.com/theckman/go-flock"
 )
 
@@ -27,67 +35,82 @@ func StartStatsd(s *Server, a net.Addr, packetPool *sync.Pool) net.Addr {
 }
 
 // udpProcessor is a function that reads packets from a socket, using
-// the pool provided.
-type udpProcessor func(net.PacketConn, *sync.Pool)
-
-// startProcessingOnUDP starts network num_readers listeners on the
-// given address in one goroutine each, using the passed pool. When
-// the listener is established, it starts the udpProcessor with the
-// listener.
-func startProcessingOnUDP(s *Server, protocol string, addr *net.UDPAddr, pool *sync.Pool, proc udpProcessor) net.Addr {
-	reusePort := s.numReaders != 1
-	// If we're reusing the port, make sure we're listening on the
-	// exact same address always; this is mostly relevant for
-	// tests, where port is typically 0 and the initial ListenUDP
-	// call results in a contrete port.
-	if reusePort {
+// the pool provided, and dropping those over the rate limit.
+type udpProcessor func(net.PacketConn, *sync.Pool, *readerRateLimit)
+
+// startProcessingOnUDP starts num_readers listeners on the given
+// address in one goroutine each, using the passed pool. The listeners
+// read from num_udp_sockets sockets, bound with SO_REUSEPORT so that the
+// kernel distributes datagrams across them, or from a single socket if
+// the platform doesn't support it. It starts the udpProcessor with each
+// listener's socket, and its share of the listener's rate limit.
+func startProcessingOnUDP(s *Server, protocol string, addr *net.UDPAddr, pool *sync.Pool, limit rateLimit, proc udpProcessor) net.Addr {
+	readers := s.numReaders
+	if readers < 1 {
+		readers = 1
+	}
+	sockets := s.numSockets
+	if sockets < 1 {
+		sockets = readers
+	}
+	reusePort := sockets != 1
+	if reusePort && !reusePortSupported() {
+		log.WithFields(logrus.Fields{
+			"address": addr,
+			"sockets": sockets,
+		}).Warn("SO_REUSEPORT isn't supported on this platform, reading from one UDP socket")
+		sockets = 1
+		reusePort = false
+	}
+	if readers < sockets {
+		// every socket needs a reader
+		readers = sockets
+	}
+
+	socks := make([]net.PacketConn, sockets)
+	for i := range socks {
 		sock, err := NewSocket(addr, s.RcvbufBytes, reusePort)
 		if err != nil {
+			// this probably indicates a systemic issue, so we
+			// just blow up
 			panic(fmt.Sprintf("couldn't listen on UDP socket %v: %v", addr, err))
 		}
-		defer sock.Close()
-		addr = sock.LocalAddr().(*net.UDPAddr)
+		if i == 0 {
+			// Make sure we're listening on the exact same address
+			// on every socket; this is mostly relevant for tests,
+			// where port is typically 0 and the first socket gets
+			// a concrete port.
+			addr = sock.LocalAddr().(*net.UDPAddr)
+		}
+		socks[i] = sock
+		s.registerUDPSocket(protocol, i, sock)
+		s.packetConnsMtx.Lock()
+		s.packetConns = append(s.packetConns, sock)
+		s.packetConnsMtx.Unlock()
 	}
-	addrChan := make(chan net.Addr, 1)
-	once := sync.Once{}
-	for i := 0; i < s.numReaders; i++ {
+	log.WithFields(logrus.Fields{
+		"address":   addr,
+		"protocol":  protocol,
+		"listeners": readers,
+		"sockets":   sockets,
+	}).Info("Listening on UDP address")
+
+	lrl := s.newListenerRateLimit(protocol, addr.String(), limit)
+	for i := 0; i < readers; i++ {
+		sock := socks[i%sockets]
+		rrl := lrl.reader(readers)
 		go func() {
 			defer func() {
 				ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
 			}()
-			// each goroutine gets its own socket
-			// if the sockets support SO_REUSEPORT, then this will cause the
-			// kernel to distribute datagrams across them, for better read
-			// performance
-			sock, err := NewSocket(addr, s.RcvbufBytes, reusePort)
-			if err != nil {
-				// if any goroutine fails to create the socket, we can't really
-				// recover, so we just blow up
-				// this probably indicates a systemic issue, eg lack of
-				// SO_REUSEPORT support
-				panic(fmt.Sprintf("couldn't listen on UDP socket %v: %v", addr, err))
-			}
-			// Pass the address that we are listening on
-			// back to whoever spawned this goroutine so
-			// it can return that address.
-			once.Do(func() {
-				addrChan <- sock.LocalAddr()
-				log.WithFields(logrus.Fields{
-					"address":   sock.LocalAddr(),
-					"protocol":  protocol,
-					"listeners": s.numReaders,
-				}).Info("Listening on UDP address")
-				close(addrChan)
-			})
-
-			proc(sock, pool)
+			proc(sock, pool, rrl)
 		}()
 	}
-	return <-addrChan
+	return addr
 }
 
 func startStatsdUDP(s *Server, addr *net.UDPAddr, packetPool *sync.Pool) net.Addr {
-	return startProcessingOnUDP(s, "statsd", addr, packetPool, s.ReadMetricSocket)
+	return startProcessingOnUDP(s, "statsd", addr, packetPool, s.statsdRateLimit, s.readMetricSocket)
 }
 
 func startStatsdTCP(s *Server, addr *net.TCPAddr, packetPool *sync.Pool) net.Addr {
@@ -133,6 +156,42 @@ func startStatsdTCP(s *Server, addr *net.TCPAddr, packetPool *sync.Pool) net.Add
 	return listener.Addr()
 }
 
+// newListenerTLSConfig returns the TLS config for listeners with the
+// PEM-encoded key and certificate, or nil if there's no key. If there's
+// an authority certificate, clients must present a certificate that it
+// signed. The settings' names start with prefix, for errors.
+func newListenerTLSConfig(prefix, key, certificate, authority string) (*tls.Config, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if certificate == "" {
+		return nil, fmt.Errorf("%s_key is set; must set %s_certificate", prefix, prefix)
+	}
+
+	// load the TLS key and certificate
+	cert, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuthMode := tls.NoClientCert
+	var clientCAs *x509.CertPool
+	if authority != "" {
+		// load the authority; require clients to present certificated signed by this authority
+		clientAuthMode = tls.RequireAndVerifyClientCert
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM([]byte(authority)) {
+			return nil, fmt.Errorf("%s_authority_certificate: Could not load any certificates", prefix)
+		}
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthMode,
+		ClientCAs:    clientCAs,
+	}, nil
+}
+
 // StartSSF starts listening for SSF on an address a, and returns the
 // concrete address that the server is listening on.
 func StartSSF(s *Server, a net.Addr, tracePool *sync.Pool) net.Addr {
@@ -141,8 +200,10 @@ func StartSSF(s *Server, a net.Addr, tracePool *sync.Pool) net.Addr {
 		a = startSSFUDP(s, addr, tracePool)
 	case *net.UnixAddr:
 		_, a = startSSFUnix(s, addr)
+	case *protocol.TLSTCPAddr:
+		a = startSSFTLS(s, addr)
 	default:
-		panic(fmt.Sprintf("Can't listen for SSF on %v: only udp:// & unix:// are supported", a))
+		panic(fmt.Sprintf("Can't listen for SSF on %v: only udp://, unix:// & tls+tcp:// are supported", a))
 	}
 	log.WithFields(logrus.Fields{
 		"address": a.String(),
@@ -151,8 +212,121 @@ func StartSSF(s *Server, a net.Addr, tracePool *sync.Pool) net.Addr {
 	return a
 }
 
+// newSSFPacketPool returns a pool of buffers for SSF datagrams of at
+// most maxLength bytes. They are one byte longer, so that
+// readSSFPacketSocket can tell the datagrams that didn't fit.
+func newSSFPacketPool(maxLength int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, maxLength+1)
+		},
+	}
+}
+
+// ssfFrameMaxLength returns the maximum length of the frames read from
+// the SSF listener on addr: its ssf_listener_max_length_bytes, or else
+// ssf_max_frame_length_bytes.
+func (s *Server) ssfFrameMaxLength(addr net.Addr) uint32 {
+	if max := s.ssfListenerMaxLengths[addr]; max > 0 && uint32(max) < protocol.MaxSSFPacketLength {
+		return uint32(max)
+	}
+	if s.ssfMaxFrameLength > 0 {
+		return s.ssfMaxFrameLength
+	}
+	return protocol.MaxSSFPacketLength
+}
+
+// startSSFUDP starts reading SSF datagrams on a UDP address, into
+// buffers from tracePool, or of the address's own maximum length.
 func startSSFUDP(s *Server, addr *net.UDPAddr, tracePool *sync.Pool) net.Addr {
-	return startProcessingOnUDP(s, "ssf", addr, tracePool, s.ReadSSFPacketSocket)
+	if max := s.ssfListenerMaxLengths[addr]; max > 0 {
+		tracePool = newSSFPacketPool(max)
+	}
+	return startProcessingOnUDP(s, "ssf", addr, tracePool, s.ssfRateLimit, s.readSSFPacketSocket)
+}
+
+// startSSFTLS starts listening for TLS connections that send framed SSF
+// spans on a TCP address, until the server shuts down. Like on unix://
+// addresses, each connection gets the whole rate limit.
+func startSSFTLS(s *Server, addr *protocol.TLSTCPAddr) net.Addr {
+	if s.ssfTLSConfig == nil {
+		panic(fmt.Sprintf("Can't listen for SSF on %v: ssf_tls_key and ssf_tls_certificate aren't set", addr))
+	}
+	listener, err := net.ListenTCP("tcp", addr.TCPAddr)
+	if err != nil {
+		panic(fmt.Sprintf("couldn't listen on TCP socket %v: %v", addr, err))
+	}
+	go func() {
+		<-s.shutdown
+		if err := listener.Close(); err != nil {
+			log.WithError(err).Warn("Ignoring error closing SSF TLS listener")
+		}
+	}()
+
+	maxLength := s.ssfFrameMaxLength(addr)
+	lrl := s.newListenerRateLimit("ssf", listener.Addr().String(), s.ssfRateLimit)
+	tlsListener := tls.NewListener(listener, s.ssfTLSConfig)
+	go func() {
+		defer func() {
+			ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
+		}()
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				select {
+				case <-s.shutdown:
+					// occurs when cleanly shutting down the server e.g. in tests; ignore errors
+					log.WithError(err).Info("Ignoring Accept error while shutting down")
+					return
+				default:
+					log.WithError(err).Fatal("SSF TLS accept failed")
+				}
+			}
+			go func() {
+				rrl := lrl.reader(1)
+				defer lrl.release(rrl)
+				s.handleSSFTLSConn(conn.(*tls.Conn), maxLength, rrl)
+			}()
+		}
+	}()
+	return &protocol.TLSTCPAddr{TCPAddr: listener.Addr().(*net.TCPAddr)}
+}
+
+// handleSSFTLSConn reads framed SSF from a connection to a tls+tcp://
+// listener, closing it once it's idle for longer than the read timeout.
+func (s *Server) handleSSFTLSConn(conn *tls.Conn, maxLength uint32, limit *readerRateLimit) {
+	atomic.AddInt64(&s.ssfTLSConns, 1)
+	metrics.ReportOne(s.TraceClient, ssf.Count("ssf.tls.connects", 1, nil))
+	defer func() {
+		atomic.AddInt64(&s.ssfTLSConns, -1)
+		metrics.ReportOne(s.TraceClient, ssf.Count("ssf.tls.disconnects", 1, nil))
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(s.ssfReadTimeout))
+	if err := conn.Handshake(); err != nil {
+		// usually io.EOF or "read: connection reset by peer"; it can
+		// also be caused by certificate authentication problems
+		metrics.ReportOne(s.TraceClient, ssf.Count("ssf.tls.handshake_failures", 1, nil))
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"peer":          conn.RemoteAddr(),
+		}).Info("SSF TLS handshake failed")
+		conn.Close()
+		return
+	}
+	s.readSSFStreamSocket(&idleTimeoutConn{Conn: conn, timeout: s.ssfReadTimeout}, maxLength, limit, nil)
+}
+
+// idleTimeoutConn is a connection whose reads time out once it's been
+// idle for longer than timeout.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
 }
 
 // startSSFUnix starts listening for connections that send framed SSF
@@ -164,34 +338,45 @@ func startSSFUnix(s *Server, addr *net.UnixAddr) (<-chan struct{}, net.Addr) {
 	if addr.Network() != "unix" {
 		panic(fmt.Sprintf("Can't listen for SSF on %v: only udp:// and unix:// addresses are supported", addr))
 	}
-	// ensure we are the only ones locking this socket:
-	lockname := fmt.Sprintf("%s.lock", addr.String())
-	lock := flock.NewFlock(lockname)
-	locked, err := lock.TryLock()
-	if err != nil {
-		panic(fmt.Sprintf("Could not acquire the lock %q to listen on %v: %v", lockname, addr, err))
-	}
-	if !locked {
-		panic(fmt.Sprintf("Lock file %q for %v is in use by another process already", lockname, addr))
+	// Sockets in the abstract namespace have no file; binding one
+	// fails if it's in use, and it goes away with the listener.
+	abstract := strings.HasPrefix(addr.Name, "@")
+	unlock := func() {}
+	if !abstract {
+		// ensure we are the only ones locking this socket:
+		lockname := fmt.Sprintf("%s.lock", addr.String())
+		lock := flock.NewFlock(lockname)
+		locked, err := lock.TryLock()
+		if err != nil {
+			panic(fmt.Sprintf("Could not acquire the lock %q to listen on %v: %v", lockname, addr, err))
+		}
+		if !locked {
+			panic(fmt.Sprintf("Lock file %q for %v is in use by another process already", lockname, addr))
+		}
+		unlock = func() { lock.Unlock() }
+		// We have the exclusive use of the socket, clear away any old sockets and listen:
+		_ = os.Remove(addr.String())
 	}
-	// We have the exclusive use of the socket, clear away any old sockets and listen:
-	_ = os.Remove(addr.String())
 	listener, err := net.ListenUnix(addr.Network(), addr)
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't listen on UNIX socket %v: %v", addr, err))
 	}
 
-	// Make the socket connectable by everyone with access to the socket pathname:
-	err = os.Chmod(addr.String(), 0666)
-	if err != nil {
-		panic(fmt.Sprintf("Couldn't set permissions on %v: %v", addr, err))
+	if !abstract {
+		// Make the socket connectable by everyone with access to the socket pathname:
+		err = os.Chmod(addr.String(), 0666)
+		if err != nil {
+			panic(fmt.Sprintf("Couldn't set permissions on %v: %v", addr, err))
+		}
 	}
 
+	maxLength := s.ssfFrameMaxLength(addr)
+	lrl := s.newListenerRateLimit("ssf", listener.Addr().String(), s.ssfRateLimit)
 	go func() {
-		conns := make(chan net.Conn)
+		conns := make(chan *net.UnixConn)
 		go func() {
 			defer func() {
-				lock.Unlock()
+				unlock()
 				close(done)
 			}()
 			for {
@@ -212,7 +397,13 @@ func startSSFUnix(s *Server, addr *net.UnixAddr) (<-chan struct{}, net.Addr) {
 		for {
 			select {
 			case conn := <-conns:
-				go s.ReadSSFStreamSocket(conn)
+				// each connection gets the whole rate limit, so
+				// that one runaway client doesn't starve the others
+				go func() {
+					rrl := lrl.reader(1)
+					defer lrl.release(rrl)
+					s.readSSFStreamSocket(conn, maxLength, rrl, s.ssfPeerTags(conn))
+				}()
 			case <-s.shutdown:
 				listener.Close()
 				return
@@ -221,3 +412,54 @@ func startSSFUnix(s *Server, addr *net.UnixAddr) (<-chan struct{}, net.Addr) {
 	}()
 	return done, listener.Addr()
 }
+
+// peerCredentials identify the process at the other end of a unix
+// socket.
+type peerCredentials struct {
+	uid uint32
+	pid int32
+}
+
+// ssfPeerTags returns the tags that identify the process sending SSF
+// on conn, if ssf_unix_peer_credentials is set: the service that its
+// uid maps to in ssf_unix_peer_services, or else its uid and pid. The
+// credentials are looked up once, when the connection is accepted.
+func (s *Server) ssfPeerTags(conn *net.UnixConn) map[string]string {
+	if !s.ssfPeerCredentials {
+		return nil
+	}
+	cred, err := unixPeerCredentials(conn)
+	if err != nil {
+		log.WithError(err).Warn("Couldn't identify the process sending SSF")
+		return nil
+	}
+	if service, ok := s.ssfPeerServices[cred.uid]; ok {
+		return map[string]string{"peer_service": service}
+	}
+	return map[string]string{
+		"peer_uid": strconv.FormatUint(uint64(cred.uid), 10),
+		"peer_pid": strconv.FormatInt(int64(cred.pid), 10),
+	}
+}
+
+// tagSSFPeer sets the tags that identify the process that sent the
+// span on it and its samples, replacing any that it set itself.
+func tagSSFPeer(span *ssf.SSFSpan, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	if span.Tags == nil {
+		span.Tags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		span.Tags[k] = v
+	}
+	for _, sample := range span.Metrics {
+		if sample.Tags == nil {
+			sample.Tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			sample.Tags[k] = v
+		}
+	}
+}
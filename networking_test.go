@@ -1,19 +1,81 @@
 package veneur
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"io/ioutil"
 	"os"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
 )
 
+func TestUDPSockets(t *testing.T) {
+	srv := &Server{numReaders: 2, numSockets: 4, RcvbufBytes: 2 * 1024 * 1024}
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	socks := make(chan net.PacketConn, 4)
+	proc := func(sock net.PacketConn, _ *sync.Pool, _ *readerRateLimit) {
+		socks <- sock
+	}
+	concrete := startProcessingOnUDP(srv, "statsd", addr, nil, rateLimit{}, proc)
+
+	expected := 4
+	if !reusePortSupported() {
+		expected = 1
+	}
+	seen := map[net.PacketConn]struct{}{}
+	for i := 0; i < 4; i++ {
+		sock := <-socks
+		defer sock.Close()
+		assert.Equal(t, concrete.String(), sock.LocalAddr().String())
+		seen[sock] = struct{}{}
+	}
+	assert.Len(t, seen, expected, "each socket should get a reader")
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	require.Len(t, srv.udpSockets, expected)
+	client, err := net.Dial("udp", concrete.String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("a.b.c:1|c"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	stats, err := readProcNetUDP()
+	require.NoError(t, err)
+	var queued int64
+	for _, sock := range srv.udpSockets {
+		assert.Contains(t, stats, sock.inode)
+		meminfo, ok := socketMeminfo(sock.conn)
+		assert.True(t, ok, "SO_MEMINFO should be supported")
+		queued += meminfo.queued
+	}
+	assert.NotZero(t, queued, "the unread packet should be queued")
+}
+
 func TestMultipleListeners(t *testing.T) {
 	srv := &Server{}
 	srv.shutdown = make(chan struct{})
@@ -92,3 +154,149 @@ func TestConnectUNIX(t *testing.T) {
 	}
 	close(srv.shutdown)
 }
+
+// testTLSPEMs generates a certificate authority, and a server and a
+// client certificate that it signed, as PEM.
+func testTLSPEMs(t *testing.T) (ca, serverCert, serverKey, clientCert, clientKey string) {
+	newKey := func() (*ecdsa.PrivateKey, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		return key, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+	newCert := func(tmpl, parent *x509.Certificate, pub, signer interface{}) (*x509.Certificate, string) {
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return cert, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	notAfter := time.Now().Add(time.Hour)
+
+	caKey, _ := newKey()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "veneur test CA"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caCert, ca := newCert(caTmpl, caTmpl, &caKey.PublicKey, caKey)
+
+	key, serverKey := newKey()
+	_, serverCert = newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, &key.PublicKey, caKey)
+	key, clientKey = newKey()
+	_, clientCert = newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, &key.PublicKey, caKey)
+	return ca, serverCert, serverKey, clientCert, clientKey
+}
+
+func TestSSFTLS(t *testing.T) {
+	ca, serverCert, serverKey, clientCert, clientKey := testTLSPEMs(t)
+	config := localConfig()
+	config.SsfListenAddresses = []string{"tls+tcp://127.0.0.1:0"}
+	_, err := NewFromConfig(logrus.New(), config)
+	assert.Error(t, err, "tls+tcp:// addresses need a key and certificate")
+
+	config.SsfTLSKey = serverKey
+	config.SsfTLSCertificate = serverCert
+	config.SsfTLSAuthorityCertificate = ca
+	config.SsfMaxFrameLengthBytes = 1024
+	srv, err := NewFromConfig(logrus.New(), config)
+	require.NoError(t, err)
+	trace.NeutralizeClient(srv.TraceClient)
+	srv.TraceClient = nil
+	defer close(srv.shutdown)
+	addr := StartSSF(srv, srv.SSFListenAddrs[0], nil)
+	assert.Equal(t, "tls+tcp", addr.Network())
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM([]byte(ca)))
+	cert, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+	require.NoError(t, err)
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", addr.String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{cert},
+		})
+		require.NoError(t, err)
+		return conn
+	}
+
+	conn := dial()
+	defer conn.Close()
+	_, err = protocol.WriteSSF(conn, &ssf.SSFSpan{
+		Id: 1, TraceId: 1, StartTimestamp: 1, EndTimestamp: 2, Name: "tls.span",
+	})
+	require.NoError(t, err)
+	select {
+	case span := <-srv.SpanChan:
+		assert.Equal(t, "tls.span", span.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the span")
+	}
+
+	// a frame over the maximum length closes the connection:
+	conn = dial()
+	defer conn.Close()
+	_, err = protocol.WriteSSF(conn, &ssf.SSFSpan{
+		Id: 1, TraceId: 1, StartTimestamp: 1, EndTimestamp: 2, Name: strings.Repeat("x", 2048),
+	})
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSSFBatches(t *testing.T) {
+	s := &Server{SpanChan: make(chan *ssf.SSFSpan, 10), ssfMaxBatchSpans: 2}
+	batch := &protocol.Batch{}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, batch.Add(&ssf.SSFSpan{Id: int64(i + 1), TraceId: 1, Name: "batched"}))
+	}
+
+	s.HandleTracePacket(batch.Datagram())
+	require.Len(t, s.SpanChan, 2)
+	<-s.SpanChan
+	<-s.SpanChan
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.readSSFStreamSocket(server, s.ssfFrameMaxLength(nil), nil, nil)
+		close(done)
+	}()
+	_, err := batch.WriteFrame(client)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		span := <-s.SpanChan
+		assert.Equal(t, "batched", span.Name)
+	}
+
+	// Batches with too many spans are dropped, without closing the
+	// connection:
+	require.NoError(t, batch.Add(&ssf.SSFSpan{Id: 3, TraceId: 1, Name: "batched"}))
+	s.HandleTracePacket(batch.Datagram())
+	_, err = batch.WriteFrame(client)
+	require.NoError(t, err)
+	_, err = protocol.WriteSSF(client, &ssf.SSFSpan{Id: 4, TraceId: 1, Name: "single"})
+	require.NoError(t, err)
+	span := <-s.SpanChan
+	assert.Equal(t, "single", span.Name)
+
+	client.Close()
+	<-done
+	assert.Empty(t, s.SpanChan)
+}
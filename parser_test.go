@@ -55,6 +55,12 @@ func TestValidTrace(t *testing.T) {
 	trace.StartTimestamp = 1
 	trace.EndTimestamp = 5
 	assert.True(t, protocol.ValidTrace(trace))
+
+	// 128-bit trace IDs may have low bits of 0:
+	trace.TraceId = 0
+	assert.False(t, protocol.ValidTrace(trace))
+	trace.TraceIdHigh = 1
+	assert.True(t, protocol.ValidTrace(trace))
 }
 
 func TestParseSSFUnmarshal(t *testing.T) {
@@ -160,6 +166,7 @@ func TestParseSSFValid(t *testing.T) {
 			assert.Equal(t, float64(metric.Value), m.Value, "Value")
 			assert.Equal(t, "counter", m.Type, "Type")
 			assert.NotContains(t, m.Tags, "foo", "Metric should not inherit tags from its parent span")
+			assert.Equal(t, int64(1), m.TraceID, "Metric should carry its span's trace ID")
 		}
 	}
 }
@@ -196,6 +203,7 @@ func TestParseSSFIndicatorSpan(t *testing.T) {
 		assert.Equal(t, "timer_name", m.Name)
 		assert.Equal(t, "histogram", m.Type)
 		assert.InEpsilon(t, float32(duration/time.Nanosecond), m.Value, 0.001)
+		assert.Equal(t, int64(5), m.TraceID)
 		if assert.Equal(t, 2, len(m.Tags)) {
 			var tags sort.StringSlice = m.Tags
 			sort.Sort(tags)
@@ -507,6 +515,99 @@ func TestParserWithSampleRateAndTags(t *testing.T) {
 	assert.Contains(t, valueError.Error(), "Invalid number", "Invalid number error missing")
 }
 
+func TestParserWithTimestamp(t *testing.T) {
+	m, err := samplers.ParseMetric([]byte("a.b.c:1|c|@0.5|#foo:bar|T1656581400"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1656581400), m.Timestamp, "Timestamp")
+	assert.Equal(t, float32(0.5), m.SampleRate, "Sample Rate")
+	assert.Equal(t, []string{"foo:bar"}, m.Tags, "Tags")
+
+	untimed, err := samplers.ParseMetric([]byte("a.b.c:1|c|@0.5|#foo:bar"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), untimed.Timestamp)
+	assert.Equal(t, untimed.Digest, m.Digest, "the timestamp shouldn't change which metric it is")
+}
+
+func TestParserWithContainerID(t *testing.T) {
+	untagged, err := samplers.ParseMetric([]byte("a.b.c:1|c|@0.5|#foo:bar"))
+	require.NoError(t, err)
+
+	for _, packet := range []string{
+		"a.b.c:1|c|@0.5|#foo:bar|c:abc123",
+		"a.b.c:1|c|c:abc123|@0.5|#foo:bar",
+		"a.b.c:1|c|#foo:bar|c:abc123|@0.5",
+	} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err, packet)
+		assert.Equal(t, float32(0.5), m.SampleRate, packet)
+		assert.Equal(t, untagged.Tags, m.Tags, "%s: the container ID should be discarded", packet)
+		assert.Equal(t, untagged.Digest, m.Digest, packet)
+
+		tagged, err := samplers.ParseMetrics([]byte(packet), "container_id")
+		require.NoError(t, err, packet)
+		require.Len(t, tagged, 1, packet)
+		assert.Equal(t, float32(0.5), tagged[0].SampleRate, packet)
+		assert.Equal(t, []string{"container_id:abc123", "foo:bar"}, tagged[0].Tags, packet)
+		assert.Equal(t, "container_id:abc123,foo:bar", tagged[0].JoinedTags, packet)
+		assert.NotEqual(t, untagged.Digest, tagged[0].Digest, packet)
+	}
+
+	tagged, err := samplers.ParseMetrics([]byte("a.b.c:1|g|c:abc123"), "container_id")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"container_id:abc123"}, tagged[0].Tags, "the tag should be added without a tag section")
+}
+
+func TestParserMultipleValues(t *testing.T) {
+	for _, test := range []struct {
+		packet string
+		values []interface{}
+	}{
+		{"a.b.c:1:2.5:3|c|@0.5|#foo:bar", []interface{}{1.0, 2.5, 3.0}},
+		{"a.b.c:1:2|g", []interface{}{1.0, 2.0}},
+		{"a.b.c:1:2|h", []interface{}{1.0, 2.0}},
+		{"a.b.c:1:2|ms|#foo:bar", []interface{}{1.0, 2.0}},
+		{"a.b.c:x:y:1.5|s", []interface{}{"x", "y", "1.5"}},
+		{"a.b.c:1:fart:NaN:3|ms", []interface{}{1.0, 3.0}},
+		{"a.b.c:1:|c", []interface{}{1.0}},
+	} {
+		metrics, err := samplers.ParseMetrics([]byte(test.packet), "")
+		require.NoError(t, err, test.packet)
+		single, err := samplers.ParseMetric([]byte(test.packet))
+		require.NoError(t, err, test.packet)
+
+		var values []interface{}
+		for _, m := range metrics {
+			values = append(values, m.Value)
+			assert.Equal(t, single.MetricKey, m.MetricKey, test.packet)
+			assert.Equal(t, single.Digest, m.Digest, test.packet)
+			assert.Equal(t, single.SampleRate, m.SampleRate, test.packet)
+			assert.Equal(t, single.Tags, m.Tags, test.packet)
+		}
+		assert.Equal(t, test.values, values, test.packet)
+	}
+
+	_, err := samplers.ParseMetrics([]byte("a.b.c:fart:NaN|c"), "")
+	assert.Error(t, err, "a packet without any valid values should be rejected")
+}
+
+func BenchmarkParseMetrics(b *testing.B) {
+	for _, packet := range []string{
+		"a.b.c:1|ms|@0.5|#foo:bar,baz:gorch",
+		"a.b.c:1:2:3:4:5:6:7:8|ms|@0.5|#foo:bar,baz:gorch",
+	} {
+		b.Run(packet, func(b *testing.B) {
+			buf := []byte(packet)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := samplers.ParseMetrics(buf, "")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestInvalidPackets(t *testing.T) {
 	table := map[string]string{
 		"foo":                                "1 colon",
@@ -524,6 +625,11 @@ func TestInvalidPackets(t *testing.T) {
 		"foo:1|c|@1.1":                       "<=1",
 		"foo:1|c|@0.5|@0.2":                  "multiple sample rates",
 		"foo:1|c|#foo|#bar":                  "multiple tag sections",
+		"foo:1|c|T1|T2":                      "multiple timestamps",
+		"foo:1|c|c:a|c:b":                    "multiple container IDs",
+		"foo:1|c|cab":                        "unknown section",
+		"foo:1|c|Tyesterday":                 "timestamp",
+		"foo:1|c|T-5":                        "timestamp",
 	}
 
 	for packet, errContent := range table {
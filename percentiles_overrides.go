@@ -0,0 +1,53 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// percentilesOverride is the percentiles flushed for the histograms and
+// timers whose names start with prefix.
+type percentilesOverride struct {
+	prefix      string
+	percentiles []float64
+}
+
+// newPercentilesOverrides validates the overrides, and sorts them
+// longest prefix first.
+func newPercentilesOverrides(overrides map[string][]float64) ([]percentilesOverride, error) {
+	var pos []percentilesOverride
+	for prefix, percentiles := range overrides {
+		for _, p := range percentiles {
+			if p < 0 || p > 1 {
+				return nil, fmt.Errorf("%s: percentile %v is not between 0 and 1", prefix, p)
+			}
+		}
+		if percentiles == nil {
+			// an empty override flushes no percentiles, rather than
+			// the default ones
+			percentiles = []float64{}
+		}
+		pos = append(pos, percentilesOverride{prefix: prefix, percentiles: percentiles})
+	}
+	sort.Slice(pos, func(i, j int) bool {
+		if len(pos[i].prefix) != len(pos[j].prefix) {
+			return len(pos[i].prefix) > len(pos[j].prefix)
+		}
+		return pos[i].prefix < pos[j].prefix
+	})
+	return pos, nil
+}
+
+// percentilesFor returns the percentiles of the longest prefix of name
+// in overrides, or fallback if there is none. The prefixes are matched at
+// flush time, so that the global veneur applies them to forwarded
+// histograms too.
+func percentilesFor(overrides []percentilesOverride, name string, fallback []float64) []float64 {
+	for _, po := range overrides {
+		if strings.HasPrefix(name, po.prefix) {
+			return po.percentiles
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,26 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentilesOverrides(t *testing.T) {
+	pos, err := newPercentilesOverrides(map[string][]float64{
+		"storage.":      {0.5, 0.999},
+		"storage.disk.": {0.9999},
+		"quiet.":        nil,
+	})
+	require.NoError(t, err)
+
+	fallback := []float64{0.5, 0.99}
+	assert.Equal(t, fallback, percentilesFor(pos, "api.latency", fallback))
+	assert.Equal(t, []float64{0.5, 0.999}, percentilesFor(pos, "storage.read", fallback))
+	assert.Equal(t, []float64{0.9999}, percentilesFor(pos, "storage.disk.read", fallback))
+	assert.Equal(t, []float64{}, percentilesFor(pos, "quiet.latency", fallback))
+
+	_, err = newPercentilesOverrides(map[string][]float64{"storage.": {99}})
+	assert.Error(t, err, "percentiles should be quantiles")
+}
@@ -0,0 +1,273 @@
+package gcs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// storageScope is the OAuth scope that uploads need.
+	storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	defaultTokenURL = "https://oauth2.googleapis.com/token"
+
+	// metadataTokenURL is where instances in GCP get tokens for their
+	// service account.
+	metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// expiryDelta is how long before they expire tokens are refreshed.
+	expiryDelta = time.Minute
+)
+
+// TokenSource gets OAuth access tokens.
+type TokenSource interface {
+	// Token returns an access token, and when it expires.
+	Token(ctx context.Context) (string, time.Time, error)
+}
+
+// credentialsFile is a file of Google credentials: either the key of a
+// service account, or the refresh token of a user that gcloud writes.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// NewTokenSource returns a TokenSource for the credentials in a file,
+// or, if it's empty, for the Application Default Credentials: the file
+// in $GOOGLE_APPLICATION_CREDENTIALS, the one that `gcloud auth
+// application-default login` writes, or else the service account of the
+// GCP instance.
+func NewTokenSource(credentialsPath string, client *http.Client) (TokenSource, error) {
+	if credentialsPath == "" {
+		credentialsPath = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsPath == "" {
+		if path := wellKnownCredentialsPath(); path != "" {
+			if _, err := os.Stat(path); err == nil {
+				credentialsPath = path
+			}
+		}
+	}
+	if credentialsPath == "" {
+		return &cachingTokenSource{source: &metadataTokenSource{client: client, url: metadataTokenURL}}, nil
+	}
+
+	contents, err := ioutil.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	source, err := parseCredentials(contents, client)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", credentialsPath, err)
+	}
+	return &cachingTokenSource{source: source}, nil
+}
+
+func wellKnownCredentialsPath() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, "application_default_credentials.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+func parseCredentials(contents []byte, client *http.Client) (TokenSource, error) {
+	var f credentialsFile
+	if err := json.Unmarshal(contents, &f); err != nil {
+		return nil, err
+	}
+	tokenURL := f.TokenURI
+	if tokenURL == "" {
+		tokenURL = defaultTokenURL
+	}
+	switch f.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(f.PrivateKey))
+		if block == nil {
+			return nil, errors.New("the private key isn't PEM-encoded")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the private key: %v", err)
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("the private key isn't an RSA key")
+		}
+		return &serviceAccountTokenSource{
+			client:   client,
+			email:    f.ClientEmail,
+			keyID:    f.PrivateKeyID,
+			key:      key,
+			tokenURL: tokenURL,
+		}, nil
+	case "authorized_user":
+		return &refreshTokenSource{
+			client:   client,
+			form:     url.Values{"grant_type": {"refresh_token"}, "client_id": {f.ClientID}, "client_secret": {f.ClientSecret}, "refresh_token": {f.RefreshToken}},
+			tokenURL: tokenURL,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported credentials type %q", f.Type)
+}
+
+// cachingTokenSource reuses the tokens of another TokenSource until
+// they're about to expire.
+type cachingTokenSource struct {
+	source TokenSource
+
+	mtx    sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (c *cachingTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.token != "" && time.Now().Add(expiryDelta).Before(c.expiry) {
+		return c.token, c.expiry, nil
+	}
+	token, expiry, err := c.source.Token(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	c.token, c.expiry = token, expiry
+	return token, expiry, nil
+}
+
+// tokenResponse is what OAuth token endpoints, and the metadata server,
+// respond with.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func fetchToken(ctx context.Context, client *http.Client, req *http.Request) (string, time.Time, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("couldn't get a token from %s: %s: %s", req.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("%s responded without a token", req.URL)
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+func postForm(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (string, time.Time, error) {
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return fetchToken(ctx, client, req)
+}
+
+// serviceAccountTokenSource exchanges JWTs signed with the key of a
+// service account for tokens.
+type serviceAccountTokenSource struct {
+	client   *http.Client
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURL string
+}
+
+func (s *serviceAccountTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.email,
+		"scope": storageScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return postForm(ctx, s.client, s.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+}
+
+// refreshTokenSource exchanges the refresh token of a user for tokens.
+type refreshTokenSource struct {
+	client   *http.Client
+	form     url.Values
+	tokenURL string
+}
+
+func (r *refreshTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	return postForm(ctx, r.client, r.tokenURL, r.form)
+}
+
+// metadataTokenSource gets the tokens of the instance's service account
+// from the metadata server.
+type metadataTokenSource struct {
+	client *http.Client
+	url    string
+}
+
+func (m *metadataTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, m.url, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return fetchToken(ctx, m.client, req)
+}
@@ -0,0 +1,139 @@
+package gcs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCredentials(t *testing.T, dir string, creds map[string]string) string {
+	contents, err := json.Marshal(creds)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "credentials.json")
+	require.NoError(t, ioutil.WriteFile(path, contents, 0600))
+	return path
+}
+
+func TestServiceAccountTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+
+		// The assertion is a JWT signed with the key:
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		require.Len(t, parts, 3)
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		var claims map[string]interface{}
+		require.NoError(t, json.Unmarshal(payload, &claims))
+		assert.Equal(t, "veneur@example.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(t, storageScope, claims["scope"])
+
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gcs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeCredentials(t, dir, map[string]string{
+		"type":         "service_account",
+		"client_email": "veneur@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL,
+	})
+
+	tokens, err := NewTokenSource(path, http.DefaultClient)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		token, _, err := tokens.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "token", token)
+	}
+	// Tokens are reused until they're about to expire:
+	assert.Equal(t, 1, requests)
+}
+
+func TestAuthorizedUserTokenSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "refresh", r.PostForm.Get("refresh_token"))
+		w.Write([]byte(`{"access_token": "user-token", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gcs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeCredentials(t, dir, map[string]string{
+		"type":          "authorized_user",
+		"client_id":     "id",
+		"client_secret": "secret",
+		"refresh_token": "refresh",
+		"token_uri":     server.URL,
+	})
+
+	// Application Default Credentials come from
+	// $GOOGLE_APPLICATION_CREDENTIALS:
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+	tokens, err := NewTokenSource("", http.DefaultClient)
+	require.NoError(t, err)
+	token, _, err := tokens.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "user-token", token)
+}
+
+func TestMetadataTokenSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"access_token": "instance-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer server.Close()
+
+	token, _, err := (&metadataTokenSource{client: http.DefaultClient, url: server.URL}).Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "instance-token", token)
+}
+
+func TestParseCredentialsInvalid(t *testing.T) {
+	for _, contents := range []string{
+		`{"type": "external_account"}`,
+		`{"type": "service_account", "private_key": "not a key"}`,
+		`not json`,
+	} {
+		_, err := parseCredentials([]byte(contents), http.DefaultClient)
+		assert.Error(t, err, contents)
+	}
+}
@@ -0,0 +1,322 @@
+// Package gcs is a plugin that archives every flush to Google Cloud
+// Storage, like the S3 plugin does to S3.
+package gcs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/plugins/s3"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+var _ plugins.Plugin = &Plugin{}
+
+// The formats that flushes can be archived in.
+const (
+	FormatTSV     = "tsv"
+	FormatCSV     = "csv"
+	FormatJSON    = "json"
+	FormatParquet = "parquet"
+)
+
+// DefaultEndpoint is the endpoint of the GCS JSON API.
+const DefaultEndpoint = "https://storage.googleapis.com"
+
+const (
+	// maxAttempts bounds how many times an upload is tried.
+	maxAttempts         = 3
+	defaultRetryBackoff = time.Second
+)
+
+// Plugin is the GCS plugin. It archives each flush as an object of
+// Bucket, under a key made from Key.
+type Plugin struct {
+	Logger   *logrus.Logger
+	Hostname string
+	Interval int
+
+	Bucket string
+	// Key is the template of the keys that flushes are archived under;
+	// nil is s3.DefaultKeyTemplate.
+	Key *s3.KeyTemplate
+	// Format is FormatTSV (the default), FormatCSV, FormatJSON or
+	// FormatParquet.
+	Format  string
+	Parquet s3.ParquetOptions
+	// Uncompressed uploads text formats as they are, rather than with
+	// gzip content encoding. Parquet files are compressed by themselves,
+	// so they're always uploaded as they are.
+	Uncompressed bool
+
+	// Tokens authenticates uploads.
+	Tokens TokenSource
+	Client *http.Client
+	// Endpoint is the endpoint of the GCS JSON API; empty is
+	// DefaultEndpoint.
+	Endpoint string
+
+	// TraceClient reports retried and failed uploads.
+	TraceClient *trace.Client
+
+	// retryBackoff is how long the first retry of an upload waits; the
+	// next ones wait twice as long as the last.
+	retryBackoff time.Duration
+}
+
+// ValidFormat returns whether flushes can be archived in a format.
+func ValidFormat(format string) bool {
+	switch format {
+	case "", FormatTSV, FormatCSV, FormatJSON, FormatParquet:
+		return true
+	}
+	return false
+}
+
+// Name returns the name of the plugin, "gcs".
+func (p *Plugin) Name() string {
+	return "gcs"
+}
+
+// Flush archives metrics to GCS.
+func (p *Plugin) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	data, ext, gzipped, err := p.encode(metrics)
+	if err != nil {
+		p.Logger.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"metrics":       len(metrics),
+		}).Error("Could not marshal metrics before posting to gcs")
+		return err
+	}
+
+	key := p.Key
+	if key == nil {
+		key, _ = s3.ParseKeyTemplate(s3.DefaultKeyTemplate)
+	}
+	name := key.Key(time.Now(), p.Hostname, ext)
+	if err := p.upload(ctx, name, data, gzipped); err != nil {
+		p.Logger.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"metrics":       len(metrics),
+		}).Error("Error posting to gcs")
+		return err
+	}
+
+	p.Logger.WithField("metrics", len(metrics)).Debug("Completed flush to gcs")
+	return nil
+}
+
+// encode returns metrics in the plugin's format, the extension of that,
+// and whether they're gzipped.
+func (p *Plugin) encode(metrics []samplers.InterMetric) ([]byte, string, bool, error) {
+	if p.Format == FormatParquet {
+		r, err := s3.EncodeInterMetricsParquet(metrics, p.Hostname, p.Interval, p.Parquet)
+		if err != nil {
+			return nil, "", false, err
+		}
+		data, err := ioutil.ReadAll(r)
+		return data, FormatParquet, false, err
+	}
+
+	format := p.Format
+	if format == "" {
+		format = FormatTSV
+	}
+	b := &bytes.Buffer{}
+	var w io.Writer = b
+	var gzw *gzip.Writer
+	if !p.Uncompressed {
+		gzw = gzip.NewWriter(b)
+		w = gzw
+	}
+	var err error
+	if format == FormatJSON {
+		err = encodeJSON(w, metrics, p.Hostname, p.Interval)
+	} else {
+		csvw := csv.NewWriter(w)
+		if format == FormatTSV {
+			csvw.Comma = '\t'
+		}
+		partitionDate := time.Now()
+		for _, metric := range metrics {
+			// Like in the S3 plugin, metrics of other types, which
+			// can't be encoded, are skipped:
+			s3.EncodeInterMetricCSV(metric, csvw, &partitionDate, p.Hostname, p.Interval)
+		}
+		csvw.Flush()
+		err = csvw.Error()
+	}
+	if gzw != nil {
+		if cerr := gzw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return b.Bytes(), format, gzw != nil, err
+}
+
+// jsonMetric is a line of JSON archives, which has the columns of the
+// TSVs.
+type jsonMetric struct {
+	Name      string   `json:"name"`
+	Tags      []string `json:"tags"`
+	Type      string   `json:"type"`
+	Interval  int      `json:"interval"`
+	Hostname  string   `json:"veneur_hostname"`
+	Value     float64  `json:"value"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// encodeJSON writes metrics as lines of JSON. Like in TSVs, counters are
+// written as rates per second over the interval, and metrics other than
+// counters and gauges are skipped.
+func encodeJSON(w io.Writer, metrics []samplers.InterMetric, hostname string, interval int) error {
+	enc := json.NewEncoder(w)
+	for _, metric := range metrics {
+		line := jsonMetric{
+			Name:      metric.Name,
+			Tags:      metric.Tags,
+			Interval:  interval,
+			Hostname:  hostname,
+			Value:     metric.Value,
+			Timestamp: metric.Timestamp,
+		}
+		switch metric.Type {
+		case samplers.CounterMetric:
+			line.Type = "rate"
+			line.Value = metric.Value / float64(interval)
+		case samplers.GaugeMetric:
+			line.Type = "gauge"
+		default:
+			continue
+		}
+		if line.Tags == nil {
+			line.Tags = []string{}
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadError is an error response of the JSON API.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("gcs responded %d: %s", e.status, e.msg)
+}
+
+// transient returns whether an upload that failed with err may succeed
+// if it's retried: if the API is throttling, timed out or failed, or if
+// it couldn't be reached at all.
+func transient(err error) bool {
+	var uerr *uploadError
+	if !errors.As(err, &uerr) {
+		return true
+	}
+	return uerr.status == http.StatusRequestTimeout ||
+		uerr.status == http.StatusTooManyRequests ||
+		uerr.status >= 500
+}
+
+// upload uploads an object, retrying it with backoff while it fails
+// transiently.
+func (p *Plugin) upload(ctx context.Context, name string, data []byte, gzipped bool) error {
+	samples := &ssf.Samples{}
+	defer metrics.Report(p.TraceClient, samples)
+
+	backoff := p.retryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = p.uploadOnce(ctx, name, data, gzipped)
+		if err == nil || attempt == maxAttempts || !transient(err) {
+			break
+		}
+		p.Logger.WithError(err).Warn("Retrying an upload to gcs")
+		samples.Add(ssf.Count("flush.plugins.gcs.upload_retries_total", 1, nil))
+		select {
+		case <-time.After(backoff << uint(attempt-1)):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		samples.Add(ssf.Count("flush.plugins.gcs.upload_failures_total", 1, nil))
+	}
+	return err
+}
+
+func (p *Plugin) uploadOnce(ctx context.Context, name string, data []byte, gzipped bool) error {
+	token, _, err := p.Tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	query := url.Values{"uploadType": {"media"}, "name": {name}}
+	if gzipped {
+		query.Set("contentEncoding", "gzip")
+	}
+	u := strings.TrimRight(endpoint, "/") + "/upload/storage/v1/b/" + url.PathEscape(p.Bucket) + "/o?" + query.Encode()
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", contentType(p.Format))
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return &uploadError{status: resp.StatusCode, msg: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+func contentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSON:
+		return "application/x-ndjson"
+	case FormatParquet:
+		return "application/octet-stream"
+	}
+	return "text/tab-separated-values"
+}
@@ -0,0 +1,280 @@
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/plugins/s3"
+	"github.com/stripe/veneur/samplers"
+)
+
+// staticTokens is a TokenSource of a single token.
+type staticTokens string
+
+func (s staticTokens) Token(context.Context) (string, time.Time, error) {
+	return string(s), time.Now().Add(time.Hour), nil
+}
+
+// fakeObject is an object uploaded to a fakeGCS.
+type fakeObject struct {
+	bucket, name, contentEncoding, contentType string
+	data                                       []byte
+}
+
+// fakeGCS is a fake of the upload endpoint of the GCS JSON API. Its
+// first failures uploads respond with failStatus.
+type fakeGCS struct {
+	*httptest.Server
+
+	mtx        sync.Mutex
+	failures   int
+	failStatus int
+	attempts   int
+	objects    []fakeObject
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	f := &fakeGCS{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		f.attempts++
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, "media", r.URL.Query().Get("uploadType"))
+		if f.failures > 0 {
+			f.failures--
+			http.Error(w, "nope", f.failStatus)
+			return
+		}
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		f.objects = append(f.objects, fakeObject{
+			bucket:          bucket,
+			name:            r.URL.Query().Get("name"),
+			contentEncoding: r.URL.Query().Get("contentEncoding"),
+			contentType:     r.Header.Get("Content-Type"),
+			data:            data,
+		})
+		w.Write([]byte("{}"))
+	}))
+	return f
+}
+
+func (f *fakeGCS) plugin() *Plugin {
+	return &Plugin{
+		Logger:       logrus.New(),
+		Hostname:     "testbox",
+		Interval:     10,
+		Bucket:       "veneur-archive",
+		Tokens:       staticTokens("token"),
+		Endpoint:     f.URL,
+		retryBackoff: time.Millisecond,
+	}
+}
+
+var testMetrics = []samplers.InterMetric{
+	{Name: "a.b.c", Timestamp: 1476119058, Value: 100, Tags: []string{"foo:bar"}, Type: samplers.CounterMetric},
+	{Name: "a.b.d", Timestamp: 1476119058, Value: 4.5, Type: samplers.GaugeMetric},
+	{Name: "farm.ok", Timestamp: 1476119058, Type: samplers.StatusMetric},
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(contents)
+}
+
+func TestFlushTSV(t *testing.T) {
+	gcs := newFakeGCS(t)
+	defer gcs.Close()
+	plugin := gcs.plugin()
+	key, err := s3.ParseKeyTemplate("{hostname}/{unix}.{ext}")
+	require.NoError(t, err)
+	plugin.Key = key
+
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	require.Len(t, gcs.objects, 1)
+	object := gcs.objects[0]
+	assert.Equal(t, "veneur-archive", object.bucket)
+	assert.Regexp(t, `^testbox/\d+\.tsv$`, object.name)
+	assert.Equal(t, "gzip", object.contentEncoding)
+	assert.Equal(t, "text/tab-separated-values", object.contentType)
+
+	lines := strings.Split(strings.TrimSpace(gunzip(t, object.data)), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "a.b.c\t{foo:bar}\trate\ttestbox\t10\t2016-10-10 05:04:18\t10\t"), lines[0])
+}
+
+func TestFlushCSVUncompressed(t *testing.T) {
+	gcs := newFakeGCS(t)
+	defer gcs.Close()
+	plugin := gcs.plugin()
+	plugin.Format = FormatCSV
+	plugin.Uncompressed = true
+
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	require.Len(t, gcs.objects, 1)
+	object := gcs.objects[0]
+	assert.Regexp(t, `^\d{4}/\d\d/\d\d/testbox/\d+\.csv$`, object.name)
+	assert.Empty(t, object.contentEncoding)
+	assert.True(t, strings.HasPrefix(string(object.data), "a.b.c,{foo:bar},rate,testbox,10,2016-10-10 05:04:18,10,"), string(object.data))
+}
+
+func TestFlushJSON(t *testing.T) {
+	gcs := newFakeGCS(t)
+	defer gcs.Close()
+	plugin := gcs.plugin()
+	plugin.Format = FormatJSON
+
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	require.Len(t, gcs.objects, 1)
+	assert.Equal(t, "application/x-ndjson", gcs.objects[0].contentType)
+
+	var lines []jsonMetric
+	scanner := bufio.NewScanner(strings.NewReader(gunzip(t, gcs.objects[0].data)))
+	for scanner.Scan() {
+		var line jsonMetric
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []jsonMetric{
+		{Name: "a.b.c", Tags: []string{"foo:bar"}, Type: "rate", Interval: 10, Hostname: "testbox", Value: 10, Timestamp: 1476119058},
+		{Name: "a.b.d", Tags: []string{}, Type: "gauge", Interval: 10, Hostname: "testbox", Value: 4.5, Timestamp: 1476119058},
+	}, lines)
+}
+
+func TestFlushParquet(t *testing.T) {
+	gcs := newFakeGCS(t)
+	defer gcs.Close()
+	plugin := gcs.plugin()
+	plugin.Format = FormatParquet
+
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	require.Len(t, gcs.objects, 1)
+	object := gcs.objects[0]
+	assert.Regexp(t, `\.parquet$`, object.name)
+	// Parquet files are compressed by themselves:
+	assert.Empty(t, object.contentEncoding)
+	assert.True(t, bytes.HasPrefix(object.data, []byte("PAR1")))
+}
+
+func TestFlushRetries(t *testing.T) {
+	gcs := newFakeGCS(t)
+	defer gcs.Close()
+	plugin := gcs.plugin()
+
+	gcs.failures, gcs.failStatus = maxAttempts-1, http.StatusServiceUnavailable
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	assert.Equal(t, maxAttempts, gcs.attempts)
+	assert.Len(t, gcs.objects, 1)
+
+	// Uploads that keep failing fail the flush:
+	gcs.attempts = 0
+	gcs.failures = maxAttempts
+	assert.Error(t, plugin.Flush(context.Background(), testMetrics))
+	assert.Equal(t, maxAttempts, gcs.attempts)
+
+	// Errors that aren't transient aren't retried:
+	gcs.attempts = 0
+	gcs.failures, gcs.failStatus = 1, http.StatusForbidden
+	err := plugin.Flush(context.Background(), testMetrics)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+	assert.Equal(t, 1, gcs.attempts)
+}
+
+// fakeGCSServerGet gets the metadata of an object from fake-gcs-server,
+// or with media, its contents.
+func fakeGCSServerGet(t *testing.T, endpoint, bucket, name string, media bool) []byte {
+	u := endpoint + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name)
+	if media {
+		u += "?alt=media"
+	}
+	resp, err := http.Get(u)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	return body
+}
+
+// TestFlushFakeGCSServer uploads to fake-gcs-server
+// (https://github.com/fsouza/fake-gcs-server), an emulator of much more
+// of the JSON API than fakeGCS. It runs only if $STORAGE_EMULATOR_HOST
+// has the emulator's address, as for Google's client libraries:
+//
+//	docker run -d -p 4443:4443 fsouza/fake-gcs-server -scheme http
+//	STORAGE_EMULATOR_HOST=localhost:4443 go test ./plugins/gcs
+func TestFlushFakeGCSServer(t *testing.T) {
+	endpoint := os.Getenv("STORAGE_EMULATOR_HOST")
+	if endpoint == "" {
+		t.Skip("STORAGE_EMULATOR_HOST isn't set")
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	bucket := fmt.Sprintf("veneur-test-%d", time.Now().UnixNano())
+	resp, err := http.Post(endpoint+"/storage/v1/b", "application/json", strings.NewReader(`{"name":"`+bucket+`"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	key, err := s3.ParseKeyTemplate("{hostname}/metrics.{ext}")
+	require.NoError(t, err)
+	plugin := &Plugin{
+		Logger:   logrus.New(),
+		Hostname: "testbox",
+		Interval: 10,
+		Bucket:   bucket,
+		Key:      key,
+		Tokens:   staticTokens("token"),
+		Endpoint: endpoint,
+	}
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	var object struct {
+		ContentEncoding string `json:"contentEncoding"`
+		ContentType     string `json:"contentType"`
+	}
+	require.NoError(t, json.Unmarshal(fakeGCSServerGet(t, endpoint, bucket, "testbox/metrics.tsv", false), &object))
+	assert.Equal(t, "gzip", object.ContentEncoding)
+	assert.Equal(t, "text/tab-separated-values", object.ContentType)
+	// Gzipped objects are downloaded decompressed:
+	data := fakeGCSServerGet(t, endpoint, bucket, "testbox/metrics.tsv", true)
+	assert.True(t, strings.HasPrefix(string(data), "a.b.c\t{foo:bar}\trate\ttestbox\t10\t"), string(data))
+
+	plugin.Format = FormatJSON
+	plugin.Uncompressed = true
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	data = fakeGCSServerGet(t, endpoint, bucket, "testbox/metrics.json", true)
+	assert.Equal(t, `{"name":"a.b.c","tags":["foo:bar"],"type":"rate","interval":10,"veneur_hostname":"testbox","value":10,"timestamp":1476119058}
+{"name":"a.b.d","tags":[],"type":"gauge","interval":10,"veneur_hostname":"testbox","value":4.5,"timestamp":1476119058}
+`, string(data))
+}
+
+func TestValidFormat(t *testing.T) {
+	for _, format := range []string{"", FormatTSV, FormatCSV, FormatJSON, FormatParquet} {
+		assert.True(t, ValidFormat(format), format)
+	}
+	assert.False(t, ValidFormat("xml"))
+}
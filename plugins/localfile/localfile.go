@@ -1,42 +1,147 @@
 package localfile
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/veneur/plugins"
 	"github.com/stripe/veneur/plugins/s3"
 	"github.com/stripe/veneur/samplers"
+	flock "github.com/theckman/go-flock"
 )
 
 var _ plugins.Plugin = &Plugin{}
 
+// The formats that flushes can be written in.
+const (
+	// FormatTSV appends each flush as a gzipped TSV, in the S3 plugin's
+	// columns.
+	FormatTSV = "tsv"
+	// FormatJSON appends each metric as a line of JSON.
+	FormatJSON = "json"
+)
+
+// rotatedTimeFormat is the suffix of rotated files, which sorts them in
+// the order that they were rotated in.
+const rotatedTimeFormat = "20060102T150405.000000000Z"
+
 // Plugin is the LocalFile plugin that we'll use in Veneur
 type Plugin struct {
 	FilePath string
 	Logger   *logrus.Logger
-	hostname string
-	interval int
+	Hostname string
+	Interval int
+
+	// Format is FormatTSV (the default) or FormatJSON.
+	Format string
+
+	// MaxSize rotates the file once it's grown past this many bytes,
+	// and MaxAge once flushes have been appended to it for this long.
+	// With neither, the file is never rotated.
+	MaxSize int64
+	MaxAge  time.Duration
+	// MaxFiles is how many rotated files are kept; 0 keeps all of
+	// them.
+	MaxFiles int
+	// Compress gzips rotated JSON files. TSV files are gzipped as
+	// they're written.
+	Compress bool
+
+	mtx    sync.Mutex
+	lock   *flock.Flock
+	opened time.Time
+	now    func() time.Time
 }
 
 // Delimiter defines what kind of delimiter we'll use in the CSV format -- in this case, we want TSV
 const Delimiter = '\t'
 
+// ValidFormat returns whether flushes can be written in a format.
+func ValidFormat(format string) bool {
+	return format == "" || format == FormatTSV || format == FormatJSON
+}
+
+func (p *Plugin) rotates() bool {
+	return p.MaxSize > 0 || p.MaxAge > 0
+}
+
+// Lock takes the lock file next to the file, so that no other veneur
+// rotates it. Files that are rotated can't be shared between processes,
+// as both would rotate them; files that aren't need no lock.
+func (p *Plugin) Lock() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.takeLock()
+}
+
+func (p *Plugin) takeLock() error {
+	if p.lock != nil || !p.rotates() {
+		return nil
+	}
+	lockname := p.FilePath + ".lock"
+	lock := flock.NewFlock(lockname)
+	locked, err := lock.TryLock()
+	if err != nil {
+		return fmt.Errorf("couldn't acquire the lock %q for %s: %v", lockname, p.FilePath, err)
+	}
+	if !locked {
+		return fmt.Errorf("lock file %q for %s is in use by another process already", lockname, p.FilePath)
+	}
+	p.lock = lock
+	return nil
+}
+
 // Flush the metrics from the LocalFilePlugin
 func (p *Plugin) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
-	f, err := os.OpenFile(p.FilePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
-	defer f.Close()
+	// Each flush is written with a single write, so that flushes
+	// appended by several processes don't interleave:
+	b := &bytes.Buffer{}
+	var err error
+	if p.Format == FormatJSON {
+		err = appendJSONToWriter(b, metrics, p.Hostname, p.Interval)
+	} else {
+		err = appendToWriter(b, metrics, p.Hostname, p.Interval)
+	}
+	if err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if err := p.takeLock(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	if p.rotates() {
+		p.rotateIfDue(now)
+	}
 
+	f, err := os.OpenFile(p.FilePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("couldn't open %s for appending: %s", p.FilePath, err)
 	}
-	appendToWriter(f, metrics, p.hostname, p.interval)
+	defer f.Close()
+	if p.opened.IsZero() {
+		p.opened = now
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("couldn't append to %s: %s", p.FilePath, err)
+	}
 	return nil
 }
 
@@ -54,6 +159,157 @@ func appendToWriter(appender io.Writer, metrics []samplers.InterMetric, hostname
 	return csvW.Error()
 }
 
+// jsonMetric is a line of JSON files: an InterMetric, with its tags as
+// a map. Tags without a value are null.
+type jsonMetric struct {
+	Name      string                 `json:"name"`
+	Timestamp int64                  `json:"timestamp"`
+	Value     float64                `json:"value"`
+	Tags      map[string]interface{} `json:"tags"`
+	Type      string                 `json:"type"`
+	Message   string                 `json:"message,omitempty"`
+	HostName  string                 `json:"host_name,omitempty"`
+	Interval  int                    `json:"interval"`
+	Hostname  string                 `json:"veneur_hostname"`
+}
+
+func appendJSONToWriter(appender io.Writer, metrics []samplers.InterMetric, hostname string, interval int) error {
+	enc := json.NewEncoder(appender)
+	for _, metric := range metrics {
+		tags := make(map[string]interface{}, len(metric.Tags))
+		for _, tag := range metric.Tags {
+			if i := strings.IndexByte(tag, ':'); i >= 0 {
+				tags[tag[:i]] = tag[i+1:]
+			} else {
+				tags[tag] = nil
+			}
+		}
+		line := jsonMetric{
+			Name:      metric.Name,
+			Timestamp: metric.Timestamp,
+			Value:     metric.Value,
+			Tags:      tags,
+			Type:      strings.ToLower(strings.TrimSuffix(metric.Type.String(), "Metric")),
+			Message:   metric.Message,
+			HostName:  metric.HostName,
+			Interval:  interval,
+			Hostname:  hostname,
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateIfDue renames the file aside if it's grown past MaxSize, or if
+// flushes have been appended to it for MaxAge, and then archives it.
+// Failures are logged, and flushes keep being appended to the file.
+func (p *Plugin) rotateIfDue(now time.Time) {
+	info, err := os.Stat(p.FilePath)
+	if err != nil {
+		return
+	}
+	tooBig := p.MaxSize > 0 && info.Size() >= p.MaxSize
+	tooOld := p.MaxAge > 0 && !p.opened.IsZero() && now.Sub(p.opened) >= p.MaxAge
+	if !tooBig && !tooOld {
+		return
+	}
+
+	rotated := p.FilePath + "." + now.UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(p.FilePath, rotated); err != nil {
+		p.Logger.WithError(err).WithField("path", p.FilePath).Error("Couldn't rotate the flush file")
+		return
+	}
+	p.opened = time.Time{}
+	if p.Compress && p.Format == FormatJSON {
+		if err := compress(rotated); err != nil {
+			p.Logger.WithError(err).WithField("path", rotated).Error("Couldn't compress a rotated flush file")
+		}
+	}
+	if p.MaxFiles > 0 {
+		p.prune()
+	}
+}
+
+// compress replaces a file with its gzipped copy.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Written under a name that prune ignores, until it's complete:
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the oldest rotated files while there are more than
+// MaxFiles of them.
+func (p *Plugin) prune() {
+	dir, base := filepath.Split(p.FilePath)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		p.Logger.WithError(err).Error("Couldn't list rotated flush files")
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		p.Logger.WithError(err).Error("Couldn't list rotated flush files")
+		return
+	}
+
+	var rotated []string
+	for _, name := range names {
+		if isRotated(base, name) {
+			rotated = append(rotated, name)
+		}
+	}
+	// Rotated files' names sort by when they were rotated:
+	sort.Strings(rotated)
+	for len(rotated) > p.MaxFiles {
+		if err := os.Remove(filepath.Join(dir, rotated[0])); err != nil {
+			p.Logger.WithError(err).WithField("path", rotated[0]).Error("Couldn't remove a rotated flush file")
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// isRotated reports whether a file name is that of a rotated file of
+// the flush file named base, so that other files are left alone.
+func isRotated(base, name string) bool {
+	if !strings.HasPrefix(name, base+".") {
+		return false
+	}
+	suffix := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ".gz")
+	_, err := time.Parse(rotatedTimeFormat, suffix)
+	return err == nil
+}
+
 // Name is the name of the LocalFilePlugin, i.e., "localfile"
 func (p *Plugin) Name() string {
 	return "localfile"
@@ -2,12 +2,20 @@ package localfile
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/samplers"
 )
 
@@ -60,7 +68,7 @@ func TestHandlesErrorsInAppendToWriter(t *testing.T) {
 }
 
 func TestWritesToDevNull(t *testing.T) {
-	plugin := Plugin{FilePath: "/dev/null", Logger: logrus.New(), hostname: "globblestoots"}
+	plugin := Plugin{FilePath: "/dev/null", Logger: logrus.New(), Hostname: "globblestoots"}
 	err := plugin.Flush(context.TODO(), []samplers.InterMetric{
 		samplers.InterMetric{
 			Name:      "sketchy.metric",
@@ -74,7 +82,7 @@ func TestWritesToDevNull(t *testing.T) {
 }
 
 func TestWritingToInvalidPath(t *testing.T) {
-	plugin := Plugin{FilePath: "", Logger: logrus.New(), hostname: "globblestoots"}
+	plugin := Plugin{FilePath: "", Logger: logrus.New(), Hostname: "globblestoots"}
 	err := plugin.Flush(context.TODO(), []samplers.InterMetric{
 		samplers.InterMetric{
 			Name:      "sketchy.metric",
@@ -86,3 +94,128 @@ func TestWritingToInvalidPath(t *testing.T) {
 	})
 	assert.Error(t, err)
 }
+
+var testMetrics = []samplers.InterMetric{
+	{
+		Name:      "a.b.c",
+		Timestamp: 1476119058,
+		Value:     float64(100),
+		Tags:      []string{"foo:bar", "baz"},
+		Type:      samplers.CounterMetric,
+	},
+}
+
+// fakeClock is a clock that tests advance by themselves.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func listDir(t *testing.T, dir string) []string {
+	f, err := os.Open(dir)
+	require.NoError(t, err)
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	require.NoError(t, err)
+	sort.Strings(names)
+	return names
+}
+
+func TestFlushJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flushes.json")
+	plugin := &Plugin{FilePath: path, Logger: logrus.New(), Hostname: "globblestoots", Interval: 10, Format: FormatJSON}
+
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"name": "a.b.c", "timestamp": 1476119058, "value": 100, "tags": {"foo": "bar", "baz": null}, "type": "counter", "interval": 10, "veneur_hostname": "globblestoots"}`, lines[0])
+}
+
+func TestFlushRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flushes.json")
+	clock := &fakeClock{t: time.Date(2018, 3, 7, 9, 30, 0, 0, time.UTC)}
+	plugin := &Plugin{
+		FilePath: path,
+		Logger:   logrus.New(),
+		Format:   FormatJSON,
+		MaxSize:  1,
+		MaxFiles: 2,
+		Compress: true,
+		now:      clock.now,
+	}
+	// Another file next to it is left alone:
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "flushes.json.bak"), nil, 0644))
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+		clock.t = clock.t.Add(time.Second)
+	}
+	// Each flush but the first rotated the last one's file, and only
+	// the last two rotated files are kept:
+	assert.Equal(t, []string{
+		"flushes.json",
+		"flushes.json.20180307T093002.000000000Z.gz",
+		"flushes.json.20180307T093003.000000000Z.gz",
+		"flushes.json.bak",
+		"flushes.json.lock",
+	}, listDir(t, dir))
+
+	f, err := os.Open(filepath.Join(dir, "flushes.json.20180307T093003.000000000Z.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Contains(t, string(contents), `"name":"a.b.c"`)
+}
+
+func TestFlushRotatesByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flushes.tsv.gz")
+	clock := &fakeClock{t: time.Date(2018, 3, 7, 9, 30, 0, 0, time.UTC)}
+	plugin := &Plugin{FilePath: path, Logger: logrus.New(), Interval: 10, MaxAge: time.Minute, Compress: true, now: clock.now}
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, plugin.Flush(context.Background(), testMetrics))
+		clock.t = clock.t.Add(30 * time.Second)
+	}
+	// TSV files aren't compressed again:
+	assert.Equal(t, []string{
+		"flushes.tsv.gz",
+		"flushes.tsv.gz.20180307T093100.000000000Z",
+		"flushes.tsv.gz.lock",
+	}, listDir(t, dir))
+}
+
+func TestLockRefusesSharedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flushes.tsv.gz")
+
+	first := &Plugin{FilePath: path, Logger: logrus.New(), MaxSize: 1 << 20}
+	require.NoError(t, first.Lock())
+	defer first.lock.Unlock()
+	second := &Plugin{FilePath: path, Logger: logrus.New(), MaxSize: 1 << 20}
+	assert.Error(t, second.Lock())
+	assert.Error(t, second.Flush(context.Background(), testMetrics))
+
+	// Files that aren't rotated can be shared:
+	third := &Plugin{FilePath: path, Logger: logrus.New()}
+	assert.NoError(t, third.Flush(context.Background(), testMetrics))
+}
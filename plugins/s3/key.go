@@ -0,0 +1,119 @@
+package s3
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultKeyTemplate is the template of the keys that flushes are
+// archived under, by default: a directory a day, and one for each host.
+const DefaultKeyTemplate = "{date:2006/01/02}/{hostname}/{unix}.{ext}"
+
+var placeholder = regexp.MustCompile(`\{([a-z]+)(?::([^}]*))?\}`)
+
+// KeyTemplate is a template of the keys that flushes are archived under.
+// Its placeholders are replaced with, at the time of the flush:
+//
+//	{hostname}      the hostname of this veneur
+//	{date:LAYOUT}   the date, formatted with a Go time layout; {date}
+//	                alone is {date:2006/01/02}
+//	{hour}          the hour, from 00 to 23
+//	{unix}          the Unix time
+//	{uuid}          a random UUID
+//	{ext}           the extension of the format that flushes are written in
+type KeyTemplate struct {
+	parts []func(k *keyContext) string
+}
+
+// keyContext is what the placeholders of a key are replaced with.
+type keyContext struct {
+	time     time.Time
+	hostname string
+	ext      string
+}
+
+// ParseKeyTemplate parses a key template, or the default one if it's
+// empty.
+func ParseKeyTemplate(template string) (*KeyTemplate, error) {
+	if template == "" {
+		template = DefaultKeyTemplate
+	}
+	t := &KeyTemplate{}
+	literal := func(s string) func(*keyContext) string {
+		return func(*keyContext) string { return s }
+	}
+	last := 0
+	for _, m := range placeholder.FindAllStringSubmatchIndex(template, -1) {
+		if prefix := template[last:m[0]]; strings.ContainsAny(prefix, "{}") {
+			return nil, fmt.Errorf("invalid key template %q", template)
+		} else if prefix != "" {
+			t.parts = append(t.parts, literal(prefix))
+		}
+		last = m[1]
+
+		name := template[m[2]:m[3]]
+		hasArg := m[4] >= 0
+		arg := ""
+		if hasArg {
+			arg = template[m[4]:m[5]]
+		}
+		if hasArg && name != "date" {
+			return nil, fmt.Errorf("the {%s} placeholder of key template %q takes no layout", name, template)
+		}
+		switch name {
+		case "hostname":
+			t.parts = append(t.parts, func(k *keyContext) string { return k.hostname })
+		case "date":
+			layout := "2006/01/02"
+			if hasArg {
+				if arg == "" {
+					return nil, fmt.Errorf("the {date} placeholder of key template %q has an empty layout", template)
+				}
+				layout = arg
+			}
+			t.parts = append(t.parts, func(k *keyContext) string { return k.time.Format(layout) })
+		case "hour":
+			t.parts = append(t.parts, func(k *keyContext) string { return k.time.Format("15") })
+		case "unix":
+			t.parts = append(t.parts, func(k *keyContext) string { return strconv.FormatInt(k.time.Unix(), 10) })
+		case "uuid":
+			t.parts = append(t.parts, func(*keyContext) string {
+				id, err := uuid.NewV4()
+				if err != nil {
+					// Without randomness, the time keeps keys
+					// apart:
+					return strconv.FormatInt(time.Now().UnixNano(), 10)
+				}
+				return id.String()
+			})
+		case "ext":
+			t.parts = append(t.parts, func(k *keyContext) string { return k.ext })
+		default:
+			return nil, fmt.Errorf("unknown placeholder {%s} in key template %q", name, template)
+		}
+	}
+	if suffix := template[last:]; strings.ContainsAny(suffix, "{}") {
+		return nil, fmt.Errorf("invalid key template %q", template)
+	} else if suffix != "" {
+		t.parts = append(t.parts, literal(suffix))
+	}
+	return t, nil
+}
+
+// Key returns the key that a flush at a time is archived under, in a
+// file with the extension ext, cleaned like a path, so that an empty
+// placeholder doesn't leave an empty directory.
+func (t *KeyTemplate) Key(at time.Time, hostname string, ext string) string {
+	k := &keyContext{time: at, hostname: hostname, ext: ext}
+	var b strings.Builder
+	for _, part := range t.parts {
+		b.WriteString(part(k))
+	}
+	return path.Clean(b.String())
+}
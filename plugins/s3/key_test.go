@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	at := time.Date(2018, 3, 7, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		template string
+		key      string
+	}{
+		{"", "2018/03/07/testbox/" + strconv.FormatInt(at.Unix(), 10) + ".tsv.gz"},
+		{"metrics/{date}/{hour}/{hostname}.{ext}", "metrics/2018/03/07/09/testbox.tsv.gz"},
+		{"dt={date:2006-01-02}/hour={hour}/{hostname}.{ext}", "dt=2018-03-07/hour=09/testbox.tsv.gz"},
+		{"/{hostname}//{unix}", "/testbox/" + strconv.FormatInt(at.Unix(), 10)},
+	}
+	for _, test := range tests {
+		kt, err := ParseKeyTemplate(test.template)
+		require.NoError(t, err, test.template)
+		assert.Equal(t, test.key, kt.Key(at, "testbox", tsvGzFt), test.template)
+	}
+}
+
+func TestKeyTemplateUUID(t *testing.T) {
+	kt, err := ParseKeyTemplate("{hostname}/{uuid}.{ext}")
+	require.NoError(t, err)
+	at := time.Now()
+	first, second := kt.Key(at, "testbox", tsvGzFt), kt.Key(at, "testbox", tsvGzFt)
+	assert.NotEqual(t, first, second)
+	assert.Regexp(t, `^testbox/[0-9a-f-]{36}\.tsv\.gz$`, first)
+}
+
+func TestKeyTemplateInvalid(t *testing.T) {
+	for _, template := range []string{
+		"{hostname}/{minute}",
+		"{hostname:upper}",
+		"{date:}",
+		"{hostname/{unix}",
+		"{hostname}}",
+	} {
+		_, err := ParseKeyTemplate(template)
+		assert.Error(t, err, template)
+	}
+}
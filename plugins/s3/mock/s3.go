@@ -7,7 +7,11 @@ import (
 
 type MockS3Client struct {
 	s3iface.S3API
-	putObject func(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	putObject               func(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	createMultipartUpload   func(*s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)
+	uploadPart              func(*s3.UploadPartInput) (*s3.UploadPartOutput, error)
+	completeMultipartUpload func(*s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	abortMultipartUpload    func(*s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)
 }
 
 // SetPutObject sets the function that acts as the PutObject handler
@@ -18,3 +22,42 @@ func (m *MockS3Client) SetPutObject(f func(*s3.PutObjectInput) (*s3.PutObjectOut
 func (m *MockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
 	return m.putObject(input)
 }
+
+// SetCreateMultipartUpload sets the function that acts as the
+// CreateMultipartUpload handler
+func (m *MockS3Client) SetCreateMultipartUpload(f func(*s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)) {
+	m.createMultipartUpload = f
+}
+
+func (m *MockS3Client) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return m.createMultipartUpload(input)
+}
+
+// SetUploadPart sets the function that acts as the UploadPart handler
+func (m *MockS3Client) SetUploadPart(f func(*s3.UploadPartInput) (*s3.UploadPartOutput, error)) {
+	m.uploadPart = f
+}
+
+func (m *MockS3Client) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	return m.uploadPart(input)
+}
+
+// SetCompleteMultipartUpload sets the function that acts as the
+// CompleteMultipartUpload handler
+func (m *MockS3Client) SetCompleteMultipartUpload(f func(*s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)) {
+	m.completeMultipartUpload = f
+}
+
+func (m *MockS3Client) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	return m.completeMultipartUpload(input)
+}
+
+// SetAbortMultipartUpload sets the function that acts as the
+// AbortMultipartUpload handler
+func (m *MockS3Client) SetAbortMultipartUpload(f func(*s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)) {
+	m.abortMultipartUpload = f
+}
+
+func (m *MockS3Client) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	return m.abortMultipartUpload(input)
+}
@@ -0,0 +1,466 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/stripe/veneur/samplers"
+)
+
+// DefaultParquetRowGroupSize is how many rows are written in each row
+// group of a Parquet file, by default.
+const DefaultParquetRowGroupSize = 100000
+
+// parquetMagic starts and ends every Parquet file.
+const parquetMagic = "PAR1"
+
+const parquetFt filetype = "parquet"
+
+// The Parquet enums that the files use.
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetRepeated = 2
+
+	parquetUTF8            = 0
+	parquetMap             = 1
+	parquetMapKeyValue     = 2
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetSnappy   = 1
+	parquetDataPage = 0
+)
+
+// ParquetOptions configures the Parquet files that the plugin writes.
+type ParquetOptions struct {
+	// RowGroupSize is how many rows are written in each row group.
+	RowGroupSize int
+
+	// TagColumns are tag keys that are written to columns of their
+	// own, named "tag_" and the key, rather than to the tags map.
+	TagColumns []string
+}
+
+// Validate checks that the tag columns have names that are distinct,
+// once they're made fit for Athena and Glue.
+func (o ParquetOptions) Validate() error {
+	seen := map[string]string{}
+	for _, key := range o.TagColumns {
+		name := tagColumnName(key)
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("the tag columns %q and %q are both named %s", other, key, name)
+		}
+		seen[name] = key
+	}
+	return nil
+}
+
+// tagColumnName returns the name of a tag key's column: lowercase, with
+// anything but letters, digits and underscores replaced by underscores.
+func tagColumnName(key string) string {
+	return "tag_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, key)
+}
+
+// parquetRow is an InterMetric, as a row of a Parquet file.
+type parquetRow struct {
+	timestamp  int64
+	name       string
+	metricType string
+	value      float64
+	interval   int32
+	hostname   string
+	// tags are the tags that aren't in columns of their own, sorted by
+	// key. A tag without a value has a nil one.
+	tags []parquetTag
+	// tagColumns are the values of the tags that are, or nil.
+	tagColumns []*string
+}
+
+type parquetTag struct {
+	key   string
+	value *string
+}
+
+// newParquetRow converts an InterMetric to a row the same way as
+// EncodeInterMetricCSV: counters become rates over the interval, and
+// metrics of other types than counters and gauges are skipped.
+func newParquetRow(d samplers.InterMetric, hostname string, interval int, tagColumns []string) (parquetRow, bool) {
+	row := parquetRow{
+		timestamp: d.Timestamp * 1000,
+		name:      d.Name,
+		value:     d.Value,
+		interval:  int32(interval),
+		hostname:  hostname,
+	}
+	switch d.Type {
+	case samplers.CounterMetric:
+		row.metricType = "rate"
+		row.value = d.Value / float64(interval)
+	case samplers.GaugeMetric:
+		row.metricType = "gauge"
+	default:
+		return row, false
+	}
+
+	tags := map[string]*string{}
+	for _, tag := range d.Tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) == 2 {
+			tags[parts[0]] = &parts[1]
+		} else {
+			tags[parts[0]] = nil
+		}
+	}
+	row.tagColumns = make([]*string, len(tagColumns))
+	for i, key := range tagColumns {
+		if value, ok := tags[key]; ok {
+			if value == nil {
+				value = new(string)
+			}
+			row.tagColumns[i] = value
+			delete(tags, key)
+		}
+	}
+	for key, value := range tags {
+		row.tags = append(row.tags, parquetTag{key, value})
+	}
+	sort.Slice(row.tags, func(i, j int) bool {
+		return row.tags[i].key < row.tags[j].key
+	})
+	return row, true
+}
+
+// parquetChunk is the values of a column in a row group, with their
+// repetition and definition levels.
+type parquetChunk struct {
+	values bytes.Buffer
+	reps   []int
+	defs   []int
+}
+
+// level appends the levels of a value, or of a null.
+func (c *parquetChunk) level(rep, def int) {
+	c.reps = append(c.reps, rep)
+	c.defs = append(c.defs, def)
+}
+
+func (c *parquetChunk) int32(v int32) {
+	binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+func (c *parquetChunk) int64(v int64) {
+	binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+func (c *parquetChunk) double(v float64) {
+	binary.Write(&c.values, binary.LittleEndian, math.Float64bits(v))
+}
+
+func (c *parquetChunk) byteArray(v string) {
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(v)))
+	c.values.WriteString(v)
+}
+
+// parquetColumn is a leaf column of the schema.
+type parquetColumn struct {
+	path   []string
+	typ    int32
+	maxRep int
+	maxDef int
+	// add appends a row's values to the column's chunk.
+	add func(c *parquetChunk, r *parquetRow)
+}
+
+// parquetSchema returns the schema of the files, as the elements that
+// describe it (in the order Parquet's metadata lists them) and the leaf
+// columns that hold the data. It only changes with the tag columns, so
+// that tables over the files stay valid from flush to flush.
+func parquetSchema(tagColumns []string) ([]func(w *thriftWriter), []parquetColumn) {
+	element := func(name string, typ, repetition, convertedType, numChildren int32) func(w *thriftWriter) {
+		return func(w *thriftWriter) {
+			w.structBegin()
+			if typ >= 0 {
+				w.fieldI32(1, typ)
+			}
+			if repetition >= 0 {
+				w.fieldI32(3, repetition)
+			}
+			w.fieldString(4, name)
+			if numChildren > 0 {
+				w.fieldI32(5, numChildren)
+			}
+			if convertedType >= 0 {
+				w.fieldI32(6, convertedType)
+			}
+			w.structEnd()
+		}
+	}
+
+	elements := []func(w *thriftWriter){
+		element("schema", -1, -1, -1, int32(7+len(tagColumns))),
+		element("timestamp", parquetInt64, parquetRequired, parquetTimestampMillis, 0),
+		element("name", parquetByteArray, parquetRequired, parquetUTF8, 0),
+		element("type", parquetByteArray, parquetRequired, parquetUTF8, 0),
+		element("value", parquetDouble, parquetRequired, -1, 0),
+		element("interval", parquetInt32, parquetRequired, -1, 0),
+		element("veneur_hostname", parquetByteArray, parquetRequired, parquetUTF8, 0),
+		element("tags", -1, parquetOptional, parquetMap, 1),
+		element("key_value", -1, parquetRepeated, parquetMapKeyValue, 2),
+		element("key", parquetByteArray, parquetRequired, parquetUTF8, 0),
+		element("value", parquetByteArray, parquetOptional, parquetUTF8, 0),
+	}
+	columns := []parquetColumn{
+		{path: []string{"timestamp"}, typ: parquetInt64, add: func(c *parquetChunk, r *parquetRow) {
+			c.level(0, 0)
+			c.int64(r.timestamp)
+		}},
+		{path: []string{"name"}, typ: parquetByteArray, add: func(c *parquetChunk, r *parquetRow) {
+			c.level(0, 0)
+			c.byteArray(r.name)
+		}},
+		{path: []string{"type"}, typ: parquetByteArray, add: func(c *parquetChunk, r *parquetRow) {
+			c.level(0, 0)
+			c.byteArray(r.metricType)
+		}},
+		{path: []string{"value"}, typ: parquetDouble, add: func(c *parquetChunk, r *parquetRow) {
+			c.level(0, 0)
+			c.double(r.value)
+		}},
+		{path: []string{"interval"}, typ: parquetInt32, add: func(c *parquetChunk, r *parquetRow) {
+			c.level(0, 0)
+			c.int32(r.interval)
+		}},
+		{path: []string{"veneur_hostname"}, typ: parquetByteArray, add: func(c *parquetChunk, r *parquetRow) {
+			c.level(0, 0)
+			c.byteArray(r.hostname)
+		}},
+		// A row's tags map is never null, but can be empty:
+		{path: []string{"tags", "key_value", "key"}, typ: parquetByteArray, maxRep: 1, maxDef: 2, add: func(c *parquetChunk, r *parquetRow) {
+			if len(r.tags) == 0 {
+				c.level(0, 1)
+			}
+			for i, tag := range r.tags {
+				c.level(entryRep(i), 2)
+				c.byteArray(tag.key)
+			}
+		}},
+		{path: []string{"tags", "key_value", "value"}, typ: parquetByteArray, maxRep: 1, maxDef: 3, add: func(c *parquetChunk, r *parquetRow) {
+			if len(r.tags) == 0 {
+				c.level(0, 1)
+			}
+			for i, tag := range r.tags {
+				if tag.value == nil {
+					c.level(entryRep(i), 2)
+					continue
+				}
+				c.level(entryRep(i), 3)
+				c.byteArray(*tag.value)
+			}
+		}},
+	}
+	for i, key := range tagColumns {
+		i := i
+		name := tagColumnName(key)
+		elements = append(elements, element(name, parquetByteArray, parquetOptional, parquetUTF8, 0))
+		columns = append(columns, parquetColumn{path: []string{name}, typ: parquetByteArray, maxDef: 1, add: func(c *parquetChunk, r *parquetRow) {
+			if r.tagColumns[i] == nil {
+				c.level(0, 0)
+				return
+			}
+			c.level(0, 1)
+			c.byteArray(*r.tagColumns[i])
+		}})
+	}
+	return elements, columns
+}
+
+// entryRep returns the repetition level of the i-th entry of a row's
+// tags map: the first starts the row, and the rest repeat key_value.
+func entryRep(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return 1
+}
+
+// encodeLevels encodes levels with the RLE/bit-packing hybrid encoding,
+// as runs of repeated levels, preceded by their length.
+func encodeLevels(levels []int, maxLevel int) []byte {
+	width := (bits.Len(uint(maxLevel)) + 7) / 8
+	var runs bytes.Buffer
+	var header [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		n := binary.PutUvarint(header[:], uint64(j-i)<<1)
+		runs.Write(header[:n])
+		for b := 0; b < width; b++ {
+			runs.WriteByte(byte(levels[i] >> (8 * uint(b))))
+		}
+		i = j
+	}
+	out := make([]byte, 4, 4+runs.Len())
+	binary.LittleEndian.PutUint32(out, uint32(runs.Len()))
+	return append(out, runs.Bytes()...)
+}
+
+// parquetChunkMeta is where a column chunk was written, for the file's
+// metadata.
+type parquetChunkMeta struct {
+	column           *parquetColumn
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// writeChunk writes a column chunk as a single snappy-compressed data
+// page.
+func writeChunk(out *bytes.Buffer, col *parquetColumn, chunk *parquetChunk) parquetChunkMeta {
+	var page []byte
+	if col.maxRep > 0 {
+		page = append(page, encodeLevels(chunk.reps, col.maxRep)...)
+	}
+	if col.maxDef > 0 {
+		page = append(page, encodeLevels(chunk.defs, col.maxDef)...)
+	}
+	page = append(page, chunk.values.Bytes()...)
+	compressed := snappy.Encode(nil, page)
+
+	header := &thriftWriter{}
+	header.structBegin()
+	header.fieldI32(1, parquetDataPage)
+	header.fieldI32(2, int32(len(page)))
+	header.fieldI32(3, int32(len(compressed)))
+	header.fieldStruct(5, func() {
+		header.fieldI32(1, int32(len(chunk.defs)))
+		header.fieldI32(2, parquetPlain)
+		header.fieldI32(3, parquetRLE)
+		header.fieldI32(4, parquetRLE)
+	})
+	header.structEnd()
+
+	meta := parquetChunkMeta{
+		column:           col,
+		offset:           int64(out.Len()),
+		numValues:        int64(len(chunk.defs)),
+		uncompressedSize: int64(header.buf.Len() + len(page)),
+		compressedSize:   int64(header.buf.Len() + len(compressed)),
+	}
+	out.Write(header.buf.Bytes())
+	out.Write(compressed)
+	return meta
+}
+
+// EncodeInterMetricsParquet returns a reader containing a Parquet file of
+// the InterMetric data, one row per InterMetric, with snappy-compressed
+// columns: timestamp, name, type, value, interval, veneur_hostname, a
+// tags map, and a column for each of opts.TagColumns. Like
+// EncodeInterMetricsCSV, it returns a ReadSeeker, for the AWS sdk.
+func EncodeInterMetricsParquet(metrics []samplers.InterMetric, hostname string, interval int, opts ParquetOptions) (io.ReadSeeker, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	rowGroupSize := opts.RowGroupSize
+	if rowGroupSize <= 0 {
+		rowGroupSize = DefaultParquetRowGroupSize
+	}
+	elements, columns := parquetSchema(opts.TagColumns)
+
+	rows := make([]parquetRow, 0, len(metrics))
+	for _, metric := range metrics {
+		if row, ok := newParquetRow(metric, hostname, interval, opts.TagColumns); ok {
+			rows = append(rows, row)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(parquetMagic)
+	var rowGroups [][]parquetChunkMeta
+	var rowGroupRows []int
+	for start := 0; start < len(rows); start += rowGroupSize {
+		end := start + rowGroupSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var chunks []parquetChunkMeta
+		for i := range columns {
+			col := &columns[i]
+			chunk := &parquetChunk{}
+			for j := start; j < end; j++ {
+				col.add(chunk, &rows[j])
+			}
+			chunks = append(chunks, writeChunk(out, col, chunk))
+		}
+		rowGroups = append(rowGroups, chunks)
+		rowGroupRows = append(rowGroupRows, end-start)
+	}
+
+	footer := &thriftWriter{}
+	footer.structBegin()
+	footer.fieldI32(1, 1)
+	footer.fieldList(2, thriftStruct, len(elements), func(i int) {
+		elements[i](footer)
+	})
+	footer.fieldI64(3, int64(len(rows)))
+	footer.fieldList(4, thriftStruct, len(rowGroups), func(i int) {
+		var totalSize int64
+		footer.structBegin()
+		footer.fieldList(1, thriftStruct, len(rowGroups[i]), func(j int) {
+			chunk := rowGroups[i][j]
+			totalSize += chunk.uncompressedSize
+			footer.structBegin()
+			footer.fieldI64(2, chunk.offset)
+			footer.fieldStruct(3, func() {
+				footer.fieldI32(1, chunk.column.typ)
+				footer.fieldList(2, thriftI32, 2, func(k int) {
+					footer.listI32([]int32{parquetPlain, parquetRLE}[k])
+				})
+				footer.fieldList(3, thriftBinary, len(chunk.column.path), func(k int) {
+					footer.listString(chunk.column.path[k])
+				})
+				footer.fieldI32(4, parquetSnappy)
+				footer.fieldI64(5, chunk.numValues)
+				footer.fieldI64(6, chunk.uncompressedSize)
+				footer.fieldI64(7, chunk.compressedSize)
+				footer.fieldI64(9, chunk.offset)
+			})
+			footer.structEnd()
+		})
+		footer.fieldI64(2, totalSize)
+		footer.fieldI64(3, int64(rowGroupRows[i]))
+		footer.structEnd()
+	})
+	footer.fieldString(6, "veneur")
+	footer.structEnd()
+
+	out.Write(footer.buf.Bytes())
+	binary.Write(out, binary.LittleEndian, uint32(footer.buf.Len()))
+	out.WriteString(parquetMagic)
+	return bytes.NewReader(out.Bytes()), nil
+}
@@ -18,25 +18,85 @@ import (
 
 	"github.com/stripe/veneur/plugins"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
 )
 
 // TODO set log level
 
 var _ plugins.Plugin = &S3Plugin{}
 
+// The formats that the plugin writes flushes in.
+const (
+	FormatTSV     = "tsv"
+	FormatParquet = "parquet"
+)
+
 type S3Plugin struct {
 	Logger   *logrus.Logger
 	Svc      s3iface.S3API
 	S3Bucket string
 	Hostname string
 	Interval int
+
+	// Format is FormatTSV (the default), gzipped, or FormatParquet.
+	Format  string
+	Parquet ParquetOptions
+
+	// Key is the template of the keys that flushes are archived
+	// under; nil is DefaultKeyTemplate.
+	Key *KeyTemplate
+
+	// SSEKMS encrypts archives with KMS, with the key KMSKeyID, or with
+	// the AWS managed key if it's empty.
+	SSEKMS   bool
+	KMSKeyID string
+
+	// BucketOwnerFullControl gives the bucket's owner full control of
+	// archives, for buckets in other accounts.
+	BucketOwnerFullControl bool
+
+	// MultipartThreshold is the size past which archives are uploaded
+	// in parts; 0 is DefaultMultipartThreshold.
+	MultipartThreshold int
+
+	// TraceClient reports retried and failed uploads.
+	TraceClient *trace.Client
+
+	// retryBackoff is how long the first retry of an upload, or of a
+	// part of one, waits; the next ones wait twice as long as the last.
+	retryBackoff time.Duration
 }
 
+const (
+	// DefaultMultipartThreshold is the size past which archives are
+	// uploaded in parts, by default.
+	DefaultMultipartThreshold = 64 << 20
+
+	// multipartPartSize is the size of each part of a multipart
+	// upload, but the last.
+	multipartPartSize = 8 << 20
+
+	// maxAttempts bounds how many times an upload, or a part of one, is
+	// tried.
+	maxAttempts         = 3
+	defaultRetryBackoff = time.Second
+)
+
 func (p *S3Plugin) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
 	const Delimiter = '\t'
 	const IncludeHeaders = false
 
-	csv, err := EncodeInterMetricsCSV(metrics, Delimiter, IncludeHeaders, p.Hostname, p.Interval)
+	var data io.ReadSeeker
+	var err error
+	ft := filetype(tsvGzFt)
+	if p.Format == FormatParquet {
+		ft = parquetFt
+		data, err = EncodeInterMetricsParquet(metrics, p.Hostname, p.Interval, p.Parquet)
+	} else {
+		data, err = EncodeInterMetricsCSV(metrics, Delimiter, IncludeHeaders, p.Hostname, p.Interval)
+	}
 	if err != nil {
 		p.Logger.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
@@ -45,7 +105,7 @@ func (p *S3Plugin) Flush(ctx context.Context, metrics []samplers.InterMetric) er
 		return err
 	}
 
-	err = p.S3Post(p.Hostname, csv, tsvGzFt)
+	err = p.S3Post(p.Hostname, data, ft)
 	if err != nil {
 		p.Logger.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
@@ -76,20 +136,161 @@ var S3Bucket string
 
 var S3ClientUninitializedError = errors.New("s3 client has not been initialized")
 
+// S3Post uploads data to the plugin's bucket, retrying with backoff if it
+// fails. Data bigger than the multipart threshold is uploaded in parts.
 func (p *S3Plugin) S3Post(hostname string, data io.ReadSeeker, ft filetype) error {
 	if p.Svc == nil {
 		return S3ClientUninitializedError
 	}
-	params := &s3.PutObjectInput{
-		Bucket: aws.String(S3Bucket),
-		Key:    S3Path(hostname, ft),
-		Body:   data,
+	key := p.Key
+	if key == nil {
+		key, _ = ParseKeyTemplate(DefaultKeyTemplate)
+	}
+	bucket := p.S3Bucket
+	if bucket == "" {
+		bucket = S3Bucket
+	}
+	size, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	threshold := int64(p.MultipartThreshold)
+	if threshold <= 0 {
+		threshold = DefaultMultipartThreshold
+	}
+
+	upload := func() error {
+		if _, err := data.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		params := &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key.Key(time.Now(), hostname, string(ft))),
+			Body:   data,
+		}
+		p.setUploadOptions(&params.ServerSideEncryption, &params.SSEKMSKeyId, &params.ACL)
+		_, err := p.Svc.PutObject(params)
+		return err
+	}
+	if size > threshold {
+		upload = func() error {
+			return p.multipartUpload(bucket, key.Key(time.Now(), hostname, string(ft)), data, size)
+		}
+	}
+
+	samples := &ssf.Samples{}
+	defer metrics.Report(p.TraceClient, samples)
+	err = p.retry(upload, func(err error) {
+		p.Logger.WithError(err).Warn("Retrying an upload to s3")
+		samples.Add(ssf.Count("flush.plugins.s3.upload_retries_total", 1, nil))
+	})
+	if err != nil {
+		samples.Add(ssf.Count("flush.plugins.s3.upload_failures_total", 1, nil))
+	}
+	return err
+}
+
+// setUploadOptions sets the encryption and ACL of an upload, which are
+// the same fields of PutObjectInput and CreateMultipartUploadInput.
+func (p *S3Plugin) setUploadOptions(sse, kmsKeyID, acl **string) {
+	if p.SSEKMS {
+		*sse = aws.String(s3.ServerSideEncryptionAwsKms)
+		if p.KMSKeyID != "" {
+			*kmsKeyID = aws.String(p.KMSKeyID)
+		}
+	}
+	if p.BucketOwnerFullControl {
+		*acl = aws.String(s3.ObjectCannedACLBucketOwnerFullControl)
+	}
+}
+
+// retry calls f until it succeeds, up to maxAttempts times, backing off
+// between attempts. Each failure but the last is passed to retrying.
+func (p *S3Plugin) retry(f func() error, retrying func(error)) error {
+	backoff := p.retryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || attempt == maxAttempts {
+			return err
+		}
+		retrying(err)
+		time.Sleep(backoff << uint(attempt-1))
+	}
+}
+
+// multipartUpload uploads data in parts, retrying each part that
+// fails. If a part can't be uploaded, the upload is aborted, so that S3
+// doesn't keep its parts.
+func (p *S3Plugin) multipartUpload(bucket, key string, data io.ReadSeeker, size int64) error {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	p.setUploadOptions(&create.ServerSideEncryption, &create.SSEKMSKeyId, &create.ACL)
+	created, err := p.Svc.CreateMultipartUpload(create)
+	if err != nil {
+		return err
 	}
 
-	_, err := p.Svc.PutObject(params)
+	var parts []*s3.CompletedPart
+	for offset, number := int64(0), int64(1); offset < size; offset, number = offset+multipartPartSize, number+1 {
+		partSize := size - offset
+		if partSize > multipartPartSize {
+			partSize = multipartPartSize
+		}
+		part := make([]byte, partSize)
+		if _, err = data.Seek(offset, io.SeekStart); err == nil {
+			_, err = io.ReadFull(data, part)
+		}
+		var uploaded *s3.UploadPartOutput
+		if err == nil {
+			err = p.retry(func() error {
+				var err error
+				uploaded, err = p.Svc.UploadPart(&s3.UploadPartInput{
+					Bucket:     aws.String(bucket),
+					Key:        aws.String(key),
+					UploadId:   created.UploadId,
+					PartNumber: aws.Int64(number),
+					Body:       bytes.NewReader(part),
+				})
+				return err
+			}, func(err error) {
+				p.Logger.WithError(err).WithField("part", number).Warn("Retrying a part of an upload to s3")
+			})
+		}
+		if err != nil {
+			p.abortMultipartUpload(bucket, key, created.UploadId)
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: uploaded.ETag, PartNumber: aws.Int64(number)})
+	}
+
+	_, err = p.Svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		p.abortMultipartUpload(bucket, key, created.UploadId)
+	}
 	return err
 }
 
+func (p *S3Plugin) abortMultipartUpload(bucket, key string, uploadID *string) {
+	_, err := p.Svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		p.Logger.WithError(err).Warn("Couldn't abort a multipart upload to s3")
+	}
+}
+
 func S3Path(hostname string, ft filetype) *string {
 	t := time.Now()
 	filename := strconv.FormatInt(t.Unix(), 10) + "." + string(ft)
@@ -3,6 +3,8 @@ package s3
 import (
 	"compress/gzip"
 	"encoding/csv"
+	"errors"
+	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
@@ -174,3 +176,113 @@ func TestEncodeDDMetricsCSV(t *testing.T) {
 		})
 	}
 }
+
+func TestS3PostOptions(t *testing.T) {
+	plugin := stubS3()
+	plugin.S3Bucket = S3TestBucket
+	plugin.SSEKMS = true
+	plugin.KMSKeyID = "alias/veneur"
+	plugin.BucketOwnerFullControl = true
+	key, err := ParseKeyTemplate("{hostname}/{hour}.{ext}")
+	assert.NoError(t, err)
+	plugin.Key = key
+
+	var input *s3.PutObjectInput
+	plugin.Svc.(*s3Mock.MockS3Client).SetPutObject(func(i *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		input = i
+		return &s3.PutObjectOutput{}, nil
+	})
+	assert.NoError(t, plugin.S3Post("testbox", strings.NewReader("data"), tsvGzFt))
+	assert.Equal(t, S3TestBucket, *input.Bucket)
+	assert.Regexp(t, `^testbox/\d\d\.tsv\.gz$`, *input.Key)
+	assert.Equal(t, s3.ServerSideEncryptionAwsKms, *input.ServerSideEncryption)
+	assert.Equal(t, "alias/veneur", *input.SSEKMSKeyId)
+	assert.Equal(t, s3.ObjectCannedACLBucketOwnerFullControl, *input.ACL)
+}
+
+func TestS3PostRetries(t *testing.T) {
+	plugin := stubS3()
+	plugin.retryBackoff = time.Millisecond
+	var bodies []string
+	plugin.Svc.(*s3Mock.MockS3Client).SetPutObject(func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		body, err := ioutil.ReadAll(input.Body)
+		assert.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if len(bodies) < maxAttempts {
+			return nil, errors.New("throttled")
+		}
+		return &s3.PutObjectOutput{}, nil
+	})
+	assert.NoError(t, plugin.S3Post("testbox", strings.NewReader("data"), tsvGzFt))
+	// Each attempt uploads the whole of the data:
+	assert.Equal(t, []string{"data", "data", "data"}, bodies)
+
+	bodies = nil
+	plugin.Svc.(*s3Mock.MockS3Client).SetPutObject(func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		bodies = append(bodies, "")
+		return nil, errors.New("access denied")
+	})
+	assert.Error(t, plugin.S3Post("testbox", strings.NewReader("data"), tsvGzFt))
+	assert.Len(t, bodies, maxAttempts)
+}
+
+func TestS3PostMultipart(t *testing.T) {
+	plugin := stubS3()
+	plugin.retryBackoff = time.Millisecond
+	plugin.MultipartThreshold = 10
+	plugin.SSEKMS = true
+	client := plugin.Svc.(*s3Mock.MockS3Client)
+	client.SetPutObject(func(*s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		t.Error("uploaded data above the threshold in one part")
+		return nil, errors.New("unexpected")
+	})
+	client.SetCreateMultipartUpload(func(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+		assert.Equal(t, s3.ServerSideEncryptionAwsKms, *input.ServerSideEncryption)
+		return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+	})
+	var parts [][]byte
+	failures := 0
+	client.SetUploadPart(func(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+		assert.Equal(t, "upload", *input.UploadId)
+		// The second part fails once:
+		if *input.PartNumber == 2 && failures == 0 {
+			failures++
+			return nil, errors.New("slow down")
+		}
+		part, err := ioutil.ReadAll(input.Body)
+		assert.NoError(t, err)
+		parts = append(parts, part)
+		return &s3.UploadPartOutput{ETag: aws.String(strconv.FormatInt(*input.PartNumber, 10))}, nil
+	})
+	var completed *s3.CompleteMultipartUploadInput
+	client.SetCompleteMultipartUpload(func(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+		completed = input
+		return &s3.CompleteMultipartUploadOutput{}, nil
+	})
+
+	data := strings.Repeat("x", multipartPartSize) + "tail"
+	assert.NoError(t, plugin.S3Post("testbox", strings.NewReader(data), tsvGzFt))
+	if assert.Len(t, parts, 2) {
+		assert.Len(t, parts[0], multipartPartSize)
+		assert.Equal(t, "tail", string(parts[1]))
+	}
+	if assert.NotNil(t, completed) {
+		assert.Len(t, completed.MultipartUpload.Parts, 2)
+		assert.Equal(t, "2", *completed.MultipartUpload.Parts[1].ETag)
+		assert.Equal(t, int64(2), *completed.MultipartUpload.Parts[1].PartNumber)
+	}
+
+	// A part that keeps failing aborts the upload:
+	client.SetUploadPart(func(*s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+		return nil, errors.New("internal error")
+	})
+	aborted := 0
+	client.SetAbortMultipartUpload(func(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+		assert.Equal(t, "upload", *input.UploadId)
+		aborted++
+		return &s3.AbortMultipartUploadOutput{}, nil
+	})
+	assert.Error(t, plugin.S3Post("testbox", strings.NewReader(data), tsvGzFt))
+	// Each attempt of the upload is aborted:
+	assert.Equal(t, maxAttempts, aborted)
+}
@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The types of the Thrift compact protocol, which Parquet's metadata is
+// written in.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes structs with the Thrift compact protocol. Fields
+// must be written in increasing order of their ids, as the protocol
+// writes the difference from the previous field's id.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// lastField is the id of the last field written in each struct
+	// being written, innermost last.
+	lastField []int16
+}
+
+func (w *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf.Write(b[:n])
+}
+
+func (w *thriftWriter) zigzag(v int64) {
+	w.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &w.lastField[len(w.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.zigzag(int64(id))
+	}
+	*last = id
+}
+
+// structBegin starts a struct, which is ended by structEnd.
+func (w *thriftWriter) structBegin() {
+	w.lastField = append(w.lastField, 0)
+}
+
+func (w *thriftWriter) structEnd() {
+	w.buf.WriteByte(0)
+	w.lastField = w.lastField[:len(w.lastField)-1]
+}
+
+func (w *thriftWriter) fieldI32(id int16, v int32) {
+	w.fieldHeader(id, thriftI32)
+	w.zigzag(int64(v))
+}
+
+func (w *thriftWriter) fieldI64(id int16, v int64) {
+	w.fieldHeader(id, thriftI64)
+	w.zigzag(v)
+}
+
+func (w *thriftWriter) fieldString(id int16, v string) {
+	w.fieldHeader(id, thriftBinary)
+	w.varint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+// fieldStruct writes a struct field, whose fields are written by body.
+func (w *thriftWriter) fieldStruct(id int16, body func()) {
+	w.fieldHeader(id, thriftStruct)
+	w.structBegin()
+	body()
+	w.structEnd()
+}
+
+// fieldList writes a list field of n elements of a type. Elements that
+// are structs are written by calling structBegin and structEnd.
+func (w *thriftWriter) fieldList(id int16, elemType byte, n int, elem func(i int)) {
+	w.fieldHeader(id, thriftList)
+	if n < 15 {
+		w.buf.WriteByte(byte(n)<<4 | elemType)
+	} else {
+		w.buf.WriteByte(0xf0 | elemType)
+		w.varint(uint64(n))
+	}
+	for i := 0; i < n; i++ {
+		elem(i)
+	}
+}
+
+// listI32 and listString write elements of lists.
+func (w *thriftWriter) listI32(v int32) {
+	w.zigzag(int64(v))
+}
+
+func (w *thriftWriter) listString(v string) {
+	w.varint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
@@ -4,8 +4,20 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strings"
 )
 
+// TLSTCPAddr is the address of a TCP listener whose connections are
+// encrypted with TLS, from a tls+tcp:// URL.
+type TLSTCPAddr struct {
+	*net.TCPAddr
+}
+
+// Network returns "tls+tcp".
+func (a *TLSTCPAddr) Network() string {
+	return "tls+" + a.TCPAddr.Network()
+}
+
 // ResolveAddr takes a URL-style listen address specification,
 // resolves it and returns a net.Addr that corresponds to the
 // string. If any error (in URL decoding, destructuring or resolving)
@@ -14,7 +26,9 @@ import (
 // Valid address examples are:
 //   udp6://127.0.0.1:8000
 //   unix:///tmp/foo.sock
+//   unix://@veneur-ssf (a socket in Linux's abstract namespace)
 //   tcp://127.0.0.1:9002
+//   tls+tcp://127.0.0.1:8128
 func ResolveAddr(str string) (net.Addr, error) {
 	u, err := url.Parse(str)
 	if err != nil {
@@ -22,7 +36,13 @@ func ResolveAddr(str string) (net.Addr, error) {
 	}
 	switch u.Scheme {
 	case "unix", "unixgram", "unixpacket":
-		addr, err := net.ResolveUnixAddr(u.Scheme, u.Path)
+		path := u.Path
+		if name := strings.TrimPrefix(str, u.Scheme+"://@"); name != str {
+			// abstract sockets' names start with @, which
+			// url.Parse takes for the end of the userinfo
+			path = "@" + name
+		}
+		addr, err := net.ResolveUnixAddr(u.Scheme, path)
 		if err != nil {
 			return nil, err
 		}
@@ -33,6 +53,12 @@ func ResolveAddr(str string) (net.Addr, error) {
 			return nil, err
 		}
 		return addr, nil
+	case "tls+tcp6", "tls+tcp4", "tls+tcp":
+		addr, err := net.ResolveTCPAddr(strings.TrimPrefix(u.Scheme, "tls+"), u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &TLSTCPAddr{addr}, nil
 	case "udp6", "udp4", "udp":
 		addr, err := net.ResolveUDPAddr(u.Scheme, u.Host)
 		if err != nil {
@@ -18,6 +18,8 @@ func TestListenAddr(t *testing.T) {
 		{"unix:///tmp/foo.sock", "unix", "/tmp/foo.sock"},
 		{"unixgram:///tmp/foo.sock", "unixgram", "/tmp/foo.sock"},
 		{"unixpacket:///tmp/foo.sock", "unixpacket", "/tmp/foo.sock"},
+		{"unix://@veneur-ssf", "unix", "@veneur-ssf"},
+		{"tls+tcp://127.0.0.1:8128", "tls+tcp", "127.0.0.1:8128"},
 	}
 	for _, test := range tests {
 		addr, err := ResolveAddr(test.input)
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/veneur/ssf"
+)
+
+// The frame version of a batch of SSF spans.
+const version1Batch uint8 = 1
+
+// batchDatagramPrefix starts the datagrams that carry a batch of SSF
+// spans. Protobuf messages never start with a 0 byte (it's the tag of
+// field number 0, which is invalid), so veneurs that can't read batches
+// fail to parse them, rather than misreading them.
+var batchDatagramPrefix = [2]byte{0, version1Batch}
+
+// Batch accumulates SSF spans that are sent together, as one frame on
+// a stream (with frame version 1) or as one datagram. Their content is
+// the spans, each protobuf-encoded and preceded by its length in
+// octets, as a 32-bit number in network byte order.
+//
+// Only veneurs that read batches should be sent them: the others drop
+// batch datagrams as unparseable, and close the streams that they're
+// sent on with a framing error.
+type Batch struct {
+	// buf is the batch's datagram: the prefix, then the content
+	buf   []byte
+	spans int
+}
+
+// Add encodes a span at the end of the batch.
+func (b *Batch) Add(span *ssf.SSFSpan) error {
+	bts, err := proto.Marshal(span)
+	if err != nil {
+		return err
+	}
+	if len(b.buf) == 0 {
+		b.buf = append(b.buf, batchDatagramPrefix[:]...)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(bts)))
+	b.buf = append(append(b.buf, length[:]...), bts...)
+	b.spans++
+	return nil
+}
+
+// Len returns the length of the batch's content, in octets.
+func (b *Batch) Len() int {
+	return len(b.content())
+}
+
+func (b *Batch) content() []byte {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	return b.buf[len(batchDatagramPrefix):]
+}
+
+// Spans returns how many spans are in the batch.
+func (b *Batch) Spans() int {
+	return b.spans
+}
+
+// Reset empties the batch, keeping its buffer for the next one.
+func (b *Batch) Reset() {
+	b.buf = b.buf[:0]
+	b.spans = 0
+}
+
+// Datagram returns the batch as a datagram. It's only valid until the
+// batch changes.
+func (b *Batch) Datagram() []byte {
+	if len(b.buf) == 0 {
+		return append([]byte{}, batchDatagramPrefix[:]...)
+	}
+	return b.buf
+}
+
+// WriteFrame writes the batch onto a stream as a v1 frame, and returns
+// the number of bytes of content written. Errors matching
+// IsFramingError poison the stream, as with WriteSSF.
+func (b *Batch) WriteFrame(out io.Writer) (int, error) {
+	content := b.content()
+	if uint32(len(content)) > MaxSSFPacketLength {
+		return 0, &errFrameLength{uint32(len(content))}
+	}
+	if err := binary.Write(out, binary.BigEndian, version1Batch); err != nil {
+		return 0, &errFramingIO{err}
+	}
+	if err := binary.Write(out, binary.BigEndian, uint32(len(content))); err != nil {
+		return 0, &errFramingIO{err}
+	}
+	n, err := out.Write(content)
+	if err != nil {
+		return n, &errFramingIO{err}
+	}
+	return n, nil
+}
+
+// IsBatchDatagram reports whether a datagram carries a batch of spans,
+// for ParseSSFBatchDatagram, rather than a single one, for ParseSSF.
+func IsBatchDatagram(packet []byte) bool {
+	return len(packet) >= len(batchDatagramPrefix) &&
+		packet[0] == batchDatagramPrefix[0] && packet[1] == batchDatagramPrefix[1]
+}
+
+// ParseSSFBatchDatagram parses the spans of a batch datagram like
+// ParseSSFBatch.
+func ParseSSFBatchDatagram(packet []byte, maxSpans int) ([]*ssf.SSFSpan, error) {
+	if !IsBatchDatagram(packet) {
+		return nil, fmt.Errorf("not an SSF batch datagram")
+	}
+	return ParseSSFBatch(packet[len(batchDatagramPrefix):], maxSpans)
+}
+
+// ParseSSFBatch parses the normalized spans of a batch frame's content,
+// like ParseSSF. If the batch has more than maxSpans spans, unless
+// that's 0, it returns a BatchTooLarge error. It returns no spans if
+// there's any error.
+func ParseSSFBatch(content []byte, maxSpans int) ([]*ssf.SSFSpan, error) {
+	var spans []*ssf.SSFSpan
+	for len(content) > 0 {
+		if len(content) < 4 {
+			return nil, fmt.Errorf("truncated SSF batch: %d octets left", len(content))
+		}
+		length := binary.BigEndian.Uint32(content)
+		content = content[4:]
+		if uint64(length) > uint64(len(content)) {
+			return nil, fmt.Errorf("truncated SSF batch: span of %d octets, %d left", length, len(content))
+		}
+		if maxSpans > 0 && len(spans) == maxSpans {
+			return nil, &BatchTooLarge{maxSpans}
+		}
+		span, err := ParseSSF(content[:length])
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+		content = content[length:]
+	}
+	return spans, nil
+}
+
+// BatchTooLarge is the error for batches of more spans than allowed.
+type BatchTooLarge struct {
+	MaxSpans int
+}
+
+func (err *BatchTooLarge) Error() string {
+	return fmt.Sprintf("SSF batch has more than %d spans", err.MaxSpans)
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+func testBatch(t *testing.T, n int) *Batch {
+	batch := &Batch{}
+	for i := 0; i < n; i++ {
+		require.NoError(t, batch.Add(&ssf.SSFSpan{
+			Version:        1,
+			TraceId:        1,
+			Id:             int64(i + 2),
+			StartTimestamp: 9000,
+			EndTimestamp:   9001,
+			Name:           fmt.Sprintf("span-%d", i),
+		}))
+	}
+	return batch
+}
+
+func TestBatchFrame(t *testing.T) {
+	batch := testBatch(t, 3)
+	assert.Equal(t, 3, batch.Spans())
+
+	buf := &bytes.Buffer{}
+	n, err := batch.WriteFrame(buf)
+	require.NoError(t, err)
+	assert.Equal(t, batch.Len(), n)
+
+	frame, isBatch, err := ReadSSFStreamFrame(buf, MaxSSFPacketLength)
+	require.NoError(t, err)
+	require.True(t, isBatch)
+	spans, err := ParseSSFBatch(frame, 0)
+	require.NoError(t, err)
+	require.Len(t, spans, 3)
+	for i, span := range spans {
+		assert.Equal(t, fmt.Sprintf("span-%d", i), span.Name)
+	}
+}
+
+func TestBatchDatagram(t *testing.T) {
+	batch := testBatch(t, 2)
+	packet := batch.Datagram()
+	require.True(t, IsBatchDatagram(packet))
+	spans, err := ParseSSFBatchDatagram(packet, 2)
+	require.NoError(t, err)
+	assert.Len(t, spans, 2)
+
+	// Veneurs that don't read batches can't mistake them for a span:
+	_, err = ParseSSF(packet)
+	assert.Error(t, err)
+
+	span, err := proto.Marshal(&ssf.SSFSpan{Version: 1, Id: 1, TraceId: 1, Name: "single"})
+	require.NoError(t, err)
+	assert.False(t, IsBatchDatagram(span))
+
+	batch.Reset()
+	assert.Equal(t, 0, batch.Spans())
+	assert.Equal(t, 0, batch.Len())
+	spans, err = ParseSSFBatchDatagram(batch.Datagram(), 0)
+	require.NoError(t, err)
+	assert.Empty(t, spans)
+}
+
+func TestParseSSFBatchTooLarge(t *testing.T) {
+	batch := testBatch(t, 3)
+	_, err := ParseSSFBatch(batch.content(), 2)
+	require.Error(t, err)
+	tooLarge, ok := err.(*BatchTooLarge)
+	require.True(t, ok, "%v should be a BatchTooLarge", err)
+	assert.Equal(t, 2, tooLarge.MaxSpans)
+}
+
+func TestParseSSFBatchTruncated(t *testing.T) {
+	content := testBatch(t, 2).content()
+	for _, cut := range []int{1, 3, 6} {
+		_, err := ParseSSFBatch(content[:len(content)-cut], 0)
+		assert.Error(t, err, "cut %d octets", cut)
+	}
+}
+
+func TestReadSSFFrameMaxRejectsBatch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	_, err := testBatch(t, 1).WriteFrame(buf)
+	require.NoError(t, err)
+
+	_, err = ReadSSFFrameMax(buf, MaxSSFPacketLength)
+	require.Error(t, err)
+	assert.True(t, IsFramingError(err))
+}
@@ -10,6 +10,11 @@ func (err *errFramingIO) Error() string {
 	return fmt.Sprintf("SSF framing I/O error: %v", err.err)
 }
 
+// Unwrap returns the I/O error.
+func (err *errFramingIO) Unwrap() error {
+	return err.err
+}
+
 type errFrameVersion struct {
 	actual uint8
 }
@@ -40,3 +45,18 @@ func IsFramingError(err error) bool {
 	}
 	return false
 }
+
+// IsFrameVersionError returns true if an error is the framing error
+// for a frame with an unknown version, which usually means that what
+// was read wasn't SSF.
+func IsFrameVersionError(err error) bool {
+	_, ok := err.(*errFrameVersion)
+	return ok
+}
+
+// IsFrameLengthError returns true if an error is the framing error for
+// a frame longer than the maximum length that was read.
+func IsFrameLengthError(err error) bool {
+	_, ok := err.(*errFrameLength)
+	return ok
+}
@@ -15,4 +15,9 @@ func TestFramingError(t *testing.T) {
 	assert.True(t, IsFramingError(&errFramingIO{fmt.Errorf("oh hai")}))
 
 	assert.False(t, IsFramingError(os.ErrClosed))
+
+	assert.True(t, IsFrameLengthError(&errFrameLength{0}))
+	assert.False(t, IsFrameLengthError(&errFrameVersion{1}))
+	assert.True(t, IsFrameVersionError(&errFrameVersion{1}))
+	assert.False(t, IsFrameVersionError(&errFramingIO{fmt.Errorf("oh hai")}))
 }
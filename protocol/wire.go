@@ -13,9 +13,9 @@
 //   [32 bits - length of framed message in octets]
 //   [<length> - SSF message]
 //
-// The version and type of message can currently only be set to the
-// value 0, which means that what follows is a protobuf-encoded
-// ssf.SSFSpan.
+// The version and type of message can be set to the value 0, which
+// means that what follows is a protobuf-encoded ssf.SSFSpan, or 1,
+// which means that what follows is a batch of them (see Batch).
 //
 // The length of the framed message is a number of octets (8-bit
 // bytes) in network byte order (big-endian), specifying the number of
@@ -68,32 +68,71 @@ func readFrame(in io.Reader, length int) ([]byte, error) {
 }
 
 // InvalidTrace is an error type indicating that an SSF span was
-// invalid.
+// invalid. Its Cause is the first field that ValidateTrace found
+// missing.
 type InvalidTrace struct {
-	span *ssf.SSFSpan
+	span  *ssf.SSFSpan
+	Cause InvalidTraceCause
 }
 
 func (e *InvalidTrace) Error() string {
-	return fmt.Sprintf("not a valid trace span: %#v", e.span)
+	return fmt.Sprintf("not a valid trace span (%v): %#v", e.Cause, e.span)
+}
+
+// InvalidTraceCause is why a span isn't a valid trace span.
+type InvalidTraceCause int
+
+// The causes of an InvalidTrace: a span needs an ID, a trace ID (in
+// either half, for 128-bit trace IDs), and start and end timestamps.
+const (
+	ZeroID InvalidTraceCause = iota + 1
+	ZeroTraceID
+	ZeroStartTimestamp
+	ZeroEndTimestamp
+)
+
+var invalidTraceCauses = map[InvalidTraceCause]string{
+	ZeroID:             "zero_id",
+	ZeroTraceID:        "zero_trace_id",
+	ZeroStartTimestamp: "zero_start_timestamp",
+	ZeroEndTimestamp:   "zero_end_timestamp",
+}
+
+// String returns the cause in snake case, for metric tags.
+func (c InvalidTraceCause) String() string {
+	if s, ok := invalidTraceCauses[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("InvalidTraceCause(%d)", int(c))
+}
+
+// invalidTraceCause returns why a span isn't a valid trace span, or 0
+// if it is one.
+func invalidTraceCause(span *ssf.SSFSpan) InvalidTraceCause {
+	switch {
+	case span.Id == 0:
+		return ZeroID
+	case span.TraceId == 0 && span.TraceIdHigh == 0:
+		return ZeroTraceID
+	case span.StartTimestamp == 0:
+		return ZeroStartTimestamp
+	case span.EndTimestamp == 0:
+		return ZeroEndTimestamp
+	}
+	return 0
 }
 
 // ValidTrace takes in an SSF span and determines if it is valid or not.
-// It also makes sure the Tags is non-nil, since we use it later.
 func ValidTrace(span *ssf.SSFSpan) bool {
-	ret := true
-	ret = ret && span.Id != 0
-	ret = ret && span.TraceId != 0
-	ret = ret && span.StartTimestamp != 0
-	ret = ret && span.EndTimestamp != 0
-	return ret
+	return invalidTraceCause(span) == 0
 }
 
 // ValidateTrace takes in an SSF span and determines if it is valid or
-// not.  It also makes sure the Tags is non-nil, since we use it
-// later. If the span is not valid, it returns an error.
+// not. If the span is not valid, it returns an *InvalidTrace with the
+// cause.
 func ValidateTrace(span *ssf.SSFSpan) error {
-	if !ValidTrace(span) {
-		return &InvalidTrace{span}
+	if cause := invalidTraceCause(span); cause != 0 {
+		return &InvalidTrace{span: span, Cause: cause}
 	}
 	return nil
 }
@@ -107,30 +146,58 @@ func ValidateTrace(span *ssf.SSFSpan) error {
 // at the start of a message (e.g. if a connection was closed after
 // the last message).
 func ReadSSF(in io.Reader) (*ssf.SSFSpan, error) {
+	bts, err := ReadSSFFrame(in)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSSF(bts)
+}
+
+// ReadSSFFrame reads a framed SSF span from a stream like ReadSSF, but
+// returns the unparsed SSF message, for ParseSSF.
+func ReadSSFFrame(in io.Reader) ([]byte, error) {
+	return ReadSSFFrameMax(in, MaxSSFPacketLength)
+}
+
+// ReadSSFFrameMax is ReadSSFFrame, with a framing error for frames
+// longer than max bytes, which may be at most MaxSSFPacketLength.
+func ReadSSFFrameMax(in io.Reader, max uint32) ([]byte, error) {
+	frame, _, err := readSSFFrame(in, max, false)
+	return frame, err
+}
+
+// ReadSSFStreamFrame is ReadSSFFrameMax, but also reads batch frames.
+// It reports whether the frame is a batch, for ParseSSFBatch, or a
+// single span, for ParseSSF.
+func ReadSSFStreamFrame(in io.Reader, max uint32) (frame []byte, batch bool, err error) {
+	return readSSFFrame(in, max, true)
+}
+
+func readSSFFrame(in io.Reader, max uint32, batches bool) ([]byte, bool, error) {
 	var version uint8
 	var length uint32
 	if err := binary.Read(in, binary.BigEndian, &version); err != nil {
 		if err == io.EOF {
 			// EOF/hang-ups at the start of a new message
 			// are fine, pass them through as-is.
-			return nil, err
+			return nil, false, err
 		}
-		return nil, &errFramingIO{err}
+		return nil, false, &errFramingIO{err}
 	}
-	if version != version0 {
-		return nil, &errFrameVersion{version}
+	if version != version0 && (version != version1Batch || !batches) {
+		return nil, false, &errFrameVersion{version}
 	}
 	if err := binary.Read(in, binary.BigEndian, &length); err != nil {
-		return nil, &errFramingIO{err}
+		return nil, false, &errFramingIO{err}
 	}
-	if length > MaxSSFPacketLength {
-		return nil, &errFrameLength{length}
+	if length > max || length > MaxSSFPacketLength {
+		return nil, false, &errFrameLength{length}
 	}
 	bts, err := readFrame(in, int(length))
 	if err != nil {
-		return nil, &errFramingIO{err}
+		return nil, false, &errFramingIO{err}
 	}
-	return ParseSSF(bts)
+	return bts, version == version1Batch, nil
 }
 
 // ParseSSF takes in a byte slice and returns: a normalized SSFSpan
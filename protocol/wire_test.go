@@ -80,6 +80,46 @@ func TestEOF(t *testing.T) {
 	}
 }
 
+func TestReadSSFFrameMax(t *testing.T) {
+	msg := &ssf.SSFSpan{Version: 1, TraceId: 1, Id: 2, Name: "a long enough name"}
+	buf := bytes.NewBuffer([]byte{})
+	n, err := WriteSSF(buf, msg)
+	require.NoError(t, err)
+	length := uint32(n)
+
+	frame := buf.Bytes()
+	read, err := ReadSSFFrameMax(bytes.NewReader(frame), length)
+	require.NoError(t, err)
+	assert.Len(t, read, int(length))
+
+	read, err = ReadSSFFrameMax(bytes.NewReader(frame), length-1)
+	assert.True(t, IsFramingError(err))
+	assert.Nil(t, read)
+}
+
+func TestValidateTraceCauses(t *testing.T) {
+	span := &ssf.SSFSpan{}
+	for _, cause := range []InvalidTraceCause{ZeroID, ZeroTraceID, ZeroStartTimestamp, ZeroEndTimestamp} {
+		err := ValidateTrace(span)
+		require.IsType(t, &InvalidTrace{}, err)
+		assert.Equal(t, cause, err.(*InvalidTrace).Cause)
+		assert.False(t, ValidTrace(span))
+		switch cause {
+		case ZeroID:
+			span.Id = 1
+		case ZeroTraceID:
+			span.TraceIdHigh = 1
+		case ZeroStartTimestamp:
+			span.StartTimestamp = 1
+		case ZeroEndTimestamp:
+			span.EndTimestamp = 2
+		}
+	}
+	assert.NoError(t, ValidateTrace(span))
+	assert.True(t, ValidTrace(span))
+	assert.Equal(t, "zero_trace_id", ZeroTraceID.String())
+}
+
 func TestReadSSFStreamBad(t *testing.T) {
 	msg := &ssf.SSFSpan{
 		Version:        1,
@@ -1,11 +1,11 @@
 package veneur
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
-	"net/url"
 	"os"
 	"reflect"
 	"runtime"
@@ -23,6 +23,7 @@ import (
 	"github.com/hashicorp/consul/api"
 	"github.com/pkg/profile"
 	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/forwardrpc"
 	vhttp "github.com/stripe/veneur/http"
 	"github.com/stripe/veneur/proxysrv"
 	"github.com/stripe/veneur/samplers"
@@ -35,6 +36,7 @@ import (
 
 	"goji.io"
 	"goji.io/pat"
+	"google.golang.org/grpc"
 )
 
 type Proxy struct {
@@ -69,6 +71,37 @@ type Proxy struct {
 	grpcServer        *proxysrv.Server
 	grpcListenAddress string
 
+	// Forwarding metrics received over HTTP with gRPC
+	forwardUseGRPC      bool
+	forwardGRPCPort     int
+	forwardGRPCDialOpts []grpc.DialOption
+	forwardGRPCMtx      sync.Mutex
+	forwardGRPCConns    map[string]*proxyGRPCDestination
+
+	// What to do with metrics that couldn't be forwarded
+	forwardRetryMode string
+	forwardBufferMtx sync.Mutex
+	forwardBuffer    []samplers.JSONMetric
+
+	// TLS for forwarding over HTTP
+	forwardTLS       *vhttp.TLSFiles
+	forwardTLSClient *http.Client
+
+	// Per-destination forwarding queues
+	forwardQueueSize    int
+	forwardQueueWorkers int
+	forwardQueuesMtx    sync.Mutex
+	forwardQueues       map[string]*forwardQueue
+	forwardQueuesClosed bool
+
+	// proxying are the batches of metrics imported over HTTP that
+	// are still being proxied.
+	proxying sync.WaitGroup
+
+	// Evicting failing destinations from the forwarding ring
+	forwardHealth        *destinationHealth
+	forwardProbeInterval time.Duration
+
 	// HTTP
 	// An atomic boolean for whether or not the HTTP server is listening
 	numListeningHTTP *int32
@@ -114,6 +147,27 @@ func NewProxyFromConfig(logger *logrus.Logger, conf ProxyConfig) (p Proxy, err e
 	p.HTTPClient = &http.Client{
 		Transport: transport,
 	}
+
+	p.forwardTLS, err = vhttp.LoadTLSFiles(
+		conf.ForwardTLSCertificateFile,
+		conf.ForwardTLSKeyFile,
+		conf.ForwardTLSAuthorityCertificateFile,
+	)
+	if err != nil {
+		logger.WithError(err).Error("Improper forwarding TLS configuration")
+		return
+	}
+	if p.forwardTLS != nil {
+		// Forwarding gets its own transport, so that Consul and trace
+		// requests aren't sent with the client certificate.
+		forwardTransport := &http.Transport{
+			IdleConnTimeout:     idleTimeout,
+			MaxIdleConns:        conf.MaxIdleConns,
+			MaxIdleConnsPerHost: conf.MaxIdleConnsPerHost,
+		}
+		p.forwardTLS.ConfigureTransport(forwardTransport, conf.ForwardTLSServerName)
+		p.forwardTLSClient = &http.Client{Transport: forwardTransport}
+	}
 	p.numListeningHTTP = new(int32)
 
 	p.enableProfiling = conf.EnableProfiling
@@ -167,6 +221,31 @@ func NewProxyFromConfig(logger *logrus.Logger, conf ProxyConfig) (p Proxy, err e
 		}
 	}
 
+	if err = validateProxyForwardRetryMode(conf.ProxyForwardRetryMode); err != nil {
+		logger.WithError(err).Error("Invalid forward retry mode")
+		return
+	}
+	p.forwardRetryMode = conf.ProxyForwardRetryMode
+	if p.forwardRetryMode == "" {
+		p.forwardRetryMode = proxyForwardRetryNone
+	}
+
+	p.forwardQueueSize = conf.ForwardQueueSize
+	p.forwardQueueWorkers = conf.ForwardQueueWorkers
+	p.forwardQueues = map[string]*forwardQueue{}
+
+	p.forwardHealth = newDestinationHealth(conf.ForwardEvictionThreshold)
+	p.forwardProbeInterval = defaultForwardProbeInterval
+	if conf.ForwardEvictionProbeInterval != "" {
+		p.forwardProbeInterval, err = time.ParseDuration(conf.ForwardEvictionProbeInterval)
+		if err != nil {
+			logger.WithError(err).
+				WithField("value", conf.ForwardEvictionProbeInterval).
+				Error("Could not parse forward eviction probe interval")
+			return
+		}
+	}
+
 	// We got a static forward address, stick it in the destination!
 	if p.ConsulForwardService == "" && conf.ForwardAddress != "" {
 		p.ForwardDestinations.Add(conf.ForwardAddress)
@@ -244,12 +323,32 @@ func NewProxyFromConfig(logger *logrus.Logger, conf ProxyConfig) (p Proxy, err e
 		}
 	}
 
+	var forwardTLS *tls.Config
+	if conf.GrpcAddress != "" || conf.ForwardUseGrpc {
+		forwardTLS, err = forwardrpc.NewClientTLSConfig(
+			conf.ForwardGrpcTLSAuthorityCertificate,
+			conf.ForwardGrpcTLSCertificate,
+			conf.ForwardGrpcTLSKey,
+		)
+		if err != nil {
+			logger.WithError(err).Fatal("Improper gRPC forwarding TLS configuration")
+		}
+	}
+
+	p.forwardUseGRPC = conf.ForwardUseGrpc
+	p.forwardGRPCPort = conf.ForwardGrpcPort
+	p.forwardGRPCConns = map[string]*proxyGRPCDestination{}
+	if p.forwardUseGRPC {
+		p.forwardGRPCDialOpts = forwardrpc.ClientDialOptions(forwardTLS, conf.ForwardGrpcAuthToken)
+	}
+
 	if conf.GrpcAddress != "" {
 		p.grpcListenAddress = conf.GrpcAddress
 		p.grpcServer, err = proxysrv.New(p.ForwardGRPCDestinations,
 			proxysrv.WithForwardTimeout(p.ForwardTimeout),
 			proxysrv.WithLog(logrus.NewEntry(log)),
 			proxysrv.WithTraceClient(p.TraceClient),
+			proxysrv.WithDialOptions(forwardrpc.ClientDialOptions(forwardTLS, conf.ForwardGrpcAuthToken)...),
 		)
 		if err != nil {
 			logger.WithError(err).Fatal("Failed to initialize the gRPC server")
@@ -263,7 +362,8 @@ func NewProxyFromConfig(logger *logrus.Logger, conf ProxyConfig) (p Proxy, err e
 		logger.SetLevel(logrus.DebugLevel)
 	}
 
-	logger.WithField("config", conf).Debug("Initialized server")
+	// Don't emit keys into logs now that we're done with them.
+	logger.WithField("config", conf.Redacted()).Debug("Initialized server")
 
 	return
 }
@@ -334,6 +434,8 @@ func (p *Proxy) Start() {
 				}).Debug("About to refresh destinations")
 				if p.AcceptingForwards && p.ConsulForwardService != "" {
 					p.RefreshDestinations(p.ConsulForwardService, p.ForwardDestinations, &p.ForwardDestinationsMtx)
+					p.closeStaleForwardQueues(p.ForwardDestinations.Members())
+					p.closeStaleGRPCForwardConns(p.ForwardDestinations.Members())
 				}
 				if p.AcceptingTraces && p.ConsulTraceService != "" {
 					p.RefreshDestinations(p.ConsulTraceService, p.TraceDestinations, &p.TraceDestinationsMtx)
@@ -346,6 +448,19 @@ func (p *Proxy) Start() {
 		}()
 	}
 
+	if p.forwardTLS != nil {
+		go p.forwardTLS.Watch(vhttp.DefaultTLSReloadInterval, p.shutdown, log)
+	}
+
+	if p.AcceptingForwards && p.forwardHealth.enabled() {
+		go func() {
+			defer func() {
+				ConsumePanic(p.Sentry, p.TraceClient, p.Hostname, recover())
+			}()
+			p.probeForwardDestinations(p.forwardProbeInterval)
+		}()
+	}
+
 	go func() {
 		hostname, _ := os.Hostname()
 		defer func() {
@@ -386,6 +501,8 @@ func (p *Proxy) Serve() {
 	<-done
 	graceful.Shutdown()
 	p.gRPCStop()
+	p.drainForwardQueues(forwardQueueDrainTimeout)
+	p.closeStaleGRPCForwardConns(nil)
 }
 
 // HTTPServe starts the HTTP server and listens perpetually until it encounters an unrecoverable error.
@@ -508,6 +625,9 @@ func (p *Proxy) RefreshDestinations(serviceName string, ring *consistent.Consist
 	}
 
 	mtx.Lock()
+	if ring == p.ForwardDestinations && p.forwardHealth.enabled() {
+		destinations = p.forwardHealth.filter(destinations)
+	}
 	ring.Set(destinations)
 	mtx.Unlock()
 	samples.Add(ssf.Gauge("discoverer.destination_number", float32(len(destinations)), srvTags))
@@ -576,7 +696,8 @@ func (p *Proxy) ProxyTraces(ctx context.Context, traces []DatadogTraceSpan) {
 }
 
 // ProxyMetrics takes a slice of JSONMetrics and breaks them up into
-// multiple HTTP requests by MetricKey using the hash ring.
+// multiple HTTP requests (or gRPC calls, if forward_use_grpc is set) by
+// MetricKey using the hash ring.
 func (p *Proxy) ProxyMetrics(ctx context.Context, jsonMetrics []samplers.JSONMetric, origin string) {
 	span, _ := trace.StartSpanFromContext(ctx, "veneur.opentracing.proxy.proxy_metrics")
 	defer span.ClientFinish(p.TraceClient)
@@ -599,17 +720,44 @@ func (p *Proxy) ProxyMetrics(ctx context.Context, jsonMetrics []samplers.JSONMet
 		jsonMetricsByDestination[h] = make([]samplers.JSONMetric, 0)
 	}
 
+	// Metrics buffered after failing to forward last time go first, so
+	// that each destination knows how many of its batch are retries.
+	buffered := p.takeForwardBuffer()
+	retriedByDestination := make(map[string]int)
+	for _, jm := range buffered {
+		dest, _ := p.ForwardDestinations.Get(jm.MetricKey.String())
+		jsonMetricsByDestination[dest] = append(jsonMetricsByDestination[dest], jm)
+		retriedByDestination[dest]++
+	}
+
 	for _, jm := range jsonMetrics {
 		dest, _ := p.ForwardDestinations.Get(jm.MetricKey.String())
 		jsonMetricsByDestination[dest] = append(jsonMetricsByDestination[dest], jm)
 	}
 
+	if p.forwardQueueSize > 0 {
+		// Each destination's workers forward its batch, so a slow
+		// destination doesn't hold up the rest:
+		for dest, batch := range jsonMetricsByDestination {
+			p.enqueueForward(dest, batch, retriedByDestination[dest])
+		}
+		log.WithField("count", metricCount).Debug("Queued forward")
+		span.Add(ssf.RandomlySample(0.1,
+			ssf.Timing("proxy.duration_ns", time.Since(span.Start), time.Nanosecond, nil),
+			ssf.Count("proxy.proxied_metrics_total", float32(len(jsonMetrics)), nil),
+		)...)
+		return
+	}
+
 	// nb The response has already been returned at this point, because we
 	wg := sync.WaitGroup{}
 	wg.Add(len(jsonMetricsByDestination)) // Make our waitgroup the size of our destinations
 
 	for dest, batch := range jsonMetricsByDestination {
-		go p.doPost(ctx, &wg, dest, batch)
+		go func(dest string, batch []samplers.JSONMetric, retried int) {
+			defer wg.Done()
+			p.forwardToDestination(ctx, dest, batch, retried)
+		}(dest, batch, retriedByDestination[dest])
 	}
 	wg.Wait() // Wait for all the above goroutines to complete
 	log.WithField("count", metricCount).Debug("Completed forward")
@@ -620,29 +768,31 @@ func (p *Proxy) ProxyMetrics(ctx context.Context, jsonMetrics []samplers.JSONMet
 	)...)
 }
 
-func (p *Proxy) doPost(ctx context.Context, wg *sync.WaitGroup, destination string, batch []samplers.JSONMetric) {
-	defer wg.Done()
-
+// doPost posts the batch to the destination's /import endpoint.
+func (p *Proxy) doPost(ctx context.Context, destination string, batch []samplers.JSONMetric) error {
 	samples := &ssf.Samples{}
 	defer metrics.Report(p.TraceClient, samples)
 
 	batchSize := len(batch)
 	if batchSize < 1 {
-		return
+		return nil
 	}
 
 	// Make sure the destination always has a valid 'http' prefix.
-	if !strings.HasPrefix(destination, "http") {
-		u := url.URL{Scheme: "http", Host: destination}
-		destination = u.String()
-	}
+	destination = p.forwardURL(destination)
 
 	endpoint := fmt.Sprintf("%s/import", destination)
-	err := vhttp.PostHelper(ctx, p.HTTPClient, p.TraceClient, http.MethodPost, endpoint, batch, "forward", true, nil, log)
+	start := time.Now()
+	err := vhttp.PostHelper(ctx, p.forwardClient(), p.TraceClient, http.MethodPost, endpoint, batch, "forward", true, nil, log)
+	samples.Add(ssf.Timing("forward.duration_ns", time.Since(start), time.Nanosecond, map[string]string{"protocol": "http"}))
 	if err == nil {
 		log.WithField("metrics", batchSize).Debug("Completed forward to Veneur")
 	} else {
-		samples.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": "post"}))
+		cause := "post"
+		if vhttp.IsTLSHandshakeError(err) {
+			cause = "tls_handshake"
+		}
+		samples.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": cause, "protocol": "http"}))
 		log.WithError(err).WithFields(logrus.Fields{
 			"endpoint":  endpoint,
 			"batchSize": batchSize,
@@ -651,6 +801,7 @@ func (p *Proxy) doPost(ctx context.Context, wg *sync.WaitGroup, destination stri
 	samples.Add(ssf.RandomlySample(0.1,
 		ssf.Count("metrics_by_destination", float32(batchSize), map[string]string{"destination": destination, "protocol": "http"}),
 	)...)
+	return err
 }
 
 func (p *Proxy) ReportRuntimeMetrics() {
@@ -665,6 +816,7 @@ func (p *Proxy) ReportRuntimeMetrics() {
 		ssf.Gauge("gc.mallocs_objects_total", float32(mem.Mallocs), nil),
 		ssf.Gauge("gc.GCCPUFraction", float32(mem.GCCPUFraction), nil),
 	})
+	p.reportForwardQueueDepths()
 }
 
 // Shutdown signals the server to shut down after closing all
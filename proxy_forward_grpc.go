@@ -0,0 +1,169 @@
+package veneur
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/samplers/metricpb"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// proxyGRPCFallbackDuration is how long the proxy forwards to a
+// destination over HTTP after forwarding to it over gRPC failed, before
+// trying gRPC again. This lets a fleet of global Veneurs be upgraded to
+// accept gRPC gradually.
+const proxyGRPCFallbackDuration = 5 * time.Minute
+
+// proxyGRPCKeepalive keeps the connections to the destinations alive
+// between flushes, and notices dead ones.
+var proxyGRPCKeepalive = keepalive.ClientParameters{
+	Time:                30 * time.Second,
+	Timeout:             10 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// proxyGRPCDestination is the gRPC connection to one forwarding
+// destination.
+type proxyGRPCDestination struct {
+	conn          *grpc.ClientConn
+	fallbackUntil time.Time
+}
+
+// grpcForwardAddress returns the address the proxy dials to forward to
+// the destination over gRPC: the destination's host, with the configured
+// gRPC port if there is one.
+func (p *Proxy) grpcForwardAddress(destination string) (string, error) {
+	if strings.Contains(destination, "://") {
+		u, err := url.Parse(destination)
+		if err != nil {
+			return "", err
+		}
+		destination = u.Host
+	}
+	if p.forwardGRPCPort == 0 {
+		return destination, nil
+	}
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.forwardGRPCPort)), nil
+}
+
+// grpcForwardConn returns the connection to the destination, dialling it
+// if there isn't one yet. It returns nil if the destination recently
+// failed over gRPC, and should be sent to over HTTP instead.
+func (p *Proxy) grpcForwardConn(destination string) (*grpc.ClientConn, error) {
+	p.forwardGRPCMtx.Lock()
+	defer p.forwardGRPCMtx.Unlock()
+	if d, ok := p.forwardGRPCConns[destination]; ok {
+		if time.Now().Before(d.fallbackUntil) {
+			return nil, nil
+		}
+		return d.conn, nil
+	}
+
+	addr, err := p.grpcForwardAddress(destination)
+	if err != nil {
+		return nil, err
+	}
+	opts := append([]grpc.DialOption{grpc.WithKeepaliveParams(proxyGRPCKeepalive)}, p.forwardGRPCDialOpts...)
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.forwardGRPCConns[destination] = &proxyGRPCDestination{conn: conn}
+	return conn, nil
+}
+
+// grpcForwardFailed makes the proxy forward to the destination over HTTP
+// for a while.
+func (p *Proxy) grpcForwardFailed(destination string) {
+	p.forwardGRPCMtx.Lock()
+	defer p.forwardGRPCMtx.Unlock()
+	if d, ok := p.forwardGRPCConns[destination]; ok {
+		d.fallbackUntil = time.Now().Add(proxyGRPCFallbackDuration)
+	}
+}
+
+// closeStaleGRPCForwardConns closes the connections to destinations that
+// are no longer in the ring, or every connection if members is empty.
+func (p *Proxy) closeStaleGRPCForwardConns(members []string) {
+	p.forwardGRPCMtx.Lock()
+	defer p.forwardGRPCMtx.Unlock()
+	for dest, d := range p.forwardGRPCConns {
+		if !strInSlice(dest, members) {
+			d.conn.Close()
+			delete(p.forwardGRPCConns, dest)
+		}
+	}
+}
+
+// doForward forwards the batch to the destination over gRPC if that's
+// configured, falling back to HTTP if gRPC fails. It returns an error if
+// the batch couldn't be forwarded at all.
+func (p *Proxy) doForward(ctx context.Context, destination string, batch []samplers.JSONMetric) error {
+	if !p.forwardUseGRPC || len(batch) == 0 {
+		return p.doPost(ctx, destination, batch)
+	}
+
+	conn, err := p.grpcForwardConn(destination)
+	if err == nil && conn != nil {
+		err = p.doGRPC(ctx, conn, destination, batch)
+		if err == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		p.grpcForwardFailed(destination)
+		metrics.ReportOne(p.TraceClient, ssf.Count("forward.grpc_fallback_total", 1, map[string]string{"destination": destination}))
+		log.WithError(err).WithFields(logrus.Fields{
+			"destination": destination,
+			"retry_after": proxyGRPCFallbackDuration,
+		}).Warn("Failed to forward metrics over gRPC, falling back to HTTP")
+	}
+	return p.doPost(ctx, destination, batch)
+}
+
+// doGRPC sends the batch to the destination with the SendMetrics RPC.
+// Metrics that can't be converted are dropped. If the RPC fails, none
+// of the batch was forwarded.
+func (p *Proxy) doGRPC(ctx context.Context, conn *grpc.ClientConn, destination string, batch []samplers.JSONMetric) error {
+	samples := &ssf.Samples{}
+	defer metrics.Report(p.TraceClient, samples)
+
+	ms := make([]*metricpb.Metric, 0, len(batch))
+	for _, jm := range batch {
+		m, err := jm.Metric()
+		if err != nil {
+			samples.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": "conversion", "protocol": "grpc"}))
+			log.WithError(err).WithField("name", jm.Name).Warn("Could not convert a metric for forwarding over gRPC")
+			continue
+		}
+		ms = append(ms, m)
+	}
+
+	start := time.Now()
+	_, err := forwardrpc.NewForwardClient(conn).SendMetrics(ctx, &forwardrpc.MetricList{Metrics: ms})
+	samples.Add(ssf.Timing("forward.duration_ns", time.Since(start), time.Nanosecond, map[string]string{"protocol": "grpc"}))
+	if err != nil {
+		samples.Add(ssf.Count("forward.error_total", 1, map[string]string{"cause": "send", "protocol": "grpc"}))
+		return err
+	}
+	log.WithField("metrics", len(ms)).Debug("Completed forward to Veneur over gRPC")
+	samples.Add(ssf.RandomlySample(0.1,
+		ssf.Count("metrics_by_destination", float32(len(ms)), map[string]string{"destination": destination, "protocol": "grpc"}),
+	)...)
+	return nil
+}
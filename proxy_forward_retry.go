@@ -0,0 +1,179 @@
+package veneur
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// The values of proxy_forward_retry_mode, which decides what happens to
+// a batch of metrics that couldn't be forwarded to its destination.
+const (
+	// proxyForwardRetryNone drops the batch.
+	proxyForwardRetryNone = "none"
+	// proxyForwardRetryNext sends the batch to the next destinations on
+	// the hash ring. Metrics may be counted twice if the destination
+	// received the batch but failed to respond.
+	proxyForwardRetryNext = "next"
+	// proxyForwardRetryBuffer keeps the batch, and forwards it along
+	// with the next metrics that are proxied.
+	proxyForwardRetryBuffer = "buffer"
+)
+
+const (
+	// proxyForwardMaxRetries is how many times a batch is sent to the
+	// next destinations on the ring, in the "next" retry mode.
+	proxyForwardMaxRetries = 2
+	// proxyForwardRetryBackoff is how long the proxy waits before the
+	// first retry; it doubles with each one.
+	proxyForwardRetryBackoff = 100 * time.Millisecond
+	// proxyForwardBufferLimit is the most metrics that are buffered in
+	// the "buffer" retry mode. Metrics beyond it are dropped.
+	proxyForwardBufferLimit = 100000
+)
+
+func validateProxyForwardRetryMode(mode string) error {
+	switch mode {
+	case "", proxyForwardRetryNone, proxyForwardRetryNext, proxyForwardRetryBuffer:
+		return nil
+	}
+	return fmt.Errorf("unknown proxy_forward_retry_mode %q", mode)
+}
+
+// forwardToDestination forwards a batch of metrics to the destination
+// it was hashed to, and handles a failure according to the retry mode.
+// The first retried metrics in the batch were buffered after failing to
+// be forwarded before; they aren't buffered a second time.
+func (p *Proxy) forwardToDestination(ctx context.Context, destination string, batch []samplers.JSONMetric, retried int) {
+	if len(batch) == 0 {
+		return
+	}
+	samples := &ssf.Samples{}
+	defer metrics.Report(p.TraceClient, samples)
+	tags := map[string]string{"destination": destination, "retry_mode": p.forwardRetryMode}
+
+	err := p.doForward(ctx, destination, batch)
+	p.recordForwardResult(destination, err)
+	if err == nil {
+		if firstTry := len(batch) - retried; firstTry > 0 {
+			samples.Add(ssf.Count("forward.metrics_first_try_total", float32(firstTry), tags))
+		}
+		if retried > 0 {
+			samples.Add(ssf.Count("forward.metrics_retried_total", float32(retried), tags))
+		}
+		return
+	}
+
+	dropped := len(batch)
+	switch p.forwardRetryMode {
+	case proxyForwardRetryNext:
+		forwarded := p.retryNextDestinations(ctx, destination, batch)
+		if forwarded > 0 {
+			samples.Add(ssf.Count("forward.metrics_retried_total", float32(forwarded), tags))
+		}
+		dropped -= forwarded
+	case proxyForwardRetryBuffer:
+		dropped = retried + p.bufferForward(batch[retried:])
+		if buffered := len(batch) - dropped; buffered > 0 {
+			samples.Add(ssf.Count("forward.metrics_buffered_total", float32(buffered), tags))
+		}
+	}
+	if dropped > 0 {
+		samples.Add(ssf.Count("forward.metrics_dropped_total", float32(dropped), tags))
+		log.WithError(err).WithFields(logrus.Fields{
+			"destination": destination,
+			"dropped":     dropped,
+			"retry_mode":  p.forwardRetryMode,
+		}).Warn("Dropped metrics that could not be forwarded")
+	}
+}
+
+// retryNextDestinations sends a batch that failed to be forwarded to
+// failed to the next destination on the ring for each metric, a bounded
+// number of times. It returns how many of the metrics were forwarded.
+func (p *Proxy) retryNextDestinations(ctx context.Context, failed string, batch []samplers.JSONMetric) int {
+	avoid := map[string]bool{failed: true}
+	backoff := proxyForwardRetryBackoff
+	forwarded := 0
+	remaining := batch
+	for attempt := 0; attempt < proxyForwardMaxRetries && len(remaining) > 0; attempt++ {
+		select {
+		case <-ctx.Done():
+			return forwarded
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		byDestination := map[string][]samplers.JSONMetric{}
+		for _, jm := range remaining {
+			dest := p.nextForwardDestination(jm.MetricKey.String(), avoid)
+			if dest == "" {
+				// Every destination failed
+				return forwarded
+			}
+			byDestination[dest] = append(byDestination[dest], jm)
+		}
+
+		remaining = nil
+		for dest, retry := range byDestination {
+			err := p.doForward(ctx, dest, retry)
+			p.recordForwardResult(dest, err)
+			if err != nil {
+				avoid[dest] = true
+				remaining = append(remaining, retry...)
+				continue
+			}
+			forwarded += len(retry)
+		}
+	}
+	return forwarded
+}
+
+// nextForwardDestination returns the first destination on the ring for
+// the key that isn't avoided, or "" if there isn't one.
+func (p *Proxy) nextForwardDestination(key string, avoid map[string]bool) string {
+	dests, err := p.ForwardDestinations.GetN(key, len(p.ForwardDestinations.Members()))
+	if err != nil {
+		return ""
+	}
+	for _, dest := range dests {
+		if !avoid[dest] {
+			return dest
+		}
+	}
+	return ""
+}
+
+// bufferForward keeps metrics to be forwarded with the next ones that
+// are proxied. It returns how many didn't fit in the buffer, and were
+// dropped.
+func (p *Proxy) bufferForward(batch []samplers.JSONMetric) (dropped int) {
+	p.forwardBufferMtx.Lock()
+	defer p.forwardBufferMtx.Unlock()
+	room := proxyForwardBufferLimit - len(p.forwardBuffer)
+	if room < 0 {
+		room = 0
+	}
+	if len(batch) > room {
+		dropped = len(batch) - room
+		batch = batch[:room]
+	}
+	p.forwardBuffer = append(p.forwardBuffer, batch...)
+	return dropped
+}
+
+// takeForwardBuffer empties the buffer, returning the metrics that were
+// in it.
+func (p *Proxy) takeForwardBuffer() []samplers.JSONMetric {
+	p.forwardBufferMtx.Lock()
+	defer p.forwardBufferMtx.Unlock()
+	buffered := p.forwardBuffer
+	p.forwardBuffer = nil
+	return buffered
+}
@@ -0,0 +1,208 @@
+package veneur
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+const defaultForwardProbeInterval = 10 * time.Second
+
+// forwardProbeTimeout is how long the health check of an evicted
+// destination can take.
+const forwardProbeTimeout = 5 * time.Second
+
+// destinationHealth tracks the consecutive forwarding failures of each
+// destination in the forwarding ring. Destinations that fail too many
+// times in a row are evicted from the ring, so that their share of the
+// metrics goes to the rest, until a health check shows they've
+// recovered.
+type destinationHealth struct {
+	threshold int
+
+	mtx      sync.Mutex
+	failures map[string]int
+	evicted  map[string]bool
+}
+
+func newDestinationHealth(threshold int) *destinationHealth {
+	return &destinationHealth{
+		threshold: threshold,
+		failures:  map[string]int{},
+		evicted:   map[string]bool{},
+	}
+}
+
+// enabled reports whether destinations are evicted at all.
+func (dh *destinationHealth) enabled() bool {
+	return dh != nil && dh.threshold > 0
+}
+
+// filter removes the evicted destinations from ones that were just
+// discovered, and forgets about evicted destinations that are gone. If
+// every destination is evicted, they're all kept.
+func (dh *destinationHealth) filter(destinations []string) []string {
+	dh.mtx.Lock()
+	defer dh.mtx.Unlock()
+	for dest := range dh.evicted {
+		if !strInSlice(dest, destinations) {
+			delete(dh.evicted, dest)
+			delete(dh.failures, dest)
+		}
+	}
+	healthy := make([]string, 0, len(destinations))
+	for _, dest := range destinations {
+		if !dh.evicted[dest] {
+			healthy = append(healthy, dest)
+		}
+	}
+	if len(healthy) == 0 {
+		return destinations
+	}
+	return healthy
+}
+
+// evictedDestinations returns the destinations that are evicted.
+func (dh *destinationHealth) evictedDestinations() []string {
+	dh.mtx.Lock()
+	defer dh.mtx.Unlock()
+	dests := make([]string, 0, len(dh.evicted))
+	for dest := range dh.evicted {
+		dests = append(dests, dest)
+	}
+	return dests
+}
+
+// recordForwardResult counts a forward to the destination, and evicts it
+// from the ring if it failed too many times in a row. The last
+// destination in the ring is never evicted.
+func (p *Proxy) recordForwardResult(destination string, err error) {
+	if !p.forwardHealth.enabled() {
+		return
+	}
+	p.ForwardDestinationsMtx.Lock()
+	defer p.ForwardDestinationsMtx.Unlock()
+	dh := p.forwardHealth
+	dh.mtx.Lock()
+	defer dh.mtx.Unlock()
+
+	if err == nil {
+		delete(dh.failures, destination)
+		return
+	}
+	dh.failures[destination]++
+	if dh.failures[destination] < dh.threshold || dh.evicted[destination] {
+		return
+	}
+	members := p.ForwardDestinations.Members()
+	if !strInSlice(destination, members) || len(members) < 2 {
+		return
+	}
+	p.ForwardDestinations.Remove(destination)
+	dh.evicted[destination] = true
+	log.WithError(err).WithFields(logrus.Fields{
+		"destination": destination,
+		"failures":    dh.failures[destination],
+	}).Warn("Evicted a failing destination from the forwarding ring")
+	metrics.ReportOne(p.TraceClient, ssf.Count("forward.ring_changes_total", 1,
+		map[string]string{"destination": destination, "change": "evicted"}))
+}
+
+// probeEvictedDestinations health checks the evicted destinations, and
+// puts the ones that have recovered back in the ring.
+func (p *Proxy) probeEvictedDestinations() {
+	for _, dest := range p.forwardHealth.evictedDestinations() {
+		if err := p.probeDestination(dest); err != nil {
+			log.WithError(err).WithField("destination", dest).Debug("Evicted destination is still unhealthy")
+			continue
+		}
+		p.readmitDestination(dest)
+	}
+}
+
+// probeDestination checks the destination's /healthcheck endpoint.
+func (p *Proxy) probeDestination(destination string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, p.forwardURL(destination)+"/healthcheck", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.forwardClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Proxy) readmitDestination(destination string) {
+	p.ForwardDestinationsMtx.Lock()
+	defer p.ForwardDestinationsMtx.Unlock()
+	dh := p.forwardHealth
+	dh.mtx.Lock()
+	defer dh.mtx.Unlock()
+
+	if !dh.evicted[destination] {
+		// It was no longer discovered while being probed
+		return
+	}
+	delete(dh.evicted, destination)
+	delete(dh.failures, destination)
+	if !strInSlice(destination, p.ForwardDestinations.Members()) {
+		p.ForwardDestinations.Add(destination)
+	}
+	log.WithField("destination", destination).Info("Readmitted a recovered destination to the forwarding ring")
+	metrics.ReportOne(p.TraceClient, ssf.Count("forward.ring_changes_total", 1,
+		map[string]string{"destination": destination, "change": "readmitted"}))
+}
+
+// probeForwardDestinations probes the evicted destinations every
+// interval until the proxy shuts down.
+func (p *Proxy) probeForwardDestinations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.shutdown:
+			return
+		case <-ticker.C:
+			p.probeEvictedDestinations()
+		}
+	}
+}
+
+// forwardURL makes sure the destination has an http prefix, or https if
+// forwarding uses TLS.
+func (p *Proxy) forwardURL(destination string) string {
+	scheme := "http"
+	if p.forwardTLS != nil {
+		scheme = "https"
+		destination = strings.TrimPrefix(destination, "http://")
+	}
+	if strings.HasPrefix(destination, "http") {
+		return destination
+	}
+	u := url.URL{Scheme: scheme, Host: destination}
+	return u.String()
+}
+
+// forwardClient returns the client that metrics are forwarded with.
+func (p *Proxy) forwardClient() *http.Client {
+	if p.forwardTLSClient != nil {
+		return p.forwardTLSClient
+	}
+	return p.HTTPClient
+}
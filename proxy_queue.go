@@ -0,0 +1,158 @@
+package veneur
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// forwardQueueDrainTimeout is how long shutting down waits for the
+// batches left in the forwarding queues to be sent.
+const forwardQueueDrainTimeout = 10 * time.Second
+
+// queuedBatch is a batch of metrics waiting to be forwarded. The first
+// retried metrics were buffered after failing to be forwarded before.
+type queuedBatch struct {
+	metrics []samplers.JSONMetric
+	retried int
+}
+
+// forwardQueue holds the batches waiting to be forwarded to one
+// destination, so that a slow destination only holds up its own
+// metrics. Its workers forward them until the queue is closed and
+// empty.
+type forwardQueue struct {
+	batches chan queuedBatch
+	wg      sync.WaitGroup
+}
+
+// enqueueForward queues a batch to be forwarded to the destination. If
+// the destination's queue is full, or the proxy is shutting down, the
+// batch is dropped rather than waiting.
+func (p *Proxy) enqueueForward(destination string, batch []samplers.JSONMetric, retried int) {
+	if len(batch) == 0 {
+		return
+	}
+	p.forwardQueuesMtx.Lock()
+	queued := false
+	if !p.forwardQueuesClosed {
+		q, ok := p.forwardQueues[destination]
+		if !ok {
+			q = p.startForwardQueue(destination)
+			p.forwardQueues[destination] = q
+		}
+		select {
+		case q.batches <- queuedBatch{metrics: batch, retried: retried}:
+			queued = true
+		default:
+		}
+	}
+	p.forwardQueuesMtx.Unlock()
+
+	if !queued {
+		metrics.ReportOne(p.TraceClient, ssf.Count("forward.queue_dropped_total", float32(len(batch)),
+			map[string]string{"destination": destination}))
+		log.WithFields(logrus.Fields{
+			"destination": destination,
+			"metrics":     len(batch),
+		}).Warn("Forwarding queue is full, dropping metrics")
+	}
+}
+
+// startForwardQueue makes a queue for the destination, and starts its
+// workers. The caller must hold forwardQueuesMtx.
+func (p *Proxy) startForwardQueue(destination string) *forwardQueue {
+	q := &forwardQueue{batches: make(chan queuedBatch, p.forwardQueueSize)}
+	workers := p.forwardQueueWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer q.wg.Done()
+			defer func() {
+				ConsumePanic(p.Sentry, p.TraceClient, p.Hostname, recover())
+			}()
+			for b := range q.batches {
+				p.forwardQueued(destination, b)
+			}
+		}()
+	}
+	return q
+}
+
+func (p *Proxy) forwardQueued(destination string, b queuedBatch) {
+	ctx := context.Background()
+	if p.ForwardTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, p.ForwardTimeout)
+		defer cancel()
+	}
+	p.forwardToDestination(ctx, destination, b.metrics, b.retried)
+}
+
+// closeStaleForwardQueues closes the queues of destinations that are no
+// longer in the ring. Their workers exit once they've forwarded what was
+// left in them.
+func (p *Proxy) closeStaleForwardQueues(members []string) {
+	p.forwardQueuesMtx.Lock()
+	defer p.forwardQueuesMtx.Unlock()
+	for dest, q := range p.forwardQueues {
+		if !strInSlice(dest, members) {
+			close(q.batches)
+			delete(p.forwardQueues, dest)
+		}
+	}
+}
+
+// drainForwardQueues stops accepting batches, and waits until the
+// timeout for the queued ones to be forwarded.
+func (p *Proxy) drainForwardQueues(timeout time.Duration) {
+	p.forwardQueuesMtx.Lock()
+	p.forwardQueuesClosed = true
+	queues := p.forwardQueues
+	p.forwardQueues = map[string]*forwardQueue{}
+	for _, q := range queues {
+		close(q.batches)
+	}
+	p.forwardQueuesMtx.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		for _, q := range queues {
+			q.wg.Wait()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		left := 0
+		for _, q := range queues {
+			left += len(q.batches)
+		}
+		log.WithField("batches", left).Warn("Timed out draining the forwarding queues")
+	}
+}
+
+// reportForwardQueueDepths reports how many batches are waiting in each
+// destination's queue.
+func (p *Proxy) reportForwardQueueDepths() {
+	p.forwardQueuesMtx.Lock()
+	samples := make([]*ssf.SSFSample, 0, len(p.forwardQueues))
+	for dest, q := range p.forwardQueues {
+		samples = append(samples, ssf.Gauge("forward.queue_depth", float32(len(q.batches)),
+			map[string]string{"destination": dest}))
+	}
+	p.forwardQueuesMtx.Unlock()
+	if len(samples) > 0 {
+		metrics.ReportBatch(p.TraceClient, samples)
+	}
+}
@@ -3,10 +3,12 @@ package veneur
 import (
 	"compress/zlib"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -15,7 +17,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/internal/forwardtest"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/samplers/metricpb"
 	"github.com/zenazn/goji/graceful"
 )
 
@@ -285,3 +289,365 @@ func TestProxyServeStopHTTP(t *testing.T) {
 		assert.Fail(t, "Stopping the Proxy over HTTP did not stop both listeners")
 	}
 }
+
+func TestProxyForwardGRPC(t *testing.T) {
+	received := make(chan []*metricpb.Metric, 1)
+	global := forwardtest.NewServer(func(ms []*metricpb.Metric) {
+		received <- ms
+	})
+	global.Start(t)
+	defer global.Stop()
+
+	cfg := generateProxyConfig()
+	cfg.ConsulForwardServiceName = ""
+	cfg.ConsulTraceServiceName = ""
+	cfg.ForwardAddress = global.Addr().String()
+	cfg.ForwardUseGrpc = true
+	proxy, err := NewProxyFromConfig(logrus.New(), cfg)
+	require.NoError(t, err)
+	defer proxy.Shutdown()
+
+	ctr := samplers.NewCounter("foo", []string{"a:b"})
+	ctr.Sample(20.0, 1.0)
+	jsonCtr, err := ctr.Export()
+	require.NoError(t, err)
+
+	proxy.ProxyMetrics(context.Background(), []samplers.JSONMetric{jsonCtr}, "foo.com")
+	select {
+	case ms := <-received:
+		require.Len(t, ms, 1)
+		assert.Equal(t, "foo", ms[0].Name)
+		assert.Equal(t, metricpb.Type_Counter, ms[0].Type)
+		assert.Equal(t, int64(20), ms[0].GetCounter().Value)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the metrics to be forwarded over gRPC")
+	}
+}
+
+func TestProxyForwardGRPCFallback(t *testing.T) {
+	var mtx sync.Mutex
+	posts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/import" {
+			// The gRPC connection preface
+			return
+		}
+		mtx.Lock()
+		posts++
+		mtx.Unlock()
+	}))
+	defer ts.Close()
+
+	cfg := generateProxyConfig()
+	cfg.ConsulForwardServiceName = ""
+	cfg.ConsulTraceServiceName = ""
+	cfg.ForwardAddress = ts.URL
+	cfg.ForwardUseGrpc = true
+	cfg.ForwardTimeout = "3s"
+	proxy, err := NewProxyFromConfig(logrus.New(), cfg)
+	require.NoError(t, err)
+	defer proxy.Shutdown()
+
+	ctr := samplers.NewCounter("foo", []string{"a:b"})
+	ctr.Sample(20.0, 1.0)
+	jsonCtr, err := ctr.Export()
+	require.NoError(t, err)
+
+	// The destination only speaks HTTP, so the first forward fails over
+	// gRPC and is posted instead; the second goes straight to HTTP.
+	proxy.ProxyMetrics(context.Background(), []samplers.JSONMetric{jsonCtr}, "foo.com")
+	conn, err := proxy.grpcForwardConn(ts.URL)
+	assert.NoError(t, err)
+	assert.Nil(t, conn, "the destination should be falling back to HTTP")
+	proxy.ProxyMetrics(context.Background(), []samplers.JSONMetric{jsonCtr}, "foo.com")
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, 2, posts)
+}
+
+func TestProxyGRPCForwardAddress(t *testing.T) {
+	p := &Proxy{}
+	addr, err := p.grpcForwardAddress("http://10.1.10.12:8000")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.10.12:8000", addr)
+
+	p.forwardGRPCPort = 8128
+	addr, err = p.grpcForwardAddress("http://10.1.10.12:8000")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.10.12:8128", addr)
+	addr, err = p.grpcForwardAddress("10.1.10.12:8000")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.10.12:8128", addr)
+}
+
+// importRecorder is a fake global Veneur that records the names of the
+// metrics posted to it, and fails the requests (and health checks) that
+// fail returns true for.
+type importRecorder struct {
+	t    *testing.T
+	fail func() bool
+
+	mtx      sync.Mutex
+	names    []string
+	requests int
+}
+
+func (ir *importRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	if r.URL.Path == "/healthcheck" {
+		if ir.fail != nil && ir.fail() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return
+	}
+	ir.requests++
+	if ir.fail != nil && ir.fail() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	z, err := zlib.NewReader(r.Body)
+	require.NoError(ir.t, err)
+	var jsonMetrics []samplers.JSONMetric
+	require.NoError(ir.t, json.NewDecoder(z).Decode(&jsonMetrics))
+	for _, jm := range jsonMetrics {
+		ir.names = append(ir.names, jm.Name)
+	}
+}
+
+func (ir *importRecorder) received() []string {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	names := append([]string{}, ir.names...)
+	sort.Strings(names)
+	return names
+}
+
+func retryTestMetrics(t *testing.T, n int) ([]samplers.JSONMetric, []string) {
+	var jsonMetrics []samplers.JSONMetric
+	var names []string
+	for i := 0; i < n; i++ {
+		ctr := samplers.NewCounter(fmt.Sprintf("counter.%d", i), nil)
+		ctr.Sample(1, 1.0)
+		jm, err := ctr.Export()
+		require.NoError(t, err)
+		jsonMetrics = append(jsonMetrics, jm)
+		names = append(names, jm.Name)
+	}
+	sort.Strings(names)
+	return jsonMetrics, names
+}
+
+func TestProxyForwardRetryNext(t *testing.T) {
+	bad := &importRecorder{t: t, fail: func() bool { return true }}
+	badServer := httptest.NewServer(bad)
+	defer badServer.Close()
+	good := &importRecorder{t: t}
+	goodServer := httptest.NewServer(good)
+	defer goodServer.Close()
+
+	cfg := generateProxyConfig()
+	cfg.ConsulForwardServiceName = ""
+	cfg.ConsulTraceServiceName = ""
+	cfg.ForwardAddress = goodServer.URL
+	cfg.ProxyForwardRetryMode = "next"
+	proxy, err := NewProxyFromConfig(logrus.New(), cfg)
+	require.NoError(t, err)
+	defer proxy.Shutdown()
+	proxy.ForwardDestinations.Set([]string{badServer.URL, goodServer.URL})
+
+	jsonMetrics, names := retryTestMetrics(t, 20)
+	proxy.ProxyMetrics(context.Background(), jsonMetrics, "foo.com")
+
+	assert.NotZero(t, bad.requests, "some metrics should have been hashed to the failing destination")
+	assert.Equal(t, names, good.received(), "every metric should have been retried against the healthy destination")
+}
+
+func TestProxyForwardRetryBuffer(t *testing.T) {
+	failing := true
+	rec := &importRecorder{t: t, fail: func() bool { return failing }}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	cfg := generateProxyConfig()
+	cfg.ConsulForwardServiceName = ""
+	cfg.ConsulTraceServiceName = ""
+	cfg.ForwardAddress = ts.URL
+	cfg.ProxyForwardRetryMode = "buffer"
+	proxy, err := NewProxyFromConfig(logrus.New(), cfg)
+	require.NoError(t, err)
+	defer proxy.Shutdown()
+
+	jsonMetrics, names := retryTestMetrics(t, 4)
+	proxy.ProxyMetrics(context.Background(), jsonMetrics[:2], "foo.com")
+	assert.Empty(t, rec.received())
+	assert.Len(t, proxy.forwardBuffer, 2, "the failed batch should have been buffered")
+
+	// Failing again drops the buffered metrics, and buffers the new ones:
+	proxy.ProxyMetrics(context.Background(), jsonMetrics[2:3], "foo.com")
+	assert.Len(t, proxy.forwardBuffer, 1, "metrics should only be buffered once")
+
+	rec.mtx.Lock()
+	failing = false
+	rec.mtx.Unlock()
+	proxy.ProxyMetrics(context.Background(), jsonMetrics[3:], "foo.com")
+	assert.Equal(t, names[2:], rec.received())
+	assert.Empty(t, proxy.forwardBuffer)
+}
+
+func TestProxyForwardRetryModeInvalid(t *testing.T) {
+	cfg := generateProxyConfig()
+	cfg.ProxyForwardRetryMode = "sometimes"
+	_, err := NewProxyFromConfig(logrus.New(), cfg)
+	assert.Error(t, err)
+}
+
+func TestProxyEvictsFailingDestination(t *testing.T) {
+	failing := true
+	recorders := []*importRecorder{
+		{t: t, fail: func() bool { return failing }},
+		{t: t},
+		{t: t},
+	}
+	var dests []string
+	for _, rec := range recorders {
+		ts := httptest.NewServer(rec)
+		defer ts.Close()
+		dests = append(dests, ts.URL)
+	}
+	bad := recorders[0]
+
+	cfg := generateProxyConfig()
+	cfg.ConsulForwardServiceName = ""
+	cfg.ConsulTraceServiceName = ""
+	cfg.ForwardAddress = dests[1]
+	cfg.ForwardEvictionThreshold = 3
+	proxy, err := NewProxyFromConfig(logrus.New(), cfg)
+	require.NoError(t, err)
+	defer proxy.Shutdown()
+	proxy.ForwardDestinations.Set(dests)
+
+	jsonMetrics, names := retryTestMetrics(t, 30)
+	requestsTo := func(rec *importRecorder) int {
+		rec.mtx.Lock()
+		defer rec.mtx.Unlock()
+		return rec.requests
+	}
+
+	// The failing destination keeps getting its share until it fails
+	// enough times in a row:
+	for i := 0; i < 3; i++ {
+		proxy.ProxyMetrics(context.Background(), jsonMetrics, "foo.com")
+	}
+	assert.Equal(t, 3, requestsTo(bad))
+	assert.NotContains(t, proxy.ForwardDestinations.Members(), dests[0], "the failing destination should have been evicted")
+
+	// Its range is now redistributed to the other two:
+	proxy.ProxyMetrics(context.Background(), jsonMetrics, "foo.com")
+	assert.Equal(t, 3, requestsTo(bad), "no metrics should go to the evicted destination")
+	lastRound := func() []string {
+		var all []string
+		for _, rec := range recorders {
+			rec.mtx.Lock()
+			rec.names = nil
+			rec.mtx.Unlock()
+		}
+		proxy.ProxyMetrics(context.Background(), jsonMetrics, "foo.com")
+		for _, rec := range recorders {
+			all = append(all, rec.received()...)
+		}
+		sort.Strings(all)
+		return all
+	}
+	assert.Equal(t, names, lastRound(), "every metric should reach one of the healthy destinations")
+
+	// Rediscovering the destinations doesn't bring it back:
+	assert.Equal(t, dests[1:], proxy.forwardHealth.filter(dests))
+
+	// While it's still failing, probing leaves it out:
+	proxy.probeEvictedDestinations()
+	assert.NotContains(t, proxy.ForwardDestinations.Members(), dests[0])
+
+	// Once it recovers, probing puts it back, and traffic returns:
+	bad.mtx.Lock()
+	failing = false
+	bad.mtx.Unlock()
+	proxy.probeEvictedDestinations()
+	assert.Contains(t, proxy.ForwardDestinations.Members(), dests[0], "the recovered destination should have been readmitted")
+	assert.Equal(t, names, lastRound())
+	assert.NotEmpty(t, bad.received(), "metrics should be forwarded to the recovered destination again")
+}
+
+func TestProxyForwardQueues(t *testing.T) {
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	slow := &importRecorder{t: t}
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		slow.ServeHTTP(w, r)
+	}))
+	defer slowServer.Close()
+	// Closing the server waits for the stuck requests, so they have to
+	// be released first even if the test fails:
+	defer releaseOnce.Do(func() { close(release) })
+	fast := &importRecorder{t: t}
+	fastServer := httptest.NewServer(fast)
+	defer fastServer.Close()
+
+	cfg := generateProxyConfig()
+	cfg.ConsulForwardServiceName = ""
+	cfg.ConsulTraceServiceName = ""
+	cfg.ForwardAddress = fastServer.URL
+	cfg.ForwardQueueSize = 3
+	cfg.ForwardQueueWorkers = 1
+	proxy, err := NewProxyFromConfig(logrus.New(), cfg)
+	require.NoError(t, err)
+	proxy.ForwardDestinations.Set([]string{slowServer.URL, fastServer.URL})
+
+	fastRequests := func(n int) func() bool {
+		return func() bool {
+			fast.mtx.Lock()
+			defer fast.mtx.Unlock()
+			return fast.requests == n
+		}
+	}
+
+	jsonMetrics, _ := retryTestMetrics(t, 30)
+	proxy.ProxyMetrics(context.Background(), jsonMetrics, "foo.com")
+	// The slow destination's worker is now stuck on the first batch, so
+	// the next three wait in its queue, and the fifth overflows it. The
+	// fast destination gets every batch in the meantime:
+	<-entered
+	require.NoError(t, waitFor(fastRequests(1)))
+	for i := 2; i <= 5; i++ {
+		start := time.Now()
+		proxy.ProxyMetrics(context.Background(), jsonMetrics, "foo.com")
+		assert.True(t, time.Since(start) < time.Second, "proxying shouldn't wait for the slow destination")
+		require.NoError(t, waitFor(fastRequests(i)), "the fast destination should get batch %d", i)
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	proxy.drainForwardQueues(3 * time.Second)
+	slow.mtx.Lock()
+	defer slow.mtx.Unlock()
+	assert.Equal(t, 4, slow.requests, "the batch that overflowed the queue should have been dropped")
+
+	// After draining, batches are dropped instead of queued:
+	proxy.ProxyMetrics(context.Background(), jsonMetrics, "foo.com")
+	assert.Empty(t, proxy.forwardQueues)
+}
+
+// waitFor polls cond until it's true, or a few seconds pass.
+func waitFor(cond func() bool) error {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
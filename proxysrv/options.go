@@ -5,6 +5,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/veneur/trace"
+	"google.golang.org/grpc"
 )
 
 // WithForwardTimeout sets the time after which an individual RPC to a
@@ -15,6 +16,15 @@ func WithForwardTimeout(d time.Duration) Option {
 	}
 }
 
+// WithDialOptions sets the options used to connect to the destination
+// Veneurs, such as their credentials. By default, the connections are
+// unencrypted.
+func WithDialOptions(dialOpts ...grpc.DialOption) Option {
+	return func(opts *options) {
+		opts.dialOptions = dialOpts
+	}
+}
+
 // WithLog sets the logger entry used in the object.
 func WithLog(e *logrus.Entry) Option {
 	return func(opts *options) {
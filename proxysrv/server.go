@@ -8,6 +8,7 @@ package proxysrv
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"strings"
@@ -19,6 +20,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context" // This can be replace with "context" after Go 1.8 support is dropped
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"stathat.com/c/consistent"
 
 	"github.com/stripe/veneur/forwardrpc"
@@ -60,6 +63,7 @@ type options struct {
 	forwardTimeout time.Duration
 	traceClient    *trace.Client
 	statsInterval  time.Duration
+	dialOptions    []grpc.DialOption
 }
 
 // New creates a new Server with the provided destinations. The server returned
@@ -70,14 +74,15 @@ func New(destinations *consistent.Consistent, opts ...Option) (*Server, error) {
 		opts: &options{
 			forwardTimeout: defaultForwardTimeout,
 			statsInterval:  defaultReportStatsInterval,
+			dialOptions:    []grpc.DialOption{grpc.WithInsecure()},
 		},
-		conns:               newClientConnMap(grpc.WithInsecure()),
 		activeProxyHandlers: new(int64),
 	}
 
 	for _, opt := range opts {
 		opt(res.opts)
 	}
+	res.conns = newClientConnMap(res.opts.dialOptions...)
 
 	if res.opts.log == nil {
 		log := logrus.New()
@@ -186,6 +191,34 @@ func (s *Server) SendMetrics(ctx context.Context, mlist *forwardrpc.MetricList)
 	return &empty.Empty{}, nil
 }
 
+// SendSpans is not supported by the proxy; spans should be sent to a
+// global Veneur directly.
+func (s *Server) SendSpans(ctx context.Context, slist *forwardrpc.SpanList) (*empty.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "veneur-proxy doesn't proxy spans")
+}
+
+// SendMetricsStream forwards each batch of metrics received on the stream,
+// in the same way as SendMetrics.
+func (s *Server) SendMetricsStream(stream forwardrpc.Forward_SendMetricsStreamServer) error {
+	if err := forwardrpc.AcceptStream(stream); err != nil {
+		return err
+	}
+	for {
+		mlist, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&empty.Empty{})
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			atomic.AddInt64(s.activeProxyHandlers, 1)
+			_ = s.sendMetrics(context.Background(), mlist)
+			atomic.AddInt64(s.activeProxyHandlers, -1)
+		}()
+	}
+}
+
 func (s *Server) sendMetrics(ctx context.Context, mlist *forwardrpc.MetricList) error {
 	span, _ := trace.StartSpanFromContext(ctx, "veneur.opentracing.proxysrv.send_metrics")
 	defer span.ClientFinish(s.opts.traceClient)
@@ -0,0 +1,187 @@
+package veneur
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// rateLimit is the rate that each listener of a protocol may read
+// packets at. A zero rate is unlimited.
+type rateLimit struct {
+	packetsPerSecond float64
+	bytesPerSecond   float64
+}
+
+func newRateLimit(protocol string, packetsPerSecond, bytesPerSecond float64) (rateLimit, error) {
+	if packetsPerSecond < 0 || bytesPerSecond < 0 {
+		return rateLimit{}, fmt.Errorf("%s rate limits must not be negative", protocol)
+	}
+	return rateLimit{packetsPerSecond: packetsPerSecond, bytesPerSecond: bytesPerSecond}, nil
+}
+
+func (rl rateLimit) enabled() bool {
+	return rl.packetsPerSecond > 0 || rl.bytesPerSecond > 0
+}
+
+// listenerRateLimit limits the packets read by one listener. Each of the
+// listener's reader goroutines has its own readerRateLimit with its share
+// of the limit, so that the readers don't contend on it. Their drops are
+// summed at flush.
+type listenerRateLimit struct {
+	protocol string
+	limit    rateLimit
+
+	address string
+
+	mtx     sync.Mutex
+	readers map[*readerRateLimit]struct{}
+	// released are the drops of the readers that have stopped since
+	// the last flush
+	released int64
+}
+
+// newListenerRateLimit creates the rate limit of a listener, and
+// registers it to be reported at flush. It returns nil if the listener
+// isn't limited.
+func (s *Server) newListenerRateLimit(protocol, address string, limit rateLimit) *listenerRateLimit {
+	if !limit.enabled() {
+		return nil
+	}
+	lrl := &listenerRateLimit{
+		protocol: protocol,
+		limit:    limit,
+		address:  address,
+		readers:  map[*readerRateLimit]struct{}{},
+	}
+	s.rateLimitsMtx.Lock()
+	s.rateLimits = append(s.rateLimits, lrl)
+	s.rateLimitsMtx.Unlock()
+	return lrl
+}
+
+// reader returns the rate limit of a reader that gets one in shares of
+// the listener's packets.
+func (lrl *listenerRateLimit) reader(shares int) *readerRateLimit {
+	if lrl == nil {
+		return nil
+	}
+	rrl := &readerRateLimit{
+		packets: newTokenBucket(lrl.limit.packetsPerSecond / float64(shares)),
+		bytes:   newTokenBucket(lrl.limit.bytesPerSecond / float64(shares)),
+	}
+	lrl.mtx.Lock()
+	lrl.readers[rrl] = struct{}{}
+	lrl.mtx.Unlock()
+	return rrl
+}
+
+// release stops reporting the reader, once it's done reading.
+func (lrl *listenerRateLimit) release(rrl *readerRateLimit) {
+	if lrl == nil {
+		return
+	}
+	lrl.mtx.Lock()
+	delete(lrl.readers, rrl)
+	lrl.released += atomic.LoadInt64(&rrl.dropped)
+	lrl.mtx.Unlock()
+}
+
+// flush returns the listener's address, and the packets that its
+// readers dropped since the last flush.
+func (lrl *listenerRateLimit) flush() (string, int64) {
+	lrl.mtx.Lock()
+	defer lrl.mtx.Unlock()
+	dropped := lrl.released
+	lrl.released = 0
+	for rrl := range lrl.readers {
+		dropped += atomic.SwapInt64(&rrl.dropped, 0)
+	}
+	return lrl.address, dropped
+}
+
+// readerRateLimit is a reader goroutine's token buckets. Only its reader
+// may call allow.
+type readerRateLimit struct {
+	packets tokenBucket
+	bytes   tokenBucket
+	// dropped is read and reset at flush
+	dropped int64
+}
+
+// allow reports whether a packet of n bytes is within the rate limit,
+// and counts it as dropped if not. It's a no-op on a nil
+// readerRateLimit.
+func (rrl *readerRateLimit) allow(n int) bool {
+	if rrl == nil {
+		return true
+	}
+	now := time.Now()
+	rrl.packets.refill(now)
+	rrl.bytes.refill(now)
+	// a packet may take more bytes than there are tokens, as long as
+	// there are any, so that packets larger than the rate aren't
+	// dropped forever
+	if !rrl.packets.has(1) || !rrl.bytes.has(1) {
+		atomic.AddInt64(&rrl.dropped, 1)
+		return false
+	}
+	rrl.packets.take(1)
+	rrl.bytes.take(float64(n))
+	return true
+}
+
+// tokenBucket allows a rate of tokens per second, with bursts of up to a
+// second's worth. A bucket with a zero rate is unlimited.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) tokenBucket {
+	return tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if tb.rate == 0 {
+		return
+	}
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+}
+
+func (tb *tokenBucket) has(n float64) bool {
+	return tb.rate == 0 || tb.tokens >= n
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb.rate != 0 {
+		tb.tokens -= n
+	}
+}
+
+// reportRateLimited reports the packets that each rate limited listener
+// dropped since the last flush.
+func (s *Server) reportRateLimited() {
+	s.rateLimitsMtx.Lock()
+	limits := s.rateLimits
+	s.rateLimitsMtx.Unlock()
+
+	samples := make([]*ssf.SSFSample, 0, len(limits))
+	for _, lrl := range limits {
+		address, dropped := lrl.flush()
+		samples = append(samples, ssf.Count("listener.rate_limited_total", float32(dropped),
+			map[string]string{"listener": address, "protocol": lrl.protocol}))
+	}
+	if len(samples) > 0 {
+		metrics.ReportBatch(s.TraceClient, samples)
+	}
+}
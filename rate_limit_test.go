@@ -0,0 +1,76 @@
+package veneur
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderRateLimit(t *testing.T) {
+	s := &Server{}
+	assert.Nil(t, s.newListenerRateLimit("statsd", "127.0.0.1:8126", rateLimit{}),
+		"listeners should be unlimited by default")
+
+	lrl := s.newListenerRateLimit("statsd", "127.0.0.1:8126", rateLimit{packetsPerSecond: 4, bytesPerSecond: 200})
+	rrl := lrl.reader(2)
+	assert.True(t, rrl.allow(10))
+	assert.True(t, rrl.allow(10))
+	assert.False(t, rrl.allow(10), "each reader should get its share of the packets")
+
+	// a second later, the bucket is full again:
+	rrl.packets.last = rrl.packets.last.Add(-time.Second)
+	rrl.bytes.last = rrl.bytes.last.Add(-time.Second)
+	assert.True(t, rrl.allow(150), "packets larger than the remaining bytes should fit")
+	assert.False(t, rrl.allow(1), "the bytes should be used up")
+
+	other := lrl.reader(2)
+	assert.True(t, other.allow(10))
+	lrl.release(rrl)
+
+	address, dropped := lrl.flush()
+	assert.Equal(t, "127.0.0.1:8126", address)
+	assert.Equal(t, int64(2), dropped, "the released reader's drops should still be counted")
+	_, dropped = lrl.flush()
+	assert.Zero(t, dropped)
+	assert.Len(t, s.rateLimits, 1)
+}
+
+func TestSSFStreamRateLimit(t *testing.T) {
+	config := globalConfig()
+	config.SsfRateLimitPacketsPerSecond = 1
+	s, err := NewFromConfig(logrus.New(), config)
+	require.NoError(t, err)
+	lrl := s.newListenerRateLimit("ssf", "/tmp/ssf.sock", s.ssfRateLimit)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.readSSFStreamSocket(server, s.ssfFrameMaxLength(nil), lrl.reader(1), nil)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		// frames that aren't valid SSF, since only the rate limit
+		// matters
+		frame := []byte{0, 0, 0, 0, 0, 'a', 'b', 'c'}
+		binary.BigEndian.PutUint32(frame[1:5], 3)
+		_, err := client.Write(frame)
+		require.NoError(t, err)
+	}
+	client.Close()
+	<-done
+
+	_, dropped := lrl.flush()
+	assert.Equal(t, int64(2), dropped)
+}
+
+func TestNegativeRateLimit(t *testing.T) {
+	config := globalConfig()
+	config.StatsdRateLimitBytesPerSecond = -1
+	_, err := NewFromConfig(logrus.New(), config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,280 @@
+package veneur
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// hotConfigKeys are the settings that reloading the config applies
+// while veneur runs. Changes to any others are only reported, as
+// requiring a restart.
+var hotConfigKeys = map[string]bool{
+	"debug":                            true,
+	"elasticsearch_span_sample_rate":   true,
+	"honeycomb_span_sample_rate":       true,
+	"kafka_span_sample_rate":           true,
+	"metric_name_allow_patterns":       true,
+	"metric_name_deny_patterns":        true,
+	"metric_rewrite_rules":             true,
+	"metric_sink_flush_timeout":        true,
+	"metric_sink_flush_timeouts":       true,
+	"span_name_allow_patterns":         true,
+	"span_name_deny_patterns":          true,
+	"span_scrub_rules":                 true,
+	"splunk_span_sample_rate":          true,
+	"tag_normalization_dedupe_keys":    true,
+	"tag_normalization_lowercase_keys": true,
+	"tag_normalization_renames":        true,
+	"tag_normalization_sanitize":       true,
+	"tags_exclude":                     true,
+}
+
+var errConfigReloadDisabled = errors.New("config reloading isn't enabled")
+
+// configReloader re-reads the config file on SIGHUP, or on a POST to
+// /config/reload.
+type configReloader struct {
+	logger *logrus.Logger
+
+	// mtx serializes reloads. conf is the config in effect: the one
+	// veneur started with, with the hot settings of the last reload.
+	mtx  sync.Mutex
+	path string
+	conf Config
+
+	// pendingExcludedTags are the excluded tags of the metric sinks, by
+	// name, that a reload changed. They're set when the sink isn't
+	// flushing, at the start of a flush.
+	pendingMtx          sync.Mutex
+	pendingExcludedTags map[string][]string
+}
+
+// ConfigReloadResult lists the settings that changed in a config reload,
+// by their keys.
+type ConfigReloadResult struct {
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requires_restart"`
+}
+
+// EnableConfigReload lets the config be reloaded from the file at path,
+// on SIGHUP or a POST to /config/reload, until the server shuts down.
+func (s *Server) EnableConfigReload(path string) {
+	s.reloader.mtx.Lock()
+	s.reloader.path = path
+	s.reloader.mtx.Unlock()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-s.shutdown:
+				return
+			case <-sigs:
+				s.ReloadConfig()
+			}
+		}
+	}()
+}
+
+// ReloadConfig re-reads the config file, and applies the settings in
+// hotConfigKeys that changed. If any of them is invalid, it applies
+// none of them.
+func (s *Server) ReloadConfig() (ConfigReloadResult, error) {
+	s.reloader.mtx.Lock()
+	defer s.reloader.mtx.Unlock()
+
+	res, err := s.reloadConfig()
+	result := "success"
+	if err != nil {
+		result = "error"
+		log.WithError(err).Error("Couldn't reload the config")
+	} else {
+		log.WithFields(logrus.Fields{
+			"applied":          res.Applied,
+			"requires_restart": res.RequiresRestart,
+		}).Info("Reloaded the config")
+	}
+	metrics.ReportOne(s.TraceClient, ssf.Count("config.reload_total", 1,
+		map[string]string{"result": result}))
+	return res, err
+}
+
+func (s *Server) reloadConfig() (ConfigReloadResult, error) {
+	if s.reloader.path == "" {
+		return ConfigReloadResult{}, errConfigReloadDisabled
+	}
+	conf, err := ReadConfig(s.reloader.path)
+	if err != nil {
+		if _, ok := err.(*UnknownConfigKeys); !ok {
+			return ConfigReloadResult{}, err
+		}
+		log.WithError(err).Warn("Reloaded config contains invalid or deprecated keys")
+	}
+	return s.applyConfig(conf)
+}
+
+// applyConfig applies the hot settings of conf that differ from the
+// config in effect. The reloader's mutex must be held.
+func (s *Server) applyConfig(conf Config) (ConfigReloadResult, error) {
+	res := ConfigReloadResult{Applied: []string{}, RequiresRestart: []string{}}
+	current := reflect.ValueOf(&s.reloader.conf).Elem()
+	reloaded := reflect.ValueOf(conf)
+	changed := map[string]bool{}
+	var hot []int
+	for i := 0; i < current.NumField(); i++ {
+		key := configKey(current.Type().Field(i))
+		if key == "" || reflect.DeepEqual(current.Field(i).Interface(), reloaded.Field(i).Interface()) {
+			continue
+		}
+		changed[key] = true
+		if hotConfigKeys[key] {
+			res.Applied = append(res.Applied, key)
+			hot = append(hot, i)
+		} else {
+			res.RequiresRestart = append(res.RequiresRestart, key)
+		}
+	}
+
+	// check every setting before applying any, so that a bad one
+	// leaves them all as they were:
+	metricNameFilter, err := newNameFilter("metric name", conf.MetricNameDenyPatterns, conf.MetricNameAllowPatterns)
+	if err != nil {
+		return res, err
+	}
+	spanNameFilter, err := newNameFilter("span name", conf.SpanNameDenyPatterns, conf.SpanNameAllowPatterns)
+	if err != nil {
+		return res, err
+	}
+	spanScrubber, err := newSpanScrubber(conf.SpanScrubRules)
+	if err != nil {
+		return res, err
+	}
+	metricRewriter, err := newMetricRewriter(conf.MetricRewriteRules)
+	if err != nil {
+		return res, err
+	}
+	timeout, timeouts, err := parseSinkFlushTimeouts(s.interval, conf.MetricSinkFlushTimeout, conf.MetricSinkFlushTimeouts)
+	if err != nil {
+		return res, err
+	}
+
+	if changed["metric_name_allow_patterns"] || changed["metric_name_deny_patterns"] {
+		s.metricNameFilter.store(metricNameFilter)
+	}
+	if changed["span_name_allow_patterns"] || changed["span_name_deny_patterns"] {
+		s.spanNameFilter.store(spanNameFilter)
+	}
+	if changed["span_scrub_rules"] {
+		s.spanScrubber.store(spanScrubber)
+	}
+	if changed["metric_rewrite_rules"] {
+		s.metricRewriter.store(metricRewriter)
+	}
+	if changed["tag_normalization_dedupe_keys"] || changed["tag_normalization_lowercase_keys"] ||
+		changed["tag_normalization_renames"] || changed["tag_normalization_sanitize"] {
+		s.tagNormalizer.Store(samplers.NewTagNormalizer(conf.TagNormalizationLowercaseKeys,
+			conf.TagNormalizationRenames, conf.TagNormalizationSanitize, conf.TagNormalizationDedupeKeys))
+	}
+	if changed["metric_sink_flush_timeout"] || changed["metric_sink_flush_timeouts"] {
+		s.sinkFlushes.setTimeouts(timeout, timeouts)
+	}
+	if changed["debug"] && s.reloader.logger != nil {
+		level := logrus.InfoLevel
+		if conf.Debug {
+			level = logrus.DebugLevel
+		}
+		s.reloader.logger.SetLevel(level)
+	}
+	if changed["tags_exclude"] {
+		s.reloader.pendingMtx.Lock()
+		s.reloader.pendingExcludedTags = map[string][]string{}
+		for _, sink := range s.metricSinks {
+			s.reloader.pendingExcludedTags[sink.Name()] = generateExcludedTags(conf.TagsExclude, sink.Name())
+		}
+		s.reloader.pendingMtx.Unlock()
+	}
+	if changed["splunk_span_sample_rate"] || changed["kafka_span_sample_rate"] ||
+		changed["honeycomb_span_sample_rate"] || changed["elasticsearch_span_sample_rate"] {
+		s.setSpanSampleRates(conf)
+	}
+
+	// the settings that need a restart stay as they were, so that the
+	// next reload reports them again
+	for _, i := range hot {
+		current.Field(i).Set(reloaded.Field(i))
+	}
+	return res, nil
+}
+
+func (s *Server) setSpanSampleRates(conf Config) {
+	type sampledSpanSink interface {
+		SetSpanSampleRate(rate int)
+	}
+	rates := map[string]int{
+		"elasticsearch": conf.ElasticsearchSpanSampleRate,
+		"honeycomb":     conf.HoneycombSpanSampleRate,
+		"kafka":         conf.KafkaSpanSampleRate,
+		"splunk":        conf.SplunkSpanSampleRate,
+	}
+	for _, sink := range s.spanSinks {
+		rate, ok := rates[sink.Name()]
+		if ss, sampled := sink.(sampledSpanSink); ok && sampled {
+			ss.SetSpanSampleRate(rate)
+		}
+	}
+}
+
+// applyPendingExcludedTags sets the excluded tags that a reload changed
+// on the metric sinks that aren't flushing. The others keep theirs until
+// a later flush.
+func (s *Server) applyPendingExcludedTags() {
+	type excludableSink interface {
+		SetExcludedTags([]string)
+	}
+
+	s.reloader.pendingMtx.Lock()
+	defer s.reloader.pendingMtx.Unlock()
+	if len(s.reloader.pendingExcludedTags) == 0 {
+		return
+	}
+	for _, sink := range s.metricSinks {
+		excludedTags, ok := s.reloader.pendingExcludedTags[sink.Name()]
+		if !ok || !s.sinkFlushes.idle(sink.Name()) {
+			continue
+		}
+		if es, ok := sink.(excludableSink); ok {
+			es.SetExcludedTags(excludedTags)
+		}
+		delete(s.reloader.pendingExcludedTags, sink.Name())
+	}
+}
+
+// handleConfigReload reloads the config, and responds with the
+// ConfigReloadResult as JSON.
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := s.ReloadConfig()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == errConfigReloadDisabled {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
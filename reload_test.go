@@ -0,0 +1,112 @@
+package veneur
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestApplyConfig(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "1h"
+	s := setupVeneurServer(t, config, nil, nil, nil)
+	defer s.Shutdown()
+
+	conf := s.reloader.conf
+	conf.MetricNameDenyPatterns = []string{`^debug\.`}
+	conf.TagNormalizationLowercaseKeys = true
+	conf.MetricSinkFlushTimeouts = map[string]string{"datadog": "2s"}
+	conf.SpanScrubRules = []SpanScrubRule{{Action: "delete", KeyPattern: "password"}}
+	conf.StatsdListenAddresses = []string{"udp://127.0.0.1:8126"}
+
+	s.reloader.mtx.Lock()
+	res, err := s.applyConfig(conf)
+	s.reloader.mtx.Unlock()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"metric_name_deny_patterns", "metric_sink_flush_timeouts", "span_scrub_rules",
+		"tag_normalization_lowercase_keys",
+	}, res.Applied)
+	assert.Equal(t, []string{"statsd_listen_addresses"}, res.RequiresRestart)
+
+	require.NotNil(t, s.metricNameFilter.load())
+	_, filtered := s.metricNameFilter.load().filtered("debug.a.b.c")
+	assert.True(t, filtered)
+	assert.NotNil(t, s.tagNormalizer.Load().(*samplers.TagNormalizer))
+	assert.Equal(t, 2*time.Second, s.sinkFlushes.timeoutFor("datadog"))
+	assert.NotNil(t, s.spanScrubber.load())
+
+	// the setting that needs a restart is reported again:
+	s.reloader.mtx.Lock()
+	res, err = s.applyConfig(conf)
+	s.reloader.mtx.Unlock()
+	require.NoError(t, err)
+	assert.Empty(t, res.Applied)
+	assert.Equal(t, []string{"statsd_listen_addresses"}, res.RequiresRestart)
+}
+
+func TestApplyConfigAtomic(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "1h"
+	s := setupVeneurServer(t, config, nil, nil, nil)
+	defer s.Shutdown()
+
+	conf := s.reloader.conf
+	conf.MetricNameDenyPatterns = []string{`^debug\.`}
+	conf.SpanNameDenyPatterns = []string{"("}
+	conf.MetricSinkFlushTimeout = "2s"
+
+	s.reloader.mtx.Lock()
+	_, err := s.applyConfig(conf)
+	s.reloader.mtx.Unlock()
+	assert.Error(t, err)
+	assert.Nil(t, s.metricNameFilter.load(), "no setting should be applied")
+	assert.Nil(t, s.spanNameFilter.load())
+	assert.Equal(t, s.interval, s.sinkFlushes.timeoutFor("datadog"))
+	assert.Empty(t, s.reloader.conf.MetricNameDenyPatterns)
+}
+
+func TestHandleConfigReload(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "1h"
+	s := setupVeneurServer(t, config, nil, nil, nil)
+	defer s.Shutdown()
+
+	w := httptest.NewRecorder()
+	s.handleConfigReload(w, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	f, err := ioutil.TempFile("", "veneur-reload")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	reloaded := s.reloader.conf
+	reloaded.SpanNameDenyPatterns = []string{`^debug\.`}
+	bts, err := yaml.Marshal(reloaded)
+	require.NoError(t, err)
+	_, err = f.Write(bts)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	s.EnableConfigReload(f.Name())
+
+	w = httptest.NewRecorder()
+	s.handleConfigReload(w, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var res ConfigReloadResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Contains(t, res.Applied, "span_name_deny_patterns")
+	assert.NotNil(t, s.spanNameFilter.load())
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("interval: ["), 0644))
+	w = httptest.NewRecorder()
+	s.handleConfigReload(w, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
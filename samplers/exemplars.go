@@ -0,0 +1,37 @@
+package samplers
+
+import "math/rand"
+
+// Exemplar is one of the samples of a histogram or timer, with the ID of
+// the trace it was recorded in, so that sinks can link from the
+// histogram's aggregates to example traces.
+type Exemplar struct {
+	TraceID int64
+	Value   float64
+	// Timestamp is when the sample was received, in Unix nanoseconds.
+	Timestamp int64
+}
+
+// EnableExemplars makes the Histo retain up to limit of the exemplars it's
+// given per interval. Exemplars are off until it's called.
+func (h *Histo) EnableExemplars(limit int) {
+	h.exemplarLimit = limit
+}
+
+// AddExemplar offers an exemplar to the Histo. If the Histo already has
+// as many exemplars as its limit, the exemplar replaces one of them at
+// random, so that the exemplars kept are a uniform sample of the ones
+// offered (reservoir sampling).
+func (h *Histo) AddExemplar(e Exemplar) {
+	if h.exemplarLimit <= 0 {
+		return
+	}
+	h.exemplarsSeen++
+	if len(h.Exemplars) < h.exemplarLimit {
+		h.Exemplars = append(h.Exemplars, e)
+		return
+	}
+	if i := rand.Int63n(h.exemplarsSeen); i < int64(h.exemplarLimit) {
+		h.Exemplars[i] = e
+	}
+}
@@ -0,0 +1,34 @@
+package samplers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoExemplars(t *testing.T) {
+	h := NewHist("a.b.c", nil)
+	h.AddExemplar(Exemplar{TraceID: 1, Value: 1})
+	assert.Empty(t, h.Exemplars, "exemplars should be off by default")
+
+	h.EnableExemplars(3)
+	for i := 1; i <= 1000; i++ {
+		h.Sample(float64(i), 1)
+		h.AddExemplar(Exemplar{TraceID: int64(i), Value: float64(i)})
+	}
+	assert.Len(t, h.Exemplars, 3, "the exemplars should be bounded")
+	late := 0
+	for _, e := range h.Exemplars {
+		if e.TraceID > 3 {
+			late++
+		}
+	}
+	assert.NotZero(t, late, "later exemplars should replace earlier ones")
+
+	metrics := h.Flush(10*time.Second, []float64{0.99}, HistogramAggregates{AggregateCount, 1})
+	assert.Len(t, metrics, 2)
+	for _, m := range metrics {
+		assert.Equal(t, h.Exemplars, m.Exemplars)
+	}
+}
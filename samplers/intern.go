@@ -0,0 +1,70 @@
+package samplers
+
+import (
+	"sync"
+
+	"github.com/segmentio/fasthash/fnv1a"
+)
+
+const (
+	internShards = 64
+	// internShardSize is how many strings each shard holds before it's
+	// emptied, which bounds the table at internShards*internShardSize
+	// strings of up to internMaxLength bytes.
+	internShardSize = 1024
+	internMaxLength = 1024
+)
+
+// stringInterner returns the same string for each run of bytes it has
+// seen recently, so that the names and tags that most packets repeat
+// are only allocated once. It's safe for use by concurrent goroutines.
+type stringInterner struct {
+	shards [internShards]internShard
+}
+
+type internShard struct {
+	mtx     sync.RWMutex
+	strings map[string]string
+}
+
+// parseInterner is the table shared by the statsd parsers.
+var parseInterner = &stringInterner{}
+
+// intern returns b as a string, without allocating if b has been
+// interned before. A shard that fills up is emptied, rather than
+// evicting strings one at a time, so that a burst of unique strings
+// can't keep the common ones out for long.
+func (si *stringInterner) intern(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if len(b) > internMaxLength {
+		return string(b)
+	}
+	shard := &si.shards[shardHash(b)%internShards]
+	shard.mtx.RLock()
+	// map lookups with a converted []byte key don't allocate:
+	s, ok := shard.strings[string(b)]
+	shard.mtx.RUnlock()
+	if ok {
+		return s
+	}
+
+	s = string(b)
+	shard.mtx.Lock()
+	if shard.strings == nil || len(shard.strings) >= internShardSize {
+		shard.strings = make(map[string]string, internShardSize)
+	}
+	shard.strings[s] = s
+	shard.mtx.Unlock()
+	return s
+}
+
+// shardHash hashes b's length and a few of its bytes, which is enough
+// to spread strings across the shards without reading all of them. b
+// mustn't be empty.
+func shardHash(b []byte) uint32 {
+	h := fnv1a.AddUint32(fnv1a.Init32, uint32(len(b)))
+	h = fnv1a.AddUint32(h, uint32(b[len(b)/2])<<16|uint32(b[len(b)-1])<<8|uint32(b[len(b)/4]))
+	return h
+}
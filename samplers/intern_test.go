@@ -0,0 +1,50 @@
+package samplers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringInterner(t *testing.T) {
+	si := &stringInterner{}
+	b := []byte("foo:bar,baz:quux")
+	s := si.intern(b)
+	assert.Equal(t, "foo:bar,baz:quux", s)
+	b[0] = 'g'
+	assert.Equal(t, "foo:bar,baz:quux", s, "interned strings should be copies")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		si.intern([]byte("goo:bar,baz:quux"))
+	})
+	assert.Equal(t, 0.0, allocs)
+
+	for i := 0; i < internShards*internShardSize*2; i++ {
+		si.intern([]byte(fmt.Sprintf("tag:%d", i)))
+	}
+	for i := range si.shards {
+		assert.True(t, len(si.shards[i].strings) <= internShardSize,
+			"shard %d has %d strings", i, len(si.shards[i].strings))
+	}
+}
+
+func TestParseMetricsInternedTags(t *testing.T) {
+	packet := []byte("a.b.c:1:2|c|#foo:bar,baz:quux")
+	first, err := ParseMetrics(packet, "")
+	require.NoError(t, err)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		ParseMetrics(packet, "")
+	})
+	// the metrics, their values, and the tags slice
+	assert.Equal(t, 4.0, allocs)
+
+	second, err := ParseMetrics(packet, "container")
+	require.NoError(t, err)
+	assert.Equal(t, first[0].Tags, second[0].Tags)
+	assert.Equal(t, "baz:quux,foo:bar", second[1].JoinedTags)
+	assert.Equal(t, len(second[0].Tags), cap(second[0].Tags),
+		"metrics sharing tags shouldn't be able to append to them in place")
+}
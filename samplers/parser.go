@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/segmentio/fasthash/fnv1a"
@@ -30,6 +31,13 @@ type UDPMetric struct {
 	Timestamp  int64
 	Message    string
 	HostName   string
+	// Size is the length of the DogStatsD line that the metric was
+	// parsed from, split between the values of a multi-value line. It's
+	// 0 for metrics from elsewhere.
+	Size int
+	// TraceID is the ID of the trace of the span that the metric was
+	// attached to, if any.
+	TraceID int64
 }
 
 type MetricScope int
@@ -82,6 +90,7 @@ func ConvertMetrics(m *ssf.SSFSpan) ([]UDPMetric, error) {
 			invalid = append(invalid, metricPacket)
 			continue
 		}
+		metric.TraceID = m.TraceId
 		metrics = append(metrics, metric)
 	}
 	if len(invalid) != 0 {
@@ -116,6 +125,7 @@ func ConvertIndicatorMetrics(span *ssf.SSFSpan, timerName string) (metrics []UDP
 	if err != nil {
 		return metrics, err
 	}
+	timer.TraceID = span.TraceId
 	metrics = append(metrics, timer)
 	return metrics, nil
 }
@@ -229,8 +239,27 @@ func ParseMetricSSF(metric *ssf.SSFSample) (UDPMetric, error) {
 
 // ParseMetric converts the incoming packet from Datadog DogStatsD
 // Datagram format in to a Metric. http://docs.datadoghq.com/guides/dogstatsd/#datagram-format
+// If the packet has several values, only the first is returned; use
+// ParseMetrics to get all of them.
 func ParseMetric(packet []byte) (*UDPMetric, error) {
-	ret := &UDPMetric{
+	metrics, err := ParseMetrics(packet, "")
+	if err != nil {
+		return nil, err
+	}
+	return &metrics[0], nil
+}
+
+// ParseMetrics converts the incoming packet from Datadog DogStatsD
+// Datagram format in to a Metric for each of its values, which are
+// separated by colons (e.g. "foo:1:2:3|ms"). They all share the packet's
+// tags and sample rate. Values that can't be parsed are dropped, and an
+// error is only returned if none of them can be.
+//
+// If containerIDTag isn't empty, the container ID that newer clients
+// send in a |c: section is added to the metrics' tags as
+// containerIDTag:<id>. Otherwise, the container ID is discarded.
+func ParseMetrics(packet []byte, containerIDTag string) ([]UDPMetric, error) {
+	ret := UDPMetric{
 		SampleRate: 1.0,
 	}
 	pipeSplitter := NewSplitBytes(packet, '|')
@@ -256,11 +285,6 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 		return nil, errors.New("Invalid metric packet, metric type not specified")
 	}
 
-	h := fnv1a.Init32
-
-	ret.Name = string(nameChunk)
-	h = fnv1a.AddString32(h, ret.Name)
-
 	// Decide on a type
 	switch typeChunk[0] {
 	case 'c':
@@ -276,22 +300,33 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 	default:
 		return nil, invalidMetricTypeError
 	}
-	// Add the type to the digest
-	h = fnv1a.AddString32(h, ret.Type)
 
-	// Now convert the metric's value
-	if ret.Type == "set" {
-		ret.Value = string(valueChunk)
-	} else {
-		v, err := strconv.ParseFloat(string(valueChunk), 64)
+	// Now convert the metric's values; the rest of each metric is filled
+	// in once the other sections are parsed
+	metrics := make([]UDPMetric, 0, bytes.Count(valueChunk, []byte{':'})+1)
+	var valueErr error
+	valueSplitter := NewSplitBytes(valueChunk, ':')
+	for valueSplitter.Next() {
+		if ret.Type == "set" {
+			metrics = append(metrics, UDPMetric{Value: string(valueSplitter.Chunk())})
+			continue
+		}
+		v, err := strconv.ParseFloat(string(valueSplitter.Chunk()), 64)
 		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
-			return nil, fmt.Errorf("Invalid number for metric value: %s", valueChunk)
+			valueErr = fmt.Errorf("Invalid number for metric value: %s", valueSplitter.Chunk())
+			continue
 		}
-		ret.Value = v
+		metrics = append(metrics, UDPMetric{Value: v})
+	}
+	if len(metrics) == 0 {
+		return nil, valueErr
 	}
 
 	// each of these sections can only appear once in the packet
 	foundSampleRate := false
+	foundTimestamp := false
+	foundContainerID := false
+	var containerID []byte
 	for pipeSplitter.Next() {
 		if len(pipeSplitter.Chunk()) == 0 {
 			// avoid panicking on malformed packets that have too many pipes
@@ -304,8 +339,8 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 				return nil, errors.New("Invalid metric packet, multiple sample rates specified")
 			}
 			// sample rate!
-			sr := string(pipeSplitter.Chunk()[1:])
-			sampleRate, err := strconv.ParseFloat(sr, 32)
+			sr := pipeSplitter.Chunk()[1:]
+			sampleRate, err := strconv.ParseFloat(string(sr), 32)
 			if err != nil {
 				return nil, fmt.Errorf("Invalid float for sample rate: %s", sr)
 			}
@@ -315,6 +350,30 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 			ret.SampleRate = float32(sampleRate)
 			foundSampleRate = true
 
+		case 'T':
+			if foundTimestamp {
+				return nil, errors.New("Invalid metric packet, multiple timestamps specified")
+			}
+			// a timestamp supplied by the client, to backfill late data
+			ts := pipeSplitter.Chunk()[1:]
+			timestamp, err := strconv.ParseInt(string(ts), 10, 64)
+			if err != nil || timestamp <= 0 {
+				return nil, fmt.Errorf("Invalid unix timestamp: %s", ts)
+			}
+			ret.Timestamp = timestamp
+			foundTimestamp = true
+
+		case 'c':
+			if len(pipeSplitter.Chunk()) < 2 || pipeSplitter.Chunk()[1] != ':' {
+				return nil, fmt.Errorf("Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
+			}
+			if foundContainerID {
+				return nil, errors.New("Invalid metric packet, multiple container IDs specified")
+			}
+			// the ID of the client's container, for origin detection
+			containerID = pipeSplitter.Chunk()[2:]
+			foundContainerID = true
+
 		case '#':
 			// tags!
 			if ret.Tags != nil {
@@ -323,7 +382,12 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 			// should we be filtering known key tags from here?
 			// in order to prevent extremely high cardinality in the global stats?
 			// see worker.go line 273
-			tags := strings.Split(string(pipeSplitter.Chunk()[1:]), ",")
+			tagChunk := pipeSplitter.Chunk()[1:]
+			// the tags are substrings of the interned section, so that
+			// a packet with the same tags as an earlier one only
+			// allocates the slice, which has room for each tag and the
+			// container ID tag
+			tags := splitTags(parseInterner.intern(tagChunk), bytes.Count(tagChunk, []byte{','})+2)
 			sort.Strings(tags)
 			for i, tag := range tags {
 				// we use this tag as an escape hatch for metrics that always
@@ -341,19 +405,84 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 				}
 			}
 			ret.Tags = tags
-			// we specifically need the sorted version here so that hashing over
-			// tags behaves deterministically
-			ret.JoinedTags = strings.Join(tags, ",")
-			h = fnv1a.AddString32(h, ret.JoinedTags)
 
 		default:
 			return nil, fmt.Errorf("Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
 		}
 	}
 
+	if containerIDTag != "" && len(containerID) > 0 {
+		ret.Tags = append(ret.Tags, containerIDTag+":"+string(containerID))
+		sort.Strings(ret.Tags)
+	}
+	h := fnv1a.Init32
+	if ret.Tags != nil {
+		// a tagged metric's name is usually repeated by other packets
+		// with other tags, which makes interning it worthwhile; looking
+		// up an untagged metric's name costs more than allocating it
+		ret.Name = parseInterner.intern(nameChunk)
+	} else {
+		ret.Name = string(nameChunk)
+	}
+	h = fnv1a.AddString32(h, ret.Name)
+	h = fnv1a.AddString32(h, ret.Type)
+	if ret.Tags != nil {
+		// we specifically need the sorted version here so that hashing over
+		// tags behaves deterministically
+		ret.JoinedTags = joinTags(ret.Tags)
+		h = fnv1a.AddString32(h, ret.JoinedTags)
+		// the metrics share the tags, so leave no room to append to
+		// them in place
+		ret.Tags = ret.Tags[:len(ret.Tags):len(ret.Tags)]
+	}
 	ret.Digest = h
 
-	return ret, nil
+	for i := range metrics {
+		value := metrics[i].Value
+		metrics[i] = ret
+		metrics[i].Value = value
+		metrics[i].Size = len(packet) / len(metrics)
+	}
+	metrics[0].Size += len(packet) % len(metrics)
+	return metrics, nil
+}
+
+// splitTags splits the comma-separated tags into a slice with room for
+// n of them, without copying them.
+func splitTags(tags string, n int) []string {
+	ret := make([]string, 0, n)
+	for {
+		comma := strings.IndexByte(tags, ',')
+		if comma == -1 {
+			return append(ret, tags)
+		}
+		ret = append(ret, tags[:comma])
+		tags = tags[comma+1:]
+	}
+}
+
+var joinBufPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// joinTags is strings.Join(tags, ","), except that the result is
+// interned, so that joining the same tags again doesn't allocate.
+func joinTags(tags []string) string {
+	if len(tags) == 1 {
+		return tags[0]
+	}
+	buf := joinBufPool.Get().(*[]byte)
+	b := (*buf)[:0]
+	for i, tag := range tags {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, tag...)
+	}
+	joined := parseInterner.intern(b)
+	*buf = b
+	joinBufPool.Put(buf)
+	return joined
 }
 
 // ParseEvent parses a DogStatsD event packet and returns an SSF sample or an
@@ -1,6 +1,7 @@
 package samplers
 
 import (
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
@@ -75,3 +76,26 @@ func BenchmarkConvertSpanUniquenessMetrics(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkParseMetrics(b *testing.B) {
+	for _, numTags := range []int{0, 5, 20} {
+		packet := []byte("api.request.duration:12.5|ms|@0.5")
+		if numTags > 0 {
+			packet = append(packet, "|#"...)
+			for i := 0; i < numTags; i++ {
+				if i > 0 {
+					packet = append(packet, ',')
+				}
+				packet = append(packet, fmt.Sprintf("tag%02d:value%d", numTags-i, i)...)
+			}
+		}
+		b.Run(fmt.Sprintf("tags=%d", numTags), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseMetrics(packet, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
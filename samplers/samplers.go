@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"strconv"
 	"strings"
 	"time"
 
@@ -58,6 +59,11 @@ type InterMetric struct {
 	// should be inserted into. If nil, that means the metric is
 	// meant to go to every sink.
 	Sinks RouteInformation
+
+	// Exemplars are example samples of the histogram or timer that the
+	// metric is an aggregate of, with their trace IDs. Sinks that can't
+	// represent them ignore them.
+	Exemplars []Exemplar
 }
 
 type Aggregate int
@@ -70,6 +76,7 @@ const (
 	AggregateCount
 	AggregateSum
 	AggregateHarmonicMean
+	AggregateSumSquares
 )
 
 var AggregatesLookup = map[string]Aggregate{
@@ -80,6 +87,7 @@ var AggregatesLookup = map[string]Aggregate{
 	"count":  AggregateCount,
 	"sum":    AggregateSum,
 	"hmean":  AggregateHarmonicMean,
+	"sumsq":  AggregateSumSquares,
 }
 
 type HistogramAggregates struct {
@@ -95,6 +103,89 @@ var aggregates = [...]string{
 	AggregateCount:        "count",
 	AggregateSum:          "sum",
 	AggregateHarmonicMean: "hmean",
+	AggregateSumSquares:   "sumsq",
+}
+
+// ParseHistogramAggregates returns the HistogramAggregates with the
+// aggregates named in names, which must all be in AggregatesLookup.
+func ParseHistogramAggregates(names []string) (HistogramAggregates, error) {
+	var ha HistogramAggregates
+	for _, name := range names {
+		agg, ok := AggregatesLookup[name]
+		if !ok {
+			return HistogramAggregates{}, fmt.Errorf("unknown aggregate %q", name)
+		}
+		if ha.Value&agg == 0 {
+			ha.Value |= agg
+			ha.Count++
+		}
+	}
+	return ha, nil
+}
+
+// AggregatesTag is the key of the tags that set which aggregates and
+// percentiles a histogram or timer is flushed with, instead of the
+// configured ones, e.g. "veneur_aggregates:min/max/p95". Since DogStatsD
+// tags are separated by commas, the names are separated by slashes, or
+// the tag can be repeated. The tags are kept while the histogram is
+// forwarded, so that the global veneur flushes it the same way, but
+// they're removed when it's flushed to sinks.
+const AggregatesTag = "veneur_aggregates"
+
+const aggregatesTagPrefix = AggregatesTag + ":"
+
+// AggregateOverride is the aggregates and percentiles that a histogram
+// is flushed with, instead of the configured ones.
+type AggregateOverride struct {
+	Aggregates  HistogramAggregates
+	Percentiles []float64
+}
+
+// ParseAggregateOverride returns the AggregateOverride with the
+// aggregates in names, which can be those in AggregatesLookup, or
+// percentiles like "p95".
+func ParseAggregateOverride(names []string) (*AggregateOverride, error) {
+	o := &AggregateOverride{}
+	var aggs []string
+	for _, name := range names {
+		if len(name) > 1 && name[0] == 'p' {
+			if p, err := strconv.Atoi(name[1:]); err == nil {
+				if p < 0 || p > 100 {
+					return nil, fmt.Errorf("percentile %q is out of range", name)
+				}
+				o.Percentiles = append(o.Percentiles, float64(p)/100)
+				continue
+			}
+		}
+		aggs = append(aggs, name)
+	}
+	var err error
+	o.Aggregates, err = ParseHistogramAggregates(aggs)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// aggregateOverrideFromTags returns the AggregateOverride set by the
+// AggregatesTag tags, or nil if there aren't any, or they're invalid.
+func aggregateOverrideFromTags(tags []string) *AggregateOverride {
+	var names []string
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, aggregatesTagPrefix) {
+			names = append(names, strings.FieldsFunc(tag[len(aggregatesTagPrefix):], func(r rune) bool {
+				return r == '/' || r == ','
+			})...)
+		}
+	}
+	if names == nil {
+		return nil
+	}
+	o, err := ParseAggregateOverride(names)
+	if err != nil {
+		return nil
+	}
+	return o
 }
 
 // JSONMetric is used to represent a metric that can be remarshaled with its
@@ -107,6 +198,43 @@ type JSONMetric struct {
 	Value []byte `json:"value"`
 }
 
+// jsonMetricExporter is implemented by the samplers that a JSONMetric
+// can be decoded into.
+type jsonMetricExporter interface {
+	Combine([]byte) error
+	Metric() (*metricpb.Metric, error)
+}
+
+// Metric decodes the JSONMetric's value, and returns the equivalent
+// metricpb.Metric, which is what's forwarded over gRPC.
+func (jm JSONMetric) Metric() (*metricpb.Metric, error) {
+	var s jsonMetricExporter
+	mType := metricpb.Type_Histogram
+	switch jm.Type {
+	case "counter":
+		s, mType = NewCounter(jm.Name, jm.Tags), metricpb.Type_Counter
+	case "gauge":
+		s, mType = NewGauge(jm.Name, jm.Tags), metricpb.Type_Gauge
+	case "set":
+		s, mType = NewSet(jm.Name, jm.Tags), metricpb.Type_Set
+	case "histogram":
+		s = NewHist(jm.Name, jm.Tags)
+	case "timer":
+		s, mType = NewHist(jm.Name, jm.Tags), metricpb.Type_Timer
+	default:
+		return nil, fmt.Errorf("can't convert a metric of type %q", jm.Type)
+	}
+	if err := s.Combine(jm.Value); err != nil {
+		return nil, err
+	}
+	m, err := s.Metric()
+	if err != nil {
+		return nil, err
+	}
+	m.Type = mType
+	return m, nil
+}
+
 const sinkPrefix string = "veneursinkonly:"
 
 func routeInfo(tags []string) RouteInformation {
@@ -126,11 +254,34 @@ func routeInfo(tags []string) RouteInformation {
 	return info
 }
 
+// WithoutRouteTags returns tags without the veneursinkonly tags that
+// route a metric, which sinks shouldn't report. It returns tags itself
+// if there are none.
+func WithoutRouteTags(tags []string) []string {
+	var stripped []string
+	for i, tag := range tags {
+		if strings.HasPrefix(tag, sinkPrefix) {
+			if stripped == nil {
+				stripped = append(make([]string, 0, len(tags)-1), tags[:i]...)
+			}
+			continue
+		}
+		if stripped != nil {
+			stripped = append(stripped, tag)
+		}
+	}
+	if stripped == nil {
+		return tags
+	}
+	return stripped
+}
+
 // Counter is an accumulator
 type Counter struct {
-	Name  string
-	Tags  []string
-	value int64
+	Name    string
+	Tags    []string
+	value   int64
+	samples int64
 }
 
 // GetName returns the name of the counter.
@@ -141,6 +292,7 @@ func (c *Counter) GetName() string {
 // Sample adds a sample to the counter.
 func (c *Counter) Sample(sample float64, sampleRate float32) {
 	c.value += int64(sample) * int64(1/sampleRate)
+	c.samples++
 }
 
 // Flush generates an InterMetric from the current state of this Counter.
@@ -157,6 +309,28 @@ func (c *Counter) Flush(interval time.Duration) []InterMetric {
 	}}
 }
 
+// TimestampedInterMetric converts a counter or gauge that its client
+// sent with a timestamp into an InterMetric with that timestamp. These
+// aren't aggregated: like the Datadog agent, each one is flushed as it
+// was received, with counters scaled by their sample rate.
+func TimestampedInterMetric(m *UDPMetric) InterMetric {
+	tags := make([]string, len(m.Tags))
+	copy(tags, m.Tags)
+	im := InterMetric{
+		Name:      m.Name,
+		Timestamp: m.Timestamp,
+		Value:     m.Value.(float64),
+		Tags:      tags,
+		Type:      GaugeMetric,
+		Sinks:     routeInfo(tags),
+	}
+	if m.Type == "counter" {
+		im.Type = CounterMetric
+		im.Value = im.Value / float64(m.SampleRate)
+	}
+	return im
+}
+
 // Export converts a Counter into a JSONMetric which reports the rate.
 func (c *Counter) Export() (JSONMetric, error) {
 	buf := new(bytes.Buffer)
@@ -188,6 +362,7 @@ func (c *Counter) Combine(other []byte) error {
 	}
 
 	c.value += otherCounts
+	c.samples++
 
 	return nil
 }
@@ -207,6 +382,7 @@ func (c *Counter) Metric() (*metricpb.Metric, error) {
 // Merge adds the value from the input CounterValue to this one.
 func (c *Counter) Merge(v *metricpb.CounterValue) {
 	c.value += v.Value
+	c.samples++
 }
 
 // NewCounter generates and returns a new Counter.
@@ -214,22 +390,94 @@ func NewCounter(Name string, Tags []string) *Counter {
 	return &Counter{Name: Name, Tags: Tags}
 }
 
-// Gauge retains whatever the last value was.
+// GaugeAggregation is how a gauge combines the values it's sampled with
+// in an interval.
+type GaugeAggregation int
+
+const (
+	// GaugeLast keeps the last value, which is the default.
+	GaugeLast GaugeAggregation = iota
+	// GaugeMin keeps the smallest value.
+	GaugeMin
+	// GaugeMax keeps the largest value.
+	GaugeMax
+	// GaugeSum adds the values up.
+	GaugeSum
+	// GaugeMean averages the values.
+	GaugeMean
+)
+
+var gaugeAggregationNames = []string{"last", "min", "max", "sum", "mean"}
+
+func (a GaugeAggregation) String() string {
+	if a < 0 || int(a) >= len(gaugeAggregationNames) {
+		return fmt.Sprintf("GaugeAggregation(%d)", int(a))
+	}
+	return gaugeAggregationNames[a]
+}
+
+// ParseGaugeAggregation returns the GaugeAggregation called name.
+func ParseGaugeAggregation(name string) (GaugeAggregation, error) {
+	for i, n := range gaugeAggregationNames {
+		if n == name {
+			return GaugeAggregation(i), nil
+		}
+	}
+	return GaugeLast, fmt.Errorf("unknown gauge aggregation %q", name)
+}
+
+// GaugeAggregationTag is the key of the tag that sets a gauge's
+// aggregation, e.g. "veneur_gauge_agg:max". The tag is kept while the
+// gauge is forwarded, so that the global veneur merges it the same way,
+// but it's removed when the gauge is flushed to sinks.
+const GaugeAggregationTag = "veneur_gauge_agg"
+
+const gaugeAggregationTagPrefix = GaugeAggregationTag + ":"
+
+// Gauge keeps the last value it was sampled with, or combines the values
+// with its GaugeAggregation.
 type Gauge struct {
-	Name  string
-	Tags  []string
-	value float64
+	Name        string
+	Tags        []string
+	Aggregation GaugeAggregation
+	value       float64
+	count       int64
 }
 
-// Sample takes on whatever value is passed in as a sample.
+// Sample combines the sample with the gauge's value.
 func (g *Gauge) Sample(sample float64, sampleRate float32) {
-	g.value = sample
+	g.add(sample)
+}
+
+func (g *Gauge) add(v float64) {
+	g.count++
+	switch g.Aggregation {
+	case GaugeMin:
+		if g.count == 1 || v < g.value {
+			g.value = v
+		}
+	case GaugeMax:
+		if g.count == 1 || v > g.value {
+			g.value = v
+		}
+	case GaugeSum:
+		g.value += v
+	case GaugeMean:
+		// a running mean, so the sum can't overflow
+		g.value += (v - g.value) / float64(g.count)
+	default:
+		g.value = v
+	}
 }
 
 // Flush generates an InterMetric from the current state of this gauge.
 func (g *Gauge) Flush() []InterMetric {
-	tags := make([]string, len(g.Tags))
-	copy(tags, g.Tags)
+	tags := make([]string, 0, len(g.Tags))
+	for _, tag := range g.Tags {
+		if !strings.HasPrefix(tag, gaugeAggregationTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
 	return []InterMetric{{
 		Name:      g.Name,
 		Timestamp: time.Now().Unix(),
@@ -261,7 +509,9 @@ func (g *Gauge) Export() (JSONMetric, error) {
 	}, nil
 }
 
-// Combine is pretty naïve for Gauges, as it just overwrites the value.
+// Combine combines another gauge's value with this one's, as if it were
+// sampled with it. Mean gauges average the other gauges' means, without
+// weighting them by how many samples each had.
 func (g *Gauge) Combine(other []byte) error {
 	var otherValue float64
 	buf := bytes.NewReader(other)
@@ -271,7 +521,7 @@ func (g *Gauge) Combine(other []byte) error {
 		return err
 	}
 
-	g.value = otherValue
+	g.add(otherValue)
 
 	return nil
 }
@@ -293,14 +543,31 @@ func (g *Gauge) Metric() (*metricpb.Metric, error) {
 	}, nil
 }
 
-// Merge sets the value of this Gauge to the value of the other.
+// Merge combines the value of the other Gauge with this one's, like
+// Combine.
 func (g *Gauge) Merge(v *metricpb.GaugeValue) {
-	g.value = v.Value
+	g.add(v.Value)
 }
 
-// NewGauge generates an empty (valueless) Gauge
+// NewGauge generates an empty (valueless) Gauge, with the aggregation set
+// by its GaugeAggregationTag tag, or GaugeLast.
 func NewGauge(Name string, Tags []string) *Gauge {
-	return &Gauge{Name: Name, Tags: Tags}
+	return NewAggregatedGauge(Name, Tags, GaugeLast)
+}
+
+// NewAggregatedGauge generates an empty Gauge with the aggregation agg,
+// unless its tags set a different one with GaugeAggregationTag. An
+// unknown aggregation in the tag is ignored.
+func NewAggregatedGauge(Name string, Tags []string, agg GaugeAggregation) *Gauge {
+	for _, tag := range Tags {
+		if strings.HasPrefix(tag, gaugeAggregationTagPrefix) {
+			if tagged, err := ParseGaugeAggregation(tag[len(gaugeAggregationTagPrefix):]); err == nil {
+				agg = tagged
+			}
+			break
+		}
+	}
+	return &Gauge{Name: Name, Tags: Tags, Aggregation: agg}
 }
 
 // StatusCheck retains whatever the last value was.
@@ -365,22 +632,53 @@ func NewStatusCheck(Name string, Tags []string) *StatusCheck {
 
 // Set is a list of unique values seen.
 type Set struct {
-	Name string
-	Tags []string
-	Hll  *hyperloglog.Sketch
+	Name    string
+	Tags    []string
+	Hll     *hyperloglog.Sketch
+	samples int64
 }
 
 // Sample checks if the supplied value has is already in the filter. If not, it increments
 // the counter!
 func (s *Set) Sample(sample string, sampleRate float32) {
 	s.Hll.Insert([]byte(sample))
+	s.samples++
 }
 
-// NewSet generates a new Set and returns it
+// The precisions that a Set's HyperLogLog can have. A sketch with
+// precision p has 2^p registers, and a standard error of about
+// 1.04/sqrt(2^p): 0.81% for 14, and 0.41% for 16, which takes up to 4
+// times the memory.
+const (
+	SetPrecision14      uint8 = 14
+	SetPrecision16      uint8 = 16
+	DefaultSetPrecision       = SetPrecision14
+)
+
+// ValidateSetPrecision returns an error if a Set can't have the
+// precision. Only those the HyperLogLog has tuned estimators for are
+// supported.
+func ValidateSetPrecision(precision uint8) error {
+	if precision != SetPrecision14 && precision != SetPrecision16 {
+		return fmt.Errorf("unsupported set precision %d, must be %d or %d",
+			precision, SetPrecision14, SetPrecision16)
+	}
+	return nil
+}
+
+// NewSet generates a new Set with the DefaultSetPrecision and returns it
 func NewSet(Name string, Tags []string) *Set {
-	// error is only returned if precision is outside the 4-18 range
-	// TODO: this is the maximum precision, should it be configurable?
-	Hll := hyperloglog.New()
+	return NewSetWithPrecision(Name, Tags, DefaultSetPrecision)
+}
+
+// NewSetWithPrecision generates a new Set whose HyperLogLog has the
+// precision, which should be valid according to ValidateSetPrecision;
+// otherwise it gets the DefaultSetPrecision.
+func NewSetWithPrecision(Name string, Tags []string, precision uint8) *Set {
+	Hll := hyperloglog.New14()
+	if precision == SetPrecision16 {
+		Hll = hyperloglog.New16()
+	}
 	return &Set{
 		Name: Name,
 		Tags: Tags,
@@ -419,17 +717,24 @@ func (s *Set) Export() (JSONMetric, error) {
 	}, nil
 }
 
-// Combine merges the values seen with another set (marshalled as a byte slice)
+// Combine merges the values seen with another set (marshalled as a byte
+// slice). Sketches can only be merged if they have the same precision,
+// so if this set is empty, it takes on the other set's precision (that
+// is, the global veneur merges sets at the precision the local veneurs
+// sent them with); otherwise, the precisions must match.
 func (s *Set) Combine(other []byte) error {
 	otherHLL := hyperloglog.New()
 	if err := otherHLL.UnmarshalBinary(other); err != nil {
 		return err
 	}
+	s.samples++
+	if s.Hll.Estimate() == 0 {
+		s.Hll = otherHLL
+		return nil
+	}
 	if err := s.Hll.Merge(otherHLL); err != nil {
-		// does not error unless compressions are different
-		// however, decoding the other Hll causes us to use its compression
-		// parameter, which might be different from ours
-		return err
+		// only errors if the precisions are different
+		return fmt.Errorf("can't merge set %q: %v", s.Name, err)
 	}
 	return nil
 }
@@ -477,7 +782,18 @@ type Histo struct {
 	LocalMin           float64
 	LocalMax           float64
 	LocalSum           float64
+	LocalSumSquares    float64
 	LocalReciprocalSum float64
+
+	// Override, if set, is flushed instead of the configured aggregates
+	// and percentiles. It's set by the histogram's AggregatesTag tags.
+	Override *AggregateOverride
+
+	// Exemplars are a sample of the exemplars added to this instance
+	// of the histogram, if they're enabled. They aren't forwarded.
+	Exemplars     []Exemplar
+	exemplarLimit int
+	exemplarsSeen int64
 }
 
 // Sample adds the supplied value to the histogram.
@@ -489,6 +805,7 @@ func (h *Histo) Sample(sample float64, sampleRate float32) {
 	h.LocalMin = math.Min(h.LocalMin, sample)
 	h.LocalMax = math.Max(h.LocalMax, sample)
 	h.LocalSum += sample * weight
+	h.LocalSumSquares += sample * sample * weight
 
 	h.LocalReciprocalSum += (1 / sample) * weight
 }
@@ -503,12 +820,22 @@ func NewHist(Name string, Tags []string) *Histo {
 		LocalMin: math.Inf(+1),
 		LocalMax: math.Inf(-1),
 		LocalSum: 0,
+		Override: aggregateOverrideFromTags(Tags),
 	}
 }
 
 // Flush generates InterMetrics for the current state of the Histo. percentiles
 // indicates what percentiles should be exported from the histogram.
+// If the Histo has an Override, its aggregates are exported instead of
+// aggregates, and its percentiles instead of percentiles, unless
+// percentiles is nil because they're exported elsewhere.
 func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates HistogramAggregates) []InterMetric {
+	if h.Override != nil {
+		aggregates = h.Override.Aggregates
+		if percentiles != nil {
+			percentiles = h.Override.Percentiles
+		}
+	}
 	now := time.Now().Unix()
 	metrics := make([]InterMetric, 0, aggregates.Count+len(percentiles))
 	sinks := routeInfo(h.Tags)
@@ -516,8 +843,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 	if (aggregates.Value&AggregateMax) == AggregateMax && !math.IsInf(h.LocalMax, 0) {
 		// Defensively recopy tags to avoid aliasing bugs in case multiple InterMetrics share the same
 		// tag array in the future
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(metrics, InterMetric{
 			Name:      fmt.Sprintf("%s.max", h.Name),
 			Timestamp: now,
@@ -528,8 +854,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 		})
 	}
 	if (aggregates.Value&AggregateMin) == AggregateMin && !math.IsInf(h.LocalMin, 0) {
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(metrics, InterMetric{
 			Name:      fmt.Sprintf("%s.min", h.Name),
 			Timestamp: now,
@@ -541,8 +866,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 	}
 
 	if (aggregates.Value&AggregateSum) == AggregateSum && h.LocalSum != 0 {
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(metrics, InterMetric{
 			Name:      fmt.Sprintf("%s.sum", h.Name),
 			Timestamp: now,
@@ -553,11 +877,22 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 		})
 	}
 
+	if (aggregates.Value&AggregateSumSquares) == AggregateSumSquares && h.LocalSumSquares != 0 {
+		tags := h.flushTags()
+		metrics = append(metrics, InterMetric{
+			Name:      fmt.Sprintf("%s.sumsq", h.Name),
+			Timestamp: now,
+			Value:     float64(h.LocalSumSquares),
+			Tags:      tags,
+			Type:      GaugeMetric,
+			Sinks:     sinks,
+		})
+	}
+
 	if (aggregates.Value&AggregateAverage) == AggregateAverage && h.LocalSum != 0 && h.LocalWeight != 0 {
 		// we need both a rate and a non-zero sum before it will make sense
 		// to submit an average
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(metrics, InterMetric{
 			Name:      fmt.Sprintf("%s.avg", h.Name),
 			Timestamp: now,
@@ -572,8 +907,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 		// if we haven't received any local samples, then leave this sparse,
 		// otherwise it can lead to some misleading zeroes in between the
 		// flushes of downstream instances
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(metrics, InterMetric{
 			Name:      fmt.Sprintf("%s.count", h.Name),
 			Timestamp: now,
@@ -585,8 +919,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 	}
 
 	if (aggregates.Value & AggregateMedian) == AggregateMedian {
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(
 			metrics,
 			InterMetric{
@@ -603,8 +936,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 	if (aggregates.Value&AggregateHarmonicMean) == AggregateHarmonicMean && h.LocalReciprocalSum != 0 && h.LocalWeight != 0 {
 		// we need both a rate and a non-zero sum before it will make sense
 		// to submit an average
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(metrics, InterMetric{
 			Name:      fmt.Sprintf("%s.hmean", h.Name),
 			Timestamp: now,
@@ -616,13 +948,11 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 	}
 
 	for _, p := range percentiles {
-		tags := make([]string, len(h.Tags))
-		copy(tags, h.Tags)
+		tags := h.flushTags()
 		metrics = append(
 			metrics,
-			// TODO Fix to allow for p999, etc
 			InterMetric{
-				Name:      fmt.Sprintf("%s.%dpercentile", h.Name, int(p*100)),
+				Name:      fmt.Sprintf("%s.%spercentile", h.Name, PercentileName(p)),
 				Timestamp: now,
 				Value:     float64(h.Value.Quantile(p)),
 				Tags:      tags,
@@ -632,9 +962,38 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 		)
 	}
 
+	if len(h.Exemplars) > 0 {
+		for i := range metrics {
+			metrics[i].Exemplars = h.Exemplars
+		}
+	}
+
 	return metrics
 }
 
+// PercentileName returns the name of the percentile series for the
+// quantile p, without its "percentile" suffix: "99" for 0.99, and
+// "99_9" for 0.999, since a percentile name can't contain a dot.
+func PercentileName(p float64) string {
+	pct := math.Round(p*100*1e6) / 1e6
+	if pct == math.Trunc(pct) {
+		return strconv.Itoa(int(pct))
+	}
+	return strings.Replace(strconv.FormatFloat(pct, 'f', -1, 64), ".", "_", 1)
+}
+
+// flushTags returns a copy of the Histo's tags, without its
+// AggregatesTag tags.
+func (h *Histo) flushTags() []string {
+	tags := make([]string, 0, len(h.Tags))
+	for _, tag := range h.Tags {
+		if !strings.HasPrefix(tag, aggregatesTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
 // Export converts a Histogram into a JSONMetric
 func (h *Histo) Export() (JSONMetric, error) {
 	val, err := h.Value.GobEncode()
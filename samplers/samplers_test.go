@@ -1,6 +1,7 @@
 package samplers
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"strconv"
@@ -8,6 +9,8 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers/metricpb"
 	"github.com/stripe/veneur/ssf"
 )
 
@@ -46,6 +49,14 @@ func TestRouting(t *testing.T) {
 	}
 }
 
+func TestWithoutRouteTags(t *testing.T) {
+	tags := []string{"foo:bar", "baz"}
+	assert.Equal(t, tags, WithoutRouteTags(tags))
+	assert.Equal(t, tags, WithoutRouteTags(
+		[]string{"veneursinkonly:kafka", "foo:bar", "veneursinkonly:datadog", "baz"}))
+	assert.Empty(t, WithoutRouteTags([]string{"veneursinkonly:kafka"}))
+}
+
 func TestCounterEmpty(t *testing.T) {
 	c := NewCounter("a.b.c", []string{"a:b"})
 	c.Sample(1, 1.0)
@@ -184,6 +195,71 @@ func TestGaugeMergeMetric(t *testing.T) {
 	assert.Equal(t, float64(5), metrics[0].Value)
 }
 
+func TestGaugeAggregations(t *testing.T) {
+	samples := []float64{3, 1, 5, 2}
+	tests := []struct {
+		agg    GaugeAggregation
+		local  float64
+		global float64
+	}{
+		{GaugeLast, 2, 2},
+		{GaugeMin, 1, 1},
+		{GaugeMax, 5, 5},
+		{GaugeSum, 11, 15},
+		{GaugeMean, 2.75, 3.375},
+	}
+	for _, test := range tests {
+		t.Run(test.agg.String(), func(t *testing.T) {
+			parsed, err := ParseGaugeAggregation(test.agg.String())
+			require.NoError(t, err)
+			assert.Equal(t, test.agg, parsed)
+
+			g := NewAggregatedGauge("a.b.c", []string{"tag:val"}, test.agg)
+			for _, sample := range samples {
+				g.Sample(sample, 1.0)
+			}
+			assert.Equal(t, test.local, g.Flush()[0].Value)
+
+			// the global gauge merges another local veneur's value:
+			m, err := g.Metric()
+			require.NoError(t, err)
+			gGlobal := NewAggregatedGauge("a.b.c", []string{"tag:val"}, test.agg)
+			gGlobal.Merge(&metricpb.GaugeValue{Value: 4})
+			gGlobal.Merge(m.GetGauge())
+			assert.Equal(t, test.global, gGlobal.Flush()[0].Value)
+		})
+	}
+
+	_, err := ParseGaugeAggregation("median")
+	assert.Error(t, err)
+}
+
+func TestPercentileName(t *testing.T) {
+	assert.Equal(t, "50", PercentileName(0.5))
+	assert.Equal(t, "99", PercentileName(0.99))
+	assert.Equal(t, "99_9", PercentileName(0.999))
+	assert.Equal(t, "99_99", PercentileName(0.9999))
+	assert.Equal(t, "0", PercentileName(0))
+	assert.Equal(t, "100", PercentileName(1))
+}
+
+func TestGaugeAggregationTag(t *testing.T) {
+	g := NewAggregatedGauge("a.b.c", []string{"a:b", "veneur_gauge_agg:max"}, GaugeMin)
+	assert.Equal(t, GaugeMax, g.Aggregation, "the tag should take precedence")
+	g.Sample(5, 1.0)
+	g.Sample(1, 1.0)
+
+	jm, err := g.Export()
+	require.NoError(t, err)
+	assert.Contains(t, jm.Tags, "veneur_gauge_agg:max", "the tag should be forwarded")
+
+	metrics := g.Flush()
+	assert.Equal(t, float64(5), metrics[0].Value)
+	assert.Equal(t, []string{"a:b"}, metrics[0].Tags, "the tag should not be flushed")
+
+	assert.Equal(t, GaugeLast, NewGauge("a.b.c", []string{"veneur_gauge_agg:median"}).Aggregation)
+}
+
 func TestSet(t *testing.T) {
 	s := NewSet("a.b.c", []string{"a:b"})
 
@@ -232,6 +308,87 @@ func TestSetMerge(t *testing.T) {
 	assert.True(t, -1 <= countDifference && countDifference <= 1, "counts did not match after merging (%d and %d)", count1, count2)
 }
 
+// setPrecision returns the precision of the set's sketch, which is the
+// second byte of its encoding.
+func setPrecision(t *testing.T, s *Set) uint8 {
+	encoded, err := s.Hll.MarshalBinary()
+	require.NoError(t, err)
+	return encoded[1]
+}
+
+// TestSetMergeAccuracy checks that sets forwarded by several local
+// veneurs, over both JSON and gRPC, merge into the same sketch as if one
+// veneur had seen every value, and that its estimate is within the
+// sketch's error bounds.
+func TestSetMergeAccuracy(t *testing.T) {
+	for _, precision := range []uint8{SetPrecision14, SetPrecision16} {
+		for _, cardinality := range []int{1e3, 1e4, 1e5, 1e6, 1e7} {
+			t.Run(fmt.Sprintf("p%d/%d", precision, cardinality), func(t *testing.T) {
+				if cardinality > 1e6 && testing.Short() {
+					t.Skip("skipping the largest cardinality in short mode")
+				}
+				// three local sets see overlapping halves of the
+				// values, and one sees all of them:
+				all := NewSetWithPrecision("a.b.c", nil, precision)
+				locals := make([]*Set, 3)
+				for i := range locals {
+					locals[i] = NewSetWithPrecision("a.b.c", nil, precision)
+				}
+				var buf []byte
+				for i := 0; i < cardinality; i++ {
+					buf = strconv.AppendInt(append(buf[:0], "user-"...), int64(i), 10)
+					all.Hll.Insert(buf)
+					for j, local := range locals {
+						if start := j * cardinality / 4; i >= start && i < start+cardinality/2 {
+							local.Hll.Insert(buf)
+						}
+					}
+				}
+
+				global := NewSet("a.b.c", nil)
+				jm, err := locals[0].Export()
+				require.NoError(t, err)
+				require.NoError(t, global.Combine(jm.Value))
+				for _, local := range locals[1:] {
+					m, err := local.Metric()
+					require.NoError(t, err)
+					require.NoError(t, global.Merge(m.GetSet()))
+				}
+
+				assert.Equal(t, precision, setPrecision(t, global),
+					"the global set should have the forwarded precision")
+				// the dense sketch's registers are stored relative to a
+				// base, which merging can shift, so the merged estimate
+				// can be slightly off from the one sketch's, but only by
+				// a fraction of the sketch's error
+				stdError := 1.04 / math.Sqrt(float64(uint64(1)<<precision))
+				estimate := global.Hll.Estimate()
+				assert.InEpsilon(t, all.Hll.Estimate(), estimate, stdError/100,
+					"the merged set should estimate the same as one set with every value")
+				assert.InEpsilon(t, cardinality, estimate, 4*stdError)
+			})
+		}
+	}
+}
+
+func TestSetPrecision(t *testing.T) {
+	assert.NoError(t, ValidateSetPrecision(14))
+	assert.NoError(t, ValidateSetPrecision(16))
+	assert.Error(t, ValidateSetPrecision(12))
+
+	assert.Equal(t, DefaultSetPrecision, setPrecision(t, NewSet("a.b.c", nil)))
+	s16 := NewSetWithPrecision("a.b.c", nil, SetPrecision16)
+	assert.Equal(t, SetPrecision16, setPrecision(t, s16))
+
+	// a set that has values can't merge a set with another precision:
+	s14 := NewSet("a.b.c", nil)
+	s14.Sample("a", 1.0)
+	s16.Sample("b", 1.0)
+	jm, err := s16.Export()
+	require.NoError(t, err)
+	assert.Error(t, s14.Combine(jm.Value))
+}
+
 // Test the Metric and Merge function on Set
 func TestSetMergeMetric(t *testing.T) {
 	rand.Seed(time.Now().Unix())
@@ -417,6 +574,67 @@ func TestHistoHMeanOnly(t *testing.T) {
 	assert.Equal(t, expected, m5.Value, "Value")
 }
 
+func TestHistoSumSquaresOnly(t *testing.T) {
+	h := NewHist("a.b.c", []string{"a:b"})
+	h.Sample(2, 1.0)
+	h.Sample(3, 0.5)
+
+	aggregates, err := ParseHistogramAggregates([]string{"sumsq"})
+	require.NoError(t, err)
+	metrics := h.Flush(10*time.Second, nil, aggregates)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "a.b.c.sumsq", metrics[0].Name)
+	assert.Equal(t, float64(2*2+3*3*2), metrics[0].Value)
+}
+
+func TestParseAggregates(t *testing.T) {
+	aggregates, err := ParseHistogramAggregates([]string{"min", "max", "min"})
+	require.NoError(t, err)
+	assert.Equal(t, HistogramAggregates{Value: AggregateMin | AggregateMax, Count: 2}, aggregates)
+
+	_, err = ParseHistogramAggregates([]string{"min", "p95"})
+	assert.Error(t, err, "percentiles aren't aggregates")
+	_, err = ParseHistogramAggregates([]string{"mode"})
+	assert.Error(t, err)
+
+	override, err := ParseAggregateOverride([]string{"sum", "sumsq", "p95", "p50"})
+	require.NoError(t, err)
+	assert.Equal(t, &AggregateOverride{
+		Aggregates:  HistogramAggregates{Value: AggregateSum | AggregateSumSquares, Count: 2},
+		Percentiles: []float64{0.95, 0.5},
+	}, override)
+
+	_, err = ParseAggregateOverride([]string{"p101"})
+	assert.Error(t, err)
+	_, err = ParseAggregateOverride([]string{"pmax"})
+	assert.Error(t, err)
+}
+
+func TestHistoAggregatesTag(t *testing.T) {
+	h := NewHist("a.b.c", []string{"a:b", "veneur_aggregates:max/p90", "veneur_aggregates:sum"})
+	require.NotNil(t, h.Override)
+	for _, v := range []float64{1, 2, 3} {
+		h.Sample(v, 1.0)
+	}
+	configured := HistogramAggregates{Value: AggregateMin | AggregateCount, Count: 2}
+
+	// percentiles are only flushed where the configured ones would be:
+	names := map[string]float64{}
+	for _, m := range h.Flush(10*time.Second, []float64{0.5}, configured) {
+		names[m.Name] = m.Value
+		assert.Equal(t, []string{"a:b"}, m.Tags, "the tags should not be flushed")
+	}
+	assert.Len(t, names, 3)
+	assert.Equal(t, float64(3), names["a.b.c.max"])
+	assert.Equal(t, float64(6), names["a.b.c.sum"])
+	assert.Contains(t, names, "a.b.c.90percentile")
+	assert.Len(t, h.Flush(10*time.Second, nil, configured), 2)
+
+	assert.Nil(t, NewHist("a.b.c", []string{"veneur_aggregates:mode"}).Override,
+		"an invalid tag should be ignored")
+	assert.Nil(t, NewHist("a.b.c", []string{"a:b"}).Override)
+}
+
 func TestHistoSampleRate(t *testing.T) {
 	h := NewHist("a.b.c", []string{"a:b"})
 
@@ -511,6 +729,50 @@ func TestMetricKeyEquality(t *testing.T) {
 	assert.NotEqual(t, ce1.MetricKey.String(), ce3.MetricKey.String())
 }
 
+func TestJSONMetricMetric(t *testing.T) {
+	c := NewCounter("a.b.c", []string{"a:b"})
+	c.Sample(5, 1.0)
+	jm, err := c.Export()
+	assert.NoError(t, err)
+	m, err := jm.Metric()
+	assert.NoError(t, err, "should have converted a counter")
+	assert.Equal(t, metricpb.Type_Counter, m.Type)
+	assert.Equal(t, "a.b.c", m.Name)
+	assert.Equal(t, []string{"a:b"}, m.Tags)
+	assert.Equal(t, int64(5), m.GetCounter().Value)
+
+	s := NewSet("a.b.c", []string{"a:b"})
+	for i := 0; i < 10; i++ {
+		s.Sample(strconv.Itoa(i), 1.0)
+	}
+	jm, err = s.Export()
+	assert.NoError(t, err)
+	m, err = jm.Metric()
+	assert.NoError(t, err, "should have converted a set")
+	assert.Equal(t, metricpb.Type_Set, m.Type)
+	s2 := NewSet("a.b.c", []string{"a:b"})
+	assert.NoError(t, s2.Merge(m.GetSet()))
+	assert.Equal(t, s.Hll.Estimate(), s2.Hll.Estimate())
+
+	h := NewHist("a.b.c", []string{"a:b"})
+	for i := 0; i < 100; i++ {
+		h.Sample(float64(i), 1.0)
+	}
+	jm, err = h.Export()
+	assert.NoError(t, err)
+	jm.Type = "timer"
+	m, err = jm.Metric()
+	assert.NoError(t, err, "should have converted a timer")
+	assert.Equal(t, metricpb.Type_Timer, m.Type)
+	h2 := NewHist("a.b.c", []string{"a:b"})
+	h2.Merge(m.GetHistogram())
+	assert.InEpsilon(t, h.Value.Quantile(0.5), h2.Value.Quantile(0.5), 0.02)
+
+	jm.Type = "status"
+	_, err = jm.Metric()
+	assert.Error(t, err, "status checks aren't forwarded")
+}
+
 func TestParseMetricSSF(t *testing.T) {
 	sample := ssf.SSFSample{
 		Metric: ssf.SSFSample_GAUGE,
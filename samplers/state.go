@@ -0,0 +1,45 @@
+package samplers
+
+// SamplerState describes what a sampler has aggregated so far in an
+// interval, for debugging.
+type SamplerState struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+	// Samples is how many samples the sampler has taken, counting each
+	// value merged from another veneur as one
+	Samples int64 `json:"samples"`
+	// Value is a counter's total, a gauge's value, or an estimate of a
+	// set's cardinality. Histograms don't have one.
+	Value       float64            `json:"value,omitempty"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// State returns the counter's state.
+func (c *Counter) State() SamplerState {
+	return SamplerState{Name: c.Name, Tags: c.Tags, Samples: c.samples, Value: float64(c.value)}
+}
+
+// State returns the gauge's state.
+func (g *Gauge) State() SamplerState {
+	return SamplerState{Name: g.Name, Tags: g.Tags, Samples: g.count, Value: g.value}
+}
+
+// State returns the set's state.
+func (s *Set) State() SamplerState {
+	return SamplerState{Name: s.Name, Tags: s.Tags, Samples: s.samples, Value: float64(s.Hll.Estimate())}
+}
+
+// State returns the histogram's state, with approximations of the
+// percentiles, keyed like the suffixes of their flushed names, e.g.
+// "99percentile".
+func (h *Histo) State(percentiles []float64) SamplerState {
+	state := SamplerState{Name: h.Name, Tags: h.Tags, Samples: int64(h.Value.Count())}
+	if state.Samples == 0 {
+		return state
+	}
+	state.Percentiles = make(map[string]float64, len(percentiles))
+	for _, p := range percentiles {
+		state.Percentiles[PercentileName(p)+"percentile"] = h.Value.Quantile(p)
+	}
+	return state
+}
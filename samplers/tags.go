@@ -0,0 +1,185 @@
+package samplers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/segmentio/fasthash/fnv1a"
+)
+
+// TagNormalizer rewrites the tags of incoming metrics, so that the same
+// logical tag sent in different ways ends up in the same series. It's
+// safe for use by concurrent goroutines.
+type TagNormalizer struct {
+	lowercaseKeys bool
+	renames       map[string]string
+	sanitize      bool
+	dedupeKeys    bool
+}
+
+// NewTagNormalizer makes a TagNormalizer that, in order:
+//
+//   - lowercases tag keys, if lowercaseKeys is set;
+//   - renames the tag keys in renames (after lowercasing them, so the
+//     keys of renames should be lowercase when lowercaseKeys is set);
+//   - replaces every character in a tag other than ASCII letters,
+//     digits, and "_-./:" with an underscore, if sanitize is set;
+//   - keeps only one tag with each key, if dedupeKeys is set. The one
+//     that's kept is the one that sorts first, e.g. "env:dev" over
+//     "env:prod".
+//
+// It returns nil if there's nothing to do.
+func NewTagNormalizer(lowercaseKeys bool, renames map[string]string, sanitize, dedupeKeys bool) *TagNormalizer {
+	if !lowercaseKeys && len(renames) == 0 && !sanitize && !dedupeKeys {
+		return nil
+	}
+	n := &TagNormalizer{
+		lowercaseKeys: lowercaseKeys,
+		renames:       make(map[string]string, len(renames)),
+		sanitize:      sanitize,
+		dedupeKeys:    dedupeKeys,
+	}
+	for from, to := range renames {
+		n.renames[from] = to
+	}
+	return n
+}
+
+// Normalize rewrites the metric's tags, and updates its joined tags and
+// digest to match. The tags are only copied if they change, so metrics
+// whose tags are already normal don't allocate.
+func (n *TagNormalizer) Normalize(m *UDPMetric) {
+	if n == nil || len(m.Tags) == 0 {
+		return
+	}
+	var tags []string
+	for i, tag := range m.Tags {
+		normal := n.normalizeTag(tag)
+		if tags == nil {
+			if normal == tag {
+				continue
+			}
+			// the first change: copy the tags, since they may be
+			// shared with other metrics parsed from the same packet
+			tags = make([]string, len(m.Tags))
+			copy(tags, m.Tags)
+		}
+		tags[i] = normal
+	}
+	if tags != nil {
+		sort.Strings(tags)
+	} else {
+		tags = m.Tags
+	}
+	if n.dedupeKeys {
+		tags = dedupeTagKeys(tags, m.Tags)
+	}
+	if &tags[0] == &m.Tags[0] && len(tags) == len(m.Tags) {
+		return
+	}
+
+	m.Tags = tags
+	m.JoinedTags = strings.Join(tags, ",")
+	h := fnv1a.Init32
+	h = fnv1a.AddString32(h, m.Name)
+	h = fnv1a.AddString32(h, m.Type)
+	h = fnv1a.AddString32(h, m.JoinedTags)
+	m.Digest = h
+}
+
+func (n *TagNormalizer) normalizeTag(tag string) string {
+	key, rest := tag, ""
+	if colon := strings.IndexByte(tag, ':'); colon != -1 {
+		key, rest = tag[:colon], tag[colon:]
+	}
+	newKey := key
+	if n.lowercaseKeys && hasUpper(key) {
+		newKey = strings.ToLower(key)
+	}
+	if renamed, ok := n.renames[newKey]; ok {
+		newKey = renamed
+	}
+	if newKey != key {
+		tag = newKey + rest
+	}
+	if n.sanitize {
+		tag = sanitizeTag(tag)
+	}
+	return tag
+}
+
+func hasUpper(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+func validTagByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	switch c {
+	case '_', '-', '.', '/', ':':
+		return true
+	}
+	return false
+}
+
+// sanitizeTag replaces the bytes in tag that aren't valid with
+// underscores. Multi-byte characters are replaced with one underscore.
+func sanitizeTag(tag string) string {
+	i := 0
+	for i < len(tag) && validTagByte(tag[i]) {
+		i++
+	}
+	if i == len(tag) {
+		return tag
+	}
+	var b strings.Builder
+	b.Grow(len(tag))
+	b.WriteString(tag[:i])
+	for _, r := range tag[i:] {
+		if r < 0x80 && validTagByte(byte(r)) {
+			b.WriteByte(byte(r))
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// dedupeTagKeys removes the tags with the same key as the tag before
+// them from the sorted tags. Since tags that start with the same "key:"
+// sort together, the first one of each is kept. If tags is the same slice as orig, it's copied
+// before being changed.
+func dedupeTagKeys(tags, orig []string) []string {
+	out := tags
+	copied := len(tags) == 0 || &tags[0] != &orig[0]
+	n := 0
+	for i, tag := range tags {
+		if i > 0 && tagKey(tag) == tagKey(out[n-1]) {
+			if !copied {
+				out = make([]string, n, len(tags))
+				copy(out, tags[:n])
+				copied = true
+			}
+			continue
+		}
+		if copied {
+			out = append(out[:n], tag)
+		}
+		n++
+	}
+	return out[:n]
+}
+
+func tagKey(tag string) string {
+	if colon := strings.IndexByte(tag, ':'); colon != -1 {
+		return tag[:colon]
+	}
+	return tag
+}
@@ -0,0 +1,71 @@
+package samplers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagNormalizer(t *testing.T) {
+	n := NewTagNormalizer(true, map[string]string{"environment": "env"}, true, true)
+	tests := []struct {
+		name string
+		in   string
+		tags []string
+	}{
+		{"unchanged", "a:1|c|#env:prod,foo:bar", []string{"env:prod", "foo:bar"}},
+		{"lowercased", "a:1|c|#Env:Prod,foo:bar", []string{"env:Prod", "foo:bar"}},
+		{"renamed", "a:1|c|#environment:prod,foo:bar", []string{"env:prod", "foo:bar"}},
+		{"renamed after lowercasing", "a:1|c|#ENVIRONMENT:prod", []string{"env:prod"}},
+		{"sanitized", "a:1|c|#foo:b a$r,ba z", []string{"ba_z", "foo:b_a_r"}},
+		{"multi-byte sanitized", "a:1|c|#foo:bär", []string{"foo:b_r"}},
+		{"deduped", "a:1|c|#env:prod,Environment:dev,env:prod,foo:bar", []string{"env:dev", "foo:bar"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics, err := ParseMetrics([]byte(test.in), "")
+			require.NoError(t, err)
+			m := metrics[0]
+			n.Normalize(&m)
+			assert.Equal(t, test.tags, m.Tags)
+
+			// it should be the same metric as one sent with the
+			// normal tags to begin with:
+			normal, err := ParseMetrics([]byte("a:1|c|#"+strings.Join(test.tags, ",")), "")
+			require.NoError(t, err)
+			assert.Equal(t, normal[0].JoinedTags, m.JoinedTags)
+			assert.Equal(t, normal[0].Digest, m.Digest)
+		})
+	}
+
+	assert.Nil(t, NewTagNormalizer(false, nil, false, false), "a normalizer that does nothing shouldn't be made")
+}
+
+func TestTagNormalizerSharedTags(t *testing.T) {
+	n := NewTagNormalizer(true, nil, false, true)
+	metrics, err := ParseMetrics([]byte("a:1:2|c|#Foo:bar,foo:baz"), "")
+	require.NoError(t, err)
+	n.Normalize(&metrics[0])
+	assert.Equal(t, []string{"foo:bar"}, metrics[0].Tags)
+	assert.Equal(t, []string{"Foo:bar", "foo:baz"}, metrics[1].Tags, "the other value's tags shouldn't change")
+}
+
+func BenchmarkTagNormalizer(b *testing.B) {
+	n := NewTagNormalizer(true, map[string]string{"environment": "env"}, true, true)
+	for _, packet := range []string{
+		"a.b.c:1|ms|#env:prod,foo:bar,host:i-1234",
+		"a.b.c:1|ms|#Environment:prod,foo:b@r,host:i-1234",
+	} {
+		metrics, err := ParseMetrics([]byte(packet), "")
+		require.NoError(b, err)
+		b.Run(packet, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := metrics[0]
+				n.Normalize(&m)
+			}
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"crypto/x509/pkix"
 	"errors"
 	"fmt"
@@ -34,20 +33,35 @@ import (
 
 	"github.com/pkg/profile"
 
+	"github.com/stripe/veneur/forwardrpc"
 	vhttp "github.com/stripe/veneur/http"
 	"github.com/stripe/veneur/importsrv"
+	"github.com/stripe/veneur/internal/build"
 	"github.com/stripe/veneur/plugins"
+	gcsp "github.com/stripe/veneur/plugins/gcs"
 	localfilep "github.com/stripe/veneur/plugins/localfile"
 	s3p "github.com/stripe/veneur/plugins/s3"
 	"github.com/stripe/veneur/protocol"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/sinks/blackhole"
+	"github.com/stripe/veneur/sinks/cloudwatch"
 	"github.com/stripe/veneur/sinks/datadog"
 	"github.com/stripe/veneur/sinks/debug"
+	"github.com/stripe/veneur/sinks/elasticsearch"
 	"github.com/stripe/veneur/sinks/falconer"
+	"github.com/stripe/veneur/sinks/graphite"
+	"github.com/stripe/veneur/sinks/honeycomb"
+	"github.com/stripe/veneur/sinks/influxdb"
 	"github.com/stripe/veneur/sinks/kafka"
 	"github.com/stripe/veneur/sinks/lightstep"
+	"github.com/stripe/veneur/sinks/newrelic"
+	"github.com/stripe/veneur/sinks/otlpmetric"
+	"github.com/stripe/veneur/sinks/otlptrace"
+	promsink "github.com/stripe/veneur/sinks/prometheus"
+	"github.com/stripe/veneur/sinks/prometheusrw"
 	"github.com/stripe/veneur/sinks/signalfx"
+	"github.com/stripe/veneur/sinks/spanfile"
 	"github.com/stripe/veneur/sinks/splunk"
 	"github.com/stripe/veneur/sinks/ssfmetrics"
 	"github.com/stripe/veneur/ssf"
@@ -57,15 +71,45 @@ import (
 
 // VERSION stores the current veneur version.
 // It must be a var so it can be set at link time.
+//
+// Deprecated: set build.Commit at link time instead.
 var VERSION = defaultLinkValue
 
+// Deprecated: set build.Date at link time instead.
 var BUILD_DATE = defaultLinkValue
 
 const defaultLinkValue = "dirty"
 
+// VERSION and BUILD_DATE predate the build package; binaries that are
+// still linked with them set the build package's variables, and the
+// others set them from it.
+func init() {
+	if VERSION != defaultLinkValue {
+		build.Commit = VERSION
+	}
+	VERSION = build.Commit
+	if BUILD_DATE != defaultLinkValue {
+		build.Date = BUILD_DATE
+	}
+	BUILD_DATE = build.Date
+}
+
 // REDACTED is used to replace values that we don't want to leak into loglines (e.g., credentials)
 const REDACTED = "REDACTED"
 
+// redactValues returns a copy of a map of settings, like headers, with
+// their values replaced by REDACTED.
+func redactValues(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return m
+	}
+	redacted := make(map[string]string, len(m))
+	for k := range m {
+		redacted[k] = REDACTED
+	}
+	return redacted
+}
+
 var profileStartOnce = sync.Once{}
 
 var log = logrus.StandardLogger()
@@ -74,6 +118,14 @@ var tracer = trace.GlobalTracer
 
 const defaultTCPReadTimeout = 10 * time.Minute
 
+// defaultSSFMaxBatchSpans is how many spans an SSF batch may have, unless
+// ssf_max_batch_spans says otherwise.
+const defaultSSFMaxBatchSpans = 1000
+
+// defaultSSFMaxSpanEvents is how many events veneur keeps on a span,
+// unless ssf_max_span_events says otherwise.
+const defaultSSFMaxSpanEvents = 128
+
 // A Server is the actual veneur instance that will be run.
 type Server struct {
 	Workers              []*Worker
@@ -93,6 +145,7 @@ type Server struct {
 
 	HTTPAddr         string
 	numListeningHTTP *int32 // An atomic boolean for whether or not the HTTP server is running
+	httpTLS          *vhttp.TLSFiles
 
 	ForwardAddr    string
 	forwardUseGRPC bool
@@ -103,12 +156,115 @@ type Server struct {
 
 	interval            time.Duration
 	synchronizeInterval bool
+	// clock drives the flush loop, and afterFlush (if set) is
+	// called after each of its flushes, with the parts of the flush
+	// that are left running in the background.
+	clock      clock
+	afterFlush func(*sync.WaitGroup)
+
+	// imports are the metrics imported over HTTP that haven't been
+	// handed to the workers yet.
+	imports sync.WaitGroup
+
 	numReaders          int
+	readBatchSize       int
 	metricMaxLength     int
+	containerIDTag      string
+	tagNormalizer       atomic.Value // *samplers.TagNormalizer
+	metricNameFilter    nameFilterValue
+	spanNameFilter      nameFilterValue
+	spanScrubber        spanScrubberValue
+	metricRewriter      metricRewriterValue
+	gaugeRates          *gaugeRates
+	spanSinkQueueSizes  map[string]int
+	spanSinkDispatchers map[string]int
+	sourceAccounting    *sourceAccounting
+	topMetrics          *topMetrics
 	traceMaxLengthBytes int
 
-	tlsConfig      *tls.Config
-	tcpReadTimeout time.Duration
+	// flushTraceEnabled traces the stages of flushTraceSampleRate of
+	// the flushes; see traceFlushStages.
+	flushTraceEnabled    bool
+	flushTraceSampleRate float64
+
+	// statsdRateLimit and ssfRateLimit limit the packets that each
+	// listener reads; rateLimits are the limited listeners
+	statsdRateLimit rateLimit
+	ssfRateLimit    rateLimit
+	rateLimitsMtx   sync.Mutex
+	rateLimits      []*listenerRateLimit
+
+	// ssfTLSConfig encrypts the connections to tls+tcp:// SSF listeners,
+	// which are closed once they've been idle for ssfReadTimeout;
+	// ssfTLSConns counts the open ones. ssfMaxFrameLength bounds the
+	// frames read from any SSF stream, ssfMaxBatchSpans the spans in
+	// any SSF batch, and ssfMaxSpanLinks and ssfMaxSpanEvents the links
+	// and events kept on any span. ssfListenerMaxLengths override
+	// traceMaxLengthBytes and ssfMaxFrameLength for some listeners, by
+	// their addresses in SSFListenAddrs, and ssfTruncateOversized
+	// truncates the spans over a stream's maximum length, rather than
+	// closing the stream.
+	ssfTLSConfig          *tls.Config
+	ssfReadTimeout        time.Duration
+	ssfTLSConns           int64
+	ssfMaxFrameLength     uint32
+	ssfMaxBatchSpans      int
+	ssfMaxSpanLinks       int
+	ssfMaxSpanEvents      int
+	ssfListenerMaxLengths map[net.Addr]int
+	ssfTruncateOversized  bool
+
+	// ssfParseFailureExamples logs examples of the SSF that fails to
+	// parse, with ssf_debug_parse_failures
+	ssfParseFailureExamples *ssfParseFailureExamples
+
+	// capture records the UDP datagrams read while /debug/capture runs
+	capture packetCapture
+
+	// ssfPeerCredentials tags the SSF read from unix sockets with the
+	// sending process, or with its service in ssfPeerServices
+	ssfPeerCredentials bool
+	ssfPeerServices    map[uint32]string
+
+	// numSockets is how many SO_REUSEPORT sockets each UDP listener
+	// reads from; udpSockets are those whose drops are reported
+	numSockets    int
+	udpSocketsMtx sync.Mutex
+	udpSockets    []udpSocket
+
+	// sinkFlushes bounds how long flushes wait for the metric sinks
+	sinkFlushes *sinkFlushes
+
+	// flushWatchdog, if set, handles flushes that are stuck
+	flushWatchdog *flushWatchdog
+	// aggregating is held by the part of a flush that takes the
+	// workers' metrics and derives the metrics to flush from them, so
+	// that a flush the watchdog abandoned and the next one never do
+	// that at the same time
+	aggregating sync.Mutex
+	// flushLoopDone is closed once the running flush loop exits
+	flushLoopMtx  sync.Mutex
+	flushLoopDone chan struct{}
+
+	// reloader applies the settings that can change without a restart
+	reloader configReloader
+
+	// shutdownTimeout bounds FlushAndShutdown; packetConns are the UDP
+	// listeners' sockets, which it closes
+	shutdownTimeout time.Duration
+	packetConnsMtx  sync.Mutex
+	packetConns     []net.PacketConn
+
+	// workerScaler routes metrics to the workers if their pool scales.
+	// Then Workers is replaced on each flush with the workers to flush.
+	workerScaler *workerScaler
+
+	tlsConfig        *tls.Config
+	tcpReadTimeout   time.Duration
+	tcpMaxLineLength int
+	// tcpConnSlots limits the number of open statsd TCP connections;
+	// it's nil if they aren't limited.
+	tcpConnSlots chan struct{}
 
 	// closed when the server is shutting down gracefully
 	shutdown chan struct{}
@@ -121,10 +277,25 @@ type Server struct {
 	enableProfiling bool
 
 	HistogramAggregates samplers.HistogramAggregates
+	// aggregateOverrides are flushed instead of HistogramAggregates and
+	// HistogramPercentiles for the histograms and timers with these
+	// names, unless they set their own with tags
+	aggregateOverrides map[string]*samplers.AggregateOverride
+	// percentilesOverrides are flushed instead of HistogramPercentiles
+	// for the histograms and timers whose names start with their
+	// prefix, longest prefix first
+	percentilesOverrides []percentilesOverride
+	// histogramWindows, if non-nil, computes the percentiles of
+	// histograms and timers over their last few intervals
+	histogramWindows *histogramWindows
 
 	spanSinks   []sinks.SpanSink
 	metricSinks []sinks.MetricSink
 
+	// promExposition, if non-nil, serves the most recent flush's
+	// metrics for scraping by Prometheus.
+	promExposition *promsink.ExpositionSink
+
 	TraceClient *trace.Client
 
 	ssfInternalMetrics sync.Map
@@ -134,7 +305,25 @@ type Server struct {
 	grpcServer        *importsrv.Server
 
 	// gRPC forward clients
-	grpcForwardConn *grpc.ClientConn
+	grpcForwardMtx         sync.Mutex
+	grpcForwardConns       map[string]*grpcForwardConn
+	grpcForwardCompression *forwardCompression
+	grpcForwardTLS         *tls.Config
+	grpcForwardAuthToken   string
+	grpcMaxRecvMsgSize     int
+	grpcMaxSendMsgSize     int
+
+	// set if forwarding over a gRPC stream
+	forwardGRPCStream          bool
+	forwardGRPCStreamBatchSize int
+
+	// the upstream Veneurs that metrics are hashed to
+	forwardDestinations    *forwardDestinations
+	forwardRefreshInterval time.Duration
+
+	// HTTP forwarding, with its own client if it uses TLS
+	forwardHTTPClient *http.Client
+	forwardTLS        *vhttp.TLSFiles
 }
 
 // ssfServiceSpanMetrics refer to the span metrics that will
@@ -162,20 +351,59 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 	mappedTags := samplers.ParseTagSliceToMap(ret.Tags)
 
 	ret.synchronizeInterval = conf.SynchronizeWithInterval
+	ret.clock = realClock{}
 
 	ret.TagsAsMap = mappedTags
 	ret.HistogramPercentiles = conf.Percentiles
-	ret.HistogramAggregates.Value = 0
-	for _, agg := range conf.Aggregates {
-		ret.HistogramAggregates.Value += samplers.AggregatesLookup[agg]
+	if ret.HistogramPercentiles == nil {
+		// nil percentiles mean that they're left to the global
+		// veneur, even for histograms that override them
+		ret.HistogramPercentiles = []float64{}
 	}
-	ret.HistogramAggregates.Count = len(conf.Aggregates)
-
 	var err error
+	ret.HistogramAggregates, err = samplers.ParseHistogramAggregates(conf.Aggregates)
+	if err != nil {
+		return ret, fmt.Errorf("aggregates: %v", err)
+	}
+	for name, aggs := range conf.AggregateOverrides {
+		override, err := samplers.ParseAggregateOverride(aggs)
+		if err != nil {
+			return ret, fmt.Errorf("aggregate_overrides: %s: %v", name, err)
+		}
+		if ret.aggregateOverrides == nil {
+			ret.aggregateOverrides = map[string]*samplers.AggregateOverride{}
+		}
+		ret.aggregateOverrides[name] = override
+	}
+	ret.percentilesOverrides, err = newPercentilesOverrides(conf.PercentilesOverrides)
+	if err != nil {
+		return ret, fmt.Errorf("percentiles_overrides: %v", err)
+	}
+	ret.histogramWindows, err = newHistogramWindows(conf.HistogramWindowIntervals, conf.HistogramWindowIntervalsPrefixes)
+	if err != nil {
+		return ret, err
+	}
+
 	ret.interval, err = conf.ParseInterval()
 	if err != nil {
 		return ret, err
 	}
+	ret.sinkFlushes, err = newSinkFlushes(ret.interval, conf.MetricSinkFlushTimeout,
+		conf.MetricSinkFlushTimeouts, conf.MetricSinkMaxStragglers)
+	if err != nil {
+		return ret, err
+	}
+	ret.flushWatchdog, err = newFlushWatchdog(conf.FlushWatchdogMissedFlushes, conf.FlushWatchdogAction)
+	if err != nil {
+		return ret, err
+	}
+	ret.shutdownTimeout = defaultShutdownTimeout
+	if conf.ShutdownTimeout != "" {
+		ret.shutdownTimeout, err = time.ParseDuration(conf.ShutdownTimeout)
+		if err != nil {
+			return ret, fmt.Errorf("shutdown_timeout: %v", err)
+		}
+	}
 
 	transport := &http.Transport{
 		IdleConnTimeout: ret.interval * 2, // If we're idle more than one interval something is up
@@ -196,7 +424,7 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 	ret.Statsd = stats
 
 	ret.SpanChan = make(chan *ssf.SSFSpan, conf.SpanChannelCapacity)
-	ret.TraceClient, err = trace.NewChannelClient(ret.SpanChan,
+	ret.TraceClient, err = newInternalTraceClient(ret.SpanChan, conf.InternalMetricsSink, conf.SpanChannelCapacity,
 		trace.ReportStatistics(stats, 1*time.Second, []string{"ssf_format:internal"}),
 	)
 	if err != nil {
@@ -215,6 +443,8 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 	if conf.Debug {
 		logger.SetLevel(logrus.DebugLevel)
 	}
+	ret.reloader.logger = logger
+	ret.reloader.conf = conf
 
 	mpf := 0
 	if conf.MutexProfileFraction > 0 {
@@ -264,17 +494,92 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 	// Allocate the slice, we'll fill it with workers later.
 	ret.Workers = make([]*Worker, numWorkers)
 	ret.numReaders = conf.NumReaders
+	ret.numSockets = conf.NumUDPSockets
+	ret.readBatchSize = conf.ReadBatchSize
 
-	// Use the pre-allocated Workers slice to know how many to start.
-	for i := range ret.Workers {
-		ret.Workers[i] = NewWorker(i+1, ret.TraceClient, log, ret.Statsd)
-		// do not close over loop index
-		go func(w *Worker) {
+	metricNameFilter, err := newNameFilter("metric name", conf.MetricNameDenyPatterns, conf.MetricNameAllowPatterns)
+	if err != nil {
+		return ret, err
+	}
+	ret.metricNameFilter.store(metricNameFilter)
+	spanNameFilter, err := newNameFilter("span name", conf.SpanNameDenyPatterns, conf.SpanNameAllowPatterns)
+	if err != nil {
+		return ret, err
+	}
+	ret.spanNameFilter.store(spanNameFilter)
+	spanScrubber, err := newSpanScrubber(conf.SpanScrubRules)
+	if err != nil {
+		return ret, err
+	}
+	ret.spanScrubber.store(spanScrubber)
+	metricRewriter, err := newMetricRewriter(conf.MetricRewriteRules)
+	if err != nil {
+		return ret, err
+	}
+	ret.metricRewriter.store(metricRewriter)
+	ret.gaugeRates = newGaugeRates(conf.GaugeRateNames, conf.GaugeRatePrefixes,
+		conf.GaugeRateExpiryIntervals, conf.GaugeRateMaxContexts)
+	setPrecisions, err := newSetPrecisions(conf.SetPrecision, conf.SetPrecisionPrefixes)
+	if err != nil {
+		return ret, err
+	}
+	var gaugeAggregations map[string]samplers.GaugeAggregation
+	for name, aggName := range conf.GaugeAggregations {
+		agg, err := samplers.ParseGaugeAggregation(aggName)
+		if err != nil {
+			return ret, fmt.Errorf("gauge_aggregations: %s: %v", name, err)
+		}
+		if gaugeAggregations == nil {
+			gaugeAggregations = map[string]samplers.GaugeAggregation{}
+		}
+		gaugeAggregations[name] = agg
+	}
+
+	if conf.WorkerScalingMaxWorkers > 0 {
+		// these keep state for the metrics in each worker across
+		// intervals, which doesn't follow the metrics when they move
+		if len(conf.CumulativeCounters) > 0 {
+			return ret, errors.New("cumulative_counters can't be used with worker_scaling_max_workers")
+		}
+		if conf.CardinalityLimit > 0 {
+			return ret, errors.New("cardinality_limit can't be used with worker_scaling_max_workers")
+		}
+	}
+	newWorker := func(id int) (*Worker, error) {
+		w := NewWorker(id, ret.TraceClient, log, ret.Statsd)
+		w.nameFilter = &ret.metricNameFilter
+		w.gaugeAggregations = gaugeAggregations
+		w.setPrecisions = setPrecisions
+		w.cumulative = newCumulativeCounters(conf.CumulativeCounters, conf.CumulativeCounterExpiryIntervals)
+		w.heavyHittersCapacity = conf.TopMetricsCount * heavyHittersCapacityFactor
+		w.heavyHittersSampling = defaultHeavyHittersSampling
+		w.exemplars = conf.HistogramExemplars
+		var err error
+		w.cardinality, err = newCardinalityLimiter(conf.CardinalityLimit,
+			conf.CardinalityLimitPrefixes, conf.CardinalityLimitOverflow, numWorkers)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
 			defer func() {
 				ConsumePanic(ret.Sentry, ret.TraceClient, ret.Hostname, recover())
 			}()
 			w.Work()
-		}(ret.Workers[i])
+		}()
+		return w, nil
+	}
+
+	// Use the pre-allocated Workers slice to know how many to start.
+	for i := range ret.Workers {
+		ret.Workers[i], err = newWorker(i + 1)
+		if err != nil {
+			return ret, err
+		}
+	}
+	ret.workerScaler, err = newWorkerScaler(ret.Workers, conf.WorkerScalingMaxWorkers,
+		conf.WorkerScalingQueueDepth, conf.WorkerScalingIdleIntervals, newWorker)
+	if err != nil {
+		return ret, err
 	}
 
 	ret.EventWorker = NewEventWorker(ret.TraceClient, ret.Statsd)
@@ -285,7 +590,17 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 	for i, w := range ret.Workers {
 		processors[i] = w
 	}
-	metricSink, err := ssfmetrics.NewMetricExtractionSink(processors, conf.IndicatorSpanTimerName, ret.TraceClient, log)
+	if ret.workerScaler != nil {
+		processors = []ssfmetrics.Processor{ret.workerScaler}
+	}
+	metricSink, err := ssfmetrics.NewMetricExtractionSink(processors, conf.IndicatorSpanTimerName, ret.TraceClient, log,
+		ssfmetrics.WithREDMetrics(ssfmetrics.REDMetrics{
+			RequestsName:  conf.SpanRedMetricsRequestsName,
+			ErrorsName:    conf.SpanRedMetricsErrorsName,
+			DurationName:  conf.SpanRedMetricsDurationName,
+			IndicatorOnly: conf.SpanRedMetricsIndicatorOnly,
+			TagKeys:       conf.SpanRedMetricsTagKeys,
+		}))
 	if err != nil {
 		return ret, err
 	}
@@ -304,61 +619,120 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 			return ret, err
 		}
 		ret.SSFListenAddrs = append(ret.SSFListenAddrs, addr)
+		if max := conf.SsfListenerMaxLengthBytes[addrStr]; max > 0 {
+			if ret.ssfListenerMaxLengths == nil {
+				ret.ssfListenerMaxLengths = map[net.Addr]int{}
+			}
+			ret.ssfListenerMaxLengths[addr] = max
+		}
 	}
 
 	ret.metricMaxLength = conf.MetricMaxLength
+	ret.containerIDTag = conf.StatsdContainerIDTag
+	if conf.StatsdSourceAccounting {
+		ret.sourceAccounting = newSourceAccounting(conf.StatsdSourceAccountingMaxSources, conf.StatsdSourceAccountingMaxNames)
+	}
+	if conf.TopMetricsCount > 0 {
+		ret.topMetrics = newTopMetrics(conf.TopMetricsCount)
+	}
+	ret.statsdRateLimit, err = newRateLimit("statsd", conf.StatsdRateLimitPacketsPerSecond, conf.StatsdRateLimitBytesPerSecond)
+	if err != nil {
+		return ret, err
+	}
+	ret.ssfRateLimit, err = newRateLimit("ssf", conf.SsfRateLimitPacketsPerSecond, conf.SsfRateLimitBytesPerSecond)
+	if err != nil {
+		return ret, err
+	}
+	if conf.SsfUnixPeerCredentials && !peerCredentialsSupported() {
+		return ret, errors.New("ssf_unix_peer_credentials isn't supported on this platform")
+	}
+	ret.ssfPeerCredentials = conf.SsfUnixPeerCredentials
+	ret.ssfPeerServices = conf.SsfUnixPeerServices
+	ret.tagNormalizer.Store(samplers.NewTagNormalizer(conf.TagNormalizationLowercaseKeys,
+		conf.TagNormalizationRenames, conf.TagNormalizationSanitize, conf.TagNormalizationDedupeKeys))
 	ret.traceMaxLengthBytes = conf.TraceMaxLengthBytes
+	ret.flushTraceEnabled = conf.FlushTraceEnabled
+	ret.flushTraceSampleRate = conf.FlushTraceSampleRate
+	if ret.flushTraceSampleRate <= 0 {
+		ret.flushTraceSampleRate = 1
+	}
 	ret.RcvbufBytes = conf.ReadBufferSizeBytes
 	ret.HTTPAddr = conf.HTTPAddress
 	ret.numListeningHTTP = new(int32)
 	ret.ForwardAddr = conf.ForwardAddress
 
-	if conf.TLSKey != "" {
-		if conf.TLSCertificate == "" {
-			err = errors.New("tls_key is set; must set tls_certificate")
-			logger.WithError(err).Error("Improper TLS configuration")
-			return ret, err
+	ret.tlsConfig, err = newListenerTLSConfig("tls", conf.TLSKey, conf.TLSCertificate, conf.TLSAuthorityCertificate)
+	if err != nil {
+		logger.WithError(err).Error("Improper TLS configuration")
+		return ret, err
+	}
+	ret.ssfTLSConfig, err = newListenerTLSConfig("ssf_tls", conf.SsfTLSKey, conf.SsfTLSCertificate, conf.SsfTLSAuthorityCertificate)
+	if err != nil {
+		logger.WithError(err).Error("Improper SSF TLS configuration")
+		return ret, err
+	}
+	for _, addr := range ret.SSFListenAddrs {
+		if _, ok := addr.(*protocol.TLSTCPAddr); ok && ret.ssfTLSConfig == nil {
+			return ret, fmt.Errorf("ssf_listen_addresses has %s; must set ssf_tls_key and ssf_tls_certificate", addr)
 		}
-
-		// load the TLS key and certificate
-		var cert tls.Certificate
-		cert, err = tls.X509KeyPair([]byte(conf.TLSCertificate), []byte(conf.TLSKey))
+	}
+	ret.ssfReadTimeout = defaultTCPReadTimeout
+	if conf.SsfTCPReadTimeout != "" {
+		ret.ssfReadTimeout, err = time.ParseDuration(conf.SsfTCPReadTimeout)
 		if err != nil {
-			logger.WithError(err).Error("Improper TLS configuration")
 			return ret, err
 		}
+	}
+	ret.ssfMaxFrameLength = protocol.MaxSSFPacketLength
+	if conf.SsfMaxFrameLengthBytes > 0 && uint32(conf.SsfMaxFrameLengthBytes) < protocol.MaxSSFPacketLength {
+		ret.ssfMaxFrameLength = uint32(conf.SsfMaxFrameLengthBytes)
+	}
+	ret.ssfTruncateOversized = conf.SsfTruncateOversizedSpans
+	if conf.SsfDebugParseFailures {
+		ret.ssfParseFailureExamples = newSSFParseFailureExamples(ret.clock)
+	}
+	ret.ssfMaxBatchSpans = defaultSSFMaxBatchSpans
+	if conf.SsfMaxBatchSpans > 0 {
+		ret.ssfMaxBatchSpans = conf.SsfMaxBatchSpans
+	}
+	ret.ssfMaxSpanLinks = conf.SsfMaxSpanLinks
+	ret.ssfMaxSpanEvents = defaultSSFMaxSpanEvents
+	if conf.SsfMaxSpanEvents > 0 {
+		ret.ssfMaxSpanEvents = conf.SsfMaxSpanEvents
+	}
 
-		clientAuthMode := tls.NoClientCert
-		var clientCAs *x509.CertPool
-		if conf.TLSAuthorityCertificate != "" {
-			// load the authority; require clients to present certificated signed by this authority
-			clientAuthMode = tls.RequireAndVerifyClientCert
-			clientCAs = x509.NewCertPool()
-			ok := clientCAs.AppendCertsFromPEM([]byte(conf.TLSAuthorityCertificate))
-			if !ok {
-				err = errors.New("tls_authority_certificate: Could not load any certificates")
-				logger.WithError(err).Error("Improper TLS configuration")
-				return ret, err
-			}
-		}
-
-		ret.tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   clientAuthMode,
-			ClientCAs:    clientCAs,
+	if conf.StatsdTCPReadTimeout != "" {
+		ret.tcpReadTimeout, err = time.ParseDuration(conf.StatsdTCPReadTimeout)
+		if err != nil {
+			return ret, err
 		}
 	}
+	ret.tcpMaxLineLength = conf.StatsdTCPMaxLineLength
+	if conf.StatsdTCPMaxConnections > 0 {
+		ret.tcpConnSlots = make(chan struct{}, conf.StatsdTCPMaxConnections)
+	}
 
 	if conf.SignalfxAPIKey != "" {
 		tracedHTTP := *ret.HTTPClient
 		tracedHTTP.Transport = vhttp.NewTraceRoundTripper(tracedHTTP.Transport, ret.TraceClient, "signalfx")
 
+		// By default, each API key's submission must complete
+		// within 90% of the flush interval, so that a slow key
+		// can't hold up the next flush.
+		sfxFlushTimeout := ret.interval * 9 / 10
+		if conf.SignalfxFlushTimeout != "" {
+			sfxFlushTimeout, err = time.ParseDuration(conf.SignalfxFlushTimeout)
+			if err != nil {
+				return ret, err
+			}
+		}
+
 		fallback := signalfx.NewClient(conf.SignalfxEndpointBase, conf.SignalfxAPIKey, &tracedHTTP)
 		byTagClients := map[string]signalfx.DPClient{}
 		for _, perTag := range conf.SignalfxPerTagAPIKeys {
 			byTagClients[perTag.Name] = signalfx.NewClient(conf.SignalfxEndpointBase, perTag.APIKey, &tracedHTTP)
 		}
-		sfxSink, err := signalfx.NewSignalFxSink(conf.SignalfxHostnameTag, conf.Hostname, ret.TagsAsMap, log, fallback, conf.SignalfxVaryKeyBy, byTagClients, metricSink)
+		sfxSink, err := signalfx.NewSignalFxSink(conf.SignalfxHostnameTag, conf.Hostname, ret.TagsAsMap, log, fallback, conf.SignalfxVaryKeyBy, byTagClients, metricSink, sfxFlushTimeout)
 		if err != nil {
 			return ret, err
 		}
@@ -395,13 +769,24 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		}
 
 		// configure Lightstep as a Span Sink
-		if conf.LightstepAccessToken != "" {
+		if conf.LightstepAccessToken != "" || conf.LightstepAccessTokenFile != "" {
+			lsOpts := []lightstep.Option{lightstep.WithCollectors(conf.LightstepCollectorHosts)}
+			if conf.LightstepAccessTokenFile != "" {
+				lsOpts = append(lsOpts, lightstep.WithAccessTokenFile(conf.LightstepAccessTokenFile))
+			}
+			if conf.LightstepRefreshPeriod != "" {
+				refresh, err := time.ParseDuration(conf.LightstepRefreshPeriod)
+				if err != nil {
+					return ret, fmt.Errorf("lightstep_refresh_period: %v", err)
+				}
+				lsOpts = append(lsOpts, lightstep.WithRefreshPeriod(refresh))
+			}
 
 			var lsSink sinks.SpanSink
 			lsSink, err = lightstep.NewLightStepSpanSink(
 				conf.LightstepCollectorHost, conf.LightstepReconnectPeriod,
 				conf.LightstepMaximumSpans, conf.LightstepNumClients,
-				conf.LightstepAccessToken, log,
+				conf.LightstepAccessToken, log, lsOpts...,
 			)
 			if err != nil {
 				return ret, err
@@ -437,6 +822,101 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 			ret.spanSinks = append(ret.spanSinks, sss)
 		}
 
+		if (conf.HoneycombAPIKey != "") != (conf.HoneycombDataset != "") {
+			return ret, fmt.Errorf("both honeycomb_api_key and honeycomb_dataset need to be set")
+		}
+		if conf.HoneycombAPIKey != "" {
+			hcSink, err := honeycomb.NewHoneycombSpanSink(
+				conf.HoneycombAPIHost, conf.HoneycombAPIKey, conf.HoneycombDataset,
+				conf.HoneycombBatchSize, conf.HoneycombSpanBufferSize,
+				conf.HoneycombSpanSampleRate, ret.HTTPClient, log,
+			)
+			if err != nil {
+				return ret, err
+			}
+			ret.spanSinks = append(ret.spanSinks, hcSink)
+			logger.Info("Configured Honeycomb trace sink")
+		}
+
+		if conf.ElasticsearchAddress != "" {
+			esSink, err := elasticsearch.NewSpanSink(
+				conf.ElasticsearchAddress, conf.Hostname, log,
+				elasticsearch.WithIndex(conf.ElasticsearchIndex),
+				elasticsearch.WithAPIKey(conf.ElasticsearchAPIKey),
+				elasticsearch.WithBasicAuth(conf.ElasticsearchUsername, conf.ElasticsearchPassword),
+				elasticsearch.WithTLS(
+					conf.ElasticsearchTLSAuthorityCertificate,
+					conf.ElasticsearchTLSCertificate,
+					conf.ElasticsearchTLSKey,
+				),
+				elasticsearch.WithBatchSize(conf.ElasticsearchBatchSize),
+				elasticsearch.WithBatchBytes(conf.ElasticsearchBatchBytes),
+				elasticsearch.WithBufferSize(conf.ElasticsearchSpanBufferSize),
+				elasticsearch.WithSampleRate(conf.ElasticsearchSpanSampleRate),
+			)
+			if err != nil {
+				logger.WithError(err).Error("Improper Elasticsearch sink configuration")
+				return ret, err
+			}
+			ret.spanSinks = append(ret.spanSinks, esSink)
+			logger.WithField("address", conf.ElasticsearchAddress).Info("Configured Elasticsearch span sink")
+		}
+
+		if conf.SpanFilePath != "" {
+			spanFileOpts := []spanfile.Option{
+				spanfile.WithMaxSize(int64(conf.SpanFileMaxSizeBytes)),
+				spanfile.WithRetention(conf.SpanFileMaxFiles, int64(conf.SpanFileMaxTotalBytes)),
+				spanfile.WithQueueSize(conf.SpanFileQueueSize),
+			}
+			if conf.SpanFileMaxAge != "" {
+				age, err := time.ParseDuration(conf.SpanFileMaxAge)
+				if err != nil {
+					return ret, fmt.Errorf("span_file_max_age: %v", err)
+				}
+				spanFileOpts = append(spanFileOpts, spanfile.WithMaxAge(age))
+			}
+			if conf.SpanFileCompress {
+				spanFileOpts = append(spanFileOpts, spanfile.WithCompression())
+			}
+			spanFileSink, err := spanfile.NewSpanSink(conf.SpanFilePath, log, spanFileOpts...)
+			if err != nil {
+				logger.WithError(err).Error("Improper span file sink configuration")
+				return ret, err
+			}
+			ret.spanSinks = append(ret.spanSinks, spanFileSink)
+			logger.WithField("path", conf.SpanFilePath).Info("Configured span file sink")
+		}
+
+		if conf.OTLPTraceEndpoint != "" {
+			otlpOpts := []otlptrace.Option{
+				otlptrace.WithHeaders(conf.OTLPTraceHeaders),
+				otlptrace.WithBufferSize(conf.OTLPTraceSpanBufferSize),
+			}
+			if conf.OTLPTraceInsecure {
+				otlpOpts = append(otlpOpts, otlptrace.WithInsecure())
+			} else {
+				otlpOpts = append(otlpOpts, otlptrace.WithTLS(
+					conf.OTLPTraceTLSAuthorityCertificate,
+					conf.OTLPTraceTLSCertificate,
+					conf.OTLPTraceTLSKey,
+				))
+			}
+			if conf.OTLPTraceExportTimeout != "" {
+				timeout, err := time.ParseDuration(conf.OTLPTraceExportTimeout)
+				if err != nil {
+					return ret, fmt.Errorf("otlp_trace_export_timeout: %v", err)
+				}
+				otlpOpts = append(otlpOpts, otlptrace.WithExportTimeout(timeout))
+			}
+			otlpSink, err := otlptrace.NewSpanSink(conf.OTLPTraceEndpoint, log, otlpOpts...)
+			if err != nil {
+				logger.WithError(err).Error("Improper OTLP trace sink configuration")
+				return ret, err
+			}
+			ret.spanSinks = append(ret.spanSinks, otlpSink)
+			logger.Info("Configured OTLP trace sink")
+		}
+
 		if conf.FalconerAddress != "" {
 			falsink, err := falconer.NewSpanSink(context.Background(), conf.FalconerAddress, log, grpc.WithInsecure())
 			if err != nil {
@@ -452,9 +932,30 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		if conf.NumSpanWorkers > 0 {
 			ret.SpanWorkerGoroutines = conf.NumSpanWorkers
 		}
+		ret.spanSinkQueueSizes = conf.SpanSinkQueueSizes
+		ret.spanSinkDispatchers = conf.SpanSinkDispatchers
 	}
 
 	if conf.KafkaBroker != "" {
+		kafkaOpts := []kafka.Option{kafka.WithSecurity(kafka.Security{
+			TLSEnabled:              conf.KafkaTLSEnabled,
+			TLSAuthorityCertificate: conf.KafkaTLSAuthorityCertificate,
+			TLSCertificate:          conf.KafkaTLSCertificate,
+			TLSKey:                  conf.KafkaTLSKey,
+			TLSInsecureSkipVerify:   conf.KafkaTLSInsecureSkipVerify,
+			SASLMechanism:           conf.KafkaSaslMechanism,
+			SASLUsername:            conf.KafkaSaslUsername,
+			SASLPassword:            conf.KafkaSaslPassword,
+			SASLPasswordFile:        conf.KafkaSaslPasswordFile,
+		}), kafka.WithSchemaRegistry(kafka.SchemaRegistry{
+			URL:      conf.KafkaSchemaRegistryURL,
+			Username: conf.KafkaSchemaRegistryUsername,
+			Password: conf.KafkaSchemaRegistryPassword,
+		}), kafka.WithRetryQueue(conf.KafkaRetryQueueSize, conf.KafkaRetryQueueMaxAttempts)}
+		if conf.KafkaHeadersEnabled || len(conf.KafkaHeaders) > 0 {
+			kafkaOpts = append(kafkaOpts, kafka.WithHeaders(conf.KafkaHeaders, conf.Hostname))
+		}
+
 		if conf.KafkaMetricTopic != "" || conf.KafkaCheckTopic != "" || conf.KafkaEventTopic != "" {
 			kSink, err := kafka.NewKafkaMetricSink(
 				log, ret.TraceClient, conf.KafkaBroker, conf.KafkaCheckTopic, conf.KafkaEventTopic,
@@ -462,6 +963,10 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 				conf.KafkaPartitioner, conf.KafkaRetryMax,
 				conf.KafkaMetricBufferBytes, conf.KafkaMetricBufferMessages,
 				conf.KafkaMetricBufferFrequency,
+				append([]kafka.Option{
+					kafka.WithPartitionKey(conf.KafkaMetricPartitionKey),
+					kafka.WithMetricSerializationFormat(conf.KafkaMetricSerializationFormat),
+				}, kafkaOpts...)...,
 			)
 			if err != nil {
 				return ret, err
@@ -480,6 +985,11 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 				conf.KafkaSpanBufferBytes, conf.KafkaSpanBufferMesages,
 				conf.KafkaSpanBufferFrequency, conf.KafkaSpanSerializationFormat,
 				conf.KafkaSpanSampleTag, conf.KafkaSpanSampleRatePercent,
+				append([]kafka.Option{
+					kafka.WithPartitionKey(conf.KafkaSpanPartitionKey),
+					kafka.WithSpanTopicTemplate(conf.KafkaSpanTopicTemplate),
+					kafka.WithTraceSampling(conf.KafkaSpanSampleRate, conf.KafkaSpanSampleKeepTag),
+				}, kafkaOpts...)...,
 			)
 			if err != nil {
 				return ret, err
@@ -492,6 +1002,144 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		}
 	}
 
+	if conf.PrometheusExpositionEnabled {
+		ret.promExposition = promsink.NewExpositionSink(log, conf.PrometheusExpositionSummaries,
+			conf.PrometheusExpositionCounterExpiryIntervals)
+		ret.metricSinks = append(ret.metricSinks, ret.promExposition)
+		logger.WithField("path", promsink.ExpositionPath).Info("Configured Prometheus exposition sink")
+	}
+
+	if conf.CloudWatchRegion != "" {
+		cloudWatchOpts := []cloudwatch.Option{
+			cloudwatch.WithEndpoint(conf.CloudWatchEndpoint),
+			cloudwatch.WithDimensionPriority(conf.CloudWatchDimensionPriority),
+		}
+		if conf.CloudWatchStatisticSets {
+			cloudWatchOpts = append(cloudWatchOpts, cloudwatch.WithStatisticSets())
+		}
+		cloudWatchSink, err := cloudwatch.NewMetricSink(conf.CloudWatchRegion, conf.CloudWatchNamespace, log, cloudWatchOpts...)
+		if err != nil {
+			logger.WithError(err).Error("Improper CloudWatch sink configuration")
+			return ret, err
+		}
+		ret.metricSinks = append(ret.metricSinks, cloudWatchSink)
+		logger.WithField("region", conf.CloudWatchRegion).Info("Configured CloudWatch metric sink")
+	}
+
+	if conf.GraphiteAddress != "" {
+		graphiteOpts := []graphite.Option{
+			graphite.WithTemplate(conf.GraphiteTemplate),
+			graphite.WithBufferSize(conf.GraphiteBufferSize),
+		}
+		if conf.GraphiteWriteTimeout != "" {
+			timeout, err := time.ParseDuration(conf.GraphiteWriteTimeout)
+			if err != nil {
+				return ret, fmt.Errorf("graphite_write_timeout: %v", err)
+			}
+			graphiteOpts = append(graphiteOpts, graphite.WithWriteTimeout(timeout))
+		}
+		graphiteSink, err := graphite.NewMetricSink(conf.GraphiteAddress, conf.Hostname, log, graphiteOpts...)
+		if err != nil {
+			logger.WithError(err).Error("Improper Graphite sink configuration")
+			return ret, err
+		}
+		ret.metricSinks = append(ret.metricSinks, graphiteSink)
+		logger.WithField("address", conf.GraphiteAddress).Info("Configured Graphite metric sink")
+	}
+
+	if conf.InfluxDBAddress != "" {
+		influxSink, err := influxdb.NewMetricSink(
+			conf.InfluxDBAddress, conf.Hostname, ret.HTTPClient, log,
+			influxdb.WithV2(conf.InfluxDBOrg, conf.InfluxDBBucket, conf.InfluxDBToken),
+			influxdb.WithV1(conf.InfluxDBDatabase, conf.InfluxDBRetentionPolicy, conf.InfluxDBUsername, conf.InfluxDBPassword),
+			influxdb.WithBatchSize(conf.InfluxDBBatchSize),
+			influxdb.WithMaxPayloadBytes(conf.InfluxDBMaxPayloadBytes),
+		)
+		if err != nil {
+			logger.WithError(err).Error("Improper InfluxDB sink configuration")
+			return ret, err
+		}
+		ret.metricSinks = append(ret.metricSinks, influxSink)
+		logger.WithField("address", conf.InfluxDBAddress).Info("Configured InfluxDB metric sink")
+	}
+
+	if conf.NewRelicInsertKey != "" {
+		newRelicSink, err := newrelic.NewMetricSink(
+			conf.NewRelicInsertKey, conf.NewRelicRegion, conf.Hostname,
+			ret.interval, ret.HTTPClient, log,
+		)
+		if err != nil {
+			logger.WithError(err).Error("Improper New Relic sink configuration")
+			return ret, err
+		}
+		ret.metricSinks = append(ret.metricSinks, newRelicSink)
+		logger.WithField("region", conf.NewRelicRegion).Info("Configured New Relic metric sink")
+	}
+
+	if conf.OTLPMetricEndpoint != "" {
+		otlpOpts := []otlpmetric.Option{otlpmetric.WithHeaders(conf.OTLPMetricHeaders)}
+		if conf.OTLPMetricInsecure {
+			otlpOpts = append(otlpOpts, otlpmetric.WithInsecure())
+		} else {
+			otlpOpts = append(otlpOpts, otlpmetric.WithTLS(
+				conf.OTLPMetricTLSAuthorityCertificate,
+				conf.OTLPMetricTLSCertificate,
+				conf.OTLPMetricTLSKey,
+			))
+		}
+		if conf.OTLPMetricTimeout != "" {
+			timeout, err := time.ParseDuration(conf.OTLPMetricTimeout)
+			if err != nil {
+				return ret, fmt.Errorf("otlp_metric_timeout: %v", err)
+			}
+			otlpOpts = append(otlpOpts, otlpmetric.WithTimeout(timeout))
+		}
+		otlpSink, err := otlpmetric.NewMetricSink(
+			conf.OTLPMetricEndpoint, conf.OTLPMetricProtocol, conf.Hostname,
+			ret.interval, log, otlpOpts...,
+		)
+		if err != nil {
+			logger.WithError(err).Error("Improper OTLP metric sink configuration")
+			return ret, err
+		}
+		ret.metricSinks = append(ret.metricSinks, otlpSink)
+		logger.Info("Configured OTLP metric sink")
+	}
+
+	if conf.PrometheusRemoteWriteAddress != "" {
+		tlsConfig, err := prometheusrw.NewTLSConfig(
+			conf.PrometheusRemoteWriteTLSAuthorityCertificate,
+			conf.PrometheusRemoteWriteTLSCertificate,
+			conf.PrometheusRemoteWriteTLSKey,
+		)
+		if err != nil {
+			logger.WithError(err).Error("Improper Prometheus remote_write TLS configuration")
+			return ret, err
+		}
+		rwHTTP := *ret.HTTPClient
+		rwTransport := &http.Transport{
+			IdleConnTimeout: ret.interval * 2,
+			TLSClientConfig: tlsConfig,
+		}
+		rwHTTP.Transport = vhttp.NewTraceRoundTripper(rwTransport, ret.TraceClient, "prometheus_remote_write")
+
+		rwSink, err := prometheusrw.NewRemoteWriteSink(prometheusrw.Options{
+			Endpoint:               conf.PrometheusRemoteWriteAddress,
+			CounterMode:            prometheusrw.CounterMode(conf.PrometheusRemoteWriteCounterMode),
+			CounterExpiryIntervals: conf.PrometheusRemoteWriteCounterExpiryIntervals,
+			BatchSize:              conf.PrometheusRemoteWriteBatchSize,
+			MaxRetries:             conf.PrometheusRemoteWriteMaxRetries,
+			BearerToken:            conf.PrometheusRemoteWriteBearerToken,
+			BasicAuthUsername:      conf.PrometheusRemoteWriteBasicAuthUsername,
+			BasicAuthPassword:      conf.PrometheusRemoteWriteBasicAuthPassword,
+		}, &rwHTTP, log)
+		if err != nil {
+			return ret, err
+		}
+		ret.metricSinks = append(ret.metricSinks, rwSink)
+		logger.Info("Configured Prometheus remote_write metric sink")
+	}
+
 	{
 		mtx := sync.Mutex{}
 		if conf.DebugFlushedMetrics {
@@ -502,13 +1150,62 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		}
 	}
 
+	if conf.BlackholeSink {
+		metricSink, _ := blackhole.NewBlackholeMetricSink()
+		spanSink, _ := blackhole.NewBlackholeSpanSink()
+		ret.metricSinks = append(ret.metricSinks, metricSink)
+		ret.spanSinks = append(ret.spanSinks, spanSink)
+		logger.Info("Configured blackhole sink")
+	}
+
+	if conf.DebugSinkOutput != "" {
+		out, err := debug.OpenOutput(conf.DebugSinkOutput)
+		if err != nil {
+			logger.WithError(err).Error("Improper debug sink configuration")
+			return ret, err
+		}
+		opts := []debug.PrintOption{
+			debug.WithFormat(conf.DebugSinkFormat),
+			debug.WithSampleRate(conf.DebugSinkSampleRate),
+			debug.WithFilter(conf.DebugSinkFilter),
+		}
+		if conf.DebugSinkColor {
+			opts = append(opts, debug.WithColor())
+		}
+		metricSink, spanSink, err := debug.NewPrintSinks(out, opts...)
+		if err != nil {
+			logger.WithError(err).Error("Improper debug sink configuration")
+			return ret, err
+		}
+		ret.metricSinks = append(ret.metricSinks, metricSink)
+		ret.spanSinks = append(ret.spanSinks, spanSink)
+		logger.WithField("output", conf.DebugSinkOutput).Info("Configured debug sink")
+	}
+
 	// After all sinks are initialized, set the list of tags to exclude
 	setSinkExcludedTags(conf.TagsExclude, ret.metricSinks)
+	if err := checkInternalMetricsSink(conf.InternalMetricsSink, ret.metricSinks); err != nil {
+		return ret, err
+	}
 
 	var svc s3iface.S3API
 	awsID := conf.AwsAccessKeyID
 	awsSecret := conf.AwsSecretAccessKey
 	if conf.AwsS3Bucket != "" {
+		if conf.AwsS3Format != "" && conf.AwsS3Format != s3p.FormatTSV && conf.AwsS3Format != s3p.FormatParquet {
+			return ret, fmt.Errorf("unknown aws_s3_format %q", conf.AwsS3Format)
+		}
+		parquetOpts := s3p.ParquetOptions{
+			RowGroupSize: conf.AwsS3ParquetRowGroupSize,
+			TagColumns:   conf.AwsS3ParquetTagColumns,
+		}
+		if err := parquetOpts.Validate(); err != nil {
+			return ret, fmt.Errorf("aws_s3_parquet_tag_columns: %v", err)
+		}
+		keyTemplate, err := s3p.ParseKeyTemplate(conf.AwsS3KeyTemplate)
+		if err != nil {
+			return ret, fmt.Errorf("aws_s3_key_template: %v", err)
+		}
 		if len(awsID) > 0 && len(awsSecret) > 0 {
 			sess, err := session.NewSession(&aws.Config{
 				Region:      aws.String(conf.AwsRegion),
@@ -522,10 +1219,19 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 				logger.Info("Successfully created AWS session")
 				svc = s3.New(sess)
 				plugin := &s3p.S3Plugin{
-					Logger:   log,
-					Svc:      svc,
-					S3Bucket: conf.AwsS3Bucket,
-					Hostname: ret.Hostname,
+					Logger:                 log,
+					Svc:                    svc,
+					S3Bucket:               conf.AwsS3Bucket,
+					Hostname:               ret.Hostname,
+					Interval:               int(ret.interval.Seconds()),
+					Format:                 conf.AwsS3Format,
+					Parquet:                parquetOpts,
+					Key:                    keyTemplate,
+					SSEKMS:                 conf.AwsS3SSEKMS,
+					KMSKeyID:               conf.AwsS3SSEKMSKeyID,
+					BucketOwnerFullControl: conf.AwsS3BucketOwnerFullControl,
+					MultipartThreshold:     conf.AwsS3MultipartThresholdBytes,
+					TraceClient:            ret.TraceClient,
 				}
 				ret.registerPlugin(plugin)
 			}
@@ -542,10 +1248,68 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		logger.Info("S3 archives are enabled")
 	}
 
+	if conf.GcsBucket != "" {
+		if !gcsp.ValidFormat(conf.GcsFormat) {
+			return ret, fmt.Errorf("unknown gcs_format %q", conf.GcsFormat)
+		}
+		parquetOpts := s3p.ParquetOptions{
+			RowGroupSize: conf.GcsParquetRowGroupSize,
+			TagColumns:   conf.GcsParquetTagColumns,
+		}
+		if err := parquetOpts.Validate(); err != nil {
+			return ret, fmt.Errorf("gcs_parquet_tag_columns: %v", err)
+		}
+		keyTemplate, err := s3p.ParseKeyTemplate(conf.GcsKeyTemplate)
+		if err != nil {
+			return ret, fmt.Errorf("gcs_key_template: %v", err)
+		}
+		client := &http.Client{Timeout: ret.interval}
+		tokens, err := gcsp.NewTokenSource(conf.GcsCredentialsFile, client)
+		if err != nil {
+			logger.WithError(err).Error("Improper GCS plugin configuration")
+			return ret, err
+		}
+		ret.registerPlugin(&gcsp.Plugin{
+			Logger:       log,
+			Hostname:     ret.Hostname,
+			Interval:     int(ret.interval.Seconds()),
+			Bucket:       conf.GcsBucket,
+			Key:          keyTemplate,
+			Format:       conf.GcsFormat,
+			Parquet:      parquetOpts,
+			Uncompressed: conf.GcsUncompressed,
+			Tokens:       tokens,
+			Client:       client,
+			TraceClient:  ret.TraceClient,
+		})
+		logger.WithField("bucket", conf.GcsBucket).Info("GCS archives are enabled")
+	}
+
 	if conf.FlushFile != "" {
+		if !localfilep.ValidFormat(conf.FlushFileFormat) {
+			return ret, fmt.Errorf("unknown flush_file_format %q", conf.FlushFileFormat)
+		}
+		var maxAge time.Duration
+		if conf.FlushFileMaxAge != "" {
+			maxAge, err = time.ParseDuration(conf.FlushFileMaxAge)
+			if err != nil {
+				return ret, fmt.Errorf("flush_file_max_age: %v", err)
+			}
+		}
 		localFilePlugin := &localfilep.Plugin{
 			FilePath: conf.FlushFile,
 			Logger:   log,
+			Hostname: ret.Hostname,
+			Interval: int(ret.interval.Seconds()),
+			Format:   conf.FlushFileFormat,
+			MaxSize:  conf.FlushFileMaxSizeBytes,
+			MaxAge:   maxAge,
+			MaxFiles: conf.FlushFileMaxFiles,
+			Compress: conf.FlushFileCompress,
+		}
+		if err := localFilePlugin.Lock(); err != nil {
+			logger.WithError(err).Error("Improper LocalFile plugin configuration")
+			return ret, err
 		}
 		ret.registerPlugin(localFilePlugin)
 		logger.Info(fmt.Sprintf("Local file logging to %s", conf.FlushFile))
@@ -554,16 +1318,70 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 	// closed in Shutdown; Same approach and http.Shutdown
 	ret.shutdown = make(chan struct{})
 
-	// Don't emit keys into logs now that we're done with them.
-	conf.SentryDsn = REDACTED
-	conf.TLSKey = REDACTED
-	conf.DatadogAPIKey = REDACTED
-	conf.SignalfxAPIKey = REDACTED
-	conf.LightstepAccessToken = REDACTED
-	conf.AwsAccessKeyID = REDACTED
-	conf.AwsSecretAccessKey = REDACTED
-
 	ret.forwardUseGRPC = conf.ForwardUseGrpc
+	ret.forwardGRPCStream = conf.ForwardGrpcStream
+	ret.forwardGRPCStreamBatchSize = conf.ForwardGrpcStreamBatchSize
+	if !forwardrpc.ValidCompression(conf.ForwardGrpcCompression) {
+		return ret, fmt.Errorf("unknown forward_grpc_compression %q", conf.ForwardGrpcCompression)
+	}
+	ret.grpcForwardCompression = newForwardCompression(conf.ForwardGrpcCompression)
+	ret.grpcMaxRecvMsgSize = conf.GrpcMaxRecvMsgSize
+	ret.grpcMaxSendMsgSize = conf.GrpcMaxSendMsgSize
+	ret.grpcForwardTLS, err = forwardrpc.NewClientTLSConfig(
+		conf.ForwardGrpcTLSAuthorityCertificate,
+		conf.ForwardGrpcTLSCertificate,
+		conf.ForwardGrpcTLSKey,
+	)
+	if err != nil {
+		logger.WithError(err).Error("Improper gRPC forwarding TLS configuration")
+		return ret, err
+	}
+	ret.grpcForwardAuthToken = conf.ForwardGrpcAuthToken
+	ret.grpcForwardConns = map[string]*grpcForwardConn{}
+
+	ret.forwardDestinations = newForwardDestinations(conf.ForwardAddress, !conf.ForwardUseGrpc)
+	ret.forwardHTTPClient = ret.HTTPClient
+	ret.forwardTLS, err = vhttp.LoadTLSFiles(
+		conf.ForwardTLSCertificateFile,
+		conf.ForwardTLSKeyFile,
+		conf.ForwardTLSAuthorityCertificateFile,
+	)
+	if err != nil {
+		logger.WithError(err).Error("Improper forwarding TLS configuration")
+		return ret, err
+	}
+	if ret.forwardTLS != nil {
+		forwardTransport := &http.Transport{IdleConnTimeout: ret.interval * 2}
+		ret.forwardTLS.ConfigureTransport(forwardTransport, conf.ForwardTLSServerName)
+		ret.forwardHTTPClient = &http.Client{
+			Timeout:   ret.HTTPClient.Timeout,
+			Transport: forwardTransport,
+		}
+		// Destinations resolved from an SRV record need to be
+		// connected to over TLS, too:
+		ret.forwardDestinations.scheme = "https://"
+	}
+	ret.httpTLS, err = vhttp.LoadTLSFiles(
+		conf.HTTPTLSCertificateFile,
+		conf.HTTPTLSKeyFile,
+		conf.HTTPTLSClientAuthorityCertificateFile,
+	)
+	if err != nil {
+		logger.WithError(err).Error("Improper HTTP listener TLS configuration")
+		return ret, err
+	}
+	if ret.httpTLS != nil && conf.HTTPTLSCertificateFile == "" {
+		err = errors.New("http_tls_client_authority_certificate_file requires a certificate and key")
+		logger.WithError(err).Error("Improper HTTP listener TLS configuration")
+		return ret, err
+	}
+	ret.forwardRefreshInterval = defaultForwardRefreshInterval
+	if conf.ForwardAddressRefreshInterval != "" {
+		ret.forwardRefreshInterval, err = time.ParseDuration(conf.ForwardAddressRefreshInterval)
+		if err != nil {
+			return ret, err
+		}
+	}
 
 	// Setup the grpc server if it was configured
 	ret.grpcListenAddress = conf.GrpcAddress
@@ -573,12 +1391,36 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		for i, worker := range ret.Workers {
 			ingesters[i] = worker
 		}
+		if ret.workerScaler != nil {
+			ingesters = []importsrv.MetricIngester{ret.workerScaler}
+		}
 
-		ret.grpcServer = importsrv.New(ingesters,
-			importsrv.WithTraceClient(ret.TraceClient))
+		importOpts := []importsrv.Option{
+			importsrv.WithTraceClient(ret.TraceClient),
+			importsrv.WithMaxRecvMsgSize(ret.grpcMaxRecvMsgSize),
+			importsrv.WithMaxSendMsgSize(ret.grpcMaxSendMsgSize),
+			importsrv.WithAuthenticator(&forwardrpc.Authenticator{
+				RequireClientCert: conf.GrpcTLSAuthorityCertificate != "",
+				Token:             conf.GrpcAuthToken,
+				Permissive:        conf.GrpcAuthPermissive,
+			}),
+			importsrv.WithSpanIngester(ret),
+			importsrv.WithMaxSpanBatchSize(conf.GrpcMaxSpanBatchSize),
+		}
+		if conf.GrpcTLSCertificate != "" || conf.GrpcTLSKey != "" || conf.GrpcTLSAuthorityCertificate != "" {
+			var grpcTLS *tls.Config
+			grpcTLS, err = forwardrpc.NewServerTLSConfig(conf.GrpcTLSCertificate, conf.GrpcTLSKey, conf.GrpcTLSAuthorityCertificate)
+			if err != nil {
+				logger.WithError(err).Error("Improper gRPC TLS configuration")
+				return ret, err
+			}
+			importOpts = append(importOpts, importsrv.WithTLS(grpcTLS))
+		}
+		ret.grpcServer = importsrv.New(ingesters, importOpts...)
 	}
 
-	logger.WithField("config", conf).Debug("Initialized server")
+	// Don't emit keys into logs now that we're done with them.
+	logger.WithField("config", conf.Redacted()).Debug("Initialized server")
 
 	return ret, err
 }
@@ -592,6 +1434,9 @@ func (s *Server) Start() {
 
 	// Use the pre-allocated Workers slice to know how many to start.
 	s.SpanWorker = NewSpanWorker(s.spanSinks, s.TraceClient, s.Statsd, s.SpanChan, s.TagsAsMap)
+	s.SpanWorker.scrubber = &s.spanScrubber
+	s.SpanWorker.queueSizes = s.spanSinkQueueSizes
+	s.SpanWorker.dispatchers = s.spanSinkDispatchers
 
 	go func() {
 		log.Info("Starting Event worker")
@@ -618,11 +1463,7 @@ func (s *Server) Start() {
 		},
 	}
 
-	tracePool := &sync.Pool{
-		New: func() interface{} {
-			return make([]byte, s.traceMaxLengthBytes)
-		},
-	}
+	tracePool := newSSFPacketPool(s.traceMaxLengthBytes)
 
 	for _, sink := range s.spanSinks {
 		logrus.WithField("sink", sink.Name()).Info("Starting span sink")
@@ -656,46 +1497,32 @@ func (s *Server) Start() {
 		logrus.Info("Tracing sockets are not configured - not reading trace socket")
 	}
 
-	// Initialize a gRPC connection for forwarding
-	if s.forwardUseGRPC {
-		var err error
-		s.grpcForwardConn, err = grpc.Dial(s.ForwardAddr, grpc.WithInsecure())
-		if err != nil {
-			log.WithError(err).WithFields(logrus.Fields{
-				"forwardAddr": s.ForwardAddr,
-			}).Fatal("Failed to initialize a gRPC connection for forwarding")
+	for _, files := range []*vhttp.TLSFiles{s.forwardTLS, s.httpTLS} {
+		if files != nil {
+			go files.Watch(vhttp.DefaultTLSReloadInterval, s.shutdown, log)
 		}
 	}
 
-	// Flush every Interval forever!
-	go func() {
-		defer func() {
-			ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
-		}()
+	if s.workerScaler != nil {
+		go s.sampleWorkerQueues()
+	}
 
-		if s.synchronizeInterval {
-			// We want to align our ticker to a multiple of its duration for
-			// convenience of bucketing.
-			<-time.After(CalculateTickDelay(s.interval, time.Now()))
+	// Initialize a gRPC connection for forwarding
+	if s.IsLocal() {
+		if s.forwardDestinations.dynamic() {
+			s.resolveForwardDestinations()
+			go s.refreshForwardDestinations(s.forwardRefreshInterval)
+		} else if s.forwardUseGRPC {
+			s.updateGRPCForwardConns(s.forwardDestinations.Members(), nil)
 		}
+	}
 
-		// We aligned the ticker to our interval above. It's worth noting that just
-		// because we aligned once we're not guaranteed to be perfect on each
-		// subsequent tick. This code is small, however, and should service the
-		// incoming tick signal fast enough that the amount we are "off" is
-		// negligible.
-		ticker := time.NewTicker(s.interval)
-		for {
-			select {
-			case <-s.shutdown:
-				// stop flushing on graceful shutdown
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				s.Flush(context.TODO())
-			}
-		}
-	}()
+	// Flush every Interval forever!
+	if s.flushWatchdog != nil {
+		s.flushWatchdog.flushed()
+		go s.watchFlushes()
+	}
+	s.startFlushLoop(0)
 }
 
 // HandleMetricPacket processes each packet that is sent to the server, and sends to an
@@ -734,9 +1561,9 @@ func (s *Server) HandleMetricPacket(packet []byte) error {
 			samples.Add(ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "service_check", "reason": "parse"}))
 			return err
 		}
-		s.Workers[svcheck.Digest%uint32(len(s.Workers))].PacketChan <- *svcheck
+		s.ingestUDP(*svcheck)
 	} else {
-		metric, err := samplers.ParseMetric(packet)
+		parsed, err := samplers.ParseMetrics(packet, s.containerIDTag)
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				logrus.ErrorKey: err,
@@ -745,11 +1572,41 @@ func (s *Server) HandleMetricPacket(packet []byte) error {
 			samples.Add(ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "metric", "reason": "parse"}))
 			return err
 		}
-		s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+		if tn, _ := s.tagNormalizer.Load().(*samplers.TagNormalizer); tn != nil {
+			// the values of a multi-value packet share their tags
+			tn.Normalize(&parsed[0])
+			for i := 1; i < len(parsed); i++ {
+				parsed[i].Tags = parsed[0].Tags
+				parsed[i].JoinedTags = parsed[0].JoinedTags
+				parsed[i].Digest = parsed[0].Digest
+			}
+		}
+		for _, metric := range parsed {
+			s.ingestUDP(metric)
+		}
 	}
 	return nil
 }
 
+// ingestUDP sends the metric to the worker for its digest.
+func (s *Server) ingestUDP(metric samplers.UDPMetric) {
+	if s.workerScaler != nil {
+		s.workerScaler.IngestUDP(metric)
+		return
+	}
+	s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- metric
+}
+
+// currentWorkers returns the metric workers. When worker scaling is
+// on, s.Workers is only for the flush loop, which reassigns it, so
+// everything else reads the workers of the scaler's routes.
+func (s *Server) currentWorkers() []*Worker {
+	if s.workerScaler != nil {
+		return s.workerScaler.load().workers
+	}
+	return s.Workers
+}
+
 // HandleTracePacket accepts an incoming packet as bytes and sends it to the
 // appropriate worker.
 func (s *Server) HandleTracePacket(packet []byte) {
@@ -759,16 +1616,32 @@ func (s *Server) HandleTracePacket(packet []byte) {
 	// Unlike metrics, protobuf shouldn't have an issue with 0-length packets
 	if len(packet) == 0 {
 		s.Statsd.Count("ssf.error_total", 1, []string{"ssf_format:packet", "packet_type:unknown", "reason:zerolength"}, 1.0)
+		s.ssfParseFailure("zero_length", "packet", nil, packet)
 		log.Warn("received zero-length trace packet")
 		return
 	}
 
 	s.Statsd.Histogram("ssf.packet_size", float64(len(packet)), nil, .1)
 
+	if protocol.IsBatchDatagram(packet) {
+		spans, err := protocol.ParseSSFBatchDatagram(packet, s.ssfMaxBatchSpans)
+		if err != nil {
+			s.Statsd.Count("ssf.error_total", 1, []string{"ssf_format:packet", "packet_type:ssf_batch", ssfBatchErrorReason(err)}, 1.0)
+			s.ssfParseFailure(ssfParseFailureCause(err), "packet", err, packet)
+			log.WithError(err).Warn("ParseSSFBatchDatagram")
+			return
+		}
+		for _, span := range spans {
+			s.handleSSF(span, "packet")
+		}
+		return
+	}
+
 	span, err := protocol.ParseSSF(packet)
 	if err != nil {
 		reason := "reason:" + err.Error()
 		s.Statsd.Count("ssf.error_total", 1, []string{"ssf_format:packet", "packet_type:ssf_metric", reason}, 1.0)
+		s.ssfParseFailure(ssfParseFailureCause(err), "packet", err, packet)
 		log.WithError(err).Warn("ParseSSF")
 		return
 	}
@@ -783,7 +1656,84 @@ func (s *Server) HandleTracePacket(packet []byte) {
 	s.handleSSF(span, "packet")
 }
 
+// ssfBatchErrorReason is the reason tag for an error parsing an SSF batch.
+func ssfBatchErrorReason(err error) string {
+	if _, ok := err.(*protocol.BatchTooLarge); ok {
+		return "reason:batch_too_large"
+	}
+	return "reason:" + err.Error()
+}
+
+// handleSSF hands a span read from an SSF listener to the span workers.
+// Spans that carry no metrics must be valid trace spans, or no sink
+// will ingest them, so the others are counted as parse failures.
 func (s *Server) handleSSF(span *ssf.SSFSpan, ssfFormat string) {
+	if len(span.Metrics) == 0 {
+		if err := protocol.ValidateTrace(span); err != nil {
+			var raw []byte
+			if s.ssfParseFailureExamples != nil {
+				raw, _ = span.Marshal()
+			}
+			s.ssfParseFailure(ssfParseFailureCause(err), ssfFormat, nil, raw)
+		}
+	}
+	if s.filterSpan(span) {
+		return
+	}
+	s.limitSpan(span, ssfFormat)
+	s.countSSF(span, ssfFormat)
+	s.SpanChan <- span
+}
+
+// filterSpan reports whether the span should be dropped because of its
+// name, and counts it if so.
+func (s *Server) filterSpan(span *ssf.SSFSpan) bool {
+	f := s.spanNameFilter.load()
+	if f == nil {
+		return false
+	}
+	pattern, ok := f.filtered(span.Name)
+	if ok {
+		s.Statsd.Count("spans_filtered_total", 1, []string{patternTag(pattern)}, 1.0)
+	}
+	return ok
+}
+
+// IngestSpan hands a span received by the gRPC import server to the span
+// workers, like the spans read from SSF listeners. If the span channel
+// stays full until ctx is done, the span is dropped.
+func (s *Server) IngestSpan(ctx context.Context, span *ssf.SSFSpan) error {
+	if s.filterSpan(span) {
+		return nil
+	}
+	s.limitSpan(span, "grpc")
+	select {
+	case s.SpanChan <- span:
+		s.countSSF(span, "grpc")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitSpan drops the links of a span beyond the first
+// ssfMaxSpanLinks, and its events beyond the first ssfMaxSpanEvents,
+// if those are set, and counts them.
+func (s *Server) limitSpan(span *ssf.SSFSpan, ssfFormat string) {
+	if s.ssfMaxSpanLinks > 0 && len(span.Links) > s.ssfMaxSpanLinks {
+		dropped := len(span.Links) - s.ssfMaxSpanLinks
+		span.Links = span.Links[:s.ssfMaxSpanLinks]
+		s.Statsd.Count("ssf.span_links_dropped_total", int64(dropped), []string{"service:" + span.Service, "ssf_format:" + ssfFormat}, 1.0)
+	}
+	if s.ssfMaxSpanEvents > 0 && len(span.Events) > s.ssfMaxSpanEvents {
+		dropped := len(span.Events) - s.ssfMaxSpanEvents
+		span.Events = span.Events[:s.ssfMaxSpanEvents]
+		s.Statsd.Count("ssf.span_events_dropped_total", int64(dropped), []string{"service:" + span.Service, "ssf_format:" + ssfFormat}, 1.0)
+	}
+}
+
+// countSSF tracks the spans received for each service and format.
+func (s *Server) countSSF(span *ssf.SSFSpan, ssfFormat string) {
 	// 1/internalMetricSampleRate packets will be chosen
 	const internalMetricSampleRate = 1000
 
@@ -792,6 +1742,7 @@ func (s *Server) handleSSF(span *ssf.SSFSpan, ssfFormat string) {
 	if (span.Id % internalMetricSampleRate) == 1 {
 		// we can't avoid emitting this metric synchronously by aggregating in-memory, but that's okay
 		s.Statsd.Histogram("ssf.spans.tags_per_span", float64(len(span.Tags)), []string{"service:" + span.Service, "ssf_format:" + ssfFormat}, 1)
+		s.Statsd.Histogram("ssf.spans.links_per_span", float64(len(span.Links)), []string{"service:" + span.Service, "ssf_format:" + ssfFormat}, 1)
 	}
 
 	metrics, ok := s.ssfInternalMetrics.Load(key)
@@ -820,33 +1771,33 @@ func (s *Server) handleSSF(span *ssf.SSFSpan, ssfFormat string) {
 	}
 
 	atomic.AddInt64(&metricsStruct.ssfSpansReceivedTotal, 1)
-
-	s.SpanChan <- span
 }
 
 // ReadMetricSocket listens for available packets to handle.
 func (s *Server) ReadMetricSocket(serverConn net.PacketConn, packetPool *sync.Pool) {
+	s.readMetricSocket(serverConn, packetPool, nil)
+}
+
+// readMetricSocket is ReadMetricSocket, dropping the packets over the
+// rate limit, if any, before parsing them.
+func (s *Server) readMetricSocket(serverConn net.PacketConn, packetPool *sync.Pool, limit *readerRateLimit) {
+	if s.readBatchSize > 1 && s.readMetricSocketBatches(serverConn, packetPool, limit) {
+		return
+	}
 	for {
 		buf := packetPool.Get().([]byte)
-		n, _, err := serverConn.ReadFrom(buf)
+		n, addr, err := serverConn.ReadFrom(buf)
 		if err != nil {
-			log.WithError(err).Error("Error reading from UDP metrics socket")
-			continue
-		}
-		if n > s.metricMaxLength {
-			metrics.ReportOne(s.TraceClient, ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "unknown", "reason": "toolong"}))
-			continue
-		}
-
-		// statsd allows multiple packets to be joined by newlines and sent as
-		// one larger packet
-		// note that spurious newlines are not allowed in this format, it has
-		// to be exactly one newline between each packet, with no leading or
-		// trailing newlines
-		splitPacket := samplers.NewSplitBytes(buf[:n], '\n')
-		for splitPacket.Next() {
-			s.HandleMetricPacket(splitPacket.Chunk())
+			select {
+			case <-s.shutdown:
+				log.WithError(err).Info("Ignoring ReadFrom error while shutting down")
+				return
+			default:
+				log.WithError(err).Error("Error reading from UDP metrics socket")
+				continue
+			}
 		}
+		s.handleMetricDatagram(buf[:n], addr, limit)
 
 		// the Metric struct created by HandleMetricPacket has no byte slices in it,
 		// only strings
@@ -856,20 +1807,104 @@ func (s *Server) ReadMetricSocket(serverConn net.PacketConn, packetPool *sync.Po
 	}
 }
 
-// ReadSSFPacketSocket reads SSF packets off a packet connection.
+// readMetricSocketBatches reads read_batch_size datagrams per syscall
+// with recvmmsg, into buffers it keeps for as long as it reads. It
+// returns false if the platform doesn't support it, or it fails, so that
+// the caller can fall back to reading one datagram per syscall, and true
+// if the server is shutting down.
+func (s *Server) readMetricSocketBatches(serverConn net.PacketConn, packetPool *sync.Pool, limit *readerRateLimit) bool {
+	bufs := make([][]byte, s.readBatchSize)
+	for i := range bufs {
+		bufs[i] = packetPool.Get().([]byte)
+	}
+	defer func() {
+		for _, buf := range bufs {
+			packetPool.Put(buf)
+		}
+	}()
+	br, ok := newBatchReader(serverConn, bufs)
+	if !ok {
+		log.WithField("address", serverConn.LocalAddr()).
+			Warn("Can't read batches of datagrams on this platform, reading them one at a time")
+		return false
+	}
+	for {
+		n, err := br.read()
+		if err != nil {
+			select {
+			case <-s.shutdown:
+				log.WithError(err).Info("Ignoring read error while shutting down")
+				return true
+			default:
+			}
+			log.WithError(err).WithField("address", serverConn.LocalAddr()).
+				Error("Error reading batches from UDP metrics socket, reading datagrams one at a time")
+			return false
+		}
+		for i := 0; i < n; i++ {
+			var addr net.Addr
+			if s.sourceAccounting != nil || s.capture.isActive() {
+				addr = br.addr(i)
+			}
+			// the buffers are reused by the next read, which is
+			// safe for the same reason as returning them to the
+			// pool is in readMetricSocket
+			s.handleMetricDatagram(br.packet(i), addr, limit)
+		}
+	}
+}
+
+// handleMetricDatagram handles a datagram of statsd metrics from addr,
+// unless it's over the rate limit.
+func (s *Server) handleMetricDatagram(packet []byte, addr net.Addr, limit *readerRateLimit) {
+	if s.capture.isActive() {
+		s.capture.record("statsd", packet, addr)
+	}
+	if !limit.allow(len(packet)) {
+		return
+	}
+	if len(packet) > s.metricMaxLength {
+		metrics.ReportOne(s.TraceClient, ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "unknown", "reason": "toolong"}))
+		return
+	}
+	if s.sourceAccounting != nil {
+		s.sourceAccounting.recordPacket(sourceIP(addr), packet)
+	}
+
+	// statsd allows multiple packets to be joined by newlines and sent as
+	// one larger packet
+	// note that spurious newlines are not allowed in this format, it has
+	// to be exactly one newline between each packet, with no leading or
+	// trailing newlines
+	splitPacket := samplers.NewSplitBytes(packet, '\n')
+	for splitPacket.Next() {
+		s.HandleMetricPacket(splitPacket.Chunk())
+	}
+}
+
+// ReadSSFPacketSocket reads SSF packets off a packet connection. The
+// buffers in packetPool must be one byte longer than the longest packet,
+// like those of newSSFPacketPool: the packets that fill them were
+// truncated, and are dropped.
 func (s *Server) ReadSSFPacketSocket(serverConn net.PacketConn, packetPool *sync.Pool) {
+	s.readSSFPacketSocket(serverConn, packetPool, nil)
+}
+
+// readSSFPacketSocket is ReadSSFPacketSocket, dropping the packets over
+// the rate limit, if any, before parsing them.
+func (s *Server) readSSFPacketSocket(serverConn net.PacketConn, packetPool *sync.Pool, limit *readerRateLimit) {
 	// TODO This is duplicated from ReadMetricSocket and feels like it could be it's
 	// own function?
 	p := packetPool.Get().([]byte)
-	if len(p) == 0 {
+	if len(p) <= 1 {
 		log.WithField("len", len(p)).Fatal(
-			"packetPool making empty slices: trace_max_length_bytes must be >= 0")
+			"packetPool making empty slices: trace_max_length_bytes must be > 0")
 	}
 	packetPool.Put(p)
 
 	for {
 		buf := packetPool.Get().([]byte)
-		n, _, err := serverConn.ReadFrom(buf)
+		n, addr, err := serverConn.ReadFrom(buf)
 		if err != nil {
 			// In tests, the probably-best way to
 			// terminate this reader is to issue a shutdown and close the listening
@@ -883,6 +1918,22 @@ func (s *Server) ReadSSFPacketSocket(serverConn net.PacketConn, packetPool *sync
 				continue
 			}
 		}
+		if s.capture.isActive() {
+			s.capture.record("ssf", buf[:n], addr)
+		}
+		if !limit.allow(n) {
+			packetPool.Put(buf)
+			continue
+		}
+		if n == len(buf) {
+			// the datagram didn't fit in the buffer, so the
+			// kernel cut it off; parsing what's left would
+			// only count as a parse error
+			s.Statsd.Count("ssf.error_total", 1, []string{"ssf_format:packet", "packet_type:unknown", "reason:truncated"}, 1.0)
+			s.ssfParseFailure("truncated_datagram", "packet", nil, buf[:n])
+			packetPool.Put(buf)
+			continue
+		}
 
 		s.HandleTracePacket(buf[:n])
 		packetPool.Put(buf)
@@ -893,6 +1944,18 @@ func (s *Server) ReadSSFPacketSocket(serverConn net.PacketConn, packetPool *sync
 // off a streaming socket. See package
 // github.com/stripe/veneur/protocol for details.
 func (s *Server) ReadSSFStreamSocket(serverConn net.Conn) {
+	s.readSSFStreamSocket(serverConn, s.ssfFrameMaxLength(nil), nil, nil)
+}
+
+// readSSFStreamSocket is ReadSSFStreamSocket, for frames of at most
+// maxLength bytes, dropping the frames over the rate limit, if any,
+// before parsing them, and setting peerTags on the spans and their
+// samples.
+//
+// Longer frames close the connection, unless ssfTruncateOversized is
+// set: then the spans in them are truncated to maxLength with
+// truncateSpan, and the batches in them are dropped.
+func (s *Server) readSSFStreamSocket(serverConn net.Conn, maxLength uint32, limit *readerRateLimit, peerTags map[string]string) {
 	defer func() {
 		serverConn.Close()
 	}()
@@ -902,32 +1965,82 @@ func (s *Server) ReadSSFStreamSocket(serverConn net.Conn) {
 	tags := make([]string, 1, 3)
 	tags[0] = "ssf_format:framed"
 
+	readLength := maxLength
+	if s.ssfTruncateOversized {
+		readLength = protocol.MaxSSFPacketLength
+	}
 	for {
-		msg, err := protocol.ReadSSF(serverConn)
+		frame, batch, err := protocol.ReadSSFStreamFrame(serverConn, readLength)
+		var msgs []*ssf.SSFSpan
+		if err == nil {
+			if !limit.allow(len(frame)) {
+				continue
+			}
+			oversized := uint32(len(frame)) > maxLength
+			if oversized && batch {
+				s.Statsd.Incr("ssf.oversized_dropped_total", []string{"ssf_format:framed", "packet_type:ssf_batch"}, 1.0)
+				s.ssfParseFailure("frame_too_large", "framed", nil, frame)
+				continue
+			}
+			if batch {
+				msgs, err = protocol.ParseSSFBatch(frame, s.ssfMaxBatchSpans)
+			} else {
+				var msg *ssf.SSFSpan
+				msg, err = protocol.ParseSSF(frame)
+				if err == nil && oversized {
+					if !truncateSpan(msg, int(maxLength)) {
+						s.Statsd.Incr("ssf.oversized_dropped_total", []string{"ssf_format:framed", "packet_type:ssf_span"}, 1.0)
+						s.ssfParseFailure("frame_too_large", "framed", nil, frame)
+						continue
+					}
+					s.Statsd.Incr("ssf.oversized_truncated_total", []string{"ssf_format:framed", "service:" + msg.Service}, 1.0)
+				}
+				msgs = []*ssf.SSFSpan{msg}
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				// Client hangup, close this
 				s.Statsd.Count("frames.disconnects", 1, nil, 1.0)
 				return
 			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// the connection was idle for longer than its
+				// read timeout
+				s.Statsd.Count("frames.idle_timeouts", 1, nil, 1.0)
+				return
+			}
 			if protocol.IsFramingError(err) {
+				if protocol.IsFrameLengthError(err) {
+					s.Statsd.Incr("ssf.oversized_dropped_total", []string{"ssf_format:framed", "packet_type:unknown"}, 1.0)
+				}
 				log.WithError(err).
 					WithField("remote", serverConn.RemoteAddr()).
 					Info("Frame error reading from SSF connection. Closing.")
 				tags = append(tags, []string{"packet_type:unknown", "reason:framing"}...)
 				s.Statsd.Incr("ssf.error_total", tags, 1.0)
+				s.ssfParseFailure(ssfParseFailureCause(err), "framed", err, nil)
 				return
 			}
 			// Non-frame errors means we can continue reading:
 			log.WithError(err).
 				WithField("remote", serverConn.RemoteAddr()).
 				Error("Error processing an SSF frame")
-			tags = append(tags, []string{"packet_type:unknown", "reason:processing"}...)
+			if batch {
+				tags = append(tags, "packet_type:ssf_batch", ssfBatchErrorReason(err))
+			} else {
+				tags = append(tags, "packet_type:unknown", "reason:processing")
+			}
 			s.Statsd.Incr("ssf.error_total", tags, 1.0)
+			s.ssfParseFailure(ssfParseFailureCause(err), "framed", err, frame)
 			tags = tags[:1]
 			continue
 		}
-		s.handleSSF(msg, "framed")
+		for _, msg := range msgs {
+			tagSSFPeer(msg, peerTags)
+			s.handleSSF(msg, "framed")
+		}
 	}
 }
 
@@ -987,14 +2100,32 @@ func (s *Server) handleTCPGoroutine(conn net.Conn) {
 		}).Debug("Starting TCP connection")
 	}
 
-	// Scanner is nearly the same performance as a custom implementation
+	// Scanner is nearly the same performance as a custom implementation,
+	// and takes care of lines split across reads
 	buf := bufio.NewScanner(conn)
+	if s.tcpMaxLineLength > 0 {
+		// leave room for the newline; the buffer can't start out any
+		// bigger than that, or lines will be allowed to fill it
+		max := s.tcpMaxLineLength + 1
+		initial := 4096
+		if initial > max {
+			initial = max
+		}
+		buf.Buffer(make([]byte, 0, initial), max)
+	}
 
 	scanWithDeadline := func() bool {
 		conn.SetReadDeadline(time.Now().Add(timeout))
 		return buf.Scan()
 	}
+	var peer net.IP
+	if s.sourceAccounting != nil {
+		peer = sourceIP(conn.RemoteAddr())
+	}
 	for scanWithDeadline() {
+		if peer != nil {
+			s.sourceAccounting.recordPacket(peer, buf.Bytes())
+		}
 		// treat each line as a separate packet
 		err := s.HandleMetricPacket(buf.Bytes())
 		if err != nil {
@@ -1002,13 +2133,21 @@ func (s *Server) handleTCPGoroutine(conn net.Conn) {
 			// HandleMetricPacket logs the err and packet, and increments error counters
 			log.WithField("peer", conn.RemoteAddr()).Warn(
 				"Error parsing packet; closing TCP connection")
+			metrics.ReportOne(s.TraceClient, ssf.Count("tcp.connection_errors", 1,
+				map[string]string{"reason": "parse"}))
 			return
 		}
 	}
-	if buf.Err() != nil {
+	if err := buf.Err(); err != nil {
+		reason := "read"
+		if err == bufio.ErrTooLong {
+			reason = "line_too_long"
+		}
+		metrics.ReportOne(s.TraceClient, ssf.Count("tcp.connection_errors", 1,
+			map[string]string{"reason": reason}))
 		// usually "read: connection reset by peer" or "i/o timeout"
 		log.WithFields(logrus.Fields{
-			logrus.ErrorKey: buf.Err(),
+			logrus.ErrorKey: err,
 			"peer":          conn.RemoteAddr(),
 		}).Info("Error reading from TCP client")
 	}
@@ -1029,7 +2168,23 @@ func (s *Server) ReadTCPSocket(listener net.Listener) {
 			}
 		}
 
-		go s.handleTCPGoroutine(conn)
+		if s.tcpConnSlots == nil {
+			go s.handleTCPGoroutine(conn)
+			continue
+		}
+		select {
+		case s.tcpConnSlots <- struct{}{}:
+			go func() {
+				defer func() { <-s.tcpConnSlots }()
+				s.handleTCPGoroutine(conn)
+			}()
+		default:
+			// too many connections are open: turn this one away
+			log.WithField("peer", conn.RemoteAddr()).Warn("Too many TCP connections; closing the new one")
+			metrics.ReportOne(s.TraceClient, ssf.Count("tcp.connection_errors", 1,
+				map[string]string{"reason": "connection_limit"}))
+			conn.Close()
+		}
 	}
 }
 
@@ -1091,9 +2246,14 @@ func (s *Server) HTTPServe() {
 
 	// Ensure that the server responds to SIGUSR2 even
 	// when *not* running under einhorn.
-	graceful.AddSignal(syscall.SIGUSR2, syscall.SIGHUP)
-	graceful.HandleSignals()
-	gracefulSocket := graceful.WrapListener(httpSocket)
+	// SIGINT and SIGTERM are left to ShutdownOnSignal, which
+	// flushes before shutting the listener down, and SIGHUP to
+	// EnableConfigReload.
+	graceful.AddSignal(syscall.SIGUSR2)
+	var gracefulSocket net.Listener = graceful.WrapListener(httpSocket)
+	if s.httpTLS != nil {
+		gracefulSocket = tls.NewListener(gracefulSocket, s.httpTLS.ServerConfig())
+	}
 	log.WithField("address", s.HTTPAddr).Info("HTTP server listening")
 
 	// Signal that the HTTP server is starting
@@ -1157,10 +2317,8 @@ func (s *Server) Shutdown() {
 	graceful.Shutdown()
 	s.gRPCStop()
 
-	// Close the gRPC connection for forwarding
-	if s.grpcForwardConn != nil {
-		s.grpcForwardConn.Close()
-	}
+	// Close the gRPC connections for forwarding
+	s.closeGRPCForwardConns()
 }
 
 // IsLocal indicates whether veneur is running as a local instance
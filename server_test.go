@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"sync"
 
@@ -18,6 +19,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -291,6 +294,140 @@ func TestGlobalServerFlush(t *testing.T) {
 	assert.Equal(t, len(expectedMetrics), len(interMetrics), "incorrect number of elements in the flushed series on the remote server")
 }
 
+func TestServerFlushAggregateOverrides(t *testing.T) {
+	config := globalConfig()
+	config.AggregateOverrides = map[string][]string{
+		"a.b.c": {"sum", "sumsq", "p50"},
+		"d.e.f": {"sum"},
+	}
+
+	metricsChan := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(metricsChan)
+	defer close(metricsChan)
+
+	f := newFixture(t, config, cms, nil)
+	defer f.Close()
+
+	for _, packet := range []string{
+		"a.b.c:1|h|#veneurlocalonly", "a.b.c:2|h|#veneurlocalonly",
+		"d.e.f:1|ms|#veneurlocalonly,veneur_aggregates:max",
+		"g.h.i:1|h|#veneurlocalonly",
+	} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		f.server.Workers[0].ProcessMetric(m)
+	}
+	f.server.Flush(context.TODO())
+
+	var names []string
+	for _, m := range <-metricsChan {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"a.b.c.50percentile", "a.b.c.sum", "a.b.c.sumsq",
+		// the tag takes precedence over the config:
+		"d.e.f.max",
+	}
+	for _, p := range config.Percentiles {
+		expected = append(expected, fmt.Sprintf("g.h.i.%dpercentile", int(p*100)))
+	}
+	expected = append(expected, "g.h.i.count", "g.h.i.max", "g.h.i.min")
+	sort.Strings(expected)
+	assert.Equal(t, expected, names)
+
+	config.Aggregates = []string{"min", "mode"}
+	_, err := NewFromConfig(logrus.New(), config)
+	assert.Error(t, err, "unknown aggregates should be rejected")
+	config.Aggregates = nil
+	config.AggregateOverrides = map[string][]string{"a.b.c": {"p999"}}
+	_, err = NewFromConfig(logrus.New(), config)
+	assert.Error(t, err, "unknown aggregates should be rejected")
+}
+
+func TestServerFlushPercentilesOverrides(t *testing.T) {
+	config := globalConfig()
+	config.Percentiles = []float64{0.5}
+	config.Aggregates = []string{"count"}
+	config.PercentilesOverrides = map[string][]float64{
+		"storage.": {0.5, 0.999, 0.9999},
+	}
+
+	metricsChan := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(metricsChan)
+	defer close(metricsChan)
+
+	f := newFixture(t, config, cms, nil)
+	defer f.Close()
+
+	for _, packet := range []string{
+		// local-only, and mixed as if forwarded:
+		"storage.read:1|h|#veneurlocalonly", "storage.write:1|ms",
+		"api.latency:1|h",
+	} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		f.server.Workers[0].ProcessMetric(m)
+	}
+	f.server.Flush(context.TODO())
+
+	var names []string
+	for _, m := range <-metricsChan {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{
+		"api.latency.50percentile", "api.latency.count",
+		"storage.read.50percentile", "storage.read.99_99percentile", "storage.read.99_9percentile", "storage.read.count",
+		"storage.write.50percentile", "storage.write.99_99percentile", "storage.write.99_9percentile", "storage.write.count",
+	}, names)
+
+	config.PercentilesOverrides = map[string][]float64{"storage.": {99.9}}
+	_, err := NewFromConfig(logrus.New(), config)
+	assert.Error(t, err, "percentiles out of range should be rejected")
+}
+
+func TestServerFlushHistogramWindows(t *testing.T) {
+	config := globalConfig()
+	config.Percentiles = []float64{0.5}
+	config.Aggregates = []string{"count"}
+	config.HistogramWindowIntervals = 2
+
+	metricsChan := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(metricsChan)
+	defer close(metricsChan)
+
+	f := newFixture(t, config, cms, nil)
+	defer f.Close()
+
+	flush := func(packets ...string) map[string]float64 {
+		for _, packet := range packets {
+			m, err := samplers.ParseMetric([]byte(packet))
+			require.NoError(t, err)
+			f.server.Workers[0].ProcessMetric(m)
+		}
+		f.server.Flush(context.TODO())
+		values := map[string]float64{}
+		for _, m := range <-metricsChan {
+			values[m.Name] = m.Value
+		}
+		return values
+	}
+
+	values := flush("a.b.c:1|h", "a.b.c:1|h", "a.b.c:1|h")
+	assert.Equal(t, float64(1), values["a.b.c.50percentile"])
+
+	values = flush("a.b.c:10|h")
+	assert.Equal(t, float64(1), values["a.b.c.50percentile"],
+		"the median should include the last interval's samples")
+	assert.Equal(t, float64(1), values["a.b.c.count"],
+		"the count should only be this interval's")
+
+	values = flush("a.b.c:10|h")
+	assert.Equal(t, float64(10), values["a.b.c.50percentile"],
+		"the first interval should have left the window")
+}
+
 func TestLocalServerMixedMetrics(t *testing.T) {
 	// The exact gob stream that we will receive might differ, so we can't
 	// test against the bytestream directly. But the two streams should unmarshal
@@ -913,6 +1050,89 @@ func TestHandleTCPGoroutineTimeout(t *testing.T) {
 	}
 }
 
+// TestHandleTCPGoroutineLines verifies that lines split across writes
+// are put back together, and that a line that's too long closes the
+// connection.
+func TestHandleTCPGoroutineLines(t *testing.T) {
+	s := &Server{tcpReadTimeout: time.Second, tcpMaxLineLength: 20, Workers: []*Worker{
+		&Worker{PacketChan: make(chan samplers.UDPMetric, 10)},
+	}}
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		for _, chunk := range []string{"a.metric:1|c\nb.met", "ric:2|c\n", strings.Repeat("x", 30) + ":1|c\n", "c.metric:3|c\n"} {
+			if _, err := client.Write([]byte(chunk)); err != nil {
+				// the connection was closed at the long line
+				return
+			}
+		}
+	}()
+	s.handleTCPGoroutine(server)
+
+	close(s.Workers[0].PacketChan)
+	var names []string
+	for packet := range s.Workers[0].PacketChan {
+		names = append(names, packet.Name)
+	}
+	assert.Equal(t, []string{"a.metric", "b.metric"}, names)
+}
+
+// TestHandleMetricPacketNormalizesTags verifies that every value of a
+// multi-value packet gets the normalized tags.
+func TestHandleMetricPacketNormalizesTags(t *testing.T) {
+	s := &Server{
+		Workers: []*Worker{
+			&Worker{PacketChan: make(chan samplers.UDPMetric, 10)},
+		},
+	}
+	s.tagNormalizer.Store(samplers.NewTagNormalizer(true, map[string]string{"environment": "env"}, false, false))
+	require.NoError(t, s.HandleMetricPacket([]byte("a.b.c:1:2|c|#Environment:prod")))
+	close(s.Workers[0].PacketChan)
+
+	normal, err := samplers.ParseMetric([]byte("a.b.c:1|c|#env:prod"))
+	require.NoError(t, err)
+	n := 0
+	for packet := range s.Workers[0].PacketChan {
+		n++
+		assert.Equal(t, normal.MetricKey, packet.MetricKey)
+		assert.Equal(t, normal.Digest, packet.Digest)
+		assert.Equal(t, normal.Tags, packet.Tags)
+	}
+	assert.Equal(t, 2, n)
+}
+
+// TestReadTCPSocketConnectionLimit verifies that connections beyond the
+// limit are closed right away.
+func TestReadTCPSocketConnectionLimit(t *testing.T) {
+	s := &Server{tcpReadTimeout: time.Second, tcpConnSlots: make(chan struct{}, 1),
+		shutdown: make(chan struct{}), Workers: []*Worker{
+			&Worker{PacketChan: make(chan samplers.UDPMetric, 10)},
+		}}
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer func() {
+		close(s.shutdown)
+		listener.Close()
+	}()
+	go s.ReadTCPSocket(listener)
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	_, err = first.Write([]byte("first:1|c\n"))
+	require.NoError(t, err)
+	// once the metric arrives, the first connection holds the only slot
+	packet := <-s.Workers[0].PacketChan
+	assert.Equal(t, "first", packet.Name)
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "the second connection should be closed")
+}
+
 // This is necessary until we can import
 // github.com/sirupsen/logrus/test - it's currently failing due to dep
 // insisting on pulling the repo in with its capitalized name.
@@ -1403,3 +1623,42 @@ func BenchmarkHandleSSF(b *testing.B) {
 		f.server.handleSSF(spans[i%LEN], "packet")
 	}
 }
+
+func TestHandleTracePacketSpanLinks(t *testing.T) {
+	s := &Server{SpanChan: make(chan *ssf.SSFSpan, 10), ssfMaxSpanLinks: 2}
+	span := &ssf.SSFSpan{
+		Id:             1,
+		TraceId:        1,
+		StartTimestamp: 1,
+		EndTimestamp:   2,
+		Links: []*ssf.SSFSpanLink{
+			{TraceId: 2, SpanId: 3},
+			{TraceId: 4, SpanId: 5, Tags: map[string]string{"message": "2"}},
+			{TraceId: 6, SpanId: 7},
+		},
+	}
+	packet, err := proto.Marshal(span)
+	require.NoError(t, err)
+	require.NoError(t, protocol.ValidateTrace(span))
+
+	s.HandleTracePacket(packet)
+	received := <-s.SpanChan
+	require.Len(t, received.Links, 2, "links beyond ssf_max_span_links should be dropped")
+	assert.Equal(t, int64(4), received.Links[1].TraceId)
+	assert.Equal(t, map[string]string{"message": "2"}, received.Links[1].Tags)
+}
+
+func TestHandleTracePacketSpanEvents(t *testing.T) {
+	s := &Server{SpanChan: make(chan *ssf.SSFSpan, 10), ssfMaxSpanEvents: 2}
+	span := &ssf.SSFSpan{Id: 1, TraceId: 1, StartTimestamp: 1, EndTimestamp: 2}
+	for i := 0; i < 3; i++ {
+		span.Events = append(span.Events, &ssf.SSFSpanEvent{Timestamp: 1, Name: fmt.Sprintf("retry %d", i)})
+	}
+	packet, err := proto.Marshal(span)
+	require.NoError(t, err)
+
+	s.HandleTracePacket(packet)
+	received := <-s.SpanChan
+	require.Len(t, received.Events, 2, "events beyond ssf_max_span_events should be dropped")
+	assert.Equal(t, "retry 1", received.Events[1].Name)
+}
@@ -0,0 +1,69 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// setPrecisions decides the precision of the HyperLogLog sketches of
+// new sets, by metric name.
+type setPrecisions struct {
+	// prefixes are the prefixes with their own precisions, longest
+	// first
+	prefixes   []string
+	precisions map[string]uint8
+	fallback   uint8
+}
+
+// newSetPrecisions validates the precisions. It returns nil if they're
+// all the default.
+func newSetPrecisions(precision int, prefixPrecisions map[string]int) (*setPrecisions, error) {
+	if precision == 0 && len(prefixPrecisions) == 0 {
+		return nil, nil
+	}
+	sp := &setPrecisions{
+		precisions: make(map[string]uint8, len(prefixPrecisions)),
+		fallback:   samplers.DefaultSetPrecision,
+	}
+	if precision != 0 {
+		if err := validSetPrecision(precision); err != nil {
+			return nil, fmt.Errorf("set_precision: %v", err)
+		}
+		sp.fallback = uint8(precision)
+	}
+	for prefix, p := range prefixPrecisions {
+		if err := validSetPrecision(p); err != nil {
+			return nil, fmt.Errorf("set_precision_prefixes: %s: %v", prefix, err)
+		}
+		sp.prefixes = append(sp.prefixes, prefix)
+		sp.precisions[prefix] = uint8(p)
+	}
+	sort.Slice(sp.prefixes, func(i, j int) bool {
+		if len(sp.prefixes[i]) != len(sp.prefixes[j]) {
+			return len(sp.prefixes[i]) > len(sp.prefixes[j])
+		}
+		return sp.prefixes[i] < sp.prefixes[j]
+	})
+	return sp, nil
+}
+
+func validSetPrecision(precision int) error {
+	if precision < 0 || precision > 255 {
+		return fmt.Errorf("unsupported set precision %d", precision)
+	}
+	return samplers.ValidateSetPrecision(uint8(precision))
+}
+
+// precision returns the precision for sets with the name: that of the
+// longest prefix it matches, or the default.
+func (sp *setPrecisions) precision(name string) uint8 {
+	for _, prefix := range sp.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return sp.precisions[prefix]
+		}
+	}
+	return sp.fallback
+}
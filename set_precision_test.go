@@ -0,0 +1,53 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestSetPrecisions(t *testing.T) {
+	sp, err := newSetPrecisions(0, nil)
+	require.NoError(t, err)
+	assert.Nil(t, sp, "the default precision doesn't need configuring")
+
+	sp, err = newSetPrecisions(16, map[string]int{"users.": 14, "users.ids.": 16})
+	require.NoError(t, err)
+	assert.Equal(t, samplers.SetPrecision16, sp.precision("other"))
+	assert.Equal(t, samplers.SetPrecision14, sp.precision("users.sessions"))
+	assert.Equal(t, samplers.SetPrecision16, sp.precision("users.ids.unique"))
+
+	_, err = newSetPrecisions(12, nil)
+	assert.Error(t, err)
+	_, err = newSetPrecisions(0, map[string]int{"users.": 270})
+	assert.Error(t, err)
+}
+
+func TestWorkerSetPrecision(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	var err error
+	w.setPrecisions, err = newSetPrecisions(0, map[string]int{"users.": 16})
+	require.NoError(t, err)
+
+	for _, packet := range []string{"users.ids:a|s", "other:a|s", "users.local:a|s|#veneurlocalonly"} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		w.ProcessMetric(m)
+	}
+	wm := w.Flush()
+	require.Len(t, wm.sets, 2)
+	require.Len(t, wm.localSets, 1)
+	precisions := map[string]uint8{}
+	for _, sets := range []map[samplers.MetricKey]*samplers.Set{wm.sets, wm.localSets} {
+		for _, s := range sets {
+			m, err := s.Metric()
+			require.NoError(t, err)
+			// the precision is the second byte of the encoded sketch
+			precisions[s.Name] = m.GetSet().HyperLogLog[1]
+		}
+	}
+	assert.Equal(t, map[string]uint8{"users.ids": 16, "other": 14, "users.local": 16}, precisions)
+}
@@ -0,0 +1,174 @@
+package veneur
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/sinks"
+	"github.com/zenazn/goji/graceful"
+)
+
+const defaultShutdownTimeout = 20 * time.Second
+
+// shutdownSignals are the signals that shut veneur down gracefully.
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// ShutdownOnSignal blocks until veneur receives SIGINT or SIGTERM, or
+// until stopped is closed, and then shuts the server down with
+// FlushAndShutdown. A second signal exits immediately, without waiting
+// for the shutdown to finish.
+func (s *Server) ShutdownOnSignal(stopped <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, shutdownSignals...)
+	defer signal.Stop(sigs)
+	s.shutdownOnSignal(sigs, stopped, os.Exit)
+}
+
+func (s *Server) shutdownOnSignal(sigs <-chan os.Signal, stopped <-chan struct{}, exit func(int)) {
+	select {
+	case sig := <-sigs:
+		log.WithField("signal", sig).Info("Shutting down, signal again to exit immediately")
+	case <-stopped:
+		log.Info("Stopped serving, shutting down")
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.WithField("signal", sig).Warn("Exiting without finishing the shutdown")
+			exit(1)
+		case <-finished:
+		}
+	}()
+	s.FlushAndShutdown()
+}
+
+// FlushAndShutdown shuts the server down without dropping what it has
+// aggregated: it stops listening, waits for the workers to process what
+// they've been sent, and flushes it all one last time, including the
+// span sinks. It gives up after shutdown_timeout.
+func (s *Server) FlushAndShutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.flushAndShutdown(ctx)
+	}()
+	select {
+	case <-done:
+		log.WithField("duration", time.Since(start)).Info("Shut down gracefully")
+	case <-ctx.Done():
+		log.WithField("timeout", s.shutdownTimeout).Warn("Timed out flushing before shutting down")
+	}
+}
+
+func (s *Server) flushAndShutdown(ctx context.Context) {
+	log.Info("Shutting down server gracefully, after a final flush")
+	// closing shutdown stops the flush loop (which is waited for
+	// below, if it's flushing) and the TCP and UNIX listeners, and
+	// lets the UDP readers exit quietly once their sockets are closed
+	close(s.shutdown)
+	s.packetConnsMtx.Lock()
+	for _, conn := range s.packetConns {
+		if err := conn.Close(); err != nil {
+			log.WithError(err).Warn("Ignoring error closing UDP socket")
+		}
+	}
+	s.packetConnsMtx.Unlock()
+	graceful.Shutdown()
+	s.gRPCStop()
+
+	if !s.waitFlushLoop(ctx) || !s.drainSpans(ctx) || !s.drainImports(ctx) {
+		return
+	}
+	for _, w := range s.currentWorkers() {
+		if err := w.drain(ctx); err != nil {
+			return
+		}
+	}
+	// the final flush waits for everything it sends, including the
+	// span sinks' flushes and forwarding, so the forwarding connections
+	// are only closed once it's done
+	s.flush(ctx).Wait()
+	s.closeGRPCForwardConns()
+	s.stopSinks()
+}
+
+// stopSinks stops the metric and span sinks that implement
+// sinks.Stopper.
+func (s *Server) stopSinks() {
+	for _, sink := range s.metricSinks {
+		if stopper, ok := sink.(sinks.Stopper); ok {
+			stopper.Stop()
+		}
+	}
+	for _, sink := range s.spanSinks {
+		if stopper, ok := sink.(sinks.Stopper); ok {
+			stopper.Stop()
+		}
+	}
+}
+
+// waitFlushLoop waits for the flush loop to exit, once shutdown is
+// closed, so that the final flush doesn't start while the loop is
+// flushing the same workers. It returns false if ctx is done first.
+func (s *Server) waitFlushLoop(ctx context.Context) bool {
+	s.flushLoopMtx.Lock()
+	done := s.flushLoopDone
+	s.flushLoopMtx.Unlock()
+	if done == nil {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		log.Warn("Timed out waiting for the flush loop")
+		return false
+	}
+}
+
+// drainImports waits for the metrics imported over HTTP to be handed
+// to the workers, and returns false if ctx is done first.
+func (s *Server) drainImports(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.imports.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		log.Warn("Timed out waiting for imports")
+		return false
+	}
+}
+
+// drainSpans waits for the span workers to take the spans queued for
+// them, and for the span sinks to ingest them, and returns false if
+// ctx is done first.
+func (s *Server) drainSpans(ctx context.Context) bool {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for len(s.SpanChan) > 0 || !s.SpanWorker.idle() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.WithFields(logrus.Fields{
+				"queued": len(s.SpanChan),
+			}).Warn("Timed out waiting for the span workers")
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package veneur
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+func TestShutdownOnSignalFlushes(t *testing.T) {
+	config := globalConfig()
+	// so that only the final flush flushes
+	config.Interval = "1h"
+	metricsChan := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(metricsChan)
+	s := setupVeneurServer(t, config, nil, cms, nil)
+
+	sigs := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.shutdownOnSignal(sigs, nil, func(int) {
+			t.Error("the shutdown shouldn't exit early")
+		})
+	}()
+
+	require.NoError(t, s.HandleMetricPacket([]byte("a.b.c:1|c")))
+	sigs <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+
+	select {
+	case metrics := <-metricsChan:
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "a.b.c", metrics[0].Name)
+		assert.Equal(t, float64(1), metrics[0].Value)
+	default:
+		t.Fatal("the counter wasn't flushed before shutting down")
+	}
+}
+
+func TestShutdownOnSecondSignalExits(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "1h"
+	config.MetricSinkFlushTimeout = "1h"
+	config.ShutdownTimeout = "1h"
+	sink := &wedgedMetricSink{
+		wedged:    make(chan struct{}),
+		abandoned: make(chan struct{}),
+		flushed:   make(chan []samplers.InterMetric, 10),
+	}
+	s := setupVeneurServer(t, config, nil, sink, nil)
+
+	sigs := make(chan os.Signal, 2)
+	exited := make(chan int, 1)
+	go s.shutdownOnSignal(sigs, nil, func(code int) {
+		exited <- code
+	})
+
+	require.NoError(t, s.HandleMetricPacket([]byte("a.b.c:1|c")))
+	sigs <- syscall.SIGTERM
+	select {
+	case <-sink.wedged:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the final flush")
+	}
+	sigs <- syscall.SIGINT
+	select {
+	case code := <-exited:
+		assert.Equal(t, 1, code)
+	case <-time.After(10 * time.Second):
+		t.Fatal("a second signal should exit immediately")
+	}
+}
+
+// stoppingMetricSink records being stopped, and whether it was stopped
+// before the final flush.
+type stoppingMetricSink struct {
+	*channelMetricSink
+	stopped chan bool
+}
+
+func (s *stoppingMetricSink) Stop() {
+	s.stopped <- len(s.metricsChannel) > 0
+}
+
+func TestFlushAndShutdownStopsSinks(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "1h"
+	cms, _ := NewChannelMetricSink(make(chan []samplers.InterMetric, 10))
+	sink := &stoppingMetricSink{channelMetricSink: cms, stopped: make(chan bool, 2)}
+	s := setupVeneurServer(t, config, nil, sink, nil)
+
+	require.NoError(t, s.HandleMetricPacket([]byte("a.b.c:1|c")))
+	s.FlushAndShutdown()
+	select {
+	case flushed := <-sink.stopped:
+		assert.True(t, flushed, "the sink should be stopped after the final flush")
+	default:
+		t.Fatal("the sink wasn't stopped")
+	}
+	assert.Empty(t, sink.stopped, "the sink should only be stopped once")
+}
+
+// releasedMetricSink's first flush signals flushing, and doesn't return
+// until release is closed. All flushes send their metrics down flushed.
+type releasedMetricSink struct {
+	flushes  int32
+	flushing chan struct{}
+	release  chan struct{}
+	flushed  chan []samplers.InterMetric
+}
+
+func (s *releasedMetricSink) Name() string { return "released" }
+
+func (s *releasedMetricSink) Start(*trace.Client) error { return nil }
+
+func (s *releasedMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	if atomic.AddInt32(&s.flushes, 1) == 1 {
+		close(s.flushing)
+		<-s.release
+	}
+	s.flushed <- metrics
+	return nil
+}
+
+func (s *releasedMetricSink) FlushOtherSamples(ctx context.Context, events []ssf.SSFSample) {}
+
+func TestFlushAndShutdownWaitsForFlushLoop(t *testing.T) {
+	config := globalConfig()
+	config.MetricSinkFlushTimeout = "1h"
+	sink := &releasedMetricSink{
+		flushing: make(chan struct{}),
+		release:  make(chan struct{}),
+		flushed:  make(chan []samplers.InterMetric, 10),
+	}
+	s := setupVeneurServer(t, config, nil, sink, nil)
+
+	require.NoError(t, s.HandleMetricPacket([]byte("a.b.c:1|c")))
+	select {
+	case <-sink.flushing:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the flush loop to flush")
+	}
+	require.NoError(t, s.HandleMetricPacket([]byte("d.e.f:1|c")))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.FlushAndShutdown()
+	}()
+	select {
+	case <-done:
+		t.Fatal("the shutdown shouldn't finish while the flush loop is flushing")
+	case <-time.After(5 * s.interval):
+	}
+	close(sink.release)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+
+	flushed := map[string]float64{}
+	for len(sink.flushed) > 0 {
+		for _, m := range <-sink.flushed {
+			flushed[m.Name] += m.Value
+		}
+	}
+	assert.Equal(t, map[string]float64{"a.b.c": 1, "d.e.f": 1}, flushed)
+}
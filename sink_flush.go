@@ -0,0 +1,204 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+const defaultMetricSinkMaxStragglers = 1
+
+// sinkFlushes bounds how long a flush waits for each metric sink, and
+// how many of a sink's flushes may carry on in the background after
+// missing their deadline. It's safe for use by concurrent goroutines.
+type sinkFlushes struct {
+	maxStragglers int
+
+	mtx      sync.Mutex
+	running  map[string]int
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+}
+
+// newSinkFlushes parses the sinks' flush timeouts, which default to
+// the flush interval.
+func newSinkFlushes(interval time.Duration, timeout string, timeouts map[string]string, maxStragglers int) (*sinkFlushes, error) {
+	sf := &sinkFlushes{
+		maxStragglers: maxStragglers,
+		running:       map[string]int{},
+	}
+	var err error
+	sf.timeout, sf.timeouts, err = parseSinkFlushTimeouts(interval, timeout, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	if sf.maxStragglers <= 0 {
+		sf.maxStragglers = defaultMetricSinkMaxStragglers
+	}
+	return sf, nil
+}
+
+func parseSinkFlushTimeouts(interval time.Duration, timeout string, timeouts map[string]string) (time.Duration, map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration, len(timeouts))
+	if timeout != "" {
+		var err error
+		if interval, err = time.ParseDuration(timeout); err != nil {
+			return 0, nil, fmt.Errorf("metric_sink_flush_timeout: %v", err)
+		}
+	}
+	for name, timeout := range timeouts {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return 0, nil, fmt.Errorf("metric_sink_flush_timeouts: %s: %v", name, err)
+		}
+		parsed[name] = d
+	}
+	return interval, parsed, nil
+}
+
+// setTimeouts replaces the timeouts, from the next flush of each sink.
+func (sf *sinkFlushes) setTimeouts(timeout time.Duration, timeouts map[string]time.Duration) {
+	sf.mtx.Lock()
+	defer sf.mtx.Unlock()
+	sf.timeout, sf.timeouts = timeout, timeouts
+}
+
+func (sf *sinkFlushes) timeoutFor(name string) time.Duration {
+	sf.mtx.Lock()
+	defer sf.mtx.Unlock()
+	if timeout, ok := sf.timeouts[name]; ok {
+		return timeout
+	}
+	return sf.timeout
+}
+
+// start counts a flush of the sink as running, unless as many of its
+// earlier flushes as are allowed to straggle are still running.
+func (sf *sinkFlushes) start(name string) bool {
+	sf.mtx.Lock()
+	defer sf.mtx.Unlock()
+	if sf.running[name] >= sf.maxStragglers {
+		return false
+	}
+	sf.running[name]++
+	return true
+}
+
+func (sf *sinkFlushes) finish(name string) {
+	sf.mtx.Lock()
+	defer sf.mtx.Unlock()
+	sf.running[name]--
+}
+
+// idle reports whether none of the sink's flushes are running.
+func (sf *sinkFlushes) idle(name string) bool {
+	sf.mtx.Lock()
+	defer sf.mtx.Unlock()
+	return sf.running[name] == 0
+}
+
+// routeMetrics returns the metrics that each metric sink should flush,
+// by the sink's name, following their veneursinkonly tags. The routed
+// metrics are copied without those tags. If no metric is routed, it
+// returns nil, and every sink flushes all of the metrics.
+func routeMetrics(finalMetrics []samplers.InterMetric, metricSinks []sinks.MetricSink) map[string][]samplers.InterMetric {
+	var routed map[string][]samplers.InterMetric
+	for i, metric := range finalMetrics {
+		if metric.Sinks == nil {
+			if routed != nil {
+				for name := range routed {
+					routed[name] = append(routed[name], metric)
+				}
+			}
+			continue
+		}
+		if routed == nil {
+			routed = make(map[string][]samplers.InterMetric, len(metricSinks))
+			for _, sink := range metricSinks {
+				routed[sink.Name()] = append(make([]samplers.InterMetric, 0, len(finalMetrics)), finalMetrics[:i]...)
+			}
+		}
+		metric.Tags = samplers.WithoutRouteTags(metric.Tags)
+		for name := range routed {
+			if metric.Sinks.RouteTo(name) {
+				routed[name] = append(routed[name], metric)
+			}
+		}
+	}
+	return routed
+}
+
+// flushMetricSinks flushes the metrics to each metric sink at once, and
+// waits for each until its deadline. A sink that misses its deadline is
+// left to finish in the background, so that it doesn't hold up the
+// other sinks or the next interval.
+func (s *Server) flushMetricSinks(ctx context.Context, finalMetrics []samplers.InterMetric) {
+	routed := routeMetrics(finalMetrics, s.metricSinks)
+	type sinkFlush struct {
+		name    string
+		timeout time.Duration
+		ctx     context.Context
+		done    chan struct{}
+	}
+	flushes := make([]sinkFlush, 0, len(s.metricSinks))
+	for _, sink := range s.metricSinks {
+		name := sink.Name()
+		tags := map[string]string{"sink": name}
+		if !s.sinkFlushes.start(name) {
+			log.WithField("sink", name).Warn("Skipping a sink that's still flushing earlier intervals")
+			metrics.ReportOne(s.TraceClient, ssf.Count("flush.sink.skipped_total", 1, tags))
+			continue
+		}
+
+		timeout := s.sinkFlushes.timeoutFor(name)
+		sinkCtx, cancel := context.WithTimeout(ctx, timeout)
+		flush := sinkFlush{name: name, timeout: timeout, ctx: sinkCtx, done: make(chan struct{})}
+		sinkMetrics := finalMetrics
+		if routed != nil {
+			sinkMetrics = routed[name]
+		}
+		go func(ms sinks.MetricSink, flush sinkFlush, cancel context.CancelFunc) {
+			defer close(flush.done)
+			defer s.sinkFlushes.finish(flush.name)
+			defer cancel()
+			start := time.Now()
+			done := startFlushStage(flush.ctx, "sink", flush.name)
+			err := ms.Flush(flush.ctx, sinkMetrics)
+			done(err)
+			samples := []*ssf.SSFSample{
+				ssf.Timing("flush.sink.duration_ns", time.Since(start), time.Nanosecond, tags),
+			}
+			if err != nil {
+				log.WithError(err).WithField("sink", flush.name).Warn("Error flushing sink")
+				samples = append(samples, ssf.Count("flush.sink.error_total", 1, tags))
+			}
+			metrics.ReportBatch(s.TraceClient, samples)
+		}(sink, flush, cancel)
+		flushes = append(flushes, flush)
+	}
+
+	for _, flush := range flushes {
+		select {
+		case <-flush.done:
+		case <-flush.ctx.Done():
+			select {
+			case <-flush.done:
+				continue
+			default:
+			}
+			log.WithFields(logrus.Fields{
+				"sink":    flush.name,
+				"timeout": flush.timeout,
+			}).Warn("Sink missed its flush deadline, leaving it to finish in the background")
+			metrics.ReportOne(s.TraceClient, ssf.Count("flush.sink.timeout_total", 1,
+				map[string]string{"sink": flush.name}))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package veneur
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// stuckMetricSink doesn't finish flushing until it's released, even if
+// its flush's deadline passes.
+type stuckMetricSink struct {
+	flushes int32
+	release chan struct{}
+}
+
+func (s *stuckMetricSink) Name() string { return "stuck" }
+
+func (s *stuckMetricSink) Start(*trace.Client) error { return nil }
+
+func (s *stuckMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	atomic.AddInt32(&s.flushes, 1)
+	<-s.release
+	return ctx.Err()
+}
+
+func (s *stuckMetricSink) FlushOtherSamples(ctx context.Context, events []ssf.SSFSample) {}
+
+func TestFlushMetricSinksDeadline(t *testing.T) {
+	stuck := &stuckMetricSink{release: make(chan struct{})}
+	metricsChan := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(metricsChan)
+	sf, err := newSinkFlushes(time.Hour, "", map[string]string{"stuck": "10ms"}, 1)
+	require.NoError(t, err)
+	s := &Server{metricSinks: []sinks.MetricSink{stuck, cms}, sinkFlushes: sf}
+	assert.Equal(t, time.Hour, sf.timeoutFor("channel"))
+
+	metrics := []samplers.InterMetric{{Name: "a.b.c", Value: 1}}
+	start := time.Now()
+	s.flushMetricSinks(context.Background(), metrics)
+	assert.True(t, time.Since(start) < time.Second, "the flush shouldn't wait for the stuck sink")
+	assert.Equal(t, metrics, <-metricsChan)
+
+	s.flushMetricSinks(context.Background(), metrics)
+	assert.Equal(t, metrics, <-metricsChan)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stuck.flushes),
+		"the stuck sink shouldn't be flushed again while it's straggling")
+
+	close(stuck.release)
+	for {
+		sf.mtx.Lock()
+		running := sf.running["stuck"]
+		sf.mtx.Unlock()
+		if running == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.flushMetricSinks(context.Background(), metrics)
+	<-metricsChan
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stuck.flushes))
+}
+
+func TestRouteMetrics(t *testing.T) {
+	cms, _ := NewChannelMetricSink(make(chan []samplers.InterMetric))
+	metricSinks := []sinks.MetricSink{cms, &stuckMetricSink{}}
+	everywhere := samplers.InterMetric{Name: "everywhere", Tags: []string{"foo:bar"}}
+	assert.Nil(t, routeMetrics([]samplers.InterMetric{everywhere}, metricSinks))
+
+	stuckOnly := samplers.InterMetric{
+		Name:  "stuck.only",
+		Tags:  []string{"veneursinkonly:stuck", "foo:bar"},
+		Sinks: samplers.RouteInformation{"stuck": struct{}{}},
+	}
+	both := samplers.InterMetric{
+		Name:  "both",
+		Tags:  []string{"veneursinkonly:stuck", "veneursinkonly:channel"},
+		Sinks: samplers.RouteInformation{"stuck": struct{}{}, "channel": struct{}{}},
+	}
+	routed := routeMetrics([]samplers.InterMetric{everywhere, stuckOnly, both, everywhere}, metricSinks)
+	require.Len(t, routed, 2)
+
+	names := func(metrics []samplers.InterMetric) (names []string) {
+		for _, m := range metrics {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"everywhere", "both", "everywhere"}, names(routed["channel"]))
+	assert.Equal(t, []string{"everywhere", "stuck.only", "both", "everywhere"}, names(routed["stuck"]))
+	assert.Equal(t, []string{"foo:bar"}, routed["stuck"][1].Tags)
+	assert.Empty(t, routed["stuck"][2].Tags)
+	assert.Equal(t, []string{"veneursinkonly:stuck", "foo:bar"}, stuckOnly.Tags,
+		"the metrics' tags shouldn't change")
+}
+
+func TestNewSinkFlushes(t *testing.T) {
+	sf, err := newSinkFlushes(10*time.Second, "5s", map[string]string{"datadog": "2s"}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, sf.timeoutFor("signalfx"))
+	assert.Equal(t, 2*time.Second, sf.timeoutFor("datadog"))
+	assert.Equal(t, defaultMetricSinkMaxStragglers, sf.maxStragglers)
+
+	_, err = newSinkFlushes(10*time.Second, "", map[string]string{"datadog": "soon"}, 0)
+	assert.Error(t, err)
+}
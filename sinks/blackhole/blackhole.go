@@ -2,21 +2,58 @@ package blackhole
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/sinks"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
 )
 
+// rate measures how fast things arrive at a sink, between reports.
+type rate struct {
+	count uint64
+
+	mtx      sync.Mutex
+	reported time.Time
+}
+
+// add counts n things as having arrived.
+func (r *rate) add(n int) {
+	atomic.AddUint64(&r.count, uint64(n))
+}
+
+// report returns how many things arrived since the last report, and
+// how many arrived per second. The first report's rate is 0, since
+// there's nothing to measure it against.
+func (r *rate) report(now time.Time) (uint64, float64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	n := atomic.SwapUint64(&r.count, 0)
+	last := r.reported
+	r.reported = now
+	if last.IsZero() || !now.After(last) {
+		return n, 0
+	}
+	return n, float64(n) / now.Sub(last).Seconds()
+}
+
 type blackholeMetricSink struct {
+	metrics     rate
+	samples     rate
+	traceClient *trace.Client
 }
 
 var _ sinks.MetricSink = &blackholeMetricSink{}
 
 // NewBlackholeMetricSink creates a new blackholeMetricSink. This sink does
 // nothing at flush time, effectively "black holing" any metrics that are flushed.
-// It is useful for tests that do not require any inspect of flushed metrics.
+// It is useful for tests that do not require any inspect of flushed metrics,
+// and for benchmarking veneur without a real sink slowing it down: it
+// reports how many metrics it receives per second.
 func NewBlackholeMetricSink() (*blackholeMetricSink, error) {
 	return &blackholeMetricSink{}, nil
 }
@@ -25,26 +62,40 @@ func (b *blackholeMetricSink) Name() string {
 	return "blackhole"
 }
 
-func (b *blackholeMetricSink) Start(*trace.Client) error {
+func (b *blackholeMetricSink) Start(cl *trace.Client) error {
+	b.traceClient = cl
 	return nil
 }
 
-func (b *blackholeMetricSink) Flush(context.Context, []samplers.InterMetric) error {
+func (b *blackholeMetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	b.metrics.add(len(interMetrics))
+	n, perSecond := b.metrics.report(time.Now())
+	tags := map[string]string{"sink": b.Name()}
+	metrics.ReportBatch(b.traceClient, []*ssf.SSFSample{
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(n), tags),
+		ssf.Gauge("blackhole.metrics_per_second", float32(perSecond), nil),
+	})
 	return nil
 }
 
 func (b *blackholeMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {
-	return
+	b.samples.add(len(samples))
+	_, perSecond := b.samples.report(time.Now())
+	metrics.ReportOne(b.traceClient, ssf.Gauge("blackhole.other_samples_per_second", float32(perSecond), nil))
 }
 
 type blackholeSpanSink struct {
+	spans       rate
+	traceClient *trace.Client
 }
 
 var _ sinks.SpanSink = &blackholeSpanSink{}
 
 // NewBlackholeSpanSink creates a new blackholeSpanSink. This sink does
 // nothing at flush time, effectively "black holing" any spans that are flushed.
-// It is useful for tests that do not require any inspect of flushed spans.
+// It is useful for tests that do not require any inspect of flushed spans,
+// and for benchmarking veneur without a real sink slowing it down: it
+// reports how many spans it ingests per second.
 func NewBlackholeSpanSink() (*blackholeSpanSink, error) {
 	return &blackholeSpanSink{}, nil
 }
@@ -54,14 +105,21 @@ func (b *blackholeSpanSink) Name() string {
 }
 
 // Start performs final adjustments on the sink.
-func (b *blackholeSpanSink) Start(*trace.Client) error {
+func (b *blackholeSpanSink) Start(cl *trace.Client) error {
+	b.traceClient = cl
 	return nil
 }
 
 func (b *blackholeSpanSink) Ingest(*ssf.SSFSpan) error {
+	b.spans.add(1)
 	return nil
 }
 
 func (b *blackholeSpanSink) Flush() {
-	return
+	n, perSecond := b.spans.report(time.Now())
+	tags := map[string]string{"sink": b.Name()}
+	metrics.ReportBatch(b.traceClient, []*ssf.SSFSample{
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(n), tags),
+		ssf.Gauge("blackhole.spans_per_second", float32(perSecond), nil),
+	})
 }
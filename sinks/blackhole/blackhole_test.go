@@ -0,0 +1,23 @@
+package blackhole
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRate(t *testing.T) {
+	var r rate
+	start := time.Unix(1000, 0)
+	r.add(5)
+	n, perSecond := r.report(start)
+	assert.Equal(t, uint64(5), n)
+	assert.Equal(t, 0.0, perSecond)
+
+	r.add(30)
+	r.add(10)
+	n, perSecond = r.report(start.Add(10 * time.Second))
+	assert.Equal(t, uint64(40), n)
+	assert.Equal(t, 4.0, perSecond)
+}
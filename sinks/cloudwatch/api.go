@@ -0,0 +1,108 @@
+package cloudwatch
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+)
+
+// The client below is the part of the AWS SDK's CloudWatch client that
+// the sink uses: PutMetricData, with its input's fields. It's declared
+// by hand, the way the SDK generates it, on the SDK's own client and
+// query protocol, as only the S3 client of the SDK is vendored here.
+
+const (
+	serviceName       = "monitoring"
+	apiVersion        = "2010-08-01"
+	opPutMetricData   = "PutMetricData"
+	unitCount         = "Count"
+	unitNone          = "None"
+	putMetricDataPath = "/"
+)
+
+// cloudWatchClient puts metric data to CloudWatch.
+type cloudWatchClient struct {
+	*client.Client
+}
+
+// newClient creates a CloudWatch client from a session, like the SDK's
+// cloudwatch.New.
+func newClient(p client.ConfigProvider, cfgs ...*aws.Config) *cloudWatchClient {
+	c := p.ClientConfig(serviceName, cfgs...)
+	svc := &cloudWatchClient{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   serviceName,
+				SigningName:   c.SigningName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    apiVersion,
+			},
+			c.Handlers,
+		),
+	}
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBackNamed(query.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+	return svc
+}
+
+// putMetricDataRequest creates a PutMetricData request, to be sent.
+func (c *cloudWatchClient) putMetricDataRequest(input *putMetricDataInput) *request.Request {
+	op := &request.Operation{
+		Name:       opPutMetricData,
+		HTTPMethod: "POST",
+		HTTPPath:   putMetricDataPath,
+	}
+	req := c.NewRequest(op, input, &putMetricDataOutput{})
+	req.Handlers.Unmarshal.Remove(query.UnmarshalHandler)
+	req.Handlers.Unmarshal.PushBackNamed(protocol.UnmarshalDiscardBodyHandler)
+	return req
+}
+
+type putMetricDataInput struct {
+	_ struct{} `type:"structure"`
+
+	MetricData []*metricDatum `type:"list" required:"true"`
+	Namespace  *string        `min:"1" type:"string" required:"true"`
+}
+
+type putMetricDataOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+type metricDatum struct {
+	_ struct{} `type:"structure"`
+
+	Dimensions      []*dimension  `type:"list"`
+	MetricName      *string       `min:"1" type:"string" required:"true"`
+	StatisticValues *statisticSet `type:"structure"`
+	Timestamp       *time.Time    `type:"timestamp" timestampFormat:"iso8601"`
+	Unit            *string       `type:"string" enum:"StandardUnit"`
+	Value           *float64      `type:"double"`
+}
+
+type dimension struct {
+	_ struct{} `type:"structure"`
+
+	Name  *string `min:"1" type:"string" required:"true"`
+	Value *string `min:"1" type:"string" required:"true"`
+}
+
+type statisticSet struct {
+	_ struct{} `type:"structure"`
+
+	Maximum     *float64 `type:"double" required:"true"`
+	Minimum     *float64 `type:"double" required:"true"`
+	SampleCount *float64 `type:"double" required:"true"`
+	Sum         *float64 `type:"double" required:"true"`
+}
@@ -0,0 +1,437 @@
+package cloudwatch
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/query/queryutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// DefaultNamespace is the namespace that metrics are put in, by
+// default.
+const DefaultNamespace = "Veneur"
+
+// The limits of PutMetricData: the most datums in a request, the most
+// bytes in the body of a request, and the most dimensions of a datum.
+const (
+	maxDatums         = 1000
+	maxRequestBytes   = 1000000
+	maxDimensions     = 30
+	maxDimensionValue = 1024
+)
+
+// requestOverhead is room, in a request's body, for all but its metric
+// data: its action, version and namespace.
+const requestOverhead = 1024
+
+// The suffixes of the aggregates of histograms and timers that make up
+// a statistic set.
+const (
+	suffixMin   = ".min"
+	suffixMax   = ".max"
+	suffixSum   = ".sum"
+	suffixCount = ".count"
+)
+
+// Option configures a CloudWatch sink.
+type Option func(*options)
+
+type options struct {
+	endpoint          string
+	dimensionPriority []string
+	statisticSets     bool
+}
+
+// WithEndpoint sets the endpoint of CloudWatch, instead of the one of
+// the sink's region, e.g. a VPC endpoint.
+func WithEndpoint(endpoint string) Option {
+	return func(o *options) {
+		o.endpoint = endpoint
+	}
+}
+
+// WithDimensionPriority sets which tags become dimensions first, when
+// a metric has more tags than a datum can have dimensions. After them,
+// the other tags are in the order of their names.
+func WithDimensionPriority(tags []string) Option {
+	return func(o *options) {
+		o.dimensionPriority = tags
+	}
+}
+
+// WithStatisticSets puts the min, max, sum and count of a histogram or
+// timer as one statistic set, named after it, rather than as four
+// metrics. Its other aggregates are put as metrics still.
+func WithStatisticSets() Option {
+	return func(o *options) {
+		o.statisticSets = true
+	}
+}
+
+// MetricSink puts metrics to Amazon CloudWatch.
+type MetricSink struct {
+	namespace     string
+	priority      map[string]int
+	statisticSets bool
+	excludedTags  map[string]struct{}
+
+	client *cloudWatchClient
+	// throttled counts the requests that CloudWatch throttled.
+	throttled int64
+
+	traceClient *trace.Client
+	log         *logrus.Logger
+}
+
+var _ sinks.MetricSink = &MetricSink{}
+
+// NewMetricSink creates a sink that puts metrics in a namespace of
+// CloudWatch, DefaultNamespace if it's empty, in region. It gets its
+// credentials as the AWS SDK does by default: from the environment,
+// the shared credentials file, or the instance's role. Throttled
+// requests are retried with the SDK's backoff.
+func NewMetricSink(region, namespace string, log *logrus.Logger, opts ...Option) (*MetricSink, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	if o.endpoint != "" {
+		cfg = cfg.WithEndpoint(o.endpoint)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	priority := make(map[string]int, len(o.dimensionPriority))
+	for i, tag := range o.dimensionPriority {
+		if _, ok := priority[tag]; !ok {
+			priority[tag] = i
+		}
+	}
+	return &MetricSink{
+		namespace:     namespace,
+		priority:      priority,
+		statisticSets: o.statisticSets,
+		client:        newClient(sess),
+		log:           log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (*MetricSink) Name() string {
+	return "cloudwatch"
+}
+
+// Start sets the sink up.
+func (s *MetricSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (s *MetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	s.excludedTags = tagsSet
+}
+
+// FlushOtherSamples is a no-op; events and service checks aren't
+// metrics.
+func (s *MetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// Flush puts the metrics to CloudWatch, in as many requests as
+// PutMetricData's limits need.
+func (s *MetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, subCtx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(s.traceClient)
+	flushStart := time.Now()
+
+	datums, skipped, droppedDimensions := s.datums(interMetrics)
+	tags := map[string]string{"sink": s.Name()}
+	span.Add(
+		ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(skipped), tags),
+		ssf.Count("cloudwatch.dropped_dimensions_total", float32(droppedDimensions), tags),
+	)
+	flushed := 0
+	defer func() {
+		span.Add(
+			ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(flushed), tags),
+			ssf.Count("cloudwatch.throttled_requests_total", float32(atomic.SwapInt64(&s.throttled, 0)), tags),
+		)
+	}()
+
+	for _, batch := range batches(datums) {
+		if err := s.put(subCtx, batch); err != nil {
+			span.Error(err)
+			s.log.WithError(err).WithField("datums", len(datums)-flushed).Warn("Could not put metrics to CloudWatch")
+			return err
+		}
+		flushed += len(batch)
+	}
+
+	span.Add(ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags))
+	s.log.WithField("datums", flushed).Info("Completed flush to CloudWatch")
+	return nil
+}
+
+// put sends one PutMetricData request, counting the attempts that
+// CloudWatch throttled.
+func (s *MetricSink) put(ctx context.Context, batch []*metricDatum) error {
+	req := s.client.putMetricDataRequest(&putMetricDataInput{
+		Namespace:  aws.String(s.namespace),
+		MetricData: batch,
+	})
+	req.SetContext(ctx)
+	req.Handlers.Retry.PushBack(func(r *request.Request) {
+		if r.IsErrorThrottle() {
+			atomic.AddInt64(&s.throttled, 1)
+		}
+	})
+	return req.Send()
+}
+
+// batches splits datums into batches that each fit in a PutMetricData
+// request.
+func batches(datums []*metricDatum) [][]*metricDatum {
+	var batches [][]*metricDatum
+	start, size := 0, 0
+	for i, datum := range datums {
+		datumSize := encodedSize(datum)
+		if i > start && (i-start == maxDatums || size+datumSize > maxRequestBytes-requestOverhead) {
+			batches = append(batches, datums[start:i])
+			start, size = i, 0
+		}
+		size += datumSize
+	}
+	if start < len(datums) {
+		batches = append(batches, datums[start:])
+	}
+	return batches
+}
+
+// encodedSize returns the most bytes that a datum takes in the body of
+// a request: its size as the last of the most datums in a request.
+func encodedSize(datum *metricDatum) int {
+	body := url.Values{}
+	if err := queryutil.Parse(body, &putMetricDataInput{MetricData: []*metricDatum{datum}}, false); err != nil {
+		return maxRequestBytes
+	}
+	// Every parameter of the datum is prefixed with its index, which
+	// has up to three digits more than the "1" of its only one here:
+	return len(body.Encode()) + 4*len(body)
+}
+
+// aggregate is the statistic set of a histogram or timer, as its
+// aggregates are gathered.
+type aggregate struct {
+	datum *metricDatum
+	set   statisticSet
+	// have marks which aggregates are gathered, and the index of their
+	// metrics.
+	have map[string]int
+}
+
+// datums turns the metrics into datums, and returns them with the
+// number of metrics that can't be put, and the number of dimensions
+// that were dropped past CloudWatch's limit. Counters and gauges are
+// put as values; with statistic sets, histograms and timers that have
+// all of their min, max, sum and count flushed are put as statistic
+// sets.
+func (s *MetricSink) datums(interMetrics []samplers.InterMetric) ([]*metricDatum, int, int) {
+	datums := make([]*metricDatum, 0, len(interMetrics))
+	skipped, droppedDimensions := 0, 0
+	var aggregates map[string]*aggregate
+	var aggregated []bool
+	if s.statisticSets {
+		aggregates, aggregated = s.gatherAggregates(interMetrics)
+	}
+
+	for i, im := range interMetrics {
+		if !sinks.IsAcceptableMetric(im, s) || im.Name == "" ||
+			math.IsNaN(im.Value) || math.IsInf(im.Value, 0) {
+			skipped++
+			continue
+		}
+		var unit string
+		switch im.Type {
+		case samplers.CounterMetric:
+			unit = unitCount
+		case samplers.GaugeMetric:
+			unit = unitNone
+		default:
+			skipped++
+			continue
+		}
+		if aggregated != nil && aggregated[i] {
+			// The statistic set goes where the first of its
+			// aggregates would have:
+			key := aggregateKey(baseName(im.Name), im.Tags)
+			if agg := aggregates[key]; agg != nil && agg.datum != nil {
+				datums = append(datums, agg.datum)
+				agg.datum = nil
+			}
+			continue
+		}
+
+		dimensions, dropped := s.dimensions(im.Tags)
+		droppedDimensions += dropped
+		datums = append(datums, &metricDatum{
+			MetricName: aws.String(im.Name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(time.Unix(im.Timestamp, 0)),
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(im.Value),
+		})
+	}
+	return datums, skipped, droppedDimensions
+}
+
+// gatherAggregates gathers the statistic sets of the histograms and
+// timers whose min, max, sum and count are all among the metrics, and
+// marks which metrics went into one.
+func (s *MetricSink) gatherAggregates(interMetrics []samplers.InterMetric) (map[string]*aggregate, []bool) {
+	aggregates := map[string]*aggregate{}
+	for i, im := range interMetrics {
+		base := baseName(im.Name)
+		if base == "" || !sinks.IsAcceptableMetric(im, s) ||
+			math.IsNaN(im.Value) || math.IsInf(im.Value, 0) {
+			continue
+		}
+		suffix := im.Name[len(base):]
+		if (suffix == suffixCount) != (im.Type == samplers.CounterMetric) {
+			continue
+		}
+		key := aggregateKey(base, im.Tags)
+		agg := aggregates[key]
+		if agg == nil {
+			agg = &aggregate{have: map[string]int{}}
+			aggregates[key] = agg
+		}
+		agg.have[suffix] = i
+		value := aws.Float64(im.Value)
+		switch suffix {
+		case suffixMin:
+			agg.set.Minimum = value
+		case suffixMax:
+			agg.set.Maximum = value
+		case suffixSum:
+			agg.set.Sum = value
+		case suffixCount:
+			agg.set.SampleCount = value
+		}
+		if len(agg.have) == 4 {
+			dimensions, _ := s.dimensions(im.Tags)
+			agg.datum = &metricDatum{
+				MetricName:      aws.String(base),
+				Dimensions:      dimensions,
+				Timestamp:       aws.Time(time.Unix(im.Timestamp, 0)),
+				Unit:            aws.String(unitNone),
+				StatisticValues: &agg.set,
+			}
+		}
+	}
+
+	aggregated := make([]bool, len(interMetrics))
+	for key, agg := range aggregates {
+		if agg.datum == nil {
+			delete(aggregates, key)
+			continue
+		}
+		for _, i := range agg.have {
+			aggregated[i] = true
+		}
+	}
+	return aggregates, aggregated
+}
+
+// baseName returns the name of the histogram or timer that a metric is
+// the min, max, sum or count of, or "" if it isn't one of those.
+func baseName(name string) string {
+	for _, suffix := range []string{suffixMin, suffixMax, suffixSum, suffixCount} {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return ""
+}
+
+// aggregateKey identifies a histogram or timer by its name and tags.
+func aggregateKey(name string, tags []string) string {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	return name + "|" + strings.Join(sorted, ",")
+}
+
+// dimensions turns tags into dimensions: those in the sink's priority
+// first, then the others by name, up to CloudWatch's limit. It returns
+// them with how many were dropped past the limit. Tags without a value
+// are left out, as CloudWatch doesn't take them.
+func (s *MetricSink) dimensions(tags []string) ([]*dimension, int) {
+	type kv struct{ k, v string }
+	kvs := make([]kv, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		i := strings.IndexByte(tag, ':')
+		if i <= 0 || i == len(tag)-1 {
+			continue
+		}
+		k, v := tag[:i], tag[i+1:]
+		if _, excluded := s.excludedTags[k]; excluded || seen[k] {
+			continue
+		}
+		seen[k] = true
+		if len(v) > maxDimensionValue {
+			v = v[:maxDimensionValue]
+		}
+		kvs = append(kvs, kv{k, v})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		pi, iok := s.priority[kvs[i].k]
+		pj, jok := s.priority[kvs[j].k]
+		switch {
+		case iok && jok:
+			return pi < pj
+		case iok != jok:
+			return iok
+		}
+		return kvs[i].k < kvs[j].k
+	})
+
+	dropped := 0
+	if len(kvs) > maxDimensions {
+		dropped = len(kvs) - maxDimensions
+		kvs = kvs[:maxDimensions]
+	}
+	if len(kvs) == 0 {
+		return nil, dropped
+	}
+	dimensions := make([]*dimension, len(kvs))
+	for i, d := range kvs {
+		dimensions[i] = &dimension{Name: aws.String(d.k), Value: aws.String(d.v)}
+	}
+	return dimensions, dropped
+}
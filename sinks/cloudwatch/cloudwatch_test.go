@@ -0,0 +1,163 @@
+package cloudwatch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func testSink(t *testing.T, endpoint string, opts ...Option) *MetricSink {
+	sink, err := NewMetricSink("us-west-2", "", logrus.New(), opts...)
+	require.NoError(t, err)
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	require.NoError(t, err)
+	sink.client = newClient(sess)
+	require.NoError(t, sink.Start(nil))
+	return sink
+}
+
+func TestDatums(t *testing.T) {
+	sink := testSink(t, "http://localhost")
+	sink.SetExcludedTags([]string{"secret"})
+
+	datums, skipped, _ := sink.datums([]samplers.InterMetric{
+		{Name: "requests", Timestamp: 1000, Value: 5, Tags: []string{"farm:sunny", "barn", "secret:moo"}, Type: samplers.CounterMetric},
+		{Name: "cows", Timestamp: 1000, Value: 12, Type: samplers.GaugeMetric},
+		{Name: "farm.ok", Timestamp: 1000, Type: samplers.StatusMetric},
+	})
+	assert.Equal(t, 1, skipped)
+	require.Len(t, datums, 2)
+	assert.Equal(t, "requests", *datums[0].MetricName)
+	assert.Equal(t, unitCount, *datums[0].Unit)
+	assert.Equal(t, 5.0, *datums[0].Value)
+	assert.Equal(t, int64(1000), datums[0].Timestamp.Unix())
+	assert.Equal(t, []*dimension{{Name: aws.String("farm"), Value: aws.String("sunny")}}, datums[0].Dimensions)
+	assert.Equal(t, unitNone, *datums[1].Unit)
+	assert.Nil(t, datums[1].Dimensions)
+}
+
+func TestDimensionPriority(t *testing.T) {
+	sink := testSink(t, "http://localhost", WithDimensionPriority([]string{"service", "env"}))
+
+	tags := []string{"env:prod", "zone:a"}
+	for i := 0; i < 40; i++ {
+		tags = append(tags, fmt.Sprintf("tag%02d:x", i))
+	}
+	tags = append(tags, "service:api")
+	dimensions, dropped := sink.dimensions(tags)
+	assert.Equal(t, 13, dropped)
+	require.Len(t, dimensions, maxDimensions)
+	assert.Equal(t, "service", *dimensions[0].Name)
+	assert.Equal(t, "env", *dimensions[1].Name)
+	assert.Equal(t, "tag00", *dimensions[2].Name)
+	assert.Equal(t, "tag27", *dimensions[29].Name)
+}
+
+func TestStatisticSets(t *testing.T) {
+	sink := testSink(t, "http://localhost", WithStatisticSets())
+
+	tags := []string{"farm:sunny"}
+	datums, skipped, _ := sink.datums([]samplers.InterMetric{
+		{Name: "latency.max", Timestamp: 1000, Value: 10, Tags: tags, Type: samplers.GaugeMetric},
+		{Name: "latency.min", Timestamp: 1000, Value: 1, Tags: tags, Type: samplers.GaugeMetric},
+		{Name: "latency.sum", Timestamp: 1000, Value: 20, Tags: tags, Type: samplers.GaugeMetric},
+		{Name: "latency.count", Timestamp: 1000, Value: 4, Tags: tags, Type: samplers.CounterMetric},
+		{Name: "latency.99percentile", Timestamp: 1000, Value: 9, Tags: tags, Type: samplers.GaugeMetric},
+		// Without a sum and count, these aren't a statistic set:
+		{Name: "size.max", Timestamp: 1000, Value: 3, Type: samplers.GaugeMetric},
+		{Name: "size.min", Timestamp: 1000, Value: 2, Type: samplers.GaugeMetric},
+	})
+	assert.Equal(t, 0, skipped)
+	require.Len(t, datums, 4)
+	set := datums[0]
+	assert.Equal(t, "latency", *set.MetricName)
+	assert.Nil(t, set.Value)
+	assert.Equal(t, &statisticSet{
+		Maximum:     aws.Float64(10),
+		Minimum:     aws.Float64(1),
+		Sum:         aws.Float64(20),
+		SampleCount: aws.Float64(4),
+	}, set.StatisticValues)
+	assert.Equal(t, "latency.99percentile", *datums[1].MetricName)
+	assert.Equal(t, "size.max", *datums[2].MetricName)
+	assert.Equal(t, "size.min", *datums[3].MetricName)
+}
+
+func TestBatches(t *testing.T) {
+	datums := make([]*metricDatum, 2500)
+	for i := range datums {
+		datums[i] = &metricDatum{MetricName: aws.String("m"), Value: aws.Float64(1)}
+	}
+	bs := batches(datums)
+	require.Len(t, bs, 3)
+	assert.Len(t, bs[0], maxDatums)
+	assert.Len(t, bs[2], 500)
+
+	// Datums with long dimensions fill a request before its count does:
+	long := strings.Repeat("x", maxDimensionValue)
+	for i := range datums[:1000] {
+		dimensions := make([]*dimension, maxDimensions)
+		for j := range dimensions {
+			dimensions[j] = &dimension{Name: aws.String(fmt.Sprintf("d%d", j)), Value: aws.String(long)}
+		}
+		datums[i] = &metricDatum{MetricName: aws.String("m"), Dimensions: dimensions, Value: aws.Float64(1)}
+	}
+	for _, batch := range batches(datums[:1000]) {
+		assert.True(t, len(batch) < 40, "%d datums", len(batch))
+	}
+}
+
+func TestFlush(t *testing.T) {
+	requests := make(chan http.Header, 10)
+	bodies := make(chan string, 10)
+	throttle := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		requests <- r.Header
+		bodies <- r.PostForm.Encode()
+		if throttle > 0 {
+			throttle--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>Throttling</Code><Message>Rate exceeded</Message></Error><RequestId>1</RequestId></ErrorResponse>`)
+			return
+		}
+		fmt.Fprint(w, `<PutMetricDataResponse><ResponseMetadata><RequestId>2</RequestId></ResponseMetadata></PutMetricDataResponse>`)
+	}))
+	defer srv.Close()
+
+	sink := testSink(t, srv.URL)
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "requests", Timestamp: 1000, Value: 5, Tags: []string{"farm:sunny"}, Type: samplers.CounterMetric},
+	}))
+	require.Len(t, requests, 2)
+	assert.Contains(t, (<-requests).Get("Authorization"), "AWS4-HMAC-SHA256")
+	<-bodies
+	body := <-bodies
+	for _, param := range []string{
+		"Action=PutMetricData",
+		"Namespace=Veneur",
+		"MetricData.member.1.MetricName=requests",
+		"MetricData.member.1.Value=5",
+		"MetricData.member.1.Unit=Count",
+		"MetricData.member.1.Timestamp=1970-01-01T00%3A16%3A40Z",
+		"MetricData.member.1.Dimensions.member.1.Name=farm",
+		"MetricData.member.1.Dimensions.member.1.Value=sunny",
+	} {
+		assert.Contains(t, body, param)
+	}
+}
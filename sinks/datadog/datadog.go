@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +24,20 @@ import (
 const datadogNameKey = "name"
 const datadogResourceKey = "resource"
 
+// datadogTraceIDHighKey is the tag with the high 64 bits of 128-bit
+// trace IDs, in hex; Datadog's trace_id is the low 64 bits.
+const datadogTraceIDHighKey = "_dd.p.tid"
+
+// datadogLinkKeyPrefix starts the tags that hold the first link of a
+// span.
+const datadogLinkKeyPrefix = "link."
+
+// datadogSamplingPriorityKey is the metric that tells the Datadog
+// agent to keep a trace, with a value of datadogUserKeep.
+const datadogSamplingPriorityKey = "_sampling_priority_v1"
+
+const datadogUserKeep = 2
+
 // At present Veneur has no way to differentiate between types. This could likely
 // be changed to a tag conversion (e.g. tag type is removed and used for this value)
 const datadogSpanType = "web"
@@ -444,10 +459,16 @@ func (dd *DatadogSpanSink) Flush() {
 	dd.mutex.Unlock()
 
 	serviceCount := make(map[string]int64)
+	droppedEvents := 0
+	userDropped := 0
 	// Datadog wants the spans for each trace in an array, so make a map.
-	traceMap := map[int64][]*DatadogTraceSpan{}
+	traceMap := map[[2]int64][]*DatadogTraceSpan{}
 	// Convert the SSFSpans into Datadog Spans
 	for _, span := range ssfSpans {
+		if sinks.PriorityDropped(span) {
+			userDropped++
+			continue
+		}
 		// -1 is a canonical way of passing in invalid info in Go
 		// so we should support that too
 		parentID := span.ParentId
@@ -469,12 +490,30 @@ func (dd *DatadogSpanSink) Flush() {
 			resource = "unknown"
 		}
 		delete(tags, datadogResourceKey)
+		if span.TraceIdHigh != 0 {
+			// Datadog takes the high bits of 128-bit
+			// trace IDs as a tag:
+			tags[datadogTraceIDHighKey] = fmt.Sprintf("%016x", uint64(span.TraceIdHigh))
+		}
+		if len(span.Links) > 0 {
+			// Datadog has no span links, so record the first
+			// one as tags:
+			link := span.Links[0]
+			tags[datadogLinkKeyPrefix+"trace_id"] = ssf.LinkTraceIDString(link)
+			tags[datadogLinkKeyPrefix+"span_id"] = strconv.FormatInt(link.SpanId, 10)
+			for k, v := range link.Tags {
+				tags[datadogLinkKeyPrefix+"tags."+k] = v
+			}
+		}
 
 		name := span.Name
 		if name == "" {
 			name = "unknown"
 		}
 
+		// Datadog's spans have nowhere to put events:
+		droppedEvents += len(span.Events)
+
 		var errorCode int64
 		if span.Error {
 			errorCode = 2
@@ -493,11 +532,12 @@ func (dd *DatadogSpanSink) Flush() {
 			Error:    errorCode,
 			Meta:     tags,
 		}
-		serviceCount[span.Service]++
-		if _, ok := traceMap[span.TraceId]; !ok {
-			traceMap[span.TraceId] = []*DatadogTraceSpan{}
+		if sinks.PriorityKept(span) {
+			ddspan.Metrics = map[string]float64{datadogSamplingPriorityKey: datadogUserKeep}
 		}
-		traceMap[span.TraceId] = append(traceMap[span.TraceId], ddspan)
+		serviceCount[span.Service]++
+		traceID := [2]int64{span.TraceIdHigh, span.TraceId}
+		traceMap[traceID] = append(traceMap[traceID], ddspan)
 	}
 	// Smush the spans into a two-dimensional array now that they are grouped by trace id.
 	finalTraces := make([][]*DatadogTraceSpan, len(traceMap))
@@ -524,7 +564,14 @@ func (dd *DatadogSpanSink) Flush() {
 			samples.Add(ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(count), map[string]string{"sink": dd.Name(), "service": service}))
 		}
 		samples.Add(ssf.Timing(sinks.MetricKeySpanFlushDuration, time.Since(flushStart), time.Nanosecond, map[string]string{"sink": dd.Name()}))
+		if droppedEvents > 0 {
+			samples.Add(ssf.Count(sinks.MetricKeyTotalSpanEventsDropped, float32(droppedEvents), map[string]string{"sink": dd.Name()}))
+		}
 	} else {
 		dd.log.Info("No traces to flush to Datadog, skipping.")
 	}
+	if userDropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(userDropped),
+			map[string]string{"sink": dd.Name(), "reason": sinks.SkipReasonUserDrop}))
+	}
 }
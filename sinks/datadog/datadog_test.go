@@ -191,6 +191,106 @@ func TestDatadogFlushSpans(t *testing.T) {
 	assert.Equal(t, true, transport.GotCalled, "Did not call spans endpoint")
 }
 
+func TestDatadogFlushSpansLinks(t *testing.T) {
+	transport := &DatadogRoundTripper{Endpoint: "/v0.3/traces"}
+	ddSink, err := NewDatadogSpanSink("http://example.com", 100, &http.Client{Transport: transport}, logrus.New())
+	assert.NoError(t, err)
+
+	start := time.Now()
+	err = ddSink.Ingest(&ssf.SSFSpan{
+		TraceId:        1,
+		Id:             2,
+		StartTimestamp: start.UnixNano(),
+		EndTimestamp:   start.Add(time.Second).UnixNano(),
+		Service:        "farts-srv",
+		Name:           "farting farty farts",
+		Links: []*ssf.SSFSpanLink{
+			{TraceId: 3, SpanId: 4, Tags: map[string]string{"message": "1"}},
+			{TraceId: 5, SpanId: 6},
+		},
+	})
+	assert.NoError(t, err)
+	ddSink.Flush()
+
+	var traces [][]DatadogTraceSpan
+	assert.NoError(t, json.Unmarshal([]byte(transport.Contents), &traces))
+	assert.Equal(t, map[string]string{
+		"link.trace_id":     "3",
+		"link.span_id":      "4",
+		"link.tags.message": "1",
+	}, traces[0][0].Meta)
+}
+
+func TestDatadogFlushSpans128BitTraceID(t *testing.T) {
+	transport := &DatadogRoundTripper{Endpoint: "/v0.3/traces"}
+	ddSink, err := NewDatadogSpanSink("http://example.com", 100, &http.Client{Transport: transport}, logrus.New())
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for i, high := range []int64{0, 0x4bf92f3577b34da6} {
+		err = ddSink.Ingest(&ssf.SSFSpan{
+			TraceId:        1,
+			TraceIdHigh:    high,
+			Id:             int64(i + 2),
+			StartTimestamp: start.UnixNano(),
+			EndTimestamp:   start.Add(time.Second).UnixNano(),
+			Service:        "farts-srv",
+			Name:           "farting farty farts",
+		})
+		assert.NoError(t, err)
+	}
+	ddSink.Flush()
+
+	// The spans share a trace_id, but are separate traces:
+	var traces [][]DatadogTraceSpan
+	assert.NoError(t, json.Unmarshal([]byte(transport.Contents), &traces))
+	assert.Len(t, traces, 2)
+	for _, trace := range traces {
+		assert.Len(t, trace, 1)
+		assert.Equal(t, int64(1), trace[0].TraceID)
+		if trace[0].SpanID == 2 {
+			assert.NotContains(t, trace[0].Meta, datadogTraceIDHighKey)
+		} else {
+			assert.Equal(t, "4bf92f3577b34da6", trace[0].Meta[datadogTraceIDHighKey])
+		}
+	}
+}
+
+func TestDatadogFlushSpansSamplingPriority(t *testing.T) {
+	transport := &DatadogRoundTripper{Endpoint: "/v0.3/traces"}
+	ddSink, err := NewDatadogSpanSink("http://example.com", 100, &http.Client{Transport: transport}, logrus.New())
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for i, priority := range []ssf.SSFSpan_SamplingPriority{ssf.SSFSpan_AUTO, ssf.SSFSpan_USER_KEEP, ssf.SSFSpan_USER_DROP} {
+		err = ddSink.Ingest(&ssf.SSFSpan{
+			TraceId:          int64(i + 1),
+			Id:               int64(i + 1),
+			StartTimestamp:   start.UnixNano(),
+			EndTimestamp:     start.Add(time.Second).UnixNano(),
+			Service:          "farts-srv",
+			Name:             "farting farty farts",
+			SamplingPriority: priority,
+		})
+		assert.NoError(t, err)
+	}
+	ddSink.Flush()
+
+	var traces [][]DatadogTraceSpan
+	assert.NoError(t, json.Unmarshal([]byte(transport.Contents), &traces))
+	assert.Len(t, traces, 2, "the dropped trace shouldn't be sent")
+	for _, trace := range traces {
+		switch trace[0].TraceID {
+		case 1:
+			assert.Empty(t, trace[0].Metrics)
+		case 2:
+			assert.Equal(t, float64(datadogUserKeep), trace[0].Metrics[datadogSamplingPriorityKey])
+		default:
+			t.Errorf("unexpected trace %d", trace[0].TraceID)
+		}
+	}
+}
+
 type result struct {
 	received  bool
 	contained bool
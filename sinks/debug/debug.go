@@ -107,9 +107,13 @@ func (b *debugSpanSink) Ingest(span *ssf.SSFSpan) error {
 		info = " (" + info + ")"
 	}
 	duration := time.Duration(span.EndTimestamp - span.StartTimestamp)
-	b.log.Debugf("Span %s:%s(%v) %x/%x/%x %v+%v%s (m:%d)",
+	traceID := fmt.Sprintf("%x", span.TraceId)
+	if span.TraceIdHigh != 0 {
+		traceID = ssf.TraceIDHex(span)
+	}
+	b.log.Debugf("Span %s:%s(%v) %s/%x/%x %v+%v%s (m:%d)",
 		span.Service, span.Name, span.Tags,
-		span.TraceId, span.ParentId, span.Id,
+		traceID, span.ParentId, span.Id,
 		span.StartTimestamp, duration,
 		info, len(span.Metrics),
 	)
@@ -0,0 +1,371 @@
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/sinks/splunk"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// The formats that the print sinks write in.
+const (
+	FormatHuman = "human"
+	FormatJSON  = "json"
+)
+
+// The outputs that OpenOutput takes besides file paths.
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+// The ANSI colors of the human format.
+const (
+	colorReset  = "\x1b[0m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// OpenOutput opens what the print sinks write to: standard output,
+// standard error, or a file, which is appended to.
+func OpenOutput(output string) (io.Writer, error) {
+	switch output {
+	case OutputStdout:
+		return os.Stdout, nil
+	case OutputStderr:
+		return os.Stderr, nil
+	}
+	return os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// PrintOption configures the print sinks.
+type PrintOption func(*printer)
+
+// WithFormat sets the format that the sink writes in: FormatHuman (the
+// default), a line per metric or span, or FormatJSON, a JSON object
+// per line.
+func WithFormat(format string) PrintOption {
+	return func(s *printer) {
+		if format != "" {
+			s.format = format
+		}
+	}
+}
+
+// WithColor colors the human format with ANSI escapes, for terminals.
+func WithColor() PrintOption {
+	return func(s *printer) {
+		s.color = true
+	}
+}
+
+// WithSampleRate writes only 1 in every rate metrics, spans and other
+// samples.
+func WithSampleRate(rate int) PrintOption {
+	return func(s *printer) {
+		if rate > 1 {
+			s.sampleRate = uint64(rate)
+		}
+	}
+}
+
+// WithFilter writes only the metrics, spans and other samples whose
+// names contain a substring.
+func WithFilter(substring string) PrintOption {
+	return func(s *printer) {
+		s.filter = substring
+	}
+}
+
+// printer writes what the print sinks receive.
+type printer struct {
+	format     string
+	color      bool
+	sampleRate uint64
+	filter     string
+
+	// seen counts what passed the filter, to sample it.
+	seen uint64
+
+	mtx sync.Mutex
+	out io.Writer
+}
+
+// PrintMetricSink writes all the metrics, events and service checks
+// that it receives, for seeing what veneur gets while developing
+// instrumentation.
+type PrintMetricSink struct {
+	*printer
+}
+
+// PrintSpanSink writes all the spans that it receives.
+type PrintSpanSink struct {
+	*printer
+}
+
+var _ sinks.MetricSink = &PrintMetricSink{}
+var _ sinks.SpanSink = &PrintSpanSink{}
+
+// NewPrintSinks creates a metric sink and a span sink that write to
+// out, sampled together.
+func NewPrintSinks(out io.Writer, opts ...PrintOption) (*PrintMetricSink, *PrintSpanSink, error) {
+	s := &printer{
+		format:     FormatHuman,
+		sampleRate: 1,
+		out:        out,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.format != FormatHuman && s.format != FormatJSON {
+		return nil, nil, fmt.Errorf("unknown debug sink format %q", s.format)
+	}
+	return &PrintMetricSink{s}, &PrintSpanSink{s}, nil
+}
+
+// Name returns the name of this sink.
+func (s *PrintMetricSink) Name() string {
+	return "debug"
+}
+
+// Start sets the sink up.
+func (s *PrintMetricSink) Start(*trace.Client) error {
+	return nil
+}
+
+// Name returns the name of this sink.
+func (s *PrintSpanSink) Name() string {
+	return "debug"
+}
+
+// Start sets the sink up.
+func (s *PrintSpanSink) Start(*trace.Client) error {
+	return nil
+}
+
+// chosen reports whether something with a name passes the sink's filter
+// and sampling.
+func (s *printer) chosen(name string) bool {
+	if s.filter != "" && !strings.Contains(name, s.filter) {
+		return false
+	}
+	return (atomic.AddUint64(&s.seen, 1)-1)%s.sampleRate == 0
+}
+
+// printedMetric is a metric, in the JSON format.
+type printedMetric struct {
+	Kind      string   `json:"kind"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Value     float64  `json:"value"`
+	Timestamp int64    `json:"timestamp"`
+	Tags      []string `json:"tags,omitempty"`
+	Host      string   `json:"host,omitempty"`
+	Message   string   `json:"message,omitempty"`
+}
+
+// printedSample is an event or service check, in the JSON format.
+type printedSample struct {
+	Kind      string            `json:"kind"`
+	Metric    string            `json:"metric"`
+	Name      string            `json:"name"`
+	Value     float32           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Message   string            `json:"message,omitempty"`
+}
+
+// printedSpan is a span, in the JSON format: like the events of the
+// Splunk sink.
+type printedSpan struct {
+	Kind string `json:"kind"`
+	splunk.SerializedSSF
+}
+
+// Flush writes the metrics.
+func (s *PrintMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	var b strings.Builder
+	for _, m := range metrics {
+		if !s.chosen(m.Name) {
+			continue
+		}
+		if s.format == FormatJSON {
+			// Metrics that JSON can't hold, like NaNs, are left
+			// out:
+			s.writeJSON(&b, printedMetric{
+				Kind:      "metric",
+				Name:      m.Name,
+				Type:      metricType(m.Type),
+				Value:     m.Value,
+				Timestamp: m.Timestamp,
+				Tags:      m.Tags,
+				Host:      m.HostName,
+				Message:   m.Message,
+			})
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s %s %s",
+			s.paint(colorDim, time.Unix(m.Timestamp, 0).UTC().Format(time.RFC3339)),
+			s.paint(colorCyan, metricType(m.Type)),
+			m.Name,
+			s.paint(colorYellow, fmt.Sprint(m.Value)))
+		if len(m.Tags) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(m.Tags, " "))
+		}
+		if m.HostName != "" {
+			fmt.Fprintf(&b, " host=%s", m.HostName)
+		}
+		if m.Message != "" {
+			fmt.Fprintf(&b, " message=%q", m.Message)
+		}
+		b.WriteByte('\n')
+	}
+	return s.write(b.String())
+}
+
+// FlushOtherSamples writes the events and service checks.
+func (s *PrintMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {
+	var b strings.Builder
+	for _, sample := range samples {
+		if !s.chosen(sample.Name) {
+			continue
+		}
+		if s.format == FormatJSON {
+			s.writeJSON(&b, printedSample{
+				Kind:      "sample",
+				Metric:    strings.ToLower(sample.Metric.String()),
+				Name:      sample.Name,
+				Value:     sample.Value,
+				Timestamp: sample.Timestamp,
+				Tags:      sample.Tags,
+				Message:   sample.Message,
+			})
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s %s %s",
+			s.paint(colorDim, time.Unix(sample.Timestamp, 0).UTC().Format(time.RFC3339)),
+			s.paint(colorCyan, strings.ToLower(sample.Metric.String())),
+			sample.Name,
+			s.paint(colorYellow, fmt.Sprint(sample.Value)))
+		writeTags(&b, sample.Tags)
+		if sample.Message != "" {
+			fmt.Fprintf(&b, " message=%q", sample.Message)
+		}
+		b.WriteByte('\n')
+	}
+	s.write(b.String())
+}
+
+// Ingest writes a span.
+func (s *PrintSpanSink) Ingest(span *ssf.SSFSpan) error {
+	if !s.chosen(span.Name) {
+		return nil
+	}
+	var b strings.Builder
+	if s.format == FormatJSON {
+		if err := s.writeJSON(&b, printedSpan{
+			Kind:          "span",
+			SerializedSSF: splunk.SerializeSSF(span),
+		}); err != nil {
+			return err
+		}
+		return s.write(b.String())
+	}
+
+	start := time.Unix(0, span.StartTimestamp)
+	fmt.Fprintf(&b, "%s %s %s:%s %s trace=%s id=%d parent=%d",
+		s.paint(colorDim, start.UTC().Format(time.RFC3339Nano)),
+		s.paint(colorGreen, "span"),
+		span.Service, span.Name,
+		s.paint(colorYellow, time.Duration(span.EndTimestamp-span.StartTimestamp).String()),
+		ssf.TraceIDString(span), span.Id, span.ParentId)
+	if span.Indicator {
+		b.WriteString(" indicator")
+	}
+	if span.Error {
+		b.WriteString(" " + s.paint(colorRed, "error"))
+	}
+	writeTags(&b, span.Tags)
+	if n := len(span.Metrics); n > 0 {
+		fmt.Fprintf(&b, " metrics=%d", n)
+	}
+	if n := len(span.Events); n > 0 {
+		fmt.Fprintf(&b, " events=%d", n)
+	}
+	b.WriteByte('\n')
+	return s.write(b.String())
+}
+
+// Flush is a no-op; spans are written as they're ingested.
+func (s *PrintSpanSink) Flush() {}
+
+// write writes what's been formatted, all at once.
+func (s *printer) write(text string) error {
+	if text == "" {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := io.WriteString(s.out, text)
+	return err
+}
+
+// writeJSON formats v as a line of JSON, unless it can't be.
+func (s *printer) writeJSON(b *strings.Builder, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.Write(line)
+	b.WriteByte('\n')
+	return nil
+}
+
+// paint colors text, if the sink is colored.
+func (s *printer) paint(color, text string) string {
+	if !s.color {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// writeTags formats tags as key=value, sorted by key.
+func writeTags(b *strings.Builder, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, " %s=%s", k, tags[k])
+	}
+}
+
+// metricType returns the name of a metric's type, in the sink's
+// output.
+func metricType(t samplers.MetricType) string {
+	switch t {
+	case samplers.CounterMetric:
+		return "counter"
+	case samplers.GaugeMetric:
+		return "gauge"
+	case samplers.StatusMetric:
+		return "status"
+	}
+	return t.String()
+}
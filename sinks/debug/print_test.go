@@ -0,0 +1,112 @@
+package debug
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+func testMetrics() []samplers.InterMetric {
+	return []samplers.InterMetric{
+		{Name: "farm.cows", Timestamp: 1000, Value: 12, Tags: []string{"farm:sunny"}, Type: samplers.GaugeMetric, HostName: "barn"},
+		{Name: "farm.requests", Timestamp: 1000, Value: 5, Type: samplers.CounterMetric},
+		{Name: "mill.grain", Timestamp: 1000, Value: 3, Type: samplers.CounterMetric},
+	}
+}
+
+func testSpan() *ssf.SSFSpan {
+	start := time.Date(2020, 3, 4, 23, 59, 0, 0, time.UTC)
+	return &ssf.SSFSpan{
+		TraceId:        7,
+		Id:             8,
+		ParentId:       1,
+		StartTimestamp: start.UnixNano(),
+		EndTimestamp:   start.Add(time.Second).UnixNano(),
+		Name:           "farm.feed",
+		Service:        "farm",
+		Error:          true,
+		Tags:           map[string]string{"animal": "cow"},
+	}
+}
+
+func TestPrintHuman(t *testing.T) {
+	var out bytes.Buffer
+	metricSink, spanSink, err := NewPrintSinks(&out)
+	require.NoError(t, err)
+
+	require.NoError(t, metricSink.Flush(context.Background(), testMetrics()))
+	require.NoError(t, spanSink.Ingest(testSpan()))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "1970-01-01T00:16:40Z gauge farm.cows 12 [farm:sunny] host=barn", lines[0])
+	assert.Equal(t, "1970-01-01T00:16:40Z counter farm.requests 5", lines[1])
+	assert.Equal(t, "2020-03-04T23:59:00Z span farm:farm.feed 1s trace=7 id=8 parent=1 error animal=cow", lines[3])
+	assert.NotContains(t, out.String(), "\x1b[")
+}
+
+func TestPrintColor(t *testing.T) {
+	var out bytes.Buffer
+	_, spanSink, err := NewPrintSinks(&out, WithColor())
+	require.NoError(t, err)
+	require.NoError(t, spanSink.Ingest(testSpan()))
+	assert.Contains(t, out.String(), colorRed+"error"+colorReset)
+}
+
+func TestPrintJSON(t *testing.T) {
+	var out bytes.Buffer
+	metricSink, spanSink, err := NewPrintSinks(&out, WithFormat(FormatJSON))
+	require.NoError(t, err)
+
+	require.NoError(t, metricSink.Flush(context.Background(), testMetrics()[:1]))
+	metricSink.FlushOtherSamples(context.Background(), []ssf.SSFSample{{
+		Metric: ssf.SSFSample_STATUS,
+		Name:   "farm.ok",
+		Tags:   map[string]string{"farm": "sunny"},
+	}})
+	require.NoError(t, spanSink.Ingest(testSpan()))
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var v map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &v), line)
+		lines = append(lines, v)
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "metric", lines[0]["kind"])
+	assert.Equal(t, "gauge", lines[0]["type"])
+	assert.Equal(t, 12.0, lines[0]["value"])
+	assert.Equal(t, "sample", lines[1]["kind"])
+	assert.Equal(t, "status", lines[1]["metric"])
+	assert.Equal(t, "span", lines[2]["kind"])
+	assert.Equal(t, "farm.feed", lines[2]["name"])
+	assert.Equal(t, true, lines[2]["error"])
+}
+
+func TestPrintFilterAndSampling(t *testing.T) {
+	var out bytes.Buffer
+	metricSink, _, err := NewPrintSinks(&out, WithFilter("farm."))
+	require.NoError(t, err)
+	require.NoError(t, metricSink.Flush(context.Background(), testMetrics()))
+	assert.Equal(t, 2, strings.Count(out.String(), "\n"))
+	assert.NotContains(t, out.String(), "mill.grain")
+
+	out.Reset()
+	metricSink, _, err = NewPrintSinks(&out, WithSampleRate(2))
+	require.NoError(t, err)
+	require.NoError(t, metricSink.Flush(context.Background(), testMetrics()))
+	require.NoError(t, metricSink.Flush(context.Background(), testMetrics()))
+	assert.Equal(t, 3, strings.Count(out.String(), "\n"))
+}
+
+func TestNewPrintSinks(t *testing.T) {
+	_, _, err := NewPrintSinks(&bytes.Buffer{}, WithFormat("xml"))
+	assert.Error(t, err)
+}
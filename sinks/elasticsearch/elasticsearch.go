@@ -0,0 +1,591 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/sinks/splunk"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+const (
+	// DefaultIndex is the template of the indices that spans are
+	// written to, by default: one a day.
+	DefaultIndex = "veneur-spans-{yyyy.MM.dd}"
+
+	// DefaultBatchSize is the most documents written in one bulk
+	// request, by default.
+	DefaultBatchSize = 500
+
+	// DefaultBatchBytes is the most bytes written in one bulk request,
+	// by default.
+	DefaultBatchBytes = 5 << 20
+
+	// DefaultBufferSize is how many spans are held between flushes, by
+	// default.
+	DefaultBufferSize = 1 << 14
+)
+
+const (
+	requestTimeout = 10 * time.Second
+
+	// maxAttempts bounds how many times a document is written, while
+	// Elasticsearch is throttling, or failing to take, it.
+	maxAttempts  = 3
+	retryBackoff = 250 * time.Millisecond
+)
+
+// The reasons that spans are dropped for, besides the errors that
+// Elasticsearch rejects them with.
+const (
+	reasonBufferFull       = "buffer_full"
+	reasonRetriesExhausted = "retries_exhausted"
+	reasonRequestFailed    = "request_failed"
+)
+
+// The date formats that index templates can have between braces, and
+// their layouts.
+var dateTokens = []struct{ token, layout string }{
+	{"yyyy", "2006"},
+	{"yy", "06"},
+	{"MM", "01"},
+	{"dd", "02"},
+	{"HH", "15"},
+}
+
+// Option configures an Elasticsearch span sink.
+type Option func(*options)
+
+type options struct {
+	index      string
+	username   string
+	password   string
+	apiKey     string
+	tlsConfig  *tls.Config
+	tlsErr     error
+	batchSize  int
+	batchBytes int
+	bufferSize int
+	sampleRate int
+}
+
+// WithIndex sets the template of the indices that spans are written to.
+// Its parts between braces are the date the span started, in UTC, in a
+// format of yyyy, yy, MM, dd and HH, e.g. "spans-{yyyy.MM.dd}" for an
+// index a day.
+func WithIndex(template string) Option {
+	return func(o *options) {
+		if template != "" {
+			o.index = template
+		}
+	}
+}
+
+// WithBasicAuth authenticates with a username and password.
+func WithBasicAuth(username, password string) Option {
+	return func(o *options) {
+		o.username, o.password = username, password
+	}
+}
+
+// WithAPIKey authenticates with an API key, encoded as Elasticsearch
+// returns it.
+func WithAPIKey(key string) Option {
+	return func(o *options) {
+		o.apiKey = key
+	}
+}
+
+// WithTLS sets the PEM-encoded certificates that the sink connects with:
+// the authority that the cluster's certificate is verified with, if not
+// the system's, and a client certificate and key. Any of them may be
+// empty.
+func WithTLS(authorityCert, cert, key string) Option {
+	return func(o *options) {
+		conf := &tls.Config{}
+		if authorityCert != "" {
+			conf.RootCAs = x509.NewCertPool()
+			if !conf.RootCAs.AppendCertsFromPEM([]byte(authorityCert)) {
+				o.tlsErr = errors.New("could not load any authority certificates")
+				return
+			}
+		}
+		if cert != "" || key != "" {
+			pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+			if err != nil {
+				o.tlsErr = err
+				return
+			}
+			conf.Certificates = []tls.Certificate{pair}
+		}
+		o.tlsConfig = conf
+	}
+}
+
+// WithBatchSize sets the most documents written in one bulk request.
+func WithBatchSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.batchSize = size
+		}
+	}
+}
+
+// WithBatchBytes sets the most bytes written in one bulk request.
+func WithBatchBytes(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.batchBytes = size
+		}
+	}
+}
+
+// WithBufferSize sets how many spans are held between flushes. Spans
+// past that are dropped.
+func WithBufferSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.bufferSize = size
+		}
+	}
+}
+
+// WithSampleRate samples 1 in every rate traces.
+func WithSampleRate(rate int) Option {
+	return func(o *options) {
+		o.sampleRate = rate
+	}
+}
+
+// document is a span, as it's indexed.
+type document struct {
+	Timestamp string `json:"@timestamp"`
+	Host      string `json:"host,omitempty"`
+	splunk.SerializedSSF
+}
+
+// bulkItem is a span, as the two lines of a bulk request that index
+// it.
+type bulkItem []byte
+
+// bulkResponse is the part of Elasticsearch's response to a bulk
+// request that says which documents it failed to index, and why.
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// SpanSink writes spans to Elasticsearch or OpenSearch, as documents,
+// with the bulk API.
+type SpanSink struct {
+	bulkURL    string
+	hostname   string
+	index      func(time.Time) string
+	opts       options
+	sampleRate int64
+
+	client *http.Client
+
+	mutex  sync.Mutex
+	buffer []bulkItem
+
+	skippedSpans     int64
+	userDroppedSpans int64
+	droppedSpans     int64
+
+	traceClient *trace.Client
+	log         *logrus.Logger
+}
+
+var _ sinks.SpanSink = &SpanSink{}
+
+// NewSpanSink creates a sink that writes spans to the cluster at
+// address, a URL, from a veneur on hostname.
+func NewSpanSink(address, hostname string, log *logrus.Logger, opts ...Option) (*SpanSink, error) {
+	o := options{
+		index:      DefaultIndex,
+		batchSize:  DefaultBatchSize,
+		batchBytes: DefaultBatchBytes,
+		bufferSize: DefaultBufferSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.tlsErr != nil {
+		return nil, o.tlsErr
+	}
+	if o.apiKey != "" && o.username != "" {
+		return nil, errors.New("elasticsearch takes either an API key or a username and password, not both")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("elasticsearch address %q is not a URL", address)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/_bulk"
+	index, err := parseIndex(o.index)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: o.tlsConfig,
+	}
+	return &SpanSink{
+		bulkURL:    u.String(),
+		hostname:   hostname,
+		index:      index,
+		opts:       o,
+		sampleRate: int64(o.sampleRate),
+		client:     &http.Client{Transport: transport, Timeout: requestTimeout},
+		log:        log,
+	}, nil
+}
+
+// parseIndex parses an index template into a function that returns the
+// index of a span that started at a time.
+func parseIndex(template string) (func(time.Time) string, error) {
+	// The template's parts alternate between literal text, and the
+	// layouts of dates:
+	var parts []string
+	rest := template
+	for {
+		open := strings.IndexByte(rest, '{')
+		literal := rest
+		if open >= 0 {
+			literal = rest[:open]
+		}
+		if strings.IndexByte(literal, '}') >= 0 {
+			return nil, fmt.Errorf("elasticsearch index %q has an unmatched }", template)
+		}
+		if literal != strings.ToLower(literal) {
+			return nil, fmt.Errorf("elasticsearch index %q must be lowercase", template)
+		}
+		parts = append(parts, literal)
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("elasticsearch index %q has an unmatched {", template)
+		}
+		layout, err := dateLayout(rest[open+1 : open+end])
+		if err != nil {
+			return nil, fmt.Errorf("elasticsearch index %q: %v", template, err)
+		}
+		parts = append(parts, layout)
+		rest = rest[open+end+1:]
+	}
+	if parts[0] == "" && len(parts) == 1 {
+		return nil, errors.New("elasticsearch index is empty")
+	}
+
+	return func(t time.Time) string {
+		t = t.UTC()
+		var b strings.Builder
+		for i, part := range parts {
+			if i%2 == 0 {
+				b.WriteString(part)
+			} else {
+				b.WriteString(t.Format(part))
+			}
+		}
+		return b.String()
+	}, nil
+}
+
+// dateLayout translates a date format of yyyy, yy, MM, dd and HH, with
+// any separators, into a time layout.
+func dateLayout(format string) (string, error) {
+	if format == "" {
+		return "", errors.New("empty date format")
+	}
+	var b strings.Builder
+	for format != "" {
+		matched := false
+		for _, t := range dateTokens {
+			if strings.HasPrefix(format, t.token) {
+				b.WriteString(t.layout)
+				format = format[len(t.token):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		switch c := format[0]; c {
+		case '.', '-', '_':
+			b.WriteByte(c)
+			format = format[1:]
+		default:
+			return "", fmt.Errorf("unknown date format %q", format)
+		}
+	}
+	return b.String(), nil
+}
+
+// Name returns the name of this sink.
+func (*SpanSink) Name() string {
+	return "elasticsearch"
+}
+
+// Start sets the sink up.
+func (s *SpanSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return nil
+}
+
+// SetSpanSampleRate replaces the rate that the sink samples traces at,
+// keeping 1 in every rate.
+func (s *SpanSink) SetSpanSampleRate(rate int) {
+	atomic.StoreInt64(&s.sampleRate, int64(rate))
+}
+
+// Ingest samples the span, and buffers it as a document for the next
+// flush.
+func (s *SpanSink) Ingest(span *ssf.SSFSpan) error {
+	if err := protocol.ValidateTrace(span); err != nil {
+		return err
+	}
+	if sinks.PriorityDropped(span) {
+		atomic.AddInt64(&s.userDroppedSpans, 1)
+		return nil
+	}
+	if !sinks.SampleTrace(span, atomic.LoadInt64(&s.sampleRate)) {
+		atomic.AddInt64(&s.skippedSpans, 1)
+		return nil
+	}
+
+	item, err := s.newItem(span)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.buffer) >= s.opts.bufferSize {
+		atomic.AddInt64(&s.droppedSpans, 1)
+		return nil
+	}
+	s.buffer = append(s.buffer, item)
+	return nil
+}
+
+// newItem renders a span as the lines of a bulk request that index it.
+func (s *SpanSink) newItem(span *ssf.SSFSpan) (bulkItem, error) {
+	start := time.Unix(0, span.StartTimestamp)
+	action := map[string]map[string]string{
+		"index": {"_index": s.index(start)},
+	}
+	doc := document{
+		Timestamp:     start.UTC().Format(time.RFC3339Nano),
+		Host:          s.hostname,
+		SerializedSSF: splunk.SerializeSSF(span),
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(action); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bulkItem(buf.Bytes()), nil
+}
+
+// Flush writes the buffered spans to Elasticsearch in bulk requests,
+// each bounded by the sink's batch size and bytes. Documents that
+// Elasticsearch throttles, or fails to take, are written again with
+// backoff, up to maxAttempts times; those it rejects, like for mapping
+// errors, are dropped.
+func (s *SpanSink) Flush() {
+	samples := &ssf.Samples{}
+	defer metrics.Report(s.traceClient, samples)
+	flushStart := time.Now()
+
+	s.mutex.Lock()
+	items := s.buffer
+	s.buffer = nil
+	s.mutex.Unlock()
+
+	flushed := 0
+	dropped := map[string]int{}
+	for attempt := 1; len(items) > 0; attempt++ {
+		var retry []bulkItem
+		for _, batch := range s.batches(items) {
+			ok, retryable, rejected := s.send(batch)
+			flushed += ok
+			retry = append(retry, retryable...)
+			for reason, n := range rejected {
+				dropped[reason] += n
+			}
+		}
+		items = retry
+		if len(items) == 0 {
+			break
+		}
+		if attempt == maxAttempts {
+			dropped[reasonRetriesExhausted] += len(items)
+			break
+		}
+		time.Sleep(retryBackoff << uint(attempt-1))
+	}
+
+	tags := map[string]string{"sink": s.Name()}
+	samples.Add(
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(flushed), tags),
+		ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(atomic.SwapInt64(&s.skippedSpans, 0)), tags),
+		ssf.Timing(sinks.MetricKeySpanFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+	)
+	dropped[reasonBufferFull] += int(atomic.SwapInt64(&s.droppedSpans, 0))
+	for reason, count := range dropped {
+		if count == 0 {
+			continue
+		}
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(count),
+			map[string]string{"sink": s.Name(), "reason": reason}))
+	}
+	if dropped := atomic.SwapInt64(&s.userDroppedSpans, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(dropped),
+			map[string]string{"sink": s.Name(), "reason": sinks.SkipReasonUserDrop}))
+	}
+}
+
+// batches splits items into batches of at most the sink's batch size,
+// and bytes. An item bigger than that is a batch of its own.
+func (s *SpanSink) batches(items []bulkItem) [][]bulkItem {
+	var batches [][]bulkItem
+	start, size := 0, 0
+	for i, item := range items {
+		if i > start && (i-start == s.opts.batchSize || size+len(item) > s.opts.batchBytes) {
+			batches = append(batches, items[start:i])
+			start, size = i, 0
+		}
+		size += len(item)
+	}
+	if start < len(items) {
+		batches = append(batches, items[start:])
+	}
+	return batches
+}
+
+// send writes a batch of items with one bulk request, and returns how
+// many Elasticsearch indexed, the items worth writing again, and how
+// many it rejected, by the type of its error.
+func (s *SpanSink) send(batch []bulkItem) (int, []bulkItem, map[string]int) {
+	var body bytes.Buffer
+	for _, item := range batch {
+		body.Write(item)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.bulkURL, &body)
+	if err != nil {
+		s.log.WithError(err).Error("Could not create a bulk request")
+		return 0, nil, map[string]int{reasonRequestFailed: len(batch)}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "veneur")
+	if s.opts.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.opts.apiKey)
+	} else if s.opts.username != "" {
+		req.SetBasicAuth(s.opts.username, s.opts.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.log.WithError(err).WithField("spans", len(batch)).Warn("Could not write spans to Elasticsearch")
+		return 0, batch, nil
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.log.WithError(err).WithField("spans", len(batch)).Warn("Could not read Elasticsearch's response")
+		return 0, batch, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		s.log.WithFields(logrus.Fields{
+			"status": resp.StatusCode,
+			"spans":  len(batch),
+		}).Warn("Elasticsearch failed to take spans, retrying")
+		return 0, batch, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		s.log.WithFields(logrus.Fields{
+			"status":   resp.StatusCode,
+			"response": string(respBody),
+			"spans":    len(batch),
+		}).Error("Elasticsearch rejected a bulk request")
+		return 0, nil, map[string]int{fmt.Sprintf("status_%d", resp.StatusCode): len(batch)}
+	}
+
+	var bulk bulkResponse
+	if err := json.Unmarshal(respBody, &bulk); err != nil {
+		s.log.WithError(err).Warn("Could not decode Elasticsearch's bulk response")
+		return len(batch), nil, nil
+	}
+	if !bulk.Errors {
+		return len(batch), nil, nil
+	}
+
+	indexed := 0
+	var retry []bulkItem
+	rejected := map[string]int{}
+	for i, item := range batch {
+		if i >= len(bulk.Items) {
+			// Items that Elasticsearch didn't report on can't be
+			// known to have been indexed:
+			retry = append(retry, item)
+			continue
+		}
+		var result bulkItemResult
+		for _, r := range bulk.Items[i] {
+			result = r
+		}
+		switch {
+		case result.Error == nil:
+			indexed++
+		case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+			retry = append(retry, item)
+		default:
+			rejected[result.Error.Type]++
+			s.log.WithFields(logrus.Fields{
+				"type":   result.Error.Type,
+				"reason": result.Error.Reason,
+			}).Debug("Elasticsearch rejected a span")
+		}
+	}
+	for reason, n := range rejected {
+		s.log.WithFields(logrus.Fields{
+			"type":  reason,
+			"spans": n,
+		}).Warn("Elasticsearch rejected spans")
+	}
+	return indexed, retry, rejected
+}
@@ -0,0 +1,180 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+// bulkRequest is a bulk request that the fake cluster received: the
+// index of each document, and the document.
+type bulkRequest struct {
+	auth    string
+	indices []string
+	docs    []map[string]interface{}
+}
+
+// cluster is a fake Elasticsearch, which responds to each bulk request
+// with the next of its responses, once they're used up by indexing every
+// document.
+func cluster(t *testing.T, requests chan<- bulkRequest, responses ...func(w http.ResponseWriter, req bulkRequest)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		req := bulkRequest{auth: r.Header.Get("Authorization")}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &action))
+			req.indices = append(req.indices, action["index"]["_index"])
+			require.True(t, scanner.Scan())
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+			req.docs = append(req.docs, doc)
+		}
+		requests <- req
+		if len(responses) == 0 {
+			fmt.Fprint(w, `{"took":1,"errors":false,"items":[]}`)
+			return
+		}
+		respond := responses[0]
+		responses = responses[1:]
+		respond(w, req)
+	}))
+}
+
+func testSpan(id int64) *ssf.SSFSpan {
+	start := time.Date(2020, 3, 4, 23, 59, 0, 0, time.UTC)
+	return &ssf.SSFSpan{
+		TraceId:        id,
+		Id:             id,
+		ParentId:       1,
+		StartTimestamp: start.UnixNano(),
+		EndTimestamp:   start.Add(time.Second).UnixNano(),
+		Name:           "farm.feed",
+		Service:        "farm",
+		Tags:           map[string]string{"animal": "cow"},
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	at := time.Date(2020, 3, 4, 5, 0, 0, 0, time.FixedZone("somewhere", 10*3600))
+	for template, index := range map[string]string{
+		"veneur-spans-{yyyy.MM.dd}": "veneur-spans-2020.03.03",
+		"spans-{yy-MM}-{dd_HH}":     "spans-20-03-03_19",
+		"spans":                     "spans",
+		"jan-2006-{yyyy}":           "jan-2006-2020",
+	} {
+		f, err := parseIndex(template)
+		require.NoError(t, err, template)
+		assert.Equal(t, index, f(at), template)
+	}
+	for _, template := range []string{"Spans-{yyyy}", "spans-{yyyy", "spans-}", "spans-{mm}", "spans-{}", ""} {
+		_, err := parseIndex(template)
+		assert.Error(t, err, template)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	requests := make(chan bulkRequest, 10)
+	srv := cluster(t, requests)
+	defer srv.Close()
+
+	sink, err := NewSpanSink(srv.URL, "veneur-1", logrus.New(), WithAPIKey("key"), WithBatchSize(2))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, sink.Ingest(testSpan(i)))
+	}
+	sink.Flush()
+
+	require.Len(t, requests, 2)
+	req := <-requests
+	assert.Equal(t, "ApiKey key", req.auth)
+	assert.Equal(t, []string{"veneur-spans-2020.03.04", "veneur-spans-2020.03.04"}, req.indices)
+	doc := req.docs[0]
+	assert.Equal(t, "2020-03-04T23:59:00Z", doc["@timestamp"])
+	assert.Equal(t, "veneur-1", doc["host"])
+	assert.Equal(t, "1", doc["id"])
+	assert.Equal(t, "farm.feed", doc["name"])
+	assert.Equal(t, map[string]interface{}{"animal": "cow"}, doc["tags"])
+	assert.Len(t, (<-requests).docs, 1)
+}
+
+func TestFlushItemFailures(t *testing.T) {
+	requests := make(chan bulkRequest, 10)
+	srv := cluster(t, requests,
+		func(w http.ResponseWriter, req bulkRequest) {
+			fmt.Fprint(w, `{"took":1,"errors":true,"items":[
+				{"index":{"status":201}},
+				{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}},
+				{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"bad tag"}}}
+			]}`)
+		},
+		func(w http.ResponseWriter, req bulkRequest) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	)
+	defer srv.Close()
+
+	sink, err := NewSpanSink(srv.URL, "", logrus.New(), WithBasicAuth("user", "pass"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, sink.Ingest(testSpan(i)))
+	}
+
+	items := sink.buffer
+	indexed, retry, rejected := sink.send(items)
+	assert.Equal(t, 1, indexed)
+	assert.Equal(t, []bulkItem{items[1]}, retry)
+	assert.Equal(t, map[string]int{"mapper_parsing_exception": 1}, rejected)
+	<-requests
+
+	// The throttled document is written again, until it's taken:
+	sink.buffer = retry
+	sink.Flush()
+	require.Len(t, requests, 2)
+	<-requests
+	req := <-requests
+	require.Len(t, req.docs, 1)
+	assert.Equal(t, "2", req.docs[0]["id"])
+	assert.Contains(t, req.auth, "Basic ")
+	assert.Empty(t, sink.buffer)
+}
+
+func TestSampling(t *testing.T) {
+	sink, err := NewSpanSink("http://localhost:9200", "", logrus.New(), WithSampleRate(2))
+	require.NoError(t, err)
+	for i := int64(1); i <= 4; i++ {
+		require.NoError(t, sink.Ingest(testSpan(i)))
+	}
+	assert.Len(t, sink.buffer, 2)
+
+	sink.SetSpanSampleRate(1)
+	require.NoError(t, sink.Ingest(testSpan(5)))
+	assert.Len(t, sink.buffer, 3)
+
+	dropped := testSpan(6)
+	dropped.SamplingPriority = ssf.SSFSpan_USER_DROP
+	require.NoError(t, sink.Ingest(dropped))
+	assert.Len(t, sink.buffer, 3)
+}
+
+func TestNewSpanSink(t *testing.T) {
+	_, err := NewSpanSink("localhost:9200", "", logrus.New())
+	assert.Error(t, err)
+	_, err = NewSpanSink("http://localhost:9200", "", logrus.New(), WithAPIKey("key"), WithBasicAuth("user", "pass"))
+	assert.Error(t, err)
+	_, err = NewSpanSink("http://localhost:9200", "", logrus.New(), WithTLS("not a certificate", "", ""))
+	assert.Error(t, err)
+}
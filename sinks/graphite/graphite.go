@@ -0,0 +1,412 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+const (
+	// DefaultBufferSize is how many lines are held for Graphite while
+	// it can't be written to, by default.
+	DefaultBufferSize = 100000
+
+	// DefaultWriteTimeout bounds connecting to Graphite and each write
+	// to it, by default.
+	DefaultWriteTimeout = 5 * time.Second
+)
+
+// The backoff between attempts to connect to Graphite, after a failure.
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// hostKey is the tag with the host of the metrics.
+const hostKey = "host"
+
+// nameSegment is the segment of a template that the name of the metric
+// goes into.
+const nameSegment = "{name}"
+
+// Option configures a Graphite sink.
+type Option func(*options)
+
+type options struct {
+	template     string
+	bufferSize   int
+	writeTimeout time.Duration
+}
+
+// WithTemplate writes metrics' tags as segments of their path, rather
+// than as Graphite tags. The template is the path, with the segments
+// "{name}" for the name of the metric and "{tag}" for the value of a
+// tag, e.g. "veneur.{env}.{host}.{name}". Segments of tags that a metric
+// doesn't have are left out, as are the tags that the template doesn't
+// name.
+func WithTemplate(template string) Option {
+	return func(o *options) {
+		o.template = template
+	}
+}
+
+// WithBufferSize sets how many lines are held while Graphite can't be
+// written to. Past that, the oldest are dropped.
+func WithBufferSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.bufferSize = size
+		}
+	}
+}
+
+// WithWriteTimeout bounds connecting to Graphite and each write to it.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.writeTimeout = timeout
+		}
+	}
+}
+
+// MetricSink writes metrics to Graphite (carbon) in its plaintext
+// protocol, over a persistent TCP connection.
+type MetricSink struct {
+	address      string
+	hostname     string
+	template     []string
+	bufferSize   int
+	writeTimeout time.Duration
+	excludedTags map[string]struct{}
+
+	// mtx guards the connection, and the lines waiting for it.
+	mtx      sync.Mutex
+	conn     net.Conn
+	pending  [][]byte
+	backoff  time.Duration
+	nextDial time.Time
+
+	traceClient *trace.Client
+	log         *logrus.Logger
+}
+
+var _ sinks.MetricSink = &MetricSink{}
+
+// NewMetricSink creates a sink that writes metrics to Graphite at the
+// host:port address, from a veneur on hostname.
+func NewMetricSink(address, hostname string, log *logrus.Logger, opts ...Option) (*MetricSink, error) {
+	o := options{
+		bufferSize:   DefaultBufferSize,
+		writeTimeout: DefaultWriteTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("graphite address: %v", err)
+	}
+	var template []string
+	if o.template != "" {
+		var err error
+		if template, err = parseTemplate(o.template); err != nil {
+			return nil, err
+		}
+	}
+	return &MetricSink{
+		address:      address,
+		hostname:     hostname,
+		template:     template,
+		bufferSize:   o.bufferSize,
+		writeTimeout: o.writeTimeout,
+		log:          log,
+	}, nil
+}
+
+// parseTemplate splits a template into its segments, sanitizing the
+// literal ones.
+func parseTemplate(template string) ([]string, error) {
+	segments := strings.Split(template, ".")
+	hasName := false
+	for i, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("graphite template %q has an empty segment", template)
+		}
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") && len(segment) > 2 {
+			hasName = hasName || segment == nameSegment
+			continue
+		}
+		if strings.ContainsAny(segment, "{}") {
+			return nil, fmt.Errorf("graphite template %q has a malformed segment %q", template, segment)
+		}
+		segments[i] = sanitizeSegment(segment)
+	}
+	if !hasName {
+		return nil, fmt.Errorf("graphite template %q has no %s segment", template, nameSegment)
+	}
+	return segments, nil
+}
+
+// Name returns the name of this sink.
+func (*MetricSink) Name() string {
+	return "graphite"
+}
+
+// Start sets the sink up. It connects to Graphite on the first flush.
+func (s *MetricSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (s *MetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	s.excludedTags = tagsSet
+}
+
+// FlushOtherSamples is a no-op; Graphite has no events or service
+// checks.
+func (s *MetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// Flush writes the metrics to Graphite, with the lines that earlier
+// flushes couldn't write, in one write. Lines that can't be written are
+// held for the next flush, up to the sink's buffer size.
+func (s *MetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, _ := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(s.traceClient)
+	flushStart := time.Now()
+
+	lines, skipped := s.lines(interMetrics)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.pending = append(s.pending, lines...)
+	written, err := s.write()
+	dropped := 0
+	if len(s.pending) > s.bufferSize {
+		dropped = len(s.pending) - s.bufferSize
+		s.pending = append([][]byte(nil), s.pending[dropped:]...)
+	}
+
+	tags := map[string]string{"sink": s.Name()}
+	span.Add(
+		ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(skipped), tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(written), tags),
+		ssf.Count("graphite.dropped_lines_total", float32(dropped), tags),
+		ssf.Gauge("graphite.buffered_lines", float32(len(s.pending)), tags),
+	)
+	if err != nil {
+		span.Error(err)
+		s.log.WithError(err).WithFields(logrus.Fields{
+			"buffered": len(s.pending),
+			"dropped":  dropped,
+		}).Warn("Could not write metrics to Graphite")
+		return err
+	}
+	span.Add(ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags))
+	s.log.WithField("metrics", written).Info("Completed flush to Graphite")
+	return nil
+}
+
+// write writes the pending lines to Graphite, connecting to it first if
+// the sink isn't connected and its backoff has passed, and returns how
+// many lines were written. Those are removed from the pending ones.
+func (s *MetricSink) write() (int, error) {
+	if len(s.pending) == 0 {
+		return 0, nil
+	}
+	if s.conn == nil {
+		if wait := time.Until(s.nextDial); wait > 0 {
+			return 0, fmt.Errorf("not connected to graphite, reconnecting in %v", wait)
+		}
+		conn, err := net.DialTimeout("tcp", s.address, s.writeTimeout)
+		if err != nil {
+			s.failed()
+			return 0, err
+		}
+		s.conn = conn
+	}
+
+	var buf bytes.Buffer
+	for _, line := range s.pending {
+		buf.Write(line)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	n, err := s.conn.Write(buf.Bytes())
+
+	// Only the lines that were written whole are done with; a line
+	// cut off by a failure is written again, on a new connection.
+	written := 0
+	for written < len(s.pending) && n >= len(s.pending[written]) {
+		n -= len(s.pending[written])
+		written++
+	}
+	s.pending = s.pending[written:]
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.failed()
+		return written, err
+	}
+	s.backoff = 0
+	return written, nil
+}
+
+// failed backs off from connecting to Graphite, twice as long as the
+// last time, up to maxBackoff.
+func (s *MetricSink) failed() {
+	s.backoff *= 2
+	if s.backoff < minBackoff {
+		s.backoff = minBackoff
+	}
+	if s.backoff > maxBackoff {
+		s.backoff = maxBackoff
+	}
+	s.nextDial = time.Now().Add(s.backoff)
+}
+
+// lines renders the metrics as lines of Graphite's plaintext protocol,
+// and returns them with the number of metrics that can't be written.
+func (s *MetricSink) lines(interMetrics []samplers.InterMetric) ([][]byte, int) {
+	lines := make([][]byte, 0, len(interMetrics))
+	skipped := 0
+	for _, im := range interMetrics {
+		if !sinks.IsAcceptableMetric(im, s) || im.Type == samplers.StatusMetric ||
+			math.IsNaN(im.Value) || math.IsInf(im.Value, 0) {
+			skipped++
+			continue
+		}
+		path := s.path(im)
+		if path == "" {
+			skipped++
+			continue
+		}
+		line := make([]byte, 0, len(path)+32)
+		line = append(line, path...)
+		line = append(line, ' ')
+		line = strconv.AppendFloat(line, im.Value, 'f', -1, 64)
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, im.Timestamp, 10)
+		line = append(line, '\n')
+		lines = append(lines, line)
+	}
+	return lines, skipped
+}
+
+// path returns the path of a metric: its name and tags, in Graphite's
+// tag syntax or in the sink's template.
+func (s *MetricSink) path(im samplers.InterMetric) string {
+	tags := make(map[string]string, len(im.Tags)+1)
+	for _, tag := range im.Tags {
+		k, v := tag, ""
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			k, v = tag[:i], tag[i+1:]
+		}
+		if _, excluded := s.excludedTags[k]; excluded {
+			continue
+		}
+		tags[k] = v
+	}
+	if _, ok := tags[hostKey]; !ok {
+		if host := im.HostName; host != "" {
+			tags[hostKey] = host
+		} else if s.hostname != "" {
+			tags[hostKey] = s.hostname
+		}
+	}
+
+	if s.template == nil {
+		return taggedPath(sanitizeName(im.Name), tags)
+	}
+	segments := make([]string, 0, len(s.template))
+	for _, segment := range s.template {
+		switch {
+		case segment == nameSegment:
+			if name := sanitizeName(im.Name); name != "" {
+				segments = append(segments, name)
+			}
+		case strings.HasPrefix(segment, "{"):
+			if v := sanitizeSegment(tags[segment[1:len(segment)-1]]); v != "" {
+				segments = append(segments, v)
+			}
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+// taggedPath returns a name with tags in Graphite's tag syntax,
+// name;k1=v1;k2=v2, sorted by key. Graphite tags need a value, so
+// tags without one are left out.
+func taggedPath(name string, tags map[string]string) string {
+	if name == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteByte(';')
+		b.WriteString(sanitize(k, true))
+		b.WriteByte('=')
+		b.WriteString(sanitize(tags[k], true))
+	}
+	return b.String()
+}
+
+// sanitizeName replaces the characters of a metric name that Graphite
+// can't take, or that its queries would read as something else, with
+// underscores, and removes empty segments.
+func sanitizeName(name string) string {
+	segments := strings.Split(sanitize(name, true), ".")
+	nonEmpty := segments[:0]
+	for _, segment := range segments {
+		if segment != "" {
+			nonEmpty = append(nonEmpty, segment)
+		}
+	}
+	return strings.Join(nonEmpty, ".")
+}
+
+// sanitizeSegment sanitizes one segment of a path, replacing dots too.
+func sanitizeSegment(segment string) string {
+	return sanitize(segment, false)
+}
+
+// sanitize replaces all but letters, digits, '-', '_' and ':' (and '.',
+// if dots is set) with underscores.
+func sanitize(s string, dots bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == ':':
+			return r
+		case r == '.' && dots:
+			return r
+		}
+		return '_'
+	}, s)
+}
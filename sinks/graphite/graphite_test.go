@@ -0,0 +1,139 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+// carbon is a fake Graphite, which sends the lines it reads on a
+// channel.
+func carbon(t *testing.T, lines chan<- string) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return lis
+}
+
+func TestLines(t *testing.T) {
+	sink, err := NewMetricSink("localhost:2003", "veneur-1", logrus.New())
+	require.NoError(t, err)
+	sink.SetExcludedTags([]string{"secret"})
+
+	lines, skipped := sink.lines([]samplers.InterMetric{
+		{Name: "requests", Timestamp: 1000, Value: 5, Tags: []string{"farm:sunny", "barn", "secret:moo"}, Type: samplers.CounterMetric},
+		{Name: "latency.99percentile", Timestamp: 1000, Value: 0.25, Type: samplers.GaugeMetric, HostName: "other"},
+		{Name: "weird name!..here", Timestamp: 1000, Value: 1, Tags: []string{"pa;th:a=b"}, Type: samplers.GaugeMetric},
+		{Name: "farm.ok", Timestamp: 1000, Type: samplers.StatusMetric},
+	})
+	assert.Equal(t, 1, skipped)
+	require.Len(t, lines, 3)
+	assert.Equal(t, "requests;farm=sunny;host=veneur-1 5 1000\n", string(lines[0]))
+	assert.Equal(t, "latency.99percentile;host=other 0.25 1000\n", string(lines[1]))
+	assert.Equal(t, "weird_name_.here;host=veneur-1;pa_th=a_b 1 1000\n", string(lines[2]))
+}
+
+func TestTemplate(t *testing.T) {
+	sink, err := NewMetricSink("localhost:2003", "veneur-1", logrus.New(),
+		WithTemplate("veneur.{env}.{host}.{name}"))
+	require.NoError(t, err)
+
+	lines, _ := sink.lines([]samplers.InterMetric{
+		{Name: "requests", Timestamp: 1000, Value: 5, Tags: []string{"env:prod", "farm:sunny"}, Type: samplers.CounterMetric},
+		{Name: "cows", Timestamp: 1000, Value: 12, Type: samplers.GaugeMetric, HostName: "farm.example.com"},
+	})
+	require.Len(t, lines, 2)
+	assert.Equal(t, "veneur.prod.veneur-1.requests 5 1000\n", string(lines[0]))
+	assert.Equal(t, "veneur.farm_example_com.cows 12 1000\n", string(lines[1]))
+
+	for _, template := range []string{"veneur.{env}", "veneur..{name}", "veneur.{env.{name}", "{name}.x}"} {
+		_, err := NewMetricSink("localhost:2003", "", logrus.New(), WithTemplate(template))
+		assert.Error(t, err, template)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	lines := make(chan string, 10)
+	lis := carbon(t, lines)
+	defer lis.Close()
+	sink, err := NewMetricSink(lis.Addr().String(), "", logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	metrics := []samplers.InterMetric{
+		{Name: "a", Timestamp: 1000, Value: 1, Type: samplers.GaugeMetric},
+		{Name: "b", Timestamp: 1000, Value: 2, Type: samplers.GaugeMetric},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	assert.Equal(t, "a 1 1000", <-lines)
+	assert.Equal(t, "b 2 1000", <-lines)
+
+	// The connection is kept:
+	conn := sink.conn
+	require.NoError(t, sink.Flush(context.Background(), metrics[:1]))
+	assert.Equal(t, "a 1 1000", <-lines)
+	assert.Equal(t, conn, sink.conn)
+}
+
+func TestFlushBuffers(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := lis.Addr().String()
+	lis.Close()
+
+	sink, err := NewMetricSink(address, "", logrus.New(), WithBufferSize(3))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	metrics := []samplers.InterMetric{
+		{Name: "a", Timestamp: 1000, Value: 1, Type: samplers.GaugeMetric},
+		{Name: "b", Timestamp: 1000, Value: 2, Type: samplers.GaugeMetric},
+	}
+	assert.Error(t, sink.Flush(context.Background(), metrics))
+	assert.Len(t, sink.pending, 2)
+	assert.Equal(t, minBackoff, sink.backoff)
+
+	// While backing off, the sink doesn't connect, and drops the
+	// oldest lines past its buffer:
+	metrics[0].Timestamp, metrics[1].Timestamp = 1010, 1010
+	err = sink.Flush(context.Background(), metrics)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "reconnecting")
+	require.Len(t, sink.pending, 3)
+	assert.Equal(t, "b 2 1000\n", string(sink.pending[0]))
+
+	// Once Graphite is back, the buffered lines are written first:
+	lines := make(chan string, 10)
+	lis = carbon(t, lines)
+	defer lis.Close()
+	sink.address = lis.Addr().String()
+	sink.nextDial = time.Time{}
+
+	require.NoError(t, sink.Flush(context.Background(), nil))
+	assert.Equal(t, "b 2 1000", <-lines)
+	assert.Equal(t, "a 1 1010", <-lines)
+	assert.Equal(t, "b 2 1010", <-lines)
+	assert.Empty(t, sink.pending)
+	assert.Equal(t, time.Duration(0), sink.backoff)
+}
@@ -103,7 +103,11 @@ func (gs *GRPCSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 		return err
 	}
 
-	ctx := metadata.AppendToOutgoingContext(ocontext.Background(), "x-veneur-trace-id", strconv.FormatInt(ssfSpan.TraceId, 16))
+	traceID := strconv.FormatInt(ssfSpan.TraceId, 16)
+	if ssfSpan.TraceIdHigh != 0 {
+		traceID = ssf.TraceIDHex(ssfSpan)
+	}
+	ctx := metadata.AppendToOutgoingContext(ocontext.Background(), "x-veneur-trace-id", traceID)
 	_, err := gs.ssc.SendSpan(ctx, ssfSpan)
 
 	if err != nil {
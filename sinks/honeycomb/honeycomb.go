@@ -0,0 +1,350 @@
+package honeycomb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// DefaultAPIHost is where spans are sent, unless another API host is
+// configured.
+const DefaultAPIHost = "https://api.honeycomb.io"
+
+const (
+	defaultBatchSize  = 100
+	defaultBufferSize = 1 << 14
+)
+
+// The fields of Honeycomb's trace events.
+const (
+	fieldTraceID    = "trace.trace_id"
+	fieldSpanID     = "trace.span_id"
+	fieldParentID   = "trace.parent_id"
+	fieldName       = "name"
+	fieldService    = "service_name"
+	fieldDurationMs = "duration_ms"
+	fieldError      = "error"
+	fieldIndicator  = "indicator"
+)
+
+// eventAccepted is the status of each event that Honeycomb took from a
+// batch.
+const eventAccepted = http.StatusAccepted
+
+// event is a span in the form of a Honeycomb event.
+type event struct {
+	Time       string                 `json:"time"`
+	SampleRate int64                  `json:"samplerate,omitempty"`
+	Data       map[string]interface{} `json:"data"`
+
+	// retried is set on events that are sent again after Honeycomb
+	// failed to take them; they aren't retried twice.
+	retried bool
+}
+
+// eventStatus is Honeycomb's response to one event of a batch.
+type eventStatus struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchError is the error for batches that Honeycomb rejected as a
+// whole.
+type batchError struct {
+	status int
+	body   string
+}
+
+func (err *batchError) Error() string {
+	return fmt.Sprintf("honeycomb responded with status %d: %s", err.status, err.body)
+}
+
+// retryable reports whether the events that failed with a status are
+// worth sending again. A status of 0 stands for the batch not reaching
+// Honeycomb at all.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// HoneycombSpanSink is a sink that sends spans to a Honeycomb dataset,
+// through its batch API.
+type HoneycombSpanSink struct {
+	HTTPClient *http.Client
+
+	endpoint   string
+	apiKey     string
+	batchSize  int
+	bufferSize int
+	sampleRate int64
+
+	mutex  sync.Mutex
+	buffer []*event
+
+	skippedSpans      int64
+	userDroppedSpans  int64
+	droppedSpans      int64
+	droppedSpanEvents int64
+	traceClient       *trace.Client
+	log               *logrus.Logger
+}
+
+// NewHoneycombSpanSink creates a sink that sends spans to a dataset on
+// Honeycomb's API host (DefaultAPIHost, if it's empty), authenticated
+// by the team's API key. Spans are buffered, up to bufferSize, and sent
+// on flush in batches of batchSize. The sink samples 1 in every
+// sampleRate traces, and sets the samplerate of the events it sends to
+// match.
+func NewHoneycombSpanSink(apiHost, apiKey, dataset string, batchSize, bufferSize, sampleRate int, httpClient *http.Client, log *logrus.Logger) (*HoneycombSpanSink, error) {
+	if apiKey == "" || dataset == "" {
+		return nil, fmt.Errorf("honeycomb needs both an API key and a dataset")
+	}
+	if apiHost == "" {
+		apiHost = DefaultAPIHost
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	return &HoneycombSpanSink{
+		HTTPClient: httpClient,
+		endpoint:   strings.TrimSuffix(apiHost, "/") + "/1/batch/" + url.PathEscape(dataset),
+		apiKey:     apiKey,
+		batchSize:  batchSize,
+		bufferSize: bufferSize,
+		sampleRate: int64(sampleRate),
+		log:        log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (*HoneycombSpanSink) Name() string {
+	return "honeycomb"
+}
+
+// Start performs final adjustments on the sink.
+func (hs *HoneycombSpanSink) Start(cl *trace.Client) error {
+	hs.traceClient = cl
+	return nil
+}
+
+// SetSpanSampleRate replaces the rate that the sink samples traces at,
+// keeping 1 in every rate.
+func (hs *HoneycombSpanSink) SetSpanSampleRate(rate int) {
+	atomic.StoreInt64(&hs.sampleRate, int64(rate))
+}
+
+// Ingest samples the span, and buffers it as an event for the next
+// flush.
+func (hs *HoneycombSpanSink) Ingest(span *ssf.SSFSpan) error {
+	if err := protocol.ValidateTrace(span); err != nil {
+		return err
+	}
+	if sinks.PriorityDropped(span) {
+		atomic.AddInt64(&hs.userDroppedSpans, 1)
+		return nil
+	}
+	sampleRate := atomic.LoadInt64(&hs.sampleRate)
+	if !sinks.SampleTrace(span, sampleRate) {
+		atomic.AddInt64(&hs.skippedSpans, 1)
+		return nil
+	}
+	// Honeycomb's events have nowhere to put span events:
+	atomic.AddInt64(&hs.droppedSpanEvents, int64(len(span.Events)))
+
+	ev := newEvent(span, sampleRate)
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if len(hs.buffer) >= hs.bufferSize {
+		atomic.AddInt64(&hs.droppedSpans, 1)
+		return nil
+	}
+	hs.buffer = append(hs.buffer, ev)
+	return nil
+}
+
+// newEvent converts a span into an event. Its tags become fields of
+// the event, unless they collide with the fields that describe the span
+// itself.
+func newEvent(span *ssf.SSFSpan, sampleRate int64) *event {
+	data := make(map[string]interface{}, len(span.Tags)+8)
+	for k, v := range span.Tags {
+		data[k] = v
+	}
+	data[fieldTraceID] = ssf.TraceIDString(span)
+	data[fieldSpanID] = strconv.FormatInt(span.Id, 10)
+	if span.ParentId > 0 {
+		data[fieldParentID] = strconv.FormatInt(span.ParentId, 10)
+	}
+	data[fieldName] = span.Name
+	data[fieldService] = span.Service
+	data[fieldDurationMs] = float64(span.EndTimestamp-span.StartTimestamp) / float64(time.Millisecond)
+	if span.Error {
+		data[fieldError] = true
+	}
+	if span.Indicator {
+		data[fieldIndicator] = true
+	}
+
+	ev := &event{
+		Time: time.Unix(0, span.StartTimestamp).UTC().Format(time.RFC3339Nano),
+		Data: data,
+	}
+	// Spans that are kept regardless of the sample rate only stand
+	// for themselves:
+	if sampleRate > 1 && !span.Indicator && !sinks.PriorityKept(span) {
+		ev.SampleRate = sampleRate
+	}
+	return ev
+}
+
+// Flush sends the buffered events to Honeycomb in batches. The events
+// that Honeycomb fails to take for reasons that may pass, like rate
+// limiting or server errors, are buffered again for the next flush;
+// the others are dropped.
+func (hs *HoneycombSpanSink) Flush() {
+	samples := &ssf.Samples{}
+	defer metrics.Report(hs.traceClient, samples)
+	flushStart := time.Now()
+
+	hs.mutex.Lock()
+	events := hs.buffer
+	hs.buffer = nil
+	hs.mutex.Unlock()
+
+	flushed := 0
+	rejected := map[int]int{}
+	var retry []*event
+	fail := func(ev *event, status int) {
+		if !ev.retried && retryable(status) {
+			ev.retried = true
+			retry = append(retry, ev)
+			return
+		}
+		rejected[status]++
+	}
+	for len(events) > 0 {
+		n := hs.batchSize
+		if n > len(events) {
+			n = len(events)
+		}
+		batch := events[:n]
+		events = events[n:]
+
+		statuses, err := hs.send(batch)
+		if err != nil {
+			status := 0
+			if berr, ok := err.(*batchError); ok {
+				status = berr.status
+			}
+			hs.log.WithError(err).WithField("events", len(batch)).Warn("Error flushing spans to Honeycomb")
+			for _, ev := range batch {
+				fail(ev, status)
+			}
+			continue
+		}
+		var firstError string
+		for i, ev := range batch {
+			// Events that Honeycomb didn't report on can't be
+			// known to have arrived:
+			status := 0
+			if i < len(statuses) {
+				status = statuses[i].Status
+			}
+			if status == eventAccepted {
+				flushed++
+				continue
+			}
+			if firstError == "" && i < len(statuses) {
+				firstError = statuses[i].Error
+			}
+			fail(ev, status)
+		}
+		if firstError != "" {
+			hs.log.WithField("error", firstError).Warn("Honeycomb failed to take some events")
+		}
+	}
+	hs.requeue(retry)
+
+	tags := map[string]string{"sink": hs.Name()}
+	samples.Add(
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(flushed), tags),
+		ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(atomic.SwapInt64(&hs.skippedSpans, 0)), tags),
+		ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(atomic.SwapInt64(&hs.droppedSpans, 0)), tags),
+		ssf.Timing(sinks.MetricKeySpanFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+	)
+	for status, count := range rejected {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(count),
+			map[string]string{"sink": hs.Name(), "status_code": strconv.Itoa(status)}))
+	}
+	if dropped := atomic.SwapInt64(&hs.userDroppedSpans, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(dropped),
+			map[string]string{"sink": hs.Name(), "reason": sinks.SkipReasonUserDrop}))
+	}
+	if dropped := atomic.SwapInt64(&hs.droppedSpanEvents, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpanEventsDropped, float32(dropped), tags))
+	}
+}
+
+// send posts a batch of events to Honeycomb, and returns its response
+// to each of them, in order.
+func (hs *HoneycombSpanSink) send(batch []*event) ([]eventStatus, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, hs.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Honeycomb-Team", hs.apiKey)
+
+	resp, err := hs.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &batchError{status: resp.StatusCode, body: string(respBody)}
+	}
+	var statuses []eventStatus
+	if err := json.Unmarshal(respBody, &statuses); err != nil {
+		return nil, fmt.Errorf("decoding honeycomb's response: %v", err)
+	}
+	return statuses, nil
+}
+
+// requeue buffers events again for the next flush, dropping those that
+// don't fit.
+func (hs *HoneycombSpanSink) requeue(events []*event) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	for _, ev := range events {
+		if len(hs.buffer) >= hs.bufferSize {
+			atomic.AddInt64(&hs.droppedSpans, 1)
+			continue
+		}
+		hs.buffer = append(hs.buffer, ev)
+	}
+}
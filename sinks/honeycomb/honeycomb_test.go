@@ -0,0 +1,120 @@
+package honeycomb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+// batchEndpoint is a fake Honeycomb batch API, which responds to each
+// event with the status that respond returns for it.
+func batchEndpoint(t *testing.T, batches chan<- []*event, respond func(*event) eventStatus) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/1/batch/spans", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-Honeycomb-Team"))
+		var batch []*event
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		statuses := make([]eventStatus, len(batch))
+		for i, ev := range batch {
+			statuses[i] = respond(ev)
+		}
+		json.NewEncoder(w).Encode(statuses)
+		batches <- batch
+	}))
+}
+
+func testSpan(id int64, tags map[string]string) *ssf.SSFSpan {
+	start := time.Unix(1500000000, 0)
+	return &ssf.SSFSpan{
+		Id:             id,
+		TraceId:        id,
+		ParentId:       1,
+		Name:           "lookup",
+		Service:        "farms",
+		StartTimestamp: start.UnixNano(),
+		EndTimestamp:   start.Add(1500 * time.Microsecond).UnixNano(),
+		Tags:           tags,
+	}
+}
+
+func TestHoneycombFlushSpans(t *testing.T) {
+	batches := make(chan []*event, 10)
+	srv := batchEndpoint(t, batches, func(*event) eventStatus {
+		return eventStatus{Status: eventAccepted}
+	})
+	defer srv.Close()
+
+	sink, err := NewHoneycombSpanSink(srv.URL, "secret", "spans", 2, 0, 2, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	kept := testSpan(2, map[string]string{"farm": "sunny", "name": "overridden"})
+	require.NoError(t, sink.Ingest(kept))
+	require.NoError(t, sink.Ingest(testSpan(3, nil)), "sampled out")
+	priority := testSpan(5, nil)
+	priority.SamplingPriority = ssf.SSFSpan_USER_KEEP
+	require.NoError(t, sink.Ingest(priority))
+	dropped := testSpan(4, nil)
+	dropped.SamplingPriority = ssf.SSFSpan_USER_DROP
+	require.NoError(t, sink.Ingest(dropped))
+	assert.Error(t, sink.Ingest(&ssf.SSFSpan{}))
+
+	sink.Flush()
+	batch := <-batches
+	require.Len(t, batch, 2)
+	assert.Equal(t, "2017-07-14T02:40:00Z", batch[0].Time)
+	assert.Equal(t, int64(2), batch[0].SampleRate)
+	assert.Equal(t, map[string]interface{}{
+		"trace.trace_id":  "2",
+		"trace.span_id":   "2",
+		"trace.parent_id": "1",
+		"name":            "lookup",
+		"service_name":    "farms",
+		"duration_ms":     1.5,
+		"farm":            "sunny",
+	}, batch[0].Data)
+	assert.Equal(t, int64(0), batch[1].SampleRate, "kept regardless of the sample rate")
+	assert.Equal(t, "5", batch[1].Data["trace.span_id"])
+	assert.Empty(t, batches)
+}
+
+func TestHoneycombPartialFailure(t *testing.T) {
+	batches := make(chan []*event, 10)
+	srv := batchEndpoint(t, batches, func(ev *event) eventStatus {
+		switch ev.Data["trace.span_id"] {
+		case "2":
+			return eventStatus{Status: http.StatusTooManyRequests, Error: "slow down"}
+		case "3":
+			return eventStatus{Status: http.StatusBadRequest, Error: "bad event"}
+		}
+		return eventStatus{Status: eventAccepted}
+	})
+	defer srv.Close()
+
+	sink, err := NewHoneycombSpanSink(srv.URL+"/", "secret", "spans", 0, 0, 1, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	for id := int64(1); id <= 3; id++ {
+		require.NoError(t, sink.Ingest(testSpan(id, nil)))
+	}
+
+	sink.Flush()
+	assert.Len(t, <-batches, 3)
+	// Only the rate-limited event is sent again, and only once:
+	sink.Flush()
+	retried := <-batches
+	require.Len(t, retried, 1)
+	assert.Equal(t, "2", retried[0].Data["trace.span_id"])
+	sink.Flush()
+	assert.Empty(t, batches)
+}
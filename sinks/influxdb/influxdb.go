@@ -0,0 +1,434 @@
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+const (
+	// DefaultBatchSize is the most lines written in one request, by
+	// default.
+	DefaultBatchSize = 5000
+
+	// DefaultMaxPayloadBytes is the most bytes of lines, before they're
+	// compressed, written in one request, by default.
+	DefaultMaxPayloadBytes = 5 << 20
+)
+
+// The paths of the write endpoints of InfluxDB 2.x, and of 1.x (which
+// 2.x serves too, for compatibility).
+const (
+	writePathV2 = "/api/v2/write"
+	writePathV1 = "/write"
+)
+
+// hostKey is the tag with the host of the metrics.
+const hostKey = "host"
+
+// The fields that metrics' values are written to, by their type.
+const (
+	fieldCount  = "count"
+	fieldValue  = "value"
+	fieldStatus = "status"
+)
+
+// Option configures an InfluxDB sink.
+type Option func(*options)
+
+type options struct {
+	org, bucket, token        string
+	database, retentionPolicy string
+	username, password        string
+	batchSize                 int
+	maxPayloadBytes           int
+}
+
+// WithV2 writes to a bucket of an org of InfluxDB 2.x, with an API
+// token.
+func WithV2(org, bucket, token string) Option {
+	return func(o *options) {
+		o.org, o.bucket, o.token = org, bucket, token
+	}
+}
+
+// WithV1 writes to a database and retention policy (the database's
+// default, if empty) of InfluxDB 1.x, or through the 1.x compatibility
+// API of 2.x. The username and password may be empty, if InfluxDB
+// doesn't authenticate.
+func WithV1(database, retentionPolicy, username, password string) Option {
+	return func(o *options) {
+		o.database, o.retentionPolicy = database, retentionPolicy
+		o.username, o.password = username, password
+	}
+}
+
+// WithBatchSize sets the most lines written in one request.
+func WithBatchSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.batchSize = size
+		}
+	}
+}
+
+// WithMaxPayloadBytes sets the most bytes of lines, before they're
+// compressed, written in one request.
+func WithMaxPayloadBytes(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.maxPayloadBytes = size
+		}
+	}
+}
+
+// MetricSink writes metrics to InfluxDB, in its line protocol.
+type MetricSink struct {
+	writeURL string
+	hostname string
+	opts     options
+
+	client       *http.Client
+	excludedTags map[string]struct{}
+
+	traceClient *trace.Client
+	log         *logrus.Logger
+}
+
+var _ sinks.MetricSink = &MetricSink{}
+
+// NewMetricSink creates a sink that writes metrics to the InfluxDB at
+// address, a URL, from a veneur on hostname. Either WithV2 or WithV1
+// says where to.
+func NewMetricSink(address, hostname string, client *http.Client, log *logrus.Logger, opts ...Option) (*MetricSink, error) {
+	o := options{
+		batchSize:       DefaultBatchSize,
+		maxPayloadBytes: DefaultMaxPayloadBytes,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("influxdb address %q is not a URL", address)
+	}
+	query := url.Values{"precision": {"ns"}}
+	switch {
+	case o.bucket != "" && o.database != "":
+		return nil, errors.New("influxdb needs either a bucket (2.x) or a database (1.x), not both")
+	case o.bucket != "":
+		if o.org == "" {
+			return nil, errors.New("influxdb needs an org for its bucket")
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + writePathV2
+		query.Set("org", o.org)
+		query.Set("bucket", o.bucket)
+	case o.database != "":
+		u.Path = strings.TrimSuffix(u.Path, "/") + writePathV1
+		query.Set("db", o.database)
+		if o.retentionPolicy != "" {
+			query.Set("rp", o.retentionPolicy)
+		}
+	default:
+		return nil, errors.New("influxdb needs a bucket (2.x) or a database (1.x)")
+	}
+	u.RawQuery = query.Encode()
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &MetricSink{
+		writeURL: u.String(),
+		hostname: hostname,
+		opts:     o,
+		client:   client,
+		log:      log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (*MetricSink) Name() string {
+	return "influxdb"
+}
+
+// Start sets the sink up.
+func (s *MetricSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (s *MetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	s.excludedTags = tagsSet
+}
+
+// FlushOtherSamples is a no-op; events and service checks aren't
+// metrics.
+func (s *MetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// Flush writes the metrics to InfluxDB in batches, each bounded by the
+// sink's batch size and payload bytes. Lines that InfluxDB rejects are
+// logged and counted, without failing the flush.
+func (s *MetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, subCtx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(s.traceClient)
+	flushStart := time.Now()
+
+	lines, skipped := s.lines(interMetrics)
+	tags := map[string]string{"sink": s.Name()}
+	span.Add(ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(skipped), tags))
+
+	flushed, rejected := 0, 0
+	defer func() {
+		span.Add(
+			ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(flushed), tags),
+			ssf.Count("influxdb.rejected_lines_total", float32(rejected), tags),
+		)
+	}()
+	for _, batch := range s.batches(lines) {
+		batchRejected, err := s.write(subCtx, batch)
+		if err != nil {
+			span.Error(err)
+			s.log.WithError(err).WithField("metrics", len(lines)-flushed-rejected).Warn("Could not write metrics to InfluxDB")
+			return err
+		}
+		rejected += batchRejected
+		flushed += len(batch) - batchRejected
+	}
+
+	span.Add(ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags))
+	s.log.WithFields(logrus.Fields{
+		"metrics":  flushed,
+		"rejected": rejected,
+	}).Info("Completed flush to InfluxDB")
+	return nil
+}
+
+// batches splits lines into batches of at most the sink's batch size,
+// and payload bytes. A line longer than that is a batch of its own.
+func (s *MetricSink) batches(lines [][]byte) [][][]byte {
+	var batches [][][]byte
+	start, size := 0, 0
+	for i, line := range lines {
+		if i > start && (i-start == s.opts.batchSize || size+len(line) > s.opts.maxPayloadBytes) {
+			batches = append(batches, lines[start:i])
+			start, size = i, 0
+		}
+		size += len(line)
+	}
+	if start < len(lines) {
+		batches = append(batches, lines[start:])
+	}
+	return batches
+}
+
+// lineNumberRegexp finds the (1-based) numbers of the lines that
+// InfluxDB couldn't write, in its errors.
+var lineNumberRegexp = regexp.MustCompile(`line (\d+)`)
+
+// droppedRegexp finds how many points InfluxDB dropped, in the errors
+// of partial writes that don't say which.
+var droppedRegexp = regexp.MustCompile(`dropped=(\d+)`)
+
+// write writes a batch of lines to InfluxDB, gzip-compressed. If
+// InfluxDB rejects some (or all) of them, with a 400, the rejected
+// lines are logged, and their number returned, rather than an error.
+func (s *MetricSink) write(ctx context.Context, batch [][]byte) (int, error) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for _, line := range batch {
+		gz.Write(line)
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, &body)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", "veneur")
+	if s.opts.token != "" {
+		req.Header.Set("Authorization", "Token "+s.opts.token)
+	} else if s.opts.username != "" {
+		req.SetBasicAuth(s.opts.username, s.opts.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 == 2 {
+		return 0, nil
+	}
+	msg := errorMessage(respBody)
+	if resp.StatusCode != http.StatusBadRequest {
+		return 0, fmt.Errorf("influxdb returned %d: %s", resp.StatusCode, msg)
+	}
+
+	// InfluxDB writes the lines it can, and says which it couldn't:
+	rejected := 0
+	seen := map[int]bool{}
+	for _, match := range lineNumberRegexp.FindAllStringSubmatch(msg, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n < 1 || n > len(batch) || seen[n] {
+			continue
+		}
+		seen[n] = true
+		rejected++
+		s.log.WithFields(logrus.Fields{
+			"line":  strings.TrimSuffix(string(batch[n-1]), "\n"),
+			"error": msg,
+		}).Warn("InfluxDB rejected a line")
+	}
+	if rejected == 0 {
+		rejected = len(batch)
+		if match := droppedRegexp.FindStringSubmatch(msg); match != nil {
+			if n, err := strconv.Atoi(match[1]); err == nil && n <= len(batch) {
+				rejected = n
+			}
+		}
+		s.log.WithFields(logrus.Fields{
+			"lines": rejected,
+			"error": msg,
+		}).Warn("InfluxDB rejected lines")
+	}
+	return rejected, nil
+}
+
+// errorMessage returns the message of an InfluxDB error: the "message"
+// of 2.x's, the "error" of 1.x's, or the body as it is.
+func errorMessage(body []byte) string {
+	var resp struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err == nil {
+		if resp.Message != "" {
+			return resp.Message
+		}
+		if resp.Error != "" {
+			return resp.Error
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// lines renders the metrics as lines of InfluxDB's line protocol, and
+// returns them with the number of metrics that can't be written. The
+// name of a metric is its measurement, and its tags are tags. Its value
+// is the field "count" of counters, "value" of gauges, and "status" (an
+// integer) of service checks.
+func (s *MetricSink) lines(interMetrics []samplers.InterMetric) ([][]byte, int) {
+	lines := make([][]byte, 0, len(interMetrics))
+	skipped := 0
+	for _, im := range interMetrics {
+		if !sinks.IsAcceptableMetric(im, s) || im.Name == "" ||
+			math.IsNaN(im.Value) || math.IsInf(im.Value, 0) {
+			skipped++
+			continue
+		}
+		line := make([]byte, 0, len(im.Name)+64)
+		line = append(line, measurementEscaper.Replace(im.Name)...)
+		for _, tag := range s.tags(im) {
+			line = append(line, ',')
+			line = append(line, tagEscaper.Replace(tag[0])...)
+			line = append(line, '=')
+			line = append(line, tagEscaper.Replace(tag[1])...)
+		}
+		line = append(line, ' ')
+		switch im.Type {
+		case samplers.CounterMetric:
+			line = append(line, fieldCount+"="...)
+			line = strconv.AppendFloat(line, im.Value, 'f', -1, 64)
+		case samplers.GaugeMetric:
+			line = append(line, fieldValue+"="...)
+			line = strconv.AppendFloat(line, im.Value, 'f', -1, 64)
+		case samplers.StatusMetric:
+			line = append(line, fieldStatus+"="...)
+			line = strconv.AppendInt(line, int64(im.Value), 10)
+			line = append(line, 'i')
+		default:
+			skipped++
+			continue
+		}
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, im.Timestamp*int64(time.Second), 10)
+		line = append(line, '\n')
+		lines = append(lines, line)
+	}
+	return lines, skipped
+}
+
+// tags returns the tags of a metric as keys and values, sorted by key,
+// as InfluxDB prefers. Metrics have a host tag, with the host they came
+// from or, if they didn't keep it, this veneur's. Tags without a value
+// are left out, as InfluxDB doesn't take them.
+func (s *MetricSink) tags(im samplers.InterMetric) [][2]string {
+	tags := make(map[string]string, len(im.Tags)+1)
+	for _, tag := range im.Tags {
+		k, v := tag, ""
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			k, v = tag[:i], tag[i+1:]
+		}
+		if _, excluded := s.excludedTags[k]; excluded || k == "" || v == "" {
+			continue
+		}
+		tags[k] = v
+	}
+	if _, ok := tags[hostKey]; !ok {
+		if im.HostName != "" {
+			tags[hostKey] = im.HostName
+		} else if s.hostname != "" {
+			tags[hostKey] = s.hostname
+		}
+	}
+
+	sorted := make([][2]string, 0, len(tags))
+	for k, v := range tags {
+		sorted = append(sorted, [2]string{k, v})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+	return sorted
+}
+
+// The escaping of the line protocol: measurements escape commas and
+// spaces, and tag keys and values equals signs too. Newlines can't be
+// escaped, so they become spaces, escaped.
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\ `)
+	tagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\ `)
+)
@@ -0,0 +1,165 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+// write is a request that the fake InfluxDB received.
+type write struct {
+	path, query, auth string
+	lines             []string
+}
+
+// influxDB is a fake InfluxDB, which responds to each write with the
+// next of its responses, once they're used up with 204.
+func influxDB(t *testing.T, writes chan<- write, responses ...func(w http.ResponseWriter)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+		writes <- write{
+			path:  r.URL.Path,
+			query: r.URL.RawQuery,
+			auth:  r.Header.Get("Authorization"),
+			lines: strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"),
+		}
+		if len(responses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		respond := responses[0]
+		responses = responses[1:]
+		respond(w)
+	}))
+}
+
+func TestLines(t *testing.T) {
+	sink, err := NewMetricSink("http://localhost:8086", "veneur-1", nil, logrus.New(), WithV2("farm", "metrics", "token"))
+	require.NoError(t, err)
+	sink.SetExcludedTags([]string{"secret"})
+
+	lines, skipped := sink.lines([]samplers.InterMetric{
+		{Name: "requests", Timestamp: 1000, Value: 5, Tags: []string{"farm:sunny", "barn", "secret:moo"}, Type: samplers.CounterMetric},
+		{Name: "latency.99percentile", Timestamp: 1000, Value: 0.25, Type: samplers.GaugeMetric, HostName: "other"},
+		{Name: "farm.ok", Timestamp: 1000, Value: 2, Type: samplers.StatusMetric},
+		{Name: "odd name,here", Timestamp: 1000, Value: 1, Tags: []string{"a b:c=d,e"}, Type: samplers.GaugeMetric},
+	})
+	assert.Equal(t, 0, skipped)
+	require.Len(t, lines, 4)
+	assert.Equal(t, "requests,farm=sunny,host=veneur-1 count=5 1000000000000\n", string(lines[0]))
+	assert.Equal(t, "latency.99percentile,host=other value=0.25 1000000000000\n", string(lines[1]))
+	assert.Equal(t, "farm.ok,host=veneur-1 status=2i 1000000000000\n", string(lines[2]))
+	assert.Equal(t, `odd\ name\,here,a\ b=c\=d\,e,host=veneur-1 value=1 1000000000000`+"\n", string(lines[3]))
+}
+
+func TestNewMetricSink(t *testing.T) {
+	sink, err := NewMetricSink("http://localhost:8086/", "", nil, logrus.New(), WithV2("farm", "metrics", "token"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8086/api/v2/write?bucket=metrics&org=farm&precision=ns", sink.writeURL)
+
+	sink, err = NewMetricSink("http://localhost:8086", "", nil, logrus.New(), WithV1("metrics", "autogen", "", ""))
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8086/write?db=metrics&precision=ns&rp=autogen", sink.writeURL)
+
+	_, err = NewMetricSink("http://localhost:8086", "", nil, logrus.New())
+	assert.Error(t, err)
+	_, err = NewMetricSink("http://localhost:8086", "", nil, logrus.New(), WithV2("", "metrics", "token"))
+	assert.Error(t, err)
+	_, err = NewMetricSink("http://localhost:8086", "", nil, logrus.New(),
+		WithV2("farm", "metrics", "token"), WithV1("metrics", "", "", ""))
+	assert.Error(t, err)
+	_, err = NewMetricSink("localhost:8086", "", nil, logrus.New(), WithV1("metrics", "", "", ""))
+	assert.Error(t, err)
+}
+
+func gauges(n int) []samplers.InterMetric {
+	metrics := make([]samplers.InterMetric, n)
+	for i := range metrics {
+		metrics[i] = samplers.InterMetric{Name: fmt.Sprintf("m%d", i), Timestamp: 1, Value: 1, Type: samplers.GaugeMetric}
+	}
+	return metrics
+}
+
+func TestFlushBatches(t *testing.T) {
+	writes := make(chan write, 10)
+	srv := influxDB(t, writes)
+	defer srv.Close()
+
+	sink, err := NewMetricSink(srv.URL, "", nil, logrus.New(), WithV2("farm", "metrics", "token"), WithBatchSize(3))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	require.NoError(t, sink.Flush(context.Background(), gauges(7)))
+	require.Len(t, writes, 3)
+	w := <-writes
+	assert.Equal(t, "/api/v2/write", w.path)
+	assert.Equal(t, "Token token", w.auth)
+	assert.Equal(t, []string{"m0 value=1 1000000000", "m1 value=1 1000000000", "m2 value=1 1000000000"}, w.lines)
+	assert.Len(t, (<-writes).lines, 3)
+	assert.Len(t, (<-writes).lines, 1)
+
+	// Each line is 22 bytes:
+	sink, err = NewMetricSink(srv.URL, "", nil, logrus.New(), WithV1("metrics", "", "user", "pass"), WithMaxPayloadBytes(50))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	require.NoError(t, sink.Flush(context.Background(), gauges(5)))
+	require.Len(t, writes, 3)
+	w = <-writes
+	assert.Equal(t, "/write", w.path)
+	assert.True(t, strings.HasPrefix(w.auth, "Basic "))
+	assert.Len(t, w.lines, 2)
+}
+
+func TestFlushPartialWrite(t *testing.T) {
+	writes := make(chan write, 10)
+	srv := influxDB(t, writes,
+		func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"code":"invalid","message":"failed to parse line protocol:\nerrors encountered on line(s):\nline 2: field type conflict\nline 3: field type conflict"}`)
+		},
+		func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"partial write: field type conflict dropped=1"}`)
+		},
+		func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"code":"unavailable","message":"no thanks"}`)
+		},
+	)
+	defer srv.Close()
+
+	sink, err := NewMetricSink(srv.URL, "", nil, logrus.New(), WithV2("farm", "metrics", "token"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	rejected, err := sink.write(context.Background(), mustLines(sink, gauges(4)))
+	require.NoError(t, err)
+	assert.Equal(t, 2, rejected)
+
+	rejected, err = sink.write(context.Background(), mustLines(sink, gauges(4)))
+	require.NoError(t, err)
+	assert.Equal(t, 1, rejected)
+
+	err = sink.Flush(context.Background(), gauges(4))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no thanks")
+}
+
+func mustLines(sink *MetricSink, interMetrics []samplers.InterMetric) [][]byte {
+	lines, _ := sink.lines(interMetrics)
+	return lines
+}
@@ -0,0 +1,248 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// The Avro schemas for the messages the Kafka sinks produce. They
+// mirror samplers.InterMetric and ssf.SSFSpan; the encoders below
+// must be kept in sync with them. Fields added to the schemas go at
+// the end, with defaults, so that readers can still read the older
+// messages.
+const (
+	avroMetricSchema = `{
+  "type": "record",
+  "name": "InterMetric",
+  "namespace": "com.stripe.veneur",
+  "fields": [
+    {"name": "name", "type": "string"},
+    {"name": "timestamp", "type": "long"},
+    {"name": "value", "type": "double"},
+    {"name": "tags", "type": {"type": "array", "items": "string"}},
+    {"name": "type", "type": {"type": "enum", "name": "MetricType", "symbols": ["COUNTER", "GAUGE", "STATUS"]}},
+    {"name": "message", "type": "string"},
+    {"name": "hostname", "type": "string"}
+  ]
+}`
+
+	avroSpanSchema = `{
+  "type": "record",
+  "name": "SSFSpan",
+  "namespace": "com.stripe.veneur.ssf",
+  "fields": [
+    {"name": "version", "type": "int"},
+    {"name": "trace_id", "type": "long"},
+    {"name": "id", "type": "long"},
+    {"name": "parent_id", "type": "long"},
+    {"name": "start_timestamp", "type": "long"},
+    {"name": "end_timestamp", "type": "long"},
+    {"name": "error", "type": "boolean"},
+    {"name": "service", "type": "string"},
+    {"name": "metrics", "type": {"type": "array", "items": {
+      "type": "record",
+      "name": "SSFSample",
+      "fields": [
+        {"name": "metric", "type": {"type": "enum", "name": "Metric", "symbols": ["COUNTER", "GAUGE", "HISTOGRAM", "SET", "STATUS"]}},
+        {"name": "name", "type": "string"},
+        {"name": "value", "type": "float"},
+        {"name": "timestamp", "type": "long"},
+        {"name": "message", "type": "string"},
+        {"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["OK", "WARNING", "CRITICAL", "UNKNOWN"]}},
+        {"name": "sample_rate", "type": "float"},
+        {"name": "tags", "type": {"type": "map", "values": "string"}},
+        {"name": "unit", "type": "string"}
+      ]
+    }}},
+    {"name": "tags", "type": {"type": "map", "values": "string"}},
+    {"name": "indicator", "type": "boolean"},
+    {"name": "name", "type": "string"},
+    {"name": "trace_id_high", "type": "long", "default": 0},
+    {"name": "links", "type": {"type": "array", "items": {
+      "type": "record",
+      "name": "SSFSpanLink",
+      "fields": [
+        {"name": "trace_id", "type": "long"},
+        {"name": "span_id", "type": "long"},
+        {"name": "tags", "type": {"type": "map", "values": "string"}},
+        {"name": "trace_id_high", "type": "long", "default": 0}
+      ]
+    }}, "default": []},
+    {"name": "events", "type": {"type": "array", "items": {
+      "type": "record",
+      "name": "SSFSpanEvent",
+      "fields": [
+        {"name": "timestamp", "type": "long"},
+        {"name": "name", "type": "string"},
+        {"name": "tags", "type": {"type": "map", "values": "string"}}
+      ]
+    }}, "default": []},
+    {"name": "sampling_priority", "type": {"type": "enum", "name": "SamplingPriority", "symbols": ["AUTO", "USER_KEEP", "USER_DROP"]}, "default": "AUTO"}
+  ]
+}`
+)
+
+var errUnknownMetricType = errors.New("metric type has no Avro enum symbol")
+var errUnknownStatus = errors.New("status has no Avro enum symbol")
+var errUnknownSamplingPriority = errors.New("sampling priority has no Avro enum symbol")
+
+// confluentMagicByte starts every message in the Confluent wire
+// format, followed by the 4-byte big-endian schema ID.
+const confluentMagicByte = 0
+
+// avroEncoder accumulates an Avro binary encoding.
+type avroEncoder []byte
+
+func (e *avroEncoder) long(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v) // zig-zag, as Avro wants
+	*e = append(*e, buf[:n]...)
+}
+
+func (e *avroEncoder) boolean(v bool) {
+	if v {
+		*e = append(*e, 1)
+	} else {
+		*e = append(*e, 0)
+	}
+}
+
+func (e *avroEncoder) float(v float32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+	*e = append(*e, buf[:]...)
+}
+
+func (e *avroEncoder) double(v float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	*e = append(*e, buf[:]...)
+}
+
+func (e *avroEncoder) string(v string) {
+	e.long(int64(len(v)))
+	*e = append(*e, v...)
+}
+
+func (e *avroEncoder) stringArray(vs []string) {
+	if len(vs) > 0 {
+		e.long(int64(len(vs)))
+		for _, v := range vs {
+			e.string(v)
+		}
+	}
+	e.long(0)
+}
+
+func (e *avroEncoder) stringMap(m map[string]string) {
+	if len(m) > 0 {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		e.long(int64(len(keys)))
+		for _, k := range keys {
+			e.string(k)
+			e.string(m[k])
+		}
+	}
+	e.long(0)
+}
+
+// header writes the Confluent wire format framing.
+func (e *avroEncoder) header(schemaID int32) {
+	var buf [5]byte
+	buf[0] = confluentMagicByte
+	binary.BigEndian.PutUint32(buf[1:], uint32(schemaID))
+	*e = append(*e, buf[:]...)
+}
+
+// encodeAvroMetric encodes an InterMetric in the Confluent Avro wire
+// format with the given schema ID.
+func encodeAvroMetric(schemaID int32, metric *samplers.InterMetric) ([]byte, error) {
+	var e avroEncoder
+	e.header(schemaID)
+	e.string(metric.Name)
+	e.long(metric.Timestamp)
+	e.double(metric.Value)
+	e.stringArray(metric.Tags)
+	switch metric.Type {
+	case samplers.CounterMetric, samplers.GaugeMetric, samplers.StatusMetric:
+		e.long(int64(metric.Type))
+	default:
+		return nil, errUnknownMetricType
+	}
+	e.string(metric.Message)
+	e.string(metric.HostName)
+	return e, nil
+}
+
+// encodeAvroSpan encodes an SSFSpan in the Confluent Avro wire
+// format with the given schema ID.
+func encodeAvroSpan(schemaID int32, span *ssf.SSFSpan) ([]byte, error) {
+	var e avroEncoder
+	e.header(schemaID)
+	e.long(int64(span.Version))
+	e.long(span.TraceId)
+	e.long(span.Id)
+	e.long(span.ParentId)
+	e.long(span.StartTimestamp)
+	e.long(span.EndTimestamp)
+	e.boolean(span.Error)
+	e.string(span.Service)
+	if len(span.Metrics) > 0 {
+		e.long(int64(len(span.Metrics)))
+		for _, sample := range span.Metrics {
+			if _, ok := ssf.SSFSample_Metric_name[int32(sample.Metric)]; !ok {
+				return nil, errUnknownMetricType
+			}
+			if _, ok := ssf.SSFSample_Status_name[int32(sample.Status)]; !ok {
+				return nil, errUnknownStatus
+			}
+			e.long(int64(sample.Metric))
+			e.string(sample.Name)
+			e.float(sample.Value)
+			e.long(sample.Timestamp)
+			e.string(sample.Message)
+			e.long(int64(sample.Status))
+			e.float(sample.SampleRate)
+			e.stringMap(sample.Tags)
+			e.string(sample.Unit)
+		}
+	}
+	e.long(0)
+	e.stringMap(span.Tags)
+	e.boolean(span.Indicator)
+	e.string(span.Name)
+	e.long(span.TraceIdHigh)
+	if len(span.Links) > 0 {
+		e.long(int64(len(span.Links)))
+		for _, link := range span.Links {
+			e.long(link.TraceId)
+			e.long(link.SpanId)
+			e.stringMap(link.Tags)
+			e.long(link.TraceIdHigh)
+		}
+	}
+	e.long(0)
+	if len(span.Events) > 0 {
+		e.long(int64(len(span.Events)))
+		for _, event := range span.Events {
+			e.long(event.Timestamp)
+			e.string(event.Name)
+			e.stringMap(event.Tags)
+		}
+	}
+	e.long(0)
+	if _, ok := ssf.SSFSpan_SamplingPriority_name[int32(span.SamplingPriority)]; !ok {
+		return nil, errUnknownSamplingPriority
+	}
+	e.long(int64(span.SamplingPriority))
+	return e, nil
+}
@@ -0,0 +1,311 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestAvroPrimitives(t *testing.T) {
+	var e avroEncoder
+	e.long(0)
+	e.long(-1)
+	e.long(1)
+	e.long(64)
+	e.string("hi")
+	e.boolean(true)
+	e.stringArray(nil)
+	assert.Equal(t, []byte{0x00, 0x01, 0x02, 0x80, 0x01, 0x04, 'h', 'i', 0x01, 0x00}, []byte(e))
+}
+
+// avroDecoder reads back what avroEncoder wrote.
+type avroDecoder struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (d *avroDecoder) long() int64 {
+	v, n := binary.Varint(d.buf)
+	require.True(d.t, n > 0, "invalid long")
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *avroDecoder) boolean() bool {
+	v := d.buf[0] == 1
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *avroDecoder) float() float32 {
+	v := math.Float32frombits(binary.LittleEndian.Uint32(d.buf))
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *avroDecoder) string() string {
+	n := d.long()
+	v := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return v
+}
+
+// blocks calls read for each item of an array or map.
+func (d *avroDecoder) blocks(read func()) {
+	for n := d.long(); n != 0; n = d.long() {
+		for ; n > 0; n-- {
+			read()
+		}
+	}
+}
+
+func (d *avroDecoder) stringMap() map[string]string {
+	m := map[string]string{}
+	d.blocks(func() {
+		k := d.string()
+		m[k] = d.string()
+	})
+	return m
+}
+
+// span decodes a message in the span schema, after its framing.
+func (d *avroDecoder) span() *ssf.SSFSpan {
+	span := &ssf.SSFSpan{
+		Version:        int32(d.long()),
+		TraceId:        d.long(),
+		Id:             d.long(),
+		ParentId:       d.long(),
+		StartTimestamp: d.long(),
+		EndTimestamp:   d.long(),
+		Error:          d.boolean(),
+		Service:        d.string(),
+	}
+	d.blocks(func() {
+		span.Metrics = append(span.Metrics, &ssf.SSFSample{
+			Metric:     ssf.SSFSample_Metric(d.long()),
+			Name:       d.string(),
+			Value:      d.float(),
+			Timestamp:  d.long(),
+			Message:    d.string(),
+			Status:     ssf.SSFSample_Status(d.long()),
+			SampleRate: d.float(),
+			Tags:       d.stringMap(),
+			Unit:       d.string(),
+		})
+	})
+	span.Tags = d.stringMap()
+	span.Indicator = d.boolean()
+	span.Name = d.string()
+	span.TraceIdHigh = d.long()
+	d.blocks(func() {
+		span.Links = append(span.Links, &ssf.SSFSpanLink{
+			TraceId:     d.long(),
+			SpanId:      d.long(),
+			Tags:        d.stringMap(),
+			TraceIdHigh: d.long(),
+		})
+	})
+	d.blocks(func() {
+		span.Events = append(span.Events, &ssf.SSFSpanEvent{
+			Timestamp: d.long(),
+			Name:      d.string(),
+			Tags:      d.stringMap(),
+		})
+	})
+	span.SamplingPriority = ssf.SSFSpan_SamplingPriority(d.long())
+	assert.Empty(d.t, d.buf, "the whole message should be decoded")
+	return span
+}
+
+func TestAvroMetricFraming(t *testing.T) {
+	metric := samplers.InterMetric{
+		Name:      "a.b.c",
+		Timestamp: 1476119058,
+		Value:     100,
+		Tags:      []string{"foo:bar"},
+		Type:      samplers.GaugeMetric,
+	}
+	b, err := encodeAvroMetric(42, &metric)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), b[0])
+	assert.Equal(t, uint32(42), binary.BigEndian.Uint32(b[1:5]))
+	// the name follows the framing:
+	assert.Equal(t, []byte{0x0a, 'a', '.', 'b', '.', 'c'}, b[5:11])
+
+	metric.Type = samplers.MetricType(99)
+	_, err = encodeAvroMetric(42, &metric)
+	assert.Error(t, err)
+}
+
+func TestAvroSchemasAreJSON(t *testing.T) {
+	for _, schema := range []string{avroMetricSchema, avroSpanSchema} {
+		var parsed map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(schema), &parsed))
+	}
+}
+
+func testSchemaRegistry(t *testing.T, failures int32) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		assert.Equal(t, "/subjects/testSpanTopic-value/versions", r.URL.Path)
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+		var body map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, avroSpanSchema, body["schema"])
+		if n <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": 7}`))
+	}))
+	return srv, &calls
+}
+
+func TestSchemaRegistryRetries(t *testing.T) {
+	srv, calls := testSchemaRegistry(t, 1)
+	defer srv.Close()
+
+	sr := SchemaRegistry{URL: srv.URL, Username: "user", Password: "pass"}
+	_, err := sr.register(http.DefaultClient, "testSpanTopic", avroSpanSchema)
+	assert.Error(t, err)
+
+	id, err := sr.registerWithRetries(http.DefaultClient, "testSpanTopic", avroSpanSchema)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(7), id)
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+}
+
+func TestAvroRequiresSchemaRegistry(t *testing.T) {
+	_, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "avro", "", 100)
+	assert.Error(t, err)
+	_, err = NewKafkaMetricSink(logrus.StandardLogger(), nil, "testing", "", "", "testMetricTopic", "all", "hash", 0, 0, 0, "", WithMetricSerializationFormat("avro"))
+	assert.Error(t, err)
+	_, err = NewKafkaMetricSink(logrus.StandardLogger(), nil, "testing", "", "", "testMetricTopic", "all", "hash", 0, 0, 0, "", WithMetricSerializationFormat("farts"))
+	assert.Error(t, err)
+}
+
+func TestSpanFlushAvro(t *testing.T) {
+	srv, _ := testSchemaRegistry(t, 0)
+	defer srv.Close()
+
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producerMock := mocks.NewAsyncProducer(t, config)
+	producerMock.ExpectInputAndSucceed()
+
+	sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "avro", "", 100,
+		WithSchemaRegistry(SchemaRegistry{URL: srv.URL, Username: "user", Password: "pass"}))
+	require.NoError(t, err)
+	sink.schemaID, err = registerSchema(sink.logger, sink.opts, sink.topic, avroSpanSchema)
+	require.NoError(t, err)
+	sink.producer = producerMock
+
+	// A span that can't be encoded is dropped without an error:
+	bad := &ssf.SSFSpan{TraceId: 1, Id: 2, Metrics: []*ssf.SSFSample{{Metric: ssf.SSFSample_Metric(99)}}}
+	assert.NoError(t, sink.Ingest(bad))
+
+	assert.NoError(t, sink.Ingest(&ssf.SSFSpan{TraceId: 1, Id: 2, Service: "farts-srv"}))
+	msg := <-producerMock.Successes()
+	contents, err := msg.Value.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), contents[0])
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(contents[1:5]))
+}
+
+func TestSpanFlushAvro128BitTraceID(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producerMock := mocks.NewAsyncProducer(t, config)
+	producerMock.ExpectInputAndSucceed()
+
+	sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "avro", "", 100,
+		WithSchemaRegistry(SchemaRegistry{URL: "http://registry"}))
+	require.NoError(t, err)
+	sink.schemaID = 7
+	sink.producer = producerMock
+
+	// The W3C example trace ID 4bf92f3577b34da6a3ce929d0e0e4736:
+	span := &ssf.SSFSpan{
+		Version:        1,
+		TraceIdHigh:    0x4bf92f3577b34da6,
+		TraceId:        -0x5c316d62f1f1b8ca,
+		Id:             0x00f067aa0ba902b7,
+		StartTimestamp: 1,
+		EndTimestamp:   2,
+		Service:        "farts-srv",
+		Name:           "farting",
+		Tags:           map[string]string{"foo": "bar"},
+		Metrics: []*ssf.SSFSample{
+			{Metric: ssf.SSFSample_COUNTER, Name: "farts", Value: 1, SampleRate: 1, Tags: map[string]string{}},
+		},
+		Links: []*ssf.SSFSpanLink{
+			{TraceIdHigh: 1, TraceId: 2, SpanId: 3, Tags: map[string]string{"kind": "batch"}},
+		},
+		Events: []*ssf.SSFSpanEvent{
+			{Timestamp: 1, Name: "retry", Tags: map[string]string{}},
+		},
+		SamplingPriority: ssf.SSFSpan_USER_KEEP,
+	}
+	require.NoError(t, sink.Ingest(span))
+
+	msg := <-producerMock.Successes()
+	contents, err := msg.Value.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(contents[1:5]))
+	d := avroDecoder{t: t, buf: contents[5:]}
+	assert.Equal(t, span, d.span())
+
+	// Spans with 64-bit trace IDs encode a zero trace_id_high, the
+	// field's default:
+	b, err := encodeAvroSpan(7, &ssf.SSFSpan{TraceId: 1, Id: 1})
+	require.NoError(t, err)
+	d = avroDecoder{t: t, buf: b[5:]}
+	decoded := d.span()
+	assert.Equal(t, int64(0), decoded.TraceIdHigh)
+	assert.Equal(t, int64(1), decoded.TraceId)
+
+	_, err = encodeAvroSpan(7, &ssf.SSFSpan{TraceId: 1, Id: 1, SamplingPriority: ssf.SSFSpan_SamplingPriority(9)})
+	assert.Equal(t, errUnknownSamplingPriority, err)
+}
+
+func TestMetricFlushAvro(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producerMock := mocks.NewAsyncProducer(t, config)
+	producerMock.ExpectInputAndSucceed()
+
+	sink, err := NewKafkaMetricSink(logrus.StandardLogger(), nil, "testing", "", "", "testMetricTopic", "all", "hash", 0, 0, 0, "",
+		WithMetricSerializationFormat("avro"), WithSchemaRegistry(SchemaRegistry{URL: "http://registry"}))
+	require.NoError(t, err)
+	sink.schemaID = 3
+	sink.producer = producerMock
+
+	metrics := []samplers.InterMetric{
+		{Name: "bad", Type: samplers.MetricType(99)},
+		{Name: "a.b.c", Value: 1, Type: samplers.CounterMetric},
+	}
+	assert.NoError(t, sink.Flush(context.Background(), metrics))
+
+	msg := <-producerMock.Successes()
+	contents, err := msg.Value.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(contents[1:5]))
+	assert.Equal(t, "a.b.c", string(contents[6:11]))
+}
@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+func headerMap(headers []sarama.RecordHeader) map[string]string {
+	m := map[string]string{}
+	for _, h := range headers {
+		m[string(h.Key)] = string(h.Value)
+	}
+	return m
+}
+
+func TestMessageHeaders(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producerMock := mocks.NewAsyncProducer(t, config)
+	producerMock.ExpectInputAndSucceed()
+	producerMock.ExpectInputAndSucceed()
+
+	headers := WithHeaders(map[string]string{"env": "prod", "region": "us-east-1"}, "veneur-01")
+	spanSink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100, headers)
+	require.NoError(t, err)
+	spanSink.producer = producerMock
+	metricSink, err := NewKafkaMetricSink(logrus.StandardLogger(), nil, "testing", "", "", "testMetricTopic", "all", "hash", 0, 0, 0, "", headers)
+	require.NoError(t, err)
+	metricSink.producer = producerMock
+
+	assert.True(t, spanSink.config.Version.IsAtLeast(sarama.V0_11_0_0))
+
+	require.NoError(t, spanSink.Ingest(&ssf.SSFSpan{TraceId: 1, Id: 2, Service: "farts-srv"}))
+	msg := <-producerMock.Successes()
+	assert.Equal(t, map[string]string{
+		"env":             "prod",
+		"region":          "us-east-1",
+		"veneur_hostname": "veneur-01",
+		"veneur_sink":     "kafka-span",
+	}, headerMap(msg.Headers))
+
+	require.NoError(t, metricSink.Flush(context.Background(), []samplers.InterMetric{{Name: "a.b.c", Type: samplers.CounterMetric}}))
+	msg = <-producerMock.Successes()
+	assert.Equal(t, "kafka-metric", headerMap(msg.Headers)["veneur_sink"])
+}
+
+func TestNoHeadersByDefault(t *testing.T) {
+	sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100)
+	require.NoError(t, err)
+	assert.Nil(t, sink.headers)
+	assert.False(t, sink.config.Version.IsAtLeast(sarama.V0_11_0_0))
+}
+
+// TestHeadersProduceRecordBatches ensures that with headers enabled,
+// a real producer talking to a broker uses the message format that
+// carries them.
+func TestHeadersProduceRecordBatches(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	// NewMockProduceResponse always answers in the v0 format, which
+	// the producer can't decode in response to a v3 request:
+	produceResponse := &sarama.ProduceResponse{Version: 3}
+	produceResponse.AddTopicPartition("testSpanTopic", 0, sarama.ErrNoError)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("testSpanTopic", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockWrapper(produceResponse),
+	})
+
+	sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, broker.Addr(), "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100,
+		WithHeaders(map[string]string{"env": "test"}, "veneur-01"))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	defer sink.producer.Close()
+
+	require.NoError(t, sink.Ingest(&ssf.SSFSpan{TraceId: 1, Id: 2, Service: "farts-srv"}))
+	waitFor(t, func() bool { return atomic.LoadInt64(&sink.delivery.delivered) == 1 })
+
+	var produced *sarama.ProduceRequest
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced = req
+		}
+	}
+	require.NotNil(t, produced)
+	assert.True(t, produced.Version >= 3, "produce request version %d can't carry headers", produced.Version)
+}
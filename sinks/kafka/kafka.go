@@ -8,7 +8,7 @@ import (
 	"hash/crc32"
 	"io/ioutil"
 	"math"
-	"strconv"
+	"net/http"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -30,6 +30,27 @@ func init() {
 
 const IngestTimeout = 5 * time.Second
 
+const (
+	// PartitionKeyNone leaves messages unkeyed.
+	PartitionKeyNone = ""
+	// PartitionKeyTraceID keys span messages by their trace ID, so
+	// that all the spans in a trace land on the same partition.
+	PartitionKeyTraceID = "trace_id"
+	// PartitionKeyMetric keys metric messages by their name and
+	// tags, so that each timeseries lands on the same partition.
+	PartitionKeyMetric = "metric"
+)
+
+const (
+	// SerializationJSON encodes messages as JSON.
+	SerializationJSON = "json"
+	// SerializationProtobuf encodes span messages as SSF protobufs.
+	SerializationProtobuf = "protobuf"
+	// SerializationAvro encodes messages as Avro in the Confluent
+	// wire format, with schemas registered in a schema registry.
+	SerializationAvro = "avro"
+)
+
 var IngestTimeoutError = errors.New("Timed out writing to Kafka producer")
 
 var _ sinks.MetricSink = &KafkaMetricSink{}
@@ -44,6 +65,11 @@ type KafkaMetricSink struct {
 	brokers     string
 	config      *sarama.Config
 	traceClient *trace.Client
+	opts        *options
+	serializer  string
+	schemaID    int32
+	delivery    *deliveryTracker
+	headers     []sarama.RecordHeader
 }
 
 type KafkaSpanSink struct {
@@ -56,11 +82,18 @@ type KafkaSpanSink struct {
 	sampleThreshold uint32
 	config          *sarama.Config
 	spansFlushed    int64
+	spansSkipped    int64
+	userDropped     int64
+	eventsDropped   int64
 	traceClient     *trace.Client
+	opts            *options
+	schemaID        int32
+	delivery        *deliveryTracker
+	headers         []sarama.RecordHeader
 }
 
 // NewKafkaMetricSink creates a new Kafka Plugin.
-func NewKafkaMetricSink(logger *logrus.Logger, cl *trace.Client, brokers string, checkTopic string, eventTopic string, metricTopic string, ackRequirement string, partitioner string, retries int, bufferBytes int, bufferMessages int, bufferDuration string) (*KafkaMetricSink, error) {
+func NewKafkaMetricSink(logger *logrus.Logger, cl *trace.Client, brokers string, checkTopic string, eventTopic string, metricTopic string, ackRequirement string, partitioner string, retries int, bufferBytes int, bufferMessages int, bufferDuration string, opts ...Option) (*KafkaMetricSink, error) {
 	if logger == nil {
 		logger = &logrus.Logger{Out: ioutil.Discard}
 	}
@@ -80,7 +113,26 @@ func NewKafkaMetricSink(logger *logrus.Logger, cl *trace.Client, brokers string,
 		}
 	}
 
-	config, _ := newProducerConfig(ll, ackRequirement, partitioner, retries, bufferBytes, bufferMessages, finalBufferDuration)
+	o := newOptions(opts)
+	if err := checkPartitionKey(ll, o.partitionKey, PartitionKeyMetric, partitioner); err != nil {
+		return nil, err
+	}
+	serializer := o.metricSerializer
+	switch serializer {
+	case "":
+		serializer = SerializationJSON
+	case SerializationJSON:
+	case SerializationAvro:
+		if err := checkSchemaRegistry(o); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown metric serialization format %q", serializer)
+	}
+	config, err := newProducerConfig(ll, ackRequirement, partitioner, retries, bufferBytes, bufferMessages, finalBufferDuration, o)
+	if err != nil {
+		return nil, err
+	}
 
 	ll.WithFields(logrus.Fields{
 		"brokers":         brokers,
@@ -88,6 +140,8 @@ func NewKafkaMetricSink(logger *logrus.Logger, cl *trace.Client, brokers string,
 		"event_topic":     eventTopic,
 		"metric_topic":    metricTopic,
 		"partitioner":     partitioner,
+		"partition_key":   o.partitionKey,
+		"serializer":      serializer,
 		"ack_requirement": ackRequirement,
 		"max_retries":     retries,
 		"buffer_bytes":    bufferBytes,
@@ -103,10 +157,13 @@ func NewKafkaMetricSink(logger *logrus.Logger, cl *trace.Client, brokers string,
 		brokers:     brokers,
 		config:      config,
 		traceClient: cl,
+		opts:        o,
+		serializer:  serializer,
+		headers:     o.headers("kafka-metric"),
 	}, nil
 }
 
-func newProducerConfig(logger *logrus.Entry, ackRequirement string, partitioner string, retries int, bufferBytes int, bufferMessages int, bufferFrequency time.Duration) (*sarama.Config, error) {
+func newProducerConfig(logger *logrus.Entry, ackRequirement string, partitioner string, retries int, bufferBytes int, bufferMessages int, bufferFrequency time.Duration, o *options) (*sarama.Config, error) {
 
 	config := sarama.NewConfig()
 	// TODO Stringer?
@@ -142,15 +199,90 @@ func newProducerConfig(logger *logrus.Entry, ackRequirement string, partitioner
 
 	config.Producer.Retry.Max = retries
 
-	// If either of these is set to true, you must
-	// read from the corresponding channels in a separate
-	// goroutine. Otherwise, the entire sink will back up.
-	config.Producer.Return.Successes = false
-	config.Producer.Return.Errors = false
+	// These channels are consumed by each sink's deliveryTracker;
+	// otherwise, the entire sink would back up.
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	if o.headersEnabled && !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		// Record headers were introduced with the v2 message
+		// format; older versions silently drop them.
+		config.Version = sarama.V0_11_0_0
+	}
+
+	if o.security != nil {
+		if err := o.security.apply(config); err != nil {
+			logger.WithError(err).Error("Invalid Kafka security configuration")
+			return nil, err
+		}
+	}
 
 	return config, nil
 }
 
+// checkPartitionKey validates a partition key setting for a sink
+// that supports the given key mode.
+func checkPartitionKey(logger *logrus.Entry, key string, supported string, partitioner string) error {
+	if key == PartitionKeyNone {
+		return nil
+	}
+	if key != supported {
+		return fmt.Errorf("Unsupported partition key %q, must be %q or empty", key, supported)
+	}
+	if partitioner == "random" {
+		logger.WithField("partition_key", key).Warn("Partition key is ignored by the random partitioner")
+	}
+	return nil
+}
+
+// maxTopicLength is the longest topic name that Kafka allows.
+const maxTopicLength = 249
+
+// sanitizeTopic replaces the characters that are illegal in Kafka
+// topic names with underscores.
+func sanitizeTopic(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
+
+// checkSchemaRegistry validates that the Avro serialization format
+// has a schema registry to register its schemas with.
+func checkSchemaRegistry(o *options) error {
+	if o.schemaRegistry == nil || o.schemaRegistry.URL == "" {
+		return errors.New("The avro serialization format requires a schema registry URL")
+	}
+	return nil
+}
+
+// registerSchema registers an Avro schema for the topic, retrying for
+// a while if the registry can't be reached.
+func registerSchema(logger *logrus.Entry, o *options, topic string, schema string) (int32, error) {
+	client := &http.Client{Timeout: schemaRegistryTimeout}
+	id, err := o.schemaRegistry.registerWithRetries(client, topic, schema)
+	if err != nil {
+		logger.WithError(err).WithField("schema_registry", o.schemaRegistry.URL).Error("Could not register Avro schema")
+		return 0, err
+	}
+	logger.WithFields(logrus.Fields{
+		"topic":     topic,
+		"schema_id": id,
+	}).Info("Registered Avro schema")
+	return id, nil
+}
+
+// metricPartitionKey returns a key identifying the metric's
+// timeseries: its name and tags.
+func metricPartitionKey(metric *samplers.InterMetric) sarama.Encoder {
+	return sarama.StringEncoder(metric.Name + "," + strings.Join(metric.Tags, ","))
+}
+
 // newConfiguredProducer returns a configured Sarama SyncProducer
 func newConfiguredProducer(logger *logrus.Entry, brokerString string, config *sarama.Config) (sarama.AsyncProducer, error) {
 	brokerList := strings.Split(brokerString, ",")
@@ -162,9 +294,12 @@ func newConfiguredProducer(logger *logrus.Entry, brokerString string, config *sa
 
 	logger.WithField("addrs", brokerList).Info("Connecting to Kafka")
 	producer, err := sarama.NewAsyncProducer(brokerList, config)
-
 	if err != nil {
-		logger.Error("Error Connecting to Kafka. client error: ", err)
+		// This includes TLS and SASL authentication failures, which
+		// won't get better by themselves, so don't continue
+		// without a producer.
+		logger.WithError(err).Error("Error Connecting to Kafka")
+		return nil, err
 	}
 
 	return producer, nil
@@ -177,19 +312,39 @@ func (k *KafkaMetricSink) Name() string {
 
 // Start performs final adjustments on the sink.
 func (k *KafkaMetricSink) Start(cl *trace.Client) error {
+	if k.serializer == SerializationAvro && k.metricTopic != "" {
+		id, err := registerSchema(k.logger, k.opts, k.metricTopic, avroMetricSchema)
+		if err != nil {
+			return err
+		}
+		k.schemaID = id
+	}
 	producer, err := newConfiguredProducer(k.logger, k.brokers, k.config)
 	if err != nil {
 		return err
 	}
 	k.producer = producer
+	k.delivery = newDeliveryTracker(k.logger, producer, k.opts, "")
 	return nil
 }
 
+// Stop stops retrying messages and closes the producer, once it has
+// delivered the messages it was sent.
+func (k *KafkaMetricSink) Stop() {
+	if k.producer != nil {
+		stopProducer(k.logger, k.producer, k.delivery)
+	}
+}
+
 // Flush sends a slice of metrics to Kafka
 func (k *KafkaMetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
 	samples := &ssf.Samples{}
 	defer metrics.Report(k.traceClient, samples)
 
+	if k.delivery != nil {
+		k.delivery.report(samples, map[string]string{"sink": k.Name()})
+	}
+
 	if len(interMetrics) == 0 {
 		k.logger.Info("Nothing to flush, skipping.")
 		return nil
@@ -202,17 +357,37 @@ func (k *KafkaMetricSink) Flush(ctx context.Context, interMetrics []samplers.Int
 		}
 
 		k.logger.Debug("Emitting Metric: ", metric.Name)
-		j, err := json.Marshal(metric)
-		if err != nil {
-			k.logger.Error("Error marshalling metric: ", metric.Name)
-			samples.Add(ssf.Count("kafka.marshal.error_total", 1, nil))
-			return err
+		var enc sarama.Encoder
+		switch k.serializer {
+		case SerializationAvro:
+			a, err := encodeAvroMetric(k.schemaID, &metric)
+			if err != nil {
+				// Don't hold up the rest of the flush for
+				// one metric that can't be encoded:
+				k.logger.WithError(err).WithField("metric", metric.Name).Warn("Error encoding metric as Avro, dropping it")
+				samples.Add(ssf.Count("kafka.marshal.error_total", 1, map[string]string{"serializer": k.serializer}))
+				continue
+			}
+			enc = sarama.ByteEncoder(a)
+		default:
+			j, err := json.Marshal(metric)
+			if err != nil {
+				k.logger.Error("Error marshalling metric: ", metric.Name)
+				samples.Add(ssf.Count("kafka.marshal.error_total", 1, nil))
+				return err
+			}
+			enc = sarama.StringEncoder(j)
 		}
 
-		k.producer.Input() <- &sarama.ProducerMessage{
-			Topic: k.metricTopic,
-			Value: sarama.StringEncoder(j),
+		message := &sarama.ProducerMessage{
+			Topic:   k.metricTopic,
+			Value:   enc,
+			Headers: k.headers,
+		}
+		if k.opts.partitionKey == PartitionKeyMetric {
+			message.Key = metricPartitionKey(&metric)
 		}
+		k.producer.Input() <- message
 		successes++
 	}
 	samples.Add(ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(successes), map[string]string{"sink": k.Name()}))
@@ -225,7 +400,7 @@ func (k *KafkaMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.S
 }
 
 // NewKafkaSpanSink creates a new Kafka Plugin.
-func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, topic string, partitioner string, ackRequirement string, retries int, bufferBytes int, bufferMessages int, bufferDuration string, serializationFormat string, sampleTag string, sampleRatePercentage int) (*KafkaSpanSink, error) {
+func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, topic string, partitioner string, ackRequirement string, retries int, bufferBytes int, bufferMessages int, bufferDuration string, serializationFormat string, sampleTag string, sampleRatePercentage int, opts ...Option) (*KafkaSpanSink, error) {
 	if logger == nil {
 		logger = &logrus.Logger{Out: ioutil.Discard}
 	}
@@ -236,10 +411,20 @@ func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, t
 
 	ll := logger.WithField("span_sink", "kafka")
 
+	o := newOptions(opts)
+	if o.spanTopicTemplate != "" && !strings.Contains(o.spanTopicTemplate, "{service}") {
+		ll.WithField("topic_template", o.spanTopicTemplate).Warn("Span topic template has no {service} placeholder, so all spans go to one topic")
+	}
 	serializer := serializationFormat
-	if serializer != "json" && serializer != "protobuf" {
+	switch serializer {
+	case SerializationJSON, SerializationProtobuf:
+	case SerializationAvro:
+		if err := checkSchemaRegistry(o); err != nil {
+			return nil, err
+		}
+	default:
 		ll.WithField("serializer", serializer).Warn("Unknown serializer, defaulting to protobuf")
-		serializer = "protobuf"
+		serializer = SerializationProtobuf
 	}
 
 	var sampleThreshold uint32
@@ -261,12 +446,21 @@ func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, t
 		}
 	}
 
-	config, _ := newProducerConfig(ll, ackRequirement, partitioner, retries, bufferBytes, bufferMessages, finalBufferDuration)
+	if err := checkPartitionKey(ll, o.partitionKey, PartitionKeyTraceID, partitioner); err != nil {
+		return nil, err
+	}
+	config, err := newProducerConfig(ll, ackRequirement, partitioner, retries, bufferBytes, bufferMessages, finalBufferDuration, o)
+	if err != nil {
+		return nil, err
+	}
 
 	ll.WithFields(logrus.Fields{
 		"brokers":         brokers,
 		"topic":           topic,
+		"topic_template":  o.spanTopicTemplate,
 		"partitioner":     partitioner,
+		"partition_key":   o.partitionKey,
+		"serializer":      serializer,
 		"ack_requirement": ackRequirement,
 		"max_retries":     retries,
 		"buffer_bytes":    bufferBytes,
@@ -282,6 +476,8 @@ func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, t
 		serializer:      serializer,
 		sampleTag:       sampleTag,
 		sampleThreshold: sampleThreshold,
+		opts:            o,
+		headers:         o.headers("kafka-span"),
 	}, nil
 }
 
@@ -290,22 +486,74 @@ func (k *KafkaSpanSink) Name() string {
 	return "kafka"
 }
 
+// SetSpanSampleRate replaces the rate that the sink samples traces at,
+// as set by WithTraceSampling.
+func (k *KafkaSpanSink) SetSpanSampleRate(rate int) {
+	atomic.StoreInt64(&k.opts.traceSampleRate, int64(rate))
+}
+
 // Start performs final adjustments on the sink.
 func (k *KafkaSpanSink) Start(cl *trace.Client) error {
+	if k.serializer == SerializationAvro {
+		id, err := registerSchema(k.logger, k.opts, k.topic, avroSpanSchema)
+		if err != nil {
+			return err
+		}
+		k.schemaID = id
+	}
 	producer, err := newConfiguredProducer(k.logger, k.brokers, k.config)
 	if err != nil {
 		return err
 	}
 	k.producer = producer
+	fallback := ""
+	if k.opts.spanTopicTemplate != "" {
+		fallback = k.topic
+	}
+	k.delivery = newDeliveryTracker(k.logger, producer, k.opts, fallback)
 	return nil
 }
 
-// Ingest takes the span and adds it to Kafka producer for async flushing. The
-// flushing is driven by the settings from KafkaSpanSink's constructor. Tune
-// the bytes, messages and interval settings to your tastes!
-func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
-	samples := &ssf.Samples{}
-	defer metrics.Report(k.traceClient, samples)
+// Stop stops retrying messages and closes the producer, once it has
+// delivered the messages it was sent.
+func (k *KafkaSpanSink) Stop() {
+	if k.producer != nil {
+		stopProducer(k.logger, k.producer, k.delivery)
+	}
+}
+
+// spanTopic returns the topic that the span should be produced to.
+func (k *KafkaSpanSink) spanTopic(span *ssf.SSFSpan) string {
+	if k.opts.spanTopicTemplate == "" || span.Service == "" {
+		return k.topic
+	}
+	topic := strings.Replace(k.opts.spanTopicTemplate, "{service}", sanitizeTopic(span.Service), -1)
+	if len(topic) > maxTopicLength {
+		return k.topic
+	}
+	if k.delivery != nil && !k.delivery.topicKnown(topic) {
+		k.delivery.countRedirect(topic)
+		return k.topic
+	}
+	return topic
+}
+
+// sampled reports whether the span passes the sink's sampling
+// rules. Indicator spans, spans carrying the keep tag, and spans whose
+// trace the application asked to keep always do.
+func (k *KafkaSpanSink) sampled(span *ssf.SSFSpan) bool {
+	if span.Indicator || sinks.PriorityKept(span) {
+		return true
+	}
+	if k.opts.sampleKeepTag != "" {
+		if _, ok := span.Tags[k.opts.sampleKeepTag]; ok {
+			return true
+		}
+	}
+	if !sinks.SampleTrace(span, atomic.LoadInt64(&k.opts.traceSampleRate)) {
+		return false
+	}
+
 	// If we're sampling less than 100%, we should check whether a span should
 	// be sampled:
 	if k.sampleTag != "" || k.sampleThreshold < uint32(math.MaxUint32) {
@@ -315,7 +563,7 @@ func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
 		if k.sampleTag == "" {
 			// If we haven't set a sampleTag, we'll be hashing based on the traceID
 
-			sampleTagValue = strconv.FormatInt(span.TraceId, 10)
+			sampleTagValue = ssf.TraceIDString(span)
 		} else {
 			// If we've set a sampleTag, we'll be hashing based off of that tag's value.
 
@@ -325,7 +573,7 @@ func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
 				// If the span isn't tagged appropriately, we should drop it, regardless
 				// of our sample rate.
 				k.logger.Debug("Rejected span without appropriate tag")
-				return nil
+				return false
 			}
 		}
 
@@ -344,12 +592,42 @@ func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
 		// we previously computed.
 		if hashKey > k.sampleThreshold {
 			k.logger.WithField("traceId", span.TraceId).WithField("sampleTag", k.sampleTag).WithField("sampleTagValue", sampleTagValue).WithField("hashKey", hashKey).WithField("sampleThreshold", k.sampleThreshold).Debug("Rejected span based off of sampling rules")
-			return nil
+			return false
 		}
 	}
+	return true
+}
+
+// Ingest takes the span and adds it to Kafka producer for async flushing. The
+// flushing is driven by the settings from KafkaSpanSink's constructor. Tune
+// the bytes, messages and interval settings to your tastes!
+func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
+	samples := &ssf.Samples{}
+	defer metrics.Report(k.traceClient, samples)
+	if sinks.PriorityDropped(span) {
+		atomic.AddInt64(&k.userDropped, 1)
+		return nil
+	}
+	if !k.sampled(span) {
+		atomic.AddInt64(&k.spansSkipped, 1)
+		return nil
+	}
+
 	var enc sarama.Encoder
 	switch k.serializer {
-	case "json":
+	case SerializationAvro:
+		a, err := encodeAvroSpan(k.schemaID, span)
+		if err != nil {
+			// Drop the span rather than failing the ingest
+			// of everything else:
+			k.logger.WithError(err).Warn("Error encoding span as Avro, dropping it")
+			samples.Add(ssf.Count("kafka.span_marshal_error_total", 1, map[string]string{"serializer": k.serializer}))
+			return nil
+		}
+		enc = sarama.ByteEncoder(a)
+		// The Avro schema has no span events:
+		atomic.AddInt64(&k.eventsDropped, int64(len(span.Events)))
+	case SerializationJSON:
 		j, err := json.Marshal(span)
 		if err != nil {
 			k.logger.Error("Error marshalling span")
@@ -357,7 +635,7 @@ func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
 			return err
 		}
 		enc = sarama.StringEncoder(j)
-	case "protobuf":
+	case SerializationProtobuf:
 		p, err := proto.Marshal(span)
 		if err != nil {
 			k.logger.Error("Error marshalling span")
@@ -370,8 +648,12 @@ func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
 	}
 
 	message := &sarama.ProducerMessage{
-		Topic: k.topic,
-		Value: enc,
+		Topic:   k.spanTopic(span),
+		Value:   enc,
+		Headers: k.headers,
+	}
+	if k.opts.partitionKey == PartitionKeyTraceID {
+		message.Key = sarama.StringEncoder(ssf.TraceIDString(span))
 	}
 
 	select {
@@ -386,8 +668,23 @@ func (k *KafkaSpanSink) Ingest(span *ssf.SSFSpan) error {
 // Flush emits metrics, since the spans have already been ingested and are
 // sending async.
 func (k *KafkaSpanSink) Flush() {
-	// TODO We have no stuff in here for detecting failed writes from the async
-	// producer. We should add that.
-	metrics.ReportOne(k.traceClient, ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(atomic.LoadInt64(&k.spansFlushed)), map[string]string{"sink": k.Name()}))
-	atomic.SwapInt64(&k.spansFlushed, 0)
+	samples := &ssf.Samples{}
+	tags := map[string]string{"sink": k.Name()}
+	// Messages produced this interval may not be delivered until the
+	// next, so these are only expected to agree over time:
+	samples.Add(
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(atomic.SwapInt64(&k.spansFlushed, 0)), tags),
+		ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(atomic.SwapInt64(&k.spansSkipped, 0)), tags),
+	)
+	if dropped := atomic.SwapInt64(&k.userDropped, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(dropped),
+			map[string]string{"sink": k.Name(), "reason": sinks.SkipReasonUserDrop}))
+	}
+	if dropped := atomic.SwapInt64(&k.eventsDropped, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpanEventsDropped, float32(dropped), tags))
+	}
+	if k.delivery != nil {
+		k.delivery.report(samples, tags)
+	}
+	metrics.Report(k.traceClient, samples)
 }
@@ -3,6 +3,7 @@ package kafka
 import (
 	"context"
 	"math"
+	"strings"
 	"testing"
 	"time"
 
@@ -487,3 +488,96 @@ func TestSpanFlushProtobuf(t *testing.T) {
 
 	assert.Equal(t, testSpan.Service, span.Service)
 }
+
+func TestSpanPartitionKey(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		key  string
+	}{
+		{"default", nil, ""},
+		{"trace_id", []Option{WithPartitionKey(PartitionKeyTraceID)}, "1234567"},
+	}
+	for _, elt := range tests {
+		test := elt
+		t.Run(test.name, func(t *testing.T) {
+			config := sarama.NewConfig()
+			config.Producer.Return.Successes = true
+			producerMock := mocks.NewAsyncProducer(t, config)
+			producerMock.ExpectInputAndSucceed()
+
+			sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100, test.opts...)
+			assert.NoError(t, err)
+			sink.producer = producerMock
+
+			assert.NoError(t, sink.Ingest(&ssf.SSFSpan{TraceId: 1234567, Id: 2, Service: "farts-srv"}))
+
+			msg := <-producerMock.Successes()
+			if test.key == "" {
+				assert.Nil(t, msg.Key)
+				return
+			}
+			key, err := msg.Key.Encode()
+			assert.NoError(t, err)
+			assert.Equal(t, test.key, string(key))
+		})
+	}
+}
+
+func TestMetricPartitionKey(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producerMock := mocks.NewAsyncProducer(t, config)
+	producerMock.ExpectInputAndSucceed()
+
+	sink, err := NewKafkaMetricSink(logrus.StandardLogger(), nil, "testing", "", "", "testMetricTopic", "all", "hash", 0, 0, 0, "", WithPartitionKey(PartitionKeyMetric))
+	assert.NoError(t, err)
+	sink.producer = producerMock
+
+	metric := samplers.InterMetric{
+		Name:  "a.b.c",
+		Value: float64(100),
+		Tags:  []string{"baz:quz", "foo:bar"},
+		Type:  samplers.GaugeMetric,
+	}
+	assert.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{metric}))
+
+	msg := <-producerMock.Successes()
+	key, err := msg.Key.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, "a.b.c,baz:quz,foo:bar", string(key))
+}
+
+func TestInvalidPartitionKey(t *testing.T) {
+	_, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100, WithPartitionKey(PartitionKeyMetric))
+	assert.Error(t, err)
+	_, err = NewKafkaMetricSink(logrus.StandardLogger(), nil, "testing", "", "", "testMetricTopic", "all", "hash", 0, 0, 0, "", WithPartitionKey(PartitionKeyTraceID))
+	assert.Error(t, err)
+}
+
+func TestSpanTopicTemplate(t *testing.T) {
+	sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100,
+		WithSpanTopicTemplate("veneur-spans-{service}"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "veneur-spans-farts-srv", sink.spanTopic(&ssf.SSFSpan{Service: "farts-srv"}))
+	assert.Equal(t, "veneur-spans-my_service_v2", sink.spanTopic(&ssf.SSFSpan{Service: "my service/v2"}))
+	assert.Equal(t, "testSpanTopic", sink.spanTopic(&ssf.SSFSpan{}))
+	assert.Equal(t, "testSpanTopic", sink.spanTopic(&ssf.SSFSpan{Service: strings.Repeat("a", 250)}))
+}
+
+func TestSpanTraceSampling(t *testing.T) {
+	sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100,
+		WithTraceSampling(10, "keep"))
+	assert.NoError(t, err)
+
+	assert.True(t, sink.sampled(&ssf.SSFSpan{TraceId: 20}))
+	assert.False(t, sink.sampled(&ssf.SSFSpan{TraceId: 21}))
+	assert.True(t, sink.sampled(&ssf.SSFSpan{TraceId: 21, Indicator: true}))
+	assert.True(t, sink.sampled(&ssf.SSFSpan{TraceId: 21, Tags: map[string]string{"keep": ""}}))
+
+	// Skipped spans are counted, and not produced:
+	assert.NoError(t, sink.Ingest(&ssf.SSFSpan{TraceId: 21}))
+	assert.Equal(t, int64(1), sink.spansSkipped)
+	assert.Equal(t, int64(0), sink.spansFlushed)
+}
@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"sort"
+
+	"github.com/Shopify/sarama"
+)
+
+type options struct {
+	security         *Security
+	partitionKey     string
+	schemaRegistry   *SchemaRegistry
+	metricSerializer string
+
+	retryQueueSize     int
+	retryQueueAttempts int
+
+	spanTopicTemplate string
+
+	traceSampleRate int64
+	sampleKeepTag   string
+
+	headersEnabled bool
+	staticHeaders  map[string]string
+	hostname       string
+}
+
+const defaultRetryQueueSize = 1000
+
+// Option is returned by functions that serve as options to
+// NewKafkaMetricSink and NewKafkaSpanSink, like "With..."
+type Option func(*options)
+
+// WithSecurity configures TLS and SASL for the sink's connections to
+// the Kafka brokers.
+func WithSecurity(sec Security) Option {
+	return func(o *options) {
+		o.security = &sec
+	}
+}
+
+// WithPartitionKey sets what the sink uses as each message's key,
+// which the hash partitioner uses to pick the message's partition.
+// Span sinks accept PartitionKeyTraceID, and metric sinks accept
+// PartitionKeyMetric. The default, PartitionKeyNone, leaves messages
+// unkeyed.
+func WithPartitionKey(key string) Option {
+	return func(o *options) {
+		o.partitionKey = key
+	}
+}
+
+// WithSchemaRegistry sets the schema registry that the sink registers
+// its Avro schemas with. It is required for the "avro" serialization
+// format.
+func WithSchemaRegistry(sr SchemaRegistry) Option {
+	return func(o *options) {
+		o.schemaRegistry = &sr
+	}
+}
+
+// WithMetricSerializationFormat sets how a metric sink encodes
+// metrics: "json" (the default) or "avro".
+func WithMetricSerializationFormat(format string) Option {
+	return func(o *options) {
+		o.metricSerializer = format
+	}
+}
+
+// WithRetryQueue enables producing messages that failed with a
+// retriable error (timeouts, leadership changes and network errors)
+// again, up to maxAttempts times in total. At most size messages wait
+// to be retried; beyond that, failed messages are dropped.
+func WithRetryQueue(size int, maxAttempts int) Option {
+	return func(o *options) {
+		o.retryQueueSize = size
+		o.retryQueueAttempts = maxAttempts
+	}
+}
+
+// WithSpanTopicTemplate routes each span to a topic named by the
+// template, with "{service}" replaced by the span's service. Spans
+// without a service, and spans whose topic doesn't exist, go to the
+// sink's topic instead.
+func WithSpanTopicTemplate(template string) Option {
+	return func(o *options) {
+		o.spanTopicTemplate = template
+	}
+}
+
+// WithTraceSampling makes a span sink keep 1 in every sampleRate
+// traces, choosing the same traces as other sinks that sample with
+// sinks.SampleTrace. Spans with the keepTag tag (if it's not empty)
+// and indicator spans are always kept.
+func WithTraceSampling(sampleRate int, keepTag string) Option {
+	return func(o *options) {
+		o.traceSampleRate = int64(sampleRate)
+		o.sampleKeepTag = keepTag
+	}
+}
+
+// WithHeaders sets record headers on every message: the static
+// headers, plus "veneur_hostname" (if hostname isn't empty) and
+// "veneur_sink", which is "kafka-metric" or "kafka-span". Headers
+// require Kafka 0.11 or newer, so the producer is configured to speak
+// that version.
+func WithHeaders(static map[string]string, hostname string) Option {
+	return func(o *options) {
+		o.headersEnabled = true
+		o.staticHeaders = static
+		o.hostname = hostname
+	}
+}
+
+// headers returns the record headers for messages from the named
+// sink, or nil if headers are disabled.
+func (o *options) headers(sink string) []sarama.RecordHeader {
+	if !o.headersEnabled {
+		return nil
+	}
+	keys := make([]string, 0, len(o.staticHeaders))
+	for k := range o.staticHeaders {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	headers := make([]sarama.RecordHeader, 0, len(keys)+2)
+	for _, k := range keys {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(o.staticHeaders[k])})
+	}
+	if o.hostname != "" {
+		headers = append(headers, sarama.RecordHeader{Key: []byte("veneur_hostname"), Value: []byte(o.hostname)})
+	}
+	return append(headers, sarama.RecordHeader{Key: []byte("veneur_sink"), Value: []byte(sink)})
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{retryQueueSize: defaultRetryQueueSize}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
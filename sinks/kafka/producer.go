@@ -0,0 +1,323 @@
+package kafka
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/ssf"
+)
+
+const (
+	// MetricKeyProducerErrors counts messages that the producer
+	// failed to deliver, tagged with the error category and topic.
+	MetricKeyProducerErrors = "kafka.producer_errors_total"
+	// MetricKeyMessagesDelivered counts messages that the brokers
+	// acknowledged.
+	MetricKeyMessagesDelivered = "kafka.messages_delivered_total"
+	// MetricKeyMessagesRequeued counts failed messages that were
+	// queued to be produced again.
+	MetricKeyMessagesRequeued = "kafka.messages_requeued_total"
+	// MetricKeyRetryQueueDropped counts retriable messages that were
+	// dropped because the retry queue was full, or because the sink
+	// stopped before they could be produced again.
+	MetricKeyRetryQueueDropped = "kafka.retry_queue_dropped_total"
+	// MetricKeyMessagesRedirected counts messages sent to the
+	// fallback topic because their own topic doesn't exist.
+	MetricKeyMessagesRedirected = "kafka.messages_redirected_total"
+)
+
+// unknownTopicTTL is how long a topic that the brokers reported as
+// unknown is skipped in favor of the fallback topic, before it is
+// tried again.
+const unknownTopicTTL = 5 * time.Minute
+
+// errorLogSampleRate is how many producer errors are seen for each
+// one that's logged, so that an outage doesn't flood the logs.
+const errorLogSampleRate = 100
+
+// errorCategory classifies a producer error into a tag value with
+// low cardinality.
+func errorCategory(err error) string {
+	switch err {
+	case sarama.ErrTopicAuthorizationFailed, sarama.ErrClusterAuthorizationFailed:
+		return "authorization"
+	case sarama.ErrUnknownTopicOrPartition, sarama.ErrInvalidTopic:
+		return "unknown_topic"
+	case sarama.ErrMessageSizeTooLarge:
+		return "message_too_large"
+	case sarama.ErrRequestTimedOut:
+		return "timeout"
+	case sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition,
+		sarama.ErrNotEnoughReplicas, sarama.ErrNotEnoughReplicasAfterAppend:
+		return "leadership"
+	case sarama.ErrOutOfBrokers, sarama.ErrNetworkException:
+		return "network"
+	}
+	if _, ok := err.(net.Error); ok {
+		return "network"
+	}
+	return "other"
+}
+
+// isRetriable reports whether a message that failed with the error
+// category could succeed if produced again.
+func isRetriable(category string) bool {
+	switch category {
+	case "timeout", "leadership", "network":
+		return true
+	}
+	return false
+}
+
+type producerErrorKey struct {
+	category string
+	topic    string
+}
+
+// deliveryTracker consumes an async producer's Errors and Successes
+// channels, keeping counts that are reported at flush time. If the
+// retry queue is enabled, it also produces messages that failed with
+// a retriable error again, up to a maximum number of attempts. If a
+// fallback topic is set, messages to topics that don't exist are
+// produced to it instead, whether or not the retry queue is enabled.
+type deliveryTracker struct {
+	logger   *logrus.Entry
+	producer sarama.AsyncProducer
+
+	retries       chan *sarama.ProducerMessage
+	maxAttempts   int
+	fallbackTopic string
+
+	// done is closed by stop, which then waits for requeue to
+	// return.
+	done      chan struct{}
+	requeuing sync.WaitGroup
+
+	delivered  int64
+	errorsSeen int64
+	requeued   int64
+	dropped    int64
+
+	mtx           sync.Mutex
+	stopped       bool
+	errors        map[producerErrorKey]int64
+	redirected    map[string]int64
+	unknownTopics map[string]time.Time
+}
+
+// newDeliveryTracker starts tracking deliveries on the producer,
+// which must be configured to return both errors and successes.
+// fallbackTopic may be empty. A retry queue of size 0 disables
+// retries, but the messages redirected to the fallback topic still go
+// through a queue of the default size.
+func newDeliveryTracker(logger *logrus.Entry, producer sarama.AsyncProducer, o *options, fallbackTopic string) *deliveryTracker {
+	d := &deliveryTracker{
+		logger:        logger,
+		producer:      producer,
+		maxAttempts:   o.retryQueueAttempts,
+		fallbackTopic: fallbackTopic,
+		done:          make(chan struct{}),
+		errors:        map[producerErrorKey]int64{},
+		redirected:    map[string]int64{},
+		unknownTopics: map[string]time.Time{},
+	}
+	size := o.retryQueueSize
+	if size <= 0 {
+		d.maxAttempts = 0
+		size = defaultRetryQueueSize
+	}
+	go d.drainSuccesses()
+	go d.drainErrors()
+	if d.maxAttempts > 0 || fallbackTopic != "" {
+		d.retries = make(chan *sarama.ProducerMessage, size)
+		d.requeuing.Add(1)
+		go d.requeue()
+	}
+	return d
+}
+
+// topicKnown reports whether the topic may exist: it returns false
+// if producing to it recently failed because the brokers didn't know
+// it.
+func (d *deliveryTracker) topicKnown(topic string) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	seen, ok := d.unknownTopics[topic]
+	if !ok {
+		return true
+	}
+	if time.Since(seen) > unknownTopicTTL {
+		delete(d.unknownTopics, topic)
+		return true
+	}
+	return false
+}
+
+// countRedirect counts a message for the topic being sent to the
+// fallback topic instead.
+func (d *deliveryTracker) countRedirect(topic string) {
+	d.mtx.Lock()
+	d.redirected[topic]++
+	d.mtx.Unlock()
+}
+
+func (d *deliveryTracker) drainSuccesses() {
+	for range d.producer.Successes() {
+		atomic.AddInt64(&d.delivered, 1)
+	}
+}
+
+func (d *deliveryTracker) drainErrors() {
+	for perr := range d.producer.Errors() {
+		d.handleError(perr)
+	}
+}
+
+func (d *deliveryTracker) handleError(perr *sarama.ProducerError) {
+	category := errorCategory(perr.Err)
+	d.mtx.Lock()
+	d.errors[producerErrorKey{category: category, topic: perr.Msg.Topic}]++
+	d.mtx.Unlock()
+
+	if n := atomic.AddInt64(&d.errorsSeen, 1); n%errorLogSampleRate == 1 {
+		d.logger.WithError(perr.Err).WithFields(logrus.Fields{
+			"topic":    perr.Msg.Topic,
+			"category": category,
+			"seen":     n,
+		}).Error("Failed to produce message to Kafka (logging 1 in every 100 errors)")
+	}
+
+	if d.retries == nil {
+		return
+	}
+	topic := perr.Msg.Topic
+	attempt, _ := perr.Msg.Metadata.(int)
+	switch {
+	case category == "unknown_topic" && d.fallbackTopic != "" && topic != d.fallbackTopic:
+		d.mtx.Lock()
+		d.unknownTopics[topic] = time.Now()
+		d.mtx.Unlock()
+		d.countRedirect(topic)
+		topic = d.fallbackTopic
+	case isRetriable(category) && attempt+1 < d.maxAttempts:
+		attempt++
+	default:
+		return
+	}
+	// The producer owns the message it returned, so produce a copy:
+	msg := &sarama.ProducerMessage{
+		Topic:    topic,
+		Key:      perr.Msg.Key,
+		Value:    perr.Msg.Value,
+		Headers:  perr.Msg.Headers,
+		Metadata: attempt,
+	}
+	// Once the tracker is stopped, requeue only drops what's left in
+	// the retry queue, so nothing more is added to it:
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.stopped {
+		atomic.AddInt64(&d.dropped, 1)
+		return
+	}
+	select {
+	case d.retries <- msg:
+		atomic.AddInt64(&d.requeued, 1)
+	default:
+		atomic.AddInt64(&d.dropped, 1)
+	}
+}
+
+// requeue produces retried messages. It runs separately from
+// drainErrors so that a full Input channel can't stop the producer's
+// errors from being consumed. Once the tracker is stopped, the
+// messages that it can't hand to the producer are dropped.
+func (d *deliveryTracker) requeue() {
+	defer d.requeuing.Done()
+	for {
+		select {
+		case msg := <-d.retries:
+			select {
+			case d.producer.Input() <- msg:
+			case <-d.done:
+				atomic.AddInt64(&d.dropped, 1)
+				d.dropRetries()
+				return
+			}
+		case <-d.done:
+			d.dropRetries()
+			return
+		}
+	}
+}
+
+// dropRetries counts the messages left in the retry queue as dropped.
+func (d *deliveryTracker) dropRetries() {
+	for {
+		select {
+		case <-d.retries:
+			atomic.AddInt64(&d.dropped, 1)
+		default:
+			return
+		}
+	}
+}
+
+// stop stops producing retried messages, and returns once the
+// producer's Input channel is no longer used, so that the producer
+// can be closed.
+func (d *deliveryTracker) stop() {
+	d.mtx.Lock()
+	if d.stopped {
+		d.mtx.Unlock()
+		return
+	}
+	d.stopped = true
+	close(d.done)
+	d.mtx.Unlock()
+	d.requeuing.Wait()
+}
+
+// stopProducer stops the delivery tracker, so that nothing more is
+// sent on the producer's Input channel, and then closes the producer.
+func stopProducer(logger *logrus.Entry, producer sarama.AsyncProducer, delivery *deliveryTracker) {
+	delivery.stop()
+	if err := producer.Close(); err != nil {
+		logger.WithError(err).Warn("Failed to deliver messages while closing the Kafka producer")
+	}
+}
+
+// report adds the counts since the last report to samples, and
+// resets them.
+func (d *deliveryTracker) report(samples *ssf.Samples, tags map[string]string) {
+	samples.Add(
+		ssf.Count(MetricKeyMessagesDelivered, float32(atomic.SwapInt64(&d.delivered, 0)), tags),
+		ssf.Count(MetricKeyMessagesRequeued, float32(atomic.SwapInt64(&d.requeued, 0)), tags),
+		ssf.Count(MetricKeyRetryQueueDropped, float32(atomic.SwapInt64(&d.dropped, 0)), tags),
+	)
+
+	d.mtx.Lock()
+	errors := d.errors
+	d.errors = map[producerErrorKey]int64{}
+	redirected := d.redirected
+	d.redirected = map[string]int64{}
+	d.mtx.Unlock()
+	for key, count := range errors {
+		errTags := map[string]string{"category": key.category, "topic": key.topic}
+		for k, v := range tags {
+			errTags[k] = v
+		}
+		samples.Add(ssf.Count(MetricKeyProducerErrors, float32(count), errTags))
+	}
+	for topic, count := range redirected {
+		redirTags := map[string]string{"topic": topic}
+		for k, v := range tags {
+			redirTags[k] = v
+		}
+		samples.Add(ssf.Count(MetricKeyMessagesRedirected, float32(count), redirTags))
+	}
+}
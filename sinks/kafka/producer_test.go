@@ -0,0 +1,185 @@
+package kafka
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestErrorCategory(t *testing.T) {
+	assert.Equal(t, "authorization", errorCategory(sarama.ErrTopicAuthorizationFailed))
+	assert.Equal(t, "unknown_topic", errorCategory(sarama.ErrUnknownTopicOrPartition))
+	assert.Equal(t, "timeout", errorCategory(sarama.ErrRequestTimedOut))
+	assert.Equal(t, "network", errorCategory(sarama.ErrOutOfBrokers))
+	assert.Equal(t, "other", errorCategory(sarama.ErrInvalidMessage))
+}
+
+// waitFor polls until cond is true, failing the test if it takes
+// too long.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDeliveryTrackerRequeues(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producerMock := mocks.NewAsyncProducer(t, config)
+	defer producerMock.Close()
+
+	// A retriable failure that succeeds on the second attempt, and a
+	// permanent one that isn't retried:
+	producerMock.ExpectInputAndFail(sarama.ErrRequestTimedOut)
+	producerMock.ExpectInputAndSucceed()
+	producerMock.ExpectInputAndFail(sarama.ErrTopicAuthorizationFailed)
+
+	d := newDeliveryTracker(logrus.StandardLogger().WithField("test", t.Name()), producerMock,
+		newOptions([]Option{WithRetryQueue(10, 3)}), "")
+
+	producerMock.Input() <- &sarama.ProducerMessage{Topic: "spans", Value: sarama.StringEncoder("one")}
+	waitFor(t, func() bool { return atomic.LoadInt64(&d.delivered) == 1 })
+	producerMock.Input() <- &sarama.ProducerMessage{Topic: "spans", Value: sarama.StringEncoder("two")}
+	waitFor(t, func() bool { return atomic.LoadInt64(&d.errorsSeen) == 2 })
+
+	samples := &ssf.Samples{}
+	d.report(samples, map[string]string{"sink": "kafka"})
+	counts := map[string]float32{}
+	for _, s := range samples.Batch {
+		key := s.Name
+		if s.Name == MetricKeyProducerErrors {
+			assert.Equal(t, "spans", s.Tags["topic"])
+			key += "." + s.Tags["category"]
+		}
+		counts[key] = s.Value
+	}
+	assert.Equal(t, map[string]float32{
+		MetricKeyMessagesDelivered:                 1,
+		MetricKeyMessagesRequeued:                  1,
+		MetricKeyRetryQueueDropped:                 0,
+		MetricKeyProducerErrors + ".timeout":       1,
+		MetricKeyProducerErrors + ".authorization": 1,
+	}, counts)
+}
+
+func TestDeliveryTrackerRedirectsUnknownTopics(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testDeliveryTrackerRedirects(t, nil)
+	})
+	t.Run("noRetryQueue", func(t *testing.T) {
+		testDeliveryTrackerRedirects(t, []Option{WithRetryQueue(0, 3)})
+	})
+}
+
+func testDeliveryTrackerRedirects(t *testing.T, opts []Option) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producerMock := mocks.NewAsyncProducer(t, config)
+	defer producerMock.Close()
+
+	producerMock.ExpectInputAndFail(sarama.ErrUnknownTopicOrPartition)
+	var redirected []byte
+	producerMock.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+		redirected = val
+		return nil
+	})
+
+	d := newDeliveryTracker(logrus.StandardLogger().WithField("test", t.Name()), producerMock, newOptions(opts), "fallback")
+	producerMock.Input() <- &sarama.ProducerMessage{Topic: "spans-missing", Value: sarama.StringEncoder("one")}
+	waitFor(t, func() bool { return atomic.LoadInt64(&d.delivered) == 1 })
+	assert.Equal(t, "one", string(redirected))
+	assert.False(t, d.topicKnown("spans-missing"))
+	assert.True(t, d.topicKnown("spans-other"))
+
+	samples := &ssf.Samples{}
+	d.report(samples, nil)
+	found := false
+	for _, s := range samples.Batch {
+		if s.Name == MetricKeyMessagesRedirected {
+			found = true
+			assert.Equal(t, float32(1), s.Value)
+			assert.Equal(t, "spans-missing", s.Tags["topic"])
+		}
+	}
+	assert.True(t, found)
+}
+
+// stalledProducer is an AsyncProducer whose Input is never read, like
+// one that can't reach any broker.
+type stalledProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newStalledProducer() *stalledProducer {
+	return &stalledProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+}
+
+func (p *stalledProducer) AsyncClose() {
+	close(p.successes)
+	close(p.errors)
+}
+
+func (p *stalledProducer) Close() error {
+	p.AsyncClose()
+	return nil
+}
+
+func (p *stalledProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *stalledProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *stalledProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+// TestDeliveryTrackerStopsRequeueing ensures that stopping the tracker
+// doesn't wait on a producer that never takes the retried messages,
+// and that they are counted as dropped.
+func TestDeliveryTrackerStopsRequeueing(t *testing.T) {
+	producer := newStalledProducer()
+	d := newDeliveryTracker(logrus.StandardLogger().WithField("test", t.Name()), producer,
+		newOptions([]Option{WithRetryQueue(10, 3)}), "")
+	for i := 0; i < 3; i++ {
+		d.handleError(&sarama.ProducerError{
+			Msg: &sarama.ProducerMessage{Topic: "spans", Value: sarama.StringEncoder("retried")},
+			Err: sarama.ErrRequestTimedOut,
+		})
+	}
+	// one of them is blocked on Input:
+	waitFor(t, func() bool { return len(d.retries) == 2 })
+
+	stopped := make(chan struct{})
+	go func() {
+		stopProducer(d.logger, producer, d)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out stopping the tracker")
+	}
+	assert.Equal(t, int64(3), atomic.LoadInt64(&d.requeued))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&d.dropped))
+
+	// errors that arrive while the producer closes aren't requeued:
+	d.handleError(&sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{Topic: "spans"},
+		Err: sarama.ErrRequestTimedOut,
+	})
+	assert.Equal(t, int64(3), atomic.LoadInt64(&d.requeued))
+	assert.Equal(t, int64(4), atomic.LoadInt64(&d.dropped))
+}
@@ -0,0 +1,78 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SchemaRegistry holds the address and credentials of a Confluent
+// Schema Registry that Avro schemas are registered with.
+type SchemaRegistry struct {
+	URL      string
+	Username string
+	Password string
+}
+
+const schemaRegistryTimeout = 10 * time.Second
+const schemaRegistryAttempts = 5
+const schemaRegistryBackoff = 500 * time.Millisecond
+
+// register registers the schema under the topic's value subject and
+// returns its ID. If the schema is already registered, the registry
+// returns the existing ID.
+func (sr *SchemaRegistry) register(client *http.Client, topic string, schema string) (int32, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	endpoint := strings.TrimRight(sr.URL, "/") + "/subjects/" + url.PathEscape(topic+"-value") + "/versions"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if sr.Username != "" {
+		req.SetBasicAuth(sr.Username, sr.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("schema registry returned %d for subject %s-value: %s", resp.StatusCode, topic, msg)
+	}
+	var result struct {
+		ID int32 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("could not decode schema registry response: %v", err)
+	}
+	return result.ID, nil
+}
+
+// registerWithRetries registers the schema, retrying with a backoff
+// in case the registry is briefly unavailable.
+func (sr *SchemaRegistry) registerWithRetries(client *http.Client, topic string, schema string) (int32, error) {
+	var err error
+	for attempt := 0; attempt < schemaRegistryAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(schemaRegistryBackoff << uint(attempt-1))
+		}
+		var id int32
+		id, err = sr.register(client, topic, schema)
+		if err == nil {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("could not register Avro schema for topic %s after %d attempts: %v", topic, schemaRegistryAttempts, err)
+}
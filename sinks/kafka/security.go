@@ -0,0 +1,166 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+// The SASL mechanisms that the Kafka client can authenticate with.
+const (
+	SASLMechanismPlain       = "PLAIN"
+	SASLMechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLMechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// scramNonce generates the client nonces of the SCRAM exchanges, if
+// it's set. Only tests set it, so that the exchanges are predictable.
+var scramNonce scram.NonceGeneratorFcn
+
+// scramClient runs the client side of a SCRAM exchange with a broker,
+// using the hash function of its mechanism.
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	if scramNonce != nil {
+		client = client.WithNonceGenerator(scramNonce)
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
+
+// Security holds the TLS and SASL settings used when connecting to
+// Kafka brokers.
+type Security struct {
+	// TLSEnabled turns on TLS. It is implied by any of the other
+	// TLS settings being set.
+	TLSEnabled bool
+	// TLSAuthorityCertificate is a PEM-encoded CA certificate
+	// used to verify the brokers. If empty, the system roots are
+	// used.
+	TLSAuthorityCertificate string
+	// TLSCertificate and TLSKey are a PEM-encoded client
+	// certificate and key to present to the brokers.
+	TLSCertificate        string
+	TLSKey                string
+	TLSInsecureSkipVerify bool
+
+	// SASLMechanism enables SASL authentication if non-empty.
+	SASLMechanism string
+	SASLUsername  string
+	// SASLPassword is the password to authenticate with. If
+	// SASLPasswordFile is set instead, the password is read from
+	// that file (with surrounding whitespace trimmed).
+	SASLPassword     string
+	SASLPasswordFile string
+}
+
+func (sec *Security) tlsEnabled() bool {
+	return sec.TLSEnabled || sec.TLSAuthorityCertificate != "" ||
+		sec.TLSCertificate != "" || sec.TLSKey != "" || sec.TLSInsecureSkipVerify
+}
+
+func (sec *Security) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: sec.TLSInsecureSkipVerify}
+	if sec.TLSAuthorityCertificate != "" {
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM([]byte(sec.TLSAuthorityCertificate)) {
+			return nil, errors.New("kafka_tls_authority_certificate: Could not load any certificates")
+		}
+	}
+	if sec.TLSCertificate != "" || sec.TLSKey != "" {
+		if sec.TLSCertificate == "" || sec.TLSKey == "" {
+			return nil, errors.New("kafka_tls_certificate and kafka_tls_key must be set together")
+		}
+		cert, err := tls.X509KeyPair([]byte(sec.TLSCertificate), []byte(sec.TLSKey))
+		if err != nil {
+			return nil, fmt.Errorf("could not load Kafka client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func (sec *Security) password() (string, error) {
+	if sec.SASLPasswordFile == "" {
+		return sec.SASLPassword, nil
+	}
+	if sec.SASLPassword != "" {
+		return "", errors.New("only one of kafka_sasl_password and kafka_sasl_password_file may be set")
+	}
+	pw, err := ioutil.ReadFile(sec.SASLPasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read kafka_sasl_password_file: %v", err)
+	}
+	return strings.TrimSpace(string(pw)), nil
+}
+
+// apply sets the security settings on a sarama producer config,
+// returning an error if they're invalid or unsupported.
+func (sec *Security) apply(config *sarama.Config) error {
+	if sec.tlsEnabled() {
+		tlsConf, err := sec.tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConf
+	}
+
+	if sec.SASLMechanism == "" {
+		return nil
+	}
+	mechanism := strings.ToUpper(sec.SASLMechanism)
+	var hash scram.HashGeneratorFcn
+	switch mechanism {
+	case SASLMechanismPlain:
+	case SASLMechanismSCRAMSHA256:
+		hash = sha256.New
+	case SASLMechanismSCRAMSHA512:
+		hash = sha512.New
+	default:
+		return fmt.Errorf("unsupported kafka_sasl_mechanism %q: must be %s, %s or %s",
+			sec.SASLMechanism, SASLMechanismPlain, SASLMechanismSCRAMSHA256, SASLMechanismSCRAMSHA512)
+	}
+	if sec.SASLUsername == "" {
+		return errors.New("kafka_sasl_username must be set when SASL is enabled")
+	}
+	pw, err := sec.password()
+	if err != nil {
+		return err
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+	if hash != nil {
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: hash}
+		}
+	}
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = sec.SASLUsername
+	config.Net.SASL.Password = pw
+	return config.Validate()
+}
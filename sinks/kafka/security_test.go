@@ -0,0 +1,174 @@
+package kafka
+
+import (
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xdg/scram"
+)
+
+func readFixture(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join("..", "..", "fixtures", name))
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestSecurityTLS(t *testing.T) {
+	sec := Security{
+		TLSAuthorityCertificate: readFixture(t, "cacert.pem"),
+		TLSCertificate:          readFixture(t, "clientcert_correct.pem"),
+		TLSKey:                  readFixture(t, "clientkey.pem"),
+	}
+	config := sarama.NewConfig()
+	require.NoError(t, sec.apply(config))
+	assert.True(t, config.Net.TLS.Enable)
+	assert.NotNil(t, config.Net.TLS.Config.RootCAs)
+	assert.Len(t, config.Net.TLS.Config.Certificates, 1)
+	assert.False(t, config.Net.SASL.Enable)
+}
+
+func TestSecurityTLSErrors(t *testing.T) {
+	tests := map[string]Security{
+		"bad CA":        {TLSAuthorityCertificate: "not a cert"},
+		"cert, no key":  {TLSCertificate: readFixture(t, "clientcert_correct.pem")},
+		"bad key pair":  {TLSCertificate: "nope", TLSKey: "nope"},
+		"GSSAPI":        {SASLMechanism: "GSSAPI", SASLUsername: "u", SASLPassword: "p"},
+		"SCRAM, no pw":  {SASLMechanism: "SCRAM-SHA-512", SASLUsername: "u"},
+		"no username":   {SASLMechanism: "PLAIN", SASLPassword: "p"},
+		"both password": {SASLMechanism: "PLAIN", SASLUsername: "u", SASLPassword: "p", SASLPasswordFile: "/dev/null"},
+		"missing file":  {SASLMechanism: "PLAIN", SASLUsername: "u", SASLPasswordFile: "/nonexistent/veneur/pw"},
+	}
+	for name, sec := range tests {
+		sec := sec
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, sec.apply(sarama.NewConfig()))
+		})
+	}
+}
+
+func TestSecuritySASLPasswordFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "veneur-kafka-pw")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("hunter2\n")
+	f.Close()
+
+	sec := Security{SASLMechanism: "plain", SASLUsername: "veneur", SASLPasswordFile: f.Name()}
+	config := sarama.NewConfig()
+	require.NoError(t, sec.apply(config))
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, "veneur", config.Net.SASL.User)
+	assert.Equal(t, "hunter2", config.Net.SASL.Password)
+}
+
+func TestSecuritySCRAM(t *testing.T) {
+	sec := Security{SASLMechanism: "scram-sha-256", SASLUsername: "veneur", SASLPassword: "hunter2"}
+	config := sarama.NewConfig()
+	require.NoError(t, sec.apply(config))
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA256), config.Net.SASL.Mechanism)
+	require.NotNil(t, config.Net.SASL.SCRAMClientGeneratorFunc)
+	assert.IsType(t, &scramClient{}, config.Net.SASL.SCRAMClientGeneratorFunc())
+}
+
+func TestInvalidSecurityFailsConstruction(t *testing.T) {
+	_, err := NewKafkaMetricSink(logrus.StandardLogger(), nil, "testing", "", "", "testMetricTopic", "all", "hash", 0, 0, 0, "",
+		WithSecurity(Security{SASLMechanism: "GSSAPI"}))
+	assert.Error(t, err)
+	_, err = NewKafkaSpanSink(logrus.StandardLogger(), nil, "testing", "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100,
+		WithSecurity(Security{TLSAuthorityCertificate: "nope"}))
+	assert.Error(t, err)
+}
+
+// TestSASLRejectedByBroker ensures that a broker refusing our SASL
+// mechanism causes Start to fail, rather than leaving the sink
+// without a producer.
+func TestSASLRejectedByBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"SaslHandshakeRequest": sarama.NewMockWrapper(&sarama.SaslHandshakeResponse{
+			Err:               sarama.ErrUnsupportedSASLMechanism,
+			EnabledMechanisms: []string{"SCRAM-SHA-512"},
+		}),
+	})
+
+	sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, broker.Addr(), "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100,
+		WithSecurity(Security{SASLMechanism: "PLAIN", SASLUsername: "veneur", SASLPassword: "hunter2"}))
+	require.NoError(t, err)
+	sink.config.Metadata.Retry.Max = 0
+	assert.Error(t, sink.Start(nil))
+	assert.Nil(t, sink.producer)
+}
+
+// TestSASLSCRAMAuthentication ensures that the sink runs the SCRAM
+// exchange with a broker that only offers SCRAM-SHA-512, and that
+// Start fails if the broker's proof doesn't match the password.
+func TestSASLSCRAMAuthentication(t *testing.T) {
+	scramNonce = func() string { return "veneur-nonce" }
+	defer func() { scramNonce = nil }()
+
+	// With the client's nonce fixed, the exchange only depends on the
+	// password, so the broker's side of it can be computed up front:
+	client, err := scram.HashGeneratorFcn(sha512.New).NewClient("veneur", "hunter2", "")
+	require.NoError(t, err)
+	client = client.WithNonceGenerator(scramNonce)
+	server, err := scram.HashGeneratorFcn(sha512.New).NewServer(func(string) (scram.StoredCredentials, error) {
+		return client.GetStoredCredentials(scram.KeyFactors{Salt: "NaCl", Iters: 4096}), nil
+	})
+	require.NoError(t, err)
+	clientConv, serverConv := client.NewConversation(), server.NewConversation()
+	var challenges []interface{}
+	msg, err := clientConv.Step("")
+	require.NoError(t, err)
+	for !clientConv.Done() {
+		challenge, err := serverConv.Step(msg)
+		require.NoError(t, err)
+		challenges = append(challenges, &sarama.SaslAuthenticateResponse{SaslAuthBytes: []byte(challenge)})
+		msg, err = clientConv.Step(challenge)
+		require.NoError(t, err)
+	}
+	require.True(t, serverConv.Valid())
+
+	for password, ok := range map[string]bool{"hunter2": true, "hunter3": false} {
+		t.Run(password, func(t *testing.T) {
+			broker := sarama.NewMockBroker(t, 1)
+			defer broker.Close()
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"SaslHandshakeRequest": sarama.NewMockSaslHandshakeResponse(t).
+					SetEnabledMechanisms([]string{"SCRAM-SHA-512"}),
+				"SaslAuthenticateRequest": sarama.NewMockSequence(challenges...),
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("testSpanTopic", 0, broker.BrokerID()),
+			})
+
+			sink, err := NewKafkaSpanSink(logrus.StandardLogger(), nil, broker.Addr(), "testSpanTopic", "hash", "all", 0, 0, 0, "", "protobuf", "", 100,
+				WithSecurity(Security{SASLMechanism: "SCRAM-SHA-512", SASLUsername: "veneur", SASLPassword: password}))
+			require.NoError(t, err)
+			sink.config.Metadata.Retry.Max = 0
+			err = sink.Start(nil)
+			if !ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer sink.producer.Close()
+
+			var mechanisms []string
+			for _, rr := range broker.History() {
+				if req, ok := rr.Request.(*sarama.SaslHandshakeRequest); ok {
+					mechanisms = append(mechanisms, req.Mechanism)
+				}
+			}
+			assert.Equal(t, []string{"SCRAM-SHA-512"}, mechanisms)
+		})
+	}
+}
@@ -2,9 +2,12 @@ package lightstep
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,6 +15,7 @@ import (
 	lightstep "github.com/lightstep/lightstep-tracer-go"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	opentracinglog "github.com/opentracing/opentracing-go/log"
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/veneur/protocol"
 	"github.com/stripe/veneur/sinks"
@@ -22,44 +26,125 @@ import (
 
 const indicatorSpanTagName = "indicator"
 
+// traceIDTagName is the tag with the full, hex-encoded trace ID of spans
+// with 128-bit trace IDs. LightStep's trace IDs only have 64 bits, so
+// like other LightStep tracers, the sink sends their low 64 bits.
+const traceIDTagName = "trace_id_128"
+
 const lightstepDefaultPort = 8080
 const lightstepDefaultInterval = 5 * time.Minute
+const lightstepDefaultRefreshPeriod = time.Minute
+const lightstepDialTimeout = 5 * time.Second
 
 var unexpectedCountTypeErr = fmt.Errorf("Received unexpected count type")
 
 // LightStepSpanSink is a sink for spans to be sent to the LightStep client.
 type LightStepSpanSink struct {
+	// tracersMtx guards tracers, which are replaced when the access
+	// token or the reachable collectors change. It's held for reading
+	// while spans are recorded, so that the old tracers only close
+	// (and flush) once they've got every span they'll get.
+	tracersMtx   sync.RWMutex
 	tracers      []opentracing.Tracer
 	mutex        *sync.Mutex
 	serviceCount sync.Map
+	userDropped  int64
 	traceClient  *trace.Client
 	log          *logrus.Logger
+
+	opts        options
+	newTracer   func(lightstep.Options) opentracing.Tracer
+	tracerOpts  lightstep.Options
+	numClients  int
+	collectors  []collector
+	accessToken string
+	// reachable are the collectors that the tracers connect to.
+	reachable  []collector
+	reconnects sync.Map // reason -> *int64
 }
 
-var _ sinks.SpanSink = &LightStepSpanSink{}
+// collector is a LightStep collector (or satellite) that spans can be
+// sent to.
+type collector struct {
+	endpoint lightstep.Endpoint
+	address  string
+}
+
+type options struct {
+	collectors      []string
+	accessTokenFile string
+	refreshPeriod   time.Duration
+	dialTimeout     time.Duration
+}
+
+// Option configures a LightStep span sink.
+type Option func(*options)
+
+// WithCollectors sends spans to several collectors, instead of just
+// the one that the sink is created with. The sink's tracers are spread
+// round-robin over the collectors that are reachable, and are moved
+// off of collectors that become unreachable, checking every refresh
+// period.
+func WithCollectors(hosts []string) Option {
+	return func(o *options) {
+		o.collectors = hosts
+	}
+}
+
+// WithAccessTokenFile reads the access token from a file, instead of
+// taking the one that the sink is created with, and re-reads it every
+// refresh period. When the token changes, the sink's tracers are
+// replaced by ones that use the new token.
+func WithAccessTokenFile(path string) Option {
+	return func(o *options) {
+		o.accessTokenFile = path
+	}
+}
+
+// WithRefreshPeriod sets how often the access token file is re-read,
+// and the collectors are checked, if there's more than one. It
+// defaults to a minute.
+func WithRefreshPeriod(period time.Duration) Option {
+	return func(o *options) {
+		if period > 0 {
+			o.refreshPeriod = period
+		}
+	}
+}
 
 // NewLightStepSpanSink creates a new instance of a LightStepSpanSink.
-func NewLightStepSpanSink(collector string, reconnectPeriod string, maximumSpans int, numClients int, accessToken string, log *logrus.Logger) (*LightStepSpanSink, error) {
-	var host *url.URL
-	host, err := url.Parse(collector)
-	if err != nil {
-		log.WithError(err).WithField(
-			"host", collector,
-		).Error("Error parsing LightStep collector URL")
-		return &LightStepSpanSink{}, err
+func NewLightStepSpanSink(collectorHost string, reconnectPeriod string, maximumSpans int, numClients int, accessToken string, log *logrus.Logger, opts ...Option) (*LightStepSpanSink, error) {
+	o := options{
+		refreshPeriod: lightstepDefaultRefreshPeriod,
+		dialTimeout:   lightstepDialTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	hosts := o.collectors
+	if len(hosts) == 0 {
+		hosts = []string{collectorHost}
+	}
+	collectors := make([]collector, 0, len(hosts))
+	for _, host := range hosts {
+		c, err := parseCollector(host, log)
+		if err != nil {
+			return &LightStepSpanSink{}, err
+		}
+		collectors = append(collectors, c)
 	}
 
-	port, err := strconv.Atoi(host.Port())
-	if err != nil {
-		log.WithError(err).WithFields(logrus.Fields{
-			"port":         port,
-			"default_port": lightstepDefaultPort,
-		}).Warn("Error parsing LightStep port, using default")
-		port = lightstepDefaultPort
+	if o.accessTokenFile != "" {
+		var err error
+		accessToken, err = readAccessToken(o.accessTokenFile)
+		if err != nil {
+			return &LightStepSpanSink{}, err
+		}
 	}
 
 	reconPeriod := lightstepDefaultInterval
 	if reconnectPeriod != "" {
+		var err error
 		reconPeriod, err = time.ParseDuration(reconnectPeriod)
 		if err != nil {
 			log.WithError(err).WithFields(logrus.Fields{
@@ -70,49 +155,198 @@ func NewLightStepSpanSink(collector string, reconnectPeriod string, maximumSpans
 		}
 	}
 
-	log.WithFields(logrus.Fields{
-		"Host": host.Hostname(),
-		"Port": port,
-	}).Info("Dialing lightstep host")
-
 	lightstepMultiplexTracerNum := numClients
 	// If config value is missing, this value should default to one client
 	if lightstepMultiplexTracerNum <= 0 {
 		lightstepMultiplexTracerNum = 1
 	}
 
-	tracers := make([]opentracing.Tracer, 0, lightstepMultiplexTracerNum)
+	ls := &LightStepSpanSink{
+		serviceCount: sync.Map{},
+		mutex:        &sync.Mutex{},
+		log:          log,
+		opts:         o,
+		newTracer: func(opts lightstep.Options) opentracing.Tracer {
+			return lightstep.NewTracer(opts)
+		},
+		tracerOpts: lightstep.Options{
+			ReconnectPeriod:  reconPeriod,
+			UseGRPC:          true,
+			MaxBufferedSpans: maximumSpans,
+		},
+		numClients:  lightstepMultiplexTracerNum,
+		collectors:  collectors,
+		accessToken: accessToken,
+	}
+	ls.reachable = ls.reachableCollectors()
+	ls.tracers = ls.createTracers(ls.accessToken, ls.reachable)
+	return ls, nil
+}
 
-	plaintext := false
-	if host.Scheme == "http" {
-		plaintext = true
+// parseCollector parses the URL of a collector.
+func parseCollector(host string, log *logrus.Logger) (collector, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		log.WithError(err).WithField(
+			"host", host,
+		).Error("Error parsing LightStep collector URL")
+		return collector{}, err
 	}
 
-	for i := 0; i < lightstepMultiplexTracerNum; i++ {
-		tracers = append(tracers, lightstep.NewTracer(lightstep.Options{
-			AccessToken:     accessToken,
-			ReconnectPeriod: reconPeriod,
-			Collector: lightstep.Endpoint{
-				Host:      host.Hostname(),
-				Port:      port,
-				Plaintext: plaintext,
-			},
-			UseGRPC:          true,
-			MaxBufferedSpans: maximumSpans,
-		}))
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"port":         port,
+			"default_port": lightstepDefaultPort,
+		}).Warn("Error parsing LightStep port, using default")
+		port = lightstepDefaultPort
 	}
 
-	return &LightStepSpanSink{
-		tracers:      tracers,
-		serviceCount: sync.Map{},
-		mutex:        &sync.Mutex{},
-		log:          log,
+	return collector{
+		endpoint: lightstep.Endpoint{
+			Host:      u.Hostname(),
+			Port:      port,
+			Plaintext: u.Scheme == "http",
+		},
+		address: net.JoinHostPort(u.Hostname(), strconv.Itoa(port)),
 	}, nil
 }
 
-// Start performs final adjustments on the sink.
+// readAccessToken reads an access token from a file, without any
+// surrounding whitespace.
+func readAccessToken(path string) (string, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(bts))
+	if token == "" {
+		return "", fmt.Errorf("LightStep access token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// createTracers creates the sink's tracers, spread round-robin over the
+// collectors.
+func (ls *LightStepSpanSink) createTracers(accessToken string, collectors []collector) []opentracing.Tracer {
+	tracers := make([]opentracing.Tracer, 0, ls.numClients)
+	for i := 0; i < ls.numClients; i++ {
+		c := collectors[i%len(collectors)]
+		ls.log.WithFields(logrus.Fields{
+			"Host": c.endpoint.Host,
+			"Port": c.endpoint.Port,
+		}).Info("Dialing lightstep host")
+
+		opts := ls.tracerOpts
+		opts.AccessToken = accessToken
+		opts.Collector = c.endpoint
+		tracers = append(tracers, ls.newTracer(opts))
+	}
+	return tracers
+}
+
+// reachableCollectors returns the collectors that accept connections,
+// or all of them, if there's only one or none do: there's nothing to
+// fail over to, so the tracers are left to retry.
+func (ls *LightStepSpanSink) reachableCollectors() []collector {
+	if len(ls.collectors) == 1 {
+		return ls.collectors
+	}
+	var reachable []collector
+	for _, c := range ls.collectors {
+		conn, err := net.DialTimeout("tcp", c.address, ls.opts.dialTimeout)
+		if err != nil {
+			ls.log.WithError(err).WithField("address", c.address).
+				Warn("LightStep collector is unreachable")
+			continue
+		}
+		conn.Close()
+		reachable = append(reachable, c)
+	}
+	if len(reachable) == 0 {
+		return ls.collectors
+	}
+	return reachable
+}
+
+// refresh re-reads the access token, and checks which collectors are
+// reachable. If either changed, it replaces the tracers.
+func (ls *LightStepSpanSink) refresh() {
+	accessToken := ls.accessToken
+	if ls.opts.accessTokenFile != "" {
+		token, err := readAccessToken(ls.opts.accessTokenFile)
+		if err != nil {
+			ls.log.WithError(err).Warn("Couldn't re-read the LightStep access token, keeping the current one")
+		} else {
+			accessToken = token
+		}
+	}
+	reachable := ls.reachableCollectors()
+
+	var reason string
+	switch {
+	case accessToken != ls.accessToken:
+		reason = "access_token"
+	case !sameCollectors(reachable, ls.reachable):
+		reason = "collectors"
+	default:
+		return
+	}
+	ls.accessToken = accessToken
+	ls.reachable = reachable
+	ls.swapTracers(ls.createTracers(accessToken, reachable))
+	ls.countReconnect(reason)
+}
+
+// swapTracers replaces the tracers. The old ones are closed once no
+// span is being recorded with them, which flushes the spans they
+// buffered.
+func (ls *LightStepSpanSink) swapTracers(tracers []opentracing.Tracer) {
+	ls.tracersMtx.Lock()
+	old := ls.tracers
+	ls.tracers = tracers
+	ls.tracersMtx.Unlock()
+	for _, tracer := range old {
+		go func(tracer opentracing.Tracer) {
+			if err := lightstep.CloseTracer(tracer); err != nil {
+				ls.log.WithError(err).Warn("Couldn't close a replaced LightStep tracer")
+			}
+		}(tracer)
+	}
+}
+
+func (ls *LightStepSpanSink) countReconnect(reason string) {
+	count, ok := ls.reconnects.Load(reason)
+	if !ok {
+		count, _ = ls.reconnects.LoadOrStore(reason, new(int64))
+	}
+	atomic.AddInt64(count.(*int64), 1)
+}
+
+func sameCollectors(a, b []collector) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Start performs final adjustments on the sink. If the access token is
+// read from a file, or there are several collectors, it starts
+// refreshing them.
 func (ls *LightStepSpanSink) Start(cl *trace.Client) error {
 	ls.traceClient = cl
+	if ls.opts.accessTokenFile != "" || len(ls.collectors) > 1 {
+		go func() {
+			for range time.Tick(ls.opts.refreshPeriod) {
+				ls.refresh()
+			}
+		}()
+	}
 	return nil
 }
 
@@ -127,6 +361,10 @@ func (ls *LightStepSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 	if err := protocol.ValidateTrace(ssfSpan); err != nil {
 		return err
 	}
+	if sinks.PriorityDropped(ssfSpan) {
+		atomic.AddInt64(&ls.userDropped, 1)
+		return nil
+	}
 
 	parentID := ssfSpan.ParentId
 	if parentID <= 0 {
@@ -140,13 +378,15 @@ func (ls *LightStepSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 
 	timestamp := time.Unix(ssfSpan.StartTimestamp/1e9, ssfSpan.StartTimestamp%1e9)
 
+	ls.tracersMtx.RLock()
+	defer ls.tracersMtx.RUnlock()
 	if len(ls.tracers) == 0 {
 		err := fmt.Errorf("No lightstep tracer clients initialized")
 		ls.log.Error(err)
 		return err
 	}
 	// pick the tracer to use
-	tracerIndex := ssfSpan.TraceId % int64(len(ls.tracers))
+	tracerIndex := uint64(ssfSpan.TraceId^ssfSpan.TraceIdHigh) % uint64(len(ls.tracers))
 	tracer := ls.tracers[tracerIndex]
 
 	sp := tracer.StartSpan(
@@ -159,6 +399,9 @@ func (ls *LightStepSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 	sp.SetTag(trace.ResourceKey, ssfSpan.Tags[trace.ResourceKey]) // TODO Why is this here?
 	sp.SetTag(lightstep.ComponentNameKey, ssfSpan.Service)
 	sp.SetTag(indicatorSpanTagName, strconv.FormatBool(ssfSpan.Indicator))
+	if ssfSpan.TraceIdHigh != 0 {
+		sp.SetTag(traceIDTagName, ssf.TraceIDHex(ssfSpan))
+	}
 	// TODO don't hardcode
 	sp.SetTag("type", "http")
 	sp.SetTag("error-code", errorCode)
@@ -172,9 +415,24 @@ func (ls *LightStepSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 		// LightStep uses to flag error spans.
 		ext.Error.Set(sp, true)
 	}
+	if sinks.PriorityKept(ssfSpan) {
+		ext.SamplingPriority.Set(sp, 1)
+	}
 
 	endTime := time.Unix(ssfSpan.EndTimestamp/1e9, ssfSpan.EndTimestamp%1e9)
 	finishOpts := opentracing.FinishOptions{FinishTime: endTime}
+	// span events are LightStep's span logs:
+	for _, event := range ssfSpan.Events {
+		fields := make([]opentracinglog.Field, 0, len(event.Tags)+1)
+		fields = append(fields, opentracinglog.String("event", event.Name))
+		for k, v := range event.Tags {
+			fields = append(fields, opentracinglog.String(k, v))
+		}
+		finishOpts.LogRecords = append(finishOpts.LogRecords, opentracing.LogRecord{
+			Timestamp: time.Unix(0, event.Timestamp),
+			Fields:    fields,
+		})
+	}
 	sp.FinishWithOptions(finishOpts)
 
 	service := ssfSpan.Service
@@ -238,5 +496,17 @@ func (ls *LightStepSpanSink) Flush() {
 		return true
 	})
 
+	ls.reconnects.Range(func(reason, count interface{}) bool {
+		if n := atomic.SwapInt64(count.(*int64), 0); n > 0 {
+			samples.Add(ssf.Count("lightstep.tracer_reconnects_total", float32(n),
+				map[string]string{"sink": ls.Name(), "reason": reason.(string)}))
+		}
+		return true
+	})
+	if dropped := atomic.SwapInt64(&ls.userDropped, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(dropped),
+			map[string]string{"sink": ls.Name(), "reason": sinks.SkipReasonUserDrop}))
+	}
+
 	ls.log.WithField("total_spans", totalCount).Debug("Checkpointing flushed spans for Lightstep")
 }
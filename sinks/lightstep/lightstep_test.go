@@ -1,15 +1,21 @@
 package lightstep
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	lightstep "github.com/lightstep/lightstep-tracer-go"
 	opentracing "github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/sirupsen/logrus"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/ssf"
 )
 
@@ -142,3 +148,94 @@ func TestLSSpanSinkIngest(t *testing.T) {
 		assert.Contains(t, span.tags, "baz")
 	}
 }
+
+// fakeTracers makes the sink create test tracers, and returns the
+// options of each one it creates.
+func fakeTracers(ls *LightStepSpanSink) *[]lightstep.Options {
+	created := &[]lightstep.Options{}
+	ls.newTracer = func(opts lightstep.Options) opentracing.Tracer {
+		*created = append(*created, opts)
+		return &testLSTracer{}
+	}
+	return created
+}
+
+func reconnects(ls *LightStepSpanSink, reason string) int64 {
+	count, ok := ls.reconnects.Load(reason)
+	if !ok {
+		return 0
+	}
+	return *count.(*int64)
+}
+
+func TestLSSinkAccessTokenFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "veneur-lightstep-token")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("first\n"), 0600))
+
+	ls, err := NewLightStepSpanSink("http://example.com", "5m", 1000, 2, "", logrus.New(),
+		WithAccessTokenFile(f.Name()))
+	require.NoError(t, err)
+	assert.Equal(t, "first", ls.accessToken)
+	created := fakeTracers(ls)
+
+	// Nothing changed, so the tracers stay:
+	ls.refresh()
+	assert.Empty(t, *created)
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("second\n"), 0600))
+	ls.refresh()
+	require.Len(t, *created, 2)
+	for _, opts := range *created {
+		assert.Equal(t, "second", opts.AccessToken)
+	}
+	assert.Len(t, ls.tracers, 2)
+	assert.Equal(t, int64(1), reconnects(ls, "access_token"))
+
+	// A token that can't be read leaves the current one:
+	require.NoError(t, ioutil.WriteFile(f.Name(), nil, 0600))
+	ls.refresh()
+	assert.Equal(t, "second", ls.accessToken)
+	assert.Len(t, *created, 2)
+
+	_, err = NewLightStepSpanSink("http://example.com", "5m", 1000, 1, "", logrus.New(),
+		WithAccessTokenFile(f.Name()))
+	assert.Error(t, err, "an empty token file should be an error")
+}
+
+func TestLSSinkCollectorFailover(t *testing.T) {
+	var listeners []net.Listener
+	var hosts []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		listeners = append(listeners, l)
+		hosts = append(hosts, "http://"+l.Addr().String())
+	}
+
+	ls, err := NewLightStepSpanSink("", "5m", 1000, 2, "secret", logrus.New(),
+		WithCollectors(hosts))
+	require.NoError(t, err)
+	require.Len(t, ls.reachable, 2)
+	created := fakeTracers(ls)
+
+	// The second collector goes away, so both tracers move to the
+	// first:
+	listeners[1].Close()
+	ls.refresh()
+	require.Len(t, *created, 2)
+	for _, opts := range *created {
+		assert.Equal(t, listeners[0].Addr().String(), net.JoinHostPort(opts.Collector.Host, strconv.Itoa(opts.Collector.Port)))
+		assert.Equal(t, "secret", opts.AccessToken)
+	}
+	assert.Equal(t, int64(1), reconnects(ls, "collectors"))
+
+	// When none is reachable, there's nothing to fail over to, so
+	// the tracers are spread over all of them again, to retry:
+	listeners[0].Close()
+	ls.refresh()
+	assert.Len(t, ls.reachable, 2)
+	assert.Equal(t, int64(2), reconnects(ls, "collectors"))
+}
@@ -0,0 +1,333 @@
+package newrelic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// The Metric API endpoints of New Relic's regions.
+const (
+	USEndpoint = "https://metric-api.newrelic.com/metric/v1"
+	EUEndpoint = "https://metric-api.eu.newrelic.com/metric/v1"
+)
+
+// maxPayloadBytes is the most that the Metric API takes in one
+// request, once compressed.
+const maxPayloadBytes = 1000000
+
+// maxAttempts bounds how many times a payload is sent, while New Relic
+// throttles it. defaultRetryAfter is how long to wait if it doesn't say.
+const (
+	maxAttempts       = 3
+	defaultRetryAfter = time.Second
+)
+
+// hostNameKey is the attribute with the host of the metrics.
+const hostNameKey = "host.name"
+
+// The types of New Relic's metrics.
+const (
+	typeCount = "count"
+	typeGauge = "gauge"
+)
+
+// metric is a metric of the Metric API.
+type metric struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+	IntervalMs int64             `json:"interval.ms,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// payload is a group of metrics, with the attributes they have in
+// common. The Metric API takes a list of them.
+type payload struct {
+	Common  common   `json:"common"`
+	Metrics []metric `json:"metrics"`
+}
+
+type common struct {
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// MetricSink sends metrics to New Relic's Metric API.
+type MetricSink struct {
+	endpoint     string
+	insertKey    string
+	hostname     string
+	interval     time.Duration
+	payloadLimit int
+	excludedTags map[string]struct{}
+
+	client *http.Client
+	// throttled counts the requests that New Relic throttled.
+	throttled int64
+
+	traceClient *trace.Client
+	log         *logrus.Logger
+}
+
+var _ sinks.MetricSink = &MetricSink{}
+
+// NewMetricSink creates a sink that sends metrics to the Metric API of
+// a New Relic region, "us" (the default) or "eu", authenticated with an
+// insert key. The metrics are flushed every interval, from a veneur on
+// hostname.
+func NewMetricSink(insertKey, region, hostname string, interval time.Duration, client *http.Client, log *logrus.Logger) (*MetricSink, error) {
+	if insertKey == "" {
+		return nil, fmt.Errorf("new relic needs an insert key")
+	}
+	var endpoint string
+	switch strings.ToLower(region) {
+	case "", "us":
+		endpoint = USEndpoint
+	case "eu":
+		endpoint = EUEndpoint
+	default:
+		return nil, fmt.Errorf("unknown new relic region %q", region)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &MetricSink{
+		endpoint:     endpoint,
+		insertKey:    insertKey,
+		hostname:     hostname,
+		interval:     interval,
+		payloadLimit: maxPayloadBytes,
+		client:       client,
+		log:          log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (*MetricSink) Name() string {
+	return "newrelic"
+}
+
+// Start sets the sink up.
+func (s *MetricSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (s *MetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	s.excludedTags = tagsSet
+}
+
+// FlushOtherSamples is a no-op; events and service checks aren't
+// metrics.
+func (s *MetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// Flush converts the metrics, and sends them in gzip-compressed
+// payloads small enough for the Metric API.
+func (s *MetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, subCtx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(s.traceClient)
+	flushStart := time.Now()
+
+	metrics, skipped := s.convert(interMetrics)
+	tags := map[string]string{"sink": s.Name()}
+	span.Add(ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(skipped), tags))
+	defer func() {
+		span.Add(ssf.Count("newrelic.throttled_requests_total", float32(atomic.SwapInt64(&s.throttled, 0)), tags))
+	}()
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	bodies, err := s.compress(metrics)
+	if err != nil {
+		span.Error(err)
+		return err
+	}
+	flushed := 0
+	for _, body := range bodies {
+		if err := s.post(subCtx, body.data); err != nil {
+			span.Error(err)
+			span.Add(ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(flushed), tags))
+			s.log.WithError(err).WithField("metrics", len(metrics)-flushed).Warn("Could not send metrics to New Relic")
+			return err
+		}
+		flushed += body.metrics
+	}
+
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(flushed), tags),
+	)
+	s.log.WithField("metrics", flushed).Info("Completed flush to New Relic")
+	return nil
+}
+
+// convert turns the metrics that the sink takes into New Relic's, and
+// returns them with the number of others. Counters become counts over
+// the flush interval, and gauges, including the percentiles of
+// histograms, gauges. Tags become attributes, except excluded ones; tags
+// without a value have an empty one.
+func (s *MetricSink) convert(interMetrics []samplers.InterMetric) ([]metric, int) {
+	metrics := make([]metric, 0, len(interMetrics))
+	skipped := 0
+	intervalMs := int64(s.interval / time.Millisecond)
+	for _, im := range interMetrics {
+		if !sinks.IsAcceptableMetric(im, s) {
+			skipped++
+			continue
+		}
+		m := metric{
+			Name:      im.Name,
+			Value:     im.Value,
+			Timestamp: im.Timestamp * 1000,
+		}
+		switch im.Type {
+		case samplers.CounterMetric:
+			// Counts are timestamped with the start of their
+			// interval:
+			m.Type = typeCount
+			m.Timestamp -= intervalMs
+			m.IntervalMs = intervalMs
+		case samplers.GaugeMetric:
+			m.Type = typeGauge
+		default:
+			skipped++
+			continue
+		}
+		if len(im.Tags) > 0 || (im.HostName != "" && im.HostName != s.hostname) {
+			m.Attributes = make(map[string]string, len(im.Tags)+1)
+			if im.HostName != "" && im.HostName != s.hostname {
+				m.Attributes[hostNameKey] = im.HostName
+			}
+			for _, tag := range im.Tags {
+				k, v := tag, ""
+				if i := strings.IndexByte(tag, ':'); i >= 0 {
+					k, v = tag[:i], tag[i+1:]
+				}
+				if _, excluded := s.excludedTags[k]; excluded {
+					continue
+				}
+				m.Attributes[k] = v
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, skipped
+}
+
+// compressedBody is a payload, ready to be sent.
+type compressedBody struct {
+	data    []byte
+	metrics int
+}
+
+// compress encodes the metrics into gzip-compressed payloads, halving
+// them until each fits in the sink's payload limit.
+func (s *MetricSink) compress(metrics []metric) ([]compressedBody, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	p := payload{Metrics: metrics}
+	if s.hostname != "" {
+		p.Common.Attributes = map[string]string{hostNameKey: s.hostname}
+	}
+	if err := json.NewEncoder(gz).Encode([]payload{p}); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() <= s.payloadLimit || len(metrics) == 1 {
+		return []compressedBody{{data: buf.Bytes(), metrics: len(metrics)}}, nil
+	}
+
+	half := len(metrics) / 2
+	first, err := s.compress(metrics[:half])
+	if err != nil {
+		return nil, err
+	}
+	second, err := s.compress(metrics[half:])
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// post sends a payload to New Relic. If New Relic throttles it, it's
+// sent again once the Retry-After that New Relic responded with has
+// passed, up to maxAttempts times in all.
+func (s *MetricSink) post(ctx context.Context, body []byte) error {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Api-Key", s.insertKey)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("User-Agent", "veneur")
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == maxAttempts {
+			return fmt.Errorf("new relic returned %d: %s", resp.StatusCode, msg)
+		}
+
+		atomic.AddInt64(&s.throttled, 1)
+		wait := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		s.log.WithField("retry_after", wait).Debug("New Relic throttled metrics, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryAfter returns how long a Retry-After header asks clients to
+// wait, given in seconds or as an HTTP date, or defaultRetryAfter if it
+// doesn't say.
+func retryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return defaultRetryAfter
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if wait := t.Sub(now); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
@@ -0,0 +1,161 @@
+package newrelic
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+// metricAPI is a fake Metric API, which responds to each request with
+// the next of its statuses, once they're used up with 202.
+func metricAPI(t *testing.T, payloads chan<- []payload, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "insert-key", r.Header.Get("Api-Key"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var ps []payload
+		require.NoError(t, json.NewDecoder(gz).Decode(&ps))
+		payloads <- ps
+
+		status := http.StatusAccepted
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	}))
+}
+
+func testSink(t *testing.T, url string) *MetricSink {
+	sink, err := NewMetricSink("insert-key", "", "veneur-1", 10*time.Second, nil, logrus.New())
+	require.NoError(t, err)
+	sink.endpoint = url
+	require.NoError(t, sink.Start(nil))
+	return sink
+}
+
+func TestNewMetricSink(t *testing.T) {
+	sink, err := NewMetricSink("insert-key", "EU", "", time.Second, nil, logrus.New())
+	require.NoError(t, err)
+	assert.Equal(t, EUEndpoint, sink.endpoint)
+	sink, err = NewMetricSink("insert-key", "us", "", time.Second, nil, logrus.New())
+	require.NoError(t, err)
+	assert.Equal(t, USEndpoint, sink.endpoint)
+
+	_, err = NewMetricSink("insert-key", "mars", "", time.Second, nil, logrus.New())
+	assert.Error(t, err)
+	_, err = NewMetricSink("", "us", "", time.Second, nil, logrus.New())
+	assert.Error(t, err)
+}
+
+func TestFlushMetrics(t *testing.T) {
+	payloads := make(chan []payload, 10)
+	srv := metricAPI(t, payloads)
+	defer srv.Close()
+	sink := testSink(t, srv.URL)
+	sink.SetExcludedTags([]string{"secret"})
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "requests", Timestamp: 1000, Value: 5, Tags: []string{"farm:sunny", "barn", "secret:moo"}, Type: samplers.CounterMetric},
+		{Name: "latency.99percentile", Timestamp: 1000, Value: 0.25, Type: samplers.GaugeMetric, HostName: "other"},
+		{Name: "farm.ok", Timestamp: 1000, Type: samplers.StatusMetric},
+	}))
+	ps := <-payloads
+	require.Len(t, ps, 1)
+	assert.Equal(t, map[string]string{"host.name": "veneur-1"}, ps[0].Common.Attributes)
+	assert.Equal(t, []metric{
+		{
+			Name:       "requests",
+			Type:       "count",
+			Value:      5,
+			Timestamp:  990000,
+			IntervalMs: 10000,
+			Attributes: map[string]string{"farm": "sunny", "barn": ""},
+		},
+		{
+			Name:       "latency.99percentile",
+			Type:       "gauge",
+			Value:      0.25,
+			Timestamp:  1000000,
+			Attributes: map[string]string{"host.name": "other"},
+		},
+	}, ps[0].Metrics)
+}
+
+func TestFlushChunks(t *testing.T) {
+	payloads := make(chan []payload, 100)
+	srv := metricAPI(t, payloads)
+	defer srv.Close()
+	sink := testSink(t, srv.URL)
+	sink.payloadLimit = 500
+
+	var metrics []samplers.InterMetric
+	for i := 0; i < 50; i++ {
+		metrics = append(metrics, samplers.InterMetric{
+			Name:      fmt.Sprintf("metric.%d", i),
+			Timestamp: 1000,
+			Value:     float64(i),
+			Tags:      []string{fmt.Sprintf("id:%d", i*7919)},
+			Type:      samplers.GaugeMetric,
+		})
+	}
+	bodies, err := sink.compress(mustConvert(sink, metrics))
+	require.NoError(t, err)
+	require.True(t, len(bodies) > 1)
+	for _, body := range bodies {
+		assert.True(t, len(body.data) <= 500, "%d bytes", len(body.data))
+	}
+
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	seen := 0
+	for range bodies {
+		seen += len((<-payloads)[0].Metrics)
+	}
+	assert.Equal(t, 50, seen)
+	assert.Empty(t, payloads)
+}
+
+func mustConvert(sink *MetricSink, interMetrics []samplers.InterMetric) []metric {
+	metrics, _ := sink.convert(interMetrics)
+	return metrics
+}
+
+func TestFlushThrottled(t *testing.T) {
+	payloads := make(chan []payload, 10)
+	srv := metricAPI(t, payloads, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusAccepted,
+		http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests)
+	defer srv.Close()
+	sink := testSink(t, srv.URL)
+	metrics := []samplers.InterMetric{{Name: "cows", Timestamp: 1000, Value: 1, Type: samplers.GaugeMetric}}
+
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	assert.Len(t, payloads, 3)
+
+	// Gives up after maxAttempts:
+	err := sink.Flush(context.Background(), metrics)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "429")
+	assert.Len(t, payloads, 6)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, retryAfter("30", now))
+	assert.Equal(t, 2*time.Minute, retryAfter(now.Add(2*time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), retryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, defaultRetryAfter, retryAfter("", now))
+	assert.Equal(t, defaultRetryAfter, retryAfter("soon", now))
+}
@@ -0,0 +1,140 @@
+package otlpmetric
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// The messages below are those of the OTLP metrics service, version 1
+// (https://github.com/open-telemetry/opentelemetry-proto), with only
+// the fields that the sink uses. They're declared by hand, with the
+// same field numbers and wire types, as the generated ones need a newer
+// protobuf runtime than the one vendored here.
+// TestNewExportRequestFixture checks their encoding against a request
+// that the generated types decode.
+//
+// The members of OTLP's oneofs are declared as pointers, which are
+// encoded the same as a oneof with that member set, even if its value
+// is zero.
+
+// exportMetricsMethod is the RPC that exports metrics to an OTLP
+// receiver over gRPC.
+const exportMetricsMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// aggregationTemporalityDelta marks sums of what happened during their
+// interval only.
+const aggregationTemporalityDelta int32 = 1
+
+type exportMetricsServiceRequest struct {
+	ResourceMetrics []*resourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics,json=resourceMetrics" json:"resource_metrics,omitempty"`
+}
+
+func (m *exportMetricsServiceRequest) Reset()         { *m = exportMetricsServiceRequest{} }
+func (m *exportMetricsServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*exportMetricsServiceRequest) ProtoMessage()    {}
+
+type exportMetricsServiceResponse struct {
+	PartialSuccess *exportMetricsPartialSuccess `protobuf:"bytes,1,opt,name=partial_success,json=partialSuccess" json:"partial_success,omitempty"`
+}
+
+func (m *exportMetricsServiceResponse) Reset()         { *m = exportMetricsServiceResponse{} }
+func (m *exportMetricsServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*exportMetricsServiceResponse) ProtoMessage()    {}
+
+type exportMetricsPartialSuccess struct {
+	RejectedDataPoints int64  `protobuf:"varint,1,opt,name=rejected_data_points,json=rejectedDataPoints,proto3" json:"rejected_data_points,omitempty"`
+	ErrorMessage       string `protobuf:"bytes,2,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
+}
+
+func (m *exportMetricsPartialSuccess) Reset()         { *m = exportMetricsPartialSuccess{} }
+func (m *exportMetricsPartialSuccess) String() string { return proto.CompactTextString(m) }
+func (*exportMetricsPartialSuccess) ProtoMessage()    {}
+
+type resourceMetrics struct {
+	Resource     *resource       `protobuf:"bytes,1,opt,name=resource" json:"resource,omitempty"`
+	ScopeMetrics []*scopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics,json=scopeMetrics" json:"scope_metrics,omitempty"`
+}
+
+func (m *resourceMetrics) Reset()         { *m = resourceMetrics{} }
+func (m *resourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*resourceMetrics) ProtoMessage()    {}
+
+type resource struct {
+	Attributes []*keyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+func (m *resource) Reset()         { *m = resource{} }
+func (m *resource) String() string { return proto.CompactTextString(m) }
+func (*resource) ProtoMessage()    {}
+
+type scopeMetrics struct {
+	Scope   *instrumentationScope `protobuf:"bytes,1,opt,name=scope" json:"scope,omitempty"`
+	Metrics []*metric             `protobuf:"bytes,2,rep,name=metrics" json:"metrics,omitempty"`
+}
+
+func (m *scopeMetrics) Reset()         { *m = scopeMetrics{} }
+func (m *scopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*scopeMetrics) ProtoMessage()    {}
+
+type instrumentationScope struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+}
+
+func (m *instrumentationScope) Reset()         { *m = instrumentationScope{} }
+func (m *instrumentationScope) String() string { return proto.CompactTextString(m) }
+func (*instrumentationScope) ProtoMessage()    {}
+
+type metric struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Gauge *gauge `protobuf:"bytes,5,opt,name=gauge" json:"gauge,omitempty"`
+	Sum   *sum   `protobuf:"bytes,7,opt,name=sum" json:"sum,omitempty"`
+}
+
+func (m *metric) Reset()         { *m = metric{} }
+func (m *metric) String() string { return proto.CompactTextString(m) }
+func (*metric) ProtoMessage()    {}
+
+type gauge struct {
+	DataPoints []*numberDataPoint `protobuf:"bytes,1,rep,name=data_points,json=dataPoints" json:"data_points,omitempty"`
+}
+
+func (m *gauge) Reset()         { *m = gauge{} }
+func (m *gauge) String() string { return proto.CompactTextString(m) }
+func (*gauge) ProtoMessage()    {}
+
+type sum struct {
+	DataPoints             []*numberDataPoint `protobuf:"bytes,1,rep,name=data_points,json=dataPoints" json:"data_points,omitempty"`
+	AggregationTemporality int32              `protobuf:"varint,2,opt,name=aggregation_temporality,json=aggregationTemporality,proto3" json:"aggregation_temporality,omitempty"`
+	IsMonotonic            bool               `protobuf:"varint,3,opt,name=is_monotonic,json=isMonotonic,proto3" json:"is_monotonic,omitempty"`
+}
+
+func (m *sum) Reset()         { *m = sum{} }
+func (m *sum) String() string { return proto.CompactTextString(m) }
+func (*sum) ProtoMessage()    {}
+
+type numberDataPoint struct {
+	StartTimeUnixNano uint64      `protobuf:"fixed64,2,opt,name=start_time_unix_nano,json=startTimeUnixNano,proto3" json:"start_time_unix_nano,omitempty"`
+	TimeUnixNano      uint64      `protobuf:"fixed64,3,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"time_unix_nano,omitempty"`
+	AsDouble          *float64    `protobuf:"fixed64,4,opt,name=as_double,json=asDouble" json:"as_double,omitempty"`
+	Attributes        []*keyValue `protobuf:"bytes,7,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+func (m *numberDataPoint) Reset()         { *m = numberDataPoint{} }
+func (m *numberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*numberDataPoint) ProtoMessage()    {}
+
+type keyValue struct {
+	Key   string    `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value *anyValue `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+}
+
+func (m *keyValue) Reset()         { *m = keyValue{} }
+func (m *keyValue) String() string { return proto.CompactTextString(m) }
+func (*keyValue) ProtoMessage()    {}
+
+type anyValue struct {
+	StringValue *string `protobuf:"bytes,1,opt,name=string_value,json=stringValue" json:"string_value,omitempty"`
+}
+
+func (m *anyValue) Reset()         { *m = anyValue{} }
+func (m *anyValue) String() string { return proto.CompactTextString(m) }
+func (*anyValue) ProtoMessage()    {}
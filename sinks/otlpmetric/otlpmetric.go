@@ -0,0 +1,425 @@
+package otlpmetric
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	promsink "github.com/stripe/veneur/sinks/prometheus"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// The protocols that metrics can be exported with.
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+)
+
+// httpMetricsPath is where OTLP/HTTP receivers take metrics, if the
+// endpoint doesn't say otherwise.
+const httpMetricsPath = "/v1/metrics"
+
+const (
+	defaultTimeout   = 10 * time.Second
+	defaultBatchSize = 5000
+)
+
+// The attributes of the resource that metrics are exported with, the
+// name of their instrumentation scope, and the attribute that carries
+// the quantile of veneur's percentiles.
+const (
+	serviceNameKey = "service.name"
+	hostNameKey    = "host.name"
+	scopeName      = "veneur"
+	quantileKey    = "quantile"
+)
+
+// Option configures an OTLP metric sink.
+type Option func(*options)
+
+type options struct {
+	tlsConfig *tls.Config
+	tlsErr    error
+	headers   map[string]string
+	timeout   time.Duration
+	batchSize int
+}
+
+// WithTLS sets the PEM-encoded certificates that the sink connects to
+// the receiver with: the authority that the receiver's certificate is
+// verified with, if not the system's, and a client certificate and key.
+// Any of them may be empty.
+func WithTLS(authorityCert, cert, key string) Option {
+	return func(o *options) {
+		conf := &tls.Config{}
+		if authorityCert != "" {
+			conf.RootCAs = x509.NewCertPool()
+			if !conf.RootCAs.AppendCertsFromPEM([]byte(authorityCert)) {
+				o.tlsErr = errors.New("could not load any authority certificates")
+				return
+			}
+		}
+		if cert != "" || key != "" {
+			pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+			if err != nil {
+				o.tlsErr = err
+				return
+			}
+			conf.Certificates = []tls.Certificate{pair}
+		}
+		o.tlsConfig = conf
+	}
+}
+
+// WithInsecure connects to a gRPC receiver without TLS. Over HTTP, the
+// scheme of the endpoint decides.
+func WithInsecure() Option {
+	return func(o *options) {
+		o.tlsConfig = nil
+	}
+}
+
+// WithHeaders sets headers that are sent with every export, e.g. to
+// authenticate with the receiver.
+func WithHeaders(headers map[string]string) Option {
+	return func(o *options) {
+		o.headers = headers
+	}
+}
+
+// WithTimeout bounds each export.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.timeout = timeout
+		}
+	}
+}
+
+// WithBatchSize sets the most metrics exported in one request.
+func WithBatchSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.batchSize = size
+		}
+	}
+}
+
+// MetricSink exports veneur's flushed metrics to an OpenTelemetry
+// receiver, like a collector, over OTLP/gRPC or OTLP/HTTP.
+type MetricSink struct {
+	endpoint string
+	protocol string
+	hostname string
+	interval time.Duration
+	opts     options
+
+	httpClient   *http.Client
+	conn         *grpc.ClientConn
+	excludedTags map[string]struct{}
+
+	traceClient *trace.Client
+	log         *logrus.Logger
+}
+
+var _ sinks.MetricSink = &MetricSink{}
+
+// NewMetricSink creates a sink that exports metrics to endpoint with
+// protocol, ProtocolHTTP if it's empty. Over gRPC, the endpoint is a
+// host:port; over HTTP, it's a URL, which httpMetricsPath is added to
+// if it has no path. The metrics are flushed every interval, from a
+// veneur on hostname.
+func NewMetricSink(endpoint, protocol, hostname string, interval time.Duration, log *logrus.Logger, opts ...Option) (*MetricSink, error) {
+	o := options{
+		tlsConfig: &tls.Config{},
+		timeout:   defaultTimeout,
+		batchSize: defaultBatchSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.tlsErr != nil {
+		return nil, o.tlsErr
+	}
+	s := &MetricSink{
+		endpoint: endpoint,
+		protocol: protocol,
+		hostname: hostname,
+		interval: interval,
+		opts:     o,
+		log:      log,
+	}
+
+	switch protocol {
+	case "", ProtocolHTTP:
+		s.protocol = ProtocolHTTP
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = httpMetricsPath
+		}
+		s.endpoint = u.String()
+		s.httpClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: o.tlsConfig,
+		}}
+	case ProtocolGRPC:
+		dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+		if o.tlsConfig != nil {
+			dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(o.tlsConfig))}
+		}
+		conn, err := grpc.Dial(endpoint, dialOpts...)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q", protocol)
+	}
+	return s, nil
+}
+
+// Name returns the name of this sink.
+func (*MetricSink) Name() string {
+	return "otlp"
+}
+
+// Start sets the sink up.
+func (s *MetricSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will not be turned into attributes.
+func (s *MetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	s.excludedTags = tagsSet
+}
+
+// FlushOtherSamples is a no-op; events and service checks have no OTLP
+// metric representation.
+func (s *MetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// Flush converts the metrics, and exports them in batches. Data points
+// that the receiver rejects, while accepting the others, are logged and
+// counted.
+func (s *MetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, subCtx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(s.traceClient)
+	flushStart := time.Now()
+
+	accepted := make([]samplers.InterMetric, 0, len(interMetrics))
+	for _, m := range interMetrics {
+		if sinks.IsAcceptableMetric(m, s) && m.Type != samplers.StatusMetric {
+			accepted = append(accepted, m)
+		}
+	}
+	tags := map[string]string{"sink": s.Name()}
+	span.Add(ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(len(interMetrics)-len(accepted)), tags))
+
+	var rejected int64
+	for start := 0; start < len(accepted); start += s.opts.batchSize {
+		end := start + s.opts.batchSize
+		if end > len(accepted) {
+			end = len(accepted)
+		}
+		resp, err := s.export(subCtx, s.newExportRequest(accepted[start:end]))
+		if err != nil {
+			span.Error(err)
+			span.Add(ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(int64(start)-rejected), tags))
+			s.log.WithError(err).WithField("metrics", len(accepted)-start).Warn("Could not export metrics over OTLP")
+			return err
+		}
+		if partial := resp.PartialSuccess; partial != nil && (partial.RejectedDataPoints > 0 || partial.ErrorMessage != "") {
+			s.log.WithFields(logrus.Fields{
+				"rejected":      partial.RejectedDataPoints,
+				"metrics":       end - start,
+				logrus.ErrorKey: partial.ErrorMessage,
+			}).Warn("OTLP receiver rejected some data points")
+			rejected += partial.RejectedDataPoints
+		}
+	}
+
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(int64(len(accepted))-rejected), tags),
+		ssf.Count("otlp.rejected_data_points_total", float32(rejected), tags),
+	)
+	s.log.WithField("metrics", len(accepted)).Info("Completed flush to OTLP receiver")
+	return nil
+}
+
+// newExportRequest converts metrics into an export request. Counters
+// become delta sums over the flush interval, and gauges gauges. Each of
+// veneur's percentiles becomes a point of a gauge named after the
+// histogram, with the quantile as an attribute.
+func (s *MetricSink) newExportRequest(interMetrics []samplers.InterMetric) *exportMetricsServiceRequest {
+	type metricKey struct {
+		name    string
+		counter bool
+	}
+	scope := &scopeMetrics{Scope: &instrumentationScope{Name: scopeName}}
+	byKey := map[metricKey]*metric{}
+	for _, im := range interMetrics {
+		name, extraTags := im.Name, []string(nil)
+		if base, quantile, ok := promsink.SplitPercentile(name); ok {
+			name = base
+			extraTags = []string{quantileKey + ":" + strconv.FormatFloat(quantile, 'g', -1, 64)}
+		}
+		value := im.Value
+		point := &numberDataPoint{
+			TimeUnixNano: uint64(time.Unix(im.Timestamp, 0).UnixNano()),
+			AsDouble:     &value,
+			Attributes:   s.attributes(im, extraTags),
+		}
+
+		key := metricKey{name: name, counter: im.Type == samplers.CounterMetric}
+		m, ok := byKey[key]
+		if !ok {
+			m = &metric{Name: name}
+			if key.counter {
+				m.Sum = &sum{AggregationTemporality: aggregationTemporalityDelta, IsMonotonic: true}
+			} else {
+				m.Gauge = &gauge{}
+			}
+			byKey[key] = m
+			scope.Metrics = append(scope.Metrics, m)
+		}
+		if key.counter {
+			point.StartTimeUnixNano = point.TimeUnixNano - uint64(s.interval)
+			m.Sum.DataPoints = append(m.Sum.DataPoints, point)
+			// veneur's counters can be decremented:
+			if value < 0 {
+				m.Sum.IsMonotonic = false
+			}
+		} else {
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, point)
+		}
+	}
+
+	res := &resource{Attributes: []*keyValue{stringAttribute(serviceNameKey, "veneur")}}
+	if s.hostname != "" {
+		res.Attributes = append(res.Attributes, stringAttribute(hostNameKey, s.hostname))
+	}
+	return &exportMetricsServiceRequest{ResourceMetrics: []*resourceMetrics{{
+		Resource:     res,
+		ScopeMetrics: []*scopeMetrics{scope},
+	}}}
+}
+
+// attributes converts the tags of a metric, and any extra ones, into
+// attributes ordered by key. Tags without a value have an empty one.
+// The host of metrics from another veneur is added as host.name.
+func (s *MetricSink) attributes(im samplers.InterMetric, extraTags []string) []*keyValue {
+	values := make(map[string]string, len(im.Tags)+len(extraTags)+1)
+	if im.HostName != "" && im.HostName != s.hostname {
+		values[hostNameKey] = im.HostName
+	}
+	for _, tags := range [][]string{im.Tags, extraTags} {
+		for _, tag := range tags {
+			k, v := tag, ""
+			if i := strings.IndexByte(tag, ':'); i >= 0 {
+				k, v = tag[:i], tag[i+1:]
+			}
+			if _, excluded := s.excludedTags[k]; excluded {
+				continue
+			}
+			values[k] = v
+		}
+	}
+	attrs := make([]*keyValue, 0, len(values))
+	for k, v := range values {
+		attrs = append(attrs, stringAttribute(k, v))
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+func stringAttribute(key, value string) *keyValue {
+	return &keyValue{Key: key, Value: &anyValue{StringValue: proto.String(value)}}
+}
+
+// export sends a request to the receiver over the sink's protocol.
+func (s *MetricSink) export(ctx context.Context, req *exportMetricsServiceRequest) (*exportMetricsServiceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.timeout)
+	defer cancel()
+	if s.conn != nil {
+		if len(s.opts.headers) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.New(s.opts.headers))
+		}
+		resp := &exportMetricsServiceResponse{}
+		if err := s.conn.Invoke(ctx, exportMetricsMethod, req, resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+	return s.post(ctx, req)
+}
+
+// post sends a request to the receiver over HTTP.
+func (s *MetricSink) post(ctx context.Context, exportReq *exportMetricsServiceRequest) (*exportMetricsServiceResponse, error) {
+	body, err := proto.Marshal(exportReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "veneur")
+	for k, v := range s.opts.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Receivers explain failures with a google.rpc.Status:
+		msg := string(respBody)
+		st := &spb.Status{}
+		if resp.Header.Get("Content-Type") == "application/x-protobuf" && proto.Unmarshal(respBody, st) == nil {
+			msg = st.Message
+		}
+		return nil, fmt.Errorf("OTLP receiver returned %d: %s", resp.StatusCode, msg)
+	}
+	exportResp := &exportMetricsServiceResponse{}
+	if err := proto.Unmarshal(respBody, exportResp); err != nil {
+		return nil, fmt.Errorf("decoding the OTLP receiver's response: %v", err)
+	}
+	return exportResp, nil
+}
@@ -0,0 +1,178 @@
+package otlpmetric
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"golang.org/x/net/context"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var testMetrics = []samplers.InterMetric{
+	{Name: "requests", Timestamp: 1000, Value: 5, Tags: []string{"farm:sunny", "barn"}, Type: samplers.CounterMetric},
+	{Name: "requests", Timestamp: 1000, Value: -1, Tags: []string{"farm:rainy"}, Type: samplers.CounterMetric},
+	{Name: "cows", Timestamp: 1000, Value: 12, Tags: []string{"farm:sunny", "secret:moo"}, Type: samplers.GaugeMetric, HostName: "other"},
+	{Name: "latency.99percentile", Timestamp: 1000, Value: 0, Type: samplers.GaugeMetric},
+	{Name: "latency.50percentile", Timestamp: 1000, Value: 0.5, Type: samplers.GaugeMetric},
+	{Name: "farm.ok", Timestamp: 1000, Type: samplers.StatusMetric},
+}
+
+func attribute(key, value string) *keyValue {
+	return stringAttribute(key, value)
+}
+
+func TestNewExportRequest(t *testing.T) {
+	sink, err := NewMetricSink("http://localhost:4318", "", "veneur-1", 10*time.Second, logrus.New())
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:4318/v1/metrics", sink.endpoint)
+	sink.SetExcludedTags([]string{"secret"})
+
+	req := sink.newExportRequest(testMetrics[:5])
+	require.Len(t, req.ResourceMetrics, 1)
+	assert.Equal(t, []*keyValue{attribute("service.name", "veneur"), attribute("host.name", "veneur-1")},
+		req.ResourceMetrics[0].Resource.Attributes)
+	ms := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, ms, 3)
+
+	requests := ms[0]
+	assert.Equal(t, "requests", requests.Name)
+	require.NotNil(t, requests.Sum)
+	assert.Equal(t, aggregationTemporalityDelta, requests.Sum.AggregationTemporality)
+	assert.False(t, requests.Sum.IsMonotonic, "one of the counters went down")
+	require.Len(t, requests.Sum.DataPoints, 2)
+	point := requests.Sum.DataPoints[0]
+	assert.Equal(t, uint64(1000e9), point.TimeUnixNano)
+	assert.Equal(t, uint64(990e9), point.StartTimeUnixNano)
+	assert.Equal(t, 5.0, *point.AsDouble)
+	assert.Equal(t, []*keyValue{attribute("barn", ""), attribute("farm", "sunny")}, point.Attributes)
+
+	cows := ms[1]
+	require.NotNil(t, cows.Gauge)
+	assert.Equal(t, []*keyValue{attribute("farm", "sunny"), attribute("host.name", "other")},
+		cows.Gauge.DataPoints[0].Attributes)
+
+	latency := ms[2]
+	assert.Equal(t, "latency", latency.Name)
+	require.Len(t, latency.Gauge.DataPoints, 2)
+	assert.Equal(t, []*keyValue{attribute("quantile", "0.99")}, latency.Gauge.DataPoints[0].Attributes)
+
+	// Zero values are still sent:
+	bts, err := proto.Marshal(latency.Gauge.DataPoints[0])
+	require.NoError(t, err)
+	decoded := &numberDataPoint{}
+	require.NoError(t, proto.Unmarshal(bts, decoded))
+	require.NotNil(t, decoded.AsDouble)
+	assert.Equal(t, 0.0, *decoded.AsDouble)
+}
+
+// TestNewExportRequestFixture checks the encoding of the hand-declared
+// messages against a request that was decoded with the generated OTLP
+// types, go.opentelemetry.io/proto/otlp v1.0.0, which found every field
+// and no unknown ones. Any change to the messages has to be checked like
+// that again before the fixture is replaced.
+func TestNewExportRequestFixture(t *testing.T) {
+	expected, err := ioutil.ReadFile(path.Join("..", "..", "fixtures", "otlp", "metrics_request.pb"))
+	require.NoError(t, err)
+	sink, err := NewMetricSink("http://localhost:4318", "", "veneur-1", 10*time.Second, logrus.New())
+	require.NoError(t, err)
+	sink.SetExcludedTags([]string{"secret"})
+
+	bts, err := proto.Marshal(sink.newExportRequest(testMetrics[:5]))
+	require.NoError(t, err)
+	assert.Equal(t, expected, bts)
+}
+
+func TestFlushHTTP(t *testing.T) {
+	requests := make(chan *exportMetricsServiceRequest, 10)
+	responses := []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			bts, _ := proto.Marshal(&exportMetricsServiceResponse{
+				PartialSuccess: &exportMetricsPartialSuccess{RejectedDataPoints: 1, ErrorMessage: "bad point"},
+			})
+			w.Write(bts)
+		},
+		func(w http.ResponseWriter) {
+			bts, _ := proto.Marshal(&spb.Status{Code: 3, Message: "no metrics for you"})
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(bts)
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/otlp/v1/metrics", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		req := &exportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+		requests <- req
+		respond := responses[0]
+		responses = responses[1:]
+		respond(w)
+	}))
+	defer srv.Close()
+
+	sink, err := NewMetricSink(srv.URL+"/otlp/v1/metrics", ProtocolHTTP, "veneur-1", 10*time.Second, logrus.New(),
+		WithHeaders(map[string]string{"X-Api-Key": "secret"}), WithBatchSize(3))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	require.NoError(t, sink.Flush(context.Background(), testMetrics[:2]))
+	req := <-requests
+	assert.Len(t, req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum.DataPoints, 2)
+
+	err = sink.Flush(context.Background(), testMetrics)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no metrics for you")
+}
+
+func TestFlushGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	requests := make(chan *exportMetricsServiceRequest, 10)
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Export",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				assert.Equal(t, []string{"secret"}, md["x-api-key"])
+				req := &exportMetricsServiceRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				requests <- req
+				return &exportMetricsServiceResponse{}, nil
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	sink, err := NewMetricSink(lis.Addr().String(), ProtocolGRPC, "veneur-1", 10*time.Second, logrus.New(),
+		WithInsecure(), WithHeaders(map[string]string{"X-Api-Key": "secret"}))
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	require.NoError(t, sink.Flush(context.Background(), testMetrics))
+	req := <-requests
+	assert.Len(t, req.ResourceMetrics[0].ScopeMetrics[0].Metrics, 3)
+
+	_, err = NewMetricSink(lis.Addr().String(), "thrift", "", time.Second, logrus.New())
+	assert.Error(t, err)
+}
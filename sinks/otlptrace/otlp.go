@@ -0,0 +1,160 @@
+package otlptrace
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/duration"
+)
+
+// The messages below are those of the OTLP trace service, version 1
+// (https://github.com/open-telemetry/opentelemetry-proto), with only
+// the fields that the sink uses. They're declared by hand, with the
+// same field numbers and wire types, as the generated ones need a newer
+// protobuf runtime than the one vendored here. TestExportRequestFixture
+// checks their encoding against a request that the generated types
+// decode.
+
+// exportTraceMethod is the RPC that exports spans to an OTLP receiver.
+const exportTraceMethod = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+// statusCodeError is the status code of spans that failed.
+const statusCodeError int32 = 2
+
+type exportTraceServiceRequest struct {
+	ResourceSpans []*resourceSpans `protobuf:"bytes,1,rep,name=resource_spans,json=resourceSpans" json:"resource_spans,omitempty"`
+}
+
+func (m *exportTraceServiceRequest) Reset()         { *m = exportTraceServiceRequest{} }
+func (m *exportTraceServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*exportTraceServiceRequest) ProtoMessage()    {}
+
+type exportTraceServiceResponse struct {
+	PartialSuccess *exportTracePartialSuccess `protobuf:"bytes,1,opt,name=partial_success,json=partialSuccess" json:"partial_success,omitempty"`
+}
+
+func (m *exportTraceServiceResponse) Reset()         { *m = exportTraceServiceResponse{} }
+func (m *exportTraceServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*exportTraceServiceResponse) ProtoMessage()    {}
+
+type exportTracePartialSuccess struct {
+	RejectedSpans int64  `protobuf:"varint,1,opt,name=rejected_spans,json=rejectedSpans,proto3" json:"rejected_spans,omitempty"`
+	ErrorMessage  string `protobuf:"bytes,2,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
+}
+
+func (m *exportTracePartialSuccess) Reset()         { *m = exportTracePartialSuccess{} }
+func (m *exportTracePartialSuccess) String() string { return proto.CompactTextString(m) }
+func (*exportTracePartialSuccess) ProtoMessage()    {}
+
+type resourceSpans struct {
+	Resource   *resource     `protobuf:"bytes,1,opt,name=resource" json:"resource,omitempty"`
+	ScopeSpans []*scopeSpans `protobuf:"bytes,2,rep,name=scope_spans,json=scopeSpans" json:"scope_spans,omitempty"`
+}
+
+func (m *resourceSpans) Reset()         { *m = resourceSpans{} }
+func (m *resourceSpans) String() string { return proto.CompactTextString(m) }
+func (*resourceSpans) ProtoMessage()    {}
+
+type resource struct {
+	Attributes []*keyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+func (m *resource) Reset()         { *m = resource{} }
+func (m *resource) String() string { return proto.CompactTextString(m) }
+func (*resource) ProtoMessage()    {}
+
+type scopeSpans struct {
+	Scope *instrumentationScope `protobuf:"bytes,1,opt,name=scope" json:"scope,omitempty"`
+	Spans []*span               `protobuf:"bytes,2,rep,name=spans" json:"spans,omitempty"`
+}
+
+func (m *scopeSpans) Reset()         { *m = scopeSpans{} }
+func (m *scopeSpans) String() string { return proto.CompactTextString(m) }
+func (*scopeSpans) ProtoMessage()    {}
+
+type instrumentationScope struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+}
+
+func (m *instrumentationScope) Reset()         { *m = instrumentationScope{} }
+func (m *instrumentationScope) String() string { return proto.CompactTextString(m) }
+func (*instrumentationScope) ProtoMessage()    {}
+
+type span struct {
+	TraceId           []byte      `protobuf:"bytes,1,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	SpanId            []byte      `protobuf:"bytes,2,opt,name=span_id,json=spanId,proto3" json:"span_id,omitempty"`
+	ParentSpanId      []byte      `protobuf:"bytes,4,opt,name=parent_span_id,json=parentSpanId,proto3" json:"parent_span_id,omitempty"`
+	Name              string      `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"`
+	StartTimeUnixNano uint64      `protobuf:"fixed64,7,opt,name=start_time_unix_nano,json=startTimeUnixNano,proto3" json:"start_time_unix_nano,omitempty"`
+	EndTimeUnixNano   uint64      `protobuf:"fixed64,8,opt,name=end_time_unix_nano,json=endTimeUnixNano,proto3" json:"end_time_unix_nano,omitempty"`
+	Attributes        []*keyValue `protobuf:"bytes,9,rep,name=attributes" json:"attributes,omitempty"`
+	Events            []*event    `protobuf:"bytes,11,rep,name=events" json:"events,omitempty"`
+	Links             []*link     `protobuf:"bytes,13,rep,name=links" json:"links,omitempty"`
+	Status            *status     `protobuf:"bytes,15,opt,name=status" json:"status,omitempty"`
+}
+
+func (m *span) Reset()         { *m = span{} }
+func (m *span) String() string { return proto.CompactTextString(m) }
+func (*span) ProtoMessage()    {}
+
+// event is a Span.Event.
+type event struct {
+	TimeUnixNano uint64      `protobuf:"fixed64,1,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"time_unix_nano,omitempty"`
+	Name         string      `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Attributes   []*keyValue `protobuf:"bytes,3,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+func (m *event) Reset()         { *m = event{} }
+func (m *event) String() string { return proto.CompactTextString(m) }
+func (*event) ProtoMessage()    {}
+
+// link is a Span.Link.
+type link struct {
+	TraceId    []byte      `protobuf:"bytes,1,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	SpanId     []byte      `protobuf:"bytes,2,opt,name=span_id,json=spanId,proto3" json:"span_id,omitempty"`
+	Attributes []*keyValue `protobuf:"bytes,4,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+func (m *link) Reset()         { *m = link{} }
+func (m *link) String() string { return proto.CompactTextString(m) }
+func (*link) ProtoMessage()    {}
+
+type status struct {
+	Message string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Code    int32  `protobuf:"varint,3,opt,name=code,proto3" json:"code,omitempty"`
+}
+
+func (m *status) Reset()         { *m = status{} }
+func (m *status) String() string { return proto.CompactTextString(m) }
+func (*status) ProtoMessage()    {}
+
+type keyValue struct {
+	Key   string    `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value *anyValue `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+}
+
+func (m *keyValue) Reset()         { *m = keyValue{} }
+func (m *keyValue) String() string { return proto.CompactTextString(m) }
+func (*keyValue) ProtoMessage()    {}
+
+// anyValue only has OTLP's string_value: it's a member of a oneof
+// there, which is encoded the same as a plain field. Empty strings
+// aren't encoded, so they arrive as empty values.
+type anyValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3" json:"string_value,omitempty"`
+}
+
+func (m *anyValue) Reset()         { *m = anyValue{} }
+func (m *anyValue) String() string { return proto.CompactTextString(m) }
+func (*anyValue) ProtoMessage()    {}
+
+// retryInfoType is the type URL of the google.rpc.RetryInfo details
+// that OTLP receivers may add to their errors.
+const retryInfoType = "type.googleapis.com/google.rpc.RetryInfo"
+
+// retryInfo tells clients how long to wait before retrying a request.
+type retryInfo struct {
+	RetryDelay *duration.Duration `protobuf:"bytes,1,opt,name=retry_delay,json=retryDelay" json:"retry_delay,omitempty"`
+}
+
+func (m *retryInfo) Reset()         { *m = retryInfo{} }
+func (m *retryInfo) String() string { return proto.CompactTextString(m) }
+func (*retryInfo) ProtoMessage()    {}
@@ -0,0 +1,468 @@
+package otlptrace
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	defaultBufferSize    = 1 << 14
+	defaultExportTimeout = 10 * time.Second
+
+	// exportQueueSize is how many flushes' spans can wait to be
+	// exported, while an earlier one is being retried.
+	exportQueueSize = 4
+)
+
+// The backoff between retries of failed exports, as OTLP exporters do
+// it by default: the intervals start at 5s and double up to 30s, each
+// randomized by up to half, and exports are given up a minute after
+// they were first tried.
+const (
+	retryInitialInterval = 5 * time.Second
+	retryMaxInterval     = 30 * time.Second
+	retryMaxElapsedTime  = time.Minute
+	retryRandomization   = 0.5
+)
+
+// The attribute that carries the service of spans on their resource,
+// and the name of the instrumentation scope that they're exported
+// with.
+const (
+	serviceNameKey = "service.name"
+	scopeName      = "veneur"
+)
+
+// The causes of spans dropped by the sink.
+const (
+	causeBufferFull   = "buffer_full"
+	causeQueueFull    = "queue_full"
+	causeExportFailed = "export_failed"
+	causeRejected     = "rejected"
+)
+
+// Option configures an OTLP span sink.
+type Option func(*options)
+
+type options struct {
+	tlsConfig     *tls.Config
+	tlsErr        error
+	headers       map[string]string
+	bufferSize    int
+	exportTimeout time.Duration
+
+	retryInitialInterval time.Duration
+	retryMaxInterval     time.Duration
+	retryMaxElapsedTime  time.Duration
+}
+
+// WithTLS sets the PEM-encoded certificates that the sink connects to
+// the receiver with: the authority that the receiver's certificate is
+// verified with, if not the system's, and a client certificate and key.
+// Any of them may be empty. Without this option, the receiver is
+// verified by the system's authorities.
+func WithTLS(authorityCert, cert, key string) Option {
+	return func(o *options) {
+		conf := &tls.Config{}
+		if authorityCert != "" {
+			conf.RootCAs = x509.NewCertPool()
+			if !conf.RootCAs.AppendCertsFromPEM([]byte(authorityCert)) {
+				o.tlsErr = errors.New("could not load any authority certificates")
+				return
+			}
+		}
+		if cert != "" || key != "" {
+			pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+			if err != nil {
+				o.tlsErr = err
+				return
+			}
+			conf.Certificates = []tls.Certificate{pair}
+		}
+		o.tlsConfig = conf
+	}
+}
+
+// WithInsecure connects to the receiver without TLS.
+func WithInsecure() Option {
+	return func(o *options) {
+		o.tlsConfig = nil
+	}
+}
+
+// WithHeaders sets headers that are sent with every export, e.g. to
+// authenticate with the receiver.
+func WithHeaders(headers map[string]string) Option {
+	return func(o *options) {
+		o.headers = headers
+	}
+}
+
+// WithBufferSize sets how many spans the sink holds between flushes.
+// Spans past this are dropped.
+func WithBufferSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.bufferSize = size
+		}
+	}
+}
+
+// WithExportTimeout bounds each attempt to export a flush's spans.
+func WithExportTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.exportTimeout = timeout
+		}
+	}
+}
+
+// exportBatch is a flush's spans, waiting to be exported.
+type exportBatch struct {
+	req   *exportTraceServiceRequest
+	spans int
+}
+
+// SpanSink exports spans over OTLP/gRPC to an OpenTelemetry receiver,
+// like a collector. The spans are sent on each flush, and retried in
+// the background if the export fails for reasons that may pass.
+type SpanSink struct {
+	opts options
+	conn *grpc.ClientConn
+
+	mutex  sync.Mutex
+	buffer []*ssf.SSFSpan
+	queue  chan exportBatch
+
+	exportedSpans    int64
+	userDroppedSpans int64
+	retries          int64
+	// dropped holds the counts of spans dropped, by their cause and
+	// gRPC code, as *int64s.
+	dropped sync.Map
+
+	traceClient *trace.Client
+	log         *logrus.Logger
+}
+
+var _ sinks.SpanSink = &SpanSink{}
+
+// droppedKey is a key of the dropped spans counts.
+type droppedKey struct {
+	cause string
+	code  codes.Code
+}
+
+// NewSpanSink creates a sink that exports spans to the OTLP/gRPC
+// receiver at endpoint, a host:port.
+func NewSpanSink(endpoint string, log *logrus.Logger, opts ...Option) (*SpanSink, error) {
+	o := options{
+		tlsConfig:            &tls.Config{},
+		bufferSize:           defaultBufferSize,
+		exportTimeout:        defaultExportTimeout,
+		retryInitialInterval: retryInitialInterval,
+		retryMaxInterval:     retryMaxInterval,
+		retryMaxElapsedTime:  retryMaxElapsedTime,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.tlsErr != nil {
+		return nil, o.tlsErr
+	}
+
+	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+	if o.tlsConfig != nil {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(o.tlsConfig))}
+	}
+	conn, err := grpc.Dial(endpoint, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SpanSink{
+		opts:  o,
+		conn:  conn,
+		queue: make(chan exportBatch, exportQueueSize),
+		log:   log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (*SpanSink) Name() string {
+	return "otlp"
+}
+
+// Start starts exporting the spans of each flush.
+func (s *SpanSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	go s.export()
+	return nil
+}
+
+// Ingest buffers a span for the next flush.
+func (s *SpanSink) Ingest(span *ssf.SSFSpan) error {
+	if err := protocol.ValidateTrace(span); err != nil {
+		return err
+	}
+	if sinks.PriorityDropped(span) {
+		atomic.AddInt64(&s.userDroppedSpans, 1)
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.buffer) >= s.opts.bufferSize {
+		s.countDropped(causeBufferFull, codes.OK, 1)
+		return nil
+	}
+	s.buffer = append(s.buffer, span)
+	return nil
+}
+
+// Flush queues the buffered spans to be exported, and reports what
+// happened to the spans of earlier flushes.
+func (s *SpanSink) Flush() {
+	s.mutex.Lock()
+	spans := s.buffer
+	s.buffer = nil
+	s.mutex.Unlock()
+
+	if len(spans) > 0 {
+		select {
+		case s.queue <- exportBatch{req: newExportRequest(spans), spans: len(spans)}:
+		default:
+			s.log.WithField("spans", len(spans)).Warn("Too many OTLP exports are being retried, dropping spans")
+			s.countDropped(causeQueueFull, codes.OK, len(spans))
+		}
+	}
+
+	samples := &ssf.Samples{}
+	tags := map[string]string{"sink": s.Name()}
+	samples.Add(
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(atomic.SwapInt64(&s.exportedSpans, 0)), tags),
+		ssf.Count("otlp.export_retries_total", float32(atomic.SwapInt64(&s.retries, 0)), tags),
+	)
+	s.dropped.Range(func(k, v interface{}) bool {
+		key := k.(droppedKey)
+		if n := atomic.SwapInt64(v.(*int64), 0); n > 0 {
+			dropTags := map[string]string{"sink": s.Name(), "cause": key.cause}
+			if key.code != codes.OK {
+				dropTags["code"] = key.code.String()
+			}
+			samples.Add(ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(n), dropTags))
+		}
+		return true
+	})
+	if dropped := atomic.SwapInt64(&s.userDroppedSpans, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(dropped),
+			map[string]string{"sink": s.Name(), "reason": sinks.SkipReasonUserDrop}))
+	}
+	metrics.Report(s.traceClient, samples)
+}
+
+func (s *SpanSink) countDropped(cause string, code codes.Code, n int) {
+	count, _ := s.dropped.LoadOrStore(droppedKey{cause, code}, new(int64))
+	atomic.AddInt64(count.(*int64), int64(n))
+}
+
+// export exports the queued batches of spans, one at a time.
+func (s *SpanSink) export() {
+	for batch := range s.queue {
+		s.exportWithRetries(batch)
+	}
+}
+
+// exportWithRetries exports a batch of spans, retrying it with backoff
+// while it fails with a retryable error, until the retries would take
+// longer than allowed.
+func (s *SpanSink) exportWithRetries(batch exportBatch) {
+	start := time.Now()
+	interval := s.opts.retryInitialInterval
+	for {
+		err := s.exportOnce(batch)
+		if err == nil {
+			return
+		}
+		st := grpcstatus.Convert(err)
+		delay, retry := retryDelay(st, interval)
+		if !retry || time.Since(start)+delay > s.opts.retryMaxElapsedTime {
+			s.log.WithError(err).WithField("spans", batch.spans).Warn("Failed to export spans over OTLP")
+			s.countDropped(causeExportFailed, st.Code(), batch.spans)
+			return
+		}
+		atomic.AddInt64(&s.retries, 1)
+		time.Sleep(delay)
+
+		interval *= 2
+		if interval > s.opts.retryMaxInterval {
+			interval = s.opts.retryMaxInterval
+		}
+	}
+}
+
+// exportOnce sends a batch of spans to the receiver. Spans that the
+// receiver rejects, while accepting the others, aren't retried.
+func (s *SpanSink) exportOnce(batch exportBatch) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.exportTimeout)
+	defer cancel()
+	if len(s.opts.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(s.opts.headers))
+	}
+
+	resp := &exportTraceServiceResponse{}
+	if err := s.conn.Invoke(ctx, exportTraceMethod, batch.req, resp); err != nil {
+		return err
+	}
+	var rejected int64
+	if partial := resp.PartialSuccess; partial != nil {
+		rejected = partial.RejectedSpans
+		if rejected > 0 || partial.ErrorMessage != "" {
+			s.log.WithFields(logrus.Fields{
+				"rejected":      rejected,
+				"spans":         batch.spans,
+				logrus.ErrorKey: partial.ErrorMessage,
+			}).Warn("OTLP receiver rejected some spans")
+		}
+	}
+	if rejected > 0 {
+		s.countDropped(causeRejected, codes.OK, int(rejected))
+	}
+	atomic.AddInt64(&s.exportedSpans, int64(batch.spans)-rejected)
+	return nil
+}
+
+// retryDelay returns how long to wait before retrying an export that
+// failed with a status, and whether to retry it at all. Receivers can
+// ask for a delay with RetryInfo details; otherwise, the interval is
+// randomized. Exports that the receiver throttled are only retried if
+// it asked for a delay.
+func retryDelay(st *grpcstatus.Status, interval time.Duration) (time.Duration, bool) {
+	throttle, throttled := time.Duration(0), false
+	for _, detail := range st.Proto().GetDetails() {
+		if detail.TypeUrl != retryInfoType {
+			continue
+		}
+		info := &retryInfo{}
+		if err := proto.Unmarshal(detail.Value, info); err != nil || info.RetryDelay == nil {
+			continue
+		}
+		if d, err := ptypes.Duration(info.RetryDelay); err == nil {
+			throttle, throttled = d, true
+		}
+	}
+
+	switch st.Code() {
+	case codes.Canceled, codes.DeadlineExceeded, codes.Aborted,
+		codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+	case codes.ResourceExhausted:
+		if !throttled {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	if throttled {
+		return throttle, true
+	}
+	delta := retryRandomization * float64(interval)
+	return time.Duration(float64(interval) - delta + rand.Float64()*2*delta), true
+}
+
+// newExportRequest converts spans into an export request, with the
+// spans of each service on a resource of their own.
+func newExportRequest(spans []*ssf.SSFSpan) *exportTraceServiceRequest {
+	req := &exportTraceServiceRequest{}
+	byService := map[string]*scopeSpans{}
+	for _, ssfSpan := range spans {
+		scope, ok := byService[ssfSpan.Service]
+		if !ok {
+			scope = &scopeSpans{Scope: &instrumentationScope{Name: scopeName}}
+			byService[ssfSpan.Service] = scope
+			req.ResourceSpans = append(req.ResourceSpans, &resourceSpans{
+				Resource: &resource{
+					Attributes: []*keyValue{{Key: serviceNameKey, Value: &anyValue{StringValue: ssfSpan.Service}}},
+				},
+				ScopeSpans: []*scopeSpans{scope},
+			})
+		}
+		scope.Spans = append(scope.Spans, newSpan(ssfSpan))
+	}
+	return req
+}
+
+// newSpan converts an SSF span. Its tags become attributes, and its
+// error flag the status code.
+func newSpan(ssfSpan *ssf.SSFSpan) *span {
+	traceID := ssf.TraceIDBytes(ssfSpan)
+	sp := &span{
+		TraceId:           traceID[:],
+		SpanId:            spanID(ssfSpan.Id),
+		Name:              ssfSpan.Name,
+		StartTimeUnixNano: uint64(ssfSpan.StartTimestamp),
+		EndTimeUnixNano:   uint64(ssfSpan.EndTimestamp),
+		Attributes:        attributes(ssfSpan.Tags),
+	}
+	if ssfSpan.ParentId > 0 {
+		sp.ParentSpanId = spanID(ssfSpan.ParentId)
+	}
+	if ssfSpan.Error {
+		sp.Status = &status{Code: statusCodeError}
+	}
+	for _, ev := range ssfSpan.Events {
+		sp.Events = append(sp.Events, &event{
+			TimeUnixNano: uint64(ev.Timestamp),
+			Name:         ev.Name,
+			Attributes:   attributes(ev.Tags),
+		})
+	}
+	for _, l := range ssfSpan.Links {
+		linkTraceID := ssf.LinkTraceIDBytes(l)
+		sp.Links = append(sp.Links, &link{
+			TraceId:    linkTraceID[:],
+			SpanId:     spanID(l.SpanId),
+			Attributes: attributes(l.Tags),
+		})
+	}
+	return sp
+}
+
+// spanID returns a span ID as the 8 bytes that OTLP carries it in.
+func spanID(id int64) []byte {
+	bts := make([]byte, 8)
+	binary.BigEndian.PutUint64(bts, uint64(id))
+	return bts
+}
+
+// attributes converts tags into attributes, ordered by key.
+func attributes(tags map[string]string) []*keyValue {
+	if len(tags) == 0 {
+		return nil
+	}
+	attrs := make([]*keyValue, 0, len(tags))
+	for k, v := range tags {
+		attrs = append(attrs, &keyValue{Key: k, Value: &anyValue{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
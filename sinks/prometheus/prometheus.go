@@ -0,0 +1,521 @@
+package prometheus
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// ExpositionPath is the HTTP path that the exposition sink's handler
+// is served on.
+const ExpositionPath = "/metrics-prom"
+
+// MetricKeyCountersExpired counts the counters that the exposition sink
+// stopped exposing because they weren't updated for too long.
+const MetricKeyCountersExpired = "prometheus.counters_expired_total"
+
+const expositionContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+var percentileSuffix = regexp.MustCompile(`^(.+)\.(\d+(?:_\d+)?)percentile$`)
+
+// Label is a single Prometheus label name/value pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Series identifies a single Prometheus time series: a sanitized
+// metric name and its sorted, sanitized labels.
+type Series struct {
+	Name   string
+	Labels []Label
+}
+
+// Key returns a string that uniquely identifies the series,
+// suitable for use as a map key.
+func (s Series) Key() string {
+	buf := &strings.Builder{}
+	buf.WriteString(s.Name)
+	for _, l := range s.Labels {
+		buf.WriteByte(0)
+		buf.WriteString(l.Name)
+		buf.WriteByte(0)
+		buf.WriteString(l.Value)
+	}
+	return buf.String()
+}
+
+// SanitizeName converts a veneur metric name into one that fits
+// Prometheus' metric name charset, [a-zA-Z_:][a-zA-Z0-9_:]*.
+func SanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabelName converts a tag key into one that fits
+// Prometheus' label name charset, [a-zA-Z_][a-zA-Z0-9_]*.
+func SanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+	out := []byte(name)
+	for i, c := range out {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c >= '0' && c <= '9':
+		case c == ':' && allowColon:
+		default:
+			out[i] = '_'
+		}
+	}
+	// Names may not start with a digit:
+	if out[0] >= '0' && out[0] <= '9' {
+		return "_" + string(out)
+	}
+	return string(out)
+}
+
+// SeriesFromTags converts a metric name and veneur tags into a
+// sanitized Series. Tags without a value become labels with an empty
+// value, and tags in the excluded set (by key) are dropped. The
+// veneursinkonly routing tag is never turned into a label.
+func SeriesFromTags(name string, tags []string, excluded map[string]struct{}) Series {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if kv[0] == "veneursinkonly" {
+			continue
+		}
+		if _, ok := excluded[kv[0]]; ok {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		labels[SanitizeLabelName(kv[0])] = value
+	}
+	series := Series{Name: SanitizeName(name), Labels: make([]Label, 0, len(labels))}
+	for k, v := range labels {
+		series.Labels = append(series.Labels, Label{Name: k, Value: v})
+	}
+	sort.Slice(series.Labels, func(i, j int) bool {
+		return series.Labels[i].Name < series.Labels[j].Name
+	})
+	return series
+}
+
+// SplitPercentile reports whether the metric name is one of veneur's
+// computed percentile series (e.g. "foo.99percentile" or
+// "foo.99_9percentile"), returning the base name and the quantile it
+// represents.
+func SplitPercentile(name string) (string, float64, bool) {
+	match := percentileSuffix.FindStringSubmatch(name)
+	if match == nil {
+		return name, 0, false
+	}
+	pct, err := strconv.ParseFloat(strings.Replace(match[2], "_", ".", 1), 64)
+	if err != nil {
+		return name, 0, false
+	}
+	return match[1], pct / 100, true
+}
+
+type sample struct {
+	series Series
+	value  float64
+	// exemplar, if set, is rendered with the sample in the OpenMetrics
+	// format. Only counters have them.
+	exemplar *samplers.Exemplar
+	// updated is the flush in which a counter was last flushed.
+	updated int64
+}
+
+// defaultCounterExpiryIntervals is how many flushes a counter's total is
+// kept for without being updated, unless the sink is told otherwise.
+const defaultCounterExpiryIntervals = 60
+
+type family struct {
+	kind    string
+	samples map[string]sample
+	// parts are a summary's _sum and _count samples
+	parts []sample
+}
+
+// ExpositionSink is a MetricSink that retains the most recent
+// flush's metrics and serves them over HTTP in the Prometheus text
+// exposition format, or the OpenMetrics format if the scraper accepts it.
+// Counters are reported as cumulative totals across flushes, until they
+// go a number of flushes without being updated; everything else reflects
+// only the latest flush, except for the sums and counts of summaries,
+// which are totals like the counters.
+type ExpositionSink struct {
+	log             *logrus.Logger
+	traceClient     *trace.Client
+	summaries       bool
+	expiryIntervals int64
+	excludedTags    map[string]struct{}
+
+	mtx      sync.RWMutex
+	flushes  int64
+	counters map[string]sample
+	// summaryParts are the totals of the summaries' _sum and _count
+	// series, only in summary mode
+	summaryParts map[string]sample
+	latest       map[string]*family
+}
+
+var _ sinks.MetricSink = &ExpositionSink{}
+var _ http.Handler = &ExpositionSink{}
+
+// NewExpositionSink creates a new Prometheus exposition sink. If
+// summaries is true, veneur's computed percentiles are exposed as
+// native summary series rather than as gauges with a quantile label,
+// with the sum and count aggregates of their timers and histograms as
+// the summaries' _sum and _count series. Counters that aren't updated for expiryIntervals flushes, 60 if it's
+// 0, are no longer exposed.
+func NewExpositionSink(log *logrus.Logger, summaries bool, expiryIntervals int) *ExpositionSink {
+	if expiryIntervals <= 0 {
+		expiryIntervals = defaultCounterExpiryIntervals
+	}
+	return &ExpositionSink{
+		log:             log,
+		summaries:       summaries,
+		expiryIntervals: int64(expiryIntervals),
+		counters:        map[string]sample{},
+		summaryParts:    map[string]sample{},
+		latest:          map[string]*family{},
+	}
+}
+
+// Name returns the name of this sink.
+func (p *ExpositionSink) Name() string {
+	return "prometheus"
+}
+
+// Start sets the sink up.
+func (p *ExpositionSink) Start(cl *trace.Client) error {
+	p.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will not be turned into labels.
+func (p *ExpositionSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	p.excludedTags = tagsSet
+}
+
+// Flush replaces the exposed gauges with the ones in this flush, adds
+// the flushed counters to their running totals, and drops the totals
+// that expired.
+func (p *ExpositionSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, _ := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(p.traceClient)
+	flushStart := time.Now()
+
+	// Build the new state outside the lock, so scrapes are only
+	// blocked for the duration of the swap:
+	latest := map[string]*family{}
+	counterDeltas := []sample{}
+	partDeltas := []sample{}
+	summaries := p.summaryNames(interMetrics)
+	skipped := 0
+	for _, metric := range interMetrics {
+		if !sinks.IsAcceptableMetric(metric, p) {
+			skipped++
+			continue
+		}
+		if isSummaryPart(metric, summaries) {
+			partDeltas = append(partDeltas, sample{
+				series: SeriesFromTags(metric.Name, metric.Tags, p.excludedTags),
+				value:  metric.Value,
+			})
+			continue
+		}
+		switch metric.Type {
+		case samplers.CounterMetric:
+			series := SeriesFromTags(metric.Name, metric.Tags, p.excludedTags)
+			counterDeltas = append(counterDeltas, sample{
+				series:   series,
+				value:    metric.Value,
+				exemplar: largestExemplar(metric.Exemplars),
+			})
+		case samplers.GaugeMetric, samplers.StatusMetric:
+			name, quantile, ok := SplitPercentile(metric.Name)
+			kind := "gauge"
+			if ok {
+				metric.Tags = append(metric.Tags[:len(metric.Tags):len(metric.Tags)],
+					"quantile:"+strconv.FormatFloat(quantile, 'g', -1, 64))
+				if p.summaries {
+					kind = "summary"
+				}
+			}
+			series := SeriesFromTags(name, metric.Tags, p.excludedTags)
+			fam, ok := latest[series.Name]
+			if !ok {
+				fam = &family{kind: kind, samples: map[string]sample{}}
+				latest[series.Name] = fam
+			}
+			fam.samples[series.Key()] = sample{series: series, value: metric.Value}
+		}
+	}
+
+	p.mtx.Lock()
+	p.flushes++
+	p.addTotals(p.counters, counterDeltas)
+	p.addTotals(p.summaryParts, partDeltas)
+	expired := p.expireTotals(p.counters)
+	p.expireTotals(p.summaryParts)
+	p.latest = latest
+	p.mtx.Unlock()
+
+	tags := map[string]string{"sink": p.Name()}
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(len(interMetrics)-skipped), tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(skipped), tags),
+		ssf.Count(MetricKeyCountersExpired, float32(expired), tags),
+	)
+	return nil
+}
+
+// addTotals adds the deltas to their running totals. It must be called
+// with mtx held.
+func (p *ExpositionSink) addTotals(totals map[string]sample, deltas []sample) {
+	for _, delta := range deltas {
+		key := delta.series.Key()
+		total := totals[key]
+		total.series = delta.series
+		total.value += delta.value
+		total.updated = p.flushes
+		if delta.exemplar != nil {
+			total.exemplar = delta.exemplar
+		}
+		totals[key] = total
+	}
+}
+
+// expireTotals drops the totals that weren't updated for
+// expiryIntervals flushes, and returns how many it dropped. It must be
+// called with mtx held.
+func (p *ExpositionSink) expireTotals(totals map[string]sample) int {
+	expired := 0
+	for key, total := range totals {
+		if p.flushes-total.updated >= p.expiryIntervals {
+			delete(totals, key)
+			expired++
+		}
+	}
+	return expired
+}
+
+// summaryNames returns the names of the timers and histograms whose
+// percentiles are flushed as summaries, or nil if the sink doesn't
+// expose summaries.
+func (p *ExpositionSink) summaryNames(interMetrics []samplers.InterMetric) map[string]struct{} {
+	if !p.summaries {
+		return nil
+	}
+	names := map[string]struct{}{}
+	for _, metric := range interMetrics {
+		if name, _, ok := SplitPercentile(metric.Name); ok && metric.Type == samplers.GaugeMetric {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+// isSummaryPart reports whether the metric is the sum or the count
+// aggregate of one of the summaries, which make up its _sum and _count
+// series.
+func isSummaryPart(metric samplers.InterMetric, summaries map[string]struct{}) bool {
+	var name string
+	switch {
+	case metric.Type == samplers.GaugeMetric && strings.HasSuffix(metric.Name, ".sum"):
+		name = strings.TrimSuffix(metric.Name, ".sum")
+	case metric.Type == samplers.CounterMetric && strings.HasSuffix(metric.Name, ".count"):
+		name = strings.TrimSuffix(metric.Name, ".count")
+	default:
+		return false
+	}
+	_, ok := summaries[name]
+	return ok
+}
+
+// FlushOtherSamples is a no-op; events and service checks have no
+// Prometheus representation.
+func (p *ExpositionSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// largestExemplar returns the exemplar with the largest value, which is
+// the most interesting one to link to from a latency spike, or nil if
+// there are none.
+func largestExemplar(exemplars []samplers.Exemplar) *samplers.Exemplar {
+	var largest *samplers.Exemplar
+	for i := range exemplars {
+		if largest == nil || exemplars[i].Value > largest.Value {
+			largest = &exemplars[i]
+		}
+	}
+	return largest
+}
+
+// acceptsOpenMetrics reports whether the scraper asked for the
+// OpenMetrics format.
+func acceptsOpenMetrics(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		if strings.Contains(accept, "application/openmetrics-text") {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP writes the current metrics in the Prometheus text
+// exposition format, or in the OpenMetrics format, with the counters'
+// exemplars, if the request accepts it. It is safe to call concurrently
+// with Flush.
+func (p *ExpositionSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := acceptsOpenMetrics(r)
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", expositionContentType)
+	}
+	families := p.families()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+	for _, name := range names {
+		fam := families[name]
+		sampleName := name
+		if openMetrics && fam.kind == "counter" {
+			// OpenMetrics counter families are named without the
+			// _total suffix that their samples must have
+			name = strings.TrimSuffix(name, "_total")
+			sampleName = name + "_total"
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, fam.kind)
+		keys := make([]string, 0, len(fam.samples))
+		for key := range fam.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writeSample(buf, sampleName, fam.samples[key], openMetrics)
+		}
+		for _, part := range fam.parts {
+			writeSample(buf, part.series.Name, part, openMetrics)
+		}
+	}
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+}
+
+// families returns a copy of the families to expose, so that they can
+// be written out without holding mtx: a slow scraper mustn't hold up
+// the flushes.
+func (p *ExpositionSink) families() map[string]*family {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	families := map[string]*family{}
+	for name, fam := range p.latest {
+		families[name] = fam
+	}
+	for key, s := range p.counters {
+		fam, ok := families[s.series.Name]
+		if !ok || fam.kind != "counter" {
+			if ok {
+				// a gauge with the same name; Prometheus can't
+				// represent both, so the counter wins.
+				p.log.WithField("name", s.series.Name).Debug("Metric is both a counter and a gauge")
+			}
+			fam = &family{kind: "counter", samples: map[string]sample{}}
+			families[s.series.Name] = fam
+		}
+		fam.samples[key] = s
+	}
+
+	// Summaries end with their _sum and _count series, which can't be
+	// exposed as families of their own as well.
+	var parts []sample
+	for _, s := range p.summaryParts {
+		parts = append(parts, s)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].series.Name != parts[j].series.Name {
+			return parts[i].series.Name > parts[j].series.Name // _sum first
+		}
+		return parts[i].series.Key() < parts[j].series.Key()
+	})
+	for _, s := range parts {
+		name := strings.TrimSuffix(strings.TrimSuffix(s.series.Name, "_count"), "_sum")
+		fam, ok := families[name]
+		if !ok || fam.kind != "summary" {
+			continue
+		}
+		delete(families, s.series.Name)
+		withParts := *fam
+		withParts.parts = append(fam.parts[:len(fam.parts):len(fam.parts)], s)
+		families[name] = &withParts
+	}
+	return families
+}
+
+func writeSample(w *bufio.Writer, name string, s sample, openMetrics bool) {
+	w.WriteString(name)
+	if len(s.series.Labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range s.series.Labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l.Name)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabelValue(l.Value))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+	if openMetrics && s.exemplar != nil {
+		fmt.Fprintf(w, ` # {trace_id="%d"} %s %s`, s.exemplar.TraceID,
+			strconv.FormatFloat(s.exemplar.Value, 'g', -1, 64),
+			strconv.FormatFloat(float64(s.exemplar.Timestamp)/1e9, 'f', 3, 64))
+	}
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
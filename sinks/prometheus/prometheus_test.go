@@ -0,0 +1,234 @@
+package prometheus
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func scrape(t *testing.T, sink *ExpositionSink) string {
+	w := httptest.NewRecorder()
+	sink.ServeHTTP(w, httptest.NewRequest("GET", ExpositionPath, nil))
+	require.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	return w.Body.String()
+}
+
+func TestSanitize(t *testing.T) {
+	assert.Equal(t, "a_b_c", SanitizeName("a.b.c"))
+	assert.Equal(t, "a:b_c", SanitizeName("a:b-c"))
+	assert.Equal(t, "_9lives", SanitizeName("9lives"))
+	assert.Equal(t, "a_b", SanitizeLabelName("a:b"))
+	assert.Equal(t, "_", SanitizeLabelName(""))
+}
+
+func TestSplitPercentile(t *testing.T) {
+	name, q, ok := SplitPercentile("a.b.99percentile")
+	assert.True(t, ok)
+	assert.Equal(t, "a.b", name)
+	assert.Equal(t, 0.99, q)
+
+	name, q, ok = SplitPercentile("a.b.99_9percentile")
+	assert.True(t, ok)
+	assert.Equal(t, "a.b", name)
+	assert.InDelta(t, 0.999, q, 1e-12)
+
+	_, _, ok = SplitPercentile("a.b.max")
+	assert.False(t, ok)
+}
+
+func TestExpositionFlush(t *testing.T) {
+	sink := NewExpositionSink(logrus.New(), false, 0)
+	sink.SetExcludedTags([]string{"secret"})
+	require.NoError(t, sink.Start(nil))
+
+	metrics := []samplers.InterMetric{
+		{Name: "a.counter", Value: 2, Tags: []string{"foo:bar", "secret:x"}, Type: samplers.CounterMetric},
+		{Name: "a.gauge", Value: 1.5, Tags: []string{"foo:b\"ar", "valueless"}, Type: samplers.GaugeMetric},
+		{Name: "a.timer.50percentile", Value: 10, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+		{Name: "a.timer.99percentile", Value: 20, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+		{Name: "not.us", Value: 1, Type: samplers.GaugeMetric, Sinks: samplers.RouteInformation{"datadog": struct{}{}}},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	require.NoError(t, sink.Flush(context.Background(), metrics[:1]))
+
+	body := scrape(t, sink)
+	assert.Contains(t, body, "# TYPE a_counter counter\na_counter{foo=\"bar\"} 4\n",
+		"counters should accumulate across flushes")
+	assert.NotContains(t, body, "a_gauge", "gauges should only reflect the latest flush")
+	assert.NotContains(t, body, "not_us")
+
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	body = scrape(t, sink)
+	assert.Contains(t, body, "a_counter{foo=\"bar\"} 6\n")
+	assert.Contains(t, body, "# TYPE a_gauge gauge\na_gauge{foo=\"b\\\"ar\",valueless=\"\"} 1.5\n")
+	assert.Contains(t, body, "# TYPE a_timer gauge\n")
+	assert.Contains(t, body, "a_timer{foo=\"bar\",quantile=\"0.5\"} 10\n")
+	assert.Contains(t, body, "a_timer{foo=\"bar\",quantile=\"0.99\"} 20\n")
+	assert.NotContains(t, body, "secret")
+}
+
+func TestExpositionExpiresCounters(t *testing.T) {
+	sink := NewExpositionSink(logrus.New(), false, 2)
+	stale := samplers.InterMetric{Name: "a.stale", Value: 1, Type: samplers.CounterMetric}
+	live := samplers.InterMetric{Name: "a.live", Value: 1, Type: samplers.CounterMetric}
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{stale, live}))
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{live}))
+	body := scrape(t, sink)
+	assert.Contains(t, body, "a_stale 1\n", "counters are kept until they expire")
+	assert.Contains(t, body, "a_live 2\n")
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{live}))
+	body = scrape(t, sink)
+	assert.NotContains(t, body, "a_stale")
+	assert.Contains(t, body, "a_live 3\n")
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{stale}))
+	assert.Contains(t, scrape(t, sink), "a_stale 1\n", "expired counters start over")
+}
+
+func TestExpositionSummaries(t *testing.T) {
+	sink := NewExpositionSink(logrus.New(), true, 0)
+	metrics := []samplers.InterMetric{
+		{Name: "a.timer.50percentile", Value: 10, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+		{Name: "a.timer.99percentile", Value: 20, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+		{Name: "a.timer.sum", Value: 45, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+		{Name: "a.timer.count", Value: 3, Tags: []string{"foo:bar"}, Type: samplers.CounterMetric},
+		{Name: "a.timer.max", Value: 20, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+		{Name: "other.count", Value: 1, Type: samplers.CounterMetric},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	body := scrape(t, sink)
+	assert.Contains(t, body, "# TYPE a_timer summary\n"+
+		"a_timer{foo=\"bar\",quantile=\"0.5\"} 10\n"+
+		"a_timer{foo=\"bar\",quantile=\"0.99\"} 20\n"+
+		"a_timer_sum{foo=\"bar\"} 90\n"+
+		"a_timer_count{foo=\"bar\"} 6\n",
+		"summaries' sums and counts should accumulate across flushes")
+	assert.NotContains(t, body, "# TYPE a_timer_count")
+	assert.NotContains(t, body, "# TYPE a_timer_sum")
+	assert.Contains(t, body, "# TYPE a_timer_max gauge\n")
+	assert.Contains(t, body, "# TYPE other_count counter\nother_count 2\n")
+}
+
+// stalledResponseWriter blocks writes until release is closed.
+type stalledResponseWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *stalledResponseWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestExpositionStalledScrapeDoesntBlockFlush(t *testing.T) {
+	sink := NewExpositionSink(logrus.New(), false, 0)
+	var metrics []samplers.InterMetric
+	for i := 0; i < 1000; i++ {
+		metrics = append(metrics, samplers.InterMetric{
+			Name: "a.gauge", Value: float64(i), Tags: []string{"i:" + strconv.Itoa(i)}, Type: samplers.GaugeMetric,
+		})
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+
+	w := &stalledResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		writing:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	scraped := make(chan struct{})
+	go func() {
+		sink.ServeHTTP(w, httptest.NewRequest("GET", ExpositionPath, nil))
+		close(scraped)
+	}()
+	<-w.writing
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- sink.Flush(context.Background(), metrics[:1])
+	}()
+	select {
+	case err := <-flushed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled scrape shouldn't block flushes")
+	}
+	close(w.release)
+	<-scraped
+	assert.Contains(t, w.Body.String(), "a_gauge{i=\"999\"} 999\n",
+		"the stalled scrape should finish with the metrics it started with")
+}
+
+func TestExpositionConcurrentScrape(t *testing.T) {
+	sink := NewExpositionSink(logrus.New(), false, 0)
+	metrics := []samplers.InterMetric{
+		{Name: "a.counter", Value: 1, Type: samplers.CounterMetric},
+		{Name: "a.gauge", Value: 1, Type: samplers.GaugeMetric},
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sink.Flush(context.Background(), metrics)
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			sink.ServeHTTP(w, httptest.NewRequest("GET", ExpositionPath, nil))
+		}()
+	}
+	wg.Wait()
+	assert.True(t, strings.Contains(scrape(t, sink), "a_counter 10\n"))
+}
+
+func TestExpositionOpenMetricsExemplars(t *testing.T) {
+	sink := NewExpositionSink(logrus.New(), false, 0)
+	metrics := []samplers.InterMetric{
+		{Name: "a.timer.count", Value: 3, Type: samplers.CounterMetric, Exemplars: []samplers.Exemplar{
+			{TraceID: 1, Value: 0.5, Timestamp: 1520879607789000000},
+			{TraceID: 2, Value: 4.5, Timestamp: 1520879608000000000},
+		}},
+		{Name: "a.timer.99percentile", Value: 4, Type: samplers.GaugeMetric, Exemplars: []samplers.Exemplar{
+			{TraceID: 2, Value: 4.5, Timestamp: 1520879608000000000},
+		}},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "a.timer.count", Value: 1, Type: samplers.CounterMetric},
+		metrics[1],
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", ExpositionPath, nil)
+	r.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	sink.ServeHTTP(w, r)
+	assert.Equal(t, openMetricsContentType, w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE a_timer_count counter\n"+
+		"a_timer_count_total 4 # {trace_id=\"2\"} 4.5 1520879608.000\n",
+		"counters should keep their largest last exemplar")
+	assert.Contains(t, body, "a_timer{quantile=\"0.99\"} 4\n",
+		"only counters can have exemplars")
+	assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+
+	body = scrape(t, sink)
+	assert.Contains(t, body, "a_timer_count 4\n",
+		"the text format has no exemplars")
+	assert.NotContains(t, body, "# EOF")
+}
@@ -0,0 +1,322 @@
+package prometheusrw
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	promsink "github.com/stripe/veneur/sinks/prometheus"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// CounterMode determines how veneur's counters are written.
+type CounterMode string
+
+const (
+	// CounterModeDelta writes each interval's count as-is.
+	CounterModeDelta CounterMode = "delta"
+	// CounterModeCumulative accumulates each counter into a
+	// monotonically increasing total, so rate() works downstream.
+	CounterModeCumulative CounterMode = "cumulative"
+)
+
+const defaultBatchSize = 5000
+const defaultMaxRetries = 3
+const defaultCounterExpiryIntervals = 60
+const retryBackoff = 250 * time.Millisecond
+
+// Options configures a remote_write sink.
+type Options struct {
+	Endpoint    string
+	CounterMode CounterMode
+	BatchSize   int
+	MaxRetries  int
+	// CounterExpiryIntervals is how many flushes a cumulative counter's
+	// total is kept for without being updated. Defaults to 60.
+	CounterExpiryIntervals int
+
+	BearerToken       string
+	BasicAuthUsername string
+	BasicAuthPassword string
+}
+
+// RemoteWriteSink is a MetricSink that pushes metrics to an endpoint
+// speaking the Prometheus remote_write protocol.
+type RemoteWriteSink struct {
+	opts         Options
+	client       *http.Client
+	log          *logrus.Logger
+	traceClient  *trace.Client
+	excludedTags map[string]struct{}
+
+	// only used in CounterModeCumulative
+	totalsMtx sync.Mutex
+	flushes   int64
+	totals    map[string]cumulativeTotal
+}
+
+// cumulativeTotal is a counter's running total, and the flush in which
+// it was last updated.
+type cumulativeTotal struct {
+	value   float64
+	updated int64
+}
+
+var _ sinks.MetricSink = &RemoteWriteSink{}
+
+// NewTLSConfig builds a client TLS configuration from PEM-encoded
+// certificates. Any of the arguments may be empty. If all are empty,
+// nil is returned, meaning the system defaults are used.
+func NewTLSConfig(authorityCert, cert, key string) (*tls.Config, error) {
+	if authorityCert == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+	conf := &tls.Config{}
+	if authorityCert != "" {
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM([]byte(authorityCert)) {
+			return nil, errors.New("could not load any authority certificates")
+		}
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
+
+// NewRemoteWriteSink creates a new remote_write sink. If client is
+// nil, a default HTTP client is used.
+func NewRemoteWriteSink(opts Options, client *http.Client, log *logrus.Logger) (*RemoteWriteSink, error) {
+	if opts.Endpoint == "" {
+		return nil, errors.New("a remote_write endpoint is required")
+	}
+	switch opts.CounterMode {
+	case "":
+		opts.CounterMode = CounterModeDelta
+	case CounterModeDelta, CounterModeCumulative:
+	default:
+		return nil, fmt.Errorf("unknown counter mode %q", opts.CounterMode)
+	}
+	if opts.BearerToken != "" && opts.BasicAuthUsername != "" {
+		return nil, errors.New("only one of bearer token and basic auth may be set")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+	if opts.CounterExpiryIntervals <= 0 {
+		opts.CounterExpiryIntervals = defaultCounterExpiryIntervals
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteWriteSink{
+		opts:   opts,
+		client: client,
+		log:    log,
+		totals: map[string]cumulativeTotal{},
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (rw *RemoteWriteSink) Name() string {
+	return "prometheus_remote_write"
+}
+
+// Start sets the sink up.
+func (rw *RemoteWriteSink) Start(cl *trace.Client) error {
+	rw.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will not be turned into labels.
+func (rw *RemoteWriteSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	rw.excludedTags = tagsSet
+}
+
+// FlushOtherSamples is a no-op; events and service checks have no
+// Prometheus representation.
+func (rw *RemoteWriteSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// Flush converts the metrics to time series and writes them to the
+// remote_write endpoint in batches. In CounterModeCumulative, it drops
+// the totals of counters that weren't flushed for
+// CounterExpiryIntervals flushes, so they start over if they come back.
+func (rw *RemoteWriteSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, subCtx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(rw.traceClient)
+	flushStart := time.Now()
+
+	series, skipped, expired := rw.convert(interMetrics)
+	tags := map[string]string{"sink": rw.Name()}
+	span.Add(ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(skipped), tags))
+	if rw.opts.CounterMode == CounterModeCumulative {
+		span.Add(ssf.Count(promsink.MetricKeyCountersExpired, float32(expired), tags))
+	}
+
+	var err error
+	for start := 0; start < len(series); start += rw.opts.BatchSize {
+		end := start + rw.opts.BatchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		if err = rw.write(subCtx, &WriteRequest{Timeseries: series[start:end]}); err != nil {
+			span.Error(err)
+			span.Add(ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(start), tags))
+			rw.log.WithError(err).WithField("metrics", len(series)-start).Warn("Could not write metrics to remote_write endpoint")
+			return err
+		}
+	}
+
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(len(series)), tags),
+	)
+	rw.log.WithField("metrics", len(series)).Info("Completed flush to remote_write endpoint")
+	return nil
+}
+
+func (rw *RemoteWriteSink) convert(interMetrics []samplers.InterMetric) ([]TimeSeries, int, int) {
+	series := make([]TimeSeries, 0, len(interMetrics))
+	skipped := 0
+	if rw.opts.CounterMode == CounterModeCumulative {
+		rw.totalsMtx.Lock()
+		defer rw.totalsMtx.Unlock()
+		rw.flushes++
+	}
+	for _, metric := range interMetrics {
+		if !sinks.IsAcceptableMetric(metric, rw) {
+			skipped++
+			continue
+		}
+		name, tags := metric.Name, metric.Tags
+		if base, quantile, ok := promsink.SplitPercentile(name); ok {
+			name = base
+			tags = append(tags[:len(tags):len(tags)], "quantile:"+strconv.FormatFloat(quantile, 'g', -1, 64))
+		}
+		s := promsink.SeriesFromTags(name, tags, rw.excludedTags)
+
+		value := metric.Value
+		if metric.Type == samplers.CounterMetric && rw.opts.CounterMode == CounterModeCumulative {
+			key := s.Key()
+			total := rw.totals[key]
+			total.value += value
+			total.updated = rw.flushes
+			rw.totals[key] = total
+			value = total.value
+		}
+
+		labels := make([]Label, 0, len(s.Labels)+1)
+		labels = append(labels, Label{Name: "__name__", Value: s.Name})
+		for _, l := range s.Labels {
+			labels = append(labels, Label{Name: l.Name, Value: l.Value})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		series = append(series, TimeSeries{
+			Labels:  labels,
+			Samples: []Sample{{Value: value, Timestamp: metric.Timestamp * 1000}},
+		})
+	}
+
+	expired := 0
+	for key, total := range rw.totals {
+		if rw.flushes-total.updated >= int64(rw.opts.CounterExpiryIntervals) {
+			delete(rw.totals, key)
+			expired++
+		}
+	}
+	return series, skipped, expired
+}
+
+// retryableError is returned for responses that may succeed if
+// retried: 429s and 5xxs.
+type retryableError struct {
+	status int
+	body   string
+}
+
+func (e *retryableError) Error() string {
+	return fmt.Sprintf("remote_write endpoint returned %d: %s", e.status, e.body)
+}
+
+func (rw *RemoteWriteSink) write(ctx context.Context, req *WriteRequest) error {
+	body := snappy.Encode(nil, req.Marshal())
+
+	var err error
+	for attempt := 0; attempt <= rw.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryBackoff << uint(attempt-1)):
+			}
+		}
+		err = rw.post(ctx, body)
+		if _, ok := err.(*retryableError); !ok {
+			return err
+		}
+		rw.log.WithError(err).WithField("attempt", attempt+1).Debug("Retrying remote_write request")
+	}
+	return err
+}
+
+func (rw *RemoteWriteSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, rw.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "veneur")
+	if rw.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rw.opts.BearerToken)
+	} else if rw.opts.BasicAuthUsername != "" {
+		req.SetBasicAuth(rw.opts.BasicAuthUsername, rw.opts.BasicAuthPassword)
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5 {
+		return &retryableError{status: resp.StatusCode, body: string(msg)}
+	}
+	return fmt.Errorf("remote_write endpoint returned %d: %s", resp.StatusCode, msg)
+}
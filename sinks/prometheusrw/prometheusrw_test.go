@@ -0,0 +1,194 @@
+package prometheusrw
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+// These mirror the upstream prompb types, so we can check our
+// hand-rolled encoding against the protobuf library's decoder.
+type pbLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *pbLabel) Reset()         { *m = pbLabel{} }
+func (m *pbLabel) String() string { return proto.CompactTextString(m) }
+func (*pbLabel) ProtoMessage()    {}
+
+type pbSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *pbSample) Reset()         { *m = pbSample{} }
+func (m *pbSample) String() string { return proto.CompactTextString(m) }
+func (*pbSample) ProtoMessage()    {}
+
+type pbTimeSeries struct {
+	Labels  []*pbLabel  `protobuf:"bytes,1,rep,name=labels"`
+	Samples []*pbSample `protobuf:"bytes,2,rep,name=samples"`
+}
+
+func (m *pbTimeSeries) Reset()         { *m = pbTimeSeries{} }
+func (m *pbTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*pbTimeSeries) ProtoMessage()    {}
+
+type pbWriteRequest struct {
+	Timeseries []*pbTimeSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+func (m *pbWriteRequest) Reset()         { *m = pbWriteRequest{} }
+func (m *pbWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*pbWriteRequest) ProtoMessage()    {}
+
+func decodeRequest(t *testing.T, r *http.Request) *pbWriteRequest {
+	assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	compressed, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	raw, err := snappy.Decode(nil, compressed)
+	require.NoError(t, err)
+	req := &pbWriteRequest{}
+	require.NoError(t, proto.Unmarshal(raw, req))
+	return req
+}
+
+var testMetrics = []samplers.InterMetric{
+	{Name: "a.b.counter", Timestamp: 1476119058, Value: 3, Tags: []string{"foo:bar"}, Type: samplers.CounterMetric},
+	{Name: "a.b.timer.99percentile", Timestamp: 1476119058, Value: 1.5, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+}
+
+func TestRemoteWriteEncoding(t *testing.T) {
+	var got *pbWriteRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+		got = decodeRequest(t, r)
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteSink(Options{Endpoint: srv.URL, BasicAuthUsername: "user", BasicAuthPassword: "pass"}, nil, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Flush(context.Background(), testMetrics))
+
+	require.NotNil(t, got)
+	require.Len(t, got.Timeseries, 2)
+	counter := got.Timeseries[0]
+	assert.Equal(t, []*pbLabel{{Name: "__name__", Value: "a_b_counter"}, {Name: "foo", Value: "bar"}}, counter.Labels)
+	assert.Equal(t, []*pbSample{{Value: 3, Timestamp: 1476119058000}}, counter.Samples)
+
+	timer := got.Timeseries[1]
+	assert.Equal(t, []*pbLabel{
+		{Name: "__name__", Value: "a_b_timer"},
+		{Name: "foo", Value: "bar"},
+		{Name: "quantile", Value: "0.99"},
+	}, timer.Labels)
+	assert.Equal(t, 1.5, timer.Samples[0].Value)
+}
+
+func TestRemoteWriteCumulativeCounters(t *testing.T) {
+	values := []float64{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+		values = append(values, decodeRequest(t, r).Timeseries[0].Samples[0].Value)
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteSink(Options{Endpoint: srv.URL, CounterMode: CounterModeCumulative, BearerToken: "tok"}, nil, logrus.New())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sink.Flush(context.Background(), testMetrics[:1]))
+	}
+	assert.Equal(t, []float64{3, 6, 9}, values)
+}
+
+func TestRemoteWriteExpiresCumulativeCounters(t *testing.T) {
+	values := map[string][]float64{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, ts := range decodeRequest(t, r).Timeseries {
+			values[ts.Labels[0].Value] = append(values[ts.Labels[0].Value], ts.Samples[0].Value)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteSink(Options{Endpoint: srv.URL, CounterMode: CounterModeCumulative, CounterExpiryIntervals: 2}, nil, logrus.New())
+	require.NoError(t, err)
+	stale := samplers.InterMetric{Name: "a.stale", Value: 1, Type: samplers.CounterMetric}
+	live := samplers.InterMetric{Name: "a.live", Value: 1, Type: samplers.CounterMetric}
+	for _, metrics := range [][]samplers.InterMetric{{stale, live}, {live}, {live}} {
+		require.NoError(t, sink.Flush(context.Background(), metrics))
+	}
+	assert.Len(t, sink.totals, 1, "the stale total should be dropped")
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{stale, live}))
+	assert.Equal(t, []float64{1, 2, 3, 4}, values["a_live"])
+	assert.Equal(t, []float64{1, 1}, values["a_stale"], "the expired total should start over")
+}
+
+func TestRemoteWriteRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteSink(Options{Endpoint: srv.URL, MaxRetries: 2}, nil, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Flush(context.Background(), testMetrics))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestRemoteWriteNoRetryOnClientError(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteSink(Options{Endpoint: srv.URL}, nil, logrus.New())
+	require.NoError(t, err)
+	assert.Error(t, sink.Flush(context.Background(), testMetrics))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRemoteWriteBatching(t *testing.T) {
+	batches := []int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		batches = append(batches, len(decodeRequest(t, r).Timeseries))
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteSink(Options{Endpoint: srv.URL, BatchSize: 2}, nil, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Flush(context.Background(), append(testMetrics, testMetrics[0])))
+	assert.Equal(t, []int{2, 1}, batches)
+}
+
+func TestNewRemoteWriteSinkValidation(t *testing.T) {
+	_, err := NewRemoteWriteSink(Options{}, nil, logrus.New())
+	assert.Error(t, err)
+	_, err = NewRemoteWriteSink(Options{Endpoint: "http://x", CounterMode: "nope"}, nil, logrus.New())
+	assert.Error(t, err)
+	_, err = NewRemoteWriteSink(Options{Endpoint: "http://x", BearerToken: "a", BasicAuthUsername: "b"}, nil, logrus.New())
+	assert.Error(t, err)
+}
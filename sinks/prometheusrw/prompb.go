@@ -0,0 +1,100 @@
+package prometheusrw
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The types in this file mirror the subset of Prometheus'
+// remote.proto/types.proto that remote_write needs. They're encoded
+// by hand to avoid pulling the Prometheus codebase in as a dependency.
+
+// WriteRequest is the body of a remote_write request.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is a set of samples for a single labelled series.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Label is a label name/value pair. The reserved "__name__" label
+// holds the metric name.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single value at a timestamp, in milliseconds since the
+// epoch.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func (l *Label) marshal(b []byte) []byte {
+	if l.Name != "" {
+		b = appendBytes(b, 1, []byte(l.Name))
+	}
+	if l.Value != "" {
+		b = appendBytes(b, 2, []byte(l.Value))
+	}
+	return b
+}
+
+func (s *Sample) marshal(b []byte) []byte {
+	if s.Value != 0 {
+		b = appendTag(b, 1, wireFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(s.Value))
+		b = append(b, buf[:]...)
+	}
+	if s.Timestamp != 0 {
+		b = appendTag(b, 2, wireVarint)
+		b = appendVarint(b, uint64(s.Timestamp))
+	}
+	return b
+}
+
+func (ts *TimeSeries) marshal(b []byte) []byte {
+	for i := range ts.Labels {
+		b = appendBytes(b, 1, ts.Labels[i].marshal(nil))
+	}
+	for i := range ts.Samples {
+		b = appendBytes(b, 2, ts.Samples[i].marshal(nil))
+	}
+	return b
+}
+
+// Marshal encodes the WriteRequest in the protobuf wire format.
+func (wr *WriteRequest) Marshal() []byte {
+	var b []byte
+	for i := range wr.Timeseries {
+		b = appendBytes(b, 1, wr.Timeseries[i].marshal(nil))
+	}
+	return b
+}
@@ -2,8 +2,11 @@ package signalfx
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -42,41 +45,99 @@ func (c *collection) addPoint(key string, point *datapoint.Datapoint) {
 	c.points = append(c.points, point)
 }
 
+// keyResult records the outcome of submitting one API key's batch
+// of datapoints.
+type keyResult struct {
+	keyID    string
+	points   int
+	duration time.Duration
+	err      error
+}
+
 func (c *collection) submit(ctx context.Context, cl *trace.Client) error {
 	wg := &sync.WaitGroup{}
-	errorCh := make(chan error, len(c.pointsByKey)+1)
+	resultCh := make(chan keyResult, len(c.pointsByKey)+1)
 
-	submitOne := func(client dpsink.Sink, points []*datapoint.Datapoint) {
+	submitOne := func(client dpsink.Sink, keyID string, points []*datapoint.Datapoint) {
+		defer wg.Done()
 		span, childCtx := trace.StartSpanFromContext(ctx, "")
 		span.SetTag("datapoint_count", len(points))
+		span.SetTag("key_id", keyID)
 		defer span.ClientFinish(cl)
-		defer wg.Done()
+
+		// Each key gets its own deadline, so that one slow
+		// organization can't hold up delivery for all the others:
+		if c.sink.flushTimeout > 0 {
+			var cancel context.CancelFunc
+			childCtx, cancel = context.WithTimeout(childCtx, c.sink.flushTimeout)
+			defer cancel()
+		}
+
+		start := time.Now()
 		err := client.AddDatapoints(childCtx, points)
+		res := keyResult{keyID: keyID, points: len(points), duration: time.Since(start), err: err}
+
+		tags := map[string]string{"sink": "signalfx", "key_id": keyID}
+		span.Add(ssf.Timing("signalfx.flush.key_duration_ns", res.duration, time.Nanosecond, tags))
 		if err != nil {
+			cause := "io"
+			if childCtx.Err() == context.DeadlineExceeded {
+				cause = "deadline_exceeded"
+			}
 			span.Error(err)
-			span.Add(ssf.Count("flush.error_total", 1, map[string]string{"cause": "io", "sink": "signalfx"}))
-			errorCh <- err
+			span.Add(ssf.Count("flush.error_total", 1, map[string]string{"cause": cause, "sink": "signalfx"}))
+			span.Add(ssf.Count("signalfx.flush.key_total", 1, map[string]string{"sink": "signalfx", "key_id": keyID, "result": "failure", "cause": cause}))
+		} else {
+			span.Add(ssf.Count("signalfx.flush.key_total", 1, map[string]string{"sink": "signalfx", "key_id": keyID, "result": "success"}))
 		}
+		resultCh <- res
 	}
 
 	wg.Add(1)
-	go submitOne(c.sink.defaultClient, c.points)
+	go submitOne(c.sink.defaultClient, KeyIdentifier(c.sink.defaultClient, ""), c.points)
 	for key, points := range c.pointsByKey {
 		wg.Add(1)
-		go submitOne(c.sink.client(key), points)
+		client := c.sink.client(key)
+		go submitOne(client, KeyIdentifier(client, key), points)
 	}
 	wg.Wait()
-	close(errorCh)
-	errors := []error{}
-	for err := range errorCh {
-		errors = append(errors, err)
+	close(resultCh)
+
+	errors := []string{}
+	for res := range resultCh {
+		if res.err != nil {
+			errors = append(errors, fmt.Sprintf("key %s (%d points): %v", res.keyID, res.points, res.err))
+		}
 	}
 	if len(errors) > 0 {
-		return fmt.Errorf("Could not submit to all sfx sinks: %v", errors)
+		sort.Strings(errors)
+		return fmt.Errorf("Could not submit to %d of %d sfx sinks: %s",
+			len(errors), len(c.pointsByKey)+1, strings.Join(errors, "; "))
 	}
 	return nil
 }
 
+// keyIDLength is the number of hex characters of the API key's hash
+// that are used to identify a key in metrics and error messages.
+const keyIDLength = 8
+
+// KeyIdentifier returns a short, non-reversible identifier for the
+// API key that a client submits with, suitable for tagging metrics
+// and log lines. If the client's token can't be determined, the
+// vary-by tag value is hashed instead; the default client without a
+// known token is identified as "default".
+func KeyIdentifier(client DPClient, tagValue string) string {
+	material := tagValue
+	if httpSink, ok := client.(*sfxclient.HTTPSink); ok && httpSink.AuthToken != "" {
+		material = httpSink.AuthToken
+	}
+	if material == "" {
+		return "default"
+	}
+	sum := sha256.Sum256([]byte(material))
+	return hex.EncodeToString(sum[:])[:keyIDLength]
+}
+
 // SignalFxSink is a MetricsSink implementation.
 type SignalFxSink struct {
 	defaultClient     DPClient
@@ -90,6 +151,7 @@ type SignalFxSink struct {
 	traceClient       *trace.Client
 	excludedTags      map[string]struct{}
 	derivedMetrics    samplers.DerivedMetricsProcessor
+	flushTimeout      time.Duration
 }
 
 // A DPClient is a client that can be used to submit signalfx data
@@ -107,8 +169,11 @@ func NewClient(endpoint, apiKey string, client *http.Client) DPClient {
 	return httpSink
 }
 
-// NewSignalFxSink creates a new SignalFx sink for metrics.
-func NewSignalFxSink(hostnameTag string, hostname string, commonDimensions map[string]string, log *logrus.Logger, client DPClient, varyBy string, perTagClients map[string]DPClient, derivedMetrics samplers.DerivedMetricsProcessor) (*SignalFxSink, error) {
+// NewSignalFxSink creates a new SignalFx sink for metrics. Each API
+// key's batch of datapoints is submitted concurrently, and if
+// flushTimeout is non-zero, each submission is bounded by it (in
+// addition to any deadline on the flush context).
+func NewSignalFxSink(hostnameTag string, hostname string, commonDimensions map[string]string, log *logrus.Logger, client DPClient, varyBy string, perTagClients map[string]DPClient, derivedMetrics samplers.DerivedMetricsProcessor, flushTimeout time.Duration) (*SignalFxSink, error) {
 	return &SignalFxSink{
 		defaultClient:     client,
 		clientsByTagValue: perTagClients,
@@ -118,6 +183,7 @@ func NewSignalFxSink(hostnameTag string, hostname string, commonDimensions map[s
 		log:               log,
 		varyBy:            varyBy,
 		derivedMetrics:    derivedMetrics,
+		flushTimeout:      flushTimeout,
 	}, nil
 }
 
@@ -207,6 +273,7 @@ func (sfx *SignalFxSink) Flush(ctx context.Context, interMetrics []samplers.Inte
 			countStatusMetrics++
 			point = sfxclient.GaugeF(metric.Name, dims, metric.Value)
 		}
+		point.Timestamp = time.Unix(metric.Timestamp, 0)
 		coll.addPoint(metricKey, point)
 		numPoints++
 	}
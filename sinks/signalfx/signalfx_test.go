@@ -2,6 +2,7 @@ package signalfx
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"sort"
 	"strconv"
@@ -58,7 +59,7 @@ func TestNewSignalFxSink(t *testing.T) {
 	// test the variables that have been renamed
 	client := NewClient("http://www.example.com", "secret", http.DefaultClient)
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), client, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), client, "", nil, derived, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,7 +84,7 @@ func TestNewSignalFxSink(t *testing.T) {
 func TestSignalFxFlushRouting(t *testing.T) {
 	fakeSink := NewFakeSink()
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived, 0)
 
 	assert.NoError(t, err)
 
@@ -137,7 +138,7 @@ func TestSignalFxFlushRouting(t *testing.T) {
 func TestSignalFxFlushGauge(t *testing.T) {
 	fakeSink := NewFakeSink()
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived, 0)
 
 	assert.NoError(t, err)
 
@@ -158,6 +159,7 @@ func TestSignalFxFlushGauge(t *testing.T) {
 	point := fakeSink.points[0]
 	assert.Equal(t, "a.b.c", point.Metric, "Metric has wrong name")
 	assert.Equal(t, datapoint.Gauge, point.MetricType, "Metric has wrong type")
+	assert.Equal(t, time.Unix(1476119058, 0), point.Timestamp, "Metric has wrong timestamp")
 	val, err := strconv.Atoi(point.Value.String())
 	assert.Nil(t, err, "Failed to parse value as integer")
 	assert.Equal(t, int(interMetrics[0].Value), val, "Status translates to gauge Value")
@@ -173,7 +175,7 @@ func TestSignalFxFlushGauge(t *testing.T) {
 func TestSignalFxFlushCounter(t *testing.T) {
 	fakeSink := NewFakeSink()
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived, 0)
 	assert.NoError(t, err)
 
 	interMetrics := []samplers.InterMetric{samplers.InterMetric{
@@ -210,7 +212,7 @@ func TestSignalFxFlushCounter(t *testing.T) {
 func TestSignalFxFlushStatus(t *testing.T) {
 	fakeSink := NewFakeSink()
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived, 0)
 	assert.NoError(t, err)
 
 	interMetrics := []samplers.InterMetric{samplers.InterMetric{
@@ -248,7 +250,7 @@ func TestSignalFxFlushStatus(t *testing.T) {
 func TestSignalFxServiceCheckFlushOther(t *testing.T) {
 	fakeSink := NewFakeSink()
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived, 0)
 	assert.NoError(t, err)
 
 	serviceCheckMsg := "Service Farts starting[an example link](http://catchpoint.com/session_id \"Title\")"
@@ -269,7 +271,7 @@ func TestSignalFxServiceCheckFlushOther(t *testing.T) {
 func TestSignalFxEventFlush(t *testing.T) {
 	fakeSink := NewFakeSink()
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fakeSink, "", nil, derived, 0)
 	assert.NoError(t, err)
 
 	evMessage := "[an example link](http://catchpoint.com/session_id \"Title\")"
@@ -300,7 +302,7 @@ func TestSignalFxEventFlush(t *testing.T) {
 func TestSignalFxSetExcludeTags(t *testing.T) {
 	fakeSink := NewFakeSink()
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie", "boo": "snakes"}, logrus.New(), fakeSink, "", nil, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie", "boo": "snakes"}, logrus.New(), fakeSink, "", nil, derived, 0)
 
 	sink.SetExcludedTags([]string{"foo", "boo", "host"})
 	assert.NoError(t, err)
@@ -364,7 +366,7 @@ func TestSignalFxFlushMultiKey(t *testing.T) {
 	specialized := NewFakeSink()
 
 	derived := newDerivedProcessor()
-	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fallback, "test_by", map[string]DPClient{"available": specialized}, derived)
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fallback, "test_by", map[string]DPClient{"available": specialized}, derived, 0)
 
 	assert.NoError(t, err)
 
@@ -429,3 +431,57 @@ func TestSignalFxFlushMultiKey(t *testing.T) {
 	}
 	assert.Empty(t, derived.samples, "Gauges should not generated derived metrics")
 }
+
+type failingSink struct {
+	FakeSink
+	block bool
+}
+
+func (fs *failingSink) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	if fs.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return errors.New("nope")
+}
+
+func TestSignalFxFlushMultiKeyIsolation(t *testing.T) {
+	fallback := NewFakeSink()
+	broken := &failingSink{}
+	slow := &failingSink{block: true}
+
+	derived := newDerivedProcessor()
+	sink, err := NewSignalFxSink("host", "glooblestoots", map[string]string{"yay": "pie"}, logrus.New(), fallback, "test_by", map[string]DPClient{"broken": broken, "slow": slow}, derived, 50*time.Millisecond)
+	assert.NoError(t, err)
+
+	interMetrics := []samplers.InterMetric{}
+	for _, val := range []string{"needs_fallback", "broken", "slow"} {
+		interMetrics = append(interMetrics, samplers.InterMetric{
+			Name:      "a.b.c",
+			Timestamp: 1476119058,
+			Value:     float64(100),
+			Tags:      []string{"test_by:" + val},
+			Type:      samplers.GaugeMetric,
+		})
+	}
+
+	start := time.Now()
+	err = sink.Flush(context.Background(), interMetrics)
+	assert.True(t, time.Since(start) < 5*time.Second, "Flush should respect the per-key timeout")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "2 of 3")
+		assert.Contains(t, err.Error(), "nope")
+		assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+	}
+	assert.Equal(t, 1, len(fallback.points), "Failing keys should not prevent delivery to the others")
+}
+
+func TestSignalFxKeyIdentifier(t *testing.T) {
+	client := NewClient("http://www.example.com", "secret", http.DefaultClient)
+	id := KeyIdentifier(client, "some_tag_value")
+	assert.Len(t, id, keyIDLength)
+	assert.NotContains(t, id, "secret")
+	assert.Equal(t, id, KeyIdentifier(NewClient("http://www.example.com", "secret", http.DefaultClient), "other"),
+		"The identifier should only depend on the API key")
+	assert.Equal(t, "default", KeyIdentifier(NewFakeSink(), ""))
+}
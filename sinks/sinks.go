@@ -74,9 +74,62 @@ const MetricKeySpanIngestDuration = "sink.span_ingest_total_duration_ns"
 const MetricKeyTotalSpansDropped = "sink.spans_dropped_total"
 
 // MetricKeyTotalSpansSkipped tracks the number of spans that are skipped due to
-// sampling, if sampling is enabled.
+// sampling, if sampling is enabled. Spans skipped for any other reason are
+// counted with a `reason` tag, e.g. SkipReasonUserDrop.
 const MetricKeyTotalSpansSkipped = "sink.spans_skipped_total"
 
+// SkipReasonUserDrop is the `reason` tag of MetricKeyTotalSpansSkipped for
+// spans whose application asked for their trace to be dropped; see
+// PriorityDropped.
+const SkipReasonUserDrop = "user_drop"
+
+// MetricKeyTotalSpanEventsDropped tracks the number of span events that a
+// SpanSink drops because it can't represent them. It should be emitted as a
+// counter, tagged with `sink:sink.Name()`.
+const MetricKeyTotalSpanEventsDropped = "sink.span_events_dropped_total"
+
+// SampleTrace reports whether a span is chosen when sampling 1 in
+// every sampleRate traces. Sampling is performed on the trace ID, so
+// sinks using the same rate keep the same traces, and either all spans
+// of a trace are chosen or none are. Indicator spans, spans with a
+// trace ID of 0, and spans whose trace the application asked to keep
+// are always chosen; spans whose trace it asked to drop never are. A
+// sampleRate of 1 or less chooses every other span. Both halves of
+// 128-bit trace IDs are sampled on.
+func SampleTrace(span *ssf.SSFSpan, sampleRate int64) bool {
+	switch span.SamplingPriority {
+	case ssf.SSFSpan_USER_KEEP:
+		return true
+	case ssf.SSFSpan_USER_DROP:
+		return false
+	}
+	if sampleRate <= 1 || span.Indicator {
+		return true
+	}
+	return (span.TraceId^span.TraceIdHigh)%sampleRate == 0
+}
+
+// PriorityKept reports whether the application asked for a span's
+// trace to be kept, regardless of any sink's sample rate.
+func PriorityKept(span *ssf.SSFSpan) bool {
+	return span.SamplingPriority == ssf.SSFSpan_USER_KEEP
+}
+
+// PriorityDropped reports whether the application asked for a span's
+// trace to be dropped. Span sinks that send traces on skip these spans,
+// counting them as MetricKeyTotalSpansSkipped with the
+// SkipReasonUserDrop reason.
+func PriorityDropped(span *ssf.SSFSpan) bool {
+	return span.SamplingPriority == ssf.SSFSpan_USER_DROP
+}
+
+// Stopper is implemented by the metric and span sinks that release
+// resources, such as their connections, when Veneur shuts down. Stop is
+// called once, after the final flush.
+type Stopper interface {
+	Stop()
+}
+
 // SpanSink is a receiver of spans that handles sending those spans to some
 // downstream sink. Calls to `Ingest(span)` are meant to give the sink control
 // of the span, with periodic calls to flush as a signal for sinks that don't
@@ -93,6 +146,8 @@ type SpanSink interface {
 
 	// Flush receives `SSFSpan`s from Veneur **as they arrive**. If the sink wants
 	// to buffer spans it may do so and defer sending until `Flush` is called.
+	// Note that the sink must **not** mutate the span, as it is shared with
+	// other sinks, which may be ingesting it at the same time.
 	Ingest(*ssf.SSFSpan) error
 
 	// Invoked at the same interval as metric flushes, this can be used as a
@@ -0,0 +1,442 @@
+package spanfile
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/sinks/splunk"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+const (
+	// DefaultMaxSize is how big the file grows before it's rotated, by
+	// default.
+	DefaultMaxSize = 100 << 20
+
+	// DefaultMaxAge is how long spans are written to the file before
+	// it's rotated, by default.
+	DefaultMaxAge = time.Hour
+
+	// DefaultMaxFiles is how many rotated files are kept, by default.
+	DefaultMaxFiles = 10
+
+	// DefaultQueueSize is how many spans wait to be written, by default.
+	DefaultQueueSize = 1 << 14
+)
+
+// rotatedTimeFormat is the suffix of rotated files, which sorts them in
+// the order that they were rotated in.
+const rotatedTimeFormat = "20060102T150405.000000000Z"
+
+// checkInterval is how often the file is checked for being too old, and
+// its buffered spans written, while no spans arrive.
+const checkInterval = time.Second
+
+// The reasons that spans are dropped for.
+const (
+	reasonQueueFull   = "queue_full"
+	reasonWriteFailed = "write_failed"
+)
+
+// Option configures a span file sink.
+type Option func(*options)
+
+type options struct {
+	maxSize       int64
+	maxAge        time.Duration
+	compress      bool
+	maxFiles      int
+	maxTotalBytes int64
+	queueSize     int
+}
+
+// WithMaxSize rotates the file once it would grow past size bytes.
+func WithMaxSize(size int64) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.maxSize = size
+		}
+	}
+}
+
+// WithMaxAge rotates the file once spans have been written to it for
+// age. An age of 0 keeps the default; a negative age rotates files by
+// size only.
+func WithMaxAge(age time.Duration) Option {
+	return func(o *options) {
+		if age != 0 {
+			o.maxAge = age
+		}
+	}
+}
+
+// WithCompression compresses rotated files with gzip.
+func WithCompression() Option {
+	return func(o *options) {
+		o.compress = true
+	}
+}
+
+// WithRetention keeps at most maxFiles rotated files, and at most
+// maxTotalBytes bytes of them, removing the oldest first. 0 keeps the
+// default number of files, and any number of bytes.
+func WithRetention(maxFiles int, maxTotalBytes int64) Option {
+	return func(o *options) {
+		if maxFiles > 0 {
+			o.maxFiles = maxFiles
+		}
+		if maxTotalBytes > 0 {
+			o.maxTotalBytes = maxTotalBytes
+		}
+	}
+}
+
+// WithQueueSize sets how many spans wait to be written; spans that
+// arrive while the queue is full are dropped.
+func WithQueueSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.queueSize = size
+		}
+	}
+}
+
+// SpanSink archives spans in a local file, a JSON object per line,
+// rotating it by size and age. Spans are written in the background, so
+// a slow disk drops spans rather than slowing veneur down.
+type SpanSink struct {
+	path string
+	opts options
+	log  *logrus.Logger
+
+	queue chan []byte
+
+	// The file being written, which only the writing goroutine
+	// touches.
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	opened time.Time
+
+	// archiving is held while a rotated file is compressed and old
+	// files are removed, so that rotations are archived one at a time.
+	archiving sync.Mutex
+	archives  sync.WaitGroup
+
+	traceClient *trace.Client
+
+	writtenSpans     int64
+	droppedSpans     int64
+	failedSpans      int64
+	userDroppedSpans int64
+	rotations        int64
+}
+
+var _ sinks.SpanSink = &SpanSink{}
+
+// NewSpanSink creates a sink that archives spans in the file at path.
+func NewSpanSink(path string, log *logrus.Logger, opts ...Option) (*SpanSink, error) {
+	o := options{
+		maxSize:   DefaultMaxSize,
+		maxAge:    DefaultMaxAge,
+		maxFiles:  DefaultMaxFiles,
+		queueSize: DefaultQueueSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no span file path")
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s isn't a directory", filepath.Dir(path))
+	}
+	return &SpanSink{
+		path:  path,
+		opts:  o,
+		log:   log,
+		queue: make(chan []byte, o.queueSize),
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (*SpanSink) Name() string {
+	return "spanfile"
+}
+
+// Start opens the file and starts writing spans to it.
+func (s *SpanSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	if err := s.open(time.Now()); err != nil {
+		return err
+	}
+	go s.run()
+	return nil
+}
+
+// Ingest queues a span to be written.
+func (s *SpanSink) Ingest(span *ssf.SSFSpan) error {
+	if err := protocol.ValidateTrace(span); err != nil {
+		return err
+	}
+	if sinks.PriorityDropped(span) {
+		atomic.AddInt64(&s.userDroppedSpans, 1)
+		return nil
+	}
+
+	line, err := json.Marshal(splunk.SerializeSSF(span))
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- append(line, '\n'):
+	default:
+		atomic.AddInt64(&s.droppedSpans, 1)
+	}
+	return nil
+}
+
+// Flush reports what the sink wrote and dropped since the last flush;
+// spans are written as they arrive.
+func (s *SpanSink) Flush() {
+	samples := &ssf.Samples{}
+	defer metrics.Report(s.traceClient, samples)
+
+	tags := map[string]string{"sink": s.Name()}
+	samples.Add(
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(atomic.SwapInt64(&s.writtenSpans, 0)), tags),
+		ssf.Count("spanfile.rotations_total", float32(atomic.SwapInt64(&s.rotations, 0)), nil),
+	)
+	for reason, count := range map[string]int64{
+		reasonQueueFull:   atomic.SwapInt64(&s.droppedSpans, 0),
+		reasonWriteFailed: atomic.SwapInt64(&s.failedSpans, 0),
+	} {
+		if count == 0 {
+			continue
+		}
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(count),
+			map[string]string{"sink": s.Name(), "reason": reason}))
+	}
+	if dropped := atomic.SwapInt64(&s.userDroppedSpans, 0); dropped > 0 {
+		samples.Add(ssf.Count(sinks.MetricKeyTotalSpansSkipped, float32(dropped),
+			map[string]string{"sink": s.Name(), "reason": sinks.SkipReasonUserDrop}))
+	}
+}
+
+// run writes queued spans to the file.
+func (s *SpanSink) run() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-s.queue:
+			s.write(line, time.Now())
+			// Write what's buffered whenever the queue's caught
+			// up, so the file is never far behind:
+			if len(s.queue) == 0 {
+				s.flushFile()
+			}
+		case now := <-ticker.C:
+			s.flushFile()
+			if s.tooOld(now) {
+				s.rotate(now)
+			}
+		}
+	}
+}
+
+// open opens the file, appending to it if it exists.
+func (s *SpanSink) open(now time.Time) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.writer = bufio.NewWriter(f)
+	s.size = info.Size()
+	s.opened = now
+	return nil
+}
+
+// tooOld reports whether the file has been written to for longer than
+// its maximum age.
+func (s *SpanSink) tooOld(now time.Time) bool {
+	return s.opts.maxAge > 0 && s.size > 0 && now.Sub(s.opened) >= s.opts.maxAge
+}
+
+// write writes a span's line to the file, rotating the file first if
+// the line would make it too big or it's too old.
+func (s *SpanSink) write(line []byte, now time.Time) {
+	if s.size > 0 && (s.size+int64(len(line)) > s.opts.maxSize || s.tooOld(now)) {
+		s.rotate(now)
+	}
+	if s.file == nil {
+		// The file couldn't be opened after the last rotation:
+		if err := s.open(now); err != nil {
+			atomic.AddInt64(&s.failedSpans, 1)
+			return
+		}
+	}
+	n, err := s.writer.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		s.log.WithError(err).WithField("path", s.path).Warn("Couldn't write a span to the span file")
+		atomic.AddInt64(&s.failedSpans, 1)
+		return
+	}
+	atomic.AddInt64(&s.writtenSpans, 1)
+}
+
+// flushFile writes what's buffered to the file.
+func (s *SpanSink) flushFile() {
+	if s.writer == nil {
+		return
+	}
+	if err := s.writer.Flush(); err != nil {
+		s.log.WithError(err).WithField("path", s.path).Warn("Couldn't write spans to the span file")
+	}
+}
+
+// rotate renames the file aside, opens a new one, and archives the old
+// one in the background.
+func (s *SpanSink) rotate(now time.Time) {
+	if s.file != nil {
+		s.flushFile()
+		s.file.Close()
+		s.file, s.writer = nil, nil
+	}
+	rotated := s.path + "." + now.UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(s.path, rotated); err != nil {
+		s.log.WithError(err).WithField("path", s.path).Error("Couldn't rotate the span file")
+	} else {
+		atomic.AddInt64(&s.rotations, 1)
+		s.archives.Add(1)
+		go s.archive(rotated)
+	}
+	if err := s.open(now); err != nil {
+		s.log.WithError(err).WithField("path", s.path).Error("Couldn't open the span file")
+	}
+}
+
+// archive compresses a rotated file, if the sink compresses them, and
+// removes the oldest rotated files past the retention limits.
+func (s *SpanSink) archive(rotated string) {
+	defer s.archives.Done()
+	s.archiving.Lock()
+	defer s.archiving.Unlock()
+
+	if s.opts.compress {
+		if err := compress(rotated); err != nil {
+			s.log.WithError(err).WithField("path", rotated).Error("Couldn't compress a rotated span file")
+		}
+	}
+	s.prune()
+}
+
+// compress replaces a file with its gzipped copy.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Written under a name that prune ignores, until it's complete:
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the oldest rotated files while there are more of them,
+// or more bytes of them, than the retention limits allow.
+func (s *SpanSink) prune() {
+	dir, base := filepath.Split(s.path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		s.log.WithError(err).Error("Couldn't list rotated span files")
+		return
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		s.log.WithError(err).Error("Couldn't list rotated span files")
+		return
+	}
+
+	var rotated []os.FileInfo
+	var total int64
+	for _, info := range infos {
+		if info.IsDir() || !isRotated(base, info.Name()) {
+			continue
+		}
+		rotated = append(rotated, info)
+		total += info.Size()
+	}
+	// Rotated files' names sort by when they were rotated:
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].Name() < rotated[j].Name()
+	})
+	for len(rotated) > 0 &&
+		(len(rotated) > s.opts.maxFiles || (s.opts.maxTotalBytes > 0 && total > s.opts.maxTotalBytes)) {
+		oldest := rotated[0]
+		rotated = rotated[1:]
+		total -= oldest.Size()
+		if err := os.Remove(filepath.Join(dir, oldest.Name())); err != nil {
+			s.log.WithError(err).WithField("path", oldest.Name()).Error("Couldn't remove a rotated span file")
+		}
+	}
+}
+
+// isRotated reports whether a file name is that of a rotated file of
+// the span file named base, so that other files are left alone.
+func isRotated(base, name string) bool {
+	if !strings.HasPrefix(name, base+".") {
+		return false
+	}
+	suffix := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ".gz")
+	_, err := time.Parse(rotatedTimeFormat, suffix)
+	return err == nil
+}
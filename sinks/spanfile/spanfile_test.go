@@ -0,0 +1,184 @@
+package spanfile
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+func testSpan(id int64) *ssf.SSFSpan {
+	start := time.Date(2020, 3, 4, 23, 59, 0, 0, time.UTC)
+	return &ssf.SSFSpan{
+		TraceId:        id,
+		Id:             id,
+		ParentId:       1,
+		StartTimestamp: start.UnixNano(),
+		EndTimestamp:   start.Add(time.Second).UnixNano(),
+		Name:           "farm.feed",
+		Service:        "farm",
+		Tags:           map[string]string{"animal": "cow"},
+	}
+}
+
+// files returns the names of the files in dir, sorted.
+func files(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIngest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spanfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	sink, err := NewSpanSink(path, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, sink.Ingest(testSpan(i)))
+	}
+	dropped := testSpan(4)
+	dropped.SamplingPriority = ssf.SSFSpan_USER_DROP
+	require.NoError(t, sink.Ingest(dropped))
+	assert.Error(t, sink.Ingest(&ssf.SSFSpan{}))
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&sink.writtenSpans) < 3; {
+		require.True(t, time.Now().Before(deadline), "spans weren't written")
+		time.Sleep(10 * time.Millisecond)
+	}
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var ids []string
+	for scanner.Scan() {
+		var span map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &span))
+		assert.Equal(t, "farm.feed", span["name"])
+		ids = append(ids, span["id"].(string))
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, ids)
+	assert.Equal(t, int64(1), sink.userDroppedSpans)
+}
+
+func TestQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spanfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Without starting the sink, nothing drains the queue:
+	sink, err := NewSpanSink(filepath.Join(dir, "spans.json"), logrus.New(), WithQueueSize(2))
+	require.NoError(t, err)
+	for i := int64(1); i <= 5; i++ {
+		require.NoError(t, sink.Ingest(testSpan(i)))
+	}
+	assert.Equal(t, int64(3), sink.droppedSpans)
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spanfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+	// A file that isn't the sink's is left alone:
+	require.NoError(t, ioutil.WriteFile(path+".bak", []byte("mine"), 0644))
+
+	sink, err := NewSpanSink(path, logrus.New(), WithMaxSize(25), WithMaxAge(time.Minute), WithRetention(2, 0))
+	require.NoError(t, err)
+	now := time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, sink.open(now))
+
+	line := []byte("0123456789\n")
+	sink.write(line, now)
+	sink.write(line, now)
+	// The third line would make the file too big:
+	sink.write(line, now.Add(time.Second))
+	// The file is too old, though it's small:
+	sink.write(line, now.Add(time.Minute+time.Second))
+	sink.write(line, now.Add(time.Minute+2*time.Second))
+	sink.flushFile()
+	sink.archives.Wait()
+
+	assert.Equal(t, []string{
+		"spans.json",
+		"spans.json.20200304T000001.000000000Z",
+		"spans.json.20200304T000101.000000000Z",
+		"spans.json.bak",
+	}, files(t, dir))
+	assert.Equal(t, int64(5), sink.writtenSpans)
+	assert.Equal(t, int64(2), sink.rotations)
+
+	// A third rotation removes the oldest rotated file:
+	sink.write(line, now.Add(time.Hour))
+	sink.flushFile()
+	sink.archives.Wait()
+	assert.Equal(t, []string{
+		"spans.json",
+		"spans.json.20200304T000101.000000000Z",
+		"spans.json.20200304T010000.000000000Z",
+		"spans.json.bak",
+	}, files(t, dir))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "spans.json.20200304T010000.000000000Z"))
+	require.NoError(t, err)
+	assert.Equal(t, string(line)+string(line), string(content))
+}
+
+func TestCompressionAndTotalBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spanfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	sink, err := NewSpanSink(path, logrus.New(), WithMaxSize(1), WithCompression(), WithRetention(10, 100))
+	require.NoError(t, err)
+	now := time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, sink.open(now))
+	for i := 0; i < 5; i++ {
+		sink.write([]byte("0123456789\n"), now.Add(time.Duration(i)*time.Second))
+	}
+	sink.flushFile()
+	sink.archives.Wait()
+
+	// Each compressed file is a few dozen bytes, so only the newest
+	// few fit in 100:
+	names := files(t, dir)
+	require.True(t, len(names) > 1 && len(names) < 5, "%v", names)
+	assert.Equal(t, "spans.json", names[0])
+	newest := names[len(names)-1]
+	assert.Equal(t, "spans.json.20200304T000004.000000000Z.gz", newest)
+
+	f, err := os.Open(filepath.Join(dir, newest))
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789\n", string(content))
+}
+
+func TestNewSpanSink(t *testing.T) {
+	_, err := NewSpanSink("", logrus.New())
+	assert.Error(t, err)
+	_, err = NewSpanSink("/does/not/exist/spans.json", logrus.New())
+	assert.Error(t, err)
+}
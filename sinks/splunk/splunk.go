@@ -55,8 +55,9 @@ type splunkSpanSink struct {
 	traceClient *trace.Client
 	log         *logrus.Logger
 
-	spanSampleRate int64
-	skippedSpans   uint32
+	spanSampleRate   int64
+	skippedSpans     uint32
+	userDroppedSpans uint32
 
 	// these fields are for testing only:
 
@@ -118,6 +119,12 @@ func NewSplunkSpanSink(server string, token string, localHostname string, valida
 	}, nil
 }
 
+// SetSpanSampleRate replaces the sink's sample rate, which it samples
+// 1 in every rate traces at.
+func (sss *splunkSpanSink) SetSpanSampleRate(rate int) {
+	atomic.StoreInt64(&sss.spanSampleRate, int64(rate))
+}
+
 // Name returns this sink's name
 func (*splunkSpanSink) Name() string {
 	return "splunk"
@@ -305,6 +312,13 @@ func (sss *splunkSpanSink) Flush() {
 			map[string]string{"sink": sss.Name()},
 		),
 	)
+	if dropped := atomic.SwapUint32(&sss.userDroppedSpans, 0); dropped > 0 {
+		samples.Add(ssf.Count(
+			sinks.MetricKeyTotalSpansSkipped,
+			float32(dropped),
+			map[string]string{"sink": sss.Name(), "reason": sinks.SkipReasonUserDrop},
+		))
+	}
 
 	metrics.Report(sss.traceClient, samples)
 	return
@@ -318,10 +332,14 @@ func (sss *splunkSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 		return err
 	}
 
+	if sinks.PriorityDropped(ssfSpan) {
+		atomic.AddUint32(&sss.userDroppedSpans, 1)
+		return nil
+	}
 	// choose (1/spanSampleRate) spans for sampling if any spans
 	// have the traceID of 0 or are declared indicator spans, they
 	// will always be chosen, regardless of the sample rate.
-	if !ssfSpan.Indicator && ssfSpan.TraceId%sss.spanSampleRate != 0 {
+	if !sinks.SampleTrace(ssfSpan, atomic.LoadInt64(&sss.spanSampleRate)) {
 		atomic.AddUint32(&sss.skippedSpans, 1)
 		return nil
 	}
@@ -333,22 +351,8 @@ func (sss *splunkSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 		defer cancel()
 	}
 
-	serialized := SerializedSSF{
-		TraceId:        strconv.FormatInt(ssfSpan.TraceId, 10),
-		Id:             strconv.FormatInt(ssfSpan.Id, 10),
-		ParentId:       strconv.FormatInt(ssfSpan.ParentId, 10),
-		StartTimestamp: float64(ssfSpan.StartTimestamp) / float64(time.Second),
-		EndTimestamp:   float64(ssfSpan.EndTimestamp) / float64(time.Second),
-		Duration:       ssfSpan.EndTimestamp - ssfSpan.StartTimestamp,
-		Error:          ssfSpan.Error,
-		Service:        ssfSpan.Service,
-		Tags:           ssfSpan.Tags,
-		Indicator:      ssfSpan.Indicator,
-		Name:           ssfSpan.Name,
-	}
-
 	event := &Event{
-		Event: serialized,
+		Event: SerializeSSF(ssfSpan),
 	}
 	event.SetTime(time.Unix(0, ssfSpan.StartTimestamp))
 	event.SetHost(sss.hostname)
@@ -364,20 +368,70 @@ func (sss *splunkSpanSink) Ingest(ssfSpan *ssf.SSFSpan) error {
 	return nil
 }
 
+// SerializeSSF converts a span into a SerializedSSF.
+func SerializeSSF(ssfSpan *ssf.SSFSpan) SerializedSSF {
+	serialized := SerializedSSF{
+		TraceId:        ssf.TraceIDString(ssfSpan),
+		Id:             strconv.FormatInt(ssfSpan.Id, 10),
+		ParentId:       strconv.FormatInt(ssfSpan.ParentId, 10),
+		StartTimestamp: float64(ssfSpan.StartTimestamp) / float64(time.Second),
+		EndTimestamp:   float64(ssfSpan.EndTimestamp) / float64(time.Second),
+		Duration:       ssfSpan.EndTimestamp - ssfSpan.StartTimestamp,
+		Error:          ssfSpan.Error,
+		Service:        ssfSpan.Service,
+		Tags:           ssfSpan.Tags,
+		Indicator:      ssfSpan.Indicator,
+		Name:           ssfSpan.Name,
+	}
+	for _, link := range ssfSpan.Links {
+		serialized.Links = append(serialized.Links, SerializedSSFLink{
+			TraceId: ssf.LinkTraceIDString(link),
+			SpanId:  strconv.FormatInt(link.SpanId, 10),
+			Tags:    link.Tags,
+		})
+	}
+	for _, event := range ssfSpan.Events {
+		serialized.Events = append(serialized.Events, SerializedSSFEvent{
+			Timestamp: float64(event.Timestamp) / float64(time.Second),
+			Name:      event.Name,
+			Tags:      event.Tags,
+		})
+	}
+	return serialized
+}
+
 // SerializedSSF holds a set of fields in a format that Splunk can
 // handle (it can't handle int64s, and we don't want to round our
 // traceID to the thousands place).  This is mildly redundant, but oh
-// well.
+// well. 128-bit trace IDs are rendered as 32 hex digits.
 type SerializedSSF struct {
-	TraceId        string            `json:"trace_id"`
-	Id             string            `json:"id"`
-	ParentId       string            `json:"parent_id"`
-	StartTimestamp float64           `json:"start_timestamp"`
-	EndTimestamp   float64           `json:"end_timestamp"`
-	Duration       int64             `json:"duration_ns"`
-	Error          bool              `json:"error"`
-	Service        string            `json:"service"`
-	Tags           map[string]string `json:"tags"`
-	Indicator      bool              `json:"indicator"`
-	Name           string            `json:"name"`
+	TraceId        string               `json:"trace_id"`
+	Id             string               `json:"id"`
+	ParentId       string               `json:"parent_id"`
+	StartTimestamp float64              `json:"start_timestamp"`
+	EndTimestamp   float64              `json:"end_timestamp"`
+	Duration       int64                `json:"duration_ns"`
+	Error          bool                 `json:"error"`
+	Service        string               `json:"service"`
+	Tags           map[string]string    `json:"tags"`
+	Indicator      bool                 `json:"indicator"`
+	Name           string               `json:"name"`
+	Links          []SerializedSSFLink  `json:"links,omitempty"`
+	Events         []SerializedSSFEvent `json:"events,omitempty"`
+}
+
+// SerializedSSFLink holds a span link of a SerializedSSF, with its
+// IDs as strings like the span's.
+type SerializedSSFLink struct {
+	TraceId string            `json:"trace_id"`
+	SpanId  string            `json:"span_id"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// SerializedSSFEvent holds a span event of a SerializedSSF, with its
+// timestamp in seconds like the span's.
+type SerializedSSFEvent struct {
+	Timestamp float64           `json:"timestamp"`
+	Name      string            `json:"name"`
+	Tags      map[string]string `json:"tags,omitempty"`
 }
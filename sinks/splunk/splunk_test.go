@@ -85,6 +85,12 @@ func TestSpanIngestBatch(t *testing.T) {
 			ssf.Count("some.counter", 1, map[string]string{"purpose": "testing"}),
 			ssf.Gauge("some.gauge", 20, map[string]string{"purpose": "testing"}),
 		},
+		Links: []*ssf.SSFSpanLink{
+			{TraceId: 7, SpanId: 8, Tags: map[string]string{"message": "1"}},
+		},
+		Events: []*ssf.SSFSpanEvent{
+			{Timestamp: start.Add(time.Second).UnixNano(), Name: "cache miss"},
+		},
 	}
 	for i := 0; i < nToFlush; i++ {
 		span.Id = int64(i + 1)
@@ -123,6 +129,12 @@ func TestSpanIngestBatch(t *testing.T) {
 		assert.Equal(t, map[string]string{"farts": "mandatory"}, output.Tags)
 		assert.Equal(t, true, output.Indicator)
 		assert.Equal(t, true, output.Error)
+		assert.Equal(t, []splunk.SerializedSSFLink{
+			{TraceId: "7", SpanId: "8", Tags: map[string]string{"message": "1"}},
+		}, output.Links)
+		assert.Equal(t, []splunk.SerializedSSFEvent{
+			{Timestamp: float64(start.Add(time.Second).UnixNano()) / float64(time.Second), Name: "cache miss"},
+		}, output.Events)
 	}
 	sink.Stop()
 }
@@ -371,3 +383,56 @@ func TestSamplingIndicators(t *testing.T) {
 	assert.Equal(t, events, nToFlush, "Should have sent all the spans, but received %d of %d", events, nToFlush)
 	t.Logf("Received %d of %d events", events, nToFlush)
 }
+
+func TestSamplingPriority(t *testing.T) {
+	const nToFlush = 100
+	logger := logrus.StandardLogger()
+
+	ch := make(chan splunk.Event, nToFlush)
+	ts := httptest.NewServer(jsonEndpoint(t, ch))
+	gsink, err := splunk.NewSplunkSpanSink(ts.URL, "00000000-0000-0000-0000-000000000000",
+		"test-host", "", logger, time.Duration(0), time.Duration(0), nToFlush, 0, 10)
+	require.NoError(t, err)
+	sink := gsink.(splunk.TestableSplunkSpanSink)
+	err = sink.Start(nil)
+	require.NoError(t, err)
+
+	start := time.Unix(100000, 1000000)
+	end := start.Add(5 * time.Second)
+	span := &ssf.SSFSpan{
+		ParentId:       4,
+		StartTimestamp: start.UnixNano(),
+		EndTimestamp:   end.UnixNano(),
+		Service:        "test-srv",
+		Name:           "test-span",
+	}
+	for i := 0; i < nToFlush; i++ {
+		span.Id = int64(i + 1)
+		span.TraceId = int64(i + 1)
+		// Every kept trace is sent, regardless of the sample
+		// rate; every dropped one (including those the rate
+		// would choose) isn't:
+		span.SamplingPriority = ssf.SSFSpan_USER_KEEP
+		if i%2 == 1 {
+			span.SamplingPriority = ssf.SSFSpan_USER_DROP
+		}
+		err = sink.Ingest(span)
+		require.NoError(t, err, "error ingesting the %dth span", i)
+	}
+
+	sink.Sync()
+
+	// Ensure nothing sends into the channel anymore:
+	sink.Stop()
+
+	events := 0
+	for _ = range ch {
+		events++
+		if ch != nil {
+			ts.Close()
+			close(ch)
+			ch = nil
+		}
+	}
+	assert.Equal(t, nToFlush/2, events)
+}
@@ -2,7 +2,9 @@
 package ssfmetrics
 
 import (
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/veneur/protocol"
@@ -19,6 +21,7 @@ type metricExtractionSink struct {
 	indicatorSpanTimerName string
 	log                    *logrus.Logger
 	traceClient            *trace.Client
+	red                    *REDMetrics
 	spansProcessed         int64
 	metricsGenerated       int64
 }
@@ -37,16 +40,57 @@ type DerivedMetricsSink interface {
 	samplers.DerivedMetricsProcessor
 }
 
+// REDMetrics configures the request, error and duration ("RED")
+// metrics that the sink derives from the spans it ingests, for services
+// that only report spans. Each metric is only generated if it has a
+// name. The names are templates, in which "{service}" and "{name}" are
+// replaced by the span's service and name, e.g. "{service}.requests".
+type REDMetrics struct {
+	// RequestsName is the counter incremented for every span.
+	RequestsName string
+	// ErrorsName is the counter incremented for error spans.
+	ErrorsName string
+	// DurationName is the timer of the spans' durations, in
+	// milliseconds.
+	DurationName string
+
+	// IndicatorOnly limits the metrics to indicator spans.
+	IndicatorOnly bool
+
+	// TagKeys are the span tags that the metrics are tagged with,
+	// when spans have them, in addition to "service". Spans' other
+	// tags are left out, to bound the metrics' cardinality.
+	TagKeys []string
+}
+
+// Option configures a metric extraction sink.
+type Option func(*metricExtractionSink)
+
+// WithREDMetrics makes the sink derive RED metrics from spans. The
+// counters are aggregated globally, like the timer's percentiles, so
+// that they count every veneur's spans.
+func WithREDMetrics(red REDMetrics) Option {
+	return func(m *metricExtractionSink) {
+		if red.RequestsName != "" || red.ErrorsName != "" || red.DurationName != "" {
+			m.red = &red
+		}
+	}
+}
+
 // NewMetricExtractionSink sets up and creates a span sink that
 // extracts metrics ("samples") from SSF spans and reports them to a
 // veneur's metrics workers.
-func NewMetricExtractionSink(mw []Processor, timerName string, cl *trace.Client, log *logrus.Logger) (DerivedMetricsSink, error) {
-	return &metricExtractionSink{
+func NewMetricExtractionSink(mw []Processor, timerName string, cl *trace.Client, log *logrus.Logger, opts ...Option) (DerivedMetricsSink, error) {
+	m := &metricExtractionSink{
 		workers:                mw,
 		indicatorSpanTimerName: timerName,
 		traceClient:            cl,
 		log:                    log,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m, nil
 }
 
 // Name returns "metric_extraction".
@@ -131,10 +175,73 @@ func (m *metricExtractionSink) Ingest(span *ssf.SSFSpan) error {
 	}
 	metricsCount += len(spanMetrics)
 
-	m.sendMetrics(append(indicatorMetrics, spanMetrics...))
+	redMetrics, err := m.convertREDMetrics(span)
+	if err != nil {
+		m.log.WithError(err).
+			WithField("span_name", span.Name).
+			Warn("Couldn't derive RED metrics for span")
+		return err
+	}
+	metricsCount += len(redMetrics)
+
+	m.sendMetrics(append(append(indicatorMetrics, spanMetrics...), redMetrics...))
 	return nil
 }
 
+// convertREDMetrics derives the RED metrics of a span, if the sink is
+// configured to.
+func (m *metricExtractionSink) convertREDMetrics(span *ssf.SSFSpan) ([]samplers.UDPMetric, error) {
+	if m.red == nil || (m.red.IndicatorOnly && !span.Indicator) {
+		return nil, nil
+	}
+	service := span.Service
+	if service == "" {
+		service = "unknown"
+	}
+	names := strings.NewReplacer("{service}", service, "{name}", span.Name)
+	tags := map[string]string{"service": service}
+	for _, key := range m.red.TagKeys {
+		if value, ok := span.Tags[key]; ok {
+			tags[key] = value
+		}
+	}
+	counterTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		counterTags[k] = v
+	}
+	counterTags["veneurglobalonly"] = ""
+
+	var metrics []samplers.UDPMetric
+	add := func(name string, sample *ssf.SSFSample) error {
+		// Like the indicator timer, the metrics have no name
+		// prefix:
+		sample.Name = names.Replace(name)
+		metric, err := samplers.ParseMetricSSF(sample)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, metric)
+		return nil
+	}
+	if m.red.RequestsName != "" {
+		if err := add(m.red.RequestsName, ssf.Count("", 1, counterTags)); err != nil {
+			return nil, err
+		}
+	}
+	if m.red.ErrorsName != "" && span.Error {
+		if err := add(m.red.ErrorsName, ssf.Count("", 1, counterTags)); err != nil {
+			return nil, err
+		}
+	}
+	if m.red.DurationName != "" {
+		ms := float32(span.EndTimestamp-span.StartTimestamp) / float32(time.Millisecond)
+		if err := add(m.red.DurationName, ssf.Histogram("", ms, tags, ssf.TimeUnit(time.Millisecond))); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
 func (m *metricExtractionSink) Flush() {
 	tags := map[string]string{"sink": m.Name()}
 	metrics.ReportBatch(m.traceClient, []*ssf.SSFSample{
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur"
+	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/sinks"
 	"github.com/stripe/veneur/sinks/ssfmetrics"
 	"github.com/stripe/veneur/ssf"
@@ -138,3 +139,86 @@ func TestIndicatorMetricExtractor(t *testing.T) {
 	close(worker.PacketChan)
 	assert.Equal(t, 1, <-done, "Should have sent the right number of metrics")
 }
+
+type collector struct {
+	metrics []samplers.UDPMetric
+}
+
+func (c *collector) IngestUDP(m samplers.UDPMetric) {
+	c.metrics = append(c.metrics, m)
+}
+
+func TestREDMetricExtractor(t *testing.T) {
+	c := &collector{}
+	sink, err := ssfmetrics.NewMetricExtractionSink([]ssfmetrics.Processor{c}, "", nil, logrus.StandardLogger(),
+		ssfmetrics.WithREDMetrics(ssfmetrics.REDMetrics{
+			RequestsName: "{service}.requests",
+			ErrorsName:   "{service}.errors",
+			DurationName: "{service}.{name}.duration_ms",
+			TagKeys:      []string{"endpoint"},
+		}))
+	require.NoError(t, err)
+
+	start := time.Now()
+	span := &ssf.SSFSpan{
+		Id:             5,
+		TraceId:        5,
+		Service:        "api",
+		Name:           "handle",
+		StartTimestamp: start.UnixNano(),
+		EndTimestamp:   start.Add(1500 * time.Microsecond).UnixNano(),
+		Tags:           map[string]string{"endpoint": "/users", "user_id": "1234"},
+	}
+	require.NoError(t, sink.Ingest(span))
+
+	byName := map[string]samplers.UDPMetric{}
+	for _, m := range c.metrics {
+		if m.Name != "ssf.names_unique" {
+			byName[m.Name] = m
+		}
+	}
+	require.Len(t, byName, 2, "only error spans should be counted as errors")
+	requests := byName["api.requests"]
+	assert.Equal(t, "counter", requests.Type)
+	assert.Equal(t, samplers.GlobalOnly, requests.Scope)
+	assert.Equal(t, []string{"endpoint:/users", "service:api"}, requests.Tags)
+	duration := byName["api.handle.duration_ms"]
+	assert.Equal(t, "histogram", duration.Type)
+	assert.InDelta(t, 1.5, duration.Value, 0.001)
+	assert.Equal(t, []string{"endpoint:/users", "service:api"}, duration.Tags)
+
+	c.metrics = nil
+	span.Error = true
+	require.NoError(t, sink.Ingest(span))
+	names := []string{}
+	for _, m := range c.metrics {
+		names = append(names, m.Name)
+	}
+	assert.Contains(t, names, "api.errors")
+}
+
+func TestREDMetricExtractorIndicatorOnly(t *testing.T) {
+	c := &collector{}
+	sink, err := ssfmetrics.NewMetricExtractionSink([]ssfmetrics.Processor{c}, "", nil, logrus.StandardLogger(),
+		ssfmetrics.WithREDMetrics(ssfmetrics.REDMetrics{RequestsName: "requests", IndicatorOnly: true}))
+	require.NoError(t, err)
+
+	start := time.Now()
+	for _, indicator := range []bool{false, true} {
+		require.NoError(t, sink.Ingest(&ssf.SSFSpan{
+			Id:             5,
+			TraceId:        5,
+			Service:        "api",
+			StartTimestamp: start.UnixNano(),
+			EndTimestamp:   start.Add(time.Second).UnixNano(),
+			Indicator:      indicator,
+		}))
+	}
+	requests := 0
+	for _, m := range c.metrics {
+		if m.Name == "requests" {
+			requests++
+		}
+	}
+	assert.Equal(t, 1, requests)
+}
@@ -3,13 +3,14 @@
 package veneur
 
 import (
+	"errors"
 	"net"
 )
 
 // NewSocket creates a socket which is intended for use by a single goroutine.
 func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn, error) {
 	if reuseport {
-		panic("SO_REUSEPORT not supported on this platform")
+		return nil, errors.New("SO_REUSEPORT not supported on this platform")
 	}
 	serverConn, err := net.ListenUDP("udp", addr)
 	if err != nil {
@@ -20,3 +21,33 @@ func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn,
 	}
 	return serverConn, nil
 }
+
+// reusePortSupported reports whether the platform supports SO_REUSEPORT,
+// which it doesn't.
+func reusePortSupported() bool {
+	return false
+}
+
+// socketInode returns false, since the platform has no /proc/net/udp to
+// find the socket in.
+func socketInode(sock net.PacketConn) (uint64, bool) {
+	return 0, false
+}
+
+func socketMeminfo(sock net.PacketConn) (udpSocketStats, bool) {
+	return udpSocketStats{}, false
+}
+
+func readProcNetUDP() (map[uint64]udpSocketStats, error) {
+	return nil, errors.New("UDP socket statistics are only available on Linux")
+}
+
+// peerCredentialsSupported reports whether unix sockets' peers can be
+// identified, which they can't.
+func peerCredentialsSupported() bool {
+	return false
+}
+
+func unixPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	return peerCredentials{}, errors.New("SO_PEERCRED not supported on this platform")
+}
@@ -0,0 +1,27 @@
+// +build !linux
+
+package veneur
+
+import "net"
+
+// batchReader reads multiple datagrams per syscall, which is only
+// supported on Linux.
+type batchReader struct{}
+
+// newBatchReader returns false, since recvmmsg is only available on
+// Linux.
+func newBatchReader(conn net.PacketConn, bufs [][]byte) (*batchReader, bool) {
+	return nil, false
+}
+
+func (br *batchReader) read() (int, error) {
+	return 0, nil
+}
+
+func (br *batchReader) packet(i int) []byte {
+	return nil
+}
+
+func (br *batchReader) addr(i int) net.Addr {
+	return nil
+}
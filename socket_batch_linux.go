@@ -0,0 +1,116 @@
+package veneur
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr, which isn't in x/sys/unix.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// batchReader reads up to len(bufs) datagrams per recvmmsg syscall. It
+// reuses its buffers for every batch, so the packets it returns are only
+// valid until the next read.
+type batchReader struct {
+	raw   syscall.RawConn
+	bufs  [][]byte
+	msgs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrAny
+}
+
+// newBatchReader returns a batchReader for the socket, reading into the
+// buffers, or false if the socket can't be read from with recvmmsg.
+func newBatchReader(conn net.PacketConn, bufs [][]byte) (*batchReader, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	br := &batchReader{
+		raw:   raw,
+		bufs:  bufs,
+		msgs:  make([]mmsghdr, len(bufs)),
+		iovs:  make([]unix.Iovec, len(bufs)),
+		names: make([]unix.RawSockaddrAny, len(bufs)),
+	}
+	for i := range bufs {
+		br.iovs[i].Base = &bufs[i][0]
+		br.iovs[i].SetLen(len(bufs[i]))
+		br.msgs[i].hdr.Iov = &br.iovs[i]
+		br.msgs[i].hdr.Iovlen = 1
+		br.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&br.names[i]))
+	}
+	return br, true
+}
+
+// read waits for datagrams, and reads as many as are available, up to the
+// number of buffers. It returns how many it read.
+func (br *batchReader) read() (int, error) {
+	for i := range br.msgs {
+		// the kernel overwrites these with each datagram's
+		br.msgs[i].hdr.Namelen = unix.SizeofSockaddrAny
+		br.msgs[i].hdr.Flags = 0
+		br.msgs[i].len = 0
+	}
+	var n int
+	var errno syscall.Errno
+	err := br.raw.Read(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&br.msgs[0])), uintptr(len(br.msgs)),
+			unix.MSG_DONTWAIT, 0, 0)
+		if e == unix.EAGAIN || e == unix.EWOULDBLOCK {
+			// wait until the socket is readable
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return n, nil
+}
+
+// packet returns the i'th datagram of the last read, bounded by its
+// length, so that it never includes the bytes of an earlier, longer
+// datagram. Datagrams that didn't fit in their buffer are truncated to
+// its length.
+func (br *batchReader) packet(i int) []byte {
+	return br.bufs[i][:br.msgs[i].len]
+}
+
+// addr returns the source address of the i'th datagram of the last read.
+func (br *batchReader) addr(i int) net.Addr {
+	rsa := &br.names[i]
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])),
+		}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{
+			IP:   ip,
+			Port: int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchReader(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sock, err := NewSocket(addr, 2*1024*1024, false)
+	require.NoError(t, err)
+	defer sock.Close()
+
+	client, err := net.Dial("udp", sock.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	// the longer datagrams go first, so that any bytes of theirs left
+	// in the buffers would show in the shorter ones:
+	sent := []string{"a.b.c:1|c|#foo:bar", "d.e:2|g", "f:3|c", strings.Repeat("x", 40)}
+	for _, packet := range sent {
+		_, err := client.Write([]byte(packet))
+		require.NoError(t, err)
+	}
+
+	bufs := make([][]byte, 2)
+	for i := range bufs {
+		bufs[i] = make([]byte, 32)
+	}
+	br, ok := newBatchReader(sock, bufs)
+	require.True(t, ok)
+	var received []string
+	for len(received) < len(sent) {
+		n, err := br.read()
+		require.NoError(t, err)
+		for i := 0; i < n; i++ {
+			received = append(received, string(br.packet(i)))
+			assert.Equal(t, client.LocalAddr().String(), br.addr(i).String())
+		}
+	}
+	assert.Equal(t, []string{sent[0], sent[1], sent[2], strings.Repeat("x", 32)}, received,
+		"datagrams longer than the buffers should be truncated")
+}
+
+func TestReadMetricSocketBatches(t *testing.T) {
+	config := globalConfig()
+	config.ReadBatchSize = 4
+	s, err := NewFromConfig(logrus.New(), config)
+	require.NoError(t, err)
+	w := NewWorker(0, nil, nullLogger(), s.Statsd)
+	s.Workers = []*Worker{w}
+
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sock, err := NewSocket(addr, 2*1024*1024, false)
+	require.NoError(t, err)
+	pool := &sync.Pool{New: func() interface{} { return make([]byte, s.metricMaxLength+1) }}
+	done := make(chan struct{})
+	go func() {
+		s.readMetricSocket(sock, pool, nil)
+		close(done)
+	}()
+
+	client, err := net.Dial("udp", sock.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < 10; i++ {
+		_, err := client.Write([]byte(fmt.Sprintf("a.b.c:%d|c\nd.e.f:1|g", i)))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case m := <-w.PacketChan:
+			assert.Contains(t, []string{"a.b.c", "d.e.f"}, m.Name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the metrics")
+		}
+	}
+
+	close(s.shutdown)
+	sock.Close()
+	<-done
+}
+
+// BenchmarkReadMetricSocket floods a statsd socket, and times reading
+// and parsing b.N datagrams from it with one reader, one datagram per
+// syscall or in batches.
+func BenchmarkReadMetricSocket(b *testing.B) {
+	for _, batchSize := range []int{1, 32} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			config := globalConfig()
+			config.ReadBatchSize = batchSize
+			s, err := NewFromConfig(nullLogger(), config)
+			require.NoError(b, err)
+			w := NewWorker(0, nil, nullLogger(), s.Statsd)
+			s.Workers = []*Worker{w}
+
+			addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+			require.NoError(b, err)
+			sock, err := NewSocket(addr, 8*1024*1024, false)
+			require.NoError(b, err)
+			pool := &sync.Pool{New: func() interface{} { return make([]byte, s.metricMaxLength+1) }}
+			go s.readMetricSocket(sock, pool, nil)
+
+			stop := make(chan struct{})
+			for i := 0; i < 2; i++ {
+				go func() {
+					client, err := net.Dial("udp", sock.LocalAddr().String())
+					if err != nil {
+						return
+					}
+					defer client.Close()
+					packet := []byte("a.b.c:1|c|#foo:bar")
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						client.Write(packet)
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				<-w.PacketChan
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+			b.StopTimer()
+			close(stop)
+			close(s.shutdown)
+			sock.Close()
+		})
+	}
+}
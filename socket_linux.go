@@ -3,7 +3,9 @@ package veneur
 import (
 	"net"
 	"os"
+	"sync"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -69,3 +71,122 @@ func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn,
 	}
 	return ret, nil
 }
+
+var reusePortOnce sync.Once
+var reusePortOK bool
+
+// reusePortSupported reports whether the kernel supports SO_REUSEPORT on
+// UDP sockets.
+func reusePortSupported() bool {
+	reusePortOnce.Do(func() {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return
+		}
+		defer unix.Close(fd)
+		reusePortOK = unix.SetsockoptInt(fd, unix.SOL_SOCKET, 0xf, 1) == nil
+	})
+	return reusePortOK
+}
+
+// socketInode returns the inode of the socket, which identifies it in
+// /proc/net/udp.
+func socketInode(sock net.PacketConn) (uint64, bool) {
+	sc, ok := sock.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var stat unix.Stat_t
+	var statErr error
+	err = raw.Control(func(fd uintptr) {
+		statErr = unix.Fstat(int(fd), &stat)
+	})
+	if err != nil || statErr != nil {
+		return 0, false
+	}
+	return stat.Ino, true
+}
+
+// soMeminfo is SO_MEMINFO, which isn't in x/sys/unix.
+const soMeminfo = 55
+
+// skMeminfoDrops is the index of the drops in SO_MEMINFO's array, after
+// SK_MEMINFO_RMEM_ALLOC (the bytes queued) at 0 and the rest.
+const skMeminfoDrops = 8
+
+// socketMeminfo reads the socket's receive queue statistics with
+// SO_MEMINFO. It returns false if the kernel doesn't support it, or is
+// too old to count drops.
+func socketMeminfo(sock net.PacketConn) (udpSocketStats, bool) {
+	sc, ok := sock.(syscall.Conn)
+	if !ok {
+		return udpSocketStats{}, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return udpSocketStats{}, false
+	}
+	var meminfo [skMeminfoDrops + 1]uint32
+	size := uint32(unsafe.Sizeof(meminfo))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_SOCKET, soMeminfo,
+			uintptr(unsafe.Pointer(&meminfo[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 || size < uint32(unsafe.Sizeof(meminfo)) {
+		return udpSocketStats{}, false
+	}
+	return udpSocketStats{
+		drops:  int64(meminfo[skMeminfoDrops]),
+		queued: int64(meminfo[0]),
+	}, true
+}
+
+// readProcNetUDP reads the receive queue statistics of every UDP socket,
+// by inode.
+func readProcNetUDP() (map[uint64]udpSocketStats, error) {
+	stats := map[uint64]udpSocketStats{}
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = parseProcNetUDP(f, stats)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// peerCredentialsSupported reports whether unix sockets' peers can be
+// identified with SO_PEERCRED.
+func peerCredentialsSupported() bool {
+	return true
+}
+
+// unixPeerCredentials returns the credentials of the process at the
+// other end of the connection, as of when it connected.
+func unixPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	if credErr != nil {
+		return peerCredentials{}, credErr
+	}
+	return peerCredentials{uid: cred.Uid, pid: cred.Pid}, nil
+}
@@ -0,0 +1,70 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestSSFPeerTags(t *testing.T) {
+	addrNet, err := protocol.ResolveAddr(fmt.Sprintf("unix://@veneur-test-%d", os.Getpid()))
+	require.NoError(t, err)
+	addr := addrNet.(*net.UnixAddr)
+	listener, err := net.ListenUnix("unix", addr)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	client, err := net.DialUnix("unix", nil, addr)
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := listener.AcceptUnix()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	srv := &Server{}
+	assert.Nil(t, srv.ssfPeerTags(conn), "peer credentials should be opt-in")
+
+	srv.ssfPeerCredentials = true
+	assert.Equal(t, map[string]string{
+		"peer_uid": strconv.Itoa(os.Getuid()),
+		"peer_pid": strconv.Itoa(os.Getpid()),
+	}, srv.ssfPeerTags(conn))
+
+	srv.ssfPeerServices = map[uint32]string{uint32(os.Getuid()): "tests"}
+	tags := srv.ssfPeerTags(conn)
+	assert.Equal(t, map[string]string{"peer_service": "tests"}, tags)
+
+	span := &ssf.SSFSpan{
+		Tags:    map[string]string{"peer_service": "spoofed"},
+		Metrics: []*ssf.SSFSample{ssf.Count("a.b.c", 1, nil)},
+	}
+	tagSSFPeer(span, tags)
+	assert.Equal(t, tags, span.Tags)
+	assert.Equal(t, tags, span.Metrics[0].Tags)
+}
+
+func TestSSFUnixAbstract(t *testing.T) {
+	srv := &Server{}
+	srv.shutdown = make(chan struct{})
+	addrNet, err := protocol.ResolveAddr(fmt.Sprintf("unix://@veneur-ssf-test-%d", os.Getpid()))
+	require.NoError(t, err)
+	addr := addrNet.(*net.UnixAddr)
+
+	done, _ := startSSFUnix(srv, addr)
+	conn, err := net.DialUnix("unix", nil, addr)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Panics(t, func() {
+		startSSFUnix(&Server{}, addr)
+	}, "the abstract address should be in use")
+
+	close(srv.shutdown)
+	<-done
+}
@@ -0,0 +1,128 @@
+package veneur
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// udpSocket is one of the sockets of a UDP listener, whose kernel
+// receive queue statistics are reported at flush.
+type udpSocket struct {
+	protocol string
+	address  string
+	index    int
+	conn     net.PacketConn
+	inode    uint64
+}
+
+// udpSocketStats are the kernel's statistics of a UDP socket's receive
+// queue.
+type udpSocketStats struct {
+	// drops is how many packets were dropped since the socket was
+	// opened, because its receive buffer was full
+	drops int64
+	// queued is how many bytes are waiting to be read
+	queued int64
+}
+
+// registerUDPSocket records the socket to report its statistics, if the
+// platform can tell them.
+func (s *Server) registerUDPSocket(protocol string, index int, sock net.PacketConn) {
+	inode, ok := socketInode(sock)
+	if !ok {
+		return
+	}
+	s.udpSocketsMtx.Lock()
+	s.udpSockets = append(s.udpSockets, udpSocket{
+		protocol: protocol,
+		address:  sock.LocalAddr().String(),
+		index:    index,
+		conn:     sock,
+		inode:    inode,
+	})
+	s.udpSocketsMtx.Unlock()
+}
+
+// reportSocketStats reports each UDP socket's receive queue statistics,
+// as socket.drops_total and socket.receive_queue_bytes. They're read
+// with SO_MEMINFO, or from /proc/net/udp if the kernel doesn't support
+// it.
+func (s *Server) reportSocketStats() {
+	s.udpSocketsMtx.Lock()
+	sockets := s.udpSockets
+	s.udpSocketsMtx.Unlock()
+	if len(sockets) == 0 {
+		return
+	}
+
+	var procStats map[uint64]udpSocketStats
+	samples := make([]*ssf.SSFSample, 0, 2*len(sockets))
+	for _, sock := range sockets {
+		stats, ok := socketMeminfo(sock.conn)
+		if !ok {
+			if procStats == nil {
+				var err error
+				procStats, err = readProcNetUDP()
+				if err != nil {
+					log.WithError(err).Debug("Couldn't read the UDP sockets' statistics")
+					return
+				}
+			}
+			stats, ok = procStats[sock.inode]
+			if !ok {
+				continue
+			}
+		}
+		tags := map[string]string{
+			"listener": sock.address,
+			"protocol": sock.protocol,
+			"socket":   strconv.Itoa(sock.index),
+		}
+		samples = append(samples,
+			ssf.Gauge("socket.drops_total", float32(stats.drops), tags),
+			ssf.Gauge("socket.receive_queue_bytes", float32(stats.queued), tags))
+	}
+	if len(samples) > 0 {
+		metrics.ReportBatch(s.TraceClient, samples)
+	}
+}
+
+// parseProcNetUDP parses the statistics of each socket, by inode, from
+// the format of /proc/net/udp and /proc/net/udp6 into stats.
+func parseProcNetUDP(r io.Reader, stats map[uint64]udpSocketStats) error {
+	scanner := bufio.NewScanner(r)
+	// the first line is the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		queues := strings.SplitN(fields[4], ":", 2)
+		if len(queues) != 2 {
+			continue
+		}
+		queued, err := strconv.ParseInt(queues[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		drops, err := strconv.ParseInt(fields[12], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats[inode] = udpSocketStats{drops: drops, queued: queued}
+	}
+	return scanner.Err()
+}
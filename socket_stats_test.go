@@ -0,0 +1,22 @@
+package veneur
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcNetUDP(t *testing.T) {
+	const procNetUDP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 0100007F:1FBE 00000000:0000 07 00000000:00000A00 00:00000000 00000000  1000        0 41532 2 0000000000000000 17
+  456: 00000000:0044 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12345 2 0000000000000000 0
+`
+	stats := map[uint64]udpSocketStats{}
+	require.NoError(t, parseProcNetUDP(strings.NewReader(procNetUDP), stats))
+	assert.Equal(t, map[uint64]udpSocketStats{
+		41532: {drops: 17, queued: 2560},
+		12345: {},
+	}, stats)
+}
@@ -0,0 +1,226 @@
+package veneur
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+const (
+	defaultSourceAccountingMaxSources = 100
+	defaultSourceAccountingMaxNames   = 1000
+)
+
+// sourceAccounting counts the statsd packets, and the unique metric
+// names in them, that each source address sends in a flush interval, so
+// that the sources responsible for a spike can be found.
+//
+// Only the sources that send the most packets are kept: once there are
+// maxSources, a new source replaces the one with the fewest packets, and
+// starts out with its count (so counts may be overestimated, by at most
+// the overcount reported for them, but a source that sends a lot is
+// never missed). Each source also only keeps up to maxNames names.
+type sourceAccounting struct {
+	maxSources int
+	maxNames   int
+
+	mtx     sync.Mutex
+	sources map[string]*sourceEntry
+	byCount sourceHeap
+	last    []sourceSnapshot
+}
+
+type sourceEntry struct {
+	key         string
+	source      string
+	packets     int64
+	overcount   int64
+	names       map[string]struct{}
+	namesCapped bool
+	index       int
+}
+
+// sourceSnapshot is what's known about a source, in /debug/sources.
+type sourceSnapshot struct {
+	Source      string `json:"source"`
+	Packets     int64  `json:"packets"`
+	Overcount   int64  `json:"packets_overcount"`
+	UniqueNames int    `json:"unique_names"`
+	NamesCapped bool   `json:"unique_names_capped"`
+}
+
+func newSourceAccounting(maxSources, maxNames int) *sourceAccounting {
+	if maxSources <= 0 {
+		maxSources = defaultSourceAccountingMaxSources
+	}
+	if maxNames <= 0 {
+		maxNames = defaultSourceAccountingMaxNames
+	}
+	return &sourceAccounting{
+		maxSources: maxSources,
+		maxNames:   maxNames,
+		sources:    map[string]*sourceEntry{},
+	}
+}
+
+// sourceIP returns the IP address of a packet's or connection's peer, or
+// nil if it doesn't have one.
+func sourceIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// recordPacket counts a packet of newline-separated metrics from ip.
+func (sa *sourceAccounting) recordPacket(ip net.IP, packet []byte) {
+	if ip == nil {
+		return
+	}
+	ip = ip.To16()
+	sa.mtx.Lock()
+	defer sa.mtx.Unlock()
+
+	entry, ok := sa.sources[string(ip)]
+	if !ok {
+		entry = sa.add(ip)
+	}
+	entry.packets++
+	heap.Fix(&sa.byCount, entry.index)
+
+	for len(packet) > 0 {
+		line := packet
+		if nl := bytes.IndexByte(packet, '\n'); nl != -1 {
+			line, packet = packet[:nl], packet[nl+1:]
+		} else {
+			packet = nil
+		}
+		if bytes.HasPrefix(line, []byte("_e{")) || bytes.HasPrefix(line, []byte("_sc")) {
+			continue
+		}
+		name := line
+		if colon := bytes.IndexByte(line, ':'); colon != -1 {
+			name = line[:colon]
+		}
+		if _, ok := entry.names[string(name)]; ok {
+			continue
+		}
+		if len(entry.names) >= sa.maxNames {
+			entry.namesCapped = true
+			continue
+		}
+		entry.names[string(name)] = struct{}{}
+	}
+}
+
+// add starts tracking a source, evicting the one with the fewest packets
+// if the table is full. The caller must hold mtx.
+func (sa *sourceAccounting) add(ip net.IP) *sourceEntry {
+	entry := &sourceEntry{
+		key:    string(ip),
+		source: ip.String(),
+		names:  map[string]struct{}{},
+	}
+	if len(sa.byCount) >= sa.maxSources {
+		evicted := heap.Pop(&sa.byCount).(*sourceEntry)
+		delete(sa.sources, evicted.key)
+		entry.packets = evicted.packets
+		entry.overcount = evicted.packets
+	}
+	sa.sources[entry.key] = entry
+	heap.Push(&sa.byCount, entry)
+	return entry
+}
+
+// snapshot returns the sources being tracked, those that sent the most
+// packets first. The caller must hold mtx.
+func (sa *sourceAccounting) snapshot() []sourceSnapshot {
+	snap := make([]sourceSnapshot, 0, len(sa.byCount))
+	for _, entry := range sa.byCount {
+		snap = append(snap, sourceSnapshot{
+			Source:      entry.source,
+			Packets:     entry.packets,
+			Overcount:   entry.overcount,
+			UniqueNames: len(entry.names),
+			NamesCapped: entry.namesCapped,
+		})
+	}
+	sort.Slice(snap, func(i, j int) bool {
+		if snap[i].Packets != snap[j].Packets {
+			return snap[i].Packets > snap[j].Packets
+		}
+		return snap[i].Source < snap[j].Source
+	})
+	return snap
+}
+
+// rotate ends the interval: it reports what each source sent as internal
+// metrics, keeps it for /debug/sources, and starts counting afresh.
+func (sa *sourceAccounting) rotate(cl *trace.Client) {
+	sa.mtx.Lock()
+	snap := sa.snapshot()
+	sa.last = snap
+	sa.sources = map[string]*sourceEntry{}
+	sa.byCount = nil
+	sa.mtx.Unlock()
+
+	samples := make([]*ssf.SSFSample, 0, 2*len(snap))
+	for _, src := range snap {
+		tags := map[string]string{"source": src.Source}
+		samples = append(samples,
+			ssf.Gauge("sources.packets", float32(src.Packets), tags),
+			ssf.Gauge("sources.unique_names", float32(src.UniqueNames), tags))
+	}
+	if len(samples) > 0 {
+		metrics.ReportBatch(cl, samples)
+	}
+}
+
+// ServeHTTP shows the sources of the current and the last interval as
+// JSON.
+func (sa *sourceAccounting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sa.mtx.Lock()
+	body := struct {
+		Current      []sourceSnapshot `json:"current"`
+		LastInterval []sourceSnapshot `json:"last_interval"`
+	}{sa.snapshot(), sa.last}
+	sa.mtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// sourceHeap is a min-heap of sources by packet count.
+type sourceHeap []*sourceEntry
+
+func (h sourceHeap) Len() int           { return len(h) }
+func (h sourceHeap) Less(i, j int) bool { return h[i].packets < h[j].packets }
+func (h sourceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sourceHeap) Push(x interface{}) {
+	entry := x.(*sourceEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *sourceHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,76 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceAccounting(t *testing.T) {
+	sa := newSourceAccounting(2, 2)
+	busy := net.ParseIP("10.0.0.1")
+	quiet := net.ParseIP("10.0.0.2")
+	for i := 0; i < 5; i++ {
+		sa.recordPacket(busy, []byte("a:1|c\nb:1|c\nc:1|c\n_sc|check|0"))
+	}
+	sa.recordPacket(quiet, []byte("a:1|c"))
+	sa.recordPacket(quiet, []byte("a:2|c"))
+
+	sa.mtx.Lock()
+	snap := sa.snapshot()
+	sa.mtx.Unlock()
+	assert.Equal(t, []sourceSnapshot{
+		{Source: "10.0.0.1", Packets: 5, UniqueNames: 2, NamesCapped: true},
+		{Source: "10.0.0.2", Packets: 2, UniqueNames: 1},
+	}, snap)
+
+	// A new source replaces the one with the fewest packets, and starts
+	// out with its count:
+	sa.recordPacket(net.ParseIP("10.0.0.3"), []byte("z:1|g"))
+	sa.mtx.Lock()
+	snap = sa.snapshot()
+	sa.mtx.Unlock()
+	assert.Equal(t, []sourceSnapshot{
+		{Source: "10.0.0.1", Packets: 5, UniqueNames: 2, NamesCapped: true},
+		{Source: "10.0.0.3", Packets: 3, Overcount: 2, UniqueNames: 1},
+	}, snap)
+	assert.Len(t, sa.sources, 2)
+
+	sa.rotate(nil)
+	w := httptest.NewRecorder()
+	sa.ServeHTTP(w, httptest.NewRequest("GET", "/debug/sources", nil))
+	var body struct {
+		Current      []sourceSnapshot `json:"current"`
+		LastInterval []sourceSnapshot `json:"last_interval"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Empty(t, body.Current, "rotating should start counting afresh")
+	assert.Equal(t, snap, body.LastInterval)
+}
+
+func TestServerSourceAccounting(t *testing.T) {
+	config := localConfig()
+	config.StatsdSourceAccounting = true
+	f := newFixture(t, config, nil, nil)
+	defer f.Close()
+
+	conn, err := net.Dial("udp", f.server.StatsdListenAddrs[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a.b.c:1|c"))
+	require.NoError(t, err)
+
+	require.NoError(t, waitFor(func() bool {
+		w := httptest.NewRecorder()
+		f.server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/sources", nil))
+		var body struct {
+			Current []sourceSnapshot `json:"current"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		return len(body.Current) == 1 && body.Current[0].Source == "127.0.0.1"
+	}))
+}
@@ -0,0 +1,209 @@
+package veneur
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// The actions of span scrub rules.
+const (
+	scrubDelete   = "delete"
+	scrubRedact   = "redact"
+	scrubTruncate = "truncate"
+)
+
+// scrubRedacted replaces the values of tags that a redact rule matches.
+const scrubRedacted = "[REDACTED]"
+
+// SpanScrubRule is one of the span_scrub_rules, which change the tags
+// of spans before any span sink sees them. Its Action is one of:
+//
+//   - "delete": delete the tags whose key matches KeyPattern.
+//   - "redact": replace the values that match ValuePattern with
+//     "[REDACTED]".
+//   - "truncate": cut the values longer than MaxBytes down to size.
+//
+// Redact and truncate rules only apply to the tags whose key matches
+// KeyPattern, if it's set. Rules are counted by Name, or their index if
+// it's empty.
+type SpanScrubRule struct {
+	Action       string `yaml:"action"`
+	KeyPattern   string `yaml:"key_pattern"`
+	MaxBytes     int    `yaml:"max_bytes"`
+	Name         string `yaml:"name"`
+	ValuePattern string `yaml:"value_pattern"`
+}
+
+// scrubRule is a compiled SpanScrubRule.
+type scrubRule struct {
+	name     string
+	action   string
+	key      *regexp.Regexp
+	value    *regexp.Regexp
+	maxBytes int
+}
+
+// spanScrubber applies scrub rules to the tags of spans, and of their
+// links and events, in order.
+type spanScrubber struct {
+	rules []*scrubRule
+}
+
+// newSpanScrubber compiles the rules. It returns nil if there aren't
+// any.
+func newSpanScrubber(rules []SpanScrubRule) (*spanScrubber, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	sc := &spanScrubber{}
+	for i, rule := range rules {
+		r := &scrubRule{name: rule.Name, action: rule.Action, maxBytes: rule.MaxBytes}
+		if r.name == "" {
+			r.name = strconv.Itoa(i)
+		}
+		var err error
+		if rule.KeyPattern != "" {
+			if r.key, err = regexp.Compile(rule.KeyPattern); err != nil {
+				return nil, fmt.Errorf("span scrub rule %s key pattern: %v", r.name, err)
+			}
+		}
+		if rule.ValuePattern != "" {
+			if r.value, err = regexp.Compile(rule.ValuePattern); err != nil {
+				return nil, fmt.Errorf("span scrub rule %s value pattern: %v", r.name, err)
+			}
+		}
+		switch {
+		case r.action == scrubDelete && r.key == nil:
+			return nil, fmt.Errorf("span scrub rule %s deletes tags, but has no key_pattern", r.name)
+		case r.action == scrubRedact && r.value == nil:
+			return nil, fmt.Errorf("span scrub rule %s redacts values, but has no value_pattern", r.name)
+		case r.action == scrubTruncate && r.maxBytes <= 0:
+			return nil, fmt.Errorf("span scrub rule %s truncates values, but has no max_bytes", r.name)
+		case r.action != scrubDelete && r.action != scrubRedact && r.action != scrubTruncate:
+			return nil, fmt.Errorf("span scrub rule %s has unknown action %q", r.name, r.action)
+		}
+		sc.rules = append(sc.rules, r)
+	}
+	return sc, nil
+}
+
+// scrub returns a copy of the span with its tags, and those of its
+// links and events, scrubbed. The span itself is left as it was, and
+// the copy shares its unchanged parts. count is called with the number
+// of tags that each rule changed, if any.
+func (sc *spanScrubber) scrub(span *ssf.SSFSpan, count func(rule string, n int)) *ssf.SSFSpan {
+	counts := make([]int, len(sc.rules))
+	scrubbed := *span
+	scrubbed.Tags, _ = sc.scrubTags(span.Tags, counts)
+	linksCopied := false
+	for i, link := range span.Links {
+		tags, changed := sc.scrubTags(link.Tags, counts)
+		if !changed {
+			continue
+		}
+		if !linksCopied {
+			scrubbed.Links = append([]*ssf.SSFSpanLink{}, span.Links...)
+			linksCopied = true
+		}
+		l := *link
+		l.Tags = tags
+		scrubbed.Links[i] = &l
+	}
+	eventsCopied := false
+	for i, event := range span.Events {
+		tags, changed := sc.scrubTags(event.Tags, counts)
+		if !changed {
+			continue
+		}
+		if !eventsCopied {
+			scrubbed.Events = append([]*ssf.SSFSpanEvent{}, span.Events...)
+			eventsCopied = true
+		}
+		e := *event
+		e.Tags = tags
+		scrubbed.Events[i] = &e
+	}
+	for i, n := range counts {
+		if n > 0 {
+			count(sc.rules[i].name, n)
+		}
+	}
+	return &scrubbed
+}
+
+// scrubTags returns the tags with the rules applied, adding the number
+// of tags that each rule changed to counts. If no rule changes any,
+// it returns the tags themselves; otherwise, it returns a copy.
+func (sc *spanScrubber) scrubTags(tags map[string]string, counts []int) (map[string]string, bool) {
+	scrubbed := tags
+	changed := false
+	for i, r := range sc.rules {
+		for k, v := range scrubbed {
+			if r.key != nil && !r.key.MatchString(k) {
+				continue
+			}
+			deleted := false
+			switch r.action {
+			case scrubDelete:
+				deleted = true
+			case scrubRedact:
+				if v == scrubRedacted || !r.value.MatchString(v) {
+					continue
+				}
+				v = scrubRedacted
+			case scrubTruncate:
+				if len(v) <= r.maxBytes {
+					continue
+				}
+				v = truncateUTF8(v, r.maxBytes)
+			}
+			if !changed {
+				scrubbed = make(map[string]string, len(tags))
+				for k, v := range tags {
+					scrubbed[k] = v
+				}
+				changed = true
+			}
+			if deleted {
+				delete(scrubbed, k)
+			} else {
+				scrubbed[k] = v
+			}
+			counts[i]++
+		}
+	}
+	return scrubbed, changed
+}
+
+// truncateUTF8 cuts s down to at most n bytes, without splitting any
+// of its characters.
+func truncateUTF8(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// spanScrubberValue holds a span scrubber that's replaced, while it's
+// in use, when the config is reloaded. A nil *spanScrubberValue holds no
+// scrubber.
+type spanScrubberValue struct {
+	v atomic.Value // *spanScrubber
+}
+
+func (sv *spanScrubberValue) load() *spanScrubber {
+	if sv == nil {
+		return nil
+	}
+	sc, _ := sv.v.Load().(*spanScrubber)
+	return sc
+}
+
+func (sv *spanScrubberValue) store(sc *spanScrubber) {
+	sv.v.Store(sc)
+}
@@ -0,0 +1,93 @@
+package veneur
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestSpanScrubber(t *testing.T) {
+	sc, err := newSpanScrubber([]SpanScrubRule{
+		{Name: "secrets", Action: "delete", KeyPattern: "(?i)password|token|ssn"},
+		{Name: "cards", Action: "redact", ValuePattern: `\b[0-9]{16}\b`},
+		{Action: "truncate", KeyPattern: "^note$", MaxBytes: 4},
+	})
+	require.NoError(t, err)
+
+	span := &ssf.SSFSpan{
+		Id:      1,
+		TraceId: 1,
+		Tags: map[string]string{
+			"user":         "jane",
+			"API_TOKEN":    "hunter2",
+			"db.password":  "hunter2",
+			"payment":      "card 4242424242424242",
+			"note":         "héllo",
+			"unrestricted": "a very long value",
+		},
+		Links:  []*ssf.SSFSpanLink{{TraceId: 2, SpanId: 3, Tags: map[string]string{"ssn": "123-45-6789"}}},
+		Events: []*ssf.SSFSpanEvent{{Name: "retry", Tags: map[string]string{"attempt": "2"}}},
+	}
+	counts := map[string]int{}
+	scrubbed := sc.scrub(span, func(rule string, n int) { counts[rule] += n })
+
+	assert.Equal(t, map[string]string{
+		"user":         "jane",
+		"payment":      "[REDACTED]",
+		"note":         "hél",
+		"unrestricted": "a very long value",
+	}, scrubbed.Tags)
+	assert.Empty(t, scrubbed.Links[0].Tags)
+	assert.Equal(t, int64(3), scrubbed.Links[0].SpanId)
+	assert.Equal(t, map[string]int{"secrets": 3, "cards": 1, "2": 1}, counts)
+
+	// The original span, and the parts of it that weren't scrubbed,
+	// are left as they were:
+	assert.Len(t, span.Tags, 6)
+	assert.Equal(t, "123-45-6789", span.Links[0].Tags["ssn"])
+	assert.True(t, span.Events[0] == scrubbed.Events[0])
+
+	for _, rules := range [][]SpanScrubRule{
+		{{Action: "delete"}},
+		{{Action: "redact", KeyPattern: "password"}},
+		{{Action: "truncate"}},
+		{{Action: "shred", KeyPattern: "password"}},
+		{{Action: "delete", KeyPattern: "("}},
+	} {
+		_, err := newSpanScrubber(rules)
+		assert.Error(t, err, "rules %v", rules)
+	}
+	sc, err = newSpanScrubber(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, sc)
+}
+
+func TestSpanWorkerScrub(t *testing.T) {
+	cl, clch := newTestClient(t, 1)
+	go func() {
+		for range clch {
+		}
+	}()
+
+	fake := &fakeSpanSink{wg: &sync.WaitGroup{}}
+	spanChan := make(chan *ssf.SSFSpan)
+	sc, err := newSpanScrubber([]SpanScrubRule{{Name: "secrets", Action: "delete", KeyPattern: "password"}})
+	require.NoError(t, err)
+	worker := NewSpanWorker([]sinks.SpanSink{fake}, cl, nil, spanChan, map[string]string{"password": "common"})
+	worker.scrubber = &spanScrubberValue{}
+	worker.scrubber.store(sc)
+	go worker.Work()
+
+	fake.wg.Add(1)
+	spanChan <- &ssf.SSFSpan{Id: 1, TraceId: 1, Name: "login", Tags: map[string]string{"user": "jane"}}
+	fake.wg.Wait()
+	assert.Equal(t, map[string]string{"user": "jane"}, fake.latestSpan().Tags)
+
+	count, ok := worker.scrubCounts.Load("secrets")
+	require.True(t, ok)
+	assert.Equal(t, int64(1), *count.(*int64))
+}
@@ -10,6 +10,8 @@
 	It has these top-level messages:
 		SSFSample
 		SSFSpan
+		SSFSpanLink
+		SSFSpanEvent
 */
 package ssf
 
@@ -89,6 +91,35 @@ func (x SSFSample_Status) String() string {
 }
 func (SSFSample_Status) EnumDescriptor() ([]byte, []int) { return fileDescriptorSample, []int{0, 1} }
 
+type SSFSpan_SamplingPriority int32
+
+const (
+	// The sinks sample the span's trace at their own rates.
+	SSFSpan_AUTO SSFSpan_SamplingPriority = 0
+	// The application asked for the trace to be kept by every sink.
+	SSFSpan_USER_KEEP SSFSpan_SamplingPriority = 1
+	// The application asked for the trace to be dropped by every sink.
+	SSFSpan_USER_DROP SSFSpan_SamplingPriority = 2
+)
+
+var SSFSpan_SamplingPriority_name = map[int32]string{
+	0: "AUTO",
+	1: "USER_KEEP",
+	2: "USER_DROP",
+}
+var SSFSpan_SamplingPriority_value = map[string]int32{
+	"AUTO":      0,
+	"USER_KEEP": 1,
+	"USER_DROP": 2,
+}
+
+func (x SSFSpan_SamplingPriority) String() string {
+	return proto.EnumName(SSFSpan_SamplingPriority_name, int32(x))
+}
+func (SSFSpan_SamplingPriority) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptorSample, []int{1, 0}
+}
+
 // SSFSample is similar of a StatsD-style, point in time metric. It has a Metric
 // type, a name, a value and a timestamp. Additionally it can contain a message,
 // a status, a sample rate, a map of tags as string keys and values and a unit
@@ -240,6 +271,19 @@ type SSFSpan struct {
 	// (/customer/:id), the function (class::name.method), a friendly name
 	// (foo middleware) or whatever makes sense in your context.
 	Name string `protobuf:"bytes,13,opt,name=name,proto3" json:"name,omitempty"`
+	// the high 64 bits of a 128-bit trace ID, whose low 64 bits are
+	// trace_id. Spans from systems with 64-bit trace IDs leave it 0.
+	TraceIdHigh int64 `protobuf:"varint,14,opt,name=trace_id_high,json=traceIdHigh,proto3" json:"trace_id_high,omitempty"`
+	// Links are spans, often of other traces, that this span is
+	// causally related to without being their child: e.g., the spans
+	// that produced each of the messages of a batch that it handles.
+	Links []*SSFSpanLink `protobuf:"bytes,15,rep,name=links" json:"links,omitempty"`
+	// Events are timestamped annotations of what happened during the
+	// span, like a cache miss or the start of a retry.
+	Events []*SSFSpanEvent `protobuf:"bytes,16,rep,name=events" json:"events,omitempty"`
+	// Whether every sink should keep or drop the span's trace,
+	// regardless of their sample rates, or sample it as usual.
+	SamplingPriority SSFSpan_SamplingPriority `protobuf:"varint,17,opt,name=sampling_priority,json=samplingPriority,proto3,enum=ssf.SSFSpan_SamplingPriority" json:"sampling_priority,omitempty"`
 }
 
 func (m *SSFSpan) Reset()                    { *m = SSFSpan{} }
@@ -331,11 +375,121 @@ func (m *SSFSpan) GetName() string {
 	return ""
 }
 
+func (m *SSFSpan) GetTraceIdHigh() int64 {
+	if m != nil {
+		return m.TraceIdHigh
+	}
+	return 0
+}
+
+func (m *SSFSpan) GetLinks() []*SSFSpanLink {
+	if m != nil {
+		return m.Links
+	}
+	return nil
+}
+
+func (m *SSFSpan) GetEvents() []*SSFSpanEvent {
+	if m != nil {
+		return m.Events
+	}
+	return nil
+}
+
+func (m *SSFSpan) GetSamplingPriority() SSFSpan_SamplingPriority {
+	if m != nil {
+		return m.SamplingPriority
+	}
+	return SSFSpan_AUTO
+}
+
+// A link from an SSFSpan to another span, identified by its trace and
+// span IDs, that it is related to.
+type SSFSpanLink struct {
+	TraceId int64 `protobuf:"varint,1,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	SpanId  int64 `protobuf:"varint,2,opt,name=span_id,json=spanId,proto3" json:"span_id,omitempty"`
+	// Tags describe the relationship between the spans.
+	Tags map[string]string `protobuf:"bytes,3,rep,name=tags" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// the high 64 bits of the linked span's 128-bit trace ID, if any
+	TraceIdHigh int64 `protobuf:"varint,4,opt,name=trace_id_high,json=traceIdHigh,proto3" json:"trace_id_high,omitempty"`
+}
+
+func (m *SSFSpanLink) Reset()                    { *m = SSFSpanLink{} }
+func (m *SSFSpanLink) String() string            { return proto.CompactTextString(m) }
+func (*SSFSpanLink) ProtoMessage()               {}
+func (*SSFSpanLink) Descriptor() ([]byte, []int) { return fileDescriptorSample, []int{2} }
+
+func (m *SSFSpanLink) GetTraceId() int64 {
+	if m != nil {
+		return m.TraceId
+	}
+	return 0
+}
+
+func (m *SSFSpanLink) GetSpanId() int64 {
+	if m != nil {
+		return m.SpanId
+	}
+	return 0
+}
+
+func (m *SSFSpanLink) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *SSFSpanLink) GetTraceIdHigh() int64 {
+	if m != nil {
+		return m.TraceIdHigh
+	}
+	return 0
+}
+
+// An event that happened during an SSFSpan.
+type SSFSpanEvent struct {
+	// the time of the event, in nanoseconds since the UNIX epoch
+	Timestamp int64  `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Name      string `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	// Tags describe the event.
+	Tags map[string]string `protobuf:"bytes,3,rep,name=tags" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *SSFSpanEvent) Reset()                    { *m = SSFSpanEvent{} }
+func (m *SSFSpanEvent) String() string            { return proto.CompactTextString(m) }
+func (*SSFSpanEvent) ProtoMessage()               {}
+func (*SSFSpanEvent) Descriptor() ([]byte, []int) { return fileDescriptorSample, []int{3} }
+
+func (m *SSFSpanEvent) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *SSFSpanEvent) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *SSFSpanEvent) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*SSFSample)(nil), "ssf.SSFSample")
 	proto.RegisterType((*SSFSpan)(nil), "ssf.SSFSpan")
+	proto.RegisterType((*SSFSpanLink)(nil), "ssf.SSFSpanLink")
+	proto.RegisterType((*SSFSpanEvent)(nil), "ssf.SSFSpanEvent")
 	proto.RegisterEnum("ssf.SSFSample_Metric", SSFSample_Metric_name, SSFSample_Metric_value)
 	proto.RegisterEnum("ssf.SSFSample_Status", SSFSample_Status_name, SSFSample_Status_value)
+	proto.RegisterEnum("ssf.SSFSpan_SamplingPriority", SSFSpan_SamplingPriority_name, SSFSpan_SamplingPriority_value)
 }
 func (m *SSFSample) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
@@ -523,6 +677,140 @@ func (m *SSFSpan) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintSample(dAtA, i, uint64(len(m.Name)))
 		i += copy(dAtA[i:], m.Name)
 	}
+	if m.TraceIdHigh != 0 {
+		dAtA[i] = 0x70
+		i++
+		i = encodeVarintSample(dAtA, i, uint64(m.TraceIdHigh))
+	}
+	if len(m.Links) > 0 {
+		for _, msg := range m.Links {
+			dAtA[i] = 0x7a
+			i++
+			i = encodeVarintSample(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if len(m.Events) > 0 {
+		for _, msg := range m.Events {
+			dAtA[i] = 0x82
+			i++
+			dAtA[i] = 0x1
+			i++
+			i = encodeVarintSample(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if m.SamplingPriority != 0 {
+		dAtA[i] = 0x88
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintSample(dAtA, i, uint64(m.SamplingPriority))
+	}
+	return i, nil
+}
+
+func (m *SSFSpanLink) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *SSFSpanLink) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.TraceId != 0 {
+		dAtA[i] = 0x8
+		i++
+		i = encodeVarintSample(dAtA, i, uint64(m.TraceId))
+	}
+	if m.SpanId != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintSample(dAtA, i, uint64(m.SpanId))
+	}
+	if len(m.Tags) > 0 {
+		for k, _ := range m.Tags {
+			dAtA[i] = 0x1a
+			i++
+			v := m.Tags[k]
+			mapSize := 1 + len(k) + sovSample(uint64(len(k))) + 1 + len(v) + sovSample(uint64(len(v)))
+			i = encodeVarintSample(dAtA, i, uint64(mapSize))
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintSample(dAtA, i, uint64(len(k)))
+			i += copy(dAtA[i:], k)
+			dAtA[i] = 0x12
+			i++
+			i = encodeVarintSample(dAtA, i, uint64(len(v)))
+			i += copy(dAtA[i:], v)
+		}
+	}
+	if m.TraceIdHigh != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintSample(dAtA, i, uint64(m.TraceIdHigh))
+	}
+	return i, nil
+}
+
+func (m *SSFSpanEvent) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *SSFSpanEvent) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Timestamp != 0 {
+		dAtA[i] = 0x8
+		i++
+		i = encodeVarintSample(dAtA, i, uint64(m.Timestamp))
+	}
+	if len(m.Name) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintSample(dAtA, i, uint64(len(m.Name)))
+		i += copy(dAtA[i:], m.Name)
+	}
+	if len(m.Tags) > 0 {
+		for k, _ := range m.Tags {
+			dAtA[i] = 0x1a
+			i++
+			v := m.Tags[k]
+			mapSize := 1 + len(k) + sovSample(uint64(len(k))) + 1 + len(v) + sovSample(uint64(len(v)))
+			i = encodeVarintSample(dAtA, i, uint64(mapSize))
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintSample(dAtA, i, uint64(len(k)))
+			i += copy(dAtA[i:], k)
+			dAtA[i] = 0x12
+			i++
+			i = encodeVarintSample(dAtA, i, uint64(len(v)))
+			i += copy(dAtA[i:], v)
+		}
+	}
 	return i, nil
 }
 
@@ -625,6 +913,68 @@ func (m *SSFSpan) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovSample(uint64(l))
 	}
+	if m.TraceIdHigh != 0 {
+		n += 1 + sovSample(uint64(m.TraceIdHigh))
+	}
+	if len(m.Links) > 0 {
+		for _, e := range m.Links {
+			l = e.Size()
+			n += 1 + l + sovSample(uint64(l))
+		}
+	}
+	if len(m.Events) > 0 {
+		for _, e := range m.Events {
+			l = e.Size()
+			n += 2 + l + sovSample(uint64(l))
+		}
+	}
+	if m.SamplingPriority != 0 {
+		n += 2 + sovSample(uint64(m.SamplingPriority))
+	}
+	return n
+}
+
+func (m *SSFSpanLink) Size() (n int) {
+	var l int
+	_ = l
+	if m.TraceId != 0 {
+		n += 1 + sovSample(uint64(m.TraceId))
+	}
+	if m.SpanId != 0 {
+		n += 1 + sovSample(uint64(m.SpanId))
+	}
+	if len(m.Tags) > 0 {
+		for k, v := range m.Tags {
+			_ = k
+			_ = v
+			mapEntrySize := 1 + len(k) + sovSample(uint64(len(k))) + 1 + len(v) + sovSample(uint64(len(v)))
+			n += mapEntrySize + 1 + sovSample(uint64(mapEntrySize))
+		}
+	}
+	if m.TraceIdHigh != 0 {
+		n += 1 + sovSample(uint64(m.TraceIdHigh))
+	}
+	return n
+}
+
+func (m *SSFSpanEvent) Size() (n int) {
+	var l int
+	_ = l
+	if m.Timestamp != 0 {
+		n += 1 + sovSample(uint64(m.Timestamp))
+	}
+	l = len(m.Name)
+	if l > 0 {
+		n += 1 + l + sovSample(uint64(l))
+	}
+	if len(m.Tags) > 0 {
+		for k, v := range m.Tags {
+			_ = k
+			_ = v
+			mapEntrySize := 1 + len(k) + sovSample(uint64(len(k))) + 1 + len(v) + sovSample(uint64(len(v)))
+			n += mapEntrySize + 1 + sovSample(uint64(mapEntrySize))
+		}
+	}
 	return n
 }
 
@@ -1365,6 +1715,547 @@ func (m *SSFSpan) Unmarshal(dAtA []byte) error {
 			}
 			m.Name = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TraceIdHigh", wireType)
+			}
+			m.TraceIdHigh = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TraceIdHigh |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Links", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthSample
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Links = append(m.Links, &SSFSpanLink{})
+			if err := m.Links[len(m.Links)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 16:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Events", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthSample
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Events = append(m.Events, &SSFSpanEvent{})
+			if err := m.Events[len(m.Events)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 17:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SamplingPriority", wireType)
+			}
+			m.SamplingPriority = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.SamplingPriority |= (SSFSpan_SamplingPriority(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipSample(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthSample
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *SSFSpanLink) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowSample
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SSFSpanLink: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SSFSpanLink: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TraceId", wireType)
+			}
+			m.TraceId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TraceId |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SpanId", wireType)
+			}
+			m.SpanId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.SpanId |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tags", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthSample
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Tags == nil {
+				m.Tags = make(map[string]string)
+			}
+			var mapkey string
+			var mapvalue string
+			for iNdEx < postIndex {
+				entryPreIndex := iNdEx
+				var wire uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowSample
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					wire |= (uint64(b) & 0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				fieldNum := int32(wire >> 3)
+				if fieldNum == 1 {
+					var stringLenmapkey uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowSample
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapkey |= (uint64(b) & 0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapkey := int(stringLenmapkey)
+					if intStringLenmapkey < 0 {
+						return ErrInvalidLengthSample
+					}
+					postStringIndexmapkey := iNdEx + intStringLenmapkey
+					if postStringIndexmapkey > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapkey = string(dAtA[iNdEx:postStringIndexmapkey])
+					iNdEx = postStringIndexmapkey
+				} else if fieldNum == 2 {
+					var stringLenmapvalue uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowSample
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapvalue |= (uint64(b) & 0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapvalue := int(stringLenmapvalue)
+					if intStringLenmapvalue < 0 {
+						return ErrInvalidLengthSample
+					}
+					postStringIndexmapvalue := iNdEx + intStringLenmapvalue
+					if postStringIndexmapvalue > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapvalue = string(dAtA[iNdEx:postStringIndexmapvalue])
+					iNdEx = postStringIndexmapvalue
+				} else {
+					iNdEx = entryPreIndex
+					skippy, err := skipSample(dAtA[iNdEx:])
+					if err != nil {
+						return err
+					}
+					if skippy < 0 {
+						return ErrInvalidLengthSample
+					}
+					if (iNdEx + skippy) > postIndex {
+						return io.ErrUnexpectedEOF
+					}
+					iNdEx += skippy
+				}
+			}
+			m.Tags[mapkey] = mapvalue
+			iNdEx = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TraceIdHigh", wireType)
+			}
+			m.TraceIdHigh = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TraceIdHigh |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipSample(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthSample
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *SSFSpanEvent) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowSample
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SSFSpanEvent: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SSFSpanEvent: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timestamp", wireType)
+			}
+			m.Timestamp = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Timestamp |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Name", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthSample
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Name = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tags", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSample
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthSample
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Tags == nil {
+				m.Tags = make(map[string]string)
+			}
+			var mapkey string
+			var mapvalue string
+			for iNdEx < postIndex {
+				entryPreIndex := iNdEx
+				var wire uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowSample
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					wire |= (uint64(b) & 0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				fieldNum := int32(wire >> 3)
+				if fieldNum == 1 {
+					var stringLenmapkey uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowSample
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapkey |= (uint64(b) & 0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapkey := int(stringLenmapkey)
+					if intStringLenmapkey < 0 {
+						return ErrInvalidLengthSample
+					}
+					postStringIndexmapkey := iNdEx + intStringLenmapkey
+					if postStringIndexmapkey > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapkey = string(dAtA[iNdEx:postStringIndexmapkey])
+					iNdEx = postStringIndexmapkey
+				} else if fieldNum == 2 {
+					var stringLenmapvalue uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowSample
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapvalue |= (uint64(b) & 0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapvalue := int(stringLenmapvalue)
+					if intStringLenmapvalue < 0 {
+						return ErrInvalidLengthSample
+					}
+					postStringIndexmapvalue := iNdEx + intStringLenmapvalue
+					if postStringIndexmapvalue > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapvalue = string(dAtA[iNdEx:postStringIndexmapvalue])
+					iNdEx = postStringIndexmapvalue
+				} else {
+					iNdEx = entryPreIndex
+					skippy, err := skipSample(dAtA[iNdEx:])
+					if err != nil {
+						return err
+					}
+					if skippy < 0 {
+						return ErrInvalidLengthSample
+					}
+					if (iNdEx + skippy) > postIndex {
+						return io.ErrUnexpectedEOF
+					}
+					iNdEx += skippy
+				}
+			}
+			m.Tags[mapkey] = mapvalue
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipSample(dAtA[iNdEx:])
@@ -1494,41 +2385,53 @@ var (
 func init() { proto.RegisterFile("ssf/sample.proto", fileDescriptorSample) }
 
 var fileDescriptorSample = []byte{
-	// 573 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x53, 0xdd, 0x6e, 0xd3, 0x30,
-	0x14, 0x5e, 0xe2, 0x36, 0x4d, 0x4e, 0xb7, 0x62, 0x59, 0x03, 0x19, 0x98, 0x4a, 0x55, 0x2e, 0xa8,
-	0x10, 0x14, 0x69, 0x5c, 0x30, 0x71, 0x57, 0x46, 0x29, 0x65, 0x2c, 0x95, 0x9c, 0x54, 0xbb, 0x9c,
-	0x4c, 0xe3, 0x4d, 0x11, 0x4b, 0x1a, 0xd9, 0xde, 0xa4, 0xbd, 0x05, 0x8f, 0xc2, 0x63, 0x70, 0xc9,
-	0x23, 0xa0, 0x71, 0xc1, 0x6b, 0x20, 0xdb, 0x6d, 0xc3, 0xdf, 0x15, 0x77, 0xfe, 0xce, 0xf7, 0xc9,
-	0x3a, 0xdf, 0xf9, 0xce, 0x01, 0xac, 0xd4, 0xd9, 0x33, 0xc5, 0x8b, 0xea, 0x42, 0x0c, 0x2b, 0xb9,
-	0xd4, 0x4b, 0x82, 0x94, 0x3a, 0xeb, 0xff, 0x40, 0x10, 0x25, 0xc9, 0x9b, 0xc4, 0x12, 0xe4, 0x29,
-	0x04, 0x85, 0xd0, 0x32, 0x5f, 0x50, 0xaf, 0xe7, 0x0d, 0x3a, 0xfb, 0xb7, 0x87, 0x4a, 0x9d, 0x0d,
-	0x37, 0xfc, 0xf0, 0xd8, 0x92, 0x6c, 0x25, 0x22, 0x04, 0x1a, 0x25, 0x2f, 0x04, 0xf5, 0x7b, 0xde,
-	0x20, 0x62, 0xf6, 0x4d, 0x76, 0xa1, 0x79, 0xc5, 0x2f, 0x2e, 0x05, 0x45, 0x3d, 0x6f, 0xe0, 0x33,
-	0x07, 0xc8, 0x1e, 0x44, 0x3a, 0x2f, 0x84, 0xd2, 0xbc, 0xa8, 0x68, 0xa3, 0xe7, 0x0d, 0x10, 0xab,
-	0x0b, 0x84, 0x42, 0xab, 0x10, 0x4a, 0xf1, 0x73, 0x41, 0x9b, 0xf6, 0xab, 0x35, 0x34, 0x0d, 0x29,
-	0xcd, 0xf5, 0xa5, 0xa2, 0xc1, 0x3f, 0x1b, 0x4a, 0x2c, 0xc9, 0x56, 0x22, 0xf2, 0x00, 0xda, 0xce,
-	0xe2, 0xa9, 0xe4, 0x5a, 0xd0, 0x96, 0x6d, 0x01, 0x5c, 0x89, 0x71, 0x2d, 0xc8, 0x13, 0x68, 0x68,
-	0x7e, 0xae, 0x68, 0xd8, 0x43, 0x83, 0xf6, 0x3e, 0xfd, 0xe3, 0xb7, 0x94, 0x9f, 0xab, 0x71, 0xa9,
-	0xe5, 0x35, 0xb3, 0x2a, 0xe3, 0xef, 0xb2, 0xcc, 0x35, 0x8d, 0x9c, 0x3f, 0xf3, 0xbe, 0xf7, 0x02,
-	0xa2, 0x8d, 0x8c, 0x60, 0x40, 0x1f, 0xc5, 0xb5, 0x1d, 0x56, 0xc4, 0xcc, 0xb3, 0xb6, 0xef, 0x66,
-	0xe2, 0xc0, 0x4b, 0xff, 0xc0, 0xeb, 0xbf, 0x86, 0xc0, 0x8d, 0x8f, 0xb4, 0xa1, 0x75, 0x38, 0x9b,
-	0xc7, 0xe9, 0x98, 0xe1, 0x2d, 0x12, 0x41, 0x73, 0x32, 0x9a, 0x4f, 0xc6, 0xd8, 0x23, 0x3b, 0x10,
-	0xbd, 0x9d, 0x26, 0xe9, 0x6c, 0xc2, 0x46, 0xc7, 0xd8, 0x27, 0x2d, 0x40, 0xc9, 0x38, 0xc5, 0x88,
-	0x00, 0x04, 0x49, 0x3a, 0x4a, 0xe7, 0x09, 0x6e, 0xf4, 0x0f, 0x20, 0x70, 0x9e, 0x49, 0x00, 0xfe,
-	0xec, 0x08, 0x6f, 0x99, 0xdf, 0x4e, 0x46, 0x2c, 0x9e, 0xc6, 0x13, 0xec, 0x91, 0x6d, 0x08, 0x0f,
-	0xd9, 0x34, 0x9d, 0x1e, 0x8e, 0xde, 0x63, 0xdf, 0x50, 0xf3, 0xf8, 0x28, 0x9e, 0x9d, 0xc4, 0x18,
-	0xf5, 0x3f, 0x23, 0x68, 0x19, 0xab, 0x15, 0x2f, 0xcd, 0xc0, 0xaf, 0x84, 0x54, 0xf9, 0xb2, 0xb4,
-	0xbd, 0x37, 0xd9, 0x1a, 0x92, 0xbb, 0x10, 0x6a, 0xc9, 0x17, 0xe2, 0x34, 0xcf, 0xac, 0x05, 0xc4,
-	0x5a, 0x16, 0x4f, 0x33, 0xd2, 0x01, 0x3f, 0xcf, 0x6c, 0xac, 0x88, 0xf9, 0x79, 0x46, 0xee, 0x43,
-	0x54, 0x71, 0x29, 0x4a, 0x6d, 0xb4, 0x2e, 0xd3, 0xd0, 0x15, 0xa6, 0x19, 0x79, 0x04, 0xb7, 0x94,
-	0xe6, 0x52, 0x9f, 0xd6, 0xb1, 0x37, 0xad, 0xa4, 0x63, 0xcb, 0xe9, 0x26, 0xfb, 0x87, 0xb0, 0x23,
-	0xca, 0xec, 0x17, 0x59, 0x60, 0x65, 0xdb, 0xa2, 0xcc, 0x6a, 0xd1, 0x2e, 0x34, 0x85, 0x94, 0x4b,
-	0x69, 0x13, 0x0d, 0x99, 0x03, 0xc6, 0x85, 0x12, 0xf2, 0x2a, 0x5f, 0x08, 0x1a, 0xba, 0xb5, 0x59,
-	0x41, 0x32, 0x30, 0x0b, 0x65, 0x66, 0xad, 0x28, 0xd8, 0xa4, 0x3b, 0xbf, 0x27, 0xcd, 0xd6, 0x34,
-	0x79, 0xbc, 0x5a, 0x88, 0xb6, 0x95, 0xdd, 0xd9, 0xc8, 0x2a, 0x5e, 0xfe, 0xb5, 0x0e, 0x7b, 0x10,
-	0xe5, 0x65, 0x96, 0x2f, 0xb8, 0x5e, 0x4a, 0xba, 0x6d, 0x3b, 0xa9, 0x0b, 0x9b, 0x63, 0xd8, 0xa9,
-	0x8f, 0xe1, 0xbf, 0x97, 0xe5, 0x5d, 0x23, 0x8c, 0x30, 0xbc, 0xc2, 0x5f, 0x6e, 0xba, 0xde, 0xd7,
-	0x9b, 0xae, 0xf7, 0xed, 0xa6, 0xeb, 0x7d, 0xfa, 0xde, 0xdd, 0xfa, 0x10, 0xd8, 0xd3, 0x7d, 0xfe,
-	0x33, 0x00, 0x00, 0xff, 0xff, 0xa8, 0x9e, 0x3e, 0x57, 0xce, 0x03, 0x00, 0x00,
+	// 766 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x55, 0xdd, 0x8e, 0xdb, 0x44,
+	0x14, 0xde, 0xb1, 0x63, 0xc7, 0x3e, 0xf9, 0xe9, 0xec, 0xa8, 0xc0, 0xd0, 0x96, 0x10, 0x05, 0x09,
+	0x02, 0x82, 0x54, 0x2a, 0x17, 0x54, 0xbd, 0x0b, 0x5b, 0x93, 0xa6, 0xdb, 0x26, 0xab, 0xb1, 0xa3,
+	0x5e, 0x46, 0x43, 0x3c, 0x9b, 0x1d, 0xed, 0xc6, 0xb1, 0x3c, 0xb3, 0x91, 0xf6, 0x2d, 0x78, 0x0e,
+	0x6e, 0x78, 0x0d, 0xae, 0x10, 0x8f, 0x80, 0x96, 0x0b, 0x5e, 0x03, 0x79, 0xec, 0xfc, 0xf7, 0x6a,
+	0xef, 0x7c, 0xce, 0xf9, 0x34, 0x3a, 0xdf, 0xcf, 0x8c, 0x01, 0x2b, 0x75, 0xf9, 0x5c, 0xf1, 0x45,
+	0x7a, 0x23, 0x7a, 0x69, 0xb6, 0xd4, 0x4b, 0x62, 0x2b, 0x75, 0xd9, 0xf9, 0xcf, 0x06, 0x3f, 0x0c,
+	0x7f, 0x09, 0xcd, 0x80, 0xfc, 0x00, 0xee, 0x42, 0xe8, 0x4c, 0xce, 0x28, 0x6a, 0xa3, 0x6e, 0xf3,
+	0xc5, 0x27, 0x3d, 0xa5, 0x2e, 0x7b, 0x9b, 0x79, 0xef, 0xbd, 0x19, 0xb2, 0x12, 0x44, 0x08, 0x54,
+	0x12, 0xbe, 0x10, 0xd4, 0x6a, 0xa3, 0xae, 0xcf, 0xcc, 0x37, 0x79, 0x0c, 0xce, 0x8a, 0xdf, 0xdc,
+	0x0a, 0x6a, 0xb7, 0x51, 0xd7, 0x62, 0x45, 0x41, 0x9e, 0x81, 0xaf, 0xe5, 0x42, 0x28, 0xcd, 0x17,
+	0x29, 0xad, 0xb4, 0x51, 0xd7, 0x66, 0xdb, 0x06, 0xa1, 0x50, 0x5d, 0x08, 0xa5, 0xf8, 0x5c, 0x50,
+	0xc7, 0x1c, 0xb5, 0x2e, 0xf3, 0x85, 0x94, 0xe6, 0xfa, 0x56, 0x51, 0xf7, 0xa3, 0x0b, 0x85, 0x66,
+	0xc8, 0x4a, 0x10, 0xf9, 0x12, 0x6a, 0x05, 0xc5, 0x69, 0xc6, 0xb5, 0xa0, 0x55, 0xb3, 0x02, 0x14,
+	0x2d, 0xc6, 0xb5, 0x20, 0xdf, 0x43, 0x45, 0xf3, 0xb9, 0xa2, 0x5e, 0xdb, 0xee, 0xd6, 0x5e, 0xd0,
+	0x83, 0xd3, 0x22, 0x3e, 0x57, 0x41, 0xa2, 0xb3, 0x3b, 0x66, 0x50, 0x39, 0xbf, 0xdb, 0x44, 0x6a,
+	0xea, 0x17, 0xfc, 0xf2, 0xef, 0x27, 0x3f, 0x81, 0xbf, 0x81, 0x11, 0x0c, 0xf6, 0xb5, 0xb8, 0x33,
+	0x62, 0xf9, 0x2c, 0xff, 0xdc, 0xd2, 0x2f, 0x34, 0x29, 0x8a, 0x57, 0xd6, 0x4b, 0xd4, 0x79, 0x0d,
+	0x6e, 0x21, 0x1f, 0xa9, 0x41, 0xf5, 0x6c, 0x3c, 0x19, 0x45, 0x01, 0xc3, 0x27, 0xc4, 0x07, 0x67,
+	0xd0, 0x9f, 0x0c, 0x02, 0x8c, 0x48, 0x03, 0xfc, 0x37, 0xc3, 0x30, 0x1a, 0x0f, 0x58, 0xff, 0x3d,
+	0xb6, 0x48, 0x15, 0xec, 0x30, 0x88, 0xb0, 0x4d, 0x00, 0xdc, 0x30, 0xea, 0x47, 0x93, 0x10, 0x57,
+	0x3a, 0x2f, 0xc1, 0x2d, 0x38, 0x13, 0x17, 0xac, 0xf1, 0x39, 0x3e, 0xc9, 0x4f, 0xfb, 0xd0, 0x67,
+	0xa3, 0xe1, 0x68, 0x80, 0x11, 0xa9, 0x83, 0x77, 0xc6, 0x86, 0xd1, 0xf0, 0xac, 0xff, 0x0e, 0x5b,
+	0xf9, 0x68, 0x32, 0x3a, 0x1f, 0x8d, 0x3f, 0x8c, 0xb0, 0xdd, 0xf9, 0xc3, 0x81, 0x6a, 0x4e, 0x35,
+	0xe5, 0x49, 0x2e, 0xf8, 0x4a, 0x64, 0x4a, 0x2e, 0x13, 0xb3, 0xbb, 0xc3, 0xd6, 0x25, 0xf9, 0x1c,
+	0x3c, 0x9d, 0xf1, 0x99, 0x98, 0xca, 0xd8, 0x50, 0xb0, 0x59, 0xd5, 0xd4, 0xc3, 0x98, 0x34, 0xc1,
+	0x92, 0xb1, 0xb1, 0xd5, 0x66, 0x96, 0x8c, 0xc9, 0x53, 0xf0, 0x53, 0x9e, 0x89, 0x44, 0xe7, 0xd8,
+	0xc2, 0x53, 0xaf, 0x68, 0x0c, 0x63, 0xf2, 0x0d, 0x3c, 0x52, 0x9a, 0x67, 0x7a, 0xba, 0xb5, 0xdd,
+	0x31, 0x90, 0xa6, 0x69, 0x47, 0x1b, 0xef, 0xbf, 0x82, 0x86, 0x48, 0xe2, 0x1d, 0x98, 0x6b, 0x60,
+	0x75, 0x91, 0xc4, 0x5b, 0xd0, 0x63, 0x70, 0x44, 0x96, 0x2d, 0x33, 0xe3, 0xa8, 0xc7, 0x8a, 0x22,
+	0x67, 0xa1, 0x44, 0xb6, 0x92, 0x33, 0x41, 0xbd, 0x22, 0x36, 0x65, 0x49, 0xba, 0x79, 0xa0, 0x72,
+	0xad, 0x15, 0x05, 0xe3, 0x74, 0x73, 0xdf, 0x69, 0xb6, 0x1e, 0x93, 0xef, 0xca, 0x40, 0xd4, 0x0c,
+	0xec, 0xd3, 0x0d, 0x2c, 0xe5, 0xc9, 0x51, 0x1c, 0x9e, 0x81, 0x2f, 0x93, 0x58, 0xce, 0xb8, 0x5e,
+	0x66, 0xb4, 0x6e, 0x36, 0xd9, 0x36, 0x36, 0x97, 0xa1, 0xb1, 0x73, 0x19, 0x3a, 0xd0, 0x58, 0xab,
+	0x39, 0xbd, 0x92, 0xf3, 0x2b, 0xda, 0x34, 0xe4, 0x6a, 0xa5, 0xa4, 0x6f, 0xe4, 0xfc, 0x8a, 0x7c,
+	0x0d, 0xce, 0x8d, 0x4c, 0xae, 0x15, 0x7d, 0x64, 0x56, 0xc0, 0xbb, 0x2b, 0xbc, 0x93, 0xc9, 0x35,
+	0x2b, 0xc6, 0xe4, 0x5b, 0x70, 0xc5, 0x4a, 0x24, 0x5a, 0x51, 0x6c, 0x80, 0xa7, 0xbb, 0xc0, 0x20,
+	0x9f, 0xb0, 0x12, 0x40, 0xde, 0xc2, 0xa9, 0xc9, 0xbc, 0x4c, 0xe6, 0xd3, 0x34, 0x93, 0xcb, 0x4c,
+	0xea, 0x3b, 0x7a, 0x6a, 0x2e, 0xd0, 0x17, 0x7b, 0x0c, 0xc3, 0x12, 0x75, 0x51, 0x82, 0x18, 0x56,
+	0x07, 0x9d, 0x87, 0xe7, 0xfd, 0x15, 0xe0, 0xc3, 0xe3, 0x89, 0x07, 0x95, 0xfe, 0x24, 0x1a, 0xe3,
+	0x93, 0x3c, 0xeb, 0x93, 0x30, 0x60, 0xd3, 0xf3, 0x20, 0xb8, 0xc0, 0x68, 0x53, 0xbe, 0x66, 0xe3,
+	0x0b, 0x6c, 0xbd, 0xad, 0x78, 0x3e, 0x86, 0xce, 0x5f, 0x08, 0x6a, 0x3b, 0x42, 0xec, 0x65, 0x13,
+	0xed, 0x67, 0xf3, 0x33, 0xa8, 0xaa, 0x94, 0x27, 0xdb, 0xd4, 0xba, 0x79, 0x39, 0x8c, 0x49, 0xaf,
+	0xf4, 0xd7, 0x36, 0x9a, 0x3d, 0x39, 0x14, 0xf7, 0xc8, 0xe3, 0x23, 0xc7, 0x2a, 0x47, 0x8e, 0x3d,
+	0x5c, 0x92, 0xdf, 0x11, 0xd4, 0x77, 0x0d, 0xdb, 0x7f, 0x16, 0xd1, 0xe1, 0xb3, 0xf8, 0xb1, 0xe7,
+	0xf5, 0xf9, 0x1e, 0x9f, 0xa7, 0x47, 0x19, 0x38, 0x24, 0xf4, 0xe0, 0x65, 0x7f, 0xc6, 0x7f, 0xde,
+	0xb7, 0xd0, 0xdf, 0xf7, 0x2d, 0xf4, 0xcf, 0x7d, 0x0b, 0xfd, 0xf6, 0x6f, 0xeb, 0xe4, 0x57, 0xd7,
+	0xfc, 0x37, 0x7e, 0xfc, 0x7f, 0x00, 0xea, 0x85, 0x39, 0x42, 0x4b, 0x06, 0x00, 0x00,
 }
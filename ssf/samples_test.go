@@ -1,6 +1,7 @@
 package ssf
 
 import (
+	"encoding/hex"
 	"fmt"
 	"testing"
 	"time"
@@ -146,3 +147,23 @@ func BenchmarkRandomlySampleParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestTraceIDString(t *testing.T) {
+	span := &SSFSpan{TraceId: 12345}
+	assert.Equal(t, "12345", TraceIDString(span))
+	assert.Equal(t, "00000000000000000000000000003039", TraceIDHex(span))
+
+	low := uint64(0xa3ce929d0e0e4736)
+	span = &SSFSpan{TraceIdHigh: 0x4bf92f3577b34da6, TraceId: int64(low)}
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", TraceIDString(span))
+	id := TraceIDBytes(span)
+	assert.Equal(t, TraceIDHex(span), hex.EncodeToString(id[:]))
+
+	// The field round-trips through protobuf:
+	bts, err := span.Marshal()
+	assert.NoError(t, err)
+	parsed := &SSFSpan{}
+	assert.NoError(t, parsed.Unmarshal(bts))
+	assert.Equal(t, span.TraceIdHigh, parsed.TraceIdHigh)
+	assert.Equal(t, span.TraceId, parsed.TraceId)
+}
@@ -0,0 +1,57 @@
+package ssf
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// TraceIDHex returns a span's 128-bit trace ID, made of its
+// TraceIdHigh and TraceId, as 32 hexadecimal digits, the way that W3C
+// trace context's traceparent header renders it.
+func TraceIDHex(span *SSFSpan) string {
+	return traceIDHex(span.TraceIdHigh, span.TraceId)
+}
+
+// TraceIDString returns a span's trace ID as the spans that don't set
+// TraceIdHigh have always rendered it, in decimal, or as TraceIDHex if
+// the trace ID has 128 bits.
+func TraceIDString(span *SSFSpan) string {
+	return traceIDString(span.TraceIdHigh, span.TraceId)
+}
+
+// LinkTraceIDString returns the trace ID of a span link like
+// TraceIDString.
+func LinkTraceIDString(link *SSFSpanLink) string {
+	return traceIDString(link.TraceIdHigh, link.TraceId)
+}
+
+func traceIDHex(high, low int64) string {
+	return fmt.Sprintf("%016x%016x", uint64(high), uint64(low))
+}
+
+func traceIDString(high, low int64) string {
+	if high == 0 {
+		return fmt.Sprintf("%d", low)
+	}
+	return traceIDHex(high, low)
+}
+
+// TraceIDBytes returns a span's 128-bit trace ID as 16 bytes, in the
+// order of TraceIDHex's digits, the way that OTLP and W3C trace context
+// carry it.
+func TraceIDBytes(span *SSFSpan) [16]byte {
+	return traceIDBytes(span.TraceIdHigh, span.TraceId)
+}
+
+// LinkTraceIDBytes returns the trace ID of a span link like
+// TraceIDBytes.
+func LinkTraceIDBytes(link *SSFSpanLink) [16]byte {
+	return traceIDBytes(link.TraceIdHigh, link.TraceId)
+}
+
+func traceIDBytes(high, low int64) [16]byte {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(high))
+	binary.BigEndian.PutUint64(id[8:], uint64(low))
+	return id
+}
@@ -0,0 +1,91 @@
+package veneur
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/protocol"
+)
+
+// ssfParseFailureLogInterval is how often an example of each cause of
+// SSF parse failures is logged at most, and ssfParseFailureDumpLength
+// how many of its first bytes are dumped.
+const (
+	ssfParseFailureLogInterval = time.Minute
+	ssfParseFailureDumpLength  = 512
+)
+
+// ssfParseFailureExamples decides when to log examples of the SSF that
+// failed to parse, for ssf_debug_parse_failures: one of each cause per
+// ssfParseFailureLogInterval, so that a producer that sends nothing but
+// garbage doesn't flood the logs.
+type ssfParseFailureExamples struct {
+	clock clock
+
+	mtx    sync.Mutex
+	logged map[string]time.Time
+}
+
+func newSSFParseFailureExamples(c clock) *ssfParseFailureExamples {
+	return &ssfParseFailureExamples{clock: c, logged: map[string]time.Time{}}
+}
+
+// due reports whether an example of the cause should be logged now, and
+// if so, records that it was.
+func (e *ssfParseFailureExamples) due(cause string) bool {
+	now := e.clock.Now()
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if last, ok := e.logged[cause]; ok && now.Sub(last) < ssfParseFailureLogInterval {
+		return false
+	}
+	e.logged[cause] = now
+	return true
+}
+
+// ssfParseFailureCause returns the cause of an error reading, parsing
+// or validating SSF, for the cause tag of ssf.parse_failures_total.
+func ssfParseFailureCause(err error) string {
+	var invalid *protocol.InvalidTrace
+	switch {
+	case errors.As(err, &invalid):
+		return "validation_" + invalid.Cause.String()
+	case protocol.IsFrameLengthError(err):
+		return "frame_too_large"
+	case protocol.IsFrameVersionError(err):
+		return "frame_version"
+	case protocol.IsFramingError(err):
+		return "frame_io"
+	}
+	if _, ok := err.(*protocol.BatchTooLarge); ok {
+		return "batch_too_large"
+	}
+	return "protobuf_unmarshal"
+}
+
+// ssfParseFailure counts SSF read in ssfFormat that couldn't be parsed
+// or validated, by its cause, as ssf.parse_failures_total. With
+// ssf_debug_parse_failures, it also logs a hex dump of the start of raw,
+// the SSF as it was read, if an example of the cause is due.
+func (s *Server) ssfParseFailure(cause, ssfFormat string, err error, raw []byte) {
+	s.Statsd.Count("ssf.parse_failures_total", 1, []string{"cause:" + cause, "ssf_format:" + ssfFormat}, 1.0)
+	if s.ssfParseFailureExamples == nil || !s.ssfParseFailureExamples.due(cause) {
+		return
+	}
+	entry := log.WithFields(logrus.Fields{
+		"cause":      cause,
+		"ssf_format": ssfFormat,
+		"length":     len(raw),
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	dump := raw
+	if len(dump) > ssfParseFailureDumpLength {
+		dump = dump[:ssfParseFailureDumpLength]
+	}
+	entry.Warn("Example of SSF that failed to parse:\n" + hex.Dump(dump))
+}
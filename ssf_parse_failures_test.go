@@ -0,0 +1,60 @@
+package veneur
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/internal/veneurtest"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestSSFParseFailureCause(t *testing.T) {
+	readFrame := func(frame []byte) error {
+		_, err := protocol.ReadSSFFrameMax(bytes.NewReader(frame), 16)
+		require.Error(t, err)
+		return err
+	}
+	batch := &protocol.Batch{}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, batch.Add(&ssf.SSFSpan{Id: int64(i + 1), TraceId: 1}))
+	}
+	_, batchErr := protocol.ParseSSFBatchDatagram(batch.Datagram(), 1)
+	_, unmarshalErr := protocol.ParseSSF([]byte{0xff, 0xff, 0xff})
+
+	for cause, err := range map[string]error{
+		"frame_version":            readFrame([]byte{9, 0, 0, 0, 1, 0}),
+		"frame_too_large":          readFrame([]byte{0, 0, 0, 1, 0}),
+		"frame_io":                 readFrame([]byte{0, 0, 0, 0, 8, 1}),
+		"batch_too_large":          batchErr,
+		"protobuf_unmarshal":       unmarshalErr,
+		"validation_zero_id":       protocol.ValidateTrace(&ssf.SSFSpan{}),
+		"validation_zero_trace_id": protocol.ValidateTrace(&ssf.SSFSpan{Id: 1}),
+	} {
+		require.Error(t, err, cause)
+		assert.Equal(t, cause, ssfParseFailureCause(err))
+	}
+}
+
+func TestSSFParseFailureExamples(t *testing.T) {
+	clock := veneurtest.NewClock(time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC))
+	e := newSSFParseFailureExamples(clock)
+
+	assert.True(t, e.due("protobuf_unmarshal"))
+	assert.False(t, e.due("protobuf_unmarshal"), "only one example of a cause a minute")
+	assert.True(t, e.due("frame_too_large"), "each cause has its own examples")
+
+	clock.Advance(ssfParseFailureLogInterval)
+	assert.True(t, e.due("protobuf_unmarshal"))
+
+	// Logging the examples doesn't get in the way of ingesting spans:
+	s := &Server{SpanChan: make(chan *ssf.SSFSpan, 1), ssfParseFailureExamples: e}
+	s.HandleTracePacket([]byte{0xff, 0xff, 0xff})
+	s.HandleTracePacket(nil)
+	s.handleSSF(&ssf.SSFSpan{Id: 1, Name: "no trace"}, "packet")
+	require.Len(t, s.SpanChan, 1)
+	assert.Equal(t, "no trace", (<-s.SpanChan).Name)
+}
@@ -0,0 +1,46 @@
+package veneur
+
+import (
+	"sort"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// ssfTruncatedTag marks the spans that truncateSpan cut down to fit
+// their listener's maximum length.
+const ssfTruncatedTag = "truncated"
+
+// truncateSpan drops the largest tags of a span, one by one, until it
+// encodes in at most max bytes, and tags it with truncated:true. The
+// span's name, timestamps, metrics and other fields are kept whole, so
+// the span still counts and links like it would have. It returns false
+// if the span is still too long without any of its tags, and should be
+// dropped.
+func truncateSpan(span *ssf.SSFSpan, max int) bool {
+	if span.Tags == nil {
+		span.Tags = map[string]string{}
+	}
+	keys := make([]string, 0, len(span.Tags))
+	for k := range span.Tags {
+		if k != ssfTruncatedTag {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		li := len(keys[i]) + len(span.Tags[keys[i]])
+		lj := len(keys[j]) + len(span.Tags[keys[j]])
+		if li != lj {
+			return li > lj
+		}
+		return keys[i] < keys[j]
+	})
+
+	span.Tags[ssfTruncatedTag] = "true"
+	for _, k := range keys {
+		if span.Size() <= max {
+			break
+		}
+		delete(span.Tags, k)
+	}
+	return span.Size() <= max
+}
@@ -0,0 +1,101 @@
+package veneur
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestTruncateSpan(t *testing.T) {
+	span := &ssf.SSFSpan{
+		Id: 1, TraceId: 1, StartTimestamp: 1, EndTimestamp: 2, Name: "checkout",
+		Tags: map[string]string{
+			"stack":   strings.Repeat("x", 1000),
+			"request": strings.Repeat("y", 100),
+			"host":    "a",
+		},
+	}
+	require.True(t, truncateSpan(span, 200))
+	assert.True(t, span.Size() <= 200)
+	assert.Equal(t, map[string]string{
+		"request":       strings.Repeat("y", 100),
+		"host":          "a",
+		ssfTruncatedTag: "true",
+	}, span.Tags, "only the largest tags are dropped")
+
+	span = &ssf.SSFSpan{Id: 1, TraceId: 1, Name: strings.Repeat("x", 1000)}
+	assert.False(t, truncateSpan(span, 200), "the span is too long without tags")
+}
+
+func TestReadSSFTruncatesOversizedSpans(t *testing.T) {
+	s := &Server{SpanChan: make(chan *ssf.SSFSpan, 10), ssfMaxBatchSpans: 10, ssfTruncateOversized: true}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.readSSFStreamSocket(server, 256, nil, nil)
+		close(done)
+	}()
+
+	_, err := protocol.WriteSSF(client, &ssf.SSFSpan{
+		Id: 1, TraceId: 1, StartTimestamp: 1, EndTimestamp: 2, Name: "failed",
+		Tags: map[string]string{"stack": strings.Repeat("x", 1024), "error": "timeout"},
+	})
+	require.NoError(t, err)
+	span := <-s.SpanChan
+	assert.Equal(t, "failed", span.Name)
+	assert.Equal(t, map[string]string{"error": "timeout", ssfTruncatedTag: "true"}, span.Tags)
+
+	// Spans too long without tags, and batches that are too long, are
+	// dropped without closing the connection:
+	_, err = protocol.WriteSSF(client, &ssf.SSFSpan{Id: 2, TraceId: 1, Name: strings.Repeat("x", 1024)})
+	require.NoError(t, err)
+	batch := &protocol.Batch{}
+	require.NoError(t, batch.Add(&ssf.SSFSpan{Id: 3, TraceId: 1, Name: strings.Repeat("y", 1024)}))
+	_, err = batch.WriteFrame(client)
+	require.NoError(t, err)
+	_, err = protocol.WriteSSF(client, &ssf.SSFSpan{Id: 4, TraceId: 1, Name: "small"})
+	require.NoError(t, err)
+	span = <-s.SpanChan
+	assert.Equal(t, "small", span.Name)
+
+	client.Close()
+	<-done
+	assert.Empty(t, s.SpanChan)
+}
+
+func TestReadSSFPacketSocketDropsTruncatedDatagrams(t *testing.T) {
+	s := &Server{SpanChan: make(chan *ssf.SSFSpan, 10), shutdown: make(chan struct{})}
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.readSSFPacketSocket(sock, newSSFPacketPool(64), nil)
+	defer func() {
+		close(s.shutdown)
+		sock.Close()
+	}()
+
+	conn, err := net.Dial("udp", sock.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, span := range []*ssf.SSFSpan{
+		{Id: 1, TraceId: 1, Name: strings.Repeat("x", 200)},
+		{Id: 2, TraceId: 1, Name: "small"},
+	} {
+		packet, err := span.Marshal()
+		require.NoError(t, err)
+		_, err = conn.Write(packet)
+		require.NoError(t, err)
+	}
+
+	select {
+	case span := <-s.SpanChan:
+		assert.Equal(t, "small", span.Name, "the truncated datagram is dropped")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the span")
+	}
+}
@@ -12,9 +12,8 @@ import (
 	"github.com/stripe/veneur/ssf"
 )
 
-// DefaultBackoff defaults to 10 milliseconds of initial wait
-// time. Subsequent wait times will add this backoff to the time they
-// wait.
+// DefaultBackoff defaults to 20 milliseconds of initial wait
+// time. Subsequent wait times double, up to the maximum backoff.
 const DefaultBackoff = 20 * time.Millisecond
 
 // DefaultMaxBackoff defaults to 1 second. No reconnection attempt
@@ -36,6 +35,11 @@ type backendParams struct {
 	maxBackoff     time.Duration
 	connectTimeout time.Duration
 	bufferSize     uint
+	batchBytes     uint
+
+	// reconnected is called whenever a backend re-establishes a
+	// connection that it lost.
+	reconnected func()
 }
 
 func (p *backendParams) params() *backendParams {
@@ -89,11 +93,46 @@ type networkBackend interface {
 	connection(net.Conn)
 }
 
+// spanBatcher batches the spans that a backend sends, if its
+// batchBytes is set.
+type spanBatcher struct {
+	batch protocol.Batch
+}
+
+// add adds a span to the batch, sending the batch first if the span
+// would make it longer than maxBytes, and afterwards if it's full.
+func (sb *spanBatcher) add(span *ssf.SSFSpan, maxBytes uint, send func(*protocol.Batch) error) error {
+	size := proto.Size(span) + 4
+	if sb.batch.Spans() > 0 && sb.batch.Len()+size > int(maxBytes) {
+		if err := sb.flush(send); err != nil {
+			return err
+		}
+	}
+	if err := sb.batch.Add(span); err != nil {
+		return err
+	}
+	if sb.batch.Len() >= int(maxBytes) {
+		return sb.flush(send)
+	}
+	return nil
+}
+
+// flush sends the batch, if it has any spans. The batch is emptied
+// even if sending it fails.
+func (sb *spanBatcher) flush(send func(*protocol.Batch) error) error {
+	if sb.batch.Spans() == 0 {
+		return nil
+	}
+	defer sb.batch.Reset()
+	return send(&sb.batch)
+}
+
 // packetBackend represents a UDP connection to a veneur server. It
-// does no buffering.
+// does no buffering, unless it batches spans.
 type packetBackend struct {
 	backendParams
-	conn net.Conn
+	conn    net.Conn
+	batcher spanBatcher
 }
 
 func (s *packetBackend) connection(conn net.Conn) {
@@ -114,6 +153,9 @@ func (s *packetBackend) SendSync(ctx context.Context, span *ssf.SSFSpan) error {
 		}
 	}
 
+	if s.batchBytes > 0 {
+		return s.batcher.add(span, s.batchBytes, s.sendBatch)
+	}
 	data, err := proto.Marshal(span)
 	if err != nil {
 		return err
@@ -122,20 +164,64 @@ func (s *packetBackend) SendSync(ctx context.Context, span *ssf.SSFSpan) error {
 	return err
 }
 
+func (s *packetBackend) sendBatch(batch *protocol.Batch) error {
+	_, err := s.conn.Write(batch.Datagram())
+	return err
+}
+
+// FlushSync on a packetBackend sends the spans it's batching, if any.
+func (s *packetBackend) FlushSync(ctx context.Context) error {
+	if s.batcher.batch.Spans() == 0 {
+		return nil
+	}
+	if s.conn == nil {
+		if err := connect(ctx, s); err != nil {
+			return err
+		}
+	}
+	return s.batcher.flush(s.sendBatch)
+}
+
 var _ networkBackend = &packetBackend{}
+var _ FlushableClientBackend = &packetBackend{}
 
-// streamBackend is a backend for streaming connections.
+// streamBackend is a backend for streaming connections, over unix
+// sockets or TCP.
+//
+// When writing to its connection fails, a streamBackend closes it and
+// re-dials it in the background, with backoff. Until the connection is
+// re-established, each span waits up to the connect timeout for it, and
+// is discarded (returning an error) if that runs out; the spans
+// recorded meanwhile wait in the client, up to its capacity, or are
+// handled according to its overflow policy.
 type streamBackend struct {
 	backendParams
-	conn   net.Conn
-	output io.Writer
-	buffer *bufio.Writer
+	conn    net.Conn
+	output  io.Writer
+	buffer  *bufio.Writer
+	batcher spanBatcher
+
+	// dialing receives the connection that's being dialed in the
+	// background, if one is.
+	dialing chan net.Conn
+	// connected records whether the backend ever had a connection,
+	// so that re-establishing one counts as a reconnection.
+	connected bool
 }
 
-func connect(ctx context.Context, s networkBackend) error {
+func (p *backendParams) connectTimeoutOrDefault() time.Duration {
+	if p.connectTimeout == 0 {
+		return DefaultConnectTimeout
+	}
+	return p.connectTimeout
+}
+
+// dial connects to the backend's address, retrying until it succeeds
+// or ctx is done. The wait between attempts starts at the backoff
+// time, and doubles with every attempt up to the maximum backoff time.
+func dial(ctx context.Context, params *backendParams) (net.Conn, error) {
 	dialer := net.Dialer{}
 
-	params := s.params()
 	backoff := params.backoff
 	if backoff == 0 {
 		backoff = DefaultBackoff
@@ -146,39 +232,97 @@ func connect(ctx context.Context, s networkBackend) error {
 		maxBackoff = DefaultMaxBackoff
 	}
 
-	connectTimeout := params.connectTimeout
-	if connectTimeout == 0 {
-		connectTimeout = DefaultConnectTimeout
-	}
-	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
-	defer cancel()
-
 	var wait time.Duration
-	var conn net.Conn
-	var err error
 	for {
-		conn, err = dialer.DialContext(ctx, params.addr.Network(), params.addr.String())
+		conn, err := dialer.DialContext(ctx, params.addr.Network(), params.addr.String())
 		if err == nil {
-			break
+			return conn, nil
 		}
 
 		if ctx.Err() != nil {
-			return ctx.Err()
+			return nil, ctx.Err()
 		}
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return nil, ctx.Err()
 		case <-time.After(wait):
-			wait += backoff
-			if backoff > maxBackoff {
+			if wait == 0 {
+				wait = backoff
+			} else {
+				wait *= 2
+			}
+			if wait > maxBackoff {
 				wait = maxBackoff
 			}
 		}
 	}
+}
+
+func connect(ctx context.Context, s networkBackend) error {
+	params := s.params()
+	ctx, cancel := context.WithTimeout(ctx, params.connectTimeoutOrDefault())
+	defer cancel()
+
+	conn, err := dial(ctx, params)
+	if err != nil {
+		return err
+	}
 	s.connection(conn)
 	return nil
 }
 
+// ensureConnection waits for the backend's connection to be
+// established, dialing it in the background if it isn't already. If
+// it isn't established within the connect timeout, the background
+// dial keeps going, and the next call waits for it again.
+func (ds *streamBackend) ensureConnection(ctx context.Context) error {
+	if ds.conn != nil {
+		return nil
+	}
+	if ds.dialing == nil {
+		dialing := make(chan net.Conn, 1)
+		ds.dialing = dialing
+		params := ds.backendParams
+		go func() {
+			conn, err := dial(ctx, &params)
+			if err != nil {
+				// The client was closed; nobody waits for
+				// the connection anymore.
+				return
+			}
+			if ctx.Err() != nil {
+				_ = conn.Close()
+				return
+			}
+			dialing <- conn
+		}()
+	}
+
+	timer := time.NewTimer(ds.connectTimeoutOrDefault())
+	defer timer.Stop()
+	select {
+	case conn := <-ds.dialing:
+		ds.dialing = nil
+		ds.connection(conn)
+		if ds.connected && ds.reconnected != nil {
+			ds.reconnected()
+		}
+		ds.connected = true
+		return nil
+	case <-timer.C:
+		return context.DeadlineExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// disconnect closes a connection that can no longer be written to. The
+// next span sent re-dials it.
+func (ds *streamBackend) disconnect() {
+	_ = ds.conn.Close()
+	ds.conn = nil
+}
+
 func (ds *streamBackend) connection(conn net.Conn) {
 	ds.conn = conn
 	ds.output = conn
@@ -190,19 +334,29 @@ func (ds *streamBackend) connection(conn net.Conn) {
 
 // SendSync on a streamBackend attempts to write the packet on the
 // connection to the upstream veneur directly. If it encounters a
-// protocol error, SendSync will return the original protocol error once
-// the connection is re-established.
+// protocol error, SendSync closes the connection and returns the
+// error; the connection is re-dialed in the background.
 func (ds *streamBackend) SendSync(ctx context.Context, span *ssf.SSFSpan) error {
-	if ds.conn == nil {
-		if err := connect(ctx, ds); err != nil {
-			return err
-		}
+	if err := ds.ensureConnection(ctx); err != nil {
+		return err
+	}
+	if ds.batchBytes > 0 {
+		return ds.batcher.add(span, ds.batchBytes, ds.writeBatch)
 	}
 	_, err := protocol.WriteSSF(ds.output, span)
 	if err != nil {
 		if protocol.IsFramingError(err) {
-			_ = ds.conn.Close()
-			ds.conn = nil
+			ds.disconnect()
+		}
+	}
+	return err
+}
+
+func (ds *streamBackend) writeBatch(batch *protocol.Batch) error {
+	_, err := batch.WriteFrame(ds.output)
+	if err != nil {
+		if protocol.IsFramingError(err) {
+			ds.disconnect()
 		}
 	}
 	return err
@@ -215,24 +369,28 @@ func (ds *streamBackend) Close() error {
 	return ds.conn.Close()
 }
 
-// FlushSync on a streamBackend flushes the buffer if one exists. If the
-// connection was disconnected prior to flushing, FlushSync re-establishes
-// it and discards the buffer.
+// FlushSync on a streamBackend sends the spans it's batching, if any,
+// and flushes the buffer if one exists. If the connection was
+// disconnected prior to flushing, FlushSync re-establishes it and
+// discards the buffer.
 func (ds *streamBackend) FlushSync(ctx context.Context) error {
-	if ds.buffer == nil {
+	if ds.buffer == nil && ds.batcher.batch.Spans() == 0 {
 		return nil
 	}
-	if ds.conn == nil {
-		if err := connect(ctx, ds); err != nil {
-			return err
-		}
+	if err := ds.ensureConnection(ctx); err != nil {
+		return err
+	}
+	if err := ds.batcher.flush(ds.writeBatch); err != nil {
+		return err
+	}
+	if ds.buffer == nil {
+		return nil
 	}
 	err := ds.buffer.Flush()
 	if err != nil {
 		// buffer is poisoned, and we have no idea if the
 		// connection is still valid. We better reconnect.
-		_ = ds.conn.Close()
-		ds.conn = nil
+		ds.disconnect()
 	}
 	return err
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol"
 	"github.com/stripe/veneur/ssf"
 )
 
@@ -143,3 +144,46 @@ func BenchmarkSerialization(b *testing.B) {
 	b.Run("UDP_plain_span_no_metrics", benchmarkPlainCombination(udpBackend, spanNoMetrics))
 	b.Run("UDP_plain_empty_span_with_metrics", benchmarkPlainCombination(udpBackend, emptySpanWithMetrics))
 }
+
+func TestStreamBackendDialsInBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sockName := filepath.Join(dir, "sock")
+	laddr, err := net.ResolveUnixAddr("unix", sockName)
+	require.NoError(t, err)
+
+	reconnects := 0
+	backend := &streamBackend{
+		backendParams: backendParams{
+			addr:           laddr,
+			backoff:        time.Millisecond,
+			maxBackoff:     5 * time.Millisecond,
+			connectTimeout: 20 * time.Millisecond,
+			reconnected:    func() { reconnects++ },
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer backend.Close()
+
+	// Nothing listens yet, so the span is discarded:
+	span := &ssf.SSFSpan{Id: 1, TraceId: 1, Name: "span"}
+	assert.Equal(t, context.DeadlineExceeded, backend.SendSync(ctx, span))
+
+	// The dial that's still going on connects once veneur is up:
+	received := make(chan *ssf.SSFSpan, 1)
+	cleanup := serveUNIX(t, laddr, func(in net.Conn) {
+		defer in.Close()
+		span, err := protocol.ReadSSF(in)
+		if err == nil {
+			received <- span
+		}
+	})
+	defer cleanup()
+	backend.connectTimeout = 5 * time.Second
+	require.NoError(t, backend.SendSync(ctx, span))
+	assert.Equal(t, "span", (<-received).Name)
+	assert.Equal(t, 0, reconnects, "connecting for the first time isn't reconnecting")
+}
@@ -35,6 +35,9 @@ func initializeDefaultClient() {
 type recordOp struct {
 	span   *ssf.SSFSpan
 	result chan<- error
+	// size is the serialized size of span, if the client bounds its
+	// buffered bytes.
+	size int64
 }
 
 // flushNotifier holds a channel that lets the client notify a
@@ -66,11 +69,35 @@ type Client struct {
 	records       chan *recordOp
 	spans         chan<- *ssf.SSFSpan
 
-	// statistics:
+	// Handling spans that there's no room for:
+	overflow         OverflowPolicy
+	blockTimeout     time.Duration
+	maxBufferedBytes int64
+	room             chan struct{}
+	closed           <-chan struct{}
+
+	// sampleRate is the 1 in how many traces the client records.
+	sampleRate int64
+	// tagGuard bounds the tags of the spans the client records, if
+	// it's set up to.
+	tagGuard *tagGuard
+
+	// statistics, reset by SendClientStatistics:
 	failedFlushes     int64
 	successfulFlushes int64
 	failedRecords     int64
 	successfulRecords int64
+	reconnects        int64
+
+	// statistics returned by Stats:
+	totalRecords       int64
+	totalDropped       int64
+	totalFlushes       int64
+	totalFailedFlushes int64
+	totalReconnects    int64
+	flushLatency       int64
+	maxFlushLatency    int64
+	bufferedBytes      int64
 }
 
 // Close tears down the entire client. It waits until the backend has
@@ -82,6 +109,8 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) run(ctx context.Context) {
+	c.room = make(chan struct{}, 1)
+	c.closed = ctx.Done()
 	if c.flush != nil {
 		go c.flush(ctx)
 	}
@@ -90,16 +119,17 @@ func (c *Client) run(ctx context.Context) {
 	}
 
 	for _, b := range c.flushBackends {
-		go runFlushableBackend(ctx, c.records, b.backend, b.notify)
+		go runFlushableBackend(ctx, c.records, b.backend, b.notify, c.dequeued)
 	}
 }
 
-func runFlushableBackend(ctx context.Context, spans chan *recordOp, backend ClientBackend, flushNotify chan chan<- error) {
+func runFlushableBackend(ctx context.Context, spans chan *recordOp, backend ClientBackend, flushNotify chan chan<- error, dequeued func(*recordOp)) {
 	defer backend.Close()
 
 	for {
 		select {
 		case op := <-spans:
+			dequeued(op)
 			err := backend.SendSync(ctx, op.span)
 			if op.result != nil {
 				op.result <- err
@@ -141,6 +171,29 @@ func Capacity(n uint) ClientParam {
 	}
 }
 
+// SampleRate sets a client up to record the spans of only 1 in every
+// rate traces. Like in veneur's span sinks, sampling is performed on
+// the trace ID, so that either all spans of a trace are recorded or
+// none are, and clients with the same rate, in any process, record the
+// same traces. Indicator spans, spans without a trace ID, and spans
+// whose trace the application asked to keep are always recorded. This
+// parameter can be used on both generic and networked backends.
+func SampleRate(rate uint) ClientParam {
+	return func(cl *Client) error {
+		cl.sampleRate = int64(rate)
+		return nil
+	}
+}
+
+// sampled returns whether the client records a span, according to its
+// sample rate.
+func (c *Client) sampled(span *ssf.SSFSpan) bool {
+	if c.sampleRate <= 1 || span.Indicator || span.SamplingPriority == ssf.SSFSpan_USER_KEEP {
+		return true
+	}
+	return (span.TraceId^span.TraceIdHigh)%c.sampleRate == 0
+}
+
 // Buffered sets the client to be buffered with the default buffer
 // size (enough to accomodate a single, maximum-sized SSF frame,
 // currently about 16MB).
@@ -170,6 +223,25 @@ func BufferedSize(size uint) ClientParam {
 	}
 }
 
+// BatchSpans sets a client up to send the spans it records in batches
+// of up to maxBytes octets, rather than one by one, and to send any
+// partial batch every maxDelay. This amortizes the per-datagram (or
+// per-frame) overhead of sending many small spans.
+//
+// For UDP clients, maxBytes must leave batches small enough to fit
+// into a datagram. Only veneur servers that read SSF batches should be
+// sent them: older ones drop batch datagrams and disconnect streams
+// that carry batch frames.
+func BatchSpans(maxDelay time.Duration, maxBytes uint) ClientParam {
+	return func(cl *Client) error {
+		if cl.backendParams == nil {
+			return ErrClientNotNetworked
+		}
+		cl.backendParams.batchBytes = maxBytes
+		return FlushInterval(maxDelay)(cl)
+	}
+}
+
 // FlushInterval sets up a buffered client to perform one synchronous
 // flush per time interval in a new goroutine. The goroutine closes
 // down when the Client's Close method is called.
@@ -209,9 +281,10 @@ func FlushChannel(ch <-chan time.Time, stop func()) ClientParam {
 	}
 }
 
-// BackoffTime sets the time increment that backoff time is increased
-// (linearly) between every reconnection attempt the backend makes. If
-// this option is not used, the backend uses DefaultBackoff.
+// BackoffTime sets the time that the backend waits before its second
+// reconnection attempt; the wait doubles between every subsequent
+// attempt, up to the MaxBackoffTime. If this option is not used, the
+// backend uses DefaultBackoff.
 func BackoffTime(t time.Duration) ClientParam {
 	return func(cl *Client) error {
 		if cl.backendParams != nil {
@@ -319,6 +392,7 @@ func NewClient(addrStr string, opts ...ClientParam) (*Client, error) {
 	}
 	ch := make(chan *recordOp, cl.cap)
 	cl.records = ch
+	cl.backendParams.reconnected = cl.reconnected
 
 	var ctx context.Context
 	ctx, cl.cancel = context.WithCancel(context.Background())
@@ -328,8 +402,13 @@ func NewClient(addrStr string, opts ...ClientParam) (*Client, error) {
 		switch addr := addr.(type) {
 		case *net.UDPAddr:
 			be := &packetBackend{backendParams: *cl.backendParams}
+			if be.batchBytes == 0 {
+				// Unbatched packet backends have nothing to flush.
+				fb = append(fb, flushNotifier{backend: be})
+				continue
+			}
 			fb = append(fb, newFlushNofifier(be))
-		case *net.UnixAddr:
+		case *net.UnixAddr, *net.TCPAddr:
 			be := &streamBackend{backendParams: *cl.backendParams}
 			fb = append(fb, newFlushNofifier(be))
 		default:
@@ -447,6 +526,7 @@ func SendClientStatistics(cl *Client, stats *statsd.Client, tags []string) {
 	stats.Count("trace_client.flushes_succeeded_total", atomic.SwapInt64(&cl.successfulFlushes, 0), tags, 1.0)
 	stats.Count("trace_client.records_failed_total", atomic.SwapInt64(&cl.failedRecords, 0), tags, 1.0)
 	stats.Count("trace_client.records_succeeded_total", atomic.SwapInt64(&cl.successfulRecords, 0), tags, 1.0)
+	stats.Count("trace_client.reconnects_total", atomic.SwapInt64(&cl.reconnects, 0), tags, 1.0)
 }
 
 // Record instructs the client to serialize and send a span. It does
@@ -455,26 +535,43 @@ func SendClientStatistics(cl *Client, stats *statsd.Client, tags []string) {
 // done, if it is non-nil.
 //
 // Record returns ErrNoClient if client is nil and ErrWouldBlock if
-// the client is not able to accomodate another span.
+// the client is not able to accomodate another span. What it does when
+// the client has no room for the span is set with Overflow. Spans that
+// the client samples away (see SampleRate) are discarded, as if they
+// were sent.
 func Record(cl *Client, span *ssf.SSFSpan, done chan<- error) error {
 	if cl == nil {
 		return ErrNoClient
 	}
 
+	if !cl.sampled(span) {
+		if done != nil {
+			go func() { done <- nil }()
+		}
+		return nil
+	}
+	if cl.tagGuard != nil {
+		cl.tagGuard.apply(span)
+	}
+
+	if cl.usesPolicy() {
+		return recordWithPolicy(cl, span, done)
+	}
+
 	op := &recordOp{span: span, result: done}
 	select {
 	case cl.spans <- span:
-		atomic.AddInt64(&cl.successfulRecords, 1)
+		cl.recorded()
 		if done != nil {
 			go func() { done <- nil }()
 		}
 		return nil
 	case cl.records <- op:
-		atomic.AddInt64(&cl.successfulRecords, 1)
+		cl.recorded()
 		return nil
 	default:
 	}
-	atomic.AddInt64(&cl.failedRecords, 1)
+	cl.dropped()
 	return ErrWouldBlock
 }
 
@@ -516,6 +613,7 @@ func FlushAsync(cl *Client, ch chan<- error) error {
 		return ErrNoClient
 	}
 	go func() {
+		start := time.Now()
 		errors := []error{}
 		oneCh := make(chan error)
 		for _, fb := range cl.flushBackends {
@@ -531,12 +629,11 @@ func FlushAsync(cl *Client, ch chan<- error) error {
 				errors = append(errors, ErrWouldBlock)
 			}
 		}
+		cl.recordFlush(time.Since(start), len(errors) > 0)
 		if len(errors) > 0 {
-			atomic.AddInt64(&cl.failedFlushes, 1)
 			ch <- &FlushError{errors}
 			return
 		}
-		atomic.AddInt64(&cl.successfulFlushes, 1)
 		ch <- nil
 	}()
 	return nil
@@ -189,6 +189,89 @@ func TestUNIXBuffered(t *testing.T) {
 	}
 }
 
+func TestUDPBatched(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	client, err := NewClient(fmt.Sprintf("udp://%s", serverConn.LocalAddr().String()),
+		Capacity(4),
+		ParallelBackends(1),
+		BatchSpans(time.Hour, 8192))
+	require.NoError(t, err)
+	defer client.Close()
+
+	sentCh := make(chan error)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("Testing-%d", i)
+		tr := StartTrace(name)
+		tr.Sent = sentCh
+		mustRecord(t, client, tr)
+	}
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, <-sentCh)
+	}
+	mustFlush(t, client)
+
+	buf := make([]byte, protocol.MaxSSFPacketLength)
+	n, err := serverConn.Read(buf)
+	require.NoError(t, err)
+	require.True(t, protocol.IsBatchDatagram(buf[:n]))
+	spans, err := protocol.ParseSSFBatchDatagram(buf[:n], 0)
+	require.NoError(t, err)
+	assert.Len(t, spans, 4)
+}
+
+func TestUNIXBatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sockName := filepath.Join(dir, "sock")
+	laddr, err := net.ResolveUnixAddr("unix", sockName)
+	require.NoError(t, err)
+
+	batches := make(chan []*ssf.SSFSpan, 4)
+	cleanup := serveUNIX(t, laddr, func(in net.Conn) {
+		for {
+			frame, batch, err := protocol.ReadSSFStreamFrame(in, protocol.MaxSSFPacketLength)
+			if err == io.EOF {
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, batch)
+			spans, err := protocol.ParseSSFBatch(frame, 0)
+			assert.NoError(t, err)
+			batches <- spans
+		}
+	})
+	defer cleanup()
+
+	// Each span is a little over 50 octets, so two fit into a batch:
+	client, err := NewClient((&url.URL{Scheme: "unix", Path: sockName}).String(),
+		Capacity(4),
+		ParallelBackends(1),
+		BatchSpans(time.Hour, 120))
+	require.NoError(t, err)
+	defer client.Close()
+
+	sentCh := make(chan error)
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("Testing-%d", i)
+		tr := StartTrace(name)
+		tr.Sent = sentCh
+		mustRecord(t, client, tr)
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-sentCh)
+	}
+	assert.Len(t, <-batches, 2)
+	assert.Equal(t, 0, len(batches), "Should not have sent the partial batch yet")
+
+	mustFlush(t, client)
+	assert.Len(t, <-batches, 1)
+}
+
 func serveUNIX(t testing.TB, laddr *net.UnixAddr, onconnect func(conn net.Conn)) (cleanup func() error) {
 	srv, err := net.ListenUnix(laddr.Network(), laddr)
 	require.NoError(t, err)
@@ -407,6 +490,81 @@ func TestReconnectBufferedUNIX(t *testing.T) {
 	}
 }
 
+func TestReconnectTCP(t *testing.T) {
+	outPkg := make(chan *ssf.SSFSpan, 4)
+	conns := make(chan net.Conn, 4)
+	serve := func(ln net.Listener) {
+		for {
+			in, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- in
+			go func() {
+				for {
+					pkg, err := protocol.ReadSSF(in)
+					if err != nil {
+						return
+					}
+					outPkg <- pkg
+				}
+			}()
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	go serve(ln)
+
+	client, err := NewClient("tcp://"+addr,
+		Capacity(4),
+		ParallelBackends(1),
+		BackoffTime(5*time.Millisecond),
+		MaxBackoffTime(20*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	sentCh := make(chan error)
+	{
+		tr := StartTrace("Testing-success")
+		tr.Sent = sentCh
+		mustRecord(t, client, tr)
+		assert.NoError(t, <-sentCh)
+		<-outPkg
+	}
+
+	// veneur goes away:
+	require.NoError(t, ln.Close())
+	(<-conns).Close()
+
+	// Writing to the broken connection fails eventually, and the
+	// span that's lost is reported:
+	failed := false
+	for i := 0; i < 100 && !failed; i++ {
+		tr := StartTrace(fmt.Sprintf("Testing-failure-%d", i))
+		tr.Sent = sentCh
+		mustRecord(t, client, tr)
+		failed = <-sentCh != nil
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, failed, "writing to the closed connection never failed")
+
+	// ...and comes back:
+	ln, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer ln.Close()
+	go serve(ln)
+	{
+		tr := StartTrace("Testing-success2")
+		tr.Sent = sentCh
+		mustRecord(t, client, tr)
+		assert.NoError(t, <-sentCh)
+		assert.Equal(t, tr.SpanID, (<-outPkg).Id)
+	}
+	assert.Equal(t, int64(1), client.Stats().Reconnects)
+}
+
 type testBackend struct {
 	t  *testing.T
 	ch chan *ssf.SSFSpan
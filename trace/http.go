@@ -0,0 +1,224 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// The tags that HTTPMiddleware and HTTPTransport set on their spans.
+const (
+	httpMethodTag     = "http.method"
+	httpURLTag        = "http.url"
+	httpRouteTag      = "http.route"
+	httpStatusCodeTag = "http.status_code"
+	spanKindTag       = "span.kind"
+)
+
+// HTTPOption is an option for HTTPMiddleware and HTTPTransport.
+type HTTPOption func(*httpOptions)
+
+type httpOptions struct {
+	client *Client
+	route  func(*http.Request) string
+}
+
+func newHTTPOptions(opts []HTTPOption) *httpOptions {
+	o := &httpOptions{client: DefaultClient}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// HTTPTraceClient sets the client that spans are recorded with. If
+// this option is not used, they're recorded with DefaultClient.
+func HTTPTraceClient(cl *Client) HTTPOption {
+	return func(o *httpOptions) {
+		o.client = cl
+	}
+}
+
+// HTTPRoute sets the function that returns the route template of a
+// request, like "/users/{id}", which spans are named after, along
+// with the request's method. If this option is not used, spans are
+// named after the request's path, which is only suitable if paths
+// don't contain IDs.
+func HTTPRoute(route func(*http.Request) string) HTTPOption {
+	return func(o *httpOptions) {
+		o.route = route
+	}
+}
+
+// spanName returns the name of the span of a request, and its route.
+func (o *httpOptions) spanName(r *http.Request) (name string, route string) {
+	route = r.URL.Path
+	if o.route != nil {
+		route = o.route(r)
+	}
+	return r.Method + " " + route, route
+}
+
+// HTTPMiddleware wraps an http.Handler so that it records a span for
+// every request it serves. Requests that carry veneur's trace headers
+// get a child of the span that sent them, and other requests start a
+// new trace.
+//
+// The span is attached to the request's context, both for
+// SpanFromContext and for StartSpanFromContext, so that the handler can
+// start children of it. It's tagged with the request's method, URL
+// (without its query) and route, and the response's status code, and
+// it's marked as an error if the status code is 500 or above.
+func HTTPMiddleware(next http.Handler, opts ...HTTPOption) http.Handler {
+	o := newHTTPOptions(opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, route := o.spanName(r)
+		span, err := GlobalTracer.ExtractRequestChild(name, r, name)
+		if err != nil {
+			trace := StartTrace(name)
+			trace.Name = name
+			span = &Span{tracer: GlobalTracer, Trace: trace}
+		}
+		span.SetTag(spanKindTag, "server")
+		span.SetTag(httpMethodTag, r.Method)
+		span.SetTag(httpURLTag, redactedURL(r.URL))
+		span.SetTag(httpRouteTag, route)
+
+		sw := &statusResponseWriter{ResponseWriter: w}
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				// The handler wrote nothing, so net/http
+				// responds with 200 OK.
+				status = http.StatusOK
+			}
+			finishHTTPSpan(span, status, o.client)
+		}()
+
+		ctx := span.Attach(span.Trace.Attach(r.Context()))
+		next.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// redactedURL returns a URL without its user info and query, which
+// may hold secrets.
+func redactedURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = ""
+	redacted.ForceQuery = false
+	return redacted.String()
+}
+
+// finishHTTPSpan tags a span with the status code of its response,
+// and records it.
+func finishHTTPSpan(span *Span, status int, cl *Client) {
+	span.SetTag(httpStatusCodeTag, strconv.Itoa(status))
+	if status >= http.StatusInternalServerError {
+		span.Error(fmt.Errorf("HTTP %d %s", status, http.StatusText(status)))
+	}
+	span.ClientFinish(cl)
+}
+
+// statusResponseWriter records the status code that a handler
+// responds with.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response, if the wrapped ResponseWriter can.
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// HTTPTransport wraps an http.RoundTripper so that it records a client
+// span for every request it sends, and propagates the span to the
+// server in veneur's trace headers. The span is a child of the span in
+// the request's context, if there is one (attached with either Trace's
+// or Span's Attach), and otherwise starts a new trace. If base is nil,
+// http.DefaultTransport is used.
+//
+// The span ends when the response's headers are received, and is
+// tagged and marked as an error like HTTPMiddleware's spans; requests
+// that fail to get a response are errors too.
+func HTTPTransport(base http.RoundTripper, opts ...HTTPOption) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &httpTransport{base: base, opts: newHTTPOptions(opts)}
+}
+
+type httpTransport struct {
+	base http.RoundTripper
+	opts *httpOptions
+}
+
+func (t *httpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name, route := t.opts.spanName(req)
+	var trace *Trace
+	if parent := traceFromContext(req.Context()); parent != nil {
+		trace = StartChildSpan(parent)
+	} else {
+		trace = StartTrace(name)
+	}
+	trace.Name = name
+	span := &Span{tracer: GlobalTracer, Trace: trace}
+	span.SetTag(spanKindTag, "client")
+	span.SetTag(httpMethodTag, req.Method)
+	span.SetTag(httpURLTag, redactedURL(req.URL))
+	span.SetTag(httpRouteTag, route)
+
+	// RoundTrippers mustn't modify the request they're passed, so
+	// the headers go on a copy:
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		outReq.Header[k] = append([]string(nil), v...)
+	}
+	if err := GlobalTracer.InjectRequest(span.Trace, outReq); err != nil {
+		span.Error(err)
+	}
+
+	resp, err := t.base.RoundTrip(outReq)
+	if err != nil {
+		span.Error(err)
+		span.ClientFinish(t.opts.client)
+		return nil, err
+	}
+	finishHTTPSpan(span, resp.StatusCode, t.opts.client)
+	return resp, nil
+}
+
+// traceFromContext returns the span attached to a context, by either
+// Span's or Trace's Attach, or nil if there is none.
+func traceFromContext(ctx context.Context) *Trace {
+	if span, ok := opentracing.SpanFromContext(ctx).(*Span); ok && span != nil {
+		return span.Trace
+	}
+	if trace, ok := ctx.Value(traceKey).(*Trace); ok {
+		return trace
+	}
+	return nil
+}
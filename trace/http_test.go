@@ -0,0 +1,141 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+// receiveSpans returns the next n spans recorded, by their name and
+// span.kind tag.
+func receiveSpans(t *testing.T, spans chan *ssf.SSFSpan, n int) map[string]*ssf.SSFSpan {
+	received := map[string]*ssf.SSFSpan{}
+	for i := 0; i < n; i++ {
+		span := <-spans
+		received[span.Tags[spanKindTag]+" "+span.Name] = span
+	}
+	require.Len(t, received, n)
+	return received
+}
+
+// TestHTTPServiceHop sends a request from a client to a frontend
+// service, which makes a request to a backend service, and checks
+// that the spans of each hop are children of the spans before them.
+func TestHTTPServiceHop(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 10)
+	cl, err := NewChannelClient(spans)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	backend := httptest.NewServer(HTTPMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		}),
+		HTTPTraceClient(cl),
+		HTTPRoute(func(r *http.Request) string { return "/users/{id}" })))
+	defer backend.Close()
+
+	client := &http.Client{Transport: HTTPTransport(nil, HTTPTraceClient(cl))}
+	frontend := httptest.NewServer(HTTPMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The handler can start spans of its own:
+			work := SpanFromContext(r.Context())
+			work.Name = "frontend.work"
+			assert.NoError(t, work.ClientRecord(cl, "", nil))
+
+			req, err := http.NewRequest("GET", backend.URL+"/users/42?token=secret", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req.WithContext(r.Context()))
+			require.NoError(t, err)
+			resp.Body.Close()
+			w.WriteHeader(http.StatusAccepted)
+		}),
+		HTTPTraceClient(cl)))
+	defer frontend.Close()
+
+	root := StartTrace("checkout")
+	req, err := http.NewRequest("POST", frontend.URL+"/checkout", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req.WithContext(root.Attach(context.Background())))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	got := receiveSpans(t, spans, 5)
+	checkoutCall := got["client POST /checkout"]
+	checkout := got["server POST /checkout"]
+	work := got[" frontend.work"]
+	usersCall := got["client GET /users/42"]
+	users := got["server GET /users/{id}"]
+	for name, span := range got {
+		require.NotNil(t, span, name)
+		assert.Equal(t, root.TraceID, span.TraceId, "trace ID of %q", name)
+	}
+
+	assert.Equal(t, root.SpanID, checkoutCall.ParentId)
+	assert.Equal(t, checkoutCall.Id, checkout.ParentId)
+	assert.Equal(t, checkout.Id, work.ParentId)
+	assert.Equal(t, checkout.Id, usersCall.ParentId)
+	assert.Equal(t, usersCall.Id, users.ParentId)
+
+	assert.Equal(t, "202", checkout.Tags[httpStatusCodeTag])
+	assert.Equal(t, "POST", checkout.Tags[httpMethodTag])
+	assert.Equal(t, "/checkout", checkout.Tags[httpURLTag])
+	assert.False(t, checkout.Error)
+
+	assert.Equal(t, "/users/{id}", users.Tags[httpRouteTag])
+	assert.Equal(t, "/users/42", users.Tags[httpURLTag], "the query is left out")
+	assert.Equal(t, "503", users.Tags[httpStatusCodeTag])
+	assert.True(t, users.Error)
+	assert.Equal(t, "503", usersCall.Tags[httpStatusCodeTag])
+	assert.True(t, usersCall.Error)
+	assert.Equal(t, backend.URL+"/users/42", usersCall.Tags[httpURLTag])
+}
+
+func TestHTTPMiddlewareStartsTraces(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 1)
+	cl, err := NewChannelClient(spans)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	handler := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	}), HTTPTraceClient(cl))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	span := <-spans
+	assert.Equal(t, "GET /hello", span.Name)
+	assert.Equal(t, span.TraceId, span.Id, "the span is the root of a new trace")
+	assert.Equal(t, int64(0), span.ParentId)
+	assert.Equal(t, "200", span.Tags[httpStatusCodeTag])
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestHTTPTransportErrors(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 1)
+	cl, err := NewChannelClient(spans)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/hello", nil)
+	_, err = HTTPTransport(failingTransport{}, HTTPTraceClient(cl)).RoundTrip(req)
+	assert.Error(t, err)
+	assert.Empty(t, req.Header, "the request passed in is left alone")
+
+	span := <-spans
+	assert.Equal(t, "GET /hello", span.Name)
+	assert.True(t, span.Error)
+	assert.Equal(t, "connection refused", span.Tags[errorMessageTag])
+}
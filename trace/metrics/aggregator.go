@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// DefaultMaxBuffered is the number of samples other than counters
+// that an Aggregator holds on to before it flushes on its own.
+const DefaultMaxBuffered = 1000
+
+// Aggregator batches the metrics reported to a trace client, so that
+// code that reports many samples sends few spans: counters are summed
+// up by their name, tags and unit, and all other samples (like
+// timings) are kept, in the order they were reported, in a buffer
+// that is flushed whenever it fills up. Everything that was added is
+// sent on Flush, on the aggregator's interval and on Close.
+//
+// Once Aggregate set one up for a trace client, Report, ReportBatch,
+// ReportAsync and ReportOne add to it instead of sending a span for
+// each call.
+type Aggregator struct {
+	cl          *trace.Client
+	maxBuffered int
+
+	mtx    sync.Mutex
+	counts map[string]*ssf.SSFSample
+	// batch holds the samples to send, in the order they were
+	// first reported; counters in it are summed up in place.
+	batch    []*ssf.SSFSample
+	buffered int
+
+	stop   chan struct{}
+	done   chan struct{}
+	closed sync.Once
+}
+
+var aggregators sync.Map // *trace.Client -> *Aggregator
+
+// NewAggregator returns an Aggregator that sends the metrics added to
+// it to the trace client cl, every interval (if interval is positive)
+// and as soon as maxBuffered samples other than counters are waiting. A maxBuffered of 0 means DefaultMaxBuffered.
+func NewAggregator(cl *trace.Client, interval time.Duration, maxBuffered int) *Aggregator {
+	if maxBuffered <= 0 {
+		maxBuffered = DefaultMaxBuffered
+	}
+	a := &Aggregator{
+		cl:          cl,
+		maxBuffered: maxBuffered,
+		counts:      map[string]*ssf.SSFSample{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if interval > 0 {
+		go a.flushEvery(interval)
+	} else {
+		close(a.done)
+	}
+	return a
+}
+
+// Aggregate sets up an Aggregator (see NewAggregator) for the trace
+// client cl, which the package's Report functions use from then on
+// until it is closed. If cl already has one, that one is returned.
+func Aggregate(cl *trace.Client, interval time.Duration, maxBuffered int) *Aggregator {
+	a := NewAggregator(cl, interval, maxBuffered)
+	existing, loaded := aggregators.LoadOrStore(cl, a)
+	if loaded {
+		a.Close()
+		return existing.(*Aggregator)
+	}
+	return a
+}
+
+func aggregatorFor(cl *trace.Client) *Aggregator {
+	if a, ok := aggregators.Load(cl); ok {
+		return a.(*Aggregator)
+	}
+	return nil
+}
+
+func (a *Aggregator) flushEvery(interval time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Flush(nil)
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// countKey identifies the counters that are summed up together.
+func countKey(sample *ssf.SSFSample) string {
+	tags := make([]string, 0, len(sample.Tags))
+	for k, v := range sample.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return sample.Name + "\x00" + sample.Unit + "\x00" + strings.Join(tags, "\x00")
+}
+
+// Add adds metric samples to the aggregator. If that fills up its
+// buffer, they are flushed right away.
+func (a *Aggregator) Add(samples ...*ssf.SSFSample) error {
+	if len(samples) == 0 {
+		return NoMetrics{}
+	}
+	a.mtx.Lock()
+	for _, sample := range samples {
+		if sample.Metric != ssf.SSFSample_COUNTER {
+			a.batch = append(a.batch, sample)
+			a.buffered++
+			continue
+		}
+		// Counters with a sample rate are summed up as the
+		// count they stand for:
+		value := sample.Value
+		if sample.SampleRate > 0 && sample.SampleRate != 1 {
+			value /= sample.SampleRate
+		}
+		key := countKey(sample)
+		if count, ok := a.counts[key]; ok {
+			count.Value += value
+			if sample.Timestamp > count.Timestamp {
+				count.Timestamp = sample.Timestamp
+			}
+			continue
+		}
+		// The sample is copied, as the caller may still hold on
+		// to it:
+		count := *sample
+		count.Value = value
+		count.SampleRate = 1
+		a.counts[key] = &count
+		a.batch = append(a.batch, &count)
+	}
+	full := a.buffered >= a.maxBuffered
+	a.mtx.Unlock()
+
+	if full {
+		return a.Flush(nil)
+	}
+	return nil
+}
+
+// Flush sends the samples added so far to the trace client, as one
+// span. The channel done (if not nil) receives an error (or nil) when
+// the span was sent, or right away if there was nothing to send.
+func (a *Aggregator) Flush(done chan<- error) error {
+	a.mtx.Lock()
+	batch := a.batch
+	a.batch = nil
+	a.buffered = 0
+	if len(a.counts) > 0 {
+		a.counts = map[string]*ssf.SSFSample{}
+	}
+	a.mtx.Unlock()
+
+	if len(batch) == 0 {
+		if done != nil {
+			go func() { done <- nil }()
+		}
+		return nil
+	}
+	return trace.Record(a.cl, &ssf.SSFSpan{Metrics: batch}, done)
+}
+
+// Close stops the aggregator's interval flushes, sends what is left
+// and waits until it was sent. If the aggregator was set up with
+// Aggregate, the Report functions send each batch on its own again.
+func (a *Aggregator) Close() error {
+	var err error
+	a.closed.Do(func() {
+		if aggregatorFor(a.cl) == a {
+			aggregators.Delete(a.cl)
+		}
+		close(a.stop)
+		<-a.done
+
+		done := make(chan error, 1)
+		if err = a.Flush(done); err == nil {
+			err = <-done
+		}
+	})
+	return err
+}
@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+func TestAggregatorCoalescesCounts(t *testing.T) {
+	cl, ch := newClient(t)
+	defer cl.Close()
+	agg := NewAggregator(cl, 0, 0)
+	defer agg.Close()
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, agg.Add(
+			ssf.Count("hits", 1, map[string]string{"path": "/", "code": "200"}),
+			ssf.Count("hits", 2, map[string]string{"code": "200", "path": "/"}),
+			ssf.Count("hits", 1, map[string]string{"path": "/", "code": "500"}),
+		))
+	}
+	require.NoError(t, agg.Add(ssf.Count("sampled", 1, nil, ssf.SampleRate(0.25))))
+	assert.Len(t, ch, 0, "nothing is sent before the flush")
+
+	require.NoError(t, agg.Flush(nil))
+	span := <-ch
+	require.Len(t, span.Metrics, 3)
+	assert.Equal(t, float32(3000), span.Metrics[0].Value)
+	assert.Equal(t, "200", span.Metrics[0].Tags["code"])
+	assert.Equal(t, float32(1000), span.Metrics[1].Value)
+	assert.Equal(t, "500", span.Metrics[1].Tags["code"])
+	assert.Equal(t, float32(4), span.Metrics[2].Value)
+	assert.Equal(t, float32(1), span.Metrics[2].SampleRate)
+
+	// Flushed counters start over:
+	require.NoError(t, agg.Add(ssf.Count("hits", 1, map[string]string{"path": "/", "code": "200"})))
+	require.NoError(t, agg.Flush(nil))
+	span = <-ch
+	require.Len(t, span.Metrics, 1)
+	assert.Equal(t, float32(1), span.Metrics[0].Value)
+}
+
+func TestAggregatorKeepsOrder(t *testing.T) {
+	cl, ch := newClient(t)
+	defer cl.Close()
+	agg := NewAggregator(cl, 0, 3)
+	defer agg.Close()
+
+	require.NoError(t, agg.Add(
+		ssf.Timing("latency", 3*time.Millisecond, time.Millisecond, nil),
+		ssf.Count("hits", 1, nil),
+		ssf.Gauge("queue", 5, nil),
+		ssf.Count("hits", 1, nil),
+	))
+	assert.Len(t, ch, 0)
+	// The third sample that isn't a counter fills the buffer:
+	require.NoError(t, agg.Add(ssf.Timing("latency", 1*time.Millisecond, time.Millisecond, nil)))
+	span := <-ch
+	var names []string
+	for _, sample := range span.Metrics {
+		names = append(names, fmt.Sprintf("%s:%v", sample.Name, sample.Value))
+	}
+	assert.Equal(t, []string{"latency:3", "hits:2", "queue:5", "latency:1"}, names)
+}
+
+func TestAggregatorFlushesOnInterval(t *testing.T) {
+	cl, ch := newClient(t)
+	defer cl.Close()
+	agg := NewAggregator(cl, 10*time.Millisecond, 0)
+	defer agg.Close()
+
+	require.NoError(t, agg.Add(ssf.Count("hits", 1, nil), ssf.Count("hits", 1, nil)))
+	select {
+	case span := <-ch:
+		require.Len(t, span.Metrics, 1)
+		assert.Equal(t, float32(2), span.Metrics[0].Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the aggregator didn't flush")
+	}
+}
+
+func TestAggregateReport(t *testing.T) {
+	cl, ch := newClient(t)
+	defer cl.Close()
+	agg := Aggregate(cl, time.Hour, 0)
+	assert.Equal(t, agg, Aggregate(cl, time.Hour, 0))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ReportOne(cl, ssf.Count("hits", 1, nil)))
+	}
+	require.NoError(t, ReportBatch(cl, []*ssf.SSFSample{ssf.Gauge("queue", 1, nil)}))
+	assert.Len(t, ch, 0)
+
+	// Waiting for metrics to be sent sends the ones before them,
+	// too:
+	done := make(chan error)
+	require.NoError(t, ReportAsync(cl, []*ssf.SSFSample{ssf.Gauge("queue", 2, nil)}, done))
+	span := <-ch
+	require.NoError(t, <-done)
+	require.Len(t, span.Metrics, 3)
+	assert.Equal(t, float32(10), span.Metrics[0].Value)
+	assert.Equal(t, float32(1), span.Metrics[1].Value)
+	assert.Equal(t, float32(2), span.Metrics[2].Value)
+
+	// Closing the aggregator sends what's left, and the Report
+	// functions send their metrics right away after it:
+	require.NoError(t, ReportOne(cl, ssf.Count("hits", 1, nil)))
+	require.NoError(t, agg.Close())
+	span = <-ch
+	require.Len(t, span.Metrics, 1)
+	require.NoError(t, ReportOne(cl, ssf.Count("hits", 5, nil)))
+	span = <-ch
+	assert.Equal(t, float32(5), span.Metrics[0].Value)
+}
+
+type countingBackend struct{}
+
+func (countingBackend) Close() error                                 { return nil }
+func (countingBackend) SendSync(context.Context, *ssf.SSFSpan) error { return nil }
+func (countingBackend) FlushSync(context.Context) error              { return nil }
+
+// benchmarkSink reports as a sink would: 1000 submissions, of a
+// handful of counters and some timings, for each flush.
+func benchmarkSink(b *testing.B, aggregate bool) {
+	cl, err := trace.NewBackendClient(countingBackend{}, trace.Capacity(2048))
+	require.NoError(b, err)
+	defer cl.Close()
+	var agg *Aggregator
+	if aggregate {
+		agg = Aggregate(cl, 0, 0)
+		defer agg.Close()
+	}
+	tags := map[string]string{"sink": "benchmark"}
+	names := []string{"flush.0", "flush.1", "flush.2", "flush.3"}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			if j%10 == 0 {
+				ReportOne(cl, ssf.Timing("flush.duration", time.Duration(j)*time.Microsecond, time.Millisecond, tags))
+				continue
+			}
+			ReportOne(cl, ssf.Count(names[j%4], 1, tags))
+		}
+		if agg != nil {
+			agg.Flush(nil)
+		}
+		trace.Flush(cl)
+	}
+	stats := cl.Stats()
+	b.ReportMetric(float64(stats.Recorded+stats.Dropped)/time.Since(start).Seconds(), "messages/s")
+	b.ReportMetric(float64(stats.Recorded+stats.Dropped)/float64(b.N), "messages/flush")
+}
+
+func BenchmarkReportDirect(b *testing.B) {
+	benchmarkSink(b, false)
+}
+
+func BenchmarkReportAggregated(b *testing.B) {
+	benchmarkSink(b, true)
+}
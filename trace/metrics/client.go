@@ -35,10 +35,20 @@ func ReportBatch(cl *trace.Client, samples []*ssf.SSFSample) error {
 //
 // If metrics is empty, an error NoMetrics is returned and done does
 // not receive any data.
+//
+// If cl has an Aggregator (see Aggregate), the metrics are added to
+// it. Unless done is nil, they are then flushed right away, along
+// with all metrics added before them.
 func ReportAsync(cl *trace.Client, metrics []*ssf.SSFSample, done chan<- error) error {
 	if metrics == nil || len(metrics) == 0 {
 		return NoMetrics{}
 	}
+	if a := aggregatorFor(cl); a != nil {
+		if err := a.Add(metrics...); err != nil || done == nil {
+			return err
+		}
+		return a.Flush(done)
+	}
 	span := &ssf.SSFSpan{Metrics: metrics}
 	return trace.Record(cl, span, done)
 }
@@ -146,6 +146,44 @@ func (c *spanContext) TraceID() int64 {
 	return c.parseBaggageInt64("traceid")
 }
 
+// TraceIDHigh extracts the high 64 bits of a 128-bit Trace ID from the
+// BaggageItems. It's 0 for 64-bit Trace IDs.
+func (c *spanContext) TraceIDHigh() int64 {
+	return c.parseBaggageInt64("traceidhigh")
+}
+
+// samplingPriorityKey is the baggage item, and the trace header, that
+// carries a trace's sampling priority: the number of an
+// ssf.SSFSpan_SamplingPriority.
+const samplingPriorityKey = "samplingpriority"
+
+// SamplingPriority extracts the trace's sampling priority from the
+// BaggageItems. It's AUTO if there's none, or it's unknown.
+func (c *spanContext) SamplingPriority() ssf.SSFSpan_SamplingPriority {
+	return parseSamplingPriority(c.parseBaggageInt64(samplingPriorityKey))
+}
+
+func parseSamplingPriority(n int64) ssf.SSFSpan_SamplingPriority {
+	if _, ok := ssf.SSFSpan_SamplingPriority_name[int32(n)]; !ok {
+		return ssf.SSFSpan_AUTO
+	}
+	return ssf.SSFSpan_SamplingPriority(n)
+}
+
+// TraceState extracts the W3C tracestate from the BaggageItems. It's
+// empty if there's none.
+func (c *spanContext) TraceState() string {
+	var state string
+	c.ForeachBaggageItem(func(k, v string) bool {
+		if strings.ToLower(k) == tracestateHeader {
+			state = v
+			return false
+		}
+		return true
+	})
+	return state
+}
+
 // ParentID extracts the Parent ID from the BaggageItems.
 // It assumes the ParentID is present and valid.
 func (c *spanContext) ParentID() int64 {
@@ -197,14 +235,15 @@ type Span struct {
 	*Trace
 
 	recordErr error
-
-	// These are currently ignored
-	logLines []opentracinglog.Field
 }
 
-// Finish ends a trace end records it with DefaultClient.
+// Finish ends a trace end records it with the client of the Tracer
+// that started it.
 func (s *Span) Finish() {
-	s.ClientFinish(DefaultClient)
+	if s == nil {
+		return
+	}
+	s.ClientFinish(s.tracer.client())
 }
 
 // ClientFinish ends a trace and records it with the given Client.
@@ -223,10 +262,14 @@ func (s *Span) ClientFinish(cl *Client) {
 }
 
 // FinishWithOptions finishes the span, but with explicit
-// control over timestamps and log data.
+// control over timestamps and log data, and records it with the client
+// of the Tracer that started it.
 // The BulkLogData field is deprecated and ignored.
 func (s *Span) FinishWithOptions(opts opentracing.FinishOptions) {
-	s.ClientFinishWithOptions(DefaultClient, opts)
+	if s == nil {
+		return
+	}
+	s.ClientFinishWithOptions(s.tracer.client(), opts)
 }
 
 // ClientFinishWithOptions finishes the span and records it on the
@@ -242,6 +285,12 @@ func (s *Span) ClientFinishWithOptions(cl *Client, opts opentracing.FinishOption
 
 	// TODO remove the name tag from the slice of tags
 
+	if !opts.FinishTime.IsZero() {
+		s.End = opts.FinishTime
+	}
+	for _, record := range opts.LogRecords {
+		s.logEvent(record.Timestamp, record.Fields)
+	}
 	s.recordErr = s.ClientRecord(cl, s.Name, s.Tags)
 }
 
@@ -290,6 +339,12 @@ func (s *Span) SetTag(key string, value interface{}) opentracing.Span {
 		val = fmt.Sprintf("%#v", value)
 	}
 	s.Tags[key] = val
+	if key == "error" && value == true {
+		// The OpenTracing convention for marking spans as
+		// errors:
+		s.Status = ssf.SSFSample_CRITICAL
+		s.error = true
+	}
 	return s
 }
 
@@ -299,11 +354,37 @@ func (s *Span) Attach(ctx context.Context) context.Context {
 	return opentracing.ContextWithSpan(ctx, s)
 }
 
-// LogFields sets log fields on the underlying span.
-// Currently these are ignored, but they can be fun to set anyway!
+// LogFields adds an event to the underlying span, named after the
+// "event" field (or "log", if there is none), and tagged with the other
+// fields.
 func (s *Span) LogFields(fields ...opentracinglog.Field) {
+	s.logEvent(time.Now(), fields)
+}
+
+// logEvent adds the event that a log record represents to the span.
+func (s *Span) logEvent(at time.Time, fields []opentracinglog.Field) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	name := "log"
+	var tags map[string]string
+	for _, field := range fields {
+		value := fmt.Sprint(field.Value())
+		if field.Key() == "event" {
+			name = value
+			continue
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[field.Key()] = value
+	}
 	// TODO mutex this
-	s.logLines = append(s.logLines, fields...)
+	s.Events = append(s.Events, &ssf.SSFSpanEvent{
+		Timestamp: at.UnixNano(),
+		Name:      name,
+		Tags:      tags,
+	})
 }
 
 func (s *Span) LogKV(alternatingKeyValues ...interface{}) {
@@ -312,15 +393,15 @@ func (s *Span) LogKV(alternatingKeyValues ...interface{}) {
 	s.LogFields(fs...)
 }
 
-// SetBaggageItem sets the value of a baggage in the span.
+// SetBaggageItem does nothing: baggage isn't supported, as veneur's
+// trace headers don't propagate it.
 func (s *Span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
-	s.contextAsParent().baggageItems[restrictedKey] = value
 	return s
 }
 
-// BaggageItem fetches the value of a baggage item in the span.
+// BaggageItem returns "", as baggage isn't supported.
 func (s *Span) BaggageItem(restrictedKey string) string {
-	return s.contextAsParent().baggageItems[restrictedKey]
+	return ""
 }
 
 // Tracer returns the tracer that created this Span
@@ -328,23 +409,46 @@ func (s *Span) Tracer() opentracing.Tracer {
 	return s.tracer
 }
 
-// LogEvent is deprecated and unimplemented.
-// It is included only to satisfy the opentracing.Span interface.
+// LogEvent is deprecated, in favor of LogFields. It adds an event
+// to the span.
 func (s *Span) LogEvent(event string) {
+	s.LogFields(opentracinglog.String("event", event))
 }
 
-// LogEventWithPayload is deprecated and unimplemented.
-// It is included only to satisfy the opentracing.Span interface.
+// LogEventWithPayload is deprecated, in favor of LogFields. It adds
+// an event to the span, tagged with the payload.
 func (s *Span) LogEventWithPayload(event string, payload interface{}) {
+	s.LogFields(opentracinglog.String("event", event), opentracinglog.Object("payload", payload))
 }
 
-// Log is deprecated and unimplemented.
-// It is included only to satisfy the opentracing.Span interface.
+// Log is deprecated, in favor of LogFields. It adds the event that
+// data represents to the span.
 func (s *Span) Log(data opentracing.LogData) {
+	record := data.ToLogRecord()
+	s.logEvent(record.Timestamp, record.Fields)
 }
 
-// Tracer is a tracer
+// Tracer is an opentracing.Tracer that starts veneur Spans, and
+// propagates them in veneur's trace headers. Spans it starts are
+// recorded, when they're finished, with its Client. Its Inject and
+// Extract methods don't support baggage.
 type Tracer struct {
+	// Client is the client that spans are recorded with by Finish
+	// and FinishWithOptions; if it's nil, DefaultClient is used.
+	// Its SampleRate decides which traces are recorded.
+	Client *Client
+}
+
+// NewTracer returns a Tracer that records spans with cl.
+func NewTracer(cl *Client) Tracer {
+	return Tracer{Client: cl}
+}
+
+func (t Tracer) client() *Client {
+	if t.Client != nil {
+		return t.Client
+	}
+	return DefaultClient
 }
 
 type spanOption struct {
@@ -411,6 +515,9 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 			Trace:  StartTrace(operationName),
 			tracer: t,
 		}
+		if !sso.StartTime.IsZero() {
+			span.Start = sso.StartTime
+		}
 	} else {
 
 		// First, let's extract the parent's information
@@ -429,6 +536,9 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 					continue
 				}
 				parent.TraceID = ctx.TraceID()
+				parent.TraceIDHigh = ctx.TraceIDHigh()
+				parent.SamplingPriority = ctx.SamplingPriority()
+				parent.TraceState = ctx.TraceState()
 				parent.SpanID = ctx.SpanID()
 				parent.Resource = ctx.Resource()
 
@@ -498,10 +608,13 @@ func (tracer Tracer) ExtractRequestChild(resource string, req *http.Request, nam
 	parent := parentSpan.(*spanContext)
 
 	t := StartChildSpan(&Trace{
-		SpanID:   parent.SpanID(),
-		TraceID:  parent.TraceID(),
-		ParentID: parent.ParentID(),
-		Resource: resource,
+		SpanID:           parent.SpanID(),
+		TraceID:          parent.TraceID(),
+		TraceIDHigh:      parent.TraceIDHigh(),
+		ParentID:         parent.ParentID(),
+		Resource:         resource,
+		SamplingPriority: parent.SamplingPriority(),
+		TraceState:       parent.TraceState(),
 	})
 
 	t.Name = name
@@ -533,11 +646,13 @@ func (t Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier i
 		w := carrier.(io.Writer)
 
 		trace := &Trace{
-			TraceID:  sc.TraceID(),
-			ParentID: sc.ParentID(),
-			SpanID:   sc.SpanID(),
-			Resource: sc.Resource(),
-			Tags:     map[string]string{ResourceKey: sc.Resource()},
+			TraceID:          sc.TraceID(),
+			TraceIDHigh:      sc.TraceIDHigh(),
+			ParentID:         sc.ParentID(),
+			SpanID:           sc.SpanID(),
+			Resource:         sc.Resource(),
+			Tags:             map[string]string{ResourceKey: sc.Resource()},
+			SamplingPriority: sc.SamplingPriority(),
 		}
 
 		return trace.ProtoMarshalTo(w)
@@ -545,8 +660,17 @@ func (t Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier i
 
 	// If the carrier is a TextMapWriter, treat it as one, regardless of what the format is
 	if w, ok := carrier.(opentracing.TextMapWriter); ok {
-
-		textMapReaderWriter(sc.baggageItems).CloneTo(w)
+		items := textMapReaderWriter(sc.baggageItems).Clone()
+		delete(items, tracestateHeader)
+		if PropagateTraceparent {
+			if traceparent := sc.traceparent(); traceparent != "" {
+				items[traceparentHeader] = traceparent
+				if state := sc.TraceState(); state != "" {
+					items[tracestateHeader] = state
+				}
+			}
+		}
+		items.CloneTo(w)
 		return nil
 	}
 
@@ -581,9 +705,11 @@ func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracin
 		resource := sample.Tags[ResourceKey]
 
 		trace := &Trace{
-			TraceID:  sample.TraceId,
-			SpanID:   sample.Id,
-			Resource: resource,
+			TraceID:          sample.TraceId,
+			TraceIDHigh:      sample.TraceIdHigh,
+			SpanID:           sample.Id,
+			Resource:         resource,
+			SamplingPriority: sample.SamplingPriority,
 		}
 
 		return trace.context(), nil
@@ -592,7 +718,7 @@ func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracin
 	if tm, ok := carrier.(opentracing.TextMapReader); ok {
 		// carrier is guaranteed to be an opentracing.TextMapReader by contract
 		// TODO support other TextMapReader implementations
-		var traceID int64
+		var traceID, traceIDHigh int64
 		var spanID int64
 		for _, headers := range HeaderFormats {
 
@@ -601,21 +727,52 @@ func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracin
 				base = 16
 			}
 
-			traceID, _ = strconv.ParseInt(textMapReaderGet(tm, headers.TraceID), base, 64)
+			traceIDHigh = 0
+			traceIDStr := textMapReaderGet(tm, headers.TraceID)
+			if base == 16 && len(traceIDStr) > 16 {
+				// a 128-bit trace ID, whose halves are
+				// unsigned:
+				high, _ := strconv.ParseUint(traceIDStr[:len(traceIDStr)-16], base, 64)
+				low, _ := strconv.ParseUint(traceIDStr[len(traceIDStr)-16:], base, 64)
+				traceIDHigh, traceID = int64(high), int64(low)
+			} else {
+				traceID, _ = strconv.ParseInt(traceIDStr, base, 64)
+			}
 			spanID, _ = strconv.ParseInt(textMapReaderGet(tm, headers.SpanID), base, 64)
 
-			if traceID != 0 && spanID != 0 {
+			if (traceID != 0 || traceIDHigh != 0) && spanID != 0 {
 				break
 			}
 		}
-		if traceID == 0 && spanID == 0 {
+		traceparent, traceparentErr := ParseTraceparent(textMapReaderGet(tm, traceparentHeader))
+		if (traceID == 0 && traceIDHigh == 0) || spanID == 0 {
+			// Without any of the headers above, the W3C
+			// traceparent is the next best thing:
+			if traceparentErr == nil {
+				traceIDHigh, traceID, spanID = traceparent.TraceIDHigh, traceparent.TraceID, traceparent.ParentID
+			}
+		}
+		if traceID == 0 && traceIDHigh == 0 && spanID == 0 {
 			return nil, errors.New("error parsing fields from TextMapReader")
 		}
+		if traceIDHigh == 0 {
+			// Veneur's own headers carry the high bits
+			// separately:
+			traceIDHigh, _ = strconv.ParseInt(textMapReaderGet(tm, "traceidhigh"), 10, 64)
+		}
+		priority, _ := strconv.ParseInt(textMapReaderGet(tm, samplingPriorityKey), 10, 32)
 
 		trace := &Trace{
-			TraceID:  traceID,
-			SpanID:   spanID,
-			Resource: textMapReaderGet(tm, ResourceKey),
+			TraceID:          traceID,
+			TraceIDHigh:      traceIDHigh,
+			SpanID:           spanID,
+			Resource:         textMapReaderGet(tm, ResourceKey),
+			SamplingPriority: parseSamplingPriority(priority),
+		}
+		if traceparentErr == nil && traceparent.TraceID == traceID && traceparent.TraceIDHigh == traceIDHigh {
+			// The tracestate only goes with the traceparent
+			// of the same trace:
+			trace.TraceState = textMapReaderGet(tm, tracestateHeader)
 		}
 
 		return trace.context(), nil
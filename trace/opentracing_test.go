@@ -14,7 +14,9 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/opentracing/opentracing-go"
+	opentracinglog "github.com/opentracing/opentracing-go/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/ssf"
 )
 
@@ -248,6 +250,57 @@ func TestTraceExtractHeaderEnvoy(t *testing.T) {
 	assert.Equal(t, int64(67890), ctx.SpanID())
 }
 
+func TestTraceExtractHeaderEnvoy128Bit(t *testing.T) {
+	tracer := Tracer{}
+	tm := textMapReaderWriter(map[string]string{
+		"ot-tracer-traceid": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"ot-tracer-spanid":  "10932",
+	})
+
+	c, err := tracer.Extract(opentracing.TextMap, tm)
+	require.NoError(t, err)
+
+	ctx := c.(*spanContext)
+
+	assert.Equal(t, int64(0x4bf92f3577b34da6), ctx.TraceIDHigh())
+	low := uint64(0xa3ce929d0e0e4736)
+	assert.Equal(t, int64(low), ctx.TraceID())
+
+	// Children keep both halves of the trace ID:
+	span, ok := tracer.StartSpan("child", opentracing.ChildOf(ctx)).(*Span)
+	require.True(t, ok)
+	ssfSpan := span.Trace.SSFSpan()
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", ssf.TraceIDHex(ssfSpan))
+	assert.Equal(t, ctx.SpanID(), ssfSpan.ParentId)
+}
+
+func TestTracerPropagateSamplingPriority(t *testing.T) {
+	tracer := Tracer{}
+	for _, priority := range []ssf.SSFSpan_SamplingPriority{ssf.SSFSpan_USER_KEEP, ssf.SSFSpan_USER_DROP} {
+		trace := StartTrace("upstream")
+		trace.SamplingPriority = priority
+
+		req, err := http.NewRequest(http.MethodGet, "/test", nil)
+		require.NoError(t, err)
+		require.NoError(t, tracer.InjectRequest(trace, req))
+
+		span, err := tracer.ExtractRequestChild("downstream", req, "handle")
+		require.NoError(t, err)
+		assert.Equal(t, priority, span.SSFSpan().SamplingPriority)
+
+		// and on to the span's own children:
+		child, ok := tracer.StartSpan("query", opentracing.ChildOf(span.Context())).(*Span)
+		require.True(t, ok)
+		assert.Equal(t, priority, child.SSFSpan().SamplingPriority)
+	}
+
+	// Spans with no priority send no header:
+	req, err := http.NewRequest(http.MethodGet, "/test", nil)
+	require.NoError(t, err)
+	require.NoError(t, tracer.InjectRequest(StartTrace("upstream"), req))
+	assert.Empty(t, req.Header.Get(samplingPriorityKey))
+}
+
 func TestTraceExtractHeaderOpenTracing(t *testing.T) {
 	tracer := Tracer{}
 	tm := textMapReaderWriter(map[string]string{
@@ -325,3 +378,91 @@ func TestInjectRequestInjectHeaderExtractRequestChild(t *testing.T) {
 	assert.Equal(t, trace.SpanID, span.ParentID, "child should have the original trace's SpanId as its ParentId")
 	assert.Equal(t, trace.TraceID, span.TraceID)
 }
+
+func TestTracerRecordsWithClient(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 4)
+	cl, err := NewChannelClient(spans)
+	require.NoError(t, err)
+	defer cl.Close()
+	tracer := NewTracer(cl)
+
+	parent := tracer.StartSpan("checkout")
+	child := tracer.StartSpan("db.query", opentracing.ChildOf(parent.Context()))
+	child.SetTag("db.rows", 3)
+	child.SetTag("error", true)
+	child.LogKV("event", "cache miss", "key", "cart:42")
+	child.SetBaggageItem("user", "42")
+	assert.Equal(t, "", child.BaggageItem("user"), "baggage isn't supported")
+	child.Finish()
+
+	start := time.Now()
+	parent.FinishWithOptions(opentracing.FinishOptions{
+		FinishTime: start.Add(time.Second),
+		LogRecords: []opentracing.LogRecord{{
+			Timestamp: start,
+			Fields:    []opentracinglog.Field{opentracinglog.String("event", "paid")},
+		}},
+	})
+
+	childSpan := <-spans
+	parentSpan := <-spans
+	assert.Equal(t, "db.query", childSpan.Name)
+	assert.Equal(t, parentSpan.Id, childSpan.ParentId)
+	assert.Equal(t, parentSpan.TraceId, childSpan.TraceId)
+	assert.Equal(t, "3", childSpan.Tags["db.rows"])
+	assert.True(t, childSpan.Error)
+	require.Len(t, childSpan.Events, 1)
+	assert.Equal(t, "cache miss", childSpan.Events[0].Name)
+	assert.Equal(t, map[string]string{"key": "cart:42"}, childSpan.Events[0].Tags)
+
+	assert.Equal(t, start.Add(time.Second).UnixNano(), parentSpan.EndTimestamp)
+	require.Len(t, parentSpan.Events, 1)
+	assert.Equal(t, "paid", parentSpan.Events[0].Name)
+	assert.Equal(t, start.UnixNano(), parentSpan.Events[0].Timestamp)
+}
+
+func TestTracerPropagates(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 1)
+	cl, err := NewChannelClient(spans)
+	require.NoError(t, err)
+	defer cl.Close()
+	tracer := NewTracer(cl)
+
+	parent := tracer.StartSpan("upstream")
+	header := http.Header{}
+	require.NoError(t, tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)))
+
+	ctx, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	require.NoError(t, err)
+	child := tracer.StartSpan("downstream", opentracing.ChildOf(ctx))
+	child.Finish()
+
+	span := <-spans
+	assert.Equal(t, parent.(*Span).TraceID, span.TraceId)
+	assert.Equal(t, parent.(*Span).SpanID, span.ParentId)
+}
+
+func TestClientSampleRate(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 4)
+	cl, err := NewChannelClient(spans, SampleRate(2))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	for _, span := range []*ssf.SSFSpan{
+		{TraceId: 4, Id: 1, Name: "kept"},
+		{TraceId: 3, Id: 2, Name: "sampled away"},
+		{TraceId: 3, Id: 3, Name: "indicator", Indicator: true},
+		{TraceId: 3, Id: 4, Name: "priority", SamplingPriority: ssf.SSFSpan_USER_KEEP},
+		{Name: "metrics only"},
+	} {
+		done := make(chan error, 1)
+		require.NoError(t, Record(cl, span, done))
+		assert.NoError(t, <-done)
+	}
+	var names []string
+	for i := 0; i < 4; i++ {
+		names = append(names, (<-spans).Name)
+	}
+	assert.Equal(t, []string{"kept", "indicator", "priority", "metrics only"}, names)
+	assert.Len(t, spans, 0)
+}
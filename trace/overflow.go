@@ -0,0 +1,322 @@
+package trace
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/veneur/ssf"
+)
+
+// OverflowPolicy decides what Record does with a span when the client
+// has no room for it.
+type OverflowPolicy int
+
+const (
+	// DropNewest refuses the span, returning ErrWouldBlock. This is
+	// what clients do unless they're set up with Overflow.
+	DropNewest OverflowPolicy = iota
+
+	// DropOldest drops the oldest spans that are waiting to be sent
+	// until there's room for the span. Their done channels are sent
+	// ErrWouldBlock.
+	DropOldest
+
+	// Block waits until there's room for the span, for up to the
+	// timeout passed to Overflow, and then refuses it, returning
+	// ErrWouldBlock.
+	Block
+)
+
+// Overflow sets what Record does when a client has no room for a span,
+// either because as many spans as its Capacity are waiting to be sent,
+// or because their size adds up to MaxBufferedBytes. timeout is how
+// long the Block policy waits for; 0 waits until there's room, or the
+// client is closed. This parameter can be used on both generic and
+// networked backends.
+func Overflow(policy OverflowPolicy, timeout time.Duration) ClientParam {
+	return func(cl *Client) error {
+		cl.overflow = policy
+		cl.blockTimeout = timeout
+		return nil
+	}
+}
+
+// MaxBufferedBytes bounds the size, in serialized bytes, of the spans
+// waiting to be sent by a client. Spans that would go over it are
+// handled according to the client's Overflow policy; a span that's
+// bigger than the bound all by itself is only taken if no others are
+// waiting. This parameter can be used on both generic and networked
+// backends.
+func MaxBufferedBytes(n uint) ClientParam {
+	return func(cl *Client) error {
+		cl.maxBufferedBytes = int64(n)
+		return nil
+	}
+}
+
+// BufferPolicy configures a buffered client with BufferedWithPolicy.
+type BufferPolicy struct {
+	// Overflow and BlockTimeout are what Record does when the client
+	// has no room for a span, as set up with the Overflow option.
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration
+
+	// MaxBufferedBytes bounds the size of the spans waiting to be
+	// sent; 0 doesn't bound it.
+	MaxBufferedBytes uint
+
+	// FlushInterval is how often the buffer is flushed in the
+	// background, so that spans recorded on quiet clients don't sit
+	// unsent for long; 0 never flushes in the background.
+	FlushInterval time.Duration
+}
+
+// BufferedWithPolicy sets up a client to be Buffered, to handle spans
+// that it has no room for with an overflow policy, and to flush its
+// buffer periodically.
+func BufferedWithPolicy(policy BufferPolicy) ClientParam {
+	return func(cl *Client) error {
+		if err := Buffered(cl); err != nil {
+			return err
+		}
+		if err := Overflow(policy.Overflow, policy.BlockTimeout)(cl); err != nil {
+			return err
+		}
+		if err := MaxBufferedBytes(policy.MaxBufferedBytes)(cl); err != nil {
+			return err
+		}
+		if policy.FlushInterval > 0 {
+			return FlushInterval(policy.FlushInterval)(cl)
+		}
+		return nil
+	}
+}
+
+// ClientStats are the statistics of a client since it was created.
+// Unlike the ones that SendClientStatistics reports, they're never
+// reset.
+type ClientStats struct {
+	// Recorded is how many spans Record took, and Dropped how many
+	// it refused or later dropped for newer ones.
+	Recorded int64
+	Dropped  int64
+
+	// Flushes and FailedFlushes are how many flushes succeeded and
+	// failed. FlushLatency is how long they took in all, and
+	// MaxFlushLatency how long the slowest one took.
+	Flushes         int64
+	FailedFlushes   int64
+	FlushLatency    time.Duration
+	MaxFlushLatency time.Duration
+
+	// BufferedBytes is the size of the spans waiting to be sent, if
+	// the client bounds it with MaxBufferedBytes.
+	BufferedBytes int64
+
+	// Reconnects is how many times the client's backends
+	// re-established a connection that they lost.
+	Reconnects int64
+
+	// TagValuesTruncated, TagValuesCapped and TagsDropped are how
+	// many tag values were cut to MaxTagValueLength, replaced with
+	// OtherTagValue by TagValueCardinality, and how many tags went
+	// over MaxTagsPerSpan.
+	TagValuesTruncated int64
+	TagValuesCapped    int64
+	TagsDropped        int64
+}
+
+// Stats returns the statistics of the client.
+func (c *Client) Stats() ClientStats {
+	if c == nil {
+		return ClientStats{}
+	}
+	stats := ClientStats{
+		Recorded:        atomic.LoadInt64(&c.totalRecords),
+		Dropped:         atomic.LoadInt64(&c.totalDropped),
+		Flushes:         atomic.LoadInt64(&c.totalFlushes),
+		FailedFlushes:   atomic.LoadInt64(&c.totalFailedFlushes),
+		FlushLatency:    time.Duration(atomic.LoadInt64(&c.flushLatency)),
+		MaxFlushLatency: time.Duration(atomic.LoadInt64(&c.maxFlushLatency)),
+		BufferedBytes:   atomic.LoadInt64(&c.bufferedBytes),
+		Reconnects:      atomic.LoadInt64(&c.totalReconnects),
+	}
+	if g := c.tagGuard; g != nil {
+		stats.TagValuesTruncated = atomic.LoadInt64(&g.truncated)
+		stats.TagValuesCapped = atomic.LoadInt64(&g.capped)
+		stats.TagsDropped = atomic.LoadInt64(&g.dropped)
+	}
+	return stats
+}
+
+// recordFlush counts a flush that took latency.
+func (c *Client) recordFlush(latency time.Duration, failed bool) {
+	if failed {
+		atomic.AddInt64(&c.failedFlushes, 1)
+		atomic.AddInt64(&c.totalFailedFlushes, 1)
+	} else {
+		atomic.AddInt64(&c.successfulFlushes, 1)
+		atomic.AddInt64(&c.totalFlushes, 1)
+	}
+	atomic.AddInt64(&c.flushLatency, int64(latency))
+	for {
+		max := atomic.LoadInt64(&c.maxFlushLatency)
+		if int64(latency) <= max || atomic.CompareAndSwapInt64(&c.maxFlushLatency, max, int64(latency)) {
+			return
+		}
+	}
+}
+
+// reserve takes room for size bytes of spans, if there is room.
+func (c *Client) reserve(size int64) bool {
+	if c.maxBufferedBytes == 0 {
+		return true
+	}
+	for {
+		buffered := atomic.LoadInt64(&c.bufferedBytes)
+		if buffered > 0 && buffered+size > c.maxBufferedBytes {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.bufferedBytes, buffered, buffered+size) {
+			return true
+		}
+	}
+}
+
+// dequeued releases the room that a span waiting to be sent took.
+func (c *Client) dequeued(op *recordOp) {
+	if op.size > 0 {
+		atomic.AddInt64(&c.bufferedBytes, -op.size)
+	}
+	c.signalRoom()
+}
+
+// signalRoom wakes up a Record that's waiting for room.
+func (c *Client) signalRoom() {
+	select {
+	case c.room <- struct{}{}:
+	default:
+	}
+}
+
+// tryEnqueue queues a span to be sent, if there's room for it.
+func (c *Client) tryEnqueue(op *recordOp) bool {
+	if !c.reserve(op.size) {
+		return false
+	}
+	select {
+	case c.records <- op:
+		return true
+	default:
+	}
+	if op.size > 0 {
+		atomic.AddInt64(&c.bufferedBytes, -op.size)
+	}
+	return false
+}
+
+// dropOldest drops the oldest span waiting to be sent, if there is one.
+func (c *Client) dropOldest() bool {
+	select {
+	case old := <-c.records:
+		c.dequeued(old)
+		c.dropped()
+		if old.result != nil {
+			go func() { old.result <- ErrWouldBlock }()
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) reconnected() {
+	atomic.AddInt64(&c.reconnects, 1)
+	atomic.AddInt64(&c.totalReconnects, 1)
+}
+
+func (c *Client) recorded() {
+	atomic.AddInt64(&c.successfulRecords, 1)
+	atomic.AddInt64(&c.totalRecords, 1)
+}
+
+func (c *Client) dropped() {
+	atomic.AddInt64(&c.failedRecords, 1)
+	atomic.AddInt64(&c.totalDropped, 1)
+}
+
+// usesPolicy returns whether Record needs to apply an overflow policy
+// or bound the buffered bytes.
+func (c *Client) usesPolicy() bool {
+	return c.records != nil && (c.overflow != DropNewest || c.maxBufferedBytes > 0)
+}
+
+// recordWithPolicy queues a span to be sent by a client that bounds
+// its buffered bytes or has an overflow policy other than DropNewest.
+func recordWithPolicy(cl *Client, span *ssf.SSFSpan, done chan<- error) error {
+	op := &recordOp{span: span, result: done}
+	if cl.maxBufferedBytes > 0 {
+		op.size = int64(proto.Size(span))
+	}
+	if cl.tryEnqueue(op) {
+		cl.recorded()
+		return nil
+	}
+
+	switch cl.overflow {
+	case DropOldest:
+		for cl.dropOldest() {
+			if cl.tryEnqueue(op) {
+				cl.recorded()
+				return nil
+			}
+		}
+		// Nothing was waiting, so the last span was taken just
+		// now, and there may be room:
+		if cl.tryEnqueue(op) {
+			cl.recorded()
+			return nil
+		}
+	case Block:
+		var timeout <-chan time.Time
+		if cl.blockTimeout > 0 {
+			timer := time.NewTimer(cl.blockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		if cl.maxBufferedBytes == 0 {
+			// Only the channel bounds the spans, so wait for
+			// room in it directly:
+			select {
+			case cl.records <- op:
+				cl.recorded()
+				return nil
+			case <-timeout:
+			case <-cl.closed:
+			}
+			cl.dropped()
+			return ErrWouldBlock
+		}
+		for {
+			select {
+			case <-cl.room:
+			case <-timeout:
+				cl.dropped()
+				return ErrWouldBlock
+			case <-cl.closed:
+				cl.dropped()
+				return ErrWouldBlock
+			}
+			if cl.tryEnqueue(op) {
+				cl.recorded()
+				// Someone else may be waiting for room that's
+				// left over:
+				cl.signalRoom()
+				return nil
+			}
+		}
+	}
+	cl.dropped()
+	return ErrWouldBlock
+}
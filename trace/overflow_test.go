@@ -0,0 +1,249 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/ssf"
+)
+
+// gatedBackend announces each span it starts sending, and finishes
+// sending it once it's released.
+type gatedBackend struct {
+	started chan *ssf.SSFSpan
+	release chan struct{}
+}
+
+func newGatedBackend() *gatedBackend {
+	return &gatedBackend{started: make(chan *ssf.SSFSpan, 16), release: make(chan struct{}, 16)}
+}
+
+func (gb *gatedBackend) Close() error {
+	return nil
+}
+
+func (gb *gatedBackend) SendSync(ctx context.Context, span *ssf.SSFSpan) error {
+	gb.started <- span
+	select {
+	case <-gb.release:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func namedSpan(name string) *ssf.SSFSpan {
+	return &ssf.SSFSpan{Id: 1, TraceId: 1, Name: name, StartTimestamp: 1, EndTimestamp: 2}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	gb := newGatedBackend()
+	cl, err := NewBackendClient(gb, Capacity(1))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	require.NoError(t, Record(cl, namedSpan("a"), nil))
+	<-gb.started
+	require.NoError(t, Record(cl, namedSpan("b"), nil))
+	assert.Equal(t, ErrWouldBlock, Record(cl, namedSpan("c"), nil))
+
+	stats := cl.Stats()
+	assert.Equal(t, int64(2), stats.Recorded)
+	assert.Equal(t, int64(1), stats.Dropped)
+
+	gb.release <- struct{}{}
+	assert.Equal(t, "b", (<-gb.started).Name)
+	gb.release <- struct{}{}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	gb := newGatedBackend()
+	cl, err := NewBackendClient(gb, Capacity(1), Overflow(DropOldest, 0))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	require.NoError(t, Record(cl, namedSpan("a"), nil))
+	<-gb.started
+	dropped := make(chan error, 1)
+	require.NoError(t, Record(cl, namedSpan("b"), dropped))
+	require.NoError(t, Record(cl, namedSpan("c"), nil))
+	assert.Equal(t, ErrWouldBlock, <-dropped)
+
+	gb.release <- struct{}{}
+	assert.Equal(t, "c", (<-gb.started).Name)
+	gb.release <- struct{}{}
+
+	stats := cl.Stats()
+	assert.Equal(t, int64(3), stats.Recorded)
+	assert.Equal(t, int64(1), stats.Dropped)
+}
+
+func TestOverflowBlock(t *testing.T) {
+	gb := newGatedBackend()
+	cl, err := NewBackendClient(gb, Capacity(1), Overflow(Block, 100*time.Millisecond))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	require.NoError(t, Record(cl, namedSpan("a"), nil))
+	<-gb.started
+	require.NoError(t, Record(cl, namedSpan("b"), nil))
+
+	// Nothing is sent while Record blocks, so it times out:
+	start := time.Now()
+	assert.Equal(t, ErrWouldBlock, Record(cl, namedSpan("c"), nil))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "returned after %v", time.Since(start))
+
+	// Once there's room, the blocked Record takes it:
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		gb.release <- struct{}{}
+	}()
+	require.NoError(t, Record(cl, namedSpan("d"), nil))
+	assert.Equal(t, "b", (<-gb.started).Name)
+	gb.release <- struct{}{}
+	assert.Equal(t, "d", (<-gb.started).Name)
+	gb.release <- struct{}{}
+
+	stats := cl.Stats()
+	assert.Equal(t, int64(3), stats.Recorded)
+	assert.Equal(t, int64(1), stats.Dropped)
+}
+
+func TestOverflowBlockUntilClosed(t *testing.T) {
+	gb := newGatedBackend()
+	cl, err := NewBackendClient(gb, Capacity(1), Overflow(Block, 0))
+	require.NoError(t, err)
+
+	require.NoError(t, Record(cl, namedSpan("a"), nil))
+	<-gb.started
+	require.NoError(t, Record(cl, namedSpan("b"), nil))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cl.Close()
+	}()
+	assert.Equal(t, ErrWouldBlock, Record(cl, namedSpan("c"), nil))
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	span := namedSpan("a")
+	size := proto.Size(span)
+
+	gb := newGatedBackend()
+	cl, err := NewBackendClient(gb, Capacity(10), MaxBufferedBytes(uint(size+size/2)))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	require.NoError(t, Record(cl, namedSpan("a"), nil))
+	<-gb.started
+	assert.Equal(t, int64(0), cl.Stats().BufferedBytes)
+
+	// There's room in the channel, but not in the bytes:
+	require.NoError(t, Record(cl, namedSpan("b"), nil))
+	assert.Equal(t, int64(size), cl.Stats().BufferedBytes)
+	assert.Equal(t, ErrWouldBlock, Record(cl, namedSpan("c"), nil))
+
+	gb.release <- struct{}{}
+	assert.Equal(t, "b", (<-gb.started).Name)
+	assert.Equal(t, int64(0), cl.Stats().BufferedBytes)
+	gb.release <- struct{}{}
+
+	// A span bigger than the bound is taken if nothing's waiting:
+	big := namedSpan("big")
+	big.Tags = map[string]string{"payload": fmt.Sprintf("%0*d", 2*size, 0)}
+	require.NoError(t, Record(cl, big, nil))
+	assert.Equal(t, "big", (<-gb.started).Name)
+	gb.release <- struct{}{}
+}
+
+func TestFlushStats(t *testing.T) {
+	tb := &successTestBackend{t: t, block: make(chan chan struct{}, 1)}
+	cl, err := NewBackendClient(tb)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	done := make(chan struct{})
+	tb.block <- done
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(done)
+	}()
+	retries := mustFlush(t, cl)
+	retries += mustFlush(t, cl)
+
+	stats := cl.Stats()
+	assert.Equal(t, int64(2), stats.Flushes)
+	assert.Equal(t, int64(retries), stats.FailedFlushes)
+	assert.True(t, stats.MaxFlushLatency >= 20*time.Millisecond, "max latency %v", stats.MaxFlushLatency)
+	assert.True(t, stats.FlushLatency >= stats.MaxFlushLatency)
+
+	var nilClient *Client
+	assert.Equal(t, ClientStats{}, nilClient.Stats())
+}
+
+func TestBufferedWithPolicyFlushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sockName := filepath.Join(dir, "sock")
+	laddr, err := net.ResolveUnixAddr("unix", sockName)
+	require.NoError(t, err)
+
+	outPkg := make(chan *ssf.SSFSpan, 4)
+	cleanup := serveUNIX(t, laddr, func(in net.Conn) {
+		for {
+			pkg, err := protocol.ReadSSF(in)
+			if err == io.EOF {
+				return
+			}
+			assert.NoError(t, err)
+			outPkg <- pkg
+		}
+	})
+	defer cleanup()
+
+	client, err := NewClient((&url.URL{Scheme: "unix", Path: sockName}).String(),
+		Capacity(4),
+		ParallelBackends(1),
+		BufferedWithPolicy(BufferPolicy{
+			Overflow:         Block,
+			BlockTimeout:     time.Second,
+			MaxBufferedBytes: 1 << 20,
+			FlushInterval:    10 * time.Millisecond,
+		}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Without flushing, the spans are sent in the background:
+	sentCh := make(chan error)
+	for i := 0; i < 4; i++ {
+		tr := StartTrace(fmt.Sprintf("Testing-%d", i))
+		tr.Sent = sentCh
+		mustRecord(t, client, tr)
+	}
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, <-sentCh)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-outPkg:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the buffered spans weren't flushed")
+		}
+	}
+	assert.True(t, client.Stats().Flushes > 0)
+
+	_, err = NewBackendClient(&testBackend{t: t}, BufferedWithPolicy(BufferPolicy{}))
+	assert.Equal(t, ErrClientNotNetworked, err)
+}
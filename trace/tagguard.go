@@ -0,0 +1,154 @@
+package trace
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// OtherTagValue replaces the values of a tag key that go over the
+// limit set with TagValueCardinality.
+const OtherTagValue = "other"
+
+// tagGuard bounds the tags of the spans that a client records, and
+// counts what it had to change.
+type tagGuard struct {
+	maxValueLength int
+	maxTags        int
+
+	// Distinct values per tag key, since the window started:
+	maxValues   int
+	window      time.Duration
+	mtx         sync.Mutex
+	windowStart time.Time
+	seen        map[string]map[string]struct{}
+
+	truncated int64
+	capped    int64
+	dropped   int64
+}
+
+func (cl *Client) guard() *tagGuard {
+	if cl.tagGuard == nil {
+		cl.tagGuard = &tagGuard{}
+	}
+	return cl.tagGuard
+}
+
+// MaxTagValueLength truncates the tag values of the spans a client
+// records (and of the metrics on them) to n bytes. This parameter can
+// be used on both generic and networked backends.
+func MaxTagValueLength(n uint) ClientParam {
+	return func(cl *Client) error {
+		cl.guard().maxValueLength = int(n)
+		return nil
+	}
+}
+
+// MaxTagsPerSpan limits the spans a client records (and the metrics
+// on them) to n tags each. The tags whose keys sort last are dropped.
+// This parameter can be used on both generic and networked backends.
+func MaxTagsPerSpan(n uint) ClientParam {
+	return func(cl *Client) error {
+		cl.guard().maxTags = int(n)
+		return nil
+	}
+}
+
+// TagValueCardinality caps the number of distinct values that each
+// tag key can have, in the spans a client records (and in the metrics
+// on them), at maxValues per window: once a key had that many, its
+// other values are replaced with OtherTagValue until the next window
+// starts. A window of 0 never starts a new one. This guards sinks
+// against tags with unbounded values, like user IDs. This parameter
+// can be used on both generic and networked backends.
+func TagValueCardinality(maxValues uint, window time.Duration) ClientParam {
+	return func(cl *Client) error {
+		g := cl.guard()
+		g.maxValues = int(maxValues)
+		g.window = window
+		return nil
+	}
+}
+
+// apply bounds the tags of a span and its metrics.
+func (g *tagGuard) apply(span *ssf.SSFSpan) {
+	span.Tags = g.bound(span.Tags)
+	for _, sample := range span.Metrics {
+		sample.Tags = g.bound(sample.Tags)
+	}
+}
+
+// bound returns the tags, bounded. The map is only copied if anything
+// needs to change, as it may be shared with the Trace that the span was
+// made from.
+func (g *tagGuard) bound(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return tags
+	}
+	bounded := tags
+	copied := false
+	set := func(k, v string) {
+		if !copied {
+			bounded = make(map[string]string, len(tags))
+			for k, v := range tags {
+				bounded[k] = v
+			}
+			copied = true
+		}
+		bounded[k] = v
+	}
+
+	if g.maxValueLength > 0 {
+		for k, v := range tags {
+			if len(v) > g.maxValueLength {
+				set(k, v[:g.maxValueLength])
+				atomic.AddInt64(&g.truncated, 1)
+			}
+		}
+	}
+
+	if g.maxValues > 0 {
+		g.mtx.Lock()
+		now := time.Now()
+		if g.seen == nil || (g.window > 0 && now.Sub(g.windowStart) >= g.window) {
+			g.seen = map[string]map[string]struct{}{}
+			g.windowStart = now
+		}
+		for k, v := range bounded {
+			values, ok := g.seen[k]
+			if !ok {
+				values = map[string]struct{}{}
+				g.seen[k] = values
+			}
+			if _, ok := values[v]; ok {
+				continue
+			}
+			if len(values) < g.maxValues {
+				values[v] = struct{}{}
+				continue
+			}
+			set(k, OtherTagValue)
+			atomic.AddInt64(&g.capped, 1)
+		}
+		g.mtx.Unlock()
+	}
+
+	if g.maxTags > 0 && len(bounded) > g.maxTags {
+		keys := make([]string, 0, len(bounded))
+		for k := range bounded {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kept := make(map[string]string, g.maxTags)
+		for _, k := range keys[:g.maxTags] {
+			kept[k] = bounded[k]
+		}
+		atomic.AddInt64(&g.dropped, int64(len(bounded)-g.maxTags))
+		bounded = kept
+	}
+	return bounded
+}
@@ -0,0 +1,92 @@
+package trace
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+func recordTags(t *testing.T, cl *Client, spans chan *ssf.SSFSpan, tags map[string]string) map[string]string {
+	require.NoError(t, Record(cl, &ssf.SSFSpan{Id: 1, TraceId: 1, Tags: tags}, nil))
+	return (<-spans).Tags
+}
+
+func TestTagValueCardinality(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 1)
+	cl, err := NewChannelClient(spans, TagValueCardinality(2, time.Hour))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	for _, user := range []struct{ id, want string }{
+		{"1", "1"},
+		{"2", "2"},
+		{"3", OtherTagValue},
+		{"1", "1"},
+		{"4", OtherTagValue},
+	} {
+		tags := recordTags(t, cl, spans, map[string]string{"user": user.id, "service": "checkout"})
+		assert.Equal(t, user.want, tags["user"], "user %s", user.id)
+		assert.Equal(t, "checkout", tags["service"])
+	}
+	assert.Equal(t, int64(2), cl.Stats().TagValuesCapped)
+
+	// The Trace that the span was made from keeps its tags:
+	tr := StartTrace("checkout")
+	tr.Tags["user"] = "99"
+	tr.Sent = make(chan error, 1)
+	require.NoError(t, tr.ClientRecord(cl, "", nil))
+	assert.Equal(t, OtherTagValue, (<-spans).Tags["user"])
+	assert.Equal(t, "99", tr.Tags["user"])
+}
+
+func TestTagValueCardinalityWindow(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 1)
+	cl, err := NewChannelClient(spans, TagValueCardinality(1, 10*time.Millisecond))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	assert.Equal(t, "a", recordTags(t, cl, spans, map[string]string{"user": "a"})["user"])
+	assert.Equal(t, OtherTagValue, recordTags(t, cl, spans, map[string]string{"user": "b"})["user"])
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "b", recordTags(t, cl, spans, map[string]string{"user": "b"})["user"])
+}
+
+func TestMaxTagsAndValueLength(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 1)
+	cl, err := NewChannelClient(spans, MaxTagsPerSpan(2), MaxTagValueLength(4))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	span := &ssf.SSFSpan{
+		Id: 1, TraceId: 1,
+		Tags:    map[string]string{"c": "3", "a": "1", "b": "a long value"},
+		Metrics: []*ssf.SSFSample{ssf.Count("hits", 1, map[string]string{"path": "/users/1234567"})},
+	}
+	require.NoError(t, Record(cl, span, nil))
+	got := <-spans
+	assert.Equal(t, map[string]string{"a": "1", "b": "a lo"}, got.Tags)
+	assert.Equal(t, map[string]string{"path": "/use"}, got.Metrics[0].Tags)
+
+	stats := cl.Stats()
+	assert.Equal(t, int64(2), stats.TagValuesTruncated)
+	assert.Equal(t, int64(1), stats.TagsDropped)
+	assert.Equal(t, int64(0), stats.TagValuesCapped)
+}
+
+func TestTagGuardsOffByDefault(t *testing.T) {
+	spans := make(chan *ssf.SSFSpan, 1)
+	cl, err := NewChannelClient(spans)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	tags := map[string]string{}
+	for i := 0; i < 100; i++ {
+		tags[fmt.Sprint("tag", i)] = fmt.Sprintf("%0200d", i)
+	}
+	assert.Equal(t, tags, recordTags(t, cl, spans, tags))
+	assert.Equal(t, ClientStats{Recorded: 1}, cl.Stats())
+}
@@ -60,6 +60,10 @@ type Trace struct {
 	// which is also the ID for the trace itself
 	TraceID int64
 
+	// The high 64 bits of a 128-bit trace ID, whose low
+	// 64 bits are the TraceID. Zero for 64-bit trace IDs.
+	TraceIDHigh int64
+
 	// For the root span, this will be equal
 	// to the TraceId
 	SpanID int64
@@ -92,11 +96,31 @@ type Trace struct {
 	// alongside a span.
 	Samples []*ssf.SSFSample
 
+	// Links holds the spans, usually of other traces, that this
+	// span is related to without being their child. See AddLink.
+	Links []*ssf.SSFSpanLink
+
+	// Events holds what happened during the span, in the order it
+	// happened. See Event.
+	Events []*ssf.SSFSpanEvent
+
 	// An indicator span is one that represents an action that is included in a
 	// service's Service Level Indicators (https://en.wikipedia.org/wiki/Service_level_indicator)
 	// For more information, see the SSF definition at https://github.com/stripe/veneur/tree/master/ssf
 	Indicator bool
 
+	// SamplingPriority says whether span sinks should keep or drop
+	// the trace regardless of their sample rates. Children inherit
+	// it, in this process and (through the trace headers) in
+	// downstream services. See KeepTrace and DropTrace.
+	SamplingPriority ssf.SSFSpan_SamplingPriority
+
+	// TraceState is the W3C tracestate header that came with the
+	// traceparent header the trace was extracted from, if any.
+	// Children inherit it, and it's propagated along with the
+	// traceparent header, unchanged.
+	TraceState string
+
 	error bool
 }
 
@@ -150,17 +174,21 @@ func (t *Trace) SSFSpan() *ssf.SSFSpan {
 	name := t.Name
 
 	span := &ssf.SSFSpan{
-		StartTimestamp: t.Start.UnixNano(),
-		Error:          t.error,
-		TraceId:        t.TraceID,
-		Id:             t.SpanID,
-		ParentId:       t.ParentID,
-		EndTimestamp:   t.End.UnixNano(),
-		Name:           name,
-		Tags:           t.Tags,
-		Service:        Service,
-		Metrics:        t.Samples,
-		Indicator:      t.Indicator,
+		StartTimestamp:   t.Start.UnixNano(),
+		Error:            t.error,
+		TraceId:          t.TraceID,
+		TraceIdHigh:      t.TraceIDHigh,
+		Id:               t.SpanID,
+		ParentId:         t.ParentID,
+		EndTimestamp:     t.End.UnixNano(),
+		Name:             name,
+		Tags:             t.Tags,
+		Service:          Service,
+		Metrics:          t.Samples,
+		Indicator:        t.Indicator,
+		Links:            t.Links,
+		Events:           t.Events,
+		SamplingPriority: t.SamplingPriority,
 	}
 
 	return span
@@ -171,6 +199,42 @@ func (t *Trace) Add(samples ...*ssf.SSFSample) {
 	t.Samples = append(t.Samples, samples...)
 }
 
+// Event records that something happened during the Trace, now, like
+// a cache miss or the start of a retry. The tags describe the event,
+// and may be nil.
+func (t *Trace) Event(name string, tags map[string]string) {
+	t.Events = append(t.Events, &ssf.SSFSpanEvent{
+		Timestamp: time.Now().UnixNano(),
+		Name:      name,
+		Tags:      tags,
+	})
+}
+
+// KeepTrace asks every span sink to keep the Trace's trace, even if
+// they'd otherwise sample it away. It applies to the spans started as
+// its children after it's called.
+func (t *Trace) KeepTrace() {
+	t.SamplingPriority = ssf.SSFSpan_USER_KEEP
+}
+
+// DropTrace asks every span sink to drop the Trace's trace. It applies
+// to the spans started as its children after it's called.
+func (t *Trace) DropTrace() {
+	t.SamplingPriority = ssf.SSFSpan_USER_DROP
+}
+
+// AddLink links a Trace to another span, by its trace and span IDs.
+// Links record spans that the Trace is related to without being their
+// child, like the spans that produced each message of a batch that it
+// processes. The tags describe the relationship, and may be nil.
+func (t *Trace) AddLink(traceID, spanID int64, tags map[string]string) {
+	t.Links = append(t.Links, &ssf.SSFSpanLink{
+		TraceId: traceID,
+		SpanId:  spanID,
+		Tags:    tags,
+	})
+}
+
 // ProtoMarshalTo writes the Trace as a protocol buffer
 // in text format to the specified writer.
 func (t *Trace) ProtoMarshalTo(w io.Writer) error {
@@ -269,12 +333,16 @@ func StartSpanFromContext(ctx context.Context, name string, opts ...opentracing.
 	return s, c
 }
 
-// SetParent updates the ParentId, TraceId, and Resource of a trace
-// based on the parent's values (SpanId, TraceId, Resource).
+// SetParent updates the ParentId, TraceId, Resource,
+// SamplingPriority and TraceState of a trace based on the parent's
+// values (SpanId, TraceId, Resource, SamplingPriority, TraceState).
 func (t *Trace) SetParent(parent *Trace) {
 	t.ParentID = parent.SpanID
 	t.TraceID = parent.TraceID
+	t.TraceIDHigh = parent.TraceIDHigh
 	t.Resource = parent.Resource
+	t.SamplingPriority = parent.SamplingPriority
+	t.TraceState = parent.TraceState
 }
 
 // context returns a spanContext representing the trace
@@ -285,6 +353,7 @@ func (t *Trace) context() *spanContext {
 	c := &spanContext{}
 	c.Init()
 	c.baggageItems["traceid"] = strconv.FormatInt(t.TraceID, 10)
+	t.setOptionalBaggage(c)
 	c.baggageItems["parentid"] = strconv.FormatInt(t.ParentID, 10)
 	c.baggageItems["spanid"] = strconv.FormatInt(t.SpanID, 10)
 	c.baggageItems[ResourceKey] = t.Resource
@@ -299,11 +368,28 @@ func (t *Trace) contextAsParent() *spanContext {
 	c := &spanContext{}
 	c.Init()
 	c.baggageItems["traceid"] = strconv.FormatInt(t.TraceID, 10)
+	t.setOptionalBaggage(c)
 	c.baggageItems["parentid"] = strconv.FormatInt(t.SpanID, 10)
 	c.baggageItems[ResourceKey] = t.Resource
 	return c
 }
 
+// setOptionalBaggage propagates the high bits of 128-bit trace IDs,
+// the sampling priority, and the W3C tracestate, in the spanContext.
+// Contexts with 64-bit trace IDs, with the AUTO priority, or without a
+// tracestate, don't get them.
+func (t *Trace) setOptionalBaggage(c *spanContext) {
+	if t.TraceIDHigh != 0 {
+		c.baggageItems["traceidhigh"] = strconv.FormatInt(t.TraceIDHigh, 10)
+	}
+	if t.SamplingPriority != ssf.SSFSpan_AUTO {
+		c.baggageItems[samplingPriorityKey] = strconv.Itoa(int(t.SamplingPriority))
+	}
+	if t.TraceState != "" {
+		c.baggageItems[tracestateHeader] = t.TraceState
+	}
+}
+
 // StartTrace is called by to create the root-level span
 // for a trace
 func StartTrace(resource string) *Trace {
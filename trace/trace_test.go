@@ -211,6 +211,60 @@ func TestTraceContextAsParent(t *testing.T) {
 	assert.Equal(t, trace.Resource, ctx.Resource())
 }
 
+func TestAddLink(t *testing.T) {
+	consumer := StartTrace("consume")
+	for i := int64(1); i <= 2; i++ {
+		producer := StartTrace("produce")
+		consumer.AddLink(producer.TraceID, producer.SpanID, map[string]string{"message": fmt.Sprint(i)})
+	}
+	consumer.finish()
+
+	packet, err := proto.Marshal(consumer.SSFSpan())
+	require.NoError(t, err)
+	span := &ssf.SSFSpan{}
+	require.NoError(t, proto.Unmarshal(packet, span))
+	require.Len(t, span.Links, 2)
+	assert.Equal(t, consumer.Links[0].TraceId, span.Links[0].TraceId)
+	assert.Equal(t, consumer.Links[0].SpanId, span.Links[0].SpanId)
+	assert.Equal(t, map[string]string{"message": "2"}, span.Links[1].Tags)
+}
+
+func TestKeepDropTrace(t *testing.T) {
+	root := StartTrace("request")
+	assert.Equal(t, ssf.SSFSpan_AUTO, root.SSFSpan().SamplingPriority)
+
+	root.KeepTrace()
+	child := StartChildSpan(root)
+	assert.Equal(t, ssf.SSFSpan_USER_KEEP, root.SSFSpan().SamplingPriority)
+	assert.Equal(t, ssf.SSFSpan_USER_KEEP, child.SSFSpan().SamplingPriority)
+
+	child.DropTrace()
+	assert.Equal(t, ssf.SSFSpan_USER_DROP, StartChildSpan(child).SSFSpan().SamplingPriority)
+	assert.Equal(t, ssf.SSFSpan_USER_KEEP, root.SSFSpan().SamplingPriority,
+		"children shouldn't change their parents' priority")
+}
+
+func TestEvent(t *testing.T) {
+	tr := StartTrace("fetch")
+	tr.Event("cache miss", map[string]string{"key": "user:1"})
+	tr.Event("retry", nil)
+	tr.finish()
+
+	span := tr.SSFSpan()
+	require.Len(t, span.Events, 2)
+	assert.Equal(t, "cache miss", span.Events[0].Name)
+	assert.Equal(t, map[string]string{"key": "user:1"}, span.Events[0].Tags)
+	assert.Equal(t, "retry", span.Events[1].Name)
+	assert.True(t, span.Events[0].Timestamp >= tr.Start.UnixNano())
+	assert.True(t, span.Events[1].Timestamp <= span.EndTimestamp)
+
+	packet, err := proto.Marshal(span)
+	require.NoError(t, err)
+	parsed := &ssf.SSFSpan{}
+	require.NoError(t, proto.Unmarshal(packet, parsed))
+	assert.Equal(t, span.Events, parsed.Events)
+}
+
 type localError struct {
 	message string
 }
@@ -0,0 +1,106 @@
+package trace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// The W3C Trace Context headers
+// (https://www.w3.org/TR/trace-context/).
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+// PropagateTraceparent sets whether Inject, InjectRequest and
+// InjectHeader add a W3C traceparent header (and any tracestate that
+// was extracted along with one) to veneur's own trace headers, so that
+// services instrumented with W3C Trace Context continue the trace. It
+// should only be set before any traces are generated.
+var PropagateTraceparent = true
+
+// Traceparent is the trace context in a W3C traceparent header. Like
+// in SSF spans, the 128-bit trace ID is split into the high and low 64
+// bits, whose unsigned bits are kept as they are.
+type Traceparent struct {
+	TraceIDHigh int64
+	TraceID     int64
+	// ParentID is the ID of the span that sent the header.
+	ParentID int64
+	// Sampled is the sampled flag, which says whether the sender
+	// may have recorded the trace.
+	Sampled bool
+}
+
+// ParseTraceparent parses a W3C traceparent header, like
+// 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01. Headers of
+// versions after 00 are parsed as far as version 00 goes.
+func ParseTraceparent(header string) (Traceparent, error) {
+	var tp Traceparent
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tp, fmt.Errorf("invalid traceparent %q", header)
+	}
+	for _, part := range parts[:4] {
+		if strings.ToLower(part) != part {
+			return tp, fmt.Errorf("traceparent %q isn't in lowercase", header)
+		}
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return tp, fmt.Errorf("unsupported traceparent version in %q", header)
+	}
+	high, err := strconv.ParseUint(parts[1][:16], 16, 64)
+	if err != nil {
+		return tp, fmt.Errorf("invalid trace ID in traceparent %q", header)
+	}
+	low, err := strconv.ParseUint(parts[1][16:], 16, 64)
+	if err != nil {
+		return tp, fmt.Errorf("invalid trace ID in traceparent %q", header)
+	}
+	parent, err := strconv.ParseUint(parts[2], 16, 64)
+	if err != nil {
+		return tp, fmt.Errorf("invalid parent ID in traceparent %q", header)
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return tp, fmt.Errorf("invalid flags in traceparent %q", header)
+	}
+	if (high == 0 && low == 0) || parent == 0 {
+		return tp, fmt.Errorf("traceparent %q has no trace or parent ID", header)
+	}
+	tp.TraceIDHigh, tp.TraceID, tp.ParentID = int64(high), int64(low), int64(parent)
+	tp.Sampled = flags&1 == 1
+	return tp, nil
+}
+
+// String returns the version 00 traceparent header of the trace
+// context.
+func (tp Traceparent) String() string {
+	flags := 0
+	if tp.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%016x-%02x",
+		ssf.TraceIDHex(&ssf.SSFSpan{TraceIdHigh: tp.TraceIDHigh, TraceId: tp.TraceID}),
+		uint64(tp.ParentID), flags)
+}
+
+// traceparent returns the traceparent header that a span context is
+// propagated with, or "" if it has no trace or span ID. Traces that
+// are dropped by their sampling priority aren't sampled; all others
+// are, as veneur's span sinks decide on sampling themselves.
+func (c *spanContext) traceparent() string {
+	tp := Traceparent{
+		TraceIDHigh: c.TraceIDHigh(),
+		TraceID:     c.TraceID(),
+		ParentID:    c.SpanID(),
+		Sampled:     c.SamplingPriority() != ssf.SSFSpan_USER_DROP,
+	}
+	if (tp.TraceID == 0 && tp.TraceIDHigh == 0) || tp.ParentID == 0 {
+		return ""
+	}
+	return tp.String()
+}
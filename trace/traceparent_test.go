@@ -0,0 +1,162 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/ssf"
+)
+
+// The examples of the W3C Trace Context specification.
+const (
+	specTraceparent          = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	specTraceparentUnsampled = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"
+	specTraceparent2         = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	specTracestate           = "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tp, err := ParseTraceparent(specTraceparent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0x0af7651916cd43dd), tp.TraceIDHigh)
+	assert.Equal(t, int64(-0x7bb714dee37fce64), tp.TraceID)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", ssf.TraceIDHex(&ssf.SSFSpan{TraceIdHigh: tp.TraceIDHigh, TraceId: tp.TraceID}))
+	assert.Equal(t, "b7ad6b7169203331", fmt.Sprintf("%016x", uint64(tp.ParentID)))
+	assert.True(t, tp.Sampled)
+
+	tp, err = ParseTraceparent(specTraceparentUnsampled)
+	require.NoError(t, err)
+	assert.False(t, tp.Sampled)
+
+	// Later versions may have more fields:
+	_, err = ParseTraceparent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-what")
+	assert.NoError(t, err)
+
+	for _, bad := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-what",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01",
+		"00-zaf7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333z-01",
+		"00-0AF7651916CD43DD8448EB211C80319C-B7AD6B7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-0x",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+	} {
+		_, err := ParseTraceparent(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, header := range []string{specTraceparent, specTraceparentUnsampled, specTraceparent2} {
+		tp, err := ParseTraceparent(header)
+		require.NoError(t, err)
+		assert.Equal(t, header, tp.String())
+	}
+}
+
+func TestExtractTraceparent(t *testing.T) {
+	header := http.Header{}
+	header.Set(traceparentHeader, specTraceparent2)
+	header.Set(tracestateHeader, specTracestate)
+	req := &http.Request{Header: header}
+
+	span, err := GlobalTracer.ExtractRequestChild("/checkout", req, "checkout")
+	require.NoError(t, err)
+	parent, err := ParseTraceparent(specTraceparent2)
+	require.NoError(t, err)
+	assert.Equal(t, parent.TraceIDHigh, span.TraceIDHigh)
+	assert.Equal(t, parent.TraceID, span.TraceID)
+	assert.Equal(t, parent.ParentID, span.ParentID)
+	assert.Equal(t, specTracestate, span.TraceState)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", ssf.TraceIDHex(span.SSFSpan()))
+
+	// Downstream, the child is the parent, in the same trace, and
+	// the tracestate is passed on:
+	child := StartChildSpan(span.Trace)
+	out := http.Header{}
+	require.NoError(t, GlobalTracer.InjectHeader(child, out))
+	tp, err := ParseTraceparent(out.Get(traceparentHeader))
+	require.NoError(t, err)
+	assert.Equal(t, parent.TraceIDHigh, tp.TraceIDHigh)
+	assert.Equal(t, parent.TraceID, tp.TraceID)
+	assert.Equal(t, child.SpanID, tp.ParentID)
+	assert.True(t, tp.Sampled)
+	assert.Equal(t, specTracestate, out.Get(tracestateHeader))
+}
+
+func TestExtractPrefersVeneurHeaders(t *testing.T) {
+	trace := StartTrace("upstream")
+	header := http.Header{}
+	require.NoError(t, GlobalTracer.InjectHeader(trace, header))
+	// A traceparent of another trace, like that of a proxy that
+	// doesn't know veneur's headers:
+	header.Set(traceparentHeader, specTraceparent2)
+	header.Set(tracestateHeader, specTracestate)
+
+	span, err := GlobalTracer.ExtractRequestChild("/checkout", &http.Request{Header: header}, "checkout")
+	require.NoError(t, err)
+	assert.Equal(t, trace.TraceID, span.TraceID)
+	assert.Equal(t, int64(0), span.TraceIDHigh)
+	assert.Equal(t, trace.SpanID, span.ParentID)
+	assert.Empty(t, span.TraceState, "the tracestate of another trace is dropped")
+}
+
+func TestInjectTraceparent(t *testing.T) {
+	trace := StartTrace("upstream")
+	trace.TraceIDHigh = 0x0af7651916cd43dd
+	header := http.Header{}
+	require.NoError(t, GlobalTracer.InjectHeader(trace, header))
+
+	// Both veneur's headers and the traceparent are there:
+	assert.NotEmpty(t, header.Get("Traceid"))
+	assert.NotEmpty(t, header.Get("Spanid"))
+	tp, err := ParseTraceparent(header.Get(traceparentHeader))
+	require.NoError(t, err)
+	assert.Equal(t, trace.TraceIDHigh, tp.TraceIDHigh)
+	assert.Equal(t, trace.TraceID, tp.TraceID)
+	assert.Equal(t, trace.SpanID, tp.ParentID)
+	assert.Empty(t, header.Get(tracestateHeader))
+
+	// Dropped traces aren't sampled:
+	trace.DropTrace()
+	header = http.Header{}
+	require.NoError(t, GlobalTracer.InjectHeader(trace, header))
+	tp, err = ParseTraceparent(header.Get(traceparentHeader))
+	require.NoError(t, err)
+	assert.False(t, tp.Sampled)
+
+	// Only veneur's headers are sent if the traceparent is turned
+	// off:
+	defer func() { PropagateTraceparent = true }()
+	PropagateTraceparent = false
+	trace.TraceState = specTracestate
+	header = http.Header{}
+	require.NoError(t, GlobalTracer.InjectHeader(trace, header))
+	assert.NotEmpty(t, header.Get("Traceid"))
+	assert.Empty(t, header.Get(traceparentHeader))
+	assert.Empty(t, header.Get(tracestateHeader))
+}
+
+func TestExtractTraceparentTextMap(t *testing.T) {
+	carrier := opentracing.TextMapCarrier{traceparentHeader: specTraceparent}
+	ctx, err := GlobalTracer.Extract(opentracing.TextMap, carrier)
+	require.NoError(t, err)
+	sc := ctx.(*spanContext)
+	tp, err := ParseTraceparent(specTraceparent)
+	require.NoError(t, err)
+	assert.Equal(t, tp.TraceIDHigh, sc.TraceIDHigh())
+	assert.Equal(t, tp.TraceID, sc.TraceID())
+	assert.Equal(t, tp.ParentID, sc.SpanID())
+
+	_, err = GlobalTracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier{traceparentHeader: "00-nope"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/stripe/veneur/internal/build"
+)
+
+// versionInfo describes the running veneur, for /version.
+type versionInfo struct {
+	Version     string    `json:"version"`
+	Commit      string    `json:"commit"`
+	BuildDate   string    `json:"build_date"`
+	GoVersion   string    `json:"go_version"`
+	MetricSinks []string  `json:"metric_sinks"`
+	SpanSinks   []string  `json:"span_sinks"`
+	Interval    string    `json:"interval"`
+	StartTime   time.Time `json:"start_time"`
+}
+
+// handleVersion describes the build of veneur that's running, and how
+// it's configured to flush, as JSON.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	info := versionInfo{
+		Version:     build.Version,
+		Commit:      build.Commit,
+		BuildDate:   build.Date,
+		GoVersion:   build.GoVersion(),
+		MetricSinks: make([]string, 0, len(s.metricSinks)),
+		SpanSinks:   make([]string, 0, len(s.spanSinks)),
+		Interval:    s.interval.String(),
+		StartTime:   build.Started,
+	}
+	for _, sink := range s.metricSinks {
+		info.MetricSinks = append(info.MetricSinks, sink.Name())
+	}
+	for _, sink := range s.spanSinks {
+		info.SpanSinks = append(info.SpanSinks, sink.Name())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -1,6 +1,7 @@
 package veneur
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -39,6 +40,41 @@ type Worker struct {
 	logger           *logrus.Logger
 	wm               WorkerMetrics
 	stats            *statsd.Client
+
+	// drainChan asks the worker to process everything queued, and to
+	// close the channel it's sent once it has
+	drainChan chan chan struct{}
+
+	// nameFilter, if set, drops metrics by name before they're
+	// aggregated; filtered counts them by the pattern that matched
+	nameFilter *nameFilterValue
+	filtered   map[int]int64
+
+	// cardinality, if set, limits the unique contexts in each
+	// interval; overflowed counts the metrics that went over it
+	cardinality *cardinalityLimiter
+	overflowed  int64
+
+	// gaugeAggregations are the aggregations of the gauges with these
+	// names, for those that don't set theirs with a tag
+	gaugeAggregations map[string]samplers.GaugeAggregation
+
+	// setPrecisions, if set, are the precisions of new sets' sketches
+	setPrecisions *setPrecisions
+
+	// cumulative keeps the last values of cumulative counters, across
+	// intervals
+	cumulative *cumulativeCounters
+
+	// heavyHittersCapacity, if positive, is how many metric names are
+	// tracked in each interval's heavy hitters, from one in
+	// heavyHittersSampling samples
+	heavyHittersCapacity int
+	heavyHittersSampling int
+
+	// exemplars, if positive, is how many exemplars each histogram and
+	// timer keeps per interval, from the samples with trace IDs
+	exemplars int
 }
 
 // IngestUDP on a Worker feeds the metric into the worker's PacketChan.
@@ -71,6 +107,14 @@ type WorkerMetrics struct {
 	localSets         map[samplers.MetricKey]*samplers.Set
 	localTimers       map[samplers.MetricKey]*samplers.Histo
 	localStatusChecks map[samplers.MetricKey]*samplers.StatusCheck
+
+	// counters and gauges that were sent with a timestamp, which are
+	// flushed as-is instead of being aggregated
+	timestamped []samplers.InterMetric
+
+	// the metric names with the most samples and bytes, if they're
+	// being tracked
+	heavyHitters *metricHeavyHitters
 }
 
 // NewWorkerMetrics initializes a WorkerMetrics struct
@@ -156,6 +200,47 @@ func (wm WorkerMetrics) Upsert(mk samplers.MetricKey, Scope samplers.MetricScope
 	return !present
 }
 
+// contains reports whether the WorkerMetrics has an entry for the given
+// metrickey, in the same place Upsert would put it.
+func (wm WorkerMetrics) contains(mk samplers.MetricKey, Scope samplers.MetricScope) bool {
+	present := false
+	switch mk.Type {
+	case counterTypeName:
+		if Scope == samplers.GlobalOnly {
+			_, present = wm.globalCounters[mk]
+		} else {
+			_, present = wm.counters[mk]
+		}
+	case gaugeTypeName:
+		if Scope == samplers.GlobalOnly {
+			_, present = wm.globalGauges[mk]
+		} else {
+			_, present = wm.gauges[mk]
+		}
+	case histogramTypeName:
+		if Scope == samplers.LocalOnly {
+			_, present = wm.localHistograms[mk]
+		} else {
+			_, present = wm.histograms[mk]
+		}
+	case setTypeName:
+		if Scope == samplers.LocalOnly {
+			_, present = wm.localSets[mk]
+		} else {
+			_, present = wm.sets[mk]
+		}
+	case timerTypeName:
+		if Scope == samplers.LocalOnly {
+			_, present = wm.localTimers[mk]
+		} else {
+			_, present = wm.timers[mk]
+		}
+	case statusTypeName:
+		_, present = wm.localStatusChecks[mk]
+	}
+	return present
+}
+
 // ForwardableMetrics converts all metrics that should be forwarded to
 // metricpb.Metric (protobuf-compatible).
 func (wm WorkerMetrics) ForwardableMetrics(cl *trace.Client) []*metricpb.Metric {
@@ -219,6 +304,7 @@ func NewWorker(id int, cl *trace.Client, logger *logrus.Logger, stats *statsd.Cl
 		ImportChan:       make(chan []samplers.JSONMetric, 32),
 		ImportMetricChan: make(chan []*metricpb.Metric, 32),
 		QuitChan:         make(chan struct{}),
+		drainChan:        make(chan chan struct{}),
 		processed:        0,
 		imported:         0,
 		mutex:            &sync.Mutex{},
@@ -226,6 +312,8 @@ func NewWorker(id int, cl *trace.Client, logger *logrus.Logger, stats *statsd.Cl
 		logger:           logger,
 		wm:               NewWorkerMetrics(),
 		stats:            stats,
+		filtered:         map[int]int64{},
+		cumulative:       newCumulativeCounters(nil, 0),
 	}
 }
 
@@ -244,14 +332,55 @@ func (w *Worker) Work() {
 			for _, m := range ms {
 				w.ImportMetricGRPC(m)
 			}
+		case done := <-w.drainChan:
+			w.processQueued()
+			close(done)
 		case <-w.QuitChan:
 			// We have been asked to stop.
-			log.WithField("worker", w.id).Error("Stopping")
+			log.WithField("worker", w.id).Info("Stopping")
+			return
+		}
+	}
+}
+
+// processQueued processes the metrics queued for the worker, until its
+// queues are empty.
+func (w *Worker) processQueued() {
+	for {
+		select {
+		case m := <-w.PacketChan:
+			w.ProcessMetric(&m)
+		case m := <-w.ImportChan:
+			for _, j := range m {
+				w.ImportMetric(j)
+			}
+		case ms := <-w.ImportMetricChan:
+			for _, m := range ms {
+				w.ImportMetricGRPC(m)
+			}
+		default:
 			return
 		}
 	}
 }
 
+// drain returns once the worker has processed all the metrics that were
+// queued for it when it was called, or once ctx is done.
+func (w *Worker) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case w.drainChan <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // MetricsProcessedCount is a convenince method for testing
 // that allows us to fetch the Worker's processed count
 // in a non-racey way.
@@ -265,10 +394,37 @@ func (w *Worker) MetricsProcessedCount() int64 {
 //
 // This is standalone to facilitate testing
 func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
+	if f := w.nameFilter.load(); f != nil {
+		if pattern, ok := f.filtered(m.Name); ok {
+			w.mutex.Lock()
+			w.processed++
+			w.filtered[pattern]++
+			w.mutex.Unlock()
+			return
+		}
+	}
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 	w.processed++
-	w.wm.Upsert(m.MetricKey, m.Scope, m.Tags)
+	if w.heavyHittersCapacity > 0 {
+		if w.wm.heavyHitters == nil {
+			w.wm.heavyHitters = newMetricHeavyHitters(w.heavyHittersCapacity, w.heavyHittersSampling)
+		}
+		w.wm.heavyHitters.add(m.Name, m.Size)
+	}
+	if m.Timestamp != 0 && (m.Type == counterTypeName || m.Type == gaugeTypeName) {
+		w.wm.timestamped = append(w.wm.timestamped, samplers.TimestampedInterMetric(m))
+		return
+	}
+	if w.cumulative.cumulative(m) && !w.cumulative.increment(m) {
+		return
+	}
+	if w.cardinality != nil && !w.admitMetric(m) {
+		return
+	}
+	if w.upsert(m.MetricKey, m.Scope, m.Tags) && w.cardinality != nil {
+		w.cardinality.created(m.Name)
+	}
 
 	switch m.Type {
 	case counterTypeName:
@@ -285,9 +441,9 @@ func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
 		}
 	case histogramTypeName:
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localHistograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			w.sampleHisto(w.wm.localHistograms[m.MetricKey], m)
 		} else {
-			w.wm.histograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			w.sampleHisto(w.wm.histograms[m.MetricKey], m)
 		}
 	case setTypeName:
 		if m.Scope == samplers.LocalOnly {
@@ -297,9 +453,9 @@ func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
 		}
 	case timerTypeName:
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localTimers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			w.sampleHisto(w.wm.localTimers[m.MetricKey], m)
 		} else {
-			w.wm.timers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			w.sampleHisto(w.wm.timers[m.MetricKey], m)
 		}
 	case statusTypeName:
 		v := float64(m.Value.(ssf.SSFSample_Status))
@@ -309,6 +465,52 @@ func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
 	}
 }
 
+// sampleHisto adds the metric's value to the histogram or timer, and
+// offers it as an exemplar if it has a trace ID and exemplars are
+// enabled. The caller must hold the worker's mutex.
+func (w *Worker) sampleHisto(h *samplers.Histo, m *samplers.UDPMetric) {
+	h.Sample(m.Value.(float64), m.SampleRate)
+	if w.exemplars > 0 && m.TraceID != 0 {
+		h.EnableExemplars(w.exemplars)
+		h.AddExemplar(samplers.Exemplar{
+			TraceID:   m.TraceID,
+			Value:     m.Value.(float64),
+			Timestamp: time.Now().UnixNano(),
+		})
+	}
+}
+
+// upsert is like WorkerMetrics.Upsert, but creates gauges with the
+// aggregation, and sets with the precision, configured for their name.
+// The caller must hold the worker's mutex.
+func (w *Worker) upsert(mk samplers.MetricKey, scope samplers.MetricScope, tags []string) bool {
+	if mk.Type == setTypeName && w.setPrecisions != nil {
+		sets := w.wm.sets
+		if scope == samplers.LocalOnly {
+			sets = w.wm.localSets
+		}
+		if _, present := sets[mk]; present {
+			return false
+		}
+		sets[mk] = samplers.NewSetWithPrecision(mk.Name, tags, w.setPrecisions.precision(mk.Name))
+		return true
+	}
+	if mk.Type == gaugeTypeName {
+		if agg, ok := w.gaugeAggregations[mk.Name]; ok {
+			gauges := w.wm.gauges
+			if scope == samplers.GlobalOnly {
+				gauges = w.wm.globalGauges
+			}
+			if _, present := gauges[mk]; present {
+				return false
+			}
+			gauges[mk] = samplers.NewAggregatedGauge(mk.Name, tags, agg)
+			return true
+		}
+	}
+	return w.wm.Upsert(mk, scope, tags)
+}
+
 // ImportMetric receives a metric from another veneur instance
 func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 	w.mutex.Lock()
@@ -319,9 +521,9 @@ func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 	w.imported++
 	if other.Type == counterTypeName || other.Type == gaugeTypeName {
 		// this is an odd special case -- counters that are imported are global
-		w.wm.Upsert(other.MetricKey, samplers.GlobalOnly, other.Tags)
+		w.upsert(other.MetricKey, samplers.GlobalOnly, other.Tags)
 	} else {
-		w.wm.Upsert(other.MetricKey, samplers.MixedScope, other.Tags)
+		w.upsert(other.MetricKey, samplers.MixedScope, other.Tags)
 	}
 
 	switch other.Type {
@@ -362,7 +564,7 @@ func (w *Worker) ImportMetricGRPC(other *metricpb.Metric) (err error) {
 		scope = samplers.GlobalOnly
 	}
 
-	w.wm.Upsert(key, scope, other.Tags)
+	w.upsert(key, scope, other.Tags)
 	w.imported++
 
 	switch v := other.GetValue().(type) {
@@ -409,10 +611,18 @@ func (w *Worker) Flush() WorkerMetrics {
 	ret := w.wm
 	processed := w.processed
 	imported := w.imported
+	filtered := w.filtered
+	overflowed := w.overflowed
 
 	w.wm = wm
 	w.processed = 0
 	w.imported = 0
+	w.filtered = map[int]int64{}
+	w.overflowed = 0
+	if w.cardinality != nil {
+		w.cardinality.reset()
+	}
+	cumulativeResets, cumulativeEvicted := w.cumulative.rotate()
 	w.mutex.Unlock()
 
 	// Track how much time each worker takes to flush.
@@ -424,6 +634,22 @@ func (w *Worker) Flush() WorkerMetrics {
 	)
 	w.stats.Count("worker.metrics_processed_total", processed, []string{}, 1.0)
 	w.stats.Count("worker.metrics_imported_total", imported, []string{}, 1.0)
+	for pattern, n := range filtered {
+		w.stats.Count("metrics_filtered_total", n, []string{patternTag(pattern)}, 1.0)
+	}
+	if overflowed > 0 {
+		action := cardinalityOverflowDrop
+		if w.cardinality.aggregate {
+			action = cardinalityOverflowAggregate
+		}
+		w.stats.Count("worker.cardinality_overflow_total", overflowed, []string{"action:" + action}, 1.0)
+	}
+	if cumulativeResets > 0 {
+		w.stats.Count("worker.cumulative_counter_resets_total", cumulativeResets, nil, 1.0)
+	}
+	if cumulativeEvicted > 0 {
+		w.stats.Count("worker.cumulative_counter_evictions_total", cumulativeEvicted, nil, 1.0)
+	}
 
 	return ret
 }
@@ -495,6 +721,36 @@ type SpanWorker struct {
 	traceClient     *trace.Client
 	statsd          *statsd.Client
 	capCount        int64
+
+	// scrubber scrubs the spans before any sink sees them, and
+	// scrubCounts counts the tags that each of its rules changed,
+	// by rule name.
+	scrubber    *spanScrubberValue
+	scrubCounts sync.Map // string -> *int64
+
+	// queueSizes and dispatchers configure the sinks' ingestion
+	// queues, by sink name; sinks that aren't in them get
+	// defaultSpanSinkQueueSize and one dispatcher.
+	queueSizes  map[string]int
+	dispatchers map[string]int
+	queues      []*spanSinkQueue
+	startQueues sync.Once
+	// pending is how many of the spans the worker took haven't been
+	// ingested (or dropped) by each sink yet.
+	pending int64
+}
+
+// defaultSpanSinkQueueSize is how many spans can wait for a span sink
+// to ingest them, unless span_sink_queue_sizes says otherwise.
+const defaultSpanSinkQueueSize = 1024
+
+// spanSinkQueue holds the spans that are waiting for a span sink to
+// ingest them, so that a slow sink only holds up itself: once its
+// queue is full, the spans for it are dropped.
+type spanSinkQueue struct {
+	sink    sinks.SpanSink
+	spans   chan *ssf.SSFSpan
+	dropped int64
 }
 
 // NewSpanWorker creates a SpanWorker ready to collect events and service checks.
@@ -520,9 +776,10 @@ func NewSpanWorker(sinks []sinks.SpanSink, cl *trace.Client, statsd *statsd.Clie
 // Work will start the SpanWorker listening for spans.
 // This function will never return.
 func (tw *SpanWorker) Work() {
-	const Timeout = 9 * time.Second
+	tw.startQueues.Do(tw.startSinkQueues)
 	capcmp := cap(tw.SpanChan) - 1
 	for m := range tw.SpanChan {
+		atomic.AddInt64(&tw.pending, int64(len(tw.queues)))
 		// If we are at or one below cap, increment the counter.
 		if len(tw.SpanChan) >= capcmp {
 			atomic.AddInt64(&tw.capCount, 1)
@@ -538,62 +795,96 @@ func (tw *SpanWorker) Work() {
 			}
 		}
 
-		var wg sync.WaitGroup
-		for i, s := range tw.sinks {
-			tags := tw.sinkTags[i]
-			wg.Add(1)
-			go func(i int, sink sinks.SpanSink, span *ssf.SSFSpan, wg *sync.WaitGroup) {
-				defer wg.Done()
-
-				done := make(chan struct{})
-				start := time.Now()
-
-				go func() {
-					// Give each sink a change to ingest.
-					err := sink.Ingest(span)
-					if err != nil {
-						if _, isNoTrace := err.(*protocol.InvalidTrace); !isNoTrace {
-							// If a sink goes wacko and errors a lot, we stand to emit a
-							// loooot of metrics towards all span workers here since
-							// span ingest rates can be very high. C'est la vie.
-							t := make([]string, 0, len(tags)+1)
-							for k, v := range tags {
-								t = append(t, k+":"+v)
-							}
-
-							t = append(t, "sink:"+sink.Name())
-							tw.statsd.Incr("worker.span.ingest_error_total", t, 1.0)
-						}
-					}
-					done <- struct{}{}
-				}()
-
-				select {
-				case _ = <-done:
-				case <-time.After(Timeout):
-					log.WithFields(logrus.Fields{
-						"sink":  sink.Name(),
-						"index": i,
-					}).Error("Timed out on sink ingestion")
-
-					t := make([]string, 0, len(tags)+1)
-					for k, v := range tags {
-						t = append(t, k+":"+v)
-					}
-
-					t = append(t, "sink:"+sink.Name())
-					tw.statsd.Incr("worker.span.ingest_timeout_total", t, 1.0)
-				}
-				atomic.AddInt64(&tw.cumulativeTimes[i], int64(time.Since(start)/time.Nanosecond))
-			}(i, s, m, &wg)
-		}
-		wg.Wait()
+		if sc := tw.scrubber.load(); sc != nil {
+			m = sc.scrub(m, tw.countScrubbed)
+		}
+
+		// The sinks share the span, as they must not mutate it.
+		for _, q := range tw.queues {
+			select {
+			case q.spans <- m:
+			default:
+				atomic.AddInt64(&q.dropped, 1)
+				atomic.AddInt64(&tw.pending, -1)
+			}
+		}
+	}
+}
+
+// startSinkQueues makes the sinks' queues and starts their
+// dispatchers.
+func (tw *SpanWorker) startSinkQueues() {
+	tw.queues = make([]*spanSinkQueue, len(tw.sinks))
+	for i, sink := range tw.sinks {
+		size, ok := tw.queueSizes[sink.Name()]
+		if !ok || size < 0 {
+			size = defaultSpanSinkQueueSize
+		}
+		q := &spanSinkQueue{sink: sink, spans: make(chan *ssf.SSFSpan, size)}
+		tw.queues[i] = q
+
+		dispatchers := tw.dispatchers[sink.Name()]
+		if dispatchers <= 0 {
+			dispatchers = 1
+		}
+		for j := 0; j < dispatchers; j++ {
+			go tw.dispatch(i, q)
+		}
+	}
+}
+
+// dispatch has the ith sink ingest the spans in its queue.
+func (tw *SpanWorker) dispatch(i int, q *spanSinkQueue) {
+	const Timeout = 9 * time.Second
+	sink := q.sink
+	tags := make([]string, 0, len(tw.sinkTags[i]))
+	for k, v := range tw.sinkTags[i] {
+		tags = append(tags, k+":"+v)
+	}
+	for span := range q.spans {
+		start := time.Now()
+		err := sink.Ingest(span)
+		if err != nil {
+			if _, isNoTrace := err.(*protocol.InvalidTrace); !isNoTrace {
+				// If a sink goes wacko and errors a lot, we stand to emit a
+				// loooot of metrics towards all span workers here since
+				// span ingest rates can be very high. C'est la vie.
+				tw.statsd.Incr("worker.span.ingest_error_total", tags, 1.0)
+			}
+		}
+		took := time.Since(start)
+		if took > Timeout {
+			log.WithFields(logrus.Fields{
+				"sink":     sink.Name(),
+				"index":    i,
+				"duration": took,
+			}).Error("Sink ingestion took too long")
+			tw.statsd.Incr("worker.span.ingest_timeout_total", tags, 1.0)
+		}
+		atomic.AddInt64(&tw.cumulativeTimes[i], int64(took/time.Nanosecond))
+		atomic.AddInt64(&tw.pending, -1)
+	}
+}
+
+// idle reports whether the sinks ingested all the spans that the
+// worker took.
+func (tw *SpanWorker) idle() bool {
+	return atomic.LoadInt64(&tw.pending) == 0
+}
+
+// countScrubbed counts the tags that a scrub rule changed.
+func (tw *SpanWorker) countScrubbed(rule string, n int) {
+	count, ok := tw.scrubCounts.Load(rule)
+	if !ok {
+		count, _ = tw.scrubCounts.LoadOrStore(rule, new(int64))
 	}
+	atomic.AddInt64(count.(*int64), int64(n))
 }
 
 // Flush invokes flush on each sink.
 func (tw *SpanWorker) Flush() {
 	samples := &ssf.Samples{}
+	tw.startQueues.Do(tw.startSinkQueues)
 
 	// Flush and time each sink.
 	for i, s := range tw.sinks {
@@ -608,8 +899,18 @@ func (tw *SpanWorker) Flush() {
 		// cumulative time is measured in nanoseconds
 		cumulative := time.Duration(atomic.SwapInt64(&tw.cumulativeTimes[i], 0)) * time.Nanosecond
 		tw.statsd.Timing(sinks.MetricKeySpanIngestDuration, cumulative, tags, 1.0)
+
+		q := tw.queues[i]
+		tw.statsd.Count("worker.span.sink_queue_dropped_total", atomic.SwapInt64(&q.dropped, 0), tags, 1.0)
+		tw.statsd.Gauge("worker.span.sink_queue_length", float64(len(q.spans)), tags, 1.0)
 	}
 
 	metrics.Report(tw.traceClient, samples)
 	tw.statsd.Count("worker.span.hit_chan_cap", atomic.SwapInt64(&tw.capCount, 0), nil, 1.0)
+	tw.scrubCounts.Range(func(rule, count interface{}) bool {
+		if n := atomic.SwapInt64(count.(*int64), 0); n > 0 {
+			tw.statsd.Count("worker.span.scrubbed_tags_total", n, []string{"rule:" + rule.(string)}, 1.0)
+		}
+		return true
+	})
 }
@@ -0,0 +1,366 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/fasthash/fnv1a"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/samplers/metricpb"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// workerSlots is how many slots the digests of metrics are hashed into
+// when the worker pool scales. Each slot belongs to a worker, so adding
+// or retiring a worker only moves the metrics in the slots it gains or
+// loses, instead of rehashing all of them.
+const workerSlots = 4096
+
+// workerScalingSamples is how many times each interval the workers'
+// queues are sampled.
+const workerScalingSamples = 10
+
+const (
+	defaultWorkerScalingQueueDepth    = 0.5
+	defaultWorkerScalingIdleIntervals = 6
+)
+
+// workerRoutes assigns the slots to workers. It's never changed once
+// it's in use, only replaced.
+type workerRoutes struct {
+	slots   []uint16
+	workers []*Worker
+}
+
+func (r *workerRoutes) worker(digest uint32) *Worker {
+	return r.workers[r.slots[digest%uint32(len(r.slots))]]
+}
+
+// assignSlots returns the slots spread evenly across n workers. The
+// slots that stay with the worker they were assigned to in slots do, so
+// that growing the pool from n-1 workers only moves about 1/n of them,
+// and retiring the last worker only moves its own.
+func assignSlots(slots []uint16, n int) []uint16 {
+	target := func(w int) int {
+		if w < workerSlots%n {
+			return workerSlots/n + 1
+		}
+		return workerSlots / n
+	}
+	ret := make([]uint16, workerSlots)
+	counts := make([]int, n)
+	var free []int
+	for i := range ret {
+		if slots == nil || int(slots[i]) >= n || counts[slots[i]] >= target(int(slots[i])) {
+			free = append(free, i)
+			continue
+		}
+		ret[i] = slots[i]
+		counts[slots[i]]++
+	}
+	for w := range counts {
+		for ; counts[w] < target(w); counts[w]++ {
+			ret[free[0]] = uint16(w)
+			free = free[1:]
+		}
+	}
+	return ret
+}
+
+// workerScaler sizes the pool of metric workers between a minimum and a
+// maximum by how full their queues are: when the workers' queues are on
+// average more than queueDepth full over an interval, it adds workers,
+// and when they've been empty for idleIntervals intervals in a row, it
+// retires one.
+//
+// The pool only changes when the workers are flushed, so that a metric
+// is only aggregated by one worker in an interval. While it changes,
+// no metrics are routed: the workers' queues are drained, so that the
+// metrics routed before the change are aggregated by the slots' old
+// workers in the interval being flushed, and routing resumes once the
+// workers are flushed. Retired workers have nothing left to aggregate
+// after that, so they're stopped.
+type workerScaler struct {
+	routes atomic.Value // *workerRoutes
+	// routing is held for reading while a metric is routed and queued,
+	// and for writing from a resize until the flush is done with the
+	// workers
+	routing sync.RWMutex
+	resized bool
+
+	min, max      int
+	queueDepth    float64
+	idleIntervals int
+	newWorker     func(id int) (*Worker, error)
+
+	// depth is the sum of the sampled fullness of the queues
+	depthMtx sync.Mutex
+	depth    float64
+	samples  int
+
+	// these are only used by the flushing goroutine:
+	idle     int
+	nextID   int
+	retiring []*Worker
+}
+
+// newWorkerScaler makes a scaler for a pool that starts with workers,
+// which are also its minimum size. newWorker makes and starts the
+// worker with the given ID. It returns nil if max is 0, for a pool that
+// doesn't scale.
+func newWorkerScaler(workers []*Worker, max int, queueDepth float64, idleIntervals int, newWorker func(id int) (*Worker, error)) (*workerScaler, error) {
+	if max == 0 {
+		return nil, nil
+	}
+	if max < len(workers) || max > workerSlots {
+		return nil, fmt.Errorf("worker_scaling_max_workers must be between num_workers (%d) and %d", len(workers), workerSlots)
+	}
+	if queueDepth == 0 {
+		queueDepth = defaultWorkerScalingQueueDepth
+	}
+	if queueDepth < 0 || queueDepth > 1 {
+		return nil, fmt.Errorf("worker_scaling_queue_depth must be between 0 and 1, not %f", queueDepth)
+	}
+	if idleIntervals == 0 {
+		idleIntervals = defaultWorkerScalingIdleIntervals
+	}
+	ws := &workerScaler{
+		min:           len(workers),
+		max:           max,
+		queueDepth:    queueDepth,
+		idleIntervals: idleIntervals,
+		newWorker:     newWorker,
+		nextID:        len(workers) + 1,
+	}
+	ws.routes.Store(&workerRoutes{
+		slots:   assignSlots(nil, len(workers)),
+		workers: workers,
+	})
+	return ws, nil
+}
+
+func (ws *workerScaler) load() *workerRoutes {
+	return ws.routes.Load().(*workerRoutes)
+}
+
+// worker returns the worker for metrics with the digest.
+func (ws *workerScaler) worker(digest uint32) *Worker {
+	return ws.load().worker(digest)
+}
+
+// IngestUDP sends the metric to its worker, so that the scaler can be
+// used as the metric extraction sink's only processor.
+func (ws *workerScaler) IngestUDP(metric samplers.UDPMetric) {
+	ws.routing.RLock()
+	defer ws.routing.RUnlock()
+	ws.worker(metric.Digest).IngestUDP(metric)
+}
+
+// IngestMetrics sends each metric to its worker, so that the scaler can
+// be used as the gRPC import server's only ingester. The metrics are
+// hashed in the same way as statsd packets are.
+func (ws *workerScaler) IngestMetrics(ms []*metricpb.Metric) {
+	ws.routing.RLock()
+	defer ws.routing.RUnlock()
+	routes := ws.load()
+	batches := map[*Worker][]*metricpb.Metric{}
+	for _, m := range ms {
+		key := samplers.NewMetricKeyFromMetric(m)
+		w := routes.worker(digestMetricKey(key.Name, key.Type, key.JoinedTags))
+		batches[w] = append(batches[w], m)
+	}
+	for w, batch := range batches {
+		w.IngestMetrics(batch)
+	}
+}
+
+// importJSON sends each metric to its worker's import channel.
+func (ws *workerScaler) importJSON(jms []samplers.JSONMetric) {
+	ws.routing.RLock()
+	defer ws.routing.RUnlock()
+	routes := ws.load()
+	batches := map[*Worker][]samplers.JSONMetric{}
+	for _, jm := range jms {
+		w := routes.worker(digestMetricKey(jm.Name, jm.Type, jm.JoinedTags))
+		batches[w] = append(batches[w], jm)
+	}
+	for w, batch := range batches {
+		w.ImportChan <- batch
+	}
+}
+
+// digestMetricKey hashes a metric like samplers.ParseMetrics does.
+func digestMetricKey(name, typ, joinedTags string) uint32 {
+	h := fnv1a.Init32
+	h = fnv1a.AddString32(h, name)
+	h = fnv1a.AddString32(h, typ)
+	h = fnv1a.AddString32(h, joinedTags)
+	return h
+}
+
+// sample adds how full the workers' queues are, on average, to the
+// interval's samples.
+func (ws *workerScaler) sample() {
+	workers := ws.load().workers
+	depth := 0.0
+	for _, w := range workers {
+		depth += queueFullness(w)
+	}
+	ws.depthMtx.Lock()
+	ws.depth += depth / float64(len(workers))
+	ws.samples++
+	ws.depthMtx.Unlock()
+}
+
+// queueFullness is the fraction of the fullest of the worker's queues
+// that's in use.
+func queueFullness(w *Worker) float64 {
+	full := 0.0
+	for _, q := range []struct{ len, cap int }{
+		{len(w.PacketChan), cap(w.PacketChan)},
+		{len(w.ImportChan), cap(w.ImportChan)},
+		{len(w.ImportMetricChan), cap(w.ImportMetricChan)},
+	} {
+		if f := float64(q.len) / float64(q.cap); f > full {
+			full = f
+		}
+	}
+	return full
+}
+
+// scale resizes the pool if the interval's samples call for it, and
+// returns the workers to flush: the pool, and the workers retired in
+// this flush. Once they're flushed, flushed must be called to resume
+// routing and stop the retired workers.
+func (ws *workerScaler) scale(ctx context.Context, cl *trace.Client) []*Worker {
+	ws.depthMtx.Lock()
+	depth, samples := ws.depth, ws.samples
+	ws.depth, ws.samples = 0, 0
+	ws.depthMtx.Unlock()
+
+	routes := ws.load()
+	n := len(routes.workers)
+	size := n
+	switch {
+	case samples == 0:
+	case depth/float64(samples) >= ws.queueDepth:
+		ws.idle = 0
+		// grow by a quarter at a time, so that a large pool catches up
+		// with a burst in fewer intervals
+		grow := n / 4
+		if grow < 1 {
+			grow = 1
+		}
+		if size = n + grow; size > ws.max {
+			size = ws.max
+		}
+	case depth == 0:
+		if ws.idle++; ws.idle >= ws.idleIntervals && n > ws.min {
+			ws.idle = 0
+			size = n - 1
+		}
+	default:
+		ws.idle = 0
+	}
+	if size != n {
+		ws.resize(ctx, routes, size, cl)
+	}
+
+	workers := ws.load().workers
+	metrics.ReportOne(cl, ssf.Gauge("worker.pool_size", float32(len(workers)), nil))
+
+	return append(append([]*Worker{}, workers...), ws.retiring...)
+}
+
+func (ws *workerScaler) resize(ctx context.Context, routes *workerRoutes, size int, cl *trace.Client) {
+	n := len(routes.workers)
+	var workers []*Worker
+	var retiring []*Worker
+	if size > n {
+		workers = append(workers, routes.workers...)
+		for len(workers) < size {
+			w, err := ws.newWorker(ws.nextID)
+			if err != nil {
+				log.WithError(err).Error("Couldn't add a metric worker")
+				break
+			}
+			ws.nextID++
+			workers = append(workers, w)
+		}
+		if len(workers) == n {
+			return
+		}
+	} else {
+		workers = append(workers, routes.workers[:size]...)
+		retiring = routes.workers[size:]
+	}
+
+	slots := assignSlots(routes.slots, len(workers))
+	moved := 0
+	for i := range slots {
+		if slots[i] != routes.slots[i] {
+			moved++
+		}
+	}
+
+	ws.routing.Lock()
+	ws.resized = true
+	for _, w := range routes.workers {
+		if err := w.drain(ctx); err != nil {
+			log.WithError(err).WithField("worker", w.id).
+				Warn("Couldn't drain a metric worker before moving its slots")
+		}
+	}
+	ws.routes.Store(&workerRoutes{slots: slots, workers: workers})
+	ws.retiring = retiring
+
+	direction := "grow"
+	if len(workers) < n {
+		direction = "shrink"
+	}
+	log.WithFields(logrus.Fields{
+		"from":  n,
+		"to":    len(workers),
+		"moved": moved,
+	}).Info("Resized the metric worker pool")
+	tags := map[string]string{"direction": direction}
+	metrics.ReportBatch(cl, []*ssf.SSFSample{
+		ssf.Count("worker.rebalance_total", 1, tags),
+		ssf.Count("worker.rebalance_slots_moved_total", float32(moved), tags),
+	})
+}
+
+// flushed resumes routing after a resize, once the workers returned by
+// scale have been flushed, and stops the retired workers, which have no
+// metrics left.
+func (ws *workerScaler) flushed() {
+	for _, w := range ws.retiring {
+		close(w.QuitChan)
+	}
+	ws.retiring = nil
+	if ws.resized {
+		ws.resized = false
+		ws.routing.Unlock()
+	}
+}
+
+// sampleWorkerQueues samples the workers' queues workerScalingSamples
+// times per interval, until the server shuts down.
+func (s *Server) sampleWorkerQueues() {
+	ticker := time.NewTicker(s.interval / workerScalingSamples)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.workerScaler.sample()
+		}
+	}
+}
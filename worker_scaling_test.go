@@ -0,0 +1,255 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func slotCounts(slots []uint16, n int) []int {
+	counts := make([]int, n)
+	for _, w := range slots {
+		counts[w]++
+	}
+	return counts
+}
+
+func movedSlots(from, to []uint16) int {
+	moved := 0
+	for i := range from {
+		if from[i] != to[i] {
+			moved++
+		}
+	}
+	return moved
+}
+
+func TestAssignSlots(t *testing.T) {
+	slots := assignSlots(nil, 3)
+	assert.Equal(t, []int{1366, 1365, 1365}, slotCounts(slots, 3))
+
+	grown := assignSlots(slots, 4)
+	assert.Equal(t, []int{1024, 1024, 1024, 1024}, slotCounts(grown, 4))
+	assert.Equal(t, 1024, movedSlots(slots, grown),
+		"only the new worker's slots should move")
+
+	shrunk := assignSlots(grown, 3)
+	assert.Equal(t, []int{1366, 1365, 1365}, slotCounts(shrunk, 3))
+	assert.Equal(t, 1024, movedSlots(grown, shrunk),
+		"only the retired worker's slots should move")
+}
+
+func startTestWorker(id int) *Worker {
+	w := NewWorker(id, nil, nullLogger(), nil)
+	go w.Work()
+	return w
+}
+
+func TestWorkerScaler(t *testing.T) {
+	workers := []*Worker{startTestWorker(1), startTestWorker(2)}
+	newWorker := func(id int) (*Worker, error) {
+		return startTestWorker(id), nil
+	}
+	ws, err := newWorkerScaler(workers, 3, 0.5, 2, newWorker)
+	require.NoError(t, err)
+	defer func() {
+		for _, w := range ws.load().workers {
+			close(w.QuitChan)
+		}
+	}()
+	full := func() {
+		ws.sample()
+		ws.depth = float64(ws.samples)
+	}
+	ctx := context.Background()
+
+	digests := make([]uint32, 1000)
+	owners := make([]*Worker, len(digests))
+	for i := range digests {
+		digests[i] = digestMetricKey("a.b.c", "counter", string(rune('a'+i%26))+string(rune(i)))
+		owners[i] = ws.worker(digests[i])
+	}
+
+	assert.Len(t, ws.scale(ctx, nil), 2, "with no samples, the pool shouldn't change")
+	ws.flushed()
+
+	full()
+	assert.Len(t, ws.scale(ctx, nil), 3)
+	assert.Len(t, ws.load().workers, 3)
+	moved := 0
+	for i, digest := range digests {
+		if w := ws.worker(digest); w != owners[i] {
+			assert.Equal(t, 3, w.id, "metrics should only move to the new worker")
+			moved++
+		}
+	}
+	assert.InDelta(t, len(digests)/3, moved, float64(len(digests))/10)
+	ws.flushed()
+
+	full()
+	assert.Len(t, ws.scale(ctx, nil), 3, "the pool shouldn't grow past its maximum")
+	ws.flushed()
+
+	ws.sample()
+	assert.Len(t, ws.scale(ctx, nil), 3)
+	ws.flushed()
+	ws.sample()
+	flushing := ws.scale(ctx, nil)
+	assert.Len(t, ws.load().workers, 2, "the pool should shrink after being idle")
+	assert.Len(t, flushing, 3, "the retired worker should still be flushed")
+	retired := flushing[2]
+	for i, digest := range digests {
+		assert.Equal(t, owners[i], ws.worker(digest),
+			"metrics should move back to where they were")
+	}
+	ws.flushed()
+	select {
+	case <-retired.QuitChan:
+	default:
+		t.Error("the retired worker should have been stopped")
+	}
+	assert.Len(t, ws.scale(ctx, nil), 2)
+	ws.flushed()
+
+	ws.sample()
+	ws.sample()
+	ws.scale(ctx, nil)
+	ws.flushed()
+	assert.Len(t, ws.load().workers, 2, "the pool shouldn't shrink past its minimum")
+}
+
+func TestWorkerScalerMovesDrainedSlots(t *testing.T) {
+	workers := []*Worker{startTestWorker(1), startTestWorker(2)}
+	ws, err := newWorkerScaler(workers, 3, 0.5, 2, func(id int) (*Worker, error) {
+		return startTestWorker(id), nil
+	})
+	require.NoError(t, err)
+	defer func() {
+		for _, w := range ws.load().workers {
+			close(w.QuitChan)
+		}
+	}()
+
+	// find a metric whose slot moves to the worker that's added
+	next := &workerRoutes{slots: assignSlots(ws.load().slots, 3), workers: append(workers, nil)}
+	metric := samplers.UDPMetric{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "counter"}, Value: 1.0, SampleRate: 1.0}
+	for i := 0; next.worker(metric.Digest) != nil; i++ {
+		metric.JoinedTags = fmt.Sprintf("tag:%d", i)
+		metric.Digest = digestMetricKey(metric.Name, metric.Type, metric.JoinedTags)
+	}
+	owner := ws.worker(metric.Digest)
+
+	// the owner is still working on the metric when the pool grows:
+	owner.mutex.Lock()
+	ws.IngestUDP(metric)
+	ws.sample()
+	ws.depth = 1
+	scaled := make(chan []*Worker)
+	go func() {
+		scaled <- ws.scale(context.Background(), nil)
+	}()
+	select {
+	case <-scaled:
+		t.Fatal("the slot shouldn't move before its queued metrics are aggregated")
+	case <-time.After(20 * time.Millisecond):
+	}
+	owner.mutex.Unlock()
+	assert.Len(t, <-scaled, 3)
+	assert.Equal(t, int64(1), owner.MetricsProcessedCount(),
+		"the metric should be aggregated by the slot's old worker")
+	added := ws.worker(metric.Digest)
+	require.NotEqual(t, owner, added)
+
+	ingested := make(chan struct{})
+	go func() {
+		ws.IngestUDP(metric)
+		close(ingested)
+	}()
+	select {
+	case <-ingested:
+		t.Fatal("metrics shouldn't be routed until the workers are flushed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	ws.flushed()
+	<-ingested
+	for added.MetricsProcessedCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(1), owner.MetricsProcessedCount())
+}
+
+func TestServerFlushWorkerScaling(t *testing.T) {
+	config := globalConfig()
+	config.NumWorkers = 2
+	config.WorkerScalingMaxWorkers = 3
+	// so that the server neither flushes nor samples the queues itself
+	config.Interval = "1h"
+
+	metricsChan := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(metricsChan)
+	defer close(metricsChan)
+
+	s := setupVeneurServer(t, config, nil, cms, nil)
+	defer s.Shutdown()
+	require.NotNil(t, s.workerScaler)
+
+	// the queues were full all interval:
+	s.workerScaler.depth, s.workerScaler.samples = 1, 1
+	s.Flush(context.TODO())
+	assert.Len(t, s.Workers, 3)
+
+	packets := []string{"a.b.c:1|c", "a.b.c:2|c", "d.e.f:1|c|#foo:bar", "g.h.i:3|g"}
+	for _, packet := range packets {
+		require.NoError(t, s.HandleMetricPacket([]byte(packet)))
+	}
+	processed := func() int64 {
+		total := int64(0)
+		for _, w := range s.Workers {
+			total += w.MetricsProcessedCount()
+		}
+		return total
+	}
+	for processed() < int64(len(packets)) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Flush(context.TODO())
+	values := map[string]float64{}
+	for _, m := range <-metricsChan {
+		values[m.Name] = m.Value
+	}
+	assert.Equal(t, map[string]float64{"a.b.c": 3, "d.e.f": 1, "g.h.i": 3}, values)
+}
+
+func TestHandleDebugSamplersWhileScaling(t *testing.T) {
+	config := globalConfig()
+	config.NumWorkers = 2
+	config.WorkerScalingMaxWorkers = 3
+	config.Interval = "1h"
+	s := setupVeneurServer(t, config, nil, nil, nil)
+	defer s.Shutdown()
+	require.NotNil(t, s.workerScaler)
+
+	// the flushes reassign s.Workers, which the handler mustn't read
+	// (go test -race catches it if it does)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			s.workerScaler.depth, s.workerScaler.samples = float64(i%2), 1
+			s.Flush(context.TODO())
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		s.handleDebugSamplers(rec, httptest.NewRequest(http.MethodGet, "/debug/samplers", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	<-done
+}
@@ -2,8 +2,14 @@ package veneur
 
 import (
 	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,6 +45,32 @@ func TestWorker(t *testing.T) {
 	assert.Len(t, nometrics.counters, 0, "Should flush no metrics")
 }
 
+func TestWorkerTimestamped(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+
+	for _, packet := range []string{
+		"a.b.c:1|c|T1656581400",
+		"a.b.c:2|c|@0.5|T1656581410",
+		"a.b.c:3|c",
+		"d.e.f:4|g|#foo:bar|T1656581400",
+		"a.b.c:5|h|T1656581400",
+	} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		w.ProcessMetric(m)
+	}
+
+	wm := w.Flush()
+	assert.Len(t, wm.counters, 1, "only the counter without a timestamp should be aggregated")
+	assert.Len(t, wm.gauges, 0)
+	assert.Len(t, wm.histograms, 1, "histograms are aggregated even with a timestamp")
+	assert.Equal(t, []samplers.InterMetric{
+		{Name: "a.b.c", Timestamp: 1656581400, Value: 1, Tags: []string{}, Type: samplers.CounterMetric},
+		{Name: "a.b.c", Timestamp: 1656581410, Value: 4, Tags: []string{}, Type: samplers.CounterMetric},
+		{Name: "d.e.f", Timestamp: 1656581400, Value: 4, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+	}, wm.timestamped)
+}
+
 func TestWorkerLocal(t *testing.T) {
 	w := NewWorker(1, nil, logrus.New(), nil)
 
@@ -92,6 +124,73 @@ func TestWorkerGlobal(t *testing.T) {
 	assert.Equal(t, 0, len(w.wm.counters), "should have no local counters")
 }
 
+func TestWorkerExemplars(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	m, err := samplers.ParseMetric([]byte("a.b.c:1|ms"))
+	require.NoError(t, err)
+	m.TraceID = 7
+	w.ProcessMetric(m)
+	for _, h := range w.Flush().timers {
+		assert.Empty(t, h.Exemplars, "exemplars should be off by default")
+	}
+
+	w.exemplars = 2
+	for i, packet := range []string{"a.b.c:1|ms", "a.b.c:2|ms", "a.b.c:3|ms", "a.b.c:4|ms|#veneurlocalonly"} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		m.TraceID = int64(i)
+		w.ProcessMetric(m)
+	}
+	wm := w.Flush()
+	require.Len(t, wm.timers, 1)
+	for _, h := range wm.timers {
+		assert.Len(t, h.Exemplars, 2, "samples without trace IDs shouldn't be exemplars")
+		for _, e := range h.Exemplars {
+			assert.NotZero(t, e.TraceID)
+			assert.Equal(t, float64(e.TraceID+1), e.Value)
+			assert.NotZero(t, e.Timestamp)
+		}
+	}
+	for _, h := range wm.localTimers {
+		assert.Equal(t, []samplers.Exemplar{{TraceID: 3, Value: 4, Timestamp: h.Exemplars[0].Timestamp}}, h.Exemplars)
+	}
+}
+
+func TestWorkerGaugeAggregations(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	w.gaugeAggregations = map[string]samplers.GaugeAggregation{
+		"in_flight": samplers.GaugeMax,
+		"tagged":    samplers.GaugeMax,
+	}
+	for _, packet := range []string{
+		"in_flight:3|g", "in_flight:7|g", "in_flight:2|g",
+		"tagged:3|g|#veneur_gauge_agg:sum", "tagged:4|g|#veneur_gauge_agg:sum",
+		"other:3|g", "other:1|g",
+	} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		require.NoError(t, err)
+		w.ProcessMetric(m)
+	}
+
+	values := map[string]float64{}
+	for _, g := range w.Flush().gauges {
+		values[g.Name] = g.Flush()[0].Value
+	}
+	assert.Equal(t, map[string]float64{"in_flight": 7, "tagged": 7, "other": 1}, values)
+
+	// global gauges are merged with the same aggregation:
+	for _, v := range []float64{2, 9, 4} {
+		w.ImportMetricGRPC(&metricpb.Metric{
+			Name:  "in_flight",
+			Type:  metricpb.Type_Gauge,
+			Value: &metricpb.Metric_Gauge{Gauge: &metricpb.GaugeValue{Value: v}},
+		})
+	}
+	for _, g := range w.Flush().globalGauges {
+		assert.Equal(t, float64(9), g.Flush()[0].Value)
+	}
+}
+
 func TestWorkerImportSet(t *testing.T) {
 	w := NewWorker(1, nil, logrus.New(), nil)
 	testset := samplers.NewSet("a.b.c", nil)
@@ -444,3 +543,123 @@ func TestWorkerMetricsForwardableMetrics(t *testing.T) {
 		})
 	}
 }
+
+// blockingSpanSink doesn't return from Ingest until it's released.
+type blockingSpanSink struct {
+	release chan struct{}
+	ingests chan *ssf.SSFSpan
+}
+
+func (s *blockingSpanSink) Start(*trace.Client) error { return nil }
+func (s *blockingSpanSink) Name() string              { return "blocking" }
+func (s *blockingSpanSink) Flush()                    {}
+func (s *blockingSpanSink) Ingest(span *ssf.SSFSpan) error {
+	s.ingests <- span
+	<-s.release
+	return nil
+}
+
+func TestSpanWorkerSlowSink(t *testing.T) {
+	cl, clch := newTestClient(t, 1)
+	go func() {
+		for range clch {
+		}
+	}()
+
+	slow := &blockingSpanSink{release: make(chan struct{}), ingests: make(chan *ssf.SSFSpan, 10)}
+	fast := &fakeSpanSink{wg: &sync.WaitGroup{}}
+	spanChan := make(chan *ssf.SSFSpan)
+	worker := NewSpanWorker([]sinks.SpanSink{slow, fast}, cl, nil, spanChan, nil)
+	worker.queueSizes = map[string]int{"blocking": 1}
+	go worker.Work()
+
+	// The slow sink ingests the first span, and has room in its
+	// queue for one more; the fast sink gets all of them anyway:
+	for i := int64(1); i <= 5; i++ {
+		fast.wg.Add(1)
+		spanChan <- &ssf.SSFSpan{Id: i, TraceId: 1, Name: "checkout"}
+		fast.wg.Wait()
+		if i == 1 {
+			<-slow.ingests
+		}
+	}
+	assert.Len(t, fast.spans, 5)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&worker.queues[0].dropped))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&worker.queues[1].dropped))
+
+	close(slow.release)
+	assert.Equal(t, int64(2), (<-slow.ingests).Id)
+}
+
+// TestSpanSinksDontMutateSpans checks that no span sink's Ingest
+// assigns to the span it's given, which is shared with the other
+// sinks.
+func TestSpanSinksDontMutateSpans(t *testing.T) {
+	fset := token.NewFileSet()
+	var files []string
+	err := filepath.Walk("sinks", func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".go") && !strings.HasSuffix(path, "_test.go") {
+			files = append(files, path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+
+	// root returns the variable that an expression like
+	// span.Tags["key"] is part of.
+	var root func(ast.Expr) *ast.Ident
+	root = func(expr ast.Expr) *ast.Ident {
+		switch e := expr.(type) {
+		case *ast.SelectorExpr:
+			return root(e.X)
+		case *ast.IndexExpr:
+			return root(e.X)
+		case *ast.StarExpr:
+			return root(e.X)
+		case *ast.ParenExpr:
+			return root(e.X)
+		case *ast.Ident:
+			return e
+		}
+		return nil
+	}
+
+	ingests := 0
+	for _, path := range files {
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		require.NoError(t, err)
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || fn.Name.Name != "Ingest" || fn.Body == nil {
+				continue
+			}
+			params := fn.Type.Params.List
+			if len(params) != 1 || len(params[0].Names) != 1 {
+				continue
+			}
+			ingests++
+			span := params[0].Names[0].Name
+			mutates := func(expr ast.Expr) bool {
+				_, isIdent := expr.(*ast.Ident)
+				id := root(expr)
+				return !isIdent && id != nil && id.Name == span
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				switch s := n.(type) {
+				case *ast.AssignStmt:
+					for _, lhs := range s.Lhs {
+						assert.False(t, mutates(lhs), "%s mutates the span", fset.Position(lhs.Pos()))
+					}
+				case *ast.IncDecStmt:
+					assert.False(t, mutates(s.X), "%s mutates the span", fset.Position(s.Pos()))
+				case *ast.CallExpr:
+					if id, ok := s.Fun.(*ast.Ident); ok && id.Name == "delete" && len(s.Args) > 0 {
+						assert.False(t, mutates(s.Args[0]), "%s mutates the span", fset.Position(s.Pos()))
+					}
+				}
+				return true
+			})
+		}
+	}
+	assert.NotZero(t, ingests, "no span sinks were found")
+}